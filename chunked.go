@@ -47,7 +47,14 @@ func (cw *chunkedWriter) Write(data []byte) (n int, err error) {
 		err = io.ErrShortWrite
 		return n, err
 	}
-	_, err = io.WriteString(cw.Wire, "\r\n")
+	if _, err = io.WriteString(cw.Wire, "\r\n"); err != nil {
+		return n, err
+	}
+	// Send the chunk right away when Wire buffers the data, the responses
+	// may be streamed.
+	if f, ok := cw.Wire.(interface{ Flush() error }); ok {
+		err = f.Flush()
+	}
 	return n, err
 }
 
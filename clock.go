@@ -0,0 +1,74 @@
+package goproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the time-dependent features, such as the caches,
+// the rate limiters and the validity of the MITM certificates, so that the
+// tests control it with a FakeClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the clock of the system.
+var SystemClock Clock = systemClock{}
+
+// FakeClock is a Clock set and advanced by the tests. It is safe for
+// concurrent use.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock telling now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the clock to now.
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+type skewedClock struct {
+	clock Clock
+	skew  time.Duration
+}
+
+func (c skewedClock) Now() time.Time { return c.clock.Now().Add(c.skew) }
+
+// SkewClock returns a Clock telling the time of clock shifted by skew,
+// for example for the certificates of the devices whose clock is late.
+func SkewClock(clock Clock, skew time.Duration) Clock {
+	return skewedClock{clock: clock, skew: skew}
+}
+
+// certNow returns the time of the validity of the MITM certificates.
+func (proxy *ProxyHttpServer) certNow() time.Time {
+	if proxy.CertClock != nil {
+		return proxy.CertClock.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/mitmca"
+)
+
+func genCA(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("goproxy gen-ca", flag.ContinueOnError)
+	certPath := fs.String("cert", "ca.pem", "PEM `file` of the certificate written")
+	keyPath := fs.String("key", "ca-key.pem", "PEM `file` of the key written")
+	cn := fs.String("cn", "goproxy MITM CA", "common `name` of the CA")
+	org := fs.String("org", "", "`organization` of the CA")
+	days := fs.Int("days", 3650, "validity of the CA, in `days`")
+	keyType := fs.String("key-type", "ecdsa", "`type` of the key: ecdsa, rsa or ed25519")
+	pathLen := fs.Int("path-len", 0, "`number` of intermediate CAs allowed below the CA, unlimited if negative")
+	var permit, exclude listFlag
+	fs.Var(&permit, "permit", "`domains` or CIDR ranges to which the CA is limited, repeated or separated by commas")
+	fs.Var(&exclude, "exclude", "`domains` or CIDR ranges excluded from the CA")
+	force := fs.Bool("force", false, "overwrite the existing files")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if !*force {
+		for _, path := range []string{*certPath, *keyPath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s exists, use -force to overwrite it", path)
+			}
+		}
+	}
+
+	opts := mitmca.Options{
+		CommonName:   *cn,
+		Organization: *org,
+		Validity:     time.Duration(*days) * 24 * time.Hour,
+		KeyType:      mitmca.KeyType(*keyType),
+		MaxPathLen:   *pathLen,
+	}
+	var err error
+	if opts.PermittedDNSDomains, opts.PermittedIPRanges, err = mitmca.ParseConstraints(permit); err != nil {
+		return err
+	}
+	if opts.ExcludedDNSDomains, opts.ExcludedIPRanges, err = mitmca.ParseConstraints(exclude); err != nil {
+		return err
+	}
+	ca, err := mitmca.Generate(opts)
+	if err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := mitmca.EncodePEM(ca)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*keyPath, keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*certPath, certPEM, 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "wrote %s and %s\n", *certPath, *keyPath)
+	printFingerprints(stdout, ca.Leaf)
+	return nil
+}
+
+// readCA reads the first certificate of the PEM file path.
+func readCA(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := mitmca.ParsePEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return certs[0], nil
+}
+
+func export(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("goproxy export", flag.ContinueOnError)
+	format := fs.String("format", "pem", "`format` of the export: pem, der or mobileconfig")
+	out := fs.String("o", "", "`file` written, the standard output by default")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goproxy export [flags] ca.pem")
+		fs.PrintDefaults()
+	}
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	cert, err := readCA(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := mitmca.Export(&buf, cert, mitmca.Format(*format)); err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(*out, buf.Bytes(), 0o644)
+}
+
+func fingerprint(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("goproxy fingerprint", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goproxy fingerprint ca.pem")
+		fs.PrintDefaults()
+	}
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	cert, err := readCA(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	printFingerprints(stdout, cert)
+	return nil
+}
+
+func printFingerprints(w io.Writer, cert *x509.Certificate) {
+	fmt.Fprintf(w, "SHA-256:  %s\n", mitmca.Fingerprint(cert, crypto.SHA256))
+	fmt.Fprintf(w, "SHA-1:    %s\n", mitmca.Fingerprint(cert, crypto.SHA1))
+	fmt.Fprintf(w, "SPKI pin: sha256//%s\n", mitmca.SPKIPin(cert))
+}
+
+func inspect(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("goproxy inspect", flag.ContinueOnError)
+	serverName := fs.String("servername", "", "server `name` sent to the TLS servers, their host by default")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goproxy inspect [flags] file.pem|host[:port]")
+		fs.PrintDefaults()
+	}
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	target := fs.Arg(0)
+
+	if data, err := os.ReadFile(target); err == nil {
+		certs, err := mitmca.ParsePEM(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+		for i, cert := range certs {
+			printCertificate(stdout, i, cert)
+		}
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	addr := target
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	name := *serverName
+	if name == "" {
+		name = host
+	}
+	// Verified below, to print the certificates even if invalid.
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, &tls.Config{
+		ServerName:         name,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	fmt.Fprintf(stdout, "%s: %s, %s, ALPN %q\n", addr, goproxy.TLSVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+	for i, cert := range state.PeerCertificates {
+		printCertificate(stdout, i, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: name, Intermediates: intermediates})
+	if err != nil {
+		fmt.Fprintf(stdout, "verification: %v\n", err)
+	} else {
+		fmt.Fprintln(stdout, "verification: ok")
+	}
+	return nil
+}
+
+func printCertificate(w io.Writer, i int, cert *x509.Certificate) {
+	fmt.Fprintf(w, "certificate %d:\n", i)
+	fmt.Fprintf(w, "\tsubject:     %s\n", cert.Subject)
+	fmt.Fprintf(w, "\tissuer:      %s\n", cert.Issuer)
+	fmt.Fprintf(w, "\tserial:      %x\n", cert.SerialNumber)
+	fmt.Fprintf(w, "\tvalidity:    %s to %s\n", cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "\tkey:         %s\n", cert.PublicKeyAlgorithm)
+	fmt.Fprintf(w, "\tCA:          %v\n", cert.IsCA)
+	var names []string
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(w, "\tnames:       %s\n", strings.Join(names, ", "))
+	}
+	if cert.IsCA {
+		switch {
+		case cert.MaxPathLenZero:
+			fmt.Fprintln(w, "\tpath length: 0")
+		case cert.MaxPathLen > 0:
+			fmt.Fprintf(w, "\tpath length: %d\n", cert.MaxPathLen)
+		}
+	}
+	var permitted, excluded []string
+	permitted = append(permitted, cert.PermittedDNSDomains...)
+	for _, r := range cert.PermittedIPRanges {
+		permitted = append(permitted, r.String())
+	}
+	excluded = append(excluded, cert.ExcludedDNSDomains...)
+	for _, r := range cert.ExcludedIPRanges {
+		excluded = append(excluded, r.String())
+	}
+	if len(permitted) > 0 {
+		fmt.Fprintf(w, "\tpermitted:   %s\n", strings.Join(permitted, ", "))
+	}
+	if len(excluded) > 0 {
+		fmt.Fprintf(w, "\texcluded:    %s\n", strings.Join(excluded, ", "))
+	}
+	fmt.Fprintf(w, "\tsha256:      %s\n", mitmca.Fingerprint(cert, crypto.SHA256))
+}
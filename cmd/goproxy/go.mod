@@ -0,0 +1,13 @@
+module github.com/InsideOutSec/goproxy/cmd/goproxy
+
+go 1.20
+
+require (
+	github.com/InsideOutSec/goproxy v0.0.0-20261014092056-3d9a2a1d6b76
+	github.com/InsideOutSec/goproxy/ext v0.0.0-20261014092308-c19507d28739
+)
+
+require (
+	golang.org/x/net v0.34.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+)
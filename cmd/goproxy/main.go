@@ -0,0 +1,111 @@
+// Command goproxy runs the proxy without writing a main package:
+//
+//	goproxy serve -addr :8080 -mitm -ca-cert ca.pem -ca-key ca-key.pem
+//	goproxy record -o exchanges.jsonl -addr :8080
+//	goproxy replay -host staging.example.com -diff exchanges.jsonl
+//	goproxy gen-ca -cert ca.pem -key ca-key.pem -permit example.com
+//	goproxy export -format mobileconfig -o ca.mobileconfig ca.pem
+//	goproxy fingerprint ca.pem
+//	goproxy inspect ca.pem
+//	goproxy inspect example.com:443
+//
+// The flags of serve and record can be set by a JSON configuration file
+// given with -config, whose fields are named after the flags:
+//
+//	{
+//		"addr": ":8080",
+//		"mitm": true,
+//		"ca-cert": "ca.pem",
+//		"ca-key": "ca-key.pem",
+//		"block": ["ads.example.com"]
+//	}
+//
+// The flags override the file. SIGHUP reloads the file, swapping the new
+// rules into the running proxy; the listening address, the upstream proxy
+// and -v are only read at startup.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string, stdout io.Writer) error
+}
+
+var commands = []command{
+	{"serve", "run the proxy", serve},
+	{"record", "run the proxy, recording its exchanges", record},
+	{"replay", "replay recorded exchanges, comparing the responses", replayExchanges},
+	{"gen-ca", "generate a CA for the MITM", genCA},
+	{"export", "export a CA certificate in PEM, DER or mobileconfig", export},
+	{"fingerprint", "print the fingerprints of a CA certificate", fingerprint},
+	{"inspect", "print the certificates of a PEM file or a TLS server", inspect},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: goproxy <command> [flags]")
+	fmt.Fprintln(w)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "goproxy <command> -h" for the flags of a command.`)
+}
+
+// run runs the command of args, without the program name.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		err := c.run(args[1:], stdout)
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		}
+		fmt.Fprintf(stderr, "goproxy %s: %v\n", c.name, err)
+		return 1
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(stdout)
+		return 0
+	}
+	fmt.Fprintf(stderr, "goproxy: unknown command %q\n", args[0])
+	usage(stderr)
+	return 2
+}
+
+// errUsage is returned by the commands whose flags are invalid, once the
+// error is printed by the flag set.
+var errUsage = errors.New("usage")
+
+// parse parses args with fs, printing its errors.
+func parse(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	return nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy/ext/replay"
+)
+
+func TestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goproxy.json")
+	os.WriteFile(path, []byte(`{"addr": ":3128", "mitm": true, "block": ["a.example.com"]}`), 0o600)
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	load := configFlags(fs)
+	if err := fs.Parse([]string{"-config", path, "-block", "b.example.com,c.example.com", "-v"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":3128" || !cfg.Mitm || !cfg.Verbose || strings.Join(cfg.Block, " ") != "b.example.com c.example.com" {
+		t.Errorf("got %+v", cfg)
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	var out bytes.Buffer
+	if code := run([]string{"gen-ca", "-cert", certPath, "-key", keyPath, "-cn", "test CA"}, &out, io.Discard); code != 0 {
+		t.Fatalf("gen-ca exited with %d", code)
+	}
+	if code := run([]string{"gen-ca", "-cert", certPath, "-key", keyPath}, io.Discard, io.Discard); code != 1 {
+		t.Errorf("gen-ca overwrote the CA, exited with %d", code)
+	}
+	out.Reset()
+	if code := run([]string{"inspect", certPath}, &out, io.Discard); code != 0 || !strings.Contains(out.String(), "CN=test CA") {
+		t.Errorf("inspect exited with %d: %s", code, out.String())
+	}
+	out.Reset()
+	if code := run([]string{"fingerprint", certPath}, &out, io.Discard); code != 0 || !strings.Contains(out.String(), "SPKI pin: sha256//") {
+		t.Errorf("fingerprint exited with %d: %s", code, out.String())
+	}
+	der := filepath.Join(dir, "ca.der")
+	if code := run([]string{"export", "-format", "der", "-o", der, certPath}, io.Discard, io.Discard); code != 0 {
+		t.Errorf("export exited with %d", code)
+	}
+	if data, _ := os.ReadFile(der); len(data) == 0 || data[0] != 0x30 {
+		t.Errorf("exported %x", data)
+	}
+
+	proxy, err := newProxy(&config{Mitm: true, CACert: certPath, CAKey: keyPath, Block: []string{"example.com"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+
+	pem, _ := os.ReadFile(certPath)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+	u, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" || resp.TLS.PeerCertificates[0].Issuer.CommonName != "test CA" {
+		t.Errorf("got %q from %s", body, resp.TLS.PeerCertificates[0].Issuer)
+	}
+
+	resp, err = client.Get("http://www.example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %s for a blocked host", resp.Status)
+	}
+	if _, err := client.Get("https://example.com/"); err == nil {
+		t.Error("CONNECT to a blocked host succeeded")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v2 "+r.Header.Get("X-Version"))
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "exchanges.jsonl")
+	err := writeExchanges(path, []*replay.Exchange{{
+		Request:  replay.Request{Method: http.MethodGet, URL: server.URL + "/api", Header: http.Header{}},
+		Response: &replay.Response{Status: http.StatusOK, Header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, Body: []byte("v2 1")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if code := run([]string{"replay", path}, &out, io.Discard); code != 0 || !strings.Contains(out.String(), ": 200 OK") {
+		t.Errorf("replay exited with %d: %s", code, out.String())
+	}
+	out.Reset()
+	if code := run([]string{"replay", "-diff", path}, &out, io.Discard); code != 1 || !strings.Contains(out.String(), "differs") {
+		t.Errorf("replay -diff exited with %d: %s", code, out.String())
+	}
+	out.Reset()
+	if code := run([]string{"replay", "-diff", "-H", "X-Version: 1", path}, &out, io.Discard); code != 0 || !strings.Contains(out.String(), "identical") {
+		t.Errorf("replay -diff -H exited with %d: %s", code, out.String())
+	}
+}
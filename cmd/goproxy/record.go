@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/replay"
+)
+
+func record(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("goproxy record", flag.ContinueOnError)
+	load := configFlags(fs)
+	out := fs.String("o", "exchanges.jsonl", "`file` of the exchanges recorded, written when stopped")
+	size := fs.Int("n", 1000, "`number` of the last exchanges recorded")
+	maxBody := fs.Int64("max-body", 1<<20, "`size` above which the exchanges aren't recorded")
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	rec := replay.NewRecorder(*size)
+	rec.MaxBody = *maxBody
+	err := runProxy(load, func(rules *goproxy.Rules) {
+		// Last, not to record the requests answered by the rules.
+		rules.OnRequest().DoFunc(rec.OnRequest)
+		rules.OnResponse().DoFunc(rec.OnResponse)
+	})
+	exchanges := rec.Exchanges()
+	if werr := writeExchanges(*out, exchanges); werr != nil {
+		return errors.Join(err, werr)
+	}
+	fmt.Fprintf(stdout, "recorded %d exchanges in %s\n", len(exchanges), *out)
+	return err
+}
+
+// writeExchanges writes exchanges to path, one JSON object per line.
+func writeExchanges(path string, exchanges []*replay.Exchange) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, ex := range exchanges {
+		if err := enc.Encode(ex); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readExchanges reads the exchanges written by writeExchanges.
+func readExchanges(path string) ([]*replay.Exchange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var exchanges []*replay.Exchange
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		ex := &replay.Exchange{}
+		if err := dec.Decode(ex); err == io.EOF {
+			return exchanges, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: exchange %d: %w", path, len(exchanges)+1, err)
+		}
+		exchanges = append(exchanges, ex)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy/ext/replay"
+)
+
+func replayExchanges(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("goproxy replay", flag.ContinueOnError)
+	host := fs.String("host", "", "`host` to which the requests are replayed, theirs by default")
+	scheme := fs.String("scheme", "", "`scheme` of the replayed requests, theirs by default")
+	var set, del listFlag
+	fs.Var(&set, "H", "`name: value` header set in the replayed requests, repeated")
+	fs.Var(&del, "del-header", "`names` of the headers removed from the replayed requests")
+	diff := fs.Bool("diff", false, "compare the responses with the recorded ones, failing when they differ")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: goproxy replay [flags] exchanges.jsonl")
+		fs.PrintDefaults()
+	}
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+
+	var opts []replay.Option
+	if *host != "" {
+		opts = append(opts, replay.Host(*host))
+	}
+	if *scheme != "" {
+		opts = append(opts, replay.Scheme(*scheme))
+	}
+	for _, h := range set {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return fmt.Errorf("invalid header %q, expected name: value", h)
+		}
+		opts = append(opts, replay.SetHeader(strings.TrimSpace(name), strings.TrimSpace(value)))
+	}
+	for _, name := range del {
+		opts = append(opts, replay.DelHeader(name))
+	}
+
+	exchanges, err := readExchanges(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	differ, failed := 0, 0
+	for _, ex := range exchanges {
+		name := ex.Request.Method + " " + ex.Request.URL
+		if !*diff {
+			resp, err := replay.Replay(ctx, ex, opts...)
+			if err != nil {
+				failed++
+				fmt.Fprintf(stdout, "%s: %v\n", name, err)
+				continue
+			}
+			fmt.Fprintf(stdout, "%s: %d %s\n", name, resp.Status, http.StatusText(resp.Status))
+			continue
+		}
+		d, err := replay.Compare(ctx, ex, opts...)
+		if err != nil {
+			failed++
+			fmt.Fprintf(stdout, "%s: %v\n", name, err)
+			continue
+		}
+		if d.Equal() {
+			fmt.Fprintf(stdout, "%s: identical\n", name)
+			continue
+		}
+		differ++
+		fmt.Fprintf(stdout, "%s: differs\n", name)
+		printDiff(stdout, d)
+	}
+	switch {
+	case failed > 0:
+		return fmt.Errorf("%d of %d requests failed", failed, len(exchanges))
+	case differ > 0:
+		return fmt.Errorf("%d of %d responses differ", differ, len(exchanges))
+	}
+	return nil
+}
+
+func printDiff(w io.Writer, d *replay.Diff) {
+	if d.LeftStatus != d.RightStatus {
+		fmt.Fprintf(w, "\tstatus: %d != %d\n", d.LeftStatus, d.RightStatus)
+	}
+	for _, h := range d.Headers {
+		fmt.Fprintf(w, "\theader %s: %q != %q\n", h.Name, h.Left, h.Right)
+	}
+	for _, b := range d.Body {
+		fmt.Fprintf(w, "\tbody %s: %s != %s\n", b.Path, b.Left, b.Right)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/daemon"
+	"github.com/InsideOutSec/goproxy/ext/mitmca"
+)
+
+// config is the configuration of the proxy, read from the JSON file of
+// -config, then overridden by the flags.
+type config struct {
+	Addr     string   `json:"addr"`
+	Verbose  bool     `json:"verbose"`
+	Mitm     bool     `json:"mitm"`
+	CACert   string   `json:"ca-cert"`
+	CAKey    string   `json:"ca-key"`
+	Upstream string   `json:"upstream"`
+	Block    []string `json:"block"`
+	CrashDir string   `json:"crash-dir"`
+}
+
+// listFlag is a flag repeated, or separated by commas.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// configFlags defines the flags of the configuration in fs. The returned
+// function loads the configuration, once fs is parsed, rereading the file
+// each time.
+func configFlags(fs *flag.FlagSet) func() (*config, error) {
+	path := fs.String("config", "", "JSON configuration `file`, overridden by the flags")
+	flags := &config{}
+	fs.StringVar(&flags.Addr, "addr", ":8080", "proxy listen `address`")
+	fs.BoolVar(&flags.Verbose, "v", false, "log every request")
+	fs.BoolVar(&flags.Mitm, "mitm", false, "MITM the HTTPS requests")
+	fs.StringVar(&flags.CACert, "ca-cert", "", "PEM `file` of the MITM CA certificate, the goproxy CA by default")
+	fs.StringVar(&flags.CAKey, "ca-key", "", "PEM `file` of the MITM CA key")
+	fs.StringVar(&flags.Upstream, "upstream", "", "`URL` of the upstream proxy")
+	fs.Var((*listFlag)(&flags.Block), "block", "`hosts` blocked, with their subdomains, repeated or separated by commas")
+	fs.StringVar(&flags.CrashDir, "crash-dir", "", "`directory` of the crash reports")
+
+	return func() (*config, error) {
+		cfg := &config{Addr: flags.Addr}
+		if *path != "" {
+			data, err := os.ReadFile(*path)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(data, cfg); err != nil {
+				return nil, fmt.Errorf("%s: %w", *path, err)
+			}
+		}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "addr":
+				cfg.Addr = flags.Addr
+			case "v":
+				cfg.Verbose = flags.Verbose
+			case "mitm":
+				cfg.Mitm = flags.Mitm
+			case "ca-cert":
+				cfg.CACert = flags.CACert
+			case "ca-key":
+				cfg.CAKey = flags.CAKey
+			case "upstream":
+				cfg.Upstream = flags.Upstream
+			case "block":
+				cfg.Block = flags.Block
+			case "crash-dir":
+				cfg.CrashDir = flags.CrashDir
+			}
+		})
+		return cfg, nil
+	}
+}
+
+// loadCA loads the MITM CA of cfg, nil for the goproxy CA.
+func loadCA(cfg *config) (*tls.Certificate, error) {
+	if cfg.CACert == "" && cfg.CAKey == "" {
+		return nil, nil
+	}
+	if cfg.CACert == "" || cfg.CAKey == "" {
+		return nil, errors.New("ca-cert and ca-key must be both set")
+	}
+	return mitmca.Load(cfg.CACert, cfg.CAKey)
+}
+
+// hostBlocked returns a condition matching the requests to hosts, or to
+// their subdomains.
+func hostBlocked(hosts []string) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		host := strings.ToLower(strings.TrimSuffix(req.URL.Hostname(), "."))
+		for _, h := range hosts {
+			h = strings.ToLower(h)
+			if host == h || strings.HasSuffix(host, "."+h) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// buildRules returns the rules of cfg, extended by extra if not nil.
+func buildRules(cfg *config, extra func(rules *goproxy.Rules)) (*goproxy.Rules, error) {
+	rules := goproxy.NewRules()
+	if len(cfg.Block) > 0 {
+		blocked := hostBlocked(cfg.Block)
+		rules.OnRequest(blocked).HandleConnect(goproxy.AlwaysReject)
+		rules.OnRequest(blocked).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by the proxy\n")
+		})
+	}
+	if cfg.Mitm {
+		ca, err := loadCA(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			// The hosts outside the name constraints of the CA are tunneled.
+			rules.OnRequest().HandleConnect(goproxy.MitmWithinCA(ca))
+		} else {
+			rules.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		}
+	}
+	if extra != nil {
+		extra(rules)
+	}
+	return rules, nil
+}
+
+// newProxy returns the proxy of cfg, with its rules.
+func newProxy(cfg *config, extra func(rules *goproxy.Rules)) (*goproxy.ProxyHttpServer, error) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Verbose = cfg.Verbose
+	if cfg.Upstream != "" {
+		u, err := url.Parse(cfg.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("upstream: %w", err)
+		}
+		proxy.Tr.Proxy = http.ProxyURL(u)
+		proxy.ConnectDial = proxy.NewConnectDialToProxy(cfg.Upstream)
+	}
+	rules, err := buildRules(cfg, extra)
+	if err != nil {
+		return nil, err
+	}
+	proxy.SwapRules(rules)
+	return proxy, nil
+}
+
+// runProxy runs the proxy of load until it is stopped, reloading its rules
+// on SIGHUP.
+func runProxy(load func() (*config, error), extra func(rules *goproxy.Rules)) error {
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	proxy, err := newProxy(cfg, extra)
+	if err != nil {
+		return err
+	}
+	d := &daemon.Daemon{
+		Name:     "goproxy",
+		CrashDir: cfg.CrashDir,
+		Logger:   proxy.Logger,
+		Reload: func() error {
+			cfg, err := load()
+			if err != nil {
+				return err
+			}
+			rules, err := buildRules(cfg, extra)
+			if err != nil {
+				return err
+			}
+			proxy.SwapRules(rules)
+			return nil
+		},
+	}
+	srv := &http.Server{Addr: cfg.Addr, Handler: d.Handler(proxy)}
+	d.Serve = daemon.Server(srv, 30*time.Second)
+	proxy.Logger.Printf("goproxy: listening on %s", cfg.Addr)
+	return d.Run()
+}
+
+func serve(args []string, _ io.Writer) error {
+	fs := flag.NewFlagSet("goproxy serve", flag.ContinueOnError)
+	load := configFlags(fs)
+	if err := parse(fs, args); err != nil {
+		return err
+	}
+	return runProxy(load, nil)
+}
@@ -0,0 +1,304 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrUnknownConn is returned by CloseConn for the connections not in the
+// connection table.
+var ErrUnknownConn = errors.New("goproxy: unknown connection")
+
+// Kinds of the client connections in the connection table.
+const (
+	ConnHTTP     = "http"
+	ConnTunnel   = "tunnel"
+	ConnMitm     = "mitm"
+	ConnHTTPMitm = "http-mitm"
+	ConnHijack   = "hijack"
+)
+
+// ConnInfo describes a client connection of the connection table.
+type ConnInfo struct {
+	ID         int64  `json:"id"`
+	RemoteAddr string `json:"remote_addr"`
+	LocalAddr  string `json:"local_addr"`
+	// Kind is ConnHTTP until the connection is hijacked by a CONNECT
+	// handled as ConnTunnel, ConnMitm, ConnHTTPMitm or ConnHijack.
+	Kind string `json:"kind"`
+	// Target is the host of the CONNECT request.
+	Target string `json:"target,omitempty"`
+	// Protocol is the protocol of the last request, such as "HTTP/1.1", or
+	// the protocol negotiated by the MITM handshake, such as "h2".
+	Protocol string `json:"protocol,omitempty"`
+	// TLSVersion is the version negotiated by the MITM handshake.
+	TLSVersion string `json:"tls_version,omitempty"`
+	// User is the name of the identity of the last request.
+	User string `json:"user,omitempty"`
+	// Requests is the number of requests read from the connection, not
+	// counting the MITM'd ones.
+	Requests int64     `json:"requests"`
+	Opened   time.Time `json:"opened"`
+	// Idle is the duration since the last byte read or written.
+	Idle time.Duration `json:"idle"`
+	// BytesIn are read from the client, BytesOut written to it.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// connTable is the table of the connections of the listeners wrapped by
+// TrackListener.
+type connTable struct {
+	events   *eventBus
+	mu       sync.Mutex
+	lastID   int64
+	conns    map[int64]*trackedConn
+	byRemote map[string]*trackedConn
+}
+
+// trackedConn counts the bytes of a client connection.
+type trackedConn struct {
+	// Counters, first to be aligned in i386.
+	in, out, active int64
+	net.Conn
+	table *connTable
+	once  sync.Once
+
+	// Guarded by table.mu.
+	info ConnInfo
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.in, int64(n))
+		atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&c.out, int64(n))
+		atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.table.remove(c) })
+	return c.Conn.Close()
+}
+
+// halfClosableConn keeps the half-close of the TCP connections, used by
+// the tunnels.
+type halfClosableConn struct {
+	*trackedConn
+	hc halfClosable
+}
+
+func (c halfClosableConn) CloseWrite() error { return c.hc.CloseWrite() }
+func (c halfClosableConn) CloseRead() error  { return c.hc.CloseRead() }
+
+func (t *connTable) add(conn net.Conn) net.Conn {
+	c := &trackedConn{Conn: conn, table: t}
+	now := time.Now()
+	c.active = now.UnixNano()
+	t.mu.Lock()
+	t.lastID++
+	c.info = ConnInfo{
+		ID:         t.lastID,
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+		Kind:       ConnHTTP,
+		Opened:     now,
+	}
+	t.conns[c.info.ID] = c
+	t.byRemote[c.info.RemoteAddr] = c
+	info := c.info
+	t.mu.Unlock()
+	if t.events.wants(EventConnOpened) {
+		t.events.publish(&Event{Type: EventConnOpened, Time: now, Conn: &info})
+	}
+	if hc, ok := conn.(halfClosable); ok {
+		return halfClosableConn{c, hc}
+	}
+	return c
+}
+
+func (t *connTable) remove(c *trackedConn) {
+	now := time.Now()
+	t.mu.Lock()
+	delete(t.conns, c.info.ID)
+	if t.byRemote[c.info.RemoteAddr] == c {
+		delete(t.byRemote, c.info.RemoteAddr)
+	}
+	info := c.snapshot(now)
+	t.mu.Unlock()
+	if t.events.wants(EventConnClosed) {
+		t.events.publish(&Event{Type: EventConnClosed, Time: now, Conn: &info, Duration: now.Sub(info.Opened)})
+	}
+}
+
+// snapshot returns the description of c with its counters, with the mutex
+// of the table held.
+func (c *trackedConn) snapshot(now time.Time) ConnInfo {
+	info := c.info
+	info.BytesIn = atomic.LoadInt64(&c.in)
+	info.BytesOut = atomic.LoadInt64(&c.out)
+	info.Idle = now.Sub(time.Unix(0, atomic.LoadInt64(&c.active)))
+	return info
+}
+
+// update changes the description of the connection of a request, if it is
+// tracked.
+func (t *connTable) update(r *http.Request, f func(info *ConnInfo)) {
+	if t == nil || r == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.byRemote[r.RemoteAddr]; ok {
+		f(&c.info)
+	}
+}
+
+type trackedListener struct {
+	net.Listener
+	table *connTable
+}
+
+func (l trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.table.add(conn), nil
+}
+
+func (proxy *ProxyHttpServer) connTable() *connTable {
+	proxy.connsOnce.Do(func() {
+		proxy.conns = &connTable{events: &proxy.events, conns: make(map[int64]*trackedConn), byRemote: make(map[string]*trackedConn)}
+	})
+	return proxy.conns
+}
+
+// TrackListener returns a listener recording the connections it accepts in
+// the connection table of the proxy, for Conns and CloseConn. The proxy
+// must be served on the returned listener:
+//
+//	l, _ := net.Listen("tcp", ":8080")
+//	http.Serve(proxy.TrackListener(l), proxy)
+//
+// A TLS listener must wrap the tracking one, so that the bytes of the TLS
+// records are counted.
+func (proxy *ProxyHttpServer) TrackListener(l net.Listener) net.Listener {
+	return trackedListener{Listener: l, table: proxy.connTable()}
+}
+
+// trackRequest records a request in the connection table.
+func (proxy *ProxyHttpServer) trackRequest(r *http.Request, ctx *ProxyCtx) {
+	proxy.conns.update(r, func(info *ConnInfo) {
+		info.Requests++
+		info.Protocol = r.Proto
+		if ctx.Identity != nil {
+			info.User = ctx.Identity.Name
+		}
+	})
+}
+
+// connKind returns the connection table kind of a CONNECT handled by a.
+func (a ConnectActionLiteral) connKind() string {
+	switch a {
+	case ConnectAccept:
+		return ConnTunnel
+	case ConnectMitm:
+		return ConnMitm
+	case ConnectHTTPMitm:
+		return ConnHTTPMitm
+	case ConnectHijack, ConnectProxyAuthHijack:
+		return ConnHijack
+	}
+	return ""
+}
+
+// trackConnect records the decision on a CONNECT in the connection table.
+func (proxy *ProxyHttpServer) trackConnect(r *http.Request, ctx *ProxyCtx, kind, target string) {
+	if kind == "" {
+		return
+	}
+	proxy.conns.update(r, func(info *ConnInfo) {
+		info.Kind = kind
+		info.Target = target
+		if ctx.Identity != nil {
+			info.User = ctx.Identity.Name
+		}
+	})
+}
+
+// trackHandshake records the MITM handshake of a CONNECT in the connection
+// table.
+func (proxy *ProxyHttpServer) trackHandshake(r *http.Request, state *tls.ConnectionState) {
+	proxy.conns.update(r, func(info *ConnInfo) {
+		info.Protocol = state.NegotiatedProtocol
+		if info.Protocol == "" {
+			info.Protocol = "http/1.1"
+		}
+		info.TLSVersion = TLSVersionName(state.Version)
+	})
+}
+
+// TLSVersionName returns the name of the TLS version v, such as "TLS 1.3",
+// or its hexadecimal value when it is unknown.
+func TLSVersionName(v uint16) string {
+	switch v {
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// Conns returns the client connections of the listeners wrapped by
+// TrackListener, by ID. Their byte counters include the MITM'd and tunneled
+// traffic.
+func (proxy *ProxyHttpServer) Conns() []ConnInfo {
+	t := proxy.connTable()
+	now := time.Now()
+	t.mu.Lock()
+	infos := make([]ConnInfo, 0, len(t.conns))
+	for _, c := range t.conns {
+		infos = append(infos, c.snapshot(now))
+	}
+	t.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseConn terminates the client connection id of the connection table,
+// and the tunnel or MITM session it carries.
+func (proxy *ProxyHttpServer) CloseConn(id int64) error {
+	t := proxy.connTable()
+	t.mu.Lock()
+	c, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return ErrUnknownConn
+	}
+	return c.Close()
+}
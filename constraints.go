@@ -0,0 +1,90 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+)
+
+// CAPermits returns whether the name constraints of ca permit the
+// certificates of host, a hostname or an IP address: the clients reject
+// the certificates signed by a name-constrained CA for the other hosts.
+// The constraints of each type of name apply only to the names of that
+// type, as specified by RFC 5280.
+func CAPermits(ca *x509.Certificate, host string) bool {
+	host = strings.TrimSuffix(stripPort(host), ".")
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		for _, r := range ca.ExcludedIPRanges {
+			if r.Contains(ip) {
+				return false
+			}
+		}
+		if len(ca.PermittedIPRanges) == 0 {
+			return true
+		}
+		for _, r := range ca.PermittedIPRanges {
+			if r.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.ToLower(host)
+	for _, d := range ca.ExcludedDNSDomains {
+		if domainConstraintMatches(d, host) {
+			return false
+		}
+	}
+	if len(ca.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, d := range ca.PermittedDNSDomains {
+		if domainConstraintMatches(d, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainConstraintMatches returns whether the DNS name constraint matches
+// host: a constraint "example.com" matches the domain and its subdomains,
+// and ".example.com" only its subdomains.
+func domainConstraintMatches(constraint, host string) bool {
+	constraint = strings.ToLower(constraint)
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint || strings.HasSuffix(host, "."+constraint)
+}
+
+// caLeaf returns the parsed certificate of ca, nil if invalid.
+func caLeaf(ca *tls.Certificate) *x509.Certificate {
+	if ca.Leaf != nil {
+		return ca.Leaf
+	}
+	if len(ca.Certificate) == 0 {
+		return nil
+	}
+	leaf, _ := x509.ParseCertificate(ca.Certificate[0])
+	return leaf
+}
+
+// MitmWithinCA returns a HttpsHandler MITM'ing the CONNECT requests with
+// ca, as ConnectMitm, when its name constraints permit the host, and
+// accepting the others as OkConnect, unintercepted, since the clients would
+// reject their certificates.
+func MitmWithinCA(ca *tls.Certificate) FuncHttpsHandler {
+	mitm := &ConnectAction{Action: ConnectMitm, TLSConfig: TLSConfigFromCA(ca)}
+	return func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		if leaf := caLeaf(ca); leaf != nil && !CAPermits(leaf, host) {
+			ctx.Logf("%s is outside the name constraints of the CA, not intercepted", stripPort(host))
+			return OkConnect, host
+		}
+		return mitm, host
+	}
+}
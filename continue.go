@@ -0,0 +1,43 @@
+package goproxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// continueReader is the body of a MITM'd request expecting 100 Continue,
+// which it sends to the client when it is first read.
+type continueReader struct {
+	io.ReadCloser
+	w io.Writer
+
+	once    sync.Once
+	err     error
+	started int32
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		atomic.StoreInt32(&c.started, 1)
+		_, c.err = io.WriteString(c.w, "HTTP/1.1 100 Continue\r\n\r\n")
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.ReadCloser.Read(p)
+}
+
+// Close doesn't drain the body that wasn't asked for, the connection is
+// closed instead.
+func (c *continueReader) Close() error {
+	if !c.sent() {
+		return nil
+	}
+	return c.ReadCloser.Close()
+}
+
+// sent returns whether 100 Continue was sent.
+func (c *continueReader) sent() bool {
+	return atomic.LoadInt32(&c.started) == 1
+}
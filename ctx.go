@@ -3,9 +3,12 @@ package goproxy
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"mime"
 	"net"
 	"net/http"
+	"sync"
 )
 
 // ProxyCtx is the Proxy context, contains useful information about every request. It is passed to
@@ -14,20 +17,111 @@ type ProxyCtx struct {
 	// Will contain the client request from the proxy
 	Req *http.Request
 	// Will contain the remote server's response (if available. nil if the request wasn't send yet)
-	Resp         *http.Response
+	Resp *http.Response
+	// Specify a custom RoundTripper that will be used only for the current request.
+	// When it returns an error wrapping http.ErrAbortHandler, the connection with
+	// the client is closed without sending any response.
 	RoundTripper RoundTripper
+	// Transport, when set, sends the current request upstream instead of
+	// the proxy Tr, for example a transport bound to another network
+	// interface, or with another TLS configuration. It is used below the
+	// RoundTripper, by UpstreamRoundTrip, and should be kept by the handlers
+	// rather than created per request, to reuse its connections.
+	Transport http.RoundTripper
 	// Specify a custom connection dialer that will be used only for the current
-	// request, including WebSocket connection upgrades
+	// request, including WebSocket connection upgrades. The requests are then
+	// sent on the connections of Dialer, unless Transport is set: they are
+	// kept alive for the next requests of a MITM'd tunnel, and closed once
+	// the request is done otherwise.
 	Dialer func(ctx context.Context, network string, addr string) (net.Conn, error)
 	// will contain the recent error that occurred while trying to send receive or parse traffic
 	Error error
 	// A handle for the user to keep data in the context, from the call of ReqHandler to the
 	// call of RespHandler
 	UserData any
+	// The authenticated user of the proxy client, nil when unknown
+	Identity *Identity
+	// Logger, when set, replaces the proxy Logger for the messages of the
+	// request, for example to separate the logs of the proxy users.
+	Logger Logger
+	// WebSocketHandler, when set by the request handlers of a WebSocket
+	// handshake, handles the frames of the connection. The extensions of
+	// the connection, such as the compression, are then disabled.
+	WebSocketHandler WebSocketHandler
 	// Will connect a request to a response
-	Session   int64
-	certStore CertStorage
-	Proxy     *ProxyHttpServer
+	Session    int64
+	certStore  CertStorage
+	Proxy      *ProxyHttpServer
+	mitm       bool
+	connectReq *http.Request
+	timing     *timing
+	ruleSet    *Rules
+	dialerTr   *http.Transport
+	tunnel     *tunnelTransport
+
+	matchedRules []string
+	requestID    string
+	fingerprint  *TLSFingerprint
+	values       map[any]any
+}
+
+// IsMitm returns whether the request was read from a MITM'd CONNECT tunnel.
+func (ctx *ProxyCtx) IsMitm() bool {
+	return ctx.mitm
+}
+
+// ConnectRequest returns the CONNECT request of the tunnel a MITM'd request
+// was read from, with the listener address and TLS state of the client
+// connection with the proxy. It returns nil for the other requests.
+func (ctx *ProxyCtx) ConnectRequest() *http.Request {
+	return ctx.connectReq
+}
+
+// UpstreamTLS returns the state of the TLS connection with the upstream
+// server of a MITM'd request, such as its version, cipher suite, ALPN
+// protocol and certificates, once its response is received. It returns nil
+// otherwise.
+func (ctx *ProxyCtx) UpstreamTLS() *tls.ConnectionState {
+	if ctx.Resp == nil {
+		return nil
+	}
+	return ctx.Resp.TLS
+}
+
+// UpstreamChain returns the certificates presented by the upstream server
+// of a MITM'd request, the leaf first, once its response is received. It
+// returns nil otherwise.
+func (ctx *ProxyCtx) UpstreamChain() []*x509.Certificate {
+	if state := ctx.UpstreamTLS(); state != nil {
+		return state.PeerCertificates
+	}
+	return nil
+}
+
+// SetValue tags the request with value for key, for the next handlers and
+// conditions, such as a score computed by an extension. As with
+// context.WithValue, the keys should be of unexported types, not to collide
+// between packages.
+func (ctx *ProxyCtx) SetValue(key, value any) {
+	if ctx.values == nil {
+		ctx.values = make(map[any]any)
+	}
+	ctx.values[key] = value
+}
+
+// Value returns the value of key set with SetValue, or nil.
+func (ctx *ProxyCtx) Value(key any) any {
+	return ctx.values[key]
+}
+
+// ClientTLS returns the state of the TLS connection with the client: the
+// MITM handshake of a MITM'd request, or the connection with the proxy when
+// it is served over TLS. It returns nil for plain HTTP requests.
+func (ctx *ProxyCtx) ClientTLS() *tls.ConnectionState {
+	if ctx.Req == nil {
+		return nil
+	}
+	return ctx.Req.TLS
 }
 
 type RoundTripper interface {
@@ -45,14 +139,102 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 }
 
 func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ctx.WebSocketHandler != nil && isWebSocketHandshake(req.Header) {
+		// The handler reads the frames as they are sent.
+		req.Header.Del("Sec-Websocket-Extensions")
+	}
+	return ctx.roundTripTimed(req, func(req *http.Request) (*http.Response, error) {
+		return ctx.NextRoundTripper().RoundTrip(req, ctx)
+	})
+}
+
+// upstreamRoundTripper is the RoundTripper of UpstreamRoundTrip.
+var upstreamRoundTripper RoundTripper = RoundTripperFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+	return ctx.UpstreamRoundTrip(req)
+})
+
+// NextRoundTripper returns the RoundTripper the handlers wrapping the
+// RoundTripper send the requests with: the current RoundTripper, or
+// UpstreamRoundTrip when there is none.
+//
+//	next := ctx.NextRoundTripper()
+//	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+//		return next.RoundTrip(req, ctx)
+//	})
+func (ctx *ProxyCtx) NextRoundTripper() RoundTripper {
 	if ctx.RoundTripper != nil {
-		return ctx.RoundTripper.RoundTrip(req, ctx)
+		return ctx.RoundTripper
+	}
+	return upstreamRoundTripper
+}
+
+// UpstreamRoundTrip sends req upstream, without the RoundTripper: with
+// Transport when set, or the proxy Tr dialing with Dialer.
+func (ctx *ProxyCtx) UpstreamRoundTrip(req *http.Request) (*http.Response, error) {
+	if ctx.Transport != nil {
+		return ctx.Transport.RoundTrip(req)
+	}
+	if ctx.Dialer == nil {
+		return ctx.Proxy.Tr.RoundTrip(req)
+	}
+	if ctx.tunnel != nil {
+		req = req.WithContext(context.WithValue(req.Context(), dialerKey{}, ctx.Dialer))
+		return ctx.tunnel.transport(ctx.Proxy.Tr).RoundTrip(req)
+	}
+	if ctx.dialerTr == nil {
+		// Without keep-alive, not to leave the connections of Dialer idle
+		// once the request is done.
+		ctx.dialerTr = ctx.Proxy.Tr.Clone()
+		ctx.dialerTr.DialContext = ctx.Dialer
+		ctx.dialerTr.DialTLSContext = nil
+		ctx.dialerTr.DisableKeepAlives = true
+	}
+	return ctx.dialerTr.RoundTrip(req)
+}
+
+type dialerKey struct{}
+
+// tunnelTransport is the transport of the requests of a MITM'd tunnel
+// sent with a Dialer, keeping their connections alive for the next
+// requests of the tunnel. The connections are dialed with the Dialer of the
+// request dialing them, and closed with the tunnel.
+type tunnelTransport struct {
+	once sync.Once
+	tr   *http.Transport
+}
+
+func (t *tunnelTransport) transport(base *http.Transport) *http.Transport {
+	t.once.Do(func() {
+		t.tr = base.Clone()
+		t.tr.DialTLSContext = nil
+		t.tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dial, _ := ctx.Value(dialerKey{}).(func(ctx context.Context, network string, addr string) (net.Conn, error))
+			if dial == nil {
+				return nil, errors.New("goproxy: no Dialer for " + addr)
+			}
+			return dial(ctx, network, addr)
+		}
+	})
+	return t.tr
+}
+
+// close closes the idle connections of the tunnel.
+func (t *tunnelTransport) close() {
+	if t.tr != nil {
+		t.tr.CloseIdleConnections()
 	}
-	return ctx.Proxy.Tr.RoundTrip(req)
 }
 
 func (ctx *ProxyCtx) printf(msg string, argv ...any) {
-	ctx.Proxy.Logger.Printf("[%03d] "+msg+"\n", append([]any{ctx.Session & 0xFFFF}, argv...)...)
+	logger := ctx.Proxy.Logger
+	if ctx.Logger != nil {
+		logger = ctx.Logger
+	}
+	if ctx.requestID != "" {
+		logger.Printf("[%03d] [%s] "+msg+"\n", append([]any{ctx.Session & 0xFFFF, ctx.requestID}, argv...)...)
+		return
+	}
+	logger.Printf("[%03d] "+msg+"\n", append([]any{ctx.Session & 0xFFFF}, argv...)...)
 }
 
 // Logf prints a message to the proxy's log. Should be used in a ProxyHttpServer's filter
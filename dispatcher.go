@@ -217,15 +217,39 @@ func StatusCodeIs(codes ...int) RespCondition {
 //
 //	proxy.OnRequest(UrlIs("example.com/foo"),UrlMatches(regexp.MustParse(`.*\.exampl.\com\./.*`)).Do(...)
 func (proxy *ProxyHttpServer) OnRequest(conds ...ReqCondition) *ReqProxyConds {
-	return &ReqProxyConds{proxy, conds}
+	return proxy.Rules().OnRequest(conds...)
 }
 
 // ReqProxyConds aggregate ReqConditions for a ProxyHttpServer.
 // Upon calling Do, it will register a ReqHandler that would
 // handle the request if all conditions on the HTTP request are met.
 type ReqProxyConds struct {
-	proxy    *ProxyHttpServer
+	rules    *Rules
 	reqConds []ReqCondition
+	name     string
+}
+
+// Named names the rule, whose matches are published as EventRuleMatched
+// events, for example to count them:
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("ads.example.com")).Named("ads").DoFunc(...)
+func (pcond *ReqProxyConds) Named(name string) *ReqProxyConds {
+	pcond.name = name
+	return pcond
+}
+
+// matched records and publishes the match of a named rule.
+func matched(name string, ctx *ProxyCtx) {
+	if name != "" {
+		ctx.matchedRules = append(ctx.matchedRules, name)
+		ctx.Publish(&Event{Type: EventRuleMatched, Rule: name})
+	}
+}
+
+// MatchedRules returns the names of the rules, given by Named, that matched
+// the request so far, in the order they matched.
+func (ctx *ProxyCtx) MatchedRules() []string {
+	return append([]string(nil), ctx.matchedRules...)
 }
 
 // DoFunc is equivalent to proxy.OnRequest().Do(FuncReqHandler(f)).
@@ -242,13 +266,14 @@ func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*ht
 //	// given request to the proxy, will test if cond1.HandleReq(req,ctx) && cond2.HandleReq(req,ctx) are true
 //	// if they are, will call handler.Handle(req,ctx)
 func (pcond *ReqProxyConds) Do(h ReqHandler) {
-	pcond.proxy.reqHandlers = append(pcond.proxy.reqHandlers,
+	pcond.rules.reqHandlers = append(pcond.rules.reqHandlers,
 		FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(r, ctx) {
 					return r, nil
 				}
 			}
+			matched(pcond.name, ctx)
 			return h.Handle(r, ctx)
 		}))
 }
@@ -266,13 +291,14 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 //
 //	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject) // rejects all CONNECT requests
 func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+	pcond.rules.httpsHandlers = append(pcond.rules.httpsHandlers,
 		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
 					return nil, ""
 				}
 			}
+			matched(pcond.name, ctx)
 			return h.HandleConnect(host, ctx)
 		}))
 }
@@ -295,13 +321,14 @@ func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx)
 }
 
 func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+	pcond.rules.httpsHandlers = append(pcond.rules.httpsHandlers,
 		FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
 					return nil, ""
 				}
 			}
+			matched(pcond.name, ctx)
 			return &ConnectAction{Action: ConnectHijack, Hijack: f}, host
 		}))
 }
@@ -310,9 +337,17 @@ func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.C
 // Upon calling ProxyConds.Do, it will register a RespHandler that would
 // handle the HTTP response from remote server if all conditions on the HTTP response are met.
 type ProxyConds struct {
-	proxy    *ProxyHttpServer
+	rules    *Rules
 	reqConds []ReqCondition
 	respCond []RespCondition
+	name     string
+}
+
+// Named names the rule, whose matches are published as EventRuleMatched
+// events.
+func (pcond *ProxyConds) Named(name string) *ProxyConds {
+	pcond.name = name
+	return pcond
 }
 
 // ProxyConds.DoFunc is equivalent to proxy.OnResponse().Do(FuncRespHandler(f)).
@@ -323,7 +358,7 @@ func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http
 // ProxyConds.Do will register the RespHandler on the proxy, h.Handle(resp,ctx) will be called on every
 // request that matches the conditions aggregated in pcond.
 func (pcond *ProxyConds) Do(h RespHandler) {
-	pcond.proxy.respHandlers = append(pcond.proxy.respHandlers,
+	pcond.rules.respHandlers = append(pcond.rules.respHandlers,
 		FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
@@ -335,6 +370,7 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 					return resp
 				}
 			}
+			matched(pcond.name, ctx)
 			return h.Handle(resp, ctx)
 		}))
 }
@@ -344,7 +380,7 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 //	proxy.OnResponse(cond1,cond2).Do(handler) // handler.Handle(resp,ctx) will be used
 //				// if cond1.HandleResp(resp) && cond2.HandleResp(resp)
 func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
-	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
+	return proxy.Rules().OnResponse(conds...)
 }
 
 // AlwaysMitm is a HttpsHandler that always eavesdrop https connections, for example to
@@ -355,6 +391,16 @@ var AlwaysMitm FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectActi
 	return MitmConnect, host
 }
 
+// AlwaysSniff is a HttpsHandler that sniffs the protocol of the tunnels, to MITM the TLS
+// ones and handle the plain HTTP ones, relaying the others, for example on the ports other
+// than 443
+//
+//	proxy.OnRequest(goproxy.Not(goproxy.ReqHostMatches(regexp.MustCompile(":443$")))).
+//		HandleConnect(goproxy.AlwaysSniff)
+var AlwaysSniff FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	return SniffConnect, host
+}
+
 // AlwaysReject is a HttpsHandler that drops any CONNECT request, for example, this code will disallow
 // connections to hosts on any other port than 443
 //
@@ -367,8 +413,12 @@ var AlwaysReject FuncHttpsHandler = func(host string, ctx *ProxyCtx) (*ConnectAc
 // HandleBytes will return a RespHandler that read the entire body of the request
 // to a byte array in memory, would run the user supplied f function on the byte arra,
 // and will replace the body of the original response with the resulting byte array.
+// The partial contents, fragments of the body, are left unchanged: see DisableRanges.
 func HandleBytes(f func(b []byte, ctx *ProxyCtx) []byte) RespHandler {
 	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp.StatusCode == http.StatusPartialContent {
+			return resp
+		}
 		b, err := io.ReadAll(resp.Body)
 		if err != nil {
 			ctx.Warnf("Cannot read response %s", err)
@@ -380,3 +430,22 @@ func HandleBytes(f func(b []byte, ctx *ProxyCtx) []byte) RespHandler {
 		return resp
 	})
 }
+
+// DisableRanges is a ReqHandler removing the Range headers of the requests,
+// and the Accept-Ranges headers of their responses, so that the handlers
+// modifying the bodies receive them whole rather than partial contents:
+//
+//	proxy.OnRequest(goproxy.UrlHasPrefix("example.com/app.js")).Do(goproxy.DisableRanges)
+var DisableRanges FuncReqHandler = func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = RoundTripperFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+		resp, err := next.RoundTrip(req, ctx)
+		if err == nil {
+			resp.Header.Del("Accept-Ranges")
+		}
+		return resp, err
+	})
+	return req, nil
+}
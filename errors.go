@@ -0,0 +1,165 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+// The classes of the failures of the proxy. The errors of the requests,
+// in ProxyCtx.Error, the Err of the events and the errors passed to
+// ConnectionErrHandler, wrap their class, matched with errors.Is, besides
+// their cause:
+//
+//	if errors.Is(ctx.Error, goproxy.ErrDialTimeout) {
+//		...
+//	}
+var (
+	// ErrDialTimeout is the timeout of the connection to the destination,
+	// or to the upstream proxy.
+	ErrDialTimeout = errors.New("goproxy: dial timeout")
+	// ErrDialRefused is the connection refused by the destination, or by
+	// the upstream proxy.
+	ErrDialRefused = errors.New("goproxy: connection refused")
+	// ErrHostNotFound is the failure of the resolution of the destination.
+	ErrHostNotFound = errors.New("goproxy: host not found")
+	// ErrTLSVerify is the certificate of the destination rejected.
+	ErrTLSVerify = errors.New("goproxy: upstream certificate rejected")
+	// ErrUpstreamProxyAuth is the 407 response of the upstream proxy to a
+	// CONNECT request.
+	ErrUpstreamProxyAuth = errors.New("goproxy: upstream proxy authentication failed")
+	// ErrResponseTimeout is the timeout of the response of the
+	// destination, once connected.
+	ErrResponseTimeout = errors.New("goproxy: response timeout")
+)
+
+// ErrBlockedByRule is the error of the requests blocked by a rule, set in
+// ProxyCtx.Error by the handlers answering in its place, such as the block
+// pages.
+type ErrBlockedByRule struct {
+	RuleID string
+	Reason string
+}
+
+func (e *ErrBlockedByRule) Error() string {
+	if e.Reason != "" {
+		return "goproxy: blocked by rule " + e.RuleID + ": " + e.Reason
+	}
+	return "goproxy: blocked by rule " + e.RuleID
+}
+
+// classError is an error wrapping its class.
+type classError struct {
+	class error
+	err   error
+}
+
+func (e *classError) Error() string   { return e.err.Error() }
+func (e *classError) Unwrap() []error { return []error{e.class, e.err} }
+
+var errorClasses = []struct {
+	err  error
+	name string
+}{
+	{ErrDialTimeout, "dial_timeout"},
+	{ErrDialRefused, "dial_refused"},
+	{ErrHostNotFound, "host_not_found"},
+	{ErrTLSVerify, "tls_verify"},
+	{ErrUpstreamProxyAuth, "upstream_proxy_auth"},
+	{ErrResponseTimeout, "response_timeout"},
+}
+
+// errorClass returns the class of err, nil if unknown.
+func errorClass(err error) error {
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.err
+		}
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrHostNotFound
+	case errors.As(err, &verifyErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrTLSVerify
+	// net/http only reports the status of the CONNECT responses of the
+	// upstream proxies.
+	case strings.Contains(err.Error(), "407 Proxy Authentication Required"):
+		return ErrUpstreamProxyAuth
+	case errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect"):
+		if opErr.Timeout() {
+			return ErrDialTimeout
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return ErrDialRefused
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrResponseTimeout
+	}
+	return nil
+}
+
+// classifyError returns err wrapping its class, when known and not already
+// wrapped.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var blocked *ErrBlockedByRule
+	if errors.As(err, &blocked) {
+		return err
+	}
+	class := errorClass(err)
+	if class == nil || errors.Is(err, class) {
+		return err
+	}
+	return &classError{class: class, err: err}
+}
+
+// proxyRefused returns the error of the CONNECT request refused by an
+// upstream proxy with status and body.
+func proxyRefused(status int, body []byte) error {
+	err := errors.New("proxy refused connection" + string(body))
+	if status == http.StatusProxyAuthRequired {
+		return &classError{class: ErrUpstreamProxyAuth, err: err}
+	}
+	return err
+}
+
+// ErrorClass returns the name of the class of err, for the logs and the
+// labels of the metrics: "dial_timeout", "dial_refused", "host_not_found",
+// "tls_verify", "upstream_proxy_auth", "response_timeout", "blocked",
+// "canceled", or "other" when unknown. It is empty for a nil err.
+func ErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	var blocked *ErrBlockedByRule
+	if errors.As(err, &blocked) {
+		return "blocked"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	if class := errorClass(err); class != nil {
+		for _, c := range errorClasses {
+			if c.err == class {
+				return c.name
+			}
+		}
+	}
+	return "other"
+}
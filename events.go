@@ -0,0 +1,215 @@
+package goproxy
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the type of a lifecycle Event of the proxy.
+type EventType int
+
+// The types of the events published by the proxy, and by the extensions
+// for EventAuthFailed and EventAnomalyDetected.
+const (
+	// EventConnOpened and EventConnClosed are published for the client
+	// connections of the listeners wrapped by TrackListener.
+	EventConnOpened EventType = iota + 1
+	EventConnClosed
+	// EventRequestStarted is published once a request is read, before its
+	// handlers, and EventRequestCompleted once its response is sent or it
+	// failed, MITM'd requests included.
+	EventRequestStarted
+	EventRequestCompleted
+	// EventMitmEstablished is published once the MITM handshake with the
+	// client of a tunnel is done.
+	EventMitmEstablished
+	// EventAuthFailed is published for the credentials rejected.
+	EventAuthFailed
+	// EventRuleMatched is published when the conditions of a rule named
+	// with Named match.
+	EventRuleMatched
+	// EventAnomalyDetected is published for the anomalies of the traffic
+	// detected, such as a possible exfiltration.
+	EventAnomalyDetected
+)
+
+var eventTypeNames = map[EventType]string{
+	EventConnOpened:       "conn_opened",
+	EventConnClosed:       "conn_closed",
+	EventRequestStarted:   "request_started",
+	EventRequestCompleted: "request_completed",
+	EventMitmEstablished:  "mitm_established",
+	EventAuthFailed:       "auth_failed",
+	EventRuleMatched:      "rule_matched",
+	EventAnomalyDetected:  "anomaly_detected",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event is a lifecycle event of the proxy. The fields not relevant to its
+// type are zero.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Conn describes the client connection of the connection events, with
+	// its final byte counters once closed.
+	Conn *ConnInfo
+	// Ctx and Req are the context and the request of the request events,
+	// and of the CONNECT request of EventMitmEstablished.
+	Ctx *ProxyCtx
+	Req *http.Request
+	// Resp is the response sent, nil if the request failed.
+	Resp *http.Response
+	// Host is the target of the tunnel of EventMitmEstablished.
+	Host string
+	// Rule is the name of the rule of EventRuleMatched, the scheme of the
+	// credentials of EventAuthFailed, or the detector of
+	// EventAnomalyDetected.
+	Rule string
+	// Err is the error of the request failed, the cause of EventAuthFailed,
+	// or the anomaly of EventAnomalyDetected.
+	Err error
+	// Duration is the duration of the requests completed and of the
+	// connections closed.
+	Duration time.Duration
+}
+
+type subscription struct {
+	f     func(e *Event)
+	types uint32
+}
+
+// eventBus dispatches the events to the subscriptions. The publishers test
+// wants first, so that the events nobody subscribed to aren't built.
+type eventBus struct {
+	mu sync.Mutex
+	// subs holds the []*subscription, replaced on every change.
+	subs atomic.Value
+	// types is the union of the types of subs.
+	types uint32
+}
+
+func eventMask(types []EventType) uint32 {
+	if len(types) == 0 {
+		return ^uint32(0)
+	}
+	var mask uint32
+	for _, t := range types {
+		mask |= 1 << uint(t)
+	}
+	return mask
+}
+
+func (b *eventBus) update(f func(subs []*subscription) []*subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, _ := b.subs.Load().([]*subscription)
+	subs := f(append([]*subscription(nil), old...))
+	var types uint32
+	for _, s := range subs {
+		types |= s.types
+	}
+	b.subs.Store(subs)
+	atomic.StoreUint32(&b.types, types)
+}
+
+func (b *eventBus) wants(t EventType) bool {
+	return b != nil && atomic.LoadUint32(&b.types)&(1<<uint(t)) != 0
+}
+
+func (b *eventBus) publish(e *Event) {
+	if !b.wants(e.Type) {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	subs, _ := b.subs.Load().([]*subscription)
+	for _, s := range subs {
+		if s.types&(1<<uint(e.Type)) != 0 {
+			s.f(e)
+		}
+	}
+}
+
+// Subscribe calls f with the events of the given types, all of them when
+// none is given, until the returned function is called. f is called
+// synchronously by the goroutine handling the connection or the request,
+// concurrently for different ones: it must be quick, queueing any slow
+// work, and must not modify the event, shared by the subscribers.
+func (proxy *ProxyHttpServer) Subscribe(f func(e *Event), types ...EventType) (unsubscribe func()) {
+	s := &subscription{f: f, types: eventMask(types)}
+	proxy.events.update(func(subs []*subscription) []*subscription {
+		return append(subs, s)
+	})
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			proxy.events.update(func(subs []*subscription) []*subscription {
+				for i, sub := range subs {
+					if sub == s {
+						return append(subs[:i], subs[i+1:]...)
+					}
+				}
+				return subs
+			})
+		})
+	}
+}
+
+// Publish sends e to the subscribers of its type, setting its Time if
+// zero. The extensions publish their events, such as EventAuthFailed, with
+// it.
+func (proxy *ProxyHttpServer) Publish(e *Event) {
+	proxy.events.publish(e)
+}
+
+// Publish publishes e with the proxy of ctx, setting its Ctx and Req if
+// nil.
+func (ctx *ProxyCtx) Publish(e *Event) {
+	if ctx.Proxy == nil || !ctx.Proxy.events.wants(e.Type) {
+		return
+	}
+	if e.Ctx == nil {
+		e.Ctx = ctx
+	}
+	if e.Req == nil {
+		e.Req = ctx.Req
+	}
+	ctx.Proxy.events.publish(e)
+}
+
+// requestStarted assigns the request ID of ctx and publishes its
+// EventRequestStarted, returning when it started.
+func (proxy *ProxyHttpServer) requestStarted(ctx *ProxyCtx) time.Time {
+	start := time.Now()
+	ctx.assignRequestID()
+	if proxy.events.wants(EventRequestStarted) {
+		proxy.events.publish(&Event{Type: EventRequestStarted, Time: start, Ctx: ctx, Req: ctx.Req})
+	}
+	return start
+}
+
+// requestCompleted publishes the EventRequestCompleted of ctx, answered
+// with resp.
+func (proxy *ProxyHttpServer) requestCompleted(ctx *ProxyCtx, resp *http.Response, start time.Time) {
+	if proxy.events.wants(EventRequestCompleted) {
+		now := time.Now()
+		proxy.events.publish(&Event{
+			Type:     EventRequestCompleted,
+			Time:     now,
+			Ctx:      ctx,
+			Req:      ctx.Req,
+			Resp:     resp,
+			Err:      ctx.Error,
+			Duration: now.Sub(start),
+		})
+	}
+}
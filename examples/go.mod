@@ -3,13 +3,27 @@ module github.com/InsideOutSec/goproxy/examples/goproxy-transparent
 go 1.20
 
 require (
-	github.com/coder/websocket v1.8.12
 	github.com/InsideOutSec/goproxy v1.5.0
-	github.com/InsideOutSec/goproxy/ext v0.0.0-20250117123040-e9229c451ab8
+	github.com/InsideOutSec/goproxy/ext v0.0.0-20261014092308-c19507d28739
+	github.com/coder/websocket v1.8.12
 	github.com/inconshreveable/go-vhost v1.0.0
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.7 // indirect
+	github.com/go-ldap/ldap/v3 v3.4.10 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/go-uuid v1.0.3 // indirect
+	github.com/jcmturner/aescts/v2 v2.0.0 // indirect
+	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
+	github.com/jcmturner/gofork v1.7.6 // indirect
+	github.com/jcmturner/goidentity/v6 v6.0.1 // indirect
+	github.com/jcmturner/gokrb5/v8 v8.4.4 // indirect
+	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
+	github.com/vadimi/go-http-ntlm/v2 v2.5.0 // indirect
+	github.com/vadimi/go-ntlm v1.2.1 // indirect
+	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/net v0.34.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 )
@@ -0,0 +1,112 @@
+// Package admin guards the administration endpoints of a proxy instance,
+// which expose its traffic or control it, and so must be reached neither by
+// the proxy users nor by the web pages its operator visits:
+//
+//	g := &admin.Guard{
+//		Allow: []string{"10.0.0.0/8"},
+//		Token: os.Getenv("ADMIN_TOKEN"),
+//	}
+//	http.ListenAndServe(":8081", g.Handler(mux))
+//
+// The requests must come from an allowed network, loopback by default, and
+// carry the Token when set. The requests of the browsers, which send an
+// Origin, must also come from the origin of the endpoints or one of the
+// Origins, so that a cross-site page can't drive them.
+package admin
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Guard checks the requests to the administration endpoints.
+type Guard struct {
+	// Allow lists the networks, in CIDR notation, or addresses the requests
+	// may come from, the loopback ones by default.
+	Allow []string
+	// Token, when set, must be sent as a bearer token. The browsers can't
+	// set the Authorization header of the WebSocket handshakes, so it may
+	// also be sent as the access_token query parameter.
+	Token string
+	// Origins lists the origins of the browser requests allowed besides
+	// that of the endpoints, such as "https://ui.example.com".
+	Origins []string
+	// Authorize, when set, must also accept the requests.
+	Authorize func(req *http.Request) bool
+}
+
+// Allowed returns whether req comes from an allowed network.
+func (g *Guard) Allowed(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if len(g.Allow) == 0 {
+		return ip.IsLoopback()
+	}
+	for _, a := range g.Allow {
+		if _, network, err := net.ParseCIDR(a); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(a); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorized returns whether req carries the Token, and is accepted by
+// Authorize.
+func (g *Guard) Authorized(req *http.Request) bool {
+	if g.Token != "" {
+		token := req.URL.Query().Get("access_token")
+		if auth := req.Header.Get("Authorization"); auth != "" {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(g.Token)) != 1 {
+			return false
+		}
+	}
+	return g.Authorize == nil || g.Authorize(req)
+}
+
+// OriginAllowed returns whether req has no Origin, or that of the
+// endpoints or one of the Origins.
+func (g *Guard) OriginAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range g.Origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+// Handler returns h answering the requests rejected by g with 403, or 401
+// without the Token.
+func (g *Guard) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.Allowed(r) || !g.OriginAllowed(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !g.Authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
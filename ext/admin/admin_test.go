@@ -0,0 +1,46 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy/ext/admin"
+)
+
+func TestGuard(t *testing.T) {
+	g := &admin.Guard{
+		Allow:   []string{"10.0.0.0/8"},
+		Token:   "secret",
+		Origins: []string{"https://ui.example.com"},
+	}
+	h := g.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		remote, target, token, origin string
+		code                          int
+	}{
+		{"10.1.2.3:1", "/", "secret", "", http.StatusOK},
+		{"10.1.2.3:1", "/?access_token=secret", "", "", http.StatusOK},
+		{"10.1.2.3:1", "/", "secret", "http://admin.local", http.StatusOK},
+		{"10.1.2.3:1", "/", "secret", "https://ui.example.com", http.StatusOK},
+		{"10.1.2.3:1", "/", "secret", "https://evil.example", http.StatusForbidden},
+		{"10.1.2.3:1", "/", "secret", "null", http.StatusForbidden},
+		{"127.0.0.1:1", "/", "secret", "", http.StatusForbidden},
+		{"10.1.2.3:1", "/?access_token=wrong", "", "", http.StatusUnauthorized},
+		{"10.1.2.3:1", "/", "", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://admin.local"+tt.target, nil)
+		req.RemoteAddr = tt.remote
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s %s with %q from %q: %d, want %d", tt.remote, tt.target, tt.token, tt.origin, rec.Code, tt.code)
+		}
+	}
+}
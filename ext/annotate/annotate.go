@@ -0,0 +1,167 @@
+// Package annotate adds to the responses of the proxy diagnostic headers
+// telling what the proxy did, for the developers of its clients:
+//
+//	X-Proxy-Request-Id  the ID of the request in the proxy logs
+//	X-Proxy-Rules       the named rules that matched, see ReqProxyConds.Named
+//	X-Proxy-Cache       the cache status, from the X-Cache of ext/cache
+//	X-Proxy-Upstream    the upstream host, and the address connected to
+//	X-Proxy-Mitm        1 when the request was MITM'd
+//	Server-Timing       the timing of the upstream exchange, shown by the
+//	                    developer tools of the browsers
+//
+// The headers reveal the configuration of the proxy, so they are only
+// added for the clients of the Allow networks and, in OnDemand mode, for
+// the requests having the X-Proxy-Debug header:
+//
+//	a := &annotate.Annotator{Allow: []string{"10.0.0.0/8"}, OnDemand: true}
+//	a.Install(proxy)
+package annotate
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// DebugHeader is the request header asking for the annotations in
+// OnDemand mode. It isn't sent upstream.
+const DebugHeader = "X-Proxy-Debug"
+
+// Annotator adds the diagnostic headers to the responses.
+type Annotator struct {
+	// Allow lists the networks, in CIDR notation, or the addresses of the
+	// clients whose responses are annotated. Empty, every client is.
+	Allow []string
+	// OnDemand annotates only the responses of the requests having the
+	// DebugHeader.
+	OnDemand bool
+
+	once    sync.Once
+	allowed []*net.IPNet
+	mu      sync.Mutex
+	pending map[int64]bool
+}
+
+func (a *Annotator) init() {
+	a.once.Do(func() {
+		a.pending = make(map[int64]bool)
+		for _, s := range a.Allow {
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			if _, n, err := net.ParseCIDR(s); err == nil {
+				a.allowed = append(a.allowed, n)
+			}
+		}
+	})
+}
+
+// trusted returns whether the client of req is allowed.
+func (a *Annotator) trusted(req *http.Request) bool {
+	if len(a.Allow) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnRequest decides whether the response of the request is annotated. It
+// removes the DebugHeader.
+func (a *Annotator) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	a.init()
+	asked := req.Header.Get(DebugHeader) != ""
+	req.Header.Del(DebugHeader)
+	if (a.OnDemand && !asked) || !a.trusted(req) {
+		return req, nil
+	}
+	a.mu.Lock()
+	a.pending[ctx.Session] = true
+	a.mu.Unlock()
+	return req, nil
+}
+
+// OnResponse annotates the response.
+func (a *Annotator) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	a.init()
+	a.mu.Lock()
+	annotate := a.pending[ctx.Session]
+	delete(a.pending, ctx.Session)
+	a.mu.Unlock()
+	if !annotate || resp == nil {
+		return resp
+	}
+	h := resp.Header
+	h.Set("X-Proxy-Request-Id", ctx.RequestID())
+	if rules := ctx.MatchedRules(); len(rules) > 0 {
+		h.Set("X-Proxy-Rules", strings.Join(rules, ", "))
+	}
+	if status := h.Get("X-Cache"); status != "" {
+		h.Set("X-Proxy-Cache", status)
+	}
+	if ctx.IsMitm() {
+		h.Set("X-Proxy-Mitm", "1")
+	}
+	timing := ctx.Timing()
+	if timing == nil {
+		// Answered by the handlers.
+		h.Set("X-Proxy-Upstream", "none")
+		return resp
+	}
+	upstream := ctx.Req.URL.Host
+	if timing.RemoteAddr != "" {
+		upstream += " (" + timing.RemoteAddr + ")"
+	}
+	h.Set("X-Proxy-Upstream", upstream)
+	h.Add("Server-Timing", serverTiming(timing))
+	return resp
+}
+
+// serverTiming returns the Server-Timing of timing, without the transfer of
+// the body, not done yet.
+func serverTiming(t *goproxy.Timing) string {
+	var metrics []string
+	add := func(name string, d time.Duration) {
+		if d > 0 {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%.1f", name, float64(d)/float64(time.Millisecond)))
+		}
+	}
+	add("dns", t.DNS())
+	add("connect", t.Connect())
+	add("tls", t.TLS())
+	add("ttfb", t.TTFB())
+	if !t.FirstByte.IsZero() {
+		add("upstream", t.FirstByte.Sub(t.Start))
+	}
+	if t.Reused {
+		metrics = append(metrics, `conn;desc="reused"`)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// Install annotates the responses of proxy. It must be installed before
+// the handlers, to annotate the responses they answer.
+func (a *Annotator) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(a.OnRequest)
+	proxy.OnResponse().DoFunc(a.OnResponse)
+}
@@ -0,0 +1,83 @@
+package annotate_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/annotate"
+)
+
+func TestAnnotator(t *testing.T) {
+	var debug string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		debug = r.Header.Get(annotate.DebugHeader)
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	a := &annotate.Annotator{Allow: []string{"127.0.0.1"}, OnDemand: true}
+	proxy := goproxy.NewProxyHttpServer()
+	a.Install(proxy)
+	proxy.OnRequest(goproxy.UrlHasPrefix("/api")).Named("api").DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, nil
+	})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/blocked")).Named("block").DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked")
+	})
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(path string, ask bool) http.Header {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, backend.URL+path, nil)
+		if ask {
+			req.Header.Set(annotate.DebugHeader, "1")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.Header
+	}
+
+	if h := get("/api", false); h.Get("X-Proxy-Request-Id") != "" {
+		t.Errorf("Expected no annotation without %s, got %v", annotate.DebugHeader, h)
+	}
+	h := get("/api", true)
+	if debug != "" {
+		t.Error("Expected the debug header removed upstream")
+	}
+	if h.Get("X-Proxy-Request-Id") == "" || h.Get("X-Proxy-Rules") != "api" {
+		t.Errorf("Unexpected annotations %v", h)
+	}
+	if upstream := h.Get("X-Proxy-Upstream"); !strings.HasPrefix(upstream, backend.Listener.Addr().String()+" (") {
+		t.Errorf("Unexpected upstream %q", upstream)
+	}
+	if timing := h.Get("Server-Timing"); !strings.Contains(timing, "ttfb;dur=") {
+		t.Errorf("Unexpected Server-Timing %q", timing)
+	}
+
+	h = get("/blocked", true)
+	if h.Get("X-Proxy-Rules") != "block" || h.Get("X-Proxy-Upstream") != "none" || h.Get("Server-Timing") != "" {
+		t.Errorf("Unexpected annotations of a blocked request %v", h)
+	}
+
+	// The other clients aren't trusted.
+	a = &annotate.Annotator{Allow: []string{"10.0.0.0/8"}}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ctx := &goproxy.ProxyCtx{Req: req, Proxy: proxy, Session: 1}
+	a.OnRequest(req, ctx)
+	resp := a.OnResponse(goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, ""), ctx)
+	if resp.Header.Get("X-Proxy-Request-Id") != "" {
+		t.Errorf("Expected no annotation for an untrusted client, got %v", resp.Header)
+	}
+}
@@ -0,0 +1,491 @@
+// Package archive lists the files of the archives downloaded, the zip, tar
+// and gzip files, so that the policies act on their content:
+//
+//	in := archive.New()
+//	proxy.OnResponse().Do(in)
+//	proxy.OnResponse(archive.Contains("*.exe", "*.scr")).DoFunc(block)
+//
+// The archives are buffered, up to MaxSize, and decompressed within the
+// limits of the Inspector, the archives exceeding them, such as the zip
+// bombs, being rejected. The responses with a Content-Encoding aren't
+// inspected.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ErrBomb is the error of the archives exceeding the limits of the
+// Inspector.
+var ErrBomb = errors.New("archive: limits exceeded")
+
+// Entry is a file of an archive.
+type Entry struct {
+	// Name is the path of the file in the archive, prefixed by the names of
+	// the nested archives containing it.
+	Name string
+	// Size is the uncompressed size, as declared by the zip and tar
+	// archives.
+	Size int64
+	// DetectedType is the type detected from the content, as by
+	// http.DetectContentType, empty for the directories and the encrypted
+	// files.
+	DetectedType string
+	Dir          bool
+	Encrypted    bool
+	// Depth is the nesting of the archive containing the file, 0 for the
+	// archive downloaded.
+	Depth int
+}
+
+// Listing is the listing of an archive.
+type Listing struct {
+	// Format is "zip", "tar" or "gzip".
+	Format  string
+	Entries []Entry
+	// Err is the error which stopped the listing, such as a corrupt
+	// archive, the entries being those listed before.
+	Err error
+}
+
+// Inspector lists the archives of the responses it handles.
+type Inspector struct {
+	// MaxSize bounds the archives inspected, and the nested archives
+	// opened, 32 MiB by default.
+	MaxSize int64
+	// BlockOversize rejects the archives above MaxSize, which can't be
+	// inspected, instead of sending them without listing.
+	BlockOversize bool
+	// MaxUncompressed bounds the total size of the files, 1 GiB by
+	// default.
+	MaxUncompressed int64
+	// MaxRatio bounds the compression ratio of the files, 100 by default.
+	MaxRatio int64
+	// MaxEntries bounds the number of files, 10000 by default.
+	MaxEntries int
+	// MaxDepth bounds the nesting of the archives opened, 2 by default. The
+	// archives nested deeper are listed, but not opened.
+	MaxDepth int
+	// Check, when set, checks the listings: an error rejects the response
+	// with 403 Forbidden, the error being the reason.
+	Check func(l *Listing, ctx *goproxy.ProxyCtx) error
+}
+
+// New returns an Inspector with the default settings.
+func New() *Inspector {
+	return &Inspector{}
+}
+
+// archiveTypes are the content types inspected.
+var archiveTypes = map[string]bool{
+	"application/zip":              true,
+	"application/x-zip-compressed": true,
+	"application/x-tar":            true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-gtar":           true,
+	"application/x-compressed-tar": true,
+	"application/octet-stream":     true,
+	"binary/octet-stream":          true,
+}
+
+type listingKey struct{}
+
+// Of returns the listing of the archive of the response of ctx, nil when it
+// wasn't inspected.
+func Of(ctx *goproxy.ProxyCtx) *Listing {
+	l, _ := ctx.Value(listingKey{}).(*Listing)
+	return l
+}
+
+// format returns the format of the archive starting with data, empty when
+// it isn't an archive.
+func format(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(data, []byte("\x1f\x8b")):
+		return "gzip"
+	case len(data) >= 262 && string(data[257:262]) == "ustar":
+		return "tar"
+	}
+	return ""
+}
+
+func detect(data []byte) string {
+	switch format(data) {
+	case "gzip":
+		return "application/gzip"
+	case "tar":
+		return "application/x-tar"
+	}
+	return http.DetectContentType(data)
+}
+
+// lister lists an archive within the limits of the Inspector.
+type lister struct {
+	in           *Inspector
+	listing      *Listing
+	declared     int64
+	uncompressed int64
+}
+
+func (l *lister) maxUncompressed() int64 {
+	if l.in.MaxUncompressed > 0 {
+		return l.in.MaxUncompressed
+	}
+	return 1 << 30
+}
+
+func (l *lister) maxRatio() int64 {
+	if l.in.MaxRatio > 0 {
+		return l.in.MaxRatio
+	}
+	return 100
+}
+
+func (l *lister) maxSize() int64 {
+	if l.in.MaxSize > 0 {
+		return l.in.MaxSize
+	}
+	return 32 << 20
+}
+
+func (l *lister) add(e Entry) error {
+	maxEntries := l.in.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	if len(l.listing.Entries) >= maxEntries {
+		return fmt.Errorf("%w: more than %d files", ErrBomb, maxEntries)
+	}
+	l.declared += e.Size
+	if l.declared > l.maxUncompressed() {
+		return fmt.Errorf("%w: more than %d bytes uncompressed", ErrBomb, l.maxUncompressed())
+	}
+	l.listing.Entries = append(l.listing.Entries, e)
+	return nil
+}
+
+// counter counts the bytes decompressed by the lister.
+type counter struct {
+	r io.Reader
+	l *lister
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.l.uncompressed += int64(n)
+	if c.l.uncompressed > c.l.maxUncompressed() {
+		return n, fmt.Errorf("%w: more than %d bytes uncompressed", ErrBomb, c.l.maxUncompressed())
+	}
+	return n, err
+}
+
+// content returns the head of the file of r, and the whole file when it is
+// an archive to open.
+func (l *lister) content(r io.Reader, depth int) (head, whole []byte, err error) {
+	br := bufio.NewReaderSize(r, 512)
+	head, err = br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+	head = append([]byte(nil), head...)
+	maxDepth := l.in.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = 2
+	}
+	if format(head) == "" || depth >= maxDepth {
+		return head, nil, nil
+	}
+	whole, err = io.ReadAll(io.LimitReader(br, l.maxSize()+1))
+	if err != nil {
+		return head, nil, err
+	}
+	if int64(len(whole)) > l.maxSize() {
+		return head, nil, nil
+	}
+	return head, whole, nil
+}
+
+func (l *lister) list(prefix string, data []byte, depth int) error {
+	switch format(data) {
+	case "zip":
+		return l.listZip(prefix, data, depth)
+	case "gzip":
+		return l.listGzip(prefix, bytes.NewReader(data), depth)
+	case "tar":
+		return l.listTar(prefix, bytes.NewReader(data), depth)
+	}
+	return nil
+}
+
+func (l *lister) listZip(prefix string, data []byte, depth int) error {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		e := Entry{
+			Name:      prefix + f.Name,
+			Size:      int64(f.UncompressedSize64),
+			Dir:       strings.HasSuffix(f.Name, "/"),
+			Encrypted: f.Flags&0x1 != 0,
+			Depth:     depth,
+		}
+		if f.CompressedSize64 > 0 && e.Size > 1<<20 && e.Size/int64(f.CompressedSize64) > l.maxRatio() {
+			return fmt.Errorf("%w: %s compressed more than %d times", ErrBomb, e.Name, l.maxRatio())
+		}
+		if err := l.add(e); err != nil {
+			return err
+		}
+		if e.Dir || e.Encrypted {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		head, whole, err := l.content(&counter{io.LimitReader(rc, e.Size), l}, depth)
+		rc.Close()
+		if errors.Is(err, ErrBomb) {
+			return err
+		}
+		l.listing.Entries[len(l.listing.Entries)-1].DetectedType = detect(head)
+		if whole != nil {
+			if err := l.list(e.Name+"/", whole, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *lister) listTar(prefix string, r io.Reader, depth int) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := Entry{
+			Name:  prefix + h.Name,
+			Size:  h.Size,
+			Dir:   h.Typeflag == tar.TypeDir,
+			Depth: depth,
+		}
+		if err := l.add(e); err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		head, whole, err := l.content(tr, depth)
+		if err != nil {
+			return err
+		}
+		l.listing.Entries[len(l.listing.Entries)-1].DetectedType = detect(head)
+		if whole != nil {
+			if err := l.list(e.Name+"/", whole, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// listGzip lists the tar archive compressed by r, or its single file.
+func (l *lister) listGzip(prefix string, r io.Reader, depth int) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	br := bufio.NewReaderSize(&counter{gz, l}, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if format(head) == "tar" {
+		return l.listTar(prefix, br, depth)
+	}
+	name := gz.Name
+	if name == "" {
+		name = "content"
+	}
+	if err := l.add(Entry{Name: prefix + name, DetectedType: detect(head), Depth: depth}); err != nil {
+		return err
+	}
+	i := len(l.listing.Entries) - 1
+	start := l.uncompressed
+	_, whole, err := l.content(br, depth)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return err
+	}
+	l.listing.Entries[i].Size = l.uncompressed - start
+	if whole != nil {
+		return l.list(prefix+name+"/", whole, depth+1)
+	}
+	return nil
+}
+
+// List returns the listing of the archive data, nil when it isn't an
+// archive.
+func (in *Inspector) List(data []byte) *Listing {
+	f := format(data)
+	if f == "" {
+		return nil
+	}
+	l := &lister{in: in, listing: &Listing{Format: f}}
+	l.listing.Err = l.list("", data, 0)
+	if l.listing.Err == nil && l.uncompressed > 1<<20 && l.uncompressed/int64(len(data)) > l.maxRatio() {
+		l.listing.Err = fmt.Errorf("%w: compressed more than %d times", ErrBomb, l.maxRatio())
+	}
+	return l.listing
+}
+
+func (in *Inspector) block(resp *http.Response, ctx *goproxy.ProxyCtx, status int, reason string) *http.Response {
+	ctx.Warnf("archive: rejecting %v: %s", ctx.Req.URL, reason)
+	resp.Body.Close()
+	ctx.Error = &goproxy.ErrBlockedByRule{RuleID: "archive", Reason: reason}
+	return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, status, "Download rejected: "+reason)
+}
+
+// Handle implements goproxy.RespHandler, listing the archives.
+func (in *Inspector) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return resp
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return resp
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !archiveTypes[mediaType] {
+		return resp
+	}
+	limit := in.MaxSize
+	if limit <= 0 {
+		limit = 32 << 20
+	}
+	if resp.ContentLength > limit && !in.BlockOversize {
+		return resp
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		ctx.Warnf("archive: can't read %v: %v", ctx.Req.URL, err)
+		resp.Body.Close()
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot read the download")
+	}
+	if int64(len(data)) > limit {
+		if in.BlockOversize {
+			return in.block(resp, ctx, http.StatusForbidden, "archive too large to be inspected")
+		}
+		ctx.Logf("archive: %v is too large to be inspected", ctx.Req.URL)
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return resp
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+
+	listing := in.List(data)
+	if listing == nil {
+		return resp
+	}
+	ctx.SetValue(listingKey{}, listing)
+	if errors.Is(listing.Err, ErrBomb) {
+		return in.block(resp, ctx, http.StatusForbidden, listing.Err.Error())
+	}
+	if listing.Err != nil {
+		ctx.Logf("archive: can't list %v entirely: %v", ctx.Req.URL, listing.Err)
+	}
+	if in.Check != nil {
+		if err := in.Check(listing, ctx); err != nil {
+			return in.block(resp, ctx, http.StatusForbidden, err.Error())
+		}
+	}
+	return resp
+}
+
+// HasEntry returns a RespCondition testing whether a file of the archive of
+// the response, listed by an Inspector, matches.
+func HasEntry(match func(e *Entry) bool) goproxy.RespConditionFunc {
+	return func(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+		l := Of(ctx)
+		if l == nil {
+			return false
+		}
+		for i := range l.Entries {
+			if match(&l.Entries[i]) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Contains returns a RespCondition testing whether the archive has a file
+// whose name matches one of the patterns of path.Match, case-insensitively.
+// The patterns without a slash match the base names of the files.
+func Contains(patterns ...string) goproxy.RespConditionFunc {
+	return HasEntry(func(e *Entry) bool {
+		if e.Dir {
+			return false
+		}
+		name := strings.ToLower(e.Name)
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			subject := name
+			if !strings.Contains(pattern, "/") {
+				subject = path.Base(name)
+			}
+			if ok, _ := path.Match(pattern, subject); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ContainsType returns a RespCondition testing whether the archive has a
+// file of one of the media types detected.
+func ContainsType(types ...string) goproxy.RespConditionFunc {
+	return HasEntry(func(e *Entry) bool {
+		mediaType, _, _ := mime.ParseMediaType(e.DetectedType)
+		for _, t := range types {
+			if mediaType != "" && strings.EqualFold(t, mediaType) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ContainsEncrypted returns a RespCondition testing whether the archive has
+// encrypted files, which can't be inspected.
+func ContainsEncrypted() goproxy.RespConditionFunc {
+	return HasEntry(func(e *Entry) bool {
+		return e.Encrypted
+	})
+}
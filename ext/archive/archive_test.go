@@ -0,0 +1,150 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/archive"
+)
+
+func zipOf(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(data)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func download(contentType string, data []byte) (*http.Response, *goproxy.ProxyCtx) {
+	req := httptest.NewRequest(http.MethodGet, "http://download.example.com/file", nil)
+	ctx := &goproxy.ProxyCtx{Req: req, Proxy: goproxy.NewProxyHttpServer()}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(bytes.NewReader(data)),
+		Request:    req,
+	}
+	return resp, ctx
+}
+
+func TestInspector(t *testing.T) {
+	inner := zipOf(t, map[string][]byte{"setup.exe": []byte("MZ\x90\x00 binary")})
+	data := zipOf(t, map[string][]byte{
+		"docs/readme.txt": []byte("read me"),
+		"bundle.zip":      inner,
+	})
+	in := archive.New()
+	resp, ctx := download("application/zip", data)
+	resp = in.Handle(resp, ctx)
+	l := archive.Of(ctx)
+	if l == nil || l.Format != "zip" || l.Err != nil || len(l.Entries) != 3 {
+		t.Fatalf("Expected the listing of the nested archives, got %+v", l)
+	}
+	entries := map[string]archive.Entry{}
+	for _, e := range l.Entries {
+		entries[e.Name] = e
+	}
+	if e := entries["bundle.zip/setup.exe"]; e.Depth != 1 || e.DetectedType != "application/octet-stream" {
+		t.Errorf("Expected the file of the nested archive, got %+v", entries)
+	}
+	if e := entries["docs/readme.txt"]; e.Size != 7 || e.DetectedType != "text/plain; charset=utf-8" {
+		t.Errorf("Expected the text file, got %+v", e)
+	}
+	if !archive.Contains("*.EXE")(resp, ctx) || archive.Contains("*.dll", "docs/*.exe")(resp, ctx) || !archive.Contains("docs/*")(resp, ctx) {
+		t.Error("Expected the names of the files to match")
+	}
+	if !archive.ContainsType("application/zip")(resp, ctx) || archive.ContainsEncrypted()(resp, ctx) {
+		t.Error("Expected the types of the files to match")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, data) {
+		t.Error("Expected the archive to be sent unchanged")
+	}
+
+	in.Check = func(l *archive.Listing, ctx *goproxy.ProxyCtx) error {
+		if archive.Contains("*.exe")(nil, ctx) {
+			return errors.New("executable in archive")
+		}
+		return nil
+	}
+	resp, ctx = download("application/octet-stream", data)
+	if resp = in.Handle(resp, ctx); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the executable to be rejected, got %d", resp.StatusCode)
+	}
+	var blocked *goproxy.ErrBlockedByRule
+	if !errors.As(ctx.Error, &blocked) || blocked.Reason != "executable in archive" {
+		t.Errorf("Expected the download to be blocked, got %v", ctx.Error)
+	}
+
+	resp, ctx = download("text/html", data)
+	if in.Handle(resp, ctx); archive.Of(ctx) != nil {
+		t.Error("Expected the other types not to be inspected")
+	}
+}
+
+func TestTarGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755})
+	tw.WriteHeader(&tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, Size: 8})
+	tw.Write([]byte("\x7fELF bin"))
+	tw.Close()
+	gz.Close()
+
+	resp, ctx := download("application/gzip", buf.Bytes())
+	archive.New().Handle(resp, ctx)
+	l := archive.Of(ctx)
+	if l == nil || l.Format != "gzip" || len(l.Entries) != 2 {
+		t.Fatalf("Expected the files of the tar archive, got %+v", l)
+	}
+	if e := l.Entries[1]; e.Name != "bin/tool" || e.Size != 8 || !l.Entries[0].Dir {
+		t.Errorf("Expected the tool, got %+v", l.Entries)
+	}
+}
+
+func TestBomb(t *testing.T) {
+	data := zipOf(t, map[string][]byte{"zeros": make([]byte, 8<<20)})
+	resp, ctx := download("application/zip", data)
+	if resp = archive.New().Handle(resp, ctx); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the zip bomb to be rejected, got %d", resp.StatusCode)
+	}
+	if l := archive.Of(ctx); l == nil || !errors.Is(l.Err, archive.ErrBomb) {
+		t.Errorf("Expected the zip bomb to be detected, got %+v", l)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(make([]byte, 4<<20))
+	gz.Close()
+	resp, ctx = download("application/gzip", buf.Bytes())
+	in := &archive.Inspector{MaxUncompressed: 1 << 20, MaxRatio: 10000}
+	if resp = in.Handle(resp, ctx); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the gzip bomb to be rejected, got %d", resp.StatusCode)
+	}
+
+	files := map[string][]byte{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		files[name] = nil
+	}
+	resp, ctx = download("application/zip", zipOf(t, files))
+	in = &archive.Inspector{MaxEntries: 3}
+	if resp = in.Handle(resp, ctx); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the archive with too many files to be rejected, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,473 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// Authenticator implements a proxy authentication scheme.
+type Authenticator interface {
+	// Scheme returns the name of the scheme, such as Basic.
+	Scheme() string
+	// Challenge returns the Proxy-Authenticate value advertising the scheme.
+	Challenge(req *http.Request) string
+	// Authenticate verifies the credentials of the Proxy-Authorization
+	// header, without the scheme name. Multi-legged schemes return a
+	// *ChallengeError to continue the negotiation.
+	Authenticate(req *http.Request, credentials string) (*goproxy.Identity, error)
+}
+
+// ChallengeError is returned by an Authenticator to answer with a specific
+// challenge instead of the initial ones.
+type ChallengeError struct {
+	Challenge string
+}
+
+func (e *ChallengeError) Error() string {
+	return "auth: challenge " + e.Challenge
+}
+
+var ErrNoCredentials = errors.New("auth: no credentials")
+
+var errUnsupportedScheme = errors.New("auth: unsupported scheme")
+
+// ProxyAuth requires the proxy clients to authenticate with one of several
+// schemes, all advertised in the 407 responses.
+//
+// When ConnectionTTL is set, the identity is cached for the client
+// connection, so that clients using connection-based schemes such as
+// Negotiate don't have to authenticate every request. Setting ConnState as
+// the http.Server ConnState hook forgets the connections once closed.
+type ProxyAuth struct {
+	Authenticators []Authenticator
+	ConnectionTTL  time.Duration
+	// Mitm selects how the requests of MITM'd connections are authenticated.
+	Mitm MitmAuth
+
+	mu    sync.Mutex
+	conns map[string]connIdentity
+}
+
+type connIdentity struct {
+	identity *goproxy.Identity
+	expires  time.Time
+}
+
+// MitmAuth is the authentication policy of the requests of MITM'd
+// connections.
+type MitmAuth int
+
+const (
+	// MitmInherit authorizes the requests with the identity established by
+	// the CONNECT request. Requests without identity are handled as with
+	// MitmProxy.
+	MitmInherit MitmAuth = iota
+	// MitmProxy requires every request to carry a Proxy-Authorization
+	// header, challenged with 407 responses. Only clients that know they're
+	// intercepted send it.
+	MitmProxy
+	// MitmOrigin requires every request to carry an Authorization header,
+	// challenged with 401 responses since the client believes it's talking
+	// to the origin server. The header is removed once verified, so this
+	// can't be used for sites requiring their own authentication, and must
+	// be set explicitly.
+	MitmOrigin
+)
+
+// NewProxyAuth returns a ProxyAuth accepting the given schemes, in order of
+// preference.
+func NewProxyAuth(authenticators ...Authenticator) *ProxyAuth {
+	return &ProxyAuth{Authenticators: authenticators}
+}
+
+func (a *ProxyAuth) cached(req *http.Request) *goproxy.Identity {
+	if a.ConnectionTTL <= 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.conns[req.RemoteAddr]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(c.expires) {
+		delete(a.conns, req.RemoteAddr)
+		return nil
+	}
+	return c.identity
+}
+
+func (a *ProxyAuth) cache(req *http.Request, id *goproxy.Identity) {
+	if a.ConnectionTTL <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conns == nil {
+		a.conns = make(map[string]connIdentity)
+	}
+	a.conns[req.RemoteAddr] = connIdentity{identity: id, expires: time.Now().Add(a.ConnectionTTL)}
+}
+
+// ConnState forgets the identity of the closed connections.
+func (a *ProxyAuth) ConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed {
+		return
+	}
+	a.mu.Lock()
+	delete(a.conns, c.RemoteAddr().String())
+	a.mu.Unlock()
+}
+
+// Authenticate verifies the Proxy-Authorization header of req. It returns
+// the identity of the client, or the 407 response to send.
+func (a *ProxyAuth) Authenticate(req *http.Request, ctx *goproxy.ProxyCtx) (*goproxy.Identity, *http.Response) {
+	return a.authenticate(req, ctx, proxyAuthorizationHeader, true)
+}
+
+func (a *ProxyAuth) authenticate(req *http.Request, ctx *goproxy.ProxyCtx, headerName string, useCache bool) (*goproxy.Identity, *http.Response) {
+	header := req.Header.Get(headerName)
+	req.Header.Del(headerName)
+	if header == "" {
+		if useCache {
+			if id := a.cached(req); id != nil {
+				return id, nil
+			}
+		}
+		return nil, a.challenge(req, headerName)
+	}
+
+	scheme, credentials, _ := strings.Cut(header, " ")
+	for _, auth := range a.Authenticators {
+		if !strings.EqualFold(auth.Scheme(), scheme) {
+			continue
+		}
+		id, err := auth.Authenticate(req, strings.TrimSpace(credentials))
+		var challenge *ChallengeError
+		switch {
+		case err == nil:
+			a.cache(req, id)
+			return id, nil
+		case errors.As(err, &challenge):
+			if headerName == proxyAuthorizationHeader {
+				return nil, unauthorized(req, []string{challenge.Challenge}, false)
+			}
+			return nil, originUnauthorized(req, []string{challenge.Challenge})
+		default:
+			ctx.Logf("%s authentication failed: %v", auth.Scheme(), err)
+			ctx.Publish(&goproxy.Event{Type: goproxy.EventAuthFailed, Req: req, Rule: auth.Scheme(), Err: err})
+			return nil, a.challenge(req, headerName)
+		}
+	}
+	ctx.Publish(&goproxy.Event{Type: goproxy.EventAuthFailed, Req: req, Rule: scheme, Err: errUnsupportedScheme})
+	return nil, a.challenge(req, headerName)
+}
+
+func (a *ProxyAuth) challenges(req *http.Request) []string {
+	challenges := make([]string, 0, len(a.Authenticators))
+	for _, auth := range a.Authenticators {
+		challenges = append(challenges, auth.Challenge(req))
+	}
+	return challenges
+}
+
+func (a *ProxyAuth) challenge(req *http.Request, headerName string) *http.Response {
+	if headerName == proxyAuthorizationHeader {
+		return a.Unauthorized(req)
+	}
+	return originUnauthorized(req, a.challenges(req))
+}
+
+// Unauthorized returns a 407 response advertising all the schemes.
+func (a *ProxyAuth) Unauthorized(req *http.Request) *http.Response {
+	return unauthorized(req, a.challenges(req), true)
+}
+
+func unauthorized(req *http.Request, challenges []string, closeConn bool) *http.Response {
+	header := http.Header{"Proxy-Authenticate": challenges}
+	if closeConn {
+		header.Set("Proxy-Connection", "close")
+	}
+	return &http.Response{
+		StatusCode:    http.StatusProxyAuthRequired,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(unauthorizedMsg)),
+		ContentLength: int64(len(unauthorizedMsg)),
+	}
+}
+
+var originUnauthorizedMsg = []byte("401 Unauthorized")
+
+// originUnauthorized returns the 401 response challenging the client of a
+// MITM'd connection.
+func originUnauthorized(req *http.Request, challenges []string) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusUnauthorized,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Www-Authenticate": challenges},
+		Body:          io.NopCloser(bytes.NewReader(originUnauthorizedMsg)),
+		ContentLength: int64(len(originUnauthorizedMsg)),
+	}
+}
+
+// Handler returns an authentication handler for requests. The requests of
+// MITM'd connections are authenticated according to a.Mitm.
+func (a *ProxyAuth) Handler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		var id *goproxy.Identity
+		var resp *http.Response
+		switch {
+		case !ctx.IsMitm():
+			id, resp = a.Authenticate(req, ctx)
+		case a.Mitm == MitmInherit && ctx.Identity != nil:
+			return req, nil
+		case a.Mitm == MitmOrigin:
+			id, resp = a.authenticate(req, ctx, "Authorization", false)
+		default:
+			id, resp = a.authenticate(req, ctx, proxyAuthorizationHeader, false)
+		}
+		if resp != nil {
+			return nil, resp
+		}
+		ctx.Identity = id
+		return req, nil
+	})
+}
+
+// ConnectHandler returns an authentication handler for CONNECT requests.
+func (a *ProxyAuth) ConnectHandler() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		id, resp := a.Authenticate(ctx.Req, ctx)
+		if resp != nil {
+			ctx.Resp = resp
+			return goproxy.RejectConnect, host
+		}
+		ctx.Identity = id
+		return nil, host
+	})
+}
+
+// Install forces authentication before any request to the proxy is processed.
+func (a *ProxyAuth) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(a.Handler())
+	proxy.OnRequest().HandleConnect(a.ConnectHandler())
+}
+
+// BasicAuthenticator implements the Basic scheme.
+type BasicAuthenticator struct {
+	Realm string
+	// Verify checks the credentials, it can be the Authenticate method of
+	// the LDAP, RADIUS or TACACS backends.
+	Verify func(user, passwd string) (*goproxy.Identity, error)
+}
+
+func (b *BasicAuthenticator) Scheme() string { return "Basic" }
+
+func (b *BasicAuthenticator) Challenge(*http.Request) string {
+	return "Basic realm=" + b.Realm
+}
+
+func (b *BasicAuthenticator) Authenticate(_ *http.Request, credentials string) (*goproxy.Identity, error) {
+	raw, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, err
+	}
+	user, passwd, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return b.Verify(user, passwd)
+}
+
+// DigestAuthenticator implements the Digest scheme with MD5 and qop=auth.
+// Nonces are stateless and expire after NonceTTL, 5 minutes by default.
+type DigestAuthenticator struct {
+	Realm string
+	// Password returns the password of user.
+	Password func(user string) (string, bool)
+	NonceTTL time.Duration
+
+	once sync.Once
+	key  []byte
+}
+
+var ErrDigestMismatch = errors.New("auth: digest mismatch")
+
+func (d *DigestAuthenticator) Scheme() string { return "Digest" }
+
+func (d *DigestAuthenticator) nonceMAC(ts []byte) []byte {
+	d.once.Do(func() {
+		d.key = make([]byte, 32)
+		_, _ = rand.Read(d.key)
+	})
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(ts)
+	return mac.Sum(nil)[:16]
+}
+
+func (d *DigestAuthenticator) challenge(stale bool) string {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+	nonce := hex.EncodeToString(ts) + hex.EncodeToString(d.nonceMAC(ts))
+	c := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`, d.Realm, nonce)
+	if stale {
+		c += ", stale=true"
+	}
+	return c
+}
+
+func (d *DigestAuthenticator) Challenge(*http.Request) string {
+	return d.challenge(false)
+}
+
+// checkNonce returns whether the nonce was issued by d, and if it's still
+// fresh.
+func (d *DigestAuthenticator) checkNonce(nonce string) (valid, fresh bool) {
+	raw, err := hex.DecodeString(nonce)
+	if err != nil || len(raw) != 24 {
+		return false, false
+	}
+	if !hmac.Equal(raw[8:], d.nonceMAC(raw[:8])) {
+		return false, false
+	}
+	ttl := d.NonceTTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return true, time.Since(issued) <= ttl
+}
+
+func (d *DigestAuthenticator) Authenticate(req *http.Request, credentials string) (*goproxy.Identity, error) {
+	params := map[string]string{}
+	for _, p := range splitDigestParams(credentials) {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	user := params["username"]
+	if params["realm"] != d.Realm || user == "" {
+		return nil, ErrDigestMismatch
+	}
+	// Clients disagree on whether the uri of a proxied request is absolute.
+	if req.RequestURI != "" && params["uri"] != req.RequestURI && params["uri"] != req.URL.RequestURI() {
+		return nil, ErrDigestMismatch
+	}
+	valid, fresh := d.checkNonce(params["nonce"])
+	if !valid {
+		return nil, ErrDigestMismatch
+	}
+	passwd, ok := d.Password(user)
+	if !ok {
+		return nil, ErrDigestMismatch
+	}
+
+	ha1 := md5Hex(user + ":" + d.Realm + ":" + passwd)
+	ha2 := md5Hex(req.Method + ":" + params["uri"])
+	var expected string
+	if params["qop"] == "auth" {
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	} else {
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	}
+	if !hmac.Equal([]byte(expected), []byte(params["response"])) {
+		return nil, ErrDigestMismatch
+	}
+	if !fresh {
+		// The password is right, let the client retry with a new nonce.
+		return nil, &ChallengeError{Challenge: d.challenge(true)}
+	}
+	return &goproxy.Identity{Name: user, Method: "digest"}, nil
+}
+
+// BearerAuthenticator implements the Bearer scheme, the tokens being
+// checked by Verify.
+type BearerAuthenticator struct {
+	Realm  string
+	Verify func(token string) (*goproxy.Identity, error)
+}
+
+func (b *BearerAuthenticator) Scheme() string { return "Bearer" }
+
+func (b *BearerAuthenticator) Challenge(*http.Request) string {
+	return fmt.Sprintf(`Bearer realm="%s"`, b.Realm)
+}
+
+func (b *BearerAuthenticator) Authenticate(_ *http.Request, token string) (*goproxy.Identity, error) {
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	return b.Verify(token)
+}
+
+// NegotiateAuthenticator implements the Negotiate scheme with Kerberos
+// service tickets, checked against the keytab of the proxy service
+// principal. The groups of the identity are the SIDs of the PAC, if any.
+type NegotiateAuthenticator struct {
+	Keytab   *keytab.Keytab
+	Settings []func(*service.Settings)
+}
+
+// negotiateCredentials is the context key under which gokrb5 stores the
+// credentials of the authenticated client.
+const negotiateCredentials = "github.com/jcmturner/gokrb5/v8/ctxCredentials"
+
+func (n *NegotiateAuthenticator) Scheme() string { return "Negotiate" }
+
+func (n *NegotiateAuthenticator) Challenge(*http.Request) string {
+	return "Negotiate"
+}
+
+func (n *NegotiateAuthenticator) Authenticate(req *http.Request, token string) (*goproxy.Identity, error) {
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var st spnego.SPNEGOToken
+	if err := st.Unmarshal(raw); err != nil {
+		return nil, err
+	}
+
+	s := spnego.SPNEGOService(n.Keytab, n.Settings...)
+	ok, ctx, status := s.AcceptSecContext(&st)
+	if status.Code == gssapi.StatusContinueNeeded {
+		return nil, &ChallengeError{Challenge: "Negotiate"}
+	}
+	if !ok || status.Code != gssapi.StatusComplete {
+		return nil, fmt.Errorf("auth: negotiate: %s", status.Message)
+	}
+	creds, _ := ctx.Value(negotiateCredentials).(*credentials.Credentials)
+	if creds == nil {
+		return nil, errors.New("auth: negotiate: no credentials")
+	}
+	return &goproxy.Identity{
+		Name:       creds.UserName(),
+		Method:     "negotiate",
+		Groups:     creds.AuthzAttributes(),
+		Attributes: map[string]string{"realm": creds.Domain()},
+	}, nil
+}
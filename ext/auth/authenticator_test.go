@@ -0,0 +1,174 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+)
+
+func multiSchemeProxy(t *testing.T) (*auth.ProxyAuth, *httptest.Server) {
+	t.Helper()
+	a := auth.NewProxyAuth(
+		&auth.DigestAuthenticator{Realm: "test", Password: func(user string) (string, bool) {
+			return "secret", user == "alice"
+		}},
+		&auth.BasicAuthenticator{Realm: "test", Verify: func(user, passwd string) (*goproxy.Identity, error) {
+			if passwd != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return &goproxy.Identity{Name: user}, nil
+		}},
+		&auth.BearerAuthenticator{Realm: "test", Verify: func(token string) (*goproxy.Identity, error) {
+			if token != "token" {
+				return nil, errors.New("invalid token")
+			}
+			return &goproxy.Identity{Name: "service"}, nil
+		}},
+	)
+	proxy := goproxy.NewProxyHttpServer()
+	a.Install(proxy)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, ctx.Identity.Name)
+	})
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	return a, s
+}
+
+func TestProxyAuthChallenges(t *testing.T) {
+	_, s := multiSchemeProxy(t)
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://example.invalid/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || len(resp.Header.Values("Proxy-Authenticate")) != 3 {
+		t.Errorf("Expected 407 with 3 challenges, got %s %v", resp.Status, resp.Header.Values("Proxy-Authenticate"))
+	}
+
+	client.Transport = &http.Transport{
+		Proxy:              http.ProxyURL(proxyURL),
+		ProxyConnectHeader: http.Header{"Proxy-Authorization": {"Bearer token"}},
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.invalid/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer token")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "service" {
+		t.Errorf("Expected bearer identity, got %s %q", resp.Status, body)
+	}
+}
+
+func TestProxyAuthDigest(t *testing.T) {
+	_, s := multiSchemeProxy(t)
+	u, _ := url.Parse(s.URL)
+	u.User = url.UserPassword("alice", "secret")
+	client := proxyThrough(t, u.String())
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://example.invalid/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "alice" {
+			t.Errorf("Expected digest identity, got %s %q", resp.Status, body)
+		}
+	}
+}
+
+func TestProxyAuthConnectionCache(t *testing.T) {
+	a, _ := multiSchemeProxy(t)
+	a.ConnectionTTL = time.Minute
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.invalid/", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer token")
+	if _, resp := a.Authenticate(req, ctx); resp != nil {
+		t.Fatalf("Expected authentication, got %d", resp.StatusCode)
+	}
+	again := httptest.NewRequest(http.MethodGet, "http://example.invalid/", nil)
+	if id, resp := a.Authenticate(again, ctx); resp != nil || id.Name != "service" {
+		t.Errorf("Expected the connection to stay authenticated")
+	}
+	other := httptest.NewRequest(http.MethodGet, "http://example.invalid/", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	if _, resp := a.Authenticate(other, ctx); resp == nil {
+		t.Errorf("Expected other connections to authenticate")
+	}
+}
+
+func TestProxyAuthMitm(t *testing.T) {
+	background := httptest.NewTLSServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	for _, tc := range []struct {
+		mode      auth.MitmAuth
+		noConnect bool
+		header    string
+		status    int
+	}{
+		{auth.MitmInherit, false, "", http.StatusOK},
+		// Without the identity of the CONNECT, as with MitmProxy.
+		{auth.MitmInherit, true, "", http.StatusProxyAuthRequired},
+		{auth.MitmInherit, true, "Authorization", http.StatusProxyAuthRequired},
+		{auth.MitmInherit, true, "Proxy-Authorization", http.StatusOK},
+		{auth.MitmProxy, false, "", http.StatusProxyAuthRequired},
+		{auth.MitmProxy, false, "Proxy-Authorization", http.StatusOK},
+		{auth.MitmOrigin, false, "", http.StatusUnauthorized},
+		{auth.MitmOrigin, false, "Authorization", http.StatusOK},
+	} {
+		a := auth.NewProxyAuth(&auth.BasicAuthenticator{Realm: "test", Verify: func(user, passwd string) (*goproxy.Identity, error) {
+			if passwd != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return &goproxy.Identity{Name: user}, nil
+		}})
+		a.Mitm = tc.mode
+		proxy := goproxy.NewProxyHttpServer()
+		if tc.noConnect {
+			proxy.OnRequest().Do(a.Handler())
+		} else {
+			a.Install(proxy)
+		}
+		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		s := httptest.NewServer(proxy)
+
+		proxyURL, _ := url.Parse(s.URL)
+		proxyURL.User = url.UserPassword("alice", "secret")
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+		req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, "Basic YWxpY2U6c2VjcmV0")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("Mode %d with %q, without CONNECT identity %v: expected %d, got %d", tc.mode, tc.header, tc.noConnect, tc.status, resp.StatusCode)
+		}
+		if tc.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Basic realm=test" {
+			t.Errorf("Expected WWW-Authenticate challenge, got %v", resp.Header)
+		}
+		s.Close()
+	}
+}
@@ -2,10 +2,9 @@ package auth
 
 import (
 	"bytes"
-	"encoding/base64"
+	"errors"
 	"io"
 	"net/http"
-	"strings"
 
 	"github.com/InsideOutSec/goproxy"
 )
@@ -30,46 +29,33 @@ func BasicUnauthorized(req *http.Request, realm string) *http.Response {
 
 var proxyAuthorizationHeader = "Proxy-Authorization"
 
-func auth(req *http.Request, f func(user, passwd string) bool) bool {
-	authheader := strings.SplitN(req.Header.Get(proxyAuthorizationHeader), " ", 2)
-	req.Header.Del(proxyAuthorizationHeader)
-	if len(authheader) != 2 || authheader[0] != "Basic" {
-		return false
-	}
-	userpassraw, err := base64.StdEncoding.DecodeString(authheader[1])
-	if err != nil {
-		return false
-	}
-	userpass := strings.SplitN(string(userpassraw), ":", 2)
-	if len(userpass) != 2 {
-		return false
+// basicAuth returns the ProxyAuth accepting the Basic credentials checked by
+// f.
+func basicAuth(realm string, f func(user, passwd string) (*goproxy.Identity, error)) *ProxyAuth {
+	return NewProxyAuth(&BasicAuthenticator{Realm: realm, Verify: f})
+}
+
+func basicVerify(f func(user, passwd string) bool) func(user, passwd string) (*goproxy.Identity, error) {
+	return func(user, passwd string) (*goproxy.Identity, error) {
+		if !f(user, passwd) {
+			return nil, errors.New("auth: invalid credentials")
+		}
+		return &goproxy.Identity{Name: user, Method: "basic"}, nil
 	}
-	return f(userpass[0], userpass[1])
 }
 
 // Basic returns a basic HTTP authentication handler for requests
 //
 // You probably want to use auth.ProxyBasic(proxy) to enable authentication for all proxy activities
 func Basic(realm string, f func(user, passwd string) bool) goproxy.ReqHandler {
-	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		if !auth(req, f) {
-			return nil, BasicUnauthorized(req, realm)
-		}
-		return req, nil
-	})
+	return basicAuth(realm, basicVerify(f)).Handler()
 }
 
 // BasicConnect returns a basic HTTP authentication handler for CONNECT requests
 //
 // You probably want to use auth.ProxyBasic(proxy) to enable authentication for all proxy activities
 func BasicConnect(realm string, f func(user, passwd string) bool) goproxy.HttpsHandler {
-	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
-		if !auth(ctx.Req, f) {
-			ctx.Resp = BasicUnauthorized(ctx.Req, realm)
-			return goproxy.RejectConnect, host
-		}
-		return nil, host
-	})
+	return basicAuth(realm, basicVerify(f)).ConnectHandler()
 }
 
 // ProxyBasic will force HTTP authentication before any request to the proxy is processed
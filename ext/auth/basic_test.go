@@ -1,6 +1,7 @@
 package auth_test
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"io"
 	"net"
@@ -172,3 +173,52 @@ func TestWithBrowser(t *testing.T) {
 		t.Error("No one accessed the proxy")
 	}
 }
+
+func TestBasicMitm(t *testing.T) {
+	var authorization atomic.Value
+	background := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization.Store(r.Header.Get("Authorization"))
+		io.WriteString(w, "hello")
+	}))
+	defer background.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().Do(auth.Basic("my_realm", func(user, passwd string) bool {
+		return user == "user" && passwd == "open sesame"
+	}))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	// The MITM'd requests are still challenged with 407, not 401.
+	req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+	req.Header.Set("Authorization", "Bearer origin")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != "Basic realm=my_realm" {
+		t.Errorf("Expected 407 Proxy Authentication Required, got %s %v", resp.Status, resp.Header)
+	}
+
+	// The Authorization of the origin is kept.
+	req, _ = http.NewRequest(http.MethodGet, background.URL, nil)
+	req.Header.Set("Authorization", "Bearer origin")
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:open sesame")))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Expected status 200 OK, got", resp.Status)
+	}
+	if got, _ := authorization.Load().(string); got != "Bearer origin" {
+		t.Errorf("Expected the Authorization of the origin, got %q", got)
+	}
+}
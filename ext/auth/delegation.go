@@ -0,0 +1,375 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// cnameInAddlTkt is the KDC option of S4U2Proxy requests, MS-SFU 2.2.
+const cnameInAddlTkt = 14
+
+// s4uUsage is the key usage of the PA-FOR-USER checksum, MS-SFU 2.2.1.
+const s4uUsage = 17
+
+// Delegation authenticates the requests of the proxy users to upstream
+// Kerberos services, with service tickets obtained on their behalf: the
+// proxy service account gets a ticket to itself for the user with S4U2Self
+// (protocol transition), then exchanges it for a ticket to the upstream
+// service with S4U2Proxy (constrained delegation). The service account must
+// be trusted for delegation to the upstream services, with any
+// authentication protocol, so that users authenticated with Basic or LDAP
+// get single sign-on too.
+type Delegation struct {
+	// Client is the Kerberos client of the proxy service account.
+	Client *client.Client
+	// SPN returns the service principal of the upstream server of req.
+	// Defaults to HTTP/<hostname>.
+	SPN func(req *http.Request) string
+	// Timeout of the exchanges with the KDC. Defaults to 5 seconds.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	tgt     *delegatedTicket
+	tickets map[string]*delegatedTicket
+}
+
+type delegatedTicket struct {
+	ticket  messages.Ticket
+	key     types.EncryptionKey
+	expires time.Time
+}
+
+func (t *delegatedTicket) valid() bool {
+	return t != nil && time.Until(t.expires) > time.Minute
+}
+
+// NewDelegation returns a Delegation for the service account of cl.
+func NewDelegation(cl *client.Client) *Delegation {
+	return &Delegation{Client: cl}
+}
+
+func (d *Delegation) realm() string {
+	return d.Client.Credentials.Domain()
+}
+
+// serviceTGT returns the ticket granting ticket of the service account.
+func (d *Delegation) serviceTGT() (*delegatedTicket, error) {
+	if d.tgt.valid() {
+		return d.tgt, nil
+	}
+	asReq, err := messages.NewASReqForTGT(d.realm(), d.Client.Config, d.Client.Credentials.CName())
+	if err != nil {
+		return nil, err
+	}
+	asRep, err := d.Client.ASExchange(d.realm(), asReq, 0)
+	if err != nil {
+		return nil, err
+	}
+	d.tgt = &delegatedTicket{ticket: asRep.Ticket, key: asRep.DecryptedEncPart.Key, expires: asRep.DecryptedEncPart.EndTime}
+	return d.tgt, nil
+}
+
+// splitUser returns the name and realm of a user, written either as
+// user@REALM or DOMAIN\user.
+func (d *Delegation) splitUser(id *goproxy.Identity) (string, string) {
+	name := id.Name
+	if i := strings.LastIndexByte(name, '\\'); i >= 0 {
+		name = name[i+1:]
+	}
+	if user, realm, ok := strings.Cut(name, "@"); ok {
+		return user, strings.ToUpper(realm)
+	}
+	if realm := id.Attributes["realm"]; realm != "" {
+		return name, realm
+	}
+	return name, d.realm()
+}
+
+// ServiceTicket returns a ticket to the service principal spn on behalf of
+// the user.
+func (d *Delegation) ServiceTicket(user, realm, spn string) (messages.Ticket, types.EncryptionKey, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cacheKey := user + "@" + realm + "\x00" + spn
+	if t := d.tickets[cacheKey]; t.valid() {
+		return t.ticket, t.key, nil
+	}
+
+	tgt, err := d.serviceTGT()
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, fmt.Errorf("kerberos: service TGT: %w", err)
+	}
+	evidence, err := d.s4u2self(tgt, user, realm)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, fmt.Errorf("kerberos: S4U2Self: %w", err)
+	}
+	rep, err := d.s4u2proxy(tgt, evidence, spn)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, fmt.Errorf("kerberos: S4U2Proxy: %w", err)
+	}
+
+	if d.tickets == nil {
+		d.tickets = make(map[string]*delegatedTicket)
+	}
+	t := &delegatedTicket{ticket: rep.Ticket, key: rep.DecryptedEncPart.Key, expires: rep.DecryptedEncPart.EndTime}
+	d.tickets[cacheKey] = t
+	return t.ticket, t.key, nil
+}
+
+// paForUser is the PA-FOR-USER pre-authentication data, MS-SFU 2.2.1.
+type paForUser struct {
+	UserName    types.PrincipalName `asn1:"explicit,tag:0"`
+	UserRealm   string              `asn1:"generalstring,explicit,tag:1"`
+	Cksum       types.Checksum      `asn1:"explicit,tag:2"`
+	AuthPackage string              `asn1:"generalstring,explicit,tag:3"`
+}
+
+// forUserChecksum computes the KERB_CHECKSUM_HMAC_MD5 of the PA-FOR-USER
+// data, whatever the type of the session key.
+func forUserChecksum(key []byte, name types.PrincipalName, realm, authPackage string) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, uint32(name.NameType))
+	for _, s := range name.NameString {
+		data = append(data, s...)
+	}
+	data = append(data, realm...)
+	data = append(data, authPackage...)
+
+	sign := hmac.New(md5.New, key)
+	sign.Write([]byte("signaturekey\x00"))
+	ksign := sign.Sum(nil)
+
+	usage := make([]byte, 4)
+	binary.LittleEndian.PutUint32(usage, s4uUsage)
+	tmp := md5.Sum(append(usage, data...))
+
+	mac := hmac.New(md5.New, ksign)
+	mac.Write(tmp[:])
+	return mac.Sum(nil)
+}
+
+func (d *Delegation) s4u2self(tgt *delegatedTicket, user, realm string) (messages.Ticket, error) {
+	service := d.Client.Credentials.CName()
+	req, err := messages.NewTGSReq(service, d.realm(), d.Client.Config, tgt.ticket, tgt.key, service, false)
+	if err != nil {
+		return messages.Ticket{}, err
+	}
+	types.SetFlag(&req.ReqBody.KDCOptions, flags.Forwardable)
+	if err := signTGSReq(&req, tgt); err != nil {
+		return messages.Ticket{}, err
+	}
+
+	name := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, user)
+	forUser := paForUser{
+		UserName:    name,
+		UserRealm:   realm,
+		AuthPackage: "Kerberos",
+		Cksum: types.Checksum{
+			CksumType: chksumtype.KERB_CHECKSUM_HMAC_MD5,
+			Checksum:  forUserChecksum(tgt.key.KeyValue, name, realm, "Kerberos"),
+		},
+	}
+	b, err := asn1.Marshal(forUser)
+	if err != nil {
+		return messages.Ticket{}, err
+	}
+	req.PAData = append(req.PAData, types.PAData{PADataType: patype.PA_FOR_USER, PADataValue: b})
+
+	rep, err := d.exchange(req, tgt.key)
+	if err != nil {
+		return messages.Ticket{}, err
+	}
+	return rep.Ticket, nil
+}
+
+func (d *Delegation) s4u2proxy(tgt *delegatedTicket, evidence messages.Ticket, spn string) (messages.TGSRep, error) {
+	service := d.Client.Credentials.CName()
+	sname, _ := types.ParseSPNString(spn)
+	req, err := messages.NewTGSReq(service, d.realm(), d.Client.Config, tgt.ticket, tgt.key, sname, false)
+	if err != nil {
+		return messages.TGSRep{}, err
+	}
+	req.ReqBody.AdditionalTickets = []messages.Ticket{evidence}
+	types.SetFlag(&req.ReqBody.KDCOptions, flags.Forwardable)
+	types.SetFlag(&req.ReqBody.KDCOptions, cnameInAddlTkt)
+	if err := signTGSReq(&req, tgt); err != nil {
+		return messages.TGSRep{}, err
+	}
+	return d.exchange(req, tgt.key)
+}
+
+// signTGSReq computes the PA-TGS-REQ of req once its body is final.
+func signTGSReq(req *messages.TGSReq, tgt *delegatedTicket) error {
+	b, err := req.ReqBody.Marshal()
+	if err != nil {
+		return err
+	}
+	et, err := crypto.GetEtype(tgt.key.KeyType)
+	if err != nil {
+		return err
+	}
+	cb, err := et.GetChecksumHash(tgt.key.KeyValue, b, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM)
+	if err != nil {
+		return err
+	}
+	auth, err := types.NewAuthenticator(tgt.ticket.Realm, req.ReqBody.CName)
+	if err != nil {
+		return err
+	}
+	auth.Cksum = types.Checksum{CksumType: et.GetHashID(), Checksum: cb}
+	apReq, err := messages.NewAPReq(tgt.ticket, tgt.key, auth)
+	if err != nil {
+		return err
+	}
+	apb, err := apReq.Marshal()
+	if err != nil {
+		return err
+	}
+	req.PAData = types.PADataSequence{{PADataType: patype.PA_TGS_REQ, PADataValue: apb}}
+	return nil
+}
+
+// exchange sends req to the KDCs of the service realm. The client of the
+// reply is the impersonated user, so the reply isn't checked against the
+// request name as the gokrb5 client does.
+func (d *Delegation) exchange(req messages.TGSReq, key types.EncryptionKey) (messages.TGSRep, error) {
+	var rep messages.TGSRep
+	b, err := req.Marshal()
+	if err != nil {
+		return rep, err
+	}
+	_, kdcs, err := d.Client.Config.GetKDCs(d.realm(), true)
+	if err != nil {
+		return rep, err
+	}
+	order := make([]int, 0, len(kdcs))
+	for i := range kdcs {
+		order = append(order, i)
+	}
+	sort.Ints(order)
+
+	err = errors.New("kerberos: no KDC")
+	for _, i := range order {
+		var raw []byte
+		raw, err = d.send(kdcs[i], b)
+		if err != nil {
+			continue
+		}
+		var krbErr messages.KRBError
+		if krbErr.Unmarshal(raw) == nil {
+			return rep, krbErr
+		}
+		if err := rep.Unmarshal(raw); err != nil {
+			return rep, err
+		}
+		if err := rep.DecryptEncPart(key); err != nil {
+			return rep, err
+		}
+		if rep.DecryptedEncPart.Nonce != req.ReqBody.Nonce {
+			return rep, errors.New("kerberos: nonce mismatch in TGS reply")
+		}
+		return rep, nil
+	}
+	return rep, err
+}
+
+// send exchanges a message with a KDC over TCP, RFC 4120 section 7.2.2.
+func (d *Delegation) send(kdc string, b []byte) ([]byte, error) {
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", kdc, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	msg := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(len(b)))
+	if _, err := conn.Write(append(msg, b...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, msg[:4]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(msg[:4])
+	if n > 1<<20 {
+		return nil, errors.New("kerberos: reply too large")
+	}
+	raw := make([]byte, n)
+	_, err = io.ReadFull(conn, raw)
+	return raw, err
+}
+
+// Authorization returns the Negotiate Authorization header authenticating
+// the user of id to the service principal spn.
+func (d *Delegation) Authorization(id *goproxy.Identity, spn string) (string, error) {
+	user, realm := d.splitUser(id)
+	tkt, key, err := d.ServiceTicket(user, realm, spn)
+	if err != nil {
+		return "", err
+	}
+	// The authenticator must name the user, as the ticket does.
+	userClient := client.NewWithPassword(user, realm, "", d.Client.Config)
+	init, err := spnego.NewNegTokenInitKRB5(userClient, tkt, key)
+	if err != nil {
+		return "", err
+	}
+	token := spnego.SPNEGOToken{Init: true, NegTokenInit: init}
+	b, err := token.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return "Negotiate " + base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (d *Delegation) spn(req *http.Request) string {
+	if d.SPN != nil {
+		return d.SPN(req)
+	}
+	return "HTTP/" + req.URL.Hostname()
+}
+
+// Handle adds the Negotiate credentials of the proxy user to the requests
+// without Authorization header. Register it for the upstream services the
+// service account may delegate to, for instance:
+//
+//	proxy.OnRequest(goproxy.DstHostIs("intranet.example.com")).Do(delegation)
+func (d *Delegation) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if ctx.Identity == nil || req.Header.Get("Authorization") != "" {
+		return req, nil
+	}
+	authorization, err := d.Authorization(ctx.Identity, d.spn(req))
+	if err != nil {
+		ctx.Warnf("Cannot delegate credentials of %q: %v", ctx.Identity.Name, err)
+		return req, nil
+	}
+	req.Header.Set("Authorization", authorization)
+	return req, nil
+}
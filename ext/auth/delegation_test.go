@@ -0,0 +1,47 @@
+package auth_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+)
+
+func TestDelegationUnreachableKDC(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	kdc := l.Addr().String()
+	l.Close()
+
+	cfg, err := config.NewFromString(`[libdefaults]
+  default_realm = EXAMPLE.COM
+  udp_preference_limit = 1
+[realms]
+  EXAMPLE.COM = {
+    kdc = ` + kdc + `
+  }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := auth.NewDelegation(client.NewWithPassword("HTTP/proxy.example.com", "EXAMPLE.COM", "secret", cfg))
+	d.Timeout = time.Second
+
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+	req := httptest.NewRequest(http.MethodGet, "http://intranet.example.com/", nil)
+	if req, resp := d.Handle(req, ctx); resp != nil || req.Header.Get("Authorization") != "" {
+		t.Error("Expected anonymous requests to be left untouched")
+	}
+
+	ctx.Identity = &goproxy.Identity{Name: `EXAMPLE\alice`}
+	if req, resp := d.Handle(req, ctx); resp != nil || req.Header.Get("Authorization") != "" {
+		t.Error("Expected the request to be forwarded without credentials")
+	}
+	if _, err := d.Authorization(ctx.Identity, "HTTP/intranet.example.com"); err == nil {
+		t.Error("Expected delegation to fail without KDC")
+	}
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ErrUnknownCredential is returned by a TokenStore for the downstream
+// credentials it doesn't map.
+var ErrUnknownCredential = errors.New("auth: unknown credential")
+
+// UpstreamCredential is the credential of the requests to the upstream
+// services.
+type UpstreamCredential struct {
+	// Bearer is the token of the Bearer Authorization header.
+	Bearer string
+	// Header are the headers set in the requests, such as API keys.
+	Header http.Header
+	// Certificate is the client certificate of the mTLS connections to
+	// the upstream services.
+	Certificate *tls.Certificate
+	// Expires is when the credential expires, zero for never. The expired
+	// credentials are unknown.
+	Expires time.Time
+}
+
+// TokenStore maps the downstream credentials to the upstream ones.
+type TokenStore interface {
+	// Lookup returns the upstream credential of the downstream credential,
+	// or ErrUnknownCredential.
+	Lookup(ctx context.Context, downstream string) (*UpstreamCredential, error)
+}
+
+// MapStore is a TokenStore in memory. It is safe for concurrent use.
+type MapStore struct {
+	mu          sync.RWMutex
+	credentials map[string]*UpstreamCredential
+}
+
+// NewMapStore returns an empty MapStore.
+func NewMapStore() *MapStore {
+	return &MapStore{credentials: make(map[string]*UpstreamCredential)}
+}
+
+// Set maps downstream to upstream.
+func (s *MapStore) Set(downstream string, upstream *UpstreamCredential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[downstream] = upstream
+}
+
+// Delete forgets downstream, such as a closed session.
+func (s *MapStore) Delete(downstream string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.credentials, downstream)
+}
+
+// Lookup implements TokenStore.
+func (s *MapStore) Lookup(_ context.Context, downstream string) (*UpstreamCredential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c, ok := s.credentials[downstream]; ok {
+		return c, nil
+	}
+	return nil, ErrUnknownCredential
+}
+
+// TokenExchange swaps the downstream credentials of the requests, a session
+// cookie or a legacy header, for the upstream credentials they map to in
+// Store, so that the clients never see the tokens of the internal services:
+//
+//	store := auth.NewMapStore()
+//	store.Set(sessionID, &auth.UpstreamCredential{Bearer: token})
+//	proxy.OnRequest(goproxy.ReqHostIs("api.internal:443")).Do(&auth.TokenExchange{
+//		Cookie:   "session",
+//		Store:    store,
+//		Required: true,
+//	})
+//
+// The downstream credential is removed from the requests, as well as the
+// Authorization header of the clients, replaced by the upstream one.
+type TokenExchange struct {
+	// Cookie is the name of the cookie of the downstream credential.
+	Cookie string
+	// Header is the name of the header of the downstream credential, when
+	// there is no Cookie.
+	Header string
+	// Store maps the downstream credentials.
+	Store TokenStore
+	// Required answers 401 Unauthorized to the requests without a known
+	// downstream credential, instead of sending them without credentials.
+	Required bool
+	// Timeout of the lookups in Store. Defaults to 5 seconds.
+	Timeout time.Duration
+	// Clock tells the expiration of the credentials, goproxy.SystemClock
+	// by default.
+	Clock goproxy.Clock
+
+	mu         sync.Mutex
+	transports map[*tls.Certificate]*http.Transport
+}
+
+func (x *TokenExchange) now() time.Time {
+	if x.Clock != nil {
+		return x.Clock.Now()
+	}
+	return time.Now()
+}
+
+// downstream removes the downstream credential from req and returns it.
+func (x *TokenExchange) downstream(req *http.Request) string {
+	var credential string
+	if x.Cookie != "" {
+		var kept []string
+		for _, c := range req.Cookies() {
+			if c.Name == x.Cookie {
+				if credential == "" {
+					credential = c.Value
+				}
+				continue
+			}
+			kept = append(kept, c.String())
+		}
+		req.Header.Del("Cookie")
+		if len(kept) > 0 {
+			req.Header.Set("Cookie", strings.Join(kept, "; "))
+		}
+	}
+	if x.Header != "" {
+		if credential == "" {
+			credential = req.Header.Get(x.Header)
+		}
+		req.Header.Del(x.Header)
+	}
+	return credential
+}
+
+// transport returns the transport of the client certificate cert, a copy
+// of the transport of proxy.
+func (x *TokenExchange) transport(proxy *goproxy.ProxyHttpServer, cert *tls.Certificate) *http.Transport {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if tr, ok := x.transports[cert]; ok {
+		return tr
+	}
+	if x.transports == nil {
+		x.transports = make(map[*tls.Certificate]*http.Transport)
+	}
+	tr := proxy.Tr.Clone()
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	x.transports[cert] = tr
+	return tr
+}
+
+func (x *TokenExchange) unauthorized(req *http.Request, ctx *goproxy.ProxyCtx, reason string) (*http.Request, *http.Response) {
+	ctx.Logf("Token exchange: %s for %s", reason, req.URL.Host)
+	if !x.Required {
+		return req, nil
+	}
+	return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusUnauthorized, "Unauthorized")
+}
+
+// Handle implements goproxy.ReqHandler.
+func (x *TokenExchange) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	downstream := x.downstream(req)
+	// The clients can't choose the upstream credentials.
+	req.Header.Del("Authorization")
+	if downstream == "" {
+		return x.unauthorized(req, ctx, "no downstream credential")
+	}
+
+	timeout := x.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	lookupCtx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	upstream, err := x.Store.Lookup(lookupCtx, downstream)
+	if errors.Is(err, ErrUnknownCredential) || err == nil && !upstream.Expires.IsZero() && !x.now().Before(upstream.Expires) {
+		return x.unauthorized(req, ctx, "unknown or expired downstream credential")
+	}
+	if err != nil {
+		ctx.Warnf("Token exchange: cannot look up the downstream credential: %v", err)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable, "Credential store unavailable")
+	}
+
+	if upstream.Bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+upstream.Bearer)
+	}
+	for name, values := range upstream.Header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	if upstream.Certificate != nil {
+		ctx.Transport = x.transport(ctx.Proxy, upstream.Certificate)
+	}
+	return req, nil
+}
@@ -0,0 +1,70 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+)
+
+func TestTokenExchange(t *testing.T) {
+	clock := goproxy.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := auth.NewMapStore()
+	store.Set("s1", &auth.UpstreamCredential{Bearer: "internal", Header: http.Header{"X-Api-Key": {"k"}}})
+	store.Set("s2", &auth.UpstreamCredential{Bearer: "old", Expires: clock.Now()})
+	cert := &tls.Certificate{}
+	store.Set("legacy", &auth.UpstreamCredential{Certificate: cert})
+	x := &auth.TokenExchange{Cookie: "session", Header: "X-Legacy-Token", Store: store, Required: true, Clock: clock}
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.internal/", nil)
+	req.Header.Set("Cookie", "theme=dark; session=s1")
+	req.Header.Set("Authorization", "Bearer forged")
+	req, resp := x.Handle(req, ctx)
+	if resp != nil {
+		t.Fatalf("Expected the request to be sent, got %d", resp.StatusCode)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer internal" {
+		t.Errorf("Expected the upstream bearer token, got %q", got)
+	}
+	if got := req.Header.Get("X-Api-Key"); got != "k" {
+		t.Errorf("Expected the upstream headers, got %q", got)
+	}
+	if got := req.Header.Get("Cookie"); got != "theme=dark" {
+		t.Errorf("Expected the session cookie to be removed, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://api.internal/", nil)
+	req.Header.Set("X-Legacy-Token", "legacy")
+	ctx = &goproxy.ProxyCtx{Proxy: ctx.Proxy}
+	req, _ = x.Handle(req, ctx)
+	if req.Header.Get("X-Legacy-Token") != "" || req.Header.Get("Authorization") != "" {
+		t.Error("Expected the legacy header to be removed")
+	}
+	tr, ok := ctx.Transport.(*http.Transport)
+	if !ok || len(tr.TLSClientConfig.Certificates) != 1 {
+		t.Error("Expected the transport of the client certificate")
+	}
+
+	for _, cookie := range []string{"session=s2", "session=unknown", ""} {
+		req = httptest.NewRequest(http.MethodGet, "http://api.internal/", nil)
+		req.Header.Set("Cookie", cookie)
+		req.Header.Set("Authorization", "Bearer forged")
+		if req, resp = x.Handle(req, ctx); resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected %q to be unauthorized", cookie)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Error("Expected the Authorization of the client to be removed")
+		}
+	}
+
+	x.Required = false
+	req = httptest.NewRequest(http.MethodGet, "http://api.internal/", nil)
+	if _, resp = x.Handle(req, ctx); resp != nil {
+		t.Error("Expected the request without credential to be sent")
+	}
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConn is the subset of *ldap.Conn used by the LDAP backend.
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Compare(dn, attribute, value string) (bool, error)
+	Close() error
+}
+
+// LDAPMode selects how the user password is verified.
+type LDAPMode int
+
+const (
+	// LDAPBind verifies the password by binding as the user.
+	LDAPBind LDAPMode = iota
+	// LDAPCompare verifies the password with a compare operation on
+	// PasswordAttribute, using the service account.
+	LDAPCompare
+)
+
+var ErrLDAPUserNotFound = errors.New("ldap: user not found")
+
+// LDAP validates proxy Basic credentials against an LDAP or Active Directory
+// server. The user entry is looked up with the service account BindDN, then
+// the password is verified according to Mode. The groups of the user are
+// exposed in ctx.Identity.
+type LDAP struct {
+	// URL of the server, such as ldaps://dc.example.com:636.
+	URL string
+	// BindDN and BindPassword are the service account credentials used to
+	// look up the users. Anonymous search is used when BindDN is empty.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the root of the user search.
+	BaseDN string
+	// UserFilter is the search filter, %s being replaced by the escaped user
+	// name. Defaults to (sAMAccountName=%s).
+	UserFilter string
+	// GroupAttribute lists the groups of the user entry. Defaults to memberOf.
+	GroupAttribute string
+	Mode           LDAPMode
+	// PasswordAttribute is compared in LDAPCompare mode. Defaults to
+	// userPassword.
+	PasswordAttribute string
+	// MaxIdleConns is the number of connections kept open. Defaults to 4.
+	MaxIdleConns int
+	// CacheTTL is how long the result of an authentication is cached.
+	// Zero disables the cache.
+	CacheTTL time.Duration
+	// Dial opens a connection to the server. Defaults to ldap.DialURL.
+	Dial func(url string) (LDAPConn, error)
+
+	once  sync.Once
+	idle  chan LDAPConn
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]ldapResult
+}
+
+type ldapResult struct {
+	identity *goproxy.Identity
+	err      error
+	expires  time.Time
+}
+
+func (l *LDAP) init() {
+	l.once.Do(func() {
+		n := l.MaxIdleConns
+		if n <= 0 {
+			n = 4
+		}
+		l.idle = make(chan LDAPConn, n)
+		l.cache = make(map[[sha256.Size]byte]ldapResult)
+	})
+}
+
+func (l *LDAP) conn() (LDAPConn, error) {
+	select {
+	case c := <-l.idle:
+		return c, nil
+	default:
+	}
+	if l.Dial != nil {
+		return l.Dial(l.URL)
+	}
+	return ldap.DialURL(l.URL)
+}
+
+func (l *LDAP) release(c LDAPConn) {
+	select {
+	case l.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Authenticate verifies the credentials and returns the identity of the user.
+func (l *LDAP) Authenticate(user, passwd string) (*goproxy.Identity, error) {
+	l.init()
+	// An empty password is an unauthenticated bind, which most servers
+	// accept for any user name.
+	if user == "" || passwd == "" {
+		return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("empty credentials"))
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + passwd))
+	if l.CacheTTL > 0 {
+		l.mu.Lock()
+		r, ok := l.cache[key]
+		if ok && time.Now().After(r.expires) {
+			delete(l.cache, key)
+			ok = false
+		}
+		l.mu.Unlock()
+		if ok {
+			return r.identity, r.err
+		}
+	}
+
+	id, err := l.authenticate(user, passwd)
+	var lerr *ldap.Error
+	if l.CacheTTL > 0 && (err == nil || errors.Is(err, ErrLDAPUserNotFound) ||
+		errors.As(err, &lerr) && lerr.ResultCode == ldap.LDAPResultInvalidCredentials) {
+		l.mu.Lock()
+		l.cache[key] = ldapResult{identity: id, err: err, expires: time.Now().Add(l.CacheTTL)}
+		l.mu.Unlock()
+	}
+	return id, err
+}
+
+func (l *LDAP) authenticate(user, passwd string) (*goproxy.Identity, error) {
+	c, err := l.conn()
+	if err != nil {
+		return nil, err
+	}
+	id, err := l.verify(c, user, passwd)
+	var lerr *ldap.Error
+	if err != nil && (!errors.As(err, &lerr) || lerr.ResultCode == ldap.ErrorNetwork) {
+		// Don't reuse a connection in an unknown state.
+		c.Close()
+	} else {
+		l.release(c)
+	}
+	return id, err
+}
+
+func (l *LDAP) verify(c LDAPConn, user, passwd string) (*goproxy.Identity, error) {
+	if l.BindDN != "" {
+		if err := c.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: service bind: %w", err)
+		}
+	}
+
+	filter := l.UserFilter
+	if filter == "" {
+		filter = "(sAMAccountName=%s)"
+	}
+	groupAttr := l.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	res, err := c.Search(ldap.NewSearchRequest(l.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(user)),
+		[]string{groupAttr}, nil))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrLDAPUserNotFound
+	}
+	entry := res.Entries[0]
+
+	switch l.Mode {
+	case LDAPCompare:
+		attr := l.PasswordAttribute
+		if attr == "" {
+			attr = "userPassword"
+		}
+		ok, err := c.Compare(entry.DN, attr, passwd)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("password mismatch"))
+		}
+	default:
+		if err := c.Bind(entry.DN, passwd); err != nil {
+			return nil, err
+		}
+	}
+
+	id := &goproxy.Identity{
+		Name:       user,
+		Method:     "ldap",
+		Attributes: map[string]string{"dn": entry.DN},
+	}
+	for _, group := range entry.GetAttributeValues(groupAttr) {
+		id.Groups = append(id.Groups, groupName(group))
+	}
+	return id, nil
+}
+
+// groupName returns the common name of a group DN, or the value itself when
+// it isn't a DN.
+func groupName(group string) string {
+	dn, err := ldap.ParseDN(group)
+	if err != nil || len(dn.RDNs) == 0 {
+		return group
+	}
+	for _, attr := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+	return group
+}
+
+// Handler returns a basic HTTP authentication handler for requests, checking
+// the credentials against the LDAP server.
+func (l *LDAP) Handler(realm string) goproxy.ReqHandler {
+	return basicAuth(realm, l.Authenticate).Handler()
+}
+
+// ConnectHandler returns a basic HTTP authentication handler for CONNECT
+// requests, checking the credentials against the LDAP server.
+func (l *LDAP) ConnectHandler(realm string) goproxy.HttpsHandler {
+	return basicAuth(realm, l.Authenticate).ConnectHandler()
+}
+
+// ProxyLDAP will force HTTP authentication against the LDAP server before any
+// request to the proxy is processed.
+func ProxyLDAP(proxy *goproxy.ProxyHttpServer, realm string, l *LDAP) {
+	proxy.OnRequest().Do(l.Handler(realm))
+	proxy.OnRequest().HandleConnect(l.ConnectHandler(realm))
+}
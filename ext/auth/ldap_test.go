@@ -0,0 +1,117 @@
+package auth_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAP is a directory with a single user.
+type fakeLDAP struct {
+	searches *int32
+}
+
+const userDN = "CN=Alice,OU=Users,DC=example,DC=com"
+
+func (f fakeLDAP) Bind(username, password string) error {
+	if (username == "CN=svc" && password == "svc") || (username == userDN && password == "secret") {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (f fakeLDAP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	atomic.AddInt32(f.searches, 1)
+	if req.Filter != "(sAMAccountName=alice)" {
+		return &ldap.SearchResult{}, nil
+	}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry(userDN, map[string][]string{
+		"memberOf": {"CN=Proxy Users,OU=Groups,DC=example,DC=com", "CN=Admins,OU=Groups,DC=example,DC=com"},
+	})}}, nil
+}
+
+func (f fakeLDAP) Compare(dn, attribute, value string) (bool, error) {
+	return dn == userDN && attribute == "userPassword" && value == "secret", nil
+}
+
+func (f fakeLDAP) Close() error { return nil }
+
+func newLDAP(mode auth.LDAPMode) (*auth.LDAP, *int32, *int32) {
+	var dials, searches int32
+	return &auth.LDAP{
+		URL:          "ldap://fake",
+		BindDN:       "CN=svc",
+		BindPassword: "svc",
+		BaseDN:       "DC=example,DC=com",
+		Mode:         mode,
+		CacheTTL:     time.Minute,
+		Dial: func(string) (auth.LDAPConn, error) {
+			atomic.AddInt32(&dials, 1)
+			return fakeLDAP{searches: &searches}, nil
+		},
+	}, &dials, &searches
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	for _, mode := range []auth.LDAPMode{auth.LDAPBind, auth.LDAPCompare} {
+		l, dials, searches := newLDAP(mode)
+		id, err := l.Authenticate("alice", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !id.InGroup("Proxy Users") || !id.InGroup("Admins") || id.Attributes["dn"] != userDN {
+			t.Errorf("Unexpected identity %+v", id)
+		}
+		if _, err := l.Authenticate("alice", "wrong"); err == nil {
+			t.Error("Expected wrong password to fail")
+		}
+		if _, err := l.Authenticate("bob", "secret"); !errors.Is(err, auth.ErrLDAPUserNotFound) {
+			t.Errorf("Expected user not found, got %v", err)
+		}
+		if _, err := l.Authenticate("alice", "secret"); err != nil {
+			t.Fatal(err)
+		}
+		if *searches != 3 {
+			t.Errorf("Expected cached result, got %d searches", *searches)
+		}
+		if *dials != 1 {
+			t.Errorf("Expected pooled connection, got %d dials", *dials)
+		}
+	}
+}
+
+func TestProxyLDAP(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	l, _, _ := newLDAP(auth.LDAPBind)
+	proxy := goproxy.NewProxyHttpServer()
+	auth.ProxyLDAP(proxy, "test", l)
+	var groups []string
+	proxy.OnRequest(goproxy.UserInGroup("Admins")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		groups = ctx.Identity.Groups
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	proxyURL.User = url.UserPassword("alice", "secret")
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(groups) != 2 {
+		t.Errorf("Expected authenticated request with groups, got %s %v", resp.Status, groups)
+	}
+}
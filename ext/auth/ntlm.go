@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/InsideOutSec/goproxy"
 	httpntlm "github.com/vadimi/go-http-ntlm/v2"
+	"github.com/vadimi/go-ntlm/ntlm"
 )
 
 // NTLMAuth stores credentials and retry settings
@@ -19,6 +22,66 @@ type NTLMAuth struct {
 	MaxRetries int
 }
 
+// ntlmHandshake is the client side of an NTLM handshake. NTLM authenticates
+// a connection: the NEGOTIATE, CHALLENGE and AUTHENTICATE messages must be
+// exchanged on the connection being authenticated.
+type ntlmHandshake struct {
+	session ntlm.ClientSession
+}
+
+// handshake starts an NTLM handshake with the credentials of a.
+func (a *NTLMAuth) handshake() (*ntlmHandshake, error) {
+	session, err := ntlm.CreateClientSession(ntlm.Version2, ntlm.ConnectionOrientedMode)
+	if err != nil {
+		return nil, err
+	}
+	// CreateClientSession ignores its mode.
+	session.SetMode(ntlm.ConnectionOrientedMode)
+	session.SetUserInfo(a.Username, a.Password, a.Domain)
+	return &ntlmHandshake{session: session}, nil
+}
+
+// negotiate returns the NEGOTIATE message, as an authorization value.
+func (h *ntlmHandshake) negotiate() string {
+	return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate())
+}
+
+// authenticate returns the AUTHENTICATE message answering the CHALLENGE
+// token, as an authorization value.
+func (h *ntlmHandshake) authenticate(token string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	challenge, err := ntlm.ParseChallengeMessage(raw)
+	if err != nil {
+		return "", err
+	}
+	if err := h.session.ProcessChallengeMessage(challenge); err != nil {
+		return "", err
+	}
+	authenticate, err := h.session.GenerateAuthenticateMessage()
+	if err != nil {
+		return "", err
+	}
+	return "NTLM " + base64.StdEncoding.EncodeToString(authenticate.Bytes()), nil
+}
+
+// ntlmNegotiate returns the NEGOTIATE message, which the V2 sessions of
+// go-ntlm don't generate.
+func ntlmNegotiate() []byte {
+	const flags = ntlm.NTLMSSP_NEGOTIATE_UNICODE | ntlm.NTLM_NEGOTIATE_OEM |
+		ntlm.NTLMSSP_REQUEST_TARGET | ntlm.NTLMSSP_NEGOTIATE_NTLM |
+		ntlm.NTLMSSP_NEGOTIATE_ALWAYS_SIGN | ntlm.NTLMSSP_NEGOTIATE_EXTENDED_SESSIONSECURITY |
+		ntlm.NTLMSSP_NEGOTIATE_128 | ntlm.NTLMSSP_NEGOTIATE_KEY_EXCH | ntlm.NTLMSSP_NEGOTIATE_56
+
+	msg := make([]byte, 32)
+	copy(msg, "NTLMSSP\x00")
+	msg[8] = 1
+	binary.LittleEndian.PutUint32(msg[12:], uint32(flags))
+	return msg
+}
+
 // Cache NTLM-capable HTTP clients per host
 var ntlmClientCache sync.Map
 
@@ -0,0 +1,410 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// RADIUS packet codes, RFC 2865 and RFC 2866.
+const (
+	radiusAccessRequest      = 1
+	radiusAccessAccept       = 2
+	radiusAccessReject       = 3
+	radiusAccountingRequest  = 4
+	radiusAccountingResponse = 5
+)
+
+// RADIUS attribute types.
+const (
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusFilterID             = 11
+	radiusReplyMessage         = 18
+	radiusClass                = 25
+	radiusCallingStationID     = 31
+	radiusNASIdentifier        = 32
+	radiusAcctStatusType       = 40
+	radiusAcctInputOctets      = 42
+	radiusAcctOutputOctets     = 43
+	radiusAcctSessionID        = 44
+	radiusAcctSessionTime      = 46
+	radiusMessageAuthenticator = 80
+)
+
+// AcctStatus is the Acct-Status-Type of an accounting record.
+type AcctStatus uint32
+
+const (
+	AcctStart AcctStatus = 1
+	AcctStop  AcctStatus = 2
+)
+
+var (
+	ErrRADIUSReject  = errors.New("radius: access rejected")
+	ErrRADIUSTimeout = errors.New("radius: no server answered")
+)
+
+// RADIUS verifies proxy Basic credentials against RADIUS servers, using PAP.
+// Servers are tried in order until one answers, an Access-Reject from any of
+// them is final. The Filter-Id attributes of the Access-Accept are exposed as
+// the groups of ctx.Identity.
+//
+// When AccountingServers is set, an accounting start record is sent for each
+// authenticated request, and a stop record once its response has been sent.
+// The requests of a CONNECT tunnel are only accounted when it is MITM'd.
+type RADIUS struct {
+	// Servers are the host:port addresses of the authentication servers.
+	Servers []string
+	// AccountingServers are the host:port addresses of the accounting
+	// servers.
+	AccountingServers []string
+	Secret            string
+	// NASIdentifier identifies the proxy to the servers. Defaults to goproxy.
+	NASIdentifier string
+	// Timeout of each attempt. Defaults to 3 seconds.
+	Timeout time.Duration
+	// Retries is the number of retransmissions to each server.
+	Retries int
+
+	id uint32
+}
+
+type radiusPacket struct {
+	code          byte
+	id            byte
+	authenticator [16]byte
+	attrs         []radiusAttr
+}
+
+type radiusAttr struct {
+	typ   byte
+	value []byte
+}
+
+func (p *radiusPacket) add(typ byte, value []byte) {
+	p.attrs = append(p.attrs, radiusAttr{typ, value})
+}
+
+func (p *radiusPacket) addString(typ byte, value string) {
+	if value != "" {
+		p.add(typ, []byte(value))
+	}
+}
+
+func (p *radiusPacket) addUint32(typ byte, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	p.add(typ, b)
+}
+
+func (p *radiusPacket) get(typ byte) []byte {
+	for _, a := range p.attrs {
+		if a.typ == typ {
+			return a.value
+		}
+	}
+	return nil
+}
+
+func (p *radiusPacket) encode() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{p.code, p.id, 0, 0})
+	buf.Write(p.authenticator[:])
+	for _, a := range p.attrs {
+		buf.WriteByte(a.typ)
+		buf.WriteByte(byte(len(a.value) + 2))
+		buf.Write(a.value)
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+func decodeRADIUS(b []byte) (*radiusPacket, error) {
+	if len(b) < 20 || int(binary.BigEndian.Uint16(b[2:])) > len(b) {
+		return nil, errors.New("radius: short packet")
+	}
+	b = b[:binary.BigEndian.Uint16(b[2:])]
+	p := &radiusPacket{code: b[0], id: b[1]}
+	copy(p.authenticator[:], b[4:20])
+	for rest := b[20:]; len(rest) > 0; {
+		if len(rest) < 2 || rest[1] < 2 || int(rest[1]) > len(rest) {
+			return nil, errors.New("radius: malformed attribute")
+		}
+		p.add(rest[0], rest[2:rest[1]])
+		rest = rest[rest[1]:]
+	}
+	return p, nil
+}
+
+// hidePassword implements the User-Password hiding of RFC 2865 section 5.2.
+func hidePassword(passwd, secret string, authenticator [16]byte) []byte {
+	padded := make([]byte, (len(passwd)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, passwd)
+	prev := authenticator[:]
+	for i := 0; i < len(padded); i += 16 {
+		sum := md5.Sum(append([]byte(secret), prev...))
+		for j := range sum {
+			padded[i+j] ^= sum[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded
+}
+
+// responseAuthenticator computes the authenticator of a response to a request
+// with the given authenticator, or of an accounting request when it's zero.
+func responseAuthenticator(packet []byte, authenticator [16]byte, secret string) [16]byte {
+	h := md5.New()
+	h.Write(packet[:4])
+	h.Write(authenticator[:])
+	h.Write(packet[20:])
+	h.Write([]byte(secret))
+	var sum [16]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func (r *RADIUS) nasIdentifier() string {
+	if r.NASIdentifier == "" {
+		return "goproxy"
+	}
+	return r.NASIdentifier
+}
+
+// exchange sends p to the servers in order, and returns the first valid
+// answer.
+func (r *RADIUS) exchange(servers []string, p *radiusPacket) (*radiusPacket, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	p.id = byte(atomic.AddUint32(&r.id, 1))
+	packet := p.encode()
+	if p.code == radiusAccountingRequest {
+		auth := responseAuthenticator(packet, [16]byte{}, r.Secret)
+		copy(packet[4:20], auth[:])
+		p.authenticator = auth
+	} else if p.get(radiusMessageAuthenticator) != nil {
+		// The attribute is last, computed over the packet with itself zeroed.
+		mac := hmac.New(md5.New, []byte(r.Secret))
+		mac.Write(packet)
+		copy(packet[len(packet)-16:], mac.Sum(nil))
+	}
+
+	lastErr := ErrRADIUSTimeout
+	for _, server := range servers {
+		for attempt := 0; attempt <= r.Retries; attempt++ {
+			resp, err := r.send(server, packet, p, timeout)
+			if err == nil {
+				return resp, nil
+			}
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+func (r *RADIUS) send(server string, packet []byte, p *radiusPacket, timeout time.Duration) (*radiusPacket, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("radius: %s: %w", server, err)
+		}
+		resp, err := decodeRADIUS(buf[:n])
+		if err != nil || resp.id != p.id {
+			continue
+		}
+		if responseAuthenticator(buf[:n], p.authenticator, r.Secret) != resp.authenticator {
+			// Not signed with our secret, keep waiting for the genuine one.
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// Authenticate verifies the credentials and returns the identity of the user.
+func (r *RADIUS) Authenticate(user, passwd string) (*goproxy.Identity, error) {
+	p := &radiusPacket{code: radiusAccessRequest}
+	if _, err := io.ReadFull(rand.Reader, p.authenticator[:]); err != nil {
+		return nil, err
+	}
+	p.addString(radiusUserName, user)
+	p.add(radiusUserPassword, hidePassword(passwd, r.Secret, p.authenticator))
+	p.addString(radiusNASIdentifier, r.nasIdentifier())
+	p.add(radiusMessageAuthenticator, make([]byte, 16))
+
+	resp, err := r.exchange(r.Servers, p)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.code {
+	case radiusAccessAccept:
+	case radiusAccessReject:
+		if msg := resp.get(radiusReplyMessage); msg != nil {
+			return nil, fmt.Errorf("%w: %s", ErrRADIUSReject, msg)
+		}
+		return nil, ErrRADIUSReject
+	default:
+		return nil, fmt.Errorf("radius: unexpected response code %d", resp.code)
+	}
+
+	id := &goproxy.Identity{Name: user, Method: "radius"}
+	for _, a := range resp.attrs {
+		switch a.typ {
+		case radiusFilterID:
+			id.Groups = append(id.Groups, string(a.value))
+		case radiusClass:
+			if id.Attributes == nil {
+				id.Attributes = make(map[string]string)
+			}
+			id.Attributes["class"] = string(a.value)
+		}
+	}
+	return id, nil
+}
+
+// AcctRecord is an accounting record.
+type AcctRecord struct {
+	Status    AcctStatus
+	SessionID string
+	User      string
+	// Client is the address of the proxy client.
+	Client string
+	// The following are only sent in stop records.
+	Duration  time.Duration
+	InOctets  uint32
+	OutOctets uint32
+}
+
+// Account sends an accounting record to the accounting servers.
+func (r *RADIUS) Account(rec AcctRecord) error {
+	p := &radiusPacket{code: radiusAccountingRequest}
+	p.addUint32(radiusAcctStatusType, uint32(rec.Status))
+	p.addString(radiusAcctSessionID, rec.SessionID)
+	p.addString(radiusUserName, rec.User)
+	p.addString(radiusCallingStationID, rec.Client)
+	p.addString(radiusNASIdentifier, r.nasIdentifier())
+	if rec.Status == AcctStop {
+		p.addUint32(radiusAcctSessionTime, uint32(rec.Duration/time.Second))
+		p.addUint32(radiusAcctInputOctets, rec.InOctets)
+		p.addUint32(radiusAcctOutputOctets, rec.OutOctets)
+	}
+	resp, err := r.exchange(r.AccountingServers, p)
+	if err != nil {
+		return err
+	}
+	if resp.code != radiusAccountingResponse {
+		return fmt.Errorf("radius: unexpected response code %d", resp.code)
+	}
+	return nil
+}
+
+// Handler returns a basic HTTP authentication handler for requests, checking
+// the credentials against the RADIUS servers.
+func (r *RADIUS) Handler(realm string) goproxy.ReqHandler {
+	return basicAuth(realm, r.Authenticate).Handler()
+}
+
+// ConnectHandler returns a basic HTTP authentication handler for CONNECT
+// requests, checking the credentials against the RADIUS servers.
+func (r *RADIUS) ConnectHandler(realm string) goproxy.HttpsHandler {
+	return basicAuth(realm, r.Authenticate).ConnectHandler()
+}
+
+func (r *RADIUS) record(status AcctStatus, ctx *goproxy.ProxyCtx) AcctRecord {
+	rec := AcctRecord{
+		Status:    status,
+		SessionID: strconv.FormatInt(ctx.Session, 10),
+		Client:    ctx.Req.RemoteAddr,
+	}
+	if ctx.Identity != nil {
+		rec.User = ctx.Identity.Name
+	}
+	return rec
+}
+
+func (r *RADIUS) account(rec AcctRecord, ctx *goproxy.ProxyCtx) {
+	go func() {
+		if err := r.Account(rec); err != nil {
+			ctx.Warnf("RADIUS accounting failed: %v", err)
+		}
+	}()
+}
+
+// acctBody sends the stop record once the response has been sent.
+type acctBody struct {
+	io.ReadCloser
+	r     *RADIUS
+	ctx   *goproxy.ProxyCtx
+	start time.Time
+	n     int64
+	done  int32
+}
+
+func (b *acctBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *acctBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.done, 0, 1) {
+		rec := b.r.record(AcctStop, b.ctx)
+		rec.Duration = time.Since(b.start)
+		if b.ctx.Req.ContentLength > 0 {
+			rec.InOctets = uint32(b.ctx.Req.ContentLength)
+		}
+		rec.OutOctets = uint32(b.n)
+		b.r.account(rec, b.ctx)
+	}
+	return b.ReadCloser.Close()
+}
+
+// ProxyRADIUS will force HTTP authentication against the RADIUS servers
+// before any request to the proxy is processed, and send the accounting
+// records of the requests.
+func ProxyRADIUS(proxy *goproxy.ProxyHttpServer, realm string, r *RADIUS) {
+	proxy.OnRequest().Do(r.Handler(realm))
+	proxy.OnRequest().HandleConnect(r.ConnectHandler(realm))
+	if len(r.AccountingServers) == 0 {
+		return
+	}
+	proxy.OnRequest(goproxy.IsAuthenticated).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		r.account(r.record(AcctStart, ctx), ctx)
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil || ctx.Identity == nil {
+			return resp
+		}
+		resp.Body = &acctBody{ReadCloser: resp.Body, r: r, ctx: ctx, start: time.Now()}
+		return resp
+	})
+}
@@ -0,0 +1,146 @@
+package auth_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+)
+
+const radiusSecret = "testing123"
+
+// radiusServer answers Access-Request for alice/secret and accounting
+// requests, reporting the Acct-Status-Type of the latter on records.
+func radiusServer(t *testing.T, records chan<- uint32) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			attrs := map[byte][]byte{}
+			for rest := req[20:]; len(rest) >= 2; rest = rest[rest[1]:] {
+				attrs[rest[0]] = rest[2:rest[1]]
+			}
+			var resp []byte
+			switch req[0] {
+			case 1:
+				hidden := attrs[2]
+				passwd := make([]byte, len(hidden))
+				prev := req[4:20]
+				for i := 0; i < len(hidden); i += 16 {
+					sum := md5.Sum(append([]byte(radiusSecret), prev...))
+					for j := 0; j < 16; j++ {
+						passwd[i+j] = hidden[i+j] ^ sum[j]
+					}
+					prev = hidden[i : i+16]
+				}
+				code := byte(3)
+				var rattrs []byte
+				if string(attrs[1]) == "alice" && string(bytes.TrimRight(passwd, "\x00")) == "secret" {
+					code = 2
+					rattrs = append([]byte{11, 7}, "staff"...)
+				}
+				resp = append([]byte{code, req[1], 0, 0}, req[4:20]...)
+				resp = append(resp, rattrs...)
+			case 4:
+				records <- binary.BigEndian.Uint32(attrs[40])
+				resp = append([]byte{5, req[1], 0, 0}, req[4:20]...)
+			}
+			binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)))
+			sum := md5.Sum(append(append([]byte{}, resp...), radiusSecret...))
+			copy(resp[4:20], sum[:])
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// deadServer never answers.
+func deadServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestRADIUSFailover(t *testing.T) {
+	r := &auth.RADIUS{
+		Servers: []string{deadServer(t), radiusServer(t, nil)},
+		Secret:  radiusSecret,
+		Timeout: 100 * time.Millisecond,
+	}
+	id, err := r.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.InGroup("staff") {
+		t.Errorf("Expected Filter-Id group, got %+v", id)
+	}
+	if _, err := r.Authenticate("alice", "wrong"); !errors.Is(err, auth.ErrRADIUSReject) {
+		t.Errorf("Expected reject, got %v", err)
+	}
+}
+
+func TestProxyRADIUSAccounting(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ok"))
+	defer background.Close()
+
+	records := make(chan uint32, 2)
+	server := radiusServer(t, records)
+	proxy := goproxy.NewProxyHttpServer()
+	auth.ProxyRADIUS(proxy, "test", &auth.RADIUS{
+		Servers:           []string{server},
+		AccountingServers: []string{server},
+		Secret:            radiusSecret,
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	proxyURL.User = url.UserPassword("alice", "secret")
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %s", resp.Status)
+	}
+
+	seen := map[uint32]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case status := <-records:
+			seen[status] = true
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for accounting records")
+		}
+	}
+	if !seen[uint32(auth.AcctStart)] || !seen[uint32(auth.AcctStop)] {
+		t.Errorf("Expected start and stop records, got %v", seen)
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// TACACS+ constants, RFC 8907.
+const (
+	tacacsVersionPAP    = 0xc1
+	tacacsAuthen        = 0x01
+	tacacsLogin         = 0x01
+	tacacsTypePAP       = 0x02
+	tacacsServiceLogin  = 0x01
+	tacacsStatusPass    = 0x01
+	tacacsStatusFail    = 0x02
+	tacacsUnencrypted   = 0x01
+	tacacsHeaderLength  = 12
+	tacacsMaxBodyLength = 65536
+)
+
+var ErrTACACSReject = errors.New("tacacs+: authentication failed")
+
+// TACACS verifies proxy Basic credentials against TACACS+ servers with PAP
+// authentication. Servers are tried in order until one answers, a failure
+// reply from any of them is final.
+type TACACS struct {
+	// Servers are the host:port addresses of the servers.
+	Servers []string
+	// Key is the shared secret used to obfuscate the packets.
+	Key string
+	// Timeout of the exchange with each server. Defaults to 3 seconds.
+	Timeout time.Duration
+}
+
+// obfuscate XORs body with the pseudo pad of RFC 8907 section 4.5.
+func (t *TACACS) obfuscate(header, body []byte) {
+	var prev []byte
+	for i := 0; i < len(body); i += md5.Size {
+		h := md5.New()
+		h.Write(header[4:8])
+		h.Write([]byte(t.Key))
+		h.Write(header[0:1])
+		h.Write(header[2:3])
+		h.Write(prev)
+		prev = h.Sum(nil)
+		for j := 0; j < md5.Size && i+j < len(body); j++ {
+			body[i+j] ^= prev[j]
+		}
+	}
+}
+
+func (t *TACACS) authenticate(server, user, passwd string) (*goproxy.Identity, error) {
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if len(user) > 255 || len(passwd) > 255 {
+		return nil, errors.New("tacacs+: credentials too long")
+	}
+	body := []byte{tacacsLogin, 1, tacacsTypePAP, tacacsServiceLogin, byte(len(user)), 0, 0, byte(len(passwd))}
+	body = append(body, user...)
+	body = append(body, passwd...)
+
+	packet := make([]byte, tacacsHeaderLength, tacacsHeaderLength+len(body))
+	packet[0] = tacacsVersionPAP
+	packet[1] = tacacsAuthen
+	packet[2] = 1
+	if _, err := io.ReadFull(rand.Reader, packet[4:8]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(packet[8:], uint32(len(body)))
+	if t.Key == "" {
+		packet[3] = tacacsUnencrypted
+	} else {
+		t.obfuscate(packet, body)
+	}
+	if _, err := conn.Write(append(packet, body...)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, tacacsHeaderLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[8:])
+	if header[1] != tacacsAuthen || header[2] != 2 || string(header[4:8]) != string(packet[4:8]) || n < 6 || n > tacacsMaxBodyLength {
+		return nil, fmt.Errorf("tacacs+: %s: unexpected reply", server)
+	}
+	reply := make([]byte, n)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if header[3]&tacacsUnencrypted == 0 {
+		t.obfuscate(header, reply)
+	}
+
+	switch reply[0] {
+	case tacacsStatusPass:
+		return &goproxy.Identity{Name: user, Method: "tacacs+"}, nil
+	case tacacsStatusFail:
+		msgLen := int(binary.BigEndian.Uint16(reply[2:]))
+		if msgLen > 0 && 6+msgLen <= len(reply) {
+			return nil, fmt.Errorf("%w: %s", ErrTACACSReject, reply[6:6+msgLen])
+		}
+		return nil, ErrTACACSReject
+	default:
+		return nil, fmt.Errorf("tacacs+: %s: status %d", server, reply[0])
+	}
+}
+
+// Authenticate verifies the credentials and returns the identity of the user.
+func (t *TACACS) Authenticate(user, passwd string) (*goproxy.Identity, error) {
+	err := errors.New("tacacs+: no server configured")
+	for _, server := range t.Servers {
+		var id *goproxy.Identity
+		id, err = t.authenticate(server, user, passwd)
+		if err == nil || errors.Is(err, ErrTACACSReject) {
+			return id, err
+		}
+	}
+	return nil, err
+}
+
+// Handler returns a basic HTTP authentication handler for requests, checking
+// the credentials against the TACACS+ servers.
+func (t *TACACS) Handler(realm string) goproxy.ReqHandler {
+	return basicAuth(realm, t.Authenticate).Handler()
+}
+
+// ConnectHandler returns a basic HTTP authentication handler for CONNECT
+// requests, checking the credentials against the TACACS+ servers.
+func (t *TACACS) ConnectHandler(realm string) goproxy.HttpsHandler {
+	return basicAuth(realm, t.Authenticate).ConnectHandler()
+}
+
+// ProxyTACACS will force HTTP authentication against the TACACS+ servers
+// before any request to the proxy is processed.
+func ProxyTACACS(proxy *goproxy.ProxyHttpServer, realm string, t *TACACS) {
+	proxy.OnRequest().Do(t.Handler(realm))
+	proxy.OnRequest().HandleConnect(t.ConnectHandler(realm))
+}
@@ -0,0 +1,85 @@
+package auth_test
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy/ext/auth"
+)
+
+func tacacsPad(header []byte, key string, body []byte) {
+	var prev []byte
+	for i := 0; i < len(body); i += md5.Size {
+		h := md5.New()
+		h.Write(header[4:8])
+		h.Write([]byte(key))
+		h.Write([]byte{header[0], header[2]})
+		h.Write(prev)
+		prev = h.Sum(nil)
+		for j := 0; j < md5.Size && i+j < len(body); j++ {
+			body[i+j] ^= prev[j]
+		}
+	}
+}
+
+func tacacsServer(t *testing.T, key string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, 12)
+			if _, err := io.ReadFull(c, header); err != nil {
+				c.Close()
+				continue
+			}
+			body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+			_, _ = io.ReadFull(c, body)
+			tacacsPad(header, key, body)
+			user := string(body[8 : 8+body[4]])
+			passwd := string(body[8+int(body[4])+int(body[5])+int(body[6]):])
+
+			status := byte(2)
+			if user == "alice" && passwd == "secret" {
+				status = 1
+			}
+			reply := []byte{status, 0, 0, 0, 0, 0}
+			header[2] = 2
+			binary.BigEndian.PutUint32(header[8:], uint32(len(reply)))
+			tacacsPad(header, key, reply)
+			_, _ = c.Write(append(header, reply...))
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTACACS(t *testing.T) {
+	// The first server refuses connections.
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	l.Close()
+
+	tac := &auth.TACACS{Servers: []string{dead, tacacsServer(t, "key")}, Key: "key"}
+	id, err := tac.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Name != "alice" || id.Method != "tacacs+" {
+		t.Errorf("Unexpected identity %+v", id)
+	}
+	if _, err := tac.Authenticate("alice", "wrong"); !errors.Is(err, auth.ErrTACACSReject) {
+		t.Errorf("Expected reject, got %v", err)
+	}
+}
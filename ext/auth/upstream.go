@@ -0,0 +1,487 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+const (
+	schemeBasic  = "Basic"
+	schemeDigest = "Digest"
+	schemeNTLM   = "NTLM"
+)
+
+// ErrUpstreamProxyAuth is goproxy.ErrUpstreamProxyAuth, the failure of the
+// authentication with the upstream proxy.
+var ErrUpstreamProxyAuth = goproxy.ErrUpstreamProxyAuth
+
+// UpstreamProxy answers the 407 challenges sent by an upstream proxy, both for
+// CONNECT requests and for absolute-form HTTP requests.
+// The Basic, Digest and NTLM schemes are supported, the strongest one offered
+// by the upstream proxy is used. Once a scheme has been negotiated, it's
+// cached and the next requests are authenticated preemptively.
+type UpstreamProxy struct {
+	URL      *url.URL
+	Domain   string
+	Username string
+	Password string
+
+	proxy *goproxy.ProxyHttpServer
+	tr    *http.Transport
+
+	mu     sync.Mutex
+	scheme string
+	digest *digestChallenge
+}
+
+// NewUpstreamProxy creates an UpstreamProxy for the proxy at proxyURL.
+// When the URL contains user info, it's used as credentials, an NTLM domain can
+// be given with the DOMAIN\user form.
+func NewUpstreamProxy(proxy *goproxy.ProxyHttpServer, proxyURL string) (*UpstreamProxy, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	up := &UpstreamProxy{URL: u, proxy: proxy}
+	if u.User != nil {
+		up.Username = u.User.Username()
+		up.Password, _ = u.User.Password()
+		if domain, user, ok := strings.Cut(up.Username, `\`); ok {
+			up.Domain, up.Username = domain, user
+		}
+		u.User = nil
+	}
+	switch u.Scheme {
+	case "", "http":
+		u.Scheme = "http"
+		if u.Port() == "" {
+			u.Host += ":80"
+		}
+	case "https":
+		if u.Port() == "" {
+			u.Host += ":443"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", u.Scheme)
+	}
+
+	up.tr = proxy.Tr.Clone()
+	up.tr.Proxy = http.ProxyURL(u)
+	return up, nil
+}
+
+// Install routes all the proxy traffic through the upstream proxy.
+func (u *UpstreamProxy) Install() {
+	u.proxy.ConnectDial = u.ConnectDial
+	u.proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.RoundTripper = u
+		return req, nil
+	})
+}
+
+// ConnectDial opens a tunnel to addr through the upstream proxy.
+// It can be used as ProxyHttpServer.ConnectDial.
+func (u *UpstreamProxy) ConnectDial(network, addr string) (net.Conn, error) {
+	var c net.Conn
+	var br *bufio.Reader
+	send := func(authorization string) (*http.Response, error) {
+		if c == nil {
+			var err error
+			if c, err = u.dialProxy(network); err != nil {
+				return nil, err
+			}
+			br = bufio.NewReader(c)
+		}
+		connectReq := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if authorization != "" {
+			connectReq.Header.Set("Proxy-Authorization", authorization)
+		}
+		if err := connectReq.Write(c); err != nil {
+			return nil, err
+		}
+		resp, err := http.ReadResponse(br, connectReq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			if resp.Close {
+				// The next attempt needs a fresh connection
+				_ = c.Close()
+				c = nil
+			}
+		}
+		return resp, nil
+	}
+
+	resp, err := u.negotiate(http.MethodConnect, addr, send)
+	if err != nil {
+		if c != nil {
+			_ = c.Close()
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if c != nil {
+			_ = c.Close()
+		}
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, ErrUpstreamProxyAuth
+		}
+		return nil, errors.New("proxy refused connection " + resp.Status)
+	}
+	return c, nil
+}
+
+func (u *UpstreamProxy) dialProxy(network string) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if u.tr.DialContext != nil {
+		c, err = u.tr.DialContext(context.Background(), network, u.URL.Host)
+	} else {
+		c, err = net.Dial(network, u.URL.Host)
+	}
+	if err != nil || u.URL.Scheme != "https" {
+		return c, err
+	}
+	cfg := &tls.Config{}
+	if u.tr.TLSClientConfig != nil {
+		cfg = u.tr.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.URL.Hostname()
+	}
+	tlsConn := tls.Client(c, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// heldBody is a request body expecting 100 Continue, which may be sent
+// again while it hasn't been read.
+type heldBody struct {
+	io.ReadCloser
+	started int32
+}
+
+func (b *heldBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.started, 1)
+	return b.ReadCloser.Read(p)
+}
+
+func (b *heldBody) read() bool {
+	return atomic.LoadInt32(&b.started) == 1
+}
+
+// Close closes the body once it is read, the transport closing the bodies
+// that it doesn't send.
+func (b *heldBody) Close() error {
+	if b.read() {
+		return b.ReadCloser.Close()
+	}
+	return nil
+}
+
+// pinnedBody closes the connection of the NTLM handshake of the response
+// once its body is closed.
+type pinnedBody struct {
+	io.ReadCloser
+	tr *http.Transport
+}
+
+func (b *pinnedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.tr.CloseIdleConnections()
+	return err
+}
+
+// RoundTrip sends an absolute-form request through the upstream proxy.
+// A request whose body can't be replayed is sent only once, with the
+// cached credentials if any, unless it expects 100 Continue: its body is
+// then only sent once the upstream proxy accepted the credentials.
+func (u *UpstreamProxy) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	var held *heldBody
+	if !replayable && u.tr.ExpectContinueTimeout > 0 &&
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		held = &heldBody{ReadCloser: req.Body}
+		defer func() {
+			if !held.read() {
+				held.ReadCloser.Close()
+			}
+		}()
+	}
+	first := true
+	// NTLM authenticates a connection: the legs of its handshake go through
+	// a transport of their own, of a single connection closed with the
+	// response, rather than through the connections shared by the requests.
+	var pinned *http.Transport
+	send := func(authorization string) (*http.Response, error) {
+		tr := u.tr
+		if strings.HasPrefix(authorization, schemeNTLM+" ") {
+			if pinned == nil {
+				pinned = u.tr.Clone()
+				pinned.MaxConnsPerHost = 1
+			}
+			tr = pinned
+		}
+		out := req.Clone(req.Context())
+		if held != nil {
+			if held.read() {
+				return nil, ErrUpstreamProxyAuth
+			}
+			out.Body = held
+		} else if !first {
+			if !replayable {
+				return nil, ErrUpstreamProxyAuth
+			}
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				out.Body = body
+			}
+		}
+		first = false
+		if authorization != "" {
+			out.Header.Set("Proxy-Authorization", authorization)
+		}
+		resp, err := tr.RoundTrip(out)
+		if err == nil && resp.StatusCode == http.StatusProxyAuthRequired && (replayable || held != nil) {
+			// Drain the body, so that the connection can be reused for the
+			// connection oriented schemes.
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		}
+		return resp, err
+	}
+	resp, err := u.negotiate(req.Method, req.URL.RequestURI(), send)
+	if pinned != nil {
+		if resp != nil {
+			resp.Body = &pinnedBody{ReadCloser: resp.Body, tr: pinned}
+		} else {
+			pinned.CloseIdleConnections()
+		}
+	}
+	if errors.Is(err, ErrUpstreamProxyAuth) && resp != nil {
+		return resp, nil
+	}
+	return resp, err
+}
+
+// negotiate executes the challenge-response exchange, using send to deliver
+// each attempt with the given Proxy-Authorization value.
+func (u *UpstreamProxy) negotiate(
+	method, uri string,
+	send func(authorization string) (*http.Response, error),
+) (*http.Response, error) {
+	authorization, handshake := u.preemptive(method, uri)
+	resp, err := send(authorization)
+	// NTLM needs up to three round trips: anonymous, negotiate and authenticate.
+	for attempt := 0; err == nil && resp.StatusCode == http.StatusProxyAuthRequired && attempt < 3; attempt++ {
+		authorization, handshake, err = u.respond(method, uri, resp, handshake)
+		if err != nil {
+			return resp, nil
+		}
+		var next *http.Response
+		next, err = send(authorization)
+		if err != nil {
+			return resp, err
+		}
+		resp.Body.Close()
+		resp = next
+	}
+	return resp, err
+}
+
+// preemptive returns the authorization sent with the first attempt, based on
+// the scheme previously negotiated with the upstream proxy.
+func (u *UpstreamProxy) preemptive(method, uri string) (string, *ntlmHandshake) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch u.scheme {
+	case schemeBasic:
+		return u.basic(), nil
+	case schemeDigest:
+		return u.digest.authorization(u.Username, u.Password, method, uri), nil
+	case schemeNTLM:
+		handshake, err := u.ntlm().handshake()
+		if err != nil {
+			return "", nil
+		}
+		return handshake.negotiate(), handshake
+	}
+	return "", nil
+}
+
+// respond computes the authorization answering the challenges of resp.
+func (u *UpstreamProxy) respond(
+	method, uri string,
+	resp *http.Response,
+	handshake *ntlmHandshake,
+) (string, *ntlmHandshake, error) {
+	if u.Username == "" {
+		return "", nil, ErrUpstreamProxyAuth
+	}
+	challenges := resp.Header.Values("Proxy-Authenticate")
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if token, ok := findChallenge(challenges, schemeNTLM); ok {
+		if token == "" || handshake == nil {
+			var err error
+			if handshake, err = u.ntlm().handshake(); err != nil {
+				return "", nil, err
+			}
+			u.scheme = schemeNTLM
+			return handshake.negotiate(), handshake, nil
+		}
+		authorization, err := handshake.authenticate(token)
+		return authorization, nil, err
+	}
+	if params, ok := findChallenge(challenges, schemeDigest); ok {
+		challenge := parseDigestChallenge(params)
+		if challenge.nonce == "" {
+			return "", nil, ErrUpstreamProxyAuth
+		}
+		if u.scheme == schemeDigest && u.digest != nil && u.digest.nonce == challenge.nonce && !challenge.stale {
+			// Same nonce rejected again: the credentials are wrong
+			return "", nil, ErrUpstreamProxyAuth
+		}
+		u.scheme, u.digest = schemeDigest, challenge
+		return challenge.authorization(u.Username, u.Password, method, uri), nil, nil
+	}
+	if _, ok := findChallenge(challenges, schemeBasic); ok {
+		if u.scheme == schemeBasic {
+			return "", nil, ErrUpstreamProxyAuth
+		}
+		u.scheme = schemeBasic
+		return u.basic(), nil, nil
+	}
+	return "", nil, ErrUpstreamProxyAuth
+}
+
+func (u *UpstreamProxy) ntlm() *NTLMAuth {
+	return &NTLMAuth{Domain: u.Domain, Username: u.Username, Password: u.Password}
+}
+
+func (u *UpstreamProxy) basic() string {
+	return schemeBasic + " " + base64.StdEncoding.EncodeToString([]byte(u.Username+":"+u.Password))
+}
+
+// findChallenge returns the parameters of the challenge for scheme.
+func findChallenge(challenges []string, scheme string) (string, bool) {
+	for _, c := range challenges {
+		name, params, _ := strings.Cut(strings.TrimSpace(c), " ")
+		if strings.EqualFold(name, scheme) {
+			return strings.TrimSpace(params), true
+		}
+	}
+	return "", false
+}
+
+type digestChallenge struct {
+	realm  string
+	nonce  string
+	opaque string
+	qop    string
+	stale  bool
+	nc     uint32
+}
+
+func parseDigestChallenge(s string) *digestChallenge {
+	c := &digestChallenge{}
+	for _, p := range splitDigestParams(s) {
+		k, v, _ := strings.Cut(p, "=")
+		v = strings.Trim(strings.TrimSpace(v), `"`)
+		switch strings.ToLower(strings.TrimSpace(k)) {
+		case "realm":
+			c.realm = v
+		case "nonce":
+			c.nonce = v
+		case "opaque":
+			c.opaque = v
+		case "stale":
+			c.stale = strings.EqualFold(v, "true")
+		case "qop":
+			for _, q := range strings.Split(v, ",") {
+				if strings.TrimSpace(q) == "auth" {
+					c.qop = "auth"
+				}
+			}
+		}
+	}
+	return c
+}
+
+// splitDigestParams splits the comma separated parameters, ignoring the
+// commas inside quoted strings.
+func splitDigestParams(s string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s)) //nolint:gosec // Required by the Digest scheme
+	return hex.EncodeToString(sum[:])
+}
+
+// authorization must be called with the UpstreamProxy lock held, since it
+// increments the nonce count.
+func (c *digestChallenge) authorization(user, password, method, uri string) string {
+	ha1 := md5Hex(user + ":" + c.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`, user, c.realm, c.nonce, uri)
+	if c.qop != "" {
+		c.nc++
+		nc := fmt.Sprintf("%08x", c.nc)
+		cnonceRaw := make([]byte, 8)
+		_, _ = rand.Read(cnonceRaw)
+		cnonce := hex.EncodeToString(cnonceRaw)
+		response := md5Hex(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + c.qop + ":" + ha2)
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s", response="%s"`, c.qop, nc, cnonce, response)
+	} else {
+		fmt.Fprintf(&b, `, response="%s"`, md5Hex(ha1+":"+c.nonce+":"+ha2))
+	}
+	if c.opaque != "" {
+		fmt.Fprintf(&b, `, opaque="%s"`, c.opaque)
+	}
+	return b.String()
+}
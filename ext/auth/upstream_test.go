@@ -0,0 +1,377 @@
+package auth_test
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+	"github.com/vadimi/go-ntlm/ntlm"
+)
+
+func proxyThrough(t *testing.T, upstreamURL string) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	up, err := auth.NewUpstreamProxy(proxy, upstreamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.Install()
+	client, s := oneShotProxy(proxy)
+	t.Cleanup(s.Close)
+	return client
+}
+
+func TestUpstreamBasic(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("hello"))
+	defer background.Close()
+
+	upstream := goproxy.NewProxyHttpServer()
+	auth.ProxyBasic(upstream, "my_realm", func(user, passwd string) bool {
+		return user == "user" && passwd == "open sesame"
+	})
+	upstreamServer := httptest.NewServer(upstream)
+	defer upstreamServer.Close()
+
+	u, _ := url.Parse(upstreamServer.URL)
+	u.User = url.UserPassword("user", "open sesame")
+	client := proxyThrough(t, u.String())
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("Expected 'hello', got %q (%s)", body, resp.Status)
+		}
+	}
+}
+
+func TestUpstreamBasicWrongCredentials(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("hello"))
+	defer background.Close()
+
+	upstream := goproxy.NewProxyHttpServer()
+	auth.ProxyBasic(upstream, "my_realm", func(user, passwd string) bool {
+		return false
+	})
+	upstreamServer := httptest.NewServer(upstream)
+	defer upstreamServer.Close()
+
+	u, _ := url.Parse(upstreamServer.URL)
+	u.User = url.UserPassword("user", "wrong")
+	client := proxyThrough(t, u.String())
+
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("Expected 407, got %s", resp.Status)
+	}
+}
+
+// digestProxy is a minimal upstream proxy accepting only Digest credentials.
+type digestProxy struct {
+	target http.Handler
+}
+
+func (p digestProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	params := map[string]string{}
+	header := r.Header.Get("Proxy-Authorization")
+	if strings.HasPrefix(header, "Digest ") {
+		for _, p := range strings.Split(strings.TrimPrefix(header, "Digest "), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+	h := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := h("user:test:secret")
+	ha2 := h(r.Method + ":" + params["uri"])
+	expected := h(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+	if params["response"] != expected {
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf(`Digest realm="test", qop="auth", nonce="%s"`, nonce))
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	p.target.ServeHTTP(w, r)
+}
+
+func TestUpstreamDigest(t *testing.T) {
+	upstream := httptest.NewServer(digestProxy{ConstantHanlder("digest")})
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	u.User = url.UserPassword("user", "secret")
+	client := proxyThrough(t, u.String())
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://example.invalid/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "digest" {
+			t.Errorf("Expected 'digest', got %q (%s)", body, resp.Status)
+		}
+	}
+}
+
+func TestUpstreamDigestExpectContinue(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	})
+	upstream := httptest.NewServer(digestProxy{echo})
+	defer upstream.Close()
+
+	u, _ := url.Parse(upstream.URL)
+	u.User = url.UserPassword("user", "secret")
+	client := proxyThrough(t, u.String())
+
+	// The body of unknown length can't be replayed, but it isn't sent
+	// before the upstream proxy accepts the credentials.
+	req, _ := http.NewRequest(http.MethodPost, "http://example.invalid/upload",
+		io.MultiReader(strings.NewReader("payload")))
+	req.Header.Set("Expect", "100-continue")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "payload" {
+		t.Errorf("Expected 'payload', got %q (%s)", body, resp.Status)
+	}
+}
+
+func TestUpstreamNTLMConnect(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ntlm"))
+	defer background.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		session, _ := ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionlessMode)
+		session.SetUserInfo("user", "secret", "DOMAIN")
+		br := bufio.NewReader(c)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			token := strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "NTLM ")
+			raw, _ := base64.StdEncoding.DecodeString(token)
+			if len(raw) > 8 && raw[8] == 3 {
+				msg, err := ntlm.ParseAuthenticateMessage(raw, 2)
+				if err != nil {
+					return
+				}
+				if session.ProcessAuthenticateMessage(msg) != nil {
+					_, _ = io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				_, _ = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go func() { _, _ = io.Copy(target, br) }()
+				_, _ = io.Copy(c, target)
+				return
+			}
+			challenge := "NTLM"
+			if token != "" {
+				msg, _ := session.GenerateChallengeMessage()
+				challenge += " " + base64.StdEncoding.EncodeToString(msg.Bytes())
+			}
+			_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: "+challenge+"\r\nContent-Length: 0\r\n\r\n")
+		}
+	}()
+
+	proxy := goproxy.NewProxyHttpServer()
+	up, err := auth.NewUpstreamProxy(proxy, `http://DOMAIN%5Cuser:secret@`+l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := up.ConnectDial("tcp", background.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ntlm" {
+		t.Errorf("Expected 'ntlm', got %q", body)
+	}
+}
+
+// ntlmProxy serves the absolute-form requests, authenticating each
+// connection with NTLM. When set, legs receives the legs of the handshake
+// and the requests served, with the address of their connection.
+func ntlmProxy(t *testing.T, legs chan<- string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	serve := func(c net.Conn) {
+		defer c.Close()
+		var session ntlm.ServerSession
+		authenticated := false
+		record := func(leg string) {
+			if legs != nil {
+				legs <- c.RemoteAddr().String() + " " + leg
+			}
+		}
+		br := bufio.NewReader(c)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, req.Body)
+			token := strings.TrimPrefix(req.Header.Get("Proxy-Authorization"), "NTLM ")
+			raw, _ := base64.StdEncoding.DecodeString(token)
+			switch {
+			case len(raw) > 8 && raw[8] == 3:
+				record("authenticate")
+				msg, err := ntlm.ParseAuthenticateMessage(raw, 2)
+				if err != nil || session == nil || session.ProcessAuthenticateMessage(msg) != nil {
+					// The handshake went through another connection.
+					_, _ = io.WriteString(c, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+					return
+				}
+				authenticated = true
+			case len(raw) > 8 && raw[8] == 1:
+				record("negotiate")
+				session, _ = ntlm.CreateServerSession(ntlm.Version2, ntlm.ConnectionOrientedMode)
+				session.SetUserInfo("user", "secret", "DOMAIN")
+				msg, _ := session.GenerateChallengeMessage()
+				_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+					"Proxy-Authenticate: NTLM "+base64.StdEncoding.EncodeToString(msg.Bytes())+"\r\nContent-Length: 0\r\n\r\n")
+				continue
+			}
+			if !authenticated {
+				_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+					"Proxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n")
+				continue
+			}
+			record("request")
+			req.RequestURI = ""
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				return
+			}
+			err = resp.Write(c)
+			resp.Body.Close()
+			if err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return l
+}
+
+func TestUpstreamNTLMConcurrent(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ntlm"))
+	defer background.Close()
+	l := ntlmProxy(t, nil)
+	client := proxyThrough(t, `http://DOMAIN%5Cuser:secret@`+l.Addr().String())
+
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			resp, err := client.Get(background.URL)
+			if err != nil {
+				errs <- err
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "ntlm" {
+				err = fmt.Errorf("expected 'ntlm', got %q (%s)", body, resp.Status)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestUpstreamNTLMHandshake(t *testing.T) {
+	background := httptest.NewServer(ConstantHanlder("ntlm"))
+	defer background.Close()
+	legs := make(chan string, 16)
+	l := ntlmProxy(t, legs)
+	client := proxyThrough(t, `http://DOMAIN%5Cuser:secret@`+l.Addr().String())
+
+	// The second request authenticates preemptively.
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ntlm" {
+			t.Fatalf("Expected 'ntlm', got %q (%s)", body, resp.Status)
+		}
+		var conn string
+		for _, want := range []string{"negotiate", "authenticate", "request"} {
+			addr, leg, _ := strings.Cut(<-legs, " ")
+			if leg != want {
+				t.Fatalf("Expected %s, got %s", want, leg)
+			}
+			if conn == "" {
+				conn = addr
+			} else if addr != conn {
+				t.Errorf("Expected the %s on %s, got %s", leg, conn, addr)
+			}
+		}
+	}
+}
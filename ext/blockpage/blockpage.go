@@ -0,0 +1,297 @@
+// Package blockpage serves branded pages for the blocked requests, and
+// notification pages the users must acknowledge before continuing:
+//
+//	b := blockpage.New("helpdesk@example.com")
+//	b.Add(blockpage.Rule{
+//		ID:        "social",
+//		Reason:    "Social networks are not allowed",
+//		Condition: goproxy.ReqHostIs("www.facebook.com:443", "www.facebook.com"),
+//		Mitm:      true,
+//	})
+//	b.Install(proxy)
+//
+// The HTTPS requests can only be answered with a page once the tunnel is
+// MITM'd. The Mitm rules forge a certificate only to deliver the page, the
+// other tunnels being rejected.
+package blockpage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ackParam is the query parameter acknowledging a notification.
+const ackParam = "goproxy-ack"
+
+// Rule selects the requests receiving a page.
+type Rule struct {
+	ID        string
+	Reason    string
+	Condition goproxy.ReqCondition
+	// Mitm delivers the page to the HTTPS clients, instead of rejecting
+	// their tunnels.
+	Mitm bool
+	// Notify lets the user continue to the site after acknowledging the
+	// page, instead of blocking it.
+	Notify bool
+}
+
+// Page is the data of the page templates.
+type Page struct {
+	RuleID       string
+	Reason       string
+	URL          string
+	Host         string
+	Client       string
+	Organization string
+	Contact      string
+	Time         time.Time
+	// RequestID is the ID of the request in the proxy logs, see
+	// goproxy.ProxyCtx.RequestID.
+	RequestID string
+	// ContinueURL acknowledges a notification, it is empty for blocks.
+	ContinueURL string
+}
+
+// DefaultTemplate is the default page template.
+var DefaultTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{if .ContinueURL}}Notice{{else}}Access denied{{end}}</title></head>
+<body>
+<h1>{{if .ContinueURL}}Notice{{else}}Access to {{.Host}} is denied{{end}}</h1>
+<p>{{.Reason}}</p>
+{{if .ContinueURL}}<p><a href="{{.ContinueURL}}">Continue to {{.Host}}</a></p>{{end}}
+<p><small>Rule {{.RuleID}}, {{.Time.Format "2006-01-02 15:04:05 MST"}}, client {{.Client}}{{if .RequestID}}, request {{.RequestID}}{{end}}.
+{{if .Contact}}Contact {{.Contact}}{{if .Organization}} at {{.Organization}}{{end}} if you think this is an error.{{end}}</small></p>
+</body>
+</html>
+`))
+
+// Blocker serves the pages of its rules.
+type Blocker struct {
+	Rules        []Rule
+	Template     *template.Template
+	Organization string
+	Contact      string
+	// Status of the block pages, 403 Forbidden by default. The
+	// notifications are sent with 200 OK.
+	Status int
+	// CA signs the certificates of the Mitm rules, GoproxyCa by default.
+	CA *tls.Certificate
+	// AcknowledgeTTL is how long an acknowledged notification isn't shown
+	// again to a client, 24 hours by default.
+	AcknowledgeTTL time.Duration
+
+	mu   sync.Mutex
+	acks map[string]time.Time
+}
+
+// New returns a Blocker with the default template.
+func New(contact string) *Blocker {
+	return &Blocker{
+		Template: DefaultTemplate,
+		Contact:  contact,
+		acks:     make(map[string]time.Time),
+	}
+}
+
+// Add appends rules, tried in order.
+func (b *Blocker) Add(rules ...Rule) {
+	b.Rules = append(b.Rules, rules...)
+}
+
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+func ackKey(req *http.Request, rule *Rule) string {
+	return clientIP(req) + " " + rule.ID
+}
+
+func (b *Blocker) acknowledged(req *http.Request, rule *Rule) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := ackKey(req, rule)
+	expires, ok := b.acks[key]
+	if ok && time.Now().After(expires) {
+		delete(b.acks, key)
+		return false
+	}
+	return ok
+}
+
+func (b *Blocker) acknowledge(req *http.Request, rule *Rule) {
+	ttl := b.AcknowledgeTTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.acks == nil {
+		b.acks = make(map[string]time.Time)
+	}
+	b.acks[ackKey(req, rule)] = time.Now().Add(ttl)
+}
+
+// match returns the first rule matching req, skipping the acknowledged
+// notifications.
+func (b *Blocker) match(req *http.Request, ctx *goproxy.ProxyCtx) *Rule {
+	for i := range b.Rules {
+		rule := &b.Rules[i]
+		if rule.Condition != nil && !rule.Condition.HandleReq(req, ctx) {
+			continue
+		}
+		if rule.Notify && b.acknowledged(req, rule) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// Response returns the page of rule for req.
+func (b *Blocker) Response(req *http.Request, rule *Rule) *http.Response {
+	return b.response(req, rule, "")
+}
+
+func (b *Blocker) response(req *http.Request, rule *Rule, requestID string) *http.Response {
+	page := Page{
+		RuleID:       rule.ID,
+		Reason:       rule.Reason,
+		URL:          req.URL.String(),
+		Host:         req.URL.Hostname(),
+		Client:       clientIP(req),
+		Organization: b.Organization,
+		Contact:      b.Contact,
+		Time:         time.Now(),
+		RequestID:    requestID,
+	}
+	status := b.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if rule.Notify {
+		u := *req.URL
+		q := u.Query()
+		q.Set(ackParam, rule.ID)
+		u.RawQuery = q.Encode()
+		page.ContinueURL = u.String()
+		status = http.StatusOK
+	}
+
+	tmpl := b.Template
+	if tmpl == nil {
+		tmpl = DefaultTemplate
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+	}
+	resp := goproxy.NewResponse(req, "text/html; charset=utf-8", status, buf.String())
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// Handle implements goproxy.ReqHandler.
+func (b *Blocker) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if id := req.URL.Query().Get(ackParam); id != "" {
+		for i := range b.Rules {
+			if rule := &b.Rules[i]; rule.ID == id && rule.Notify {
+				b.acknowledge(req, rule)
+				u := *req.URL
+				q := u.Query()
+				q.Del(ackParam)
+				u.RawQuery = q.Encode()
+				resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusFound, "")
+				resp.Header.Set("Location", u.String())
+				return nil, resp
+			}
+		}
+	}
+	if rule := b.match(req, ctx); rule != nil {
+		ctx.Logf("Request to %s matched rule %s", req.URL.Host, rule.ID)
+		if !rule.Notify {
+			ctx.Error = &goproxy.ErrBlockedByRule{RuleID: rule.ID, Reason: rule.Reason}
+		}
+		return nil, b.response(req, rule, ctx.RequestID())
+	}
+	return req, nil
+}
+
+// HandleConnect rejects the tunnels matching a rule, or delivers their page
+// for the Mitm rules. The notification tunnels are MITM'd, so that the page
+// can be acknowledged.
+func (b *Blocker) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	rule := b.match(ctx.Req, ctx)
+	switch {
+	case rule == nil:
+		return nil, host
+	case rule.Notify:
+		return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(b.ca())}, host
+	case rule.Mitm:
+		return &goproxy.ConnectAction{
+			Action: goproxy.ConnectHijack,
+			Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				b.deliver(host, rule, client, ctx)
+			},
+		}, host
+	}
+	return goproxy.RejectConnect, host
+}
+
+func (b *Blocker) ca() *tls.Certificate {
+	if b.CA != nil {
+		return b.CA
+	}
+	return &goproxy.GoproxyCa
+}
+
+// deliver answers every request of the hijacked tunnel with the page of
+// rule, without connecting to the destination.
+func (b *Blocker) deliver(host string, rule *Rule, client net.Conn, ctx *goproxy.ProxyCtx) {
+	defer client.Close()
+	if _, err := client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n")); err != nil {
+		return
+	}
+	config, err := goproxy.TLSConfigFromCA(b.ca())(host, ctx)
+	if err != nil {
+		ctx.Warnf("Cannot sign the certificate of %s: %v", host, err)
+		return
+	}
+	conn := tls.Server(client, config)
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		req.RemoteAddr = ctx.Req.RemoteAddr
+		req.URL, _ = url.Parse("https://" + strings.TrimSuffix(host, ":443") + req.URL.RequestURI())
+		resp := b.response(req, rule, ctx.RequestID())
+		err = resp.Write(conn)
+		req.Body.Close()
+		if err != nil || req.Close {
+			return
+		}
+	}
+}
+
+// Install serves the pages on proxy.
+func (b *Blocker) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnect(b)
+	proxy.OnRequest().Do(b)
+}
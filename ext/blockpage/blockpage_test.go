@@ -0,0 +1,103 @@
+package blockpage_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/blockpage"
+)
+
+func newClient(t *testing.T, b *blockpage.Blocker) (*http.Client, func()) {
+	proxy := goproxy.NewProxyHttpServer()
+	b.Install(proxy)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "allowed")
+	})
+	srv := httptest.NewServer(proxy)
+	u, _ := url.Parse(srv.URL)
+	pool := x509.NewCertPool()
+	pool.AddCert(goproxy.GoproxyCa.Leaf)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(u), TLSClientConfig: &tls.Config{RootCAs: pool}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client, srv.Close
+}
+
+func get(t *testing.T, client *http.Client, u string) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestBlock(t *testing.T) {
+	b := blockpage.New("helpdesk@example.com")
+	b.Add(blockpage.Rule{
+		ID:        "games",
+		Reason:    "Games are not allowed",
+		Condition: goproxy.ReqHostIs("games.example.com", "games.example.com:443"),
+		Mitm:      true,
+	}, blockpage.Rule{
+		ID:        "tunnel",
+		Condition: goproxy.ReqHostIs("tunnel.example.com:443"),
+	})
+	client, done := newClient(t, b)
+	defer done()
+
+	resp, body := get(t, client, "http://games.example.com/play")
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "Games are not allowed") ||
+		!strings.Contains(body, "helpdesk@example.com") || !strings.Contains(body, "Rule games") {
+		t.Errorf("Expected the block page, got %s %q", resp.Status, body)
+	}
+
+	resp, body = get(t, client, "https://games.example.com/play")
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "Access to games.example.com is denied") {
+		t.Errorf("Expected the block page over HTTPS, got %s %q", resp.Status, body)
+	}
+
+	if _, err := client.Get("https://tunnel.example.com/"); err == nil {
+		t.Error("Expected the tunnel to be rejected")
+	}
+
+	if _, body = get(t, client, "http://www.example.com/"); body != "allowed" {
+		t.Errorf("Expected the other requests to be allowed, got %q", body)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	b := blockpage.New("")
+	b.Add(blockpage.Rule{
+		ID:        "aup",
+		Reason:    "Your browsing is monitored",
+		Condition: goproxy.ReqHostIs("www.example.com"),
+		Notify:    true,
+	})
+	client, done := newClient(t, b)
+	defer done()
+
+	resp, body := get(t, client, "http://www.example.com/page?a=1")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "goproxy-ack=aup") {
+		t.Fatalf("Expected the notification, got %s %q", resp.Status, body)
+	}
+	resp, _ = get(t, client, "http://www.example.com/page?a=1&goproxy-ack=aup")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "http://www.example.com/page?a=1" {
+		t.Fatalf("Expected a redirection to the page, got %s %s", resp.Status, resp.Header.Get("Location"))
+	}
+	if _, body = get(t, client, "http://www.example.com/page?a=1"); body != "allowed" {
+		t.Errorf("Expected the acknowledged notification to be skipped, got %q", body)
+	}
+}
@@ -0,0 +1,312 @@
+// Package bodystore stores the bodies captured by the proxy, for the
+// recording, HAR and inspection subsystems whose captures outgrow the
+// memory or the local disk:
+//
+//	store, err := bodystore.OpenBolt("/var/lib/proxy/bodies.db")
+//	capture := &bodystore.Capture{Store: store}
+//	capture.Install(proxy)
+//	retention := &bodystore.Retention{MaxAge: 7 * 24 * time.Hour, MaxBytes: 50 << 30}
+//	go retention.Run(ctx, store)
+//
+// The stores are a directory with Dir, an S3-compatible bucket with S3, or
+// a bbolt database with Bolt. The bodies are stored under keys of the host
+// and the day of their request, such as example.com/2026-10-14/42.response,
+// listed later by their prefix.
+package bodystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ErrNotFound is returned for the keys missing from a store.
+var ErrNotFound = errors.New("bodystore: not found")
+
+// Info describes a stored body.
+type Info struct {
+	Key     string
+	Size    int64
+	Created time.Time
+}
+
+// Store stores the bodies by key. The keys are paths of slash-separated
+// segments, without . or .. segments.
+type Store interface {
+	// Put stores the body read from r under key, replacing the previous
+	// one. Nothing is stored when reading r fails.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the body stored under key, or ErrNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete deletes the body stored under key, or returns ErrNotFound.
+	Delete(ctx context.Context, key string) error
+	// List returns the bodies whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]Info, error)
+}
+
+// validKey returns an error for the keys that can't be stored.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return fmt.Errorf("bodystore: invalid key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("bodystore: invalid key %q", key)
+		}
+	}
+	return nil
+}
+
+// errTooLarge aborts the capture of the bodies beyond MaxBodySize.
+var errTooLarge = errors.New("bodystore: body too large to be captured")
+
+// Capture stores the bodies of the requests and the responses it handles.
+type Capture struct {
+	Store Store
+	// MaxBodySize bounds the bodies stored, 64 MiB by default. The capture
+	// of the larger bodies is abandoned, while they are still sent.
+	MaxBodySize int64
+	// Key returns the key of the body of the request or the response of
+	// ctx, by default the host, the day and the session of the request,
+	// and .request or .response.
+	Key func(ctx *goproxy.ProxyCtx, response bool) string
+	// OnError, when set, is called with the errors of the store.
+	OnError func(ctx *goproxy.ProxyCtx, key string, err error)
+	// Clock defaults to goproxy.SystemClock.
+	Clock goproxy.Clock
+}
+
+type keysKey struct{}
+
+type keys struct {
+	request, response string
+}
+
+// Keys returns the keys under which the bodies of the request of ctx, and
+// of its response, are being stored, "" for those not captured.
+func Keys(ctx *goproxy.ProxyCtx) (request, response string) {
+	k, _ := ctx.Value(keysKey{}).(*keys)
+	if k == nil {
+		return "", ""
+	}
+	return k.request, k.response
+}
+
+func (c *Capture) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (c *Capture) key(ctx *goproxy.ProxyCtx, response bool) string {
+	if c.Key != nil {
+		return c.Key(ctx, response)
+	}
+	host := strings.NewReplacer(":", "_", "/", "_").Replace(ctx.Req.URL.Host)
+	if host == "" || host == "." || host == ".." {
+		host = "_"
+	}
+	suffix := ".request"
+	if response {
+		suffix = ".response"
+	}
+	return fmt.Sprintf("%s/%s/%d%s", host, c.now().UTC().Format("2006-01-02"), ctx.Session, suffix)
+}
+
+func (c *Capture) maxBodySize() int64 {
+	if c.MaxBodySize > 0 {
+		return c.MaxBodySize
+	}
+	return 64 << 20
+}
+
+// capture tees *body into the store under key, as it is read.
+func (c *Capture) capture(body *io.ReadCloser, key string, ctx *goproxy.ProxyCtx) bool {
+	if *body == nil || *body == http.NoBody {
+		return false
+	}
+	if err := validKey(key); err != nil {
+		c.fail(ctx, key, err)
+		return false
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := c.Store.Put(context.Background(), key, pr)
+		// Unblock the body when the store fails.
+		pr.CloseWithError(err)
+		if err != nil && !errors.Is(err, errTooLarge) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			c.fail(ctx, key, err)
+		}
+	}()
+	*body = &teeBody{ReadCloser: *body, w: pw, done: done, limit: c.maxBodySize()}
+	return true
+}
+
+func (c *Capture) fail(ctx *goproxy.ProxyCtx, key string, err error) {
+	ctx.Warnf("bodystore: can't store %s: %v", key, err)
+	if c.OnError != nil {
+		c.OnError(ctx, key, err)
+	}
+}
+
+// teeBody writes the body read into w, closed at its end, or with an
+// error when it is closed before.
+type teeBody struct {
+	io.ReadCloser
+	w      *io.PipeWriter
+	done   chan struct{}
+	limit  int64
+	n      int64
+	closed bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.closed {
+		if b.n += int64(n); b.n > b.limit {
+			b.finish(errTooLarge)
+		} else if _, werr := b.w.Write(p[:n]); werr != nil {
+			b.closed = true
+		}
+	}
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *teeBody) finish(err error) {
+	if b.closed {
+		return
+	}
+	b.closed = true
+	b.w.CloseWithError(err)
+	if err == nil {
+		// The body is stored once read.
+		<-b.done
+	}
+}
+
+func (b *teeBody) Close() error {
+	b.finish(io.ErrUnexpectedEOF)
+	return b.ReadCloser.Close()
+}
+
+func (c *Capture) keys(ctx *goproxy.ProxyCtx) *keys {
+	k, _ := ctx.Value(keysKey{}).(*keys)
+	if k == nil {
+		k = &keys{}
+		ctx.SetValue(keysKey{}, k)
+	}
+	return k
+}
+
+// HandleRequest is a goproxy.FuncReqHandler, capturing the request body.
+func (c *Capture) HandleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if key := c.key(ctx, false); c.capture(&req.Body, key, ctx) {
+		c.keys(ctx).request = key
+	}
+	return req, nil
+}
+
+// HandleResponse is a goproxy.FuncRespHandler, capturing the response body.
+func (c *Capture) HandleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	if key := c.key(ctx, true); c.capture(&resp.Body, key, ctx) {
+		c.keys(ctx).response = key
+	}
+	return resp
+}
+
+// Install captures the bodies of proxy.
+func (c *Capture) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(c.HandleRequest)
+	proxy.OnResponse().DoFunc(c.HandleResponse)
+}
+
+// Retention prunes the bodies of a store.
+type Retention struct {
+	// Prefix restricts the bodies pruned to the keys starting with it.
+	Prefix string
+	// MaxAge is the age beyond which the bodies are deleted.
+	MaxAge time.Duration
+	// MaxCount and MaxBytes bound the number and the total size of the
+	// bodies kept, the oldest being deleted first.
+	MaxCount int
+	MaxBytes int64
+	// Interval is the delay between the prunings of Run, 1 hour by
+	// default.
+	Interval time.Duration
+	// OnError, when set, is called with the errors of the prunings of Run.
+	OnError func(error)
+	// Clock defaults to goproxy.SystemClock.
+	Clock goproxy.Clock
+}
+
+// Prune deletes the bodies of s beyond the retention, returning the number
+// deleted.
+func (r *Retention) Prune(ctx context.Context, s Store) (int, error) {
+	infos, err := s.List(ctx, r.Prefix)
+	if err != nil {
+		return 0, err
+	}
+	// Newest first.
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].Created.After(infos[j].Created) })
+	now := time.Now()
+	if r.Clock != nil {
+		now = r.Clock.Now()
+	}
+	var (
+		kept, deleted int
+		total         int64
+		full          bool
+		errs          []error
+	)
+	for _, info := range infos {
+		expired := r.MaxAge > 0 && now.Sub(info.Created) > r.MaxAge
+		full = full || (r.MaxCount > 0 && kept >= r.MaxCount) || (r.MaxBytes > 0 && total+info.Size > r.MaxBytes)
+		if !expired && !full {
+			kept++
+			total += info.Size
+			continue
+		}
+		if err := s.Delete(ctx, info.Key); err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// Run prunes s every Interval, until ctx is done.
+func (r *Retention) Run(ctx context.Context, s Store) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for {
+		if _, err := r.Prune(ctx, s); err != nil && ctx.Err() == nil && r.OnError != nil {
+			r.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package bodystore_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/bodystore"
+	"github.com/InsideOutSec/goproxy/ext/signing"
+)
+
+// fakeS3 serves the objects of a bucket, checking that the requests are
+// signed.
+func fakeS3(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	modified := make(map[string]time.Time)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key, ok := strings.CutPrefix(r.URL.Path, "/bucket/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && key == "":
+			var result struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []struct {
+					Key          string
+					Size         int
+					LastModified time.Time
+				}
+			}
+			var keys []string
+			for k := range objects {
+				if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				result.Contents = append(result.Contents, struct {
+					Key          string
+					Size         int
+					LastModified time.Time
+				}{k, len(objects[k]), modified[k]})
+			}
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == http.MethodPut:
+			objects[key], _ = io.ReadAll(r.Body)
+			modified[key] = time.Now()
+		case r.Method == http.MethodGet:
+			body, ok := objects[key]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(body)
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func stores(t *testing.T) map[string]bodystore.Store {
+	db, err := bodystore.OpenBolt(filepath.Join(t.TempDir(), "bodies.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]bodystore.Store{
+		"dir":  &bodystore.Dir{Path: t.TempDir()},
+		"bolt": db,
+		"s3": &bodystore.S3{
+			Endpoint:    fakeS3(t).URL,
+			Bucket:      "bucket",
+			Prefix:      "captures/",
+			Credentials: signing.StaticCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		},
+	}
+}
+
+func keys(infos []bodystore.Info) string {
+	var ks []string
+	for _, info := range infos {
+		ks = append(ks, info.Key)
+	}
+	return strings.Join(ks, ", ")
+}
+
+func TestStores(t *testing.T) {
+	ctx := context.Background()
+	for name, s := range stores(t) {
+		for key, body := range map[string]string{
+			"example.com/2026-10-14/1.request":  "a=1",
+			"example.com/2026-10-14/1.response": "hello",
+			"example.com/2026-10-15/2.response": "",
+			"example.org/2026-10-14/3.response": "other",
+		} {
+			if err := s.Put(ctx, key, strings.NewReader(body)); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if err := s.Put(ctx, "../escape", strings.NewReader("x")); err == nil {
+			t.Errorf("%s: Expected the invalid key to fail", name)
+		}
+		if err := s.Put(ctx, "failed", io.MultiReader(strings.NewReader("x"), iotestErr{})); err == nil {
+			t.Errorf("%s: Expected the failed body to fail", name)
+		}
+
+		r, err := s.Get(ctx, "example.com/2026-10-14/1.response")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if body, _ := io.ReadAll(r); string(body) != "hello" {
+			t.Errorf("%s: Expected the stored body, got %q", name, body)
+		}
+		r.Close()
+		if _, err := s.Get(ctx, "example.com/missing"); !errors.Is(err, bodystore.ErrNotFound) {
+			t.Errorf("%s: Expected ErrNotFound, got %v", name, err)
+		}
+
+		infos, err := s.List(ctx, "example.com/2026-10-14/")
+		if expected := "example.com/2026-10-14/1.request, example.com/2026-10-14/1.response"; err != nil || keys(infos) != expected {
+			t.Errorf("%s: Expected the keys %q, got %q: %v", name, expected, keys(infos), err)
+		}
+		if infos[1].Size != 5 || time.Since(infos[1].Created) > time.Minute {
+			t.Errorf("%s: Expected the info of the body, got %+v", name, infos[1])
+		}
+		if err := s.Delete(ctx, "example.com/2026-10-14/1.request"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		infos, err = s.List(ctx, "")
+		if expected := "example.com/2026-10-14/1.response, example.com/2026-10-15/2.response, example.org/2026-10-14/3.response"; err != nil || keys(infos) != expected {
+			t.Errorf("%s: Expected the keys %q, got %q: %v", name, expected, keys(infos), err)
+		}
+	}
+}
+
+type iotestErr struct{}
+
+func (iotestErr) Read([]byte) (int, error) { return 0, errors.New("broken") }
+
+func TestCapture(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "got "+string(body))
+	}))
+	defer upstream.Close()
+
+	store := &bodystore.Dir{Path: t.TempDir()}
+	capture := &bodystore.Capture{Store: store, MaxBodySize: 16}
+	proxy := goproxy.NewProxyHttpServer()
+	capture.Install(proxy)
+	var captured []string
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		req, resp2 := bodystore.Keys(ctx)
+		captured = append(captured, req, resp2)
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, body := range []string{"small", "a body much too large to be captured"} {
+		resp, err := client.Post(upstream.URL, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(got) != "got "+body {
+			t.Errorf("Expected the body to be sent, got %q", got)
+		}
+	}
+
+	infos, err := store.List(context.Background(), "")
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("Expected the bodies of the small exchange, got %q: %v", keys(infos), err)
+	}
+	if captured[0] != infos[0].Key || !strings.HasSuffix(captured[0], ".request") {
+		t.Errorf("Expected the key of the request, got %q", captured)
+	}
+	r, err := store.Get(context.Background(), infos[1].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(r); string(body) != "got small" {
+		t.Errorf("Expected the response body, got %q", body)
+	}
+	r.Close()
+}
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+	store := &bodystore.Dir{Path: t.TempDir()}
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		if err := store.Put(ctx, key, strings.NewReader("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	retention := &bodystore.Retention{Prefix: "a/", MaxBytes: 25}
+	if n, err := retention.Prune(ctx, store); err != nil || n != 1 {
+		t.Errorf("Expected the oldest body to be deleted, got %d: %v", n, err)
+	}
+	infos, _ := store.List(ctx, "")
+	if expected := "a/2, a/3, b/1"; keys(infos) != expected {
+		t.Errorf("Expected the keys %q, got %q", expected, keys(infos))
+	}
+
+	retention = &bodystore.Retention{MaxCount: 2}
+	retention.Prune(ctx, store)
+	infos, _ = store.List(ctx, "")
+	if expected := "a/3, b/1"; keys(infos) != expected {
+		t.Errorf("Expected the keys %q, got %q", expected, keys(infos))
+	}
+
+	retention = &bodystore.Retention{MaxAge: time.Hour, Clock: goproxy.NewFakeClock(time.Now().Add(2 * time.Hour))}
+	if n, err := retention.Prune(ctx, store); err != nil || n != 2 {
+		t.Errorf("Expected the expired bodies to be deleted, got %d: %v", n, err)
+	}
+}
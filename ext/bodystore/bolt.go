@@ -0,0 +1,123 @@
+package bodystore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// defaultBucket is the bucket of the bodies of Bolt by default.
+var defaultBucket = []byte("bodies")
+
+// Bolt stores the bodies in a bucket of a bbolt database, for the
+// captures of many small bodies. The bodies are held in memory to be
+// stored.
+type Bolt struct {
+	DB *bolt.DB
+	// Bucket is the bucket of the bodies, "bodies" by default.
+	Bucket []byte
+}
+
+// OpenBolt opens the bbolt database at path, created if needed.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Bolt{DB: db}, nil
+}
+
+// Close closes the database.
+func (b *Bolt) Close() error {
+	return b.DB.Close()
+}
+
+func (b *Bolt) bucket() []byte {
+	if len(b.Bucket) > 0 {
+		return b.Bucket
+	}
+	return defaultBucket
+}
+
+// The values are the creation time, in Unix nanoseconds, and the body.
+const createdSize = 8
+
+// Put implements Store.
+func (b *Bolt) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	value := bytes.NewBuffer(make([]byte, createdSize))
+	if _, err := value.ReadFrom(r); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(value.Bytes(), uint64(time.Now().UnixNano()))
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(b.bucket())
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value.Bytes())
+	})
+}
+
+// Get implements Store.
+func (b *Bolt) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var body []byte
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket())
+		if bucket == nil {
+			return ErrNotFound
+		}
+		value := bucket.Get([]byte(key))
+		if len(value) < createdSize {
+			return ErrNotFound
+		}
+		// The values are only valid during the transaction.
+		body = append([]byte(nil), value[createdSize:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+// Delete implements Store.
+func (b *Bolt) Delete(ctx context.Context, key string) error {
+	return b.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket())
+		if bucket == nil || bucket.Get([]byte(key)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// List implements Store.
+func (b *Bolt) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+	err := b.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket())
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if len(v) < createdSize {
+				continue
+			}
+			infos = append(infos, Info{
+				Key:     string(k),
+				Size:    int64(len(v) - createdSize),
+				Created: time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+			})
+		}
+		return nil
+	})
+	return infos, err
+}
@@ -0,0 +1,199 @@
+package bodystore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy/ext/signing"
+)
+
+// S3 stores the bodies as the objects of a bucket of an S3-compatible
+// service, such as AWS S3, MinIO or Ceph, their keys prefixed by Prefix.
+// The requests are signed with AWS Signature Version 4, and address the
+// bucket in the path of the Endpoint.
+type S3 struct {
+	// Endpoint is the URL of the service, such as
+	// https://s3.eu-west-1.amazonaws.com or http://minio:9000.
+	Endpoint string
+	Bucket   string
+	Prefix   string
+	// Region defaults to us-east-1.
+	Region      string
+	Credentials signing.CredentialsProvider
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (s *S3) url(key string, query url.Values) string {
+	u := strings.TrimSuffix(s.Endpoint, "/") + "/" + url.PathEscape(s.Bucket) + "/"
+	if key != "" {
+		segments := strings.Split(s.Prefix+key, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		u += strings.Join(segments, "/")
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends the request, signed with the hex SHA-256 of its body, and
+// returns its response, or the error of its status but those of ok.
+func (s *S3) do(req *http.Request, payloadHash string, ok ...int) (*http.Response, error) {
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	signer := &signing.SigV4{Credentials: s.Credentials, Region: region, Service: "s3"}
+	if err := signer.Sign(req, payloadHash, time.Now()); err != nil {
+		return nil, err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	var s3Err struct {
+		Code    string
+		Message string
+	}
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3Err)
+	return nil, fmt.Errorf("bodystore: S3 %s %s: %s %s %s", req.Method, req.URL.Path, resp.Status, s3Err.Code, s3Err.Message)
+}
+
+// emptyHash is the SHA-256 of the empty payloads.
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Put implements Store, the body being spooled to a temporary file to be
+// sent with its length and its hash.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "bodystore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url(key, nil), io.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	if n == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := s.do(req, hex.EncodeToString(h.Sum(nil)), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get implements Store.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := validKey(key); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(key, nil), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptyHash, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete implements Store. The S3 services don't tell the missing keys
+// from the others, which are deleted without error.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := validKey(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.url(key, nil), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyHash, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List implements Store, with ListObjectsV2, following the pages.
+func (s *S3) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url("", query), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, emptyHash, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bodystore: invalid S3 listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			infos = append(infos, Info{Key: strings.TrimPrefix(c.Key, s.Prefix), Size: c.Size, Created: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
@@ -0,0 +1,249 @@
+// Package botscore scores the likelihood that the requests are sent by bots
+// or scrapers, from the rate and regularity of the requests of their
+// client, the anomalies of their headers, and the mismatch of the TLS
+// fingerprint of the client with its User-Agent. The score is tagged on the
+// ProxyCtx, for the next rules to rate-limit, challenge or log the bots:
+//
+//	s := botscore.New()
+//	proxy.OnRequest().Do(s)
+//	proxy.OnRequest(botscore.Above(70)).DoFunc(challenge)
+package botscore
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Score is the bot score of a request, from 0 for a human to 100 for a bot.
+type Score struct {
+	Value int
+	// Reasons are the heuristics which matched, such as "no user-agent".
+	Reasons []string
+}
+
+func (s *Score) add(points int, reason string) {
+	s.Value += points
+	s.Reasons = append(s.Reasons, reason)
+}
+
+type scoreKey struct{}
+
+// Of returns the score of the request of ctx, or nil when it wasn't
+// scored.
+func Of(ctx *goproxy.ProxyCtx) *Score {
+	s, _ := ctx.Value(scoreKey{}).(*Score)
+	return s
+}
+
+// Above returns a ReqCondition testing whether the score of the request is
+// at least threshold.
+func Above(threshold int) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		s := Of(ctx)
+		return s != nil && s.Value >= threshold
+	}
+}
+
+// Scorer scores the requests.
+type Scorer struct {
+	// Window is the period over which the rate of the requests of a client
+	// is measured, 10 seconds by default.
+	Window time.Duration
+	// MaxRate is the number of requests of a client in Window above which
+	// it is scored as a bot, 20 by default.
+	MaxRate int
+	// ClientKey identifies the client of a request, its IP address by
+	// default.
+	ClientKey func(req *http.Request, ctx *goproxy.ProxyCtx) string
+	// Fingerprints are the known TLS fingerprints of the clients, to score
+	// the tools claiming to be browsers.
+	Fingerprints goproxy.ClientFingerprints
+	// Header, when set, tags the requests sent upstream with the score, for
+	// the logs of the servers.
+	Header string
+	// Clock tells the time of the requests, goproxy.SystemClock by default.
+	Clock goproxy.Clock
+
+	mu        sync.Mutex
+	clients   map[string]*history
+	lastPrune time.Time
+}
+
+// history is the times of the last requests of a client.
+type history struct {
+	times []time.Time
+}
+
+// maxHistory bounds the times kept per client.
+const maxHistory = 64
+
+// New returns a Scorer with the default settings.
+func New() *Scorer {
+	return &Scorer{}
+}
+
+func (s *Scorer) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (s *Scorer) window() time.Duration {
+	if s.Window > 0 {
+		return s.Window
+	}
+	return 10 * time.Second
+}
+
+func (s *Scorer) clientKey(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	if s.ClientKey != nil {
+		return s.ClientKey(req, ctx)
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// record records a request of client at now, and returns the times of its
+// requests in the window.
+func (s *Scorer) record(client string, now time.Time) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients == nil {
+		s.clients = make(map[string]*history)
+	}
+	window := s.window()
+	if now.Sub(s.lastPrune) > window {
+		for key, h := range s.clients {
+			if now.Sub(h.times[len(h.times)-1]) > window {
+				delete(s.clients, key)
+			}
+		}
+		s.lastPrune = now
+	}
+	h := s.clients[client]
+	if h == nil {
+		h = &history{}
+		s.clients[client] = h
+	}
+	h.times = append(h.times, now)
+	i := 0
+	for i < len(h.times) && now.Sub(h.times[i]) > window {
+		i++
+	}
+	if len(h.times)-i > maxHistory {
+		i = len(h.times) - maxHistory
+	}
+	h.times = append(h.times[:0], h.times[i:]...)
+	return append([]time.Time(nil), h.times...)
+}
+
+// regular returns whether the intervals between times are regular, as those
+// of the scripts, their standard deviation under 10% of their mean.
+func regular(times []time.Time) bool {
+	if len(times) < 8 {
+		return false
+	}
+	var sum, sumSquares float64
+	n := float64(len(times) - 1)
+	for i := 1; i < len(times); i++ {
+		d := float64(times[i].Sub(times[i-1]))
+		sum += d
+		sumSquares += d * d
+	}
+	mean := sum / n
+	if mean <= 0 {
+		return false
+	}
+	deviation := math.Sqrt(math.Max(sumSquares/n-mean*mean, 0))
+	return deviation < mean/10
+}
+
+// Score returns the score of req.
+func (s *Scorer) Score(req *http.Request, ctx *goproxy.ProxyCtx) *Score {
+	score := &Score{}
+	ua := goproxy.ParseUserAgent(req.UserAgent())
+	switch {
+	case req.UserAgent() == "":
+		score.add(40, "no user-agent")
+	case ua.Class == goproxy.UABot:
+		score.add(60, "bot user-agent")
+	case ua.Class == goproxy.UATool:
+		score.add(50, "tool user-agent")
+	case ua.Class == goproxy.UAUnknown:
+		score.add(20, "unknown user-agent")
+	}
+
+	if ua.Class == goproxy.UABrowser {
+		if req.Header.Get("Accept-Language") == "" {
+			score.add(15, "no accept-language")
+		}
+		if req.Header.Get("Accept-Encoding") == "" {
+			score.add(10, "no accept-encoding")
+		}
+		if req.Header.Get("Accept") == "" {
+			score.add(10, "no accept")
+		}
+		// The browsers send the fetch metadata to the secure origins.
+		if req.URL.Scheme == "https" && req.Header.Get("Sec-Fetch-Mode") == "" && ua.Name != "Safari" {
+			score.add(15, "no fetch metadata")
+		}
+		if fp := ctx.ClientFingerprint(); fp != nil {
+			if class, ok := s.Fingerprints[fp.JA4]; ok && class != goproxy.UABrowser {
+				score.add(40, "TLS fingerprint of a "+class.String())
+			}
+			// All the browsers offer HTTP/2.
+			if !contains(fp.ALPN, "h2") {
+				score.add(20, "no HTTP/2 offered")
+			}
+		}
+	}
+
+	times := s.record(s.clientKey(req, ctx), s.now())
+	maxRate := s.MaxRate
+	if maxRate <= 0 {
+		maxRate = 20
+	}
+	if len(times) > maxRate {
+		score.add(30, "request rate")
+	}
+	if regular(times) {
+		score.add(20, "regular request intervals")
+	}
+	if score.Value > 100 {
+		score.Value = 100
+	}
+	return score
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle implements goproxy.ReqHandler, tagging the request with its
+// score.
+func (s *Scorer) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	score := s.Score(req, ctx)
+	ctx.SetValue(scoreKey{}, score)
+	if score.Value >= 50 {
+		ctx.Logf("botscore: %d (%s)", score.Value, strings.Join(score.Reasons, ", "))
+	}
+	if s.Header != "" {
+		req.Header.Set(s.Header, strconv.Itoa(score.Value))
+	}
+	return req, nil
+}
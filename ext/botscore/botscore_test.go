@@ -0,0 +1,77 @@
+package botscore_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/botscore"
+)
+
+const chrome = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+
+func browserRequest(remoteAddr string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("User-Agent", chrome)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Language", "en")
+	req.Header.Set("Accept-Encoding", "gzip")
+	return req
+}
+
+func TestScorer(t *testing.T) {
+	clock := goproxy.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := &botscore.Scorer{Clock: clock, Header: "X-Bot-Score"}
+
+	ctx := newCtx()
+	req, _ := s.Handle(browserRequest("10.0.0.1:1234"), ctx)
+	if score := botscore.Of(ctx); score == nil || score.Value != 0 {
+		t.Errorf("Expected the browser to score 0, got %+v", score)
+	}
+	if req.Header.Get("X-Bot-Score") != "0" {
+		t.Errorf("Expected the score header, got %q", req.Header.Get("X-Bot-Score"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("User-Agent", "curl/8.4.0")
+	ctx = newCtx()
+	s.Handle(req, ctx)
+	if score := botscore.Of(ctx); score.Value != 50 || !botscore.Above(50)(req, ctx) || botscore.Above(51)(req, ctx) {
+		t.Errorf("Expected curl to score 50, got %+v", score)
+	}
+
+	// A browser User-Agent without the headers of the browsers.
+	req = httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.RemoteAddr = "10.0.0.3:1234"
+	req.Header.Set("User-Agent", chrome)
+	ctx = newCtx()
+	s.Handle(req, ctx)
+	if score := botscore.Of(ctx); score.Value != 35 {
+		t.Errorf("Expected the header anomalies to score 35, got %+v", score)
+	}
+
+	// A script polling every second, faster than MaxRate.
+	s.MaxRate = 5
+	var score *botscore.Score
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+		ctx = newCtx()
+		s.Handle(browserRequest("10.0.0.4:1234"), ctx)
+		score = botscore.Of(ctx)
+	}
+	if score.Value != 50 {
+		t.Errorf("Expected the rate and regularity to score 50, got %+v", score)
+	}
+
+	if botscore.Above(0)(req, newCtx()) {
+		t.Error("Expected the requests not scored not to match")
+	}
+}
+
+func newCtx() *goproxy.ProxyCtx {
+	return &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+}
@@ -0,0 +1,512 @@
+// Package cache is a shared HTTP cache for the proxy, following the
+// freshness and validation rules of RFC 9111:
+//
+//	c := cache.New(256 << 20)
+//	c.Install(proxy)
+//
+// The fresh responses are served without contacting the upstream, with an
+// X-Cache: HIT header, and the stale ones having a validator are
+// revalidated with a conditional request. The range requests are answered
+// from the whole responses stored, and sent upstream otherwise. The responses to a private
+// request, with an Authorization or a Cookie, aren't stored unless they
+// are explicitly public, nor those with a Set-Cookie.
+//
+// NewLowBandwidth returns a cache tuned for the satellite and other
+// constrained links, and Delta exchanges the changed responses as deltas
+// with a paired upstream goproxy.
+//
+// A Prefetcher fetches URLs into the cache in the background, to warm it up
+// or to prefetch the resources announced by the pages.
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Entry is a stored response.
+type Entry struct {
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Vary holds the values of the request headers named by the Vary header
+	// of the response.
+	Vary map[string]string
+	// Stored is when the response was received or last revalidated.
+	Stored time.Time
+	// Lifetime is the freshness lifetime of the response, zero for the
+	// responses to revalidate before every use.
+	Lifetime time.Duration
+	// InitialAge is the Age of the response when it was received.
+	InitialAge time.Duration
+}
+
+// Age returns the age of the entry at now.
+func (e *Entry) Age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.Stored)
+}
+
+// Fresh returns whether the entry can be used without revalidation at now.
+func (e *Entry) Fresh(now time.Time) bool {
+	return e.Age(now) < e.Lifetime
+}
+
+func (e *Entry) size() int64 {
+	n := int64(len(e.Body) + len(e.URL))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+func (e *Entry) validators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+func (e *Entry) matches(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Response returns the response of the entry to req.
+func (e *Entry) Response(req *http.Request) *http.Response {
+	return e.response(req, time.Now())
+}
+
+func (e *Entry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.Age(now).Seconds())))
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// Storage stores the entries by URL.
+type Storage interface {
+	Get(key string) *Entry
+	Set(key string, e *Entry)
+	Delete(key string)
+}
+
+// Cache stores the responses of the proxy.
+type Cache struct {
+	Storage Storage
+	// MaxBodySize bounds the stored responses, 10 MiB by default.
+	MaxBodySize int64
+	// HeuristicFraction, when not zero, makes the responses without
+	// explicit freshness but with a Last-Modified date fresh for this
+	// fraction of their age, 0.1 being the usual value.
+	HeuristicFraction float64
+	// MaxHeuristic bounds the heuristic freshness, 24 hours by default.
+	MaxHeuristic time.Duration
+	// DefaultLifetime is the freshness lifetime of the responses with
+	// neither explicit freshness nor Last-Modified, zero by default.
+	DefaultLifetime time.Duration
+	// InjectIMS makes the stale entries without validators revalidated
+	// with an If-Modified-Since of their Date, rather than fetched again.
+	InjectIMS bool
+	// Delta, when set, asks the upstream proxy for the responses as deltas
+	// against the stored entries, see ServeDelta. The upstream proxy must
+	// be a goproxy with ServeDelta, seeing the requests in clear: the peers
+	// must MITM the HTTPS requests.
+	Delta bool
+	// CoalesceRanges makes the range requests missing the cache fetch the
+	// whole object, once for the parallel requests to the same URL, so that
+	// it is stored and their ranges are served from it.
+	CoalesceRanges bool
+	// Clock tells the time of the entries, goproxy.SystemClock by default.
+	Clock goproxy.Clock
+	// Now returns the current time, replacing Clock.
+	//
+	// Deprecated: use Clock.
+	Now func() time.Time
+
+	flights flights
+}
+
+// New returns a Cache storing up to maxBytes in memory.
+func New(maxBytes int64) *Cache {
+	return &Cache{Storage: NewMemoryStorage(maxBytes)}
+}
+
+// NewLowBandwidth returns a Cache storing up to maxBytes in memory, tuned
+// for the bandwidth of the links rather than the freshness: the responses
+// are fresh for half of their age since their Last-Modified, up to a week,
+// or for 10 minutes without Last-Modified, and the stale ones are
+// revalidated with If-Modified-Since.
+func NewLowBandwidth(maxBytes int64) *Cache {
+	c := New(maxBytes)
+	c.HeuristicFraction = 0.5
+	c.MaxHeuristic = 7 * 24 * time.Hour
+	c.DefaultLifetime = 10 * time.Minute
+	c.InjectIMS = true
+	return c
+}
+
+func (c *Cache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	if c.Clock != nil {
+		return c.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Key returns the storage key of a request.
+func Key(req *http.Request) string {
+	return req.URL.String()
+}
+
+// Lookup returns the entry of a request, nil if there is none.
+func (c *Cache) Lookup(req *http.Request) *Entry {
+	e := c.Storage.Get(Key(req))
+	if e == nil || !e.matches(req) {
+		return nil
+	}
+	return e
+}
+
+// Purge deletes the entry of a URL.
+func (c *Cache) Purge(url string) {
+	c.Storage.Delete(url)
+}
+
+// directives parses a Cache-Control header.
+func directives(h http.Header) map[string]string {
+	d := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				d[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return d
+}
+
+func seconds(s string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// storable returns whether the response to req may be stored, and its
+// freshness lifetime.
+func (c *Cache) storable(req *http.Request, resp *http.Response) (time.Duration, bool) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusNotFound,
+		http.StatusMethodNotAllowed, http.StatusGone, http.StatusRequestURITooLong,
+		http.StatusNotImplemented, http.StatusPermanentRedirect:
+	default:
+		return 0, false
+	}
+	if resp.Header.Get("Vary") == "*" || resp.Header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	cc := directives(resp.Header)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	_, public := cc["public"]
+	if !public && (req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "") {
+		if _, ok := cc["s-maxage"]; !ok {
+			return 0, false
+		}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0, true
+	}
+	if d, ok := seconds(cc["s-maxage"]); ok {
+		return d, true
+	}
+	if d, ok := seconds(cc["max-age"]); ok {
+		return d, true
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		date = c.now()
+	}
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(date) {
+			return 0, true
+		}
+		return t.Sub(date), true
+	}
+	if c.HeuristicFraction > 0 {
+		if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && lm.Before(date) {
+			limit := c.MaxHeuristic
+			if limit <= 0 {
+				limit = 24 * time.Hour
+			}
+			d := time.Duration(float64(date.Sub(lm)) * c.HeuristicFraction)
+			if d > limit {
+				d = limit
+			}
+			return d, true
+		}
+	}
+	return c.DefaultLifetime, true
+}
+
+// entry returns the entry of the response to req, nil if it can't be
+// stored.
+func (c *Cache) entry(req *http.Request, resp *http.Response) *Entry {
+	lifetime, ok := c.storable(req, resp)
+	if !ok {
+		return nil
+	}
+	e := &Entry{
+		URL:        Key(req),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Stored:     c.now(),
+		Lifetime:   lifetime,
+	}
+	if lifetime == 0 && !e.validators() {
+		return nil
+	}
+	if age, ok := seconds(resp.Header.Get("Age")); ok {
+		e.InitialAge = age
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				if e.Vary == nil {
+					e.Vary = make(map[string]string)
+				}
+				e.Vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+	// The hop-by-hop headers aren't stored.
+	for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Age"} {
+		e.Header.Del(h)
+	}
+	return e
+}
+
+func (c *Cache) maxBodySize() int64 {
+	if c.MaxBodySize > 0 {
+		return c.MaxBodySize
+	}
+	return 10 << 20
+}
+
+// storingBody stores the entry of a response once its body is read
+// entirely.
+type storingBody struct {
+	io.ReadCloser
+	cache *Cache
+	entry *Entry
+	buf   bytes.Buffer
+	full  bool
+}
+
+func (b *storingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.full {
+		if int64(b.buf.Len()+n) > b.cache.maxBodySize() {
+			b.full = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.full && b.entry != nil {
+		b.entry.Body = b.buf.Bytes()
+		b.cache.Storage.Set(b.entry.URL, b.entry)
+		b.entry = nil
+	}
+	return n, err
+}
+
+// cacheable returns whether a request may be answered from the cache.
+func cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	_, noStore := directives(req.Header)["no-store"]
+	return !noStore
+}
+
+// conditional returns whether the request has its own validators.
+func conditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// notModified returns whether the validators of req match e.
+func notModified(req *http.Request, e *Entry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := e.Header.Get("ETag")
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || (etag != "" && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/")) {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+		return err == nil && !lm.After(ims)
+	}
+	return false
+}
+
+// serve answers req from e.
+func (c *Cache) serve(req *http.Request, e *Entry, status string) *http.Response {
+	resp := e.response(req, c.now())
+	if notModified(req, e) {
+		resp.StatusCode, resp.Status = http.StatusNotModified, "304 Not Modified"
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		resp.Header.Del("Content-Length")
+	}
+	serveRange(req, e, resp)
+	resp.Header.Set("X-Cache", status)
+	return resp
+}
+
+// OnRequest answers the requests from the cache, or sends them upstream
+// through the cache. It must be the last handler changing
+// ctx.RoundTripper.
+func (c *Cache) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		c.invalidate(req, ctx)
+		return req, nil
+	}
+	if !cacheable(req) {
+		return req, nil
+	}
+	e := c.Lookup(req)
+	_, noCache := directives(req.Header)["no-cache"]
+	if e != nil && !noCache && e.Fresh(c.now()) {
+		ctx.Logf("cache: hit %v", req.URL)
+		return req, c.serve(req, e, "HIT")
+	}
+
+	next := ctx.NextRoundTripper()
+	if req.Header.Get("Range") != "" {
+		// The partial responses aren't stored.
+		if c.CoalesceRanges && !noCache {
+			ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+				return c.coalesce(req, ctx, next)
+			})
+		}
+		return req, nil
+	}
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		orig := req
+		revalidating := e != nil && (e.validators() || c.InjectIMS) && !conditional(req)
+		if revalidating || c.Delta {
+			req = req.Clone(req.Context())
+		}
+		if revalidating {
+			if etag := e.Header.Get("ETag"); etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lm := e.Header.Get("Last-Modified"); lm != "" {
+				req.Header.Set("If-Modified-Since", lm)
+			} else if c.InjectIMS && e.Header.Get("ETag") == "" {
+				since := e.Header.Get("Date")
+				if since == "" {
+					since = e.Stored.UTC().Format(http.TimeFormat)
+				}
+				req.Header.Set("If-Modified-Since", since)
+			}
+		}
+		var base *Entry
+		if c.Delta {
+			base = c.Storage.Get(Key(req))
+			requestDelta(req, base)
+		}
+		resp, err := next.RoundTrip(req, ctx)
+		if err != nil {
+			return resp, err
+		}
+		if err := decodeDelta(resp, base); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if revalidating && resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			ctx.Logf("cache: revalidated %v", req.URL)
+			return c.serve(orig, c.refresh(orig, e, resp), "REVALIDATED"), nil
+		}
+		if entry := c.entry(req, resp); entry != nil && resp.ContentLength <= c.maxBodySize() {
+			resp.Body = &storingBody{ReadCloser: resp.Body, cache: c, entry: entry}
+		}
+		resp.Header.Set("X-Cache", "MISS")
+		return resp, nil
+	})
+	return req, nil
+}
+
+// refresh updates e with the headers of the 304 response resp.
+func (c *Cache) refresh(req *http.Request, e *Entry, resp *http.Response) *Entry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for k, vs := range resp.Header {
+		switch k {
+		case "Content-Length", "Connection", "Keep-Alive", "Transfer-Encoding", "Age":
+			continue
+		}
+		updated.Header[k] = vs
+	}
+	merged := &http.Response{StatusCode: e.StatusCode, Header: updated.Header}
+	lifetime, ok := c.storable(req, merged)
+	if !ok {
+		c.Storage.Delete(e.URL)
+		return &updated
+	}
+	updated.Lifetime = lifetime
+	updated.Stored = c.now()
+	updated.InitialAge = 0
+	c.Storage.Set(updated.URL, &updated)
+	return &updated
+}
+
+// invalidate deletes the entry of the URL of the successful unsafe requests.
+func (c *Cache) invalidate(req *http.Request, ctx *goproxy.ProxyCtx) {
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := next.RoundTrip(req, ctx)
+		if err == nil && resp.StatusCode < 400 {
+			c.Purge(Key(req))
+		}
+		return resp, err
+	})
+}
+
+// Install caches the responses of proxy.
+func (c *Cache) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(c.OnRequest)
+}
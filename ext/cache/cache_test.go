@@ -0,0 +1,149 @@
+package cache_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/cache"
+)
+
+func newProxy(c *cache.Cache, proxies ...*goproxy.ProxyHttpServer) (*http.Client, func()) {
+	proxy := goproxy.NewProxyHttpServer()
+	if len(proxies) > 0 {
+		proxy = proxies[0]
+	}
+	c.Install(proxy)
+	s := httptest.NewServer(proxy)
+	u, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}, s.Close
+}
+
+func get(t *testing.T, client *http.Client, u string, header ...string) (string, string) {
+	req, _ := http.NewRequest("GET", u, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body), resp.Header.Get("X-Cache")
+}
+
+func TestCache(t *testing.T) {
+	var hits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&hits, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			fmt.Fprint(w, r.Header.Get("Accept-Language"))
+			return
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+	}))
+	defer upstream.Close()
+	c := cache.New(1 << 20)
+	client, closeProxy := newProxy(c)
+	defer closeProxy()
+
+	for _, tt := range []struct {
+		path, body, status string
+	}{
+		{"/fresh", "/fresh 1", "MISS"},
+		{"/fresh", "/fresh 1", "HIT"},
+		{"/etag", "/etag 2", "MISS"},
+		{"/etag", "/etag 2", "REVALIDATED"},
+		{"/nostore", "/nostore 4", "MISS"},
+		{"/nostore", "/nostore 5", "MISS"},
+	} {
+		body, status := get(t, client, upstream.URL+tt.path)
+		if body != tt.body || status != tt.status {
+			t.Errorf("%s: %q %s, want %q %s", tt.path, body, status, tt.body, tt.status)
+		}
+	}
+
+	if body, status := get(t, client, upstream.URL+"/fresh", "Cookie", "a=b"); status != "HIT" || body != "/fresh 1" {
+		t.Errorf("cookie request: %q %s", body, status)
+	}
+	if _, status := get(t, client, upstream.URL+"/fresh", "Cache-Control", "no-cache"); status != "MISS" {
+		t.Errorf("no-cache request: %s", status)
+	}
+
+	get(t, client, upstream.URL+"/vary", "Accept-Language", "fr")
+	if body, status := get(t, client, upstream.URL+"/vary", "Accept-Language", "fr"); status != "HIT" || body != "fr" {
+		t.Errorf("vary fr: %q %s", body, status)
+	}
+	if body, status := get(t, client, upstream.URL+"/vary", "Accept-Language", "de"); status != "MISS" || body != "de" {
+		t.Errorf("vary de: %q %s", body, status)
+	}
+
+	// The unsafe requests invalidate the entries.
+	resp, err := client.Post(upstream.URL+"/fresh", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, status := get(t, client, upstream.URL+"/fresh"); status != "MISS" {
+		t.Errorf("after POST: %s", status)
+	}
+}
+
+func TestHeuristicFreshness(t *testing.T) {
+	date := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", date.Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", date.Add(-10*time.Hour).Format(http.TimeFormat))
+	}))
+	defer upstream.Close()
+	c := cache.New(1 << 20)
+	c.HeuristicFraction = 0.1
+	clock := goproxy.NewFakeClock(date)
+	c.Clock = clock
+	client, closeProxy := newProxy(c)
+	defer closeProxy()
+
+	get(t, client, upstream.URL)
+	e := c.Lookup(httptest.NewRequest("GET", upstream.URL+"/", nil))
+	if e == nil || e.Lifetime != time.Hour {
+		t.Fatalf("entry %+v", e)
+	}
+	if _, status := get(t, client, upstream.URL); status != "HIT" {
+		t.Errorf("status %s", status)
+	}
+	clock.Advance(2 * time.Hour)
+	if _, status := get(t, client, upstream.URL); status != "REVALIDATED" && status != "MISS" {
+		t.Errorf("stale status %s", status)
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := cache.NewMemoryStorage(250)
+	for i := 0; i < 3; i++ {
+		s.Set(fmt.Sprint(i), &cache.Entry{URL: fmt.Sprint(i), Header: http.Header{}, Body: make([]byte, 100)})
+		s.Get("0")
+	}
+	if s.Get("0") == nil || s.Get("1") != nil || s.Get("2") == nil {
+		t.Errorf("least recently used entry not evicted")
+	}
+}
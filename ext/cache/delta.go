@@ -0,0 +1,237 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// The delta exchange between paired proxies. The downstream proxy sends the
+// hashes of the chunks of its stored response in the DeltaHeader of the
+// request, and the upstream proxy answers with the response body encoded as
+// a flate stream of references to those chunks and literal data, with the
+// DeltaEncoding content coding. The chunks are cut at content-defined
+// boundaries, so that an insertion only changes the chunks around it.
+const (
+	DeltaHeader   = "Goproxy-Delta"
+	DeltaEncoding = "goproxy-delta"
+)
+
+const (
+	minChunk = 2 << 10
+	maxChunk = 64 << 10
+	// chunkBits gives an average chunk size of 8 KiB.
+	chunkBits = 13
+	// maxDeltaChunks bounds the hashes sent in a request.
+	maxDeltaChunks = 256
+	// deltaVersion is the first token of DeltaHeader.
+	deltaVersion = "v1"
+)
+
+const (
+	opLiteral = iota
+	opRef
+)
+
+var errDelta = errors.New("cache: invalid delta response")
+
+// gear is the table of the rolling hash cutting the chunks, the same on
+// every peer.
+var gear = func() (t [256]uint64) {
+	x := uint64(0)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// chunks cuts data at content-defined boundaries.
+func chunks(data []byte) [][]byte {
+	var out [][]byte
+	for len(data) > 0 {
+		n := cut(data)
+		out = append(out, data[:n])
+		data = data[n:]
+	}
+	return out
+}
+
+func cut(data []byte) int {
+	if len(data) <= minChunk {
+		return len(data)
+	}
+	limit := len(data)
+	if limit > maxChunk {
+		limit = maxChunk
+	}
+	var h uint64
+	for i := minChunk; i < limit; i++ {
+		h = h<<1 + gear[data[i]]
+		if h>>(64-chunkBits) == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
+
+func chunkHash(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// requestDelta asks for the response to req as a delta against base, which
+// may be nil.
+func requestDelta(req *http.Request, base *Entry) {
+	hashes := []string{deltaVersion}
+	if base != nil {
+		for i, chunk := range chunks(base.Body) {
+			if i == maxDeltaChunks {
+				break
+			}
+			hashes = append(hashes, chunkHash(chunk))
+		}
+	}
+	req.Header.Set(DeltaHeader, strings.Join(hashes, " "))
+}
+
+// decodeDelta decodes the body of a delta response against base.
+func decodeDelta(resp *http.Response, base *Entry) error {
+	if resp.Header.Get("Content-Encoding") != DeltaEncoding {
+		return nil
+	}
+	var known [][]byte
+	if base != nil {
+		known = chunks(base.Body)
+	}
+	r := bufio.NewReader(flate.NewReader(resp.Body))
+	var body bytes.Buffer
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errDelta
+		}
+		switch {
+		case op == opRef && n < uint64(len(known)) && n < maxDeltaChunks:
+			body.Write(known[n])
+		case op == opLiteral && n <= maxChunk:
+			if _, err := io.CopyN(&body, r, int64(n)); err != nil {
+				return errDelta
+			}
+		default:
+			return errDelta
+		}
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(&body)
+	resp.ContentLength = int64(body.Len())
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	return nil
+}
+
+// encodeDelta encodes body against the chunks of hashes.
+func encodeDelta(body []byte, hashes []string) []byte {
+	index := make(map[string]uint64, len(hashes))
+	for i, h := range hashes {
+		if _, ok := index[h]; !ok {
+			index[h] = uint64(i)
+		}
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	var n [binary.MaxVarintLen64]byte
+	for _, chunk := range chunks(body) {
+		if i, ok := index[chunkHash(chunk)]; ok {
+			w.Write([]byte{opRef})
+			w.Write(n[:binary.PutUvarint(n[:], i)])
+			continue
+		}
+		w.Write([]byte{opLiteral})
+		w.Write(n[:binary.PutUvarint(n[:], uint64(len(chunk)))])
+		w.Write(chunk)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// ServeDelta makes proxy the upstream peer of the proxies whose Cache has
+// Delta set, sending them the responses as deltas. It must be the last
+// handler changing ctx.RoundTripper.
+func ServeDelta(proxy *goproxy.ProxyHttpServer, maxBodySize int64) {
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return OnDeltaRequest(req, ctx, maxBodySize)
+	})
+}
+
+// OnDeltaRequest encodes the responses to the requests with a DeltaHeader,
+// up to maxBodySize, as deltas against the chunks the downstream proxy
+// holds.
+func OnDeltaRequest(req *http.Request, ctx *goproxy.ProxyCtx, maxBodySize int64) (*http.Request, *http.Response) {
+	fields := strings.Fields(req.Header.Get(DeltaHeader))
+	if len(fields) == 0 {
+		return req, nil
+	}
+	req.Header.Del(DeltaHeader)
+	if fields[0] != deltaVersion {
+		return req, nil
+	}
+	hashes := fields[1:]
+	if len(hashes) > maxDeltaChunks {
+		hashes = hashes[:maxDeltaChunks]
+	}
+	// The identity bodies are deltas of each other, and are compressed on
+	// the link between the peers.
+	req.Header.Del("Accept-Encoding")
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := next.RoundTrip(req, ctx)
+		if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" ||
+			resp.ContentLength > maxBodySize {
+			return resp, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("cache: reading the response to delta: %w", err)
+		}
+		if int64(len(body)) > maxBodySize {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+			return resp, nil
+		}
+		resp.Body.Close()
+		encoded := encodeDelta(body, hashes)
+		ctx.Logf("cache: delta of %v, %d bytes for %d", req.URL, len(encoded), len(body))
+		resp.Body = io.NopCloser(bytes.NewReader(encoded))
+		resp.ContentLength = int64(len(encoded))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(encoded)))
+		resp.Header.Set("Content-Encoding", DeltaEncoding)
+		return resp, nil
+	})
+	return req, nil
+}
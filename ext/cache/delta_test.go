@@ -0,0 +1,100 @@
+package cache_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/cache"
+)
+
+func TestDelta(t *testing.T) {
+	page := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(page)
+	version := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version++
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, version))
+		// Each version inserts a line in the middle of the page.
+		w.Write(page[:100<<10])
+		fmt.Fprintf(w, "version %d\n", version)
+		w.Write(page[100<<10:])
+	}))
+	defer upstream.Close()
+
+	var sizes []int64
+	peer := goproxy.NewProxyHttpServer()
+	cache.ServeDelta(peer, 1<<20)
+	peer.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		sizes = append(sizes, resp.ContentLength)
+		return resp
+	})
+	peerServer := httptest.NewServer(peer)
+	defer peerServer.Close()
+
+	peerURL, _ := url.Parse(peerServer.URL)
+	downstream := goproxy.NewProxyHttpServer()
+	downstream.Tr = &http.Transport{Proxy: http.ProxyURL(peerURL)}
+	c := cache.New(1 << 20)
+	c.Delta = true
+	client, closeProxy := newProxy(c, downstream)
+	defer closeProxy()
+
+	for i := 1; i <= 2; i++ {
+		body, status := get(t, client, upstream.URL)
+		want := string(page[:100<<10]) + fmt.Sprintf("version %d\n", i) + string(page[100<<10:])
+		if body != want || status != "MISS" {
+			t.Fatalf("response %d: %d bytes, %s", i, len(body), status)
+		}
+	}
+	if len(sizes) != 2 || sizes[0] < 256<<10 || sizes[1] > 32<<10 {
+		t.Errorf("sizes of the deltas %v", sizes)
+	}
+}
+
+func TestInjectIMS(t *testing.T) {
+	date := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	var since []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since = append(since, r.Header.Get("If-Modified-Since"))
+		w.Header().Set("Date", date.Format(http.TimeFormat))
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.Copy(w, bytes.NewReader([]byte("static")))
+	}))
+	defer upstream.Close()
+
+	clock := goproxy.NewFakeClock(date)
+	c := cache.NewLowBandwidth(1 << 20)
+	c.Clock = clock
+	client, closeProxy := newProxy(c)
+	defer closeProxy()
+
+	for _, tt := range []struct {
+		after  time.Duration
+		status string
+	}{
+		{0, "MISS"},
+		{5 * time.Minute, "HIT"},
+		{10 * time.Minute, "REVALIDATED"},
+		{5 * time.Minute, "HIT"},
+	} {
+		clock.Advance(tt.after)
+		if body, status := get(t, client, upstream.URL); body != "static" || status != tt.status {
+			t.Errorf("after %v: %q %s, want %s", tt.after, body, status, tt.status)
+		}
+	}
+	if want := date.Format(http.TimeFormat); len(since) != 2 || since[0] != "" || since[1] != want {
+		t.Errorf("If-Modified-Since %q, want %q", since, want)
+	}
+}
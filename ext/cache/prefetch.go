@@ -0,0 +1,260 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// PrefetchStats are the counters of a Prefetcher.
+type PrefetchStats struct {
+	Fetched int64
+	Failed  int64
+	// Dropped is the number of URLs not queued because the queue was full.
+	Dropped int64
+}
+
+// Prefetcher fetches URLs into a Cache in the background, with a bounded
+// concurrency:
+//
+//	prefetch := cache.NewPrefetcher(c, proxy.Tr)
+//	prefetch.Warm("https://intranet.example.com/", "https://intranet.example.com/app.js")
+//	proxy.OnResponse().DoFunc(prefetch.OnResponse)
+//
+// The prefetch requests are sent with Transport, without the proxy
+// handlers, and without the cookies and credentials of the clients.
+type Prefetcher struct {
+	Cache     *Cache
+	Transport http.RoundTripper
+	// Concurrency is the number of concurrent fetches, 4 by default.
+	Concurrency int
+	// QueueSize bounds the URLs waiting to be fetched, 1024 by default.
+	QueueSize int
+	// Header lists the request headers copied from the requests whose
+	// responses announce the resources, the User-Agent and Accept-Language
+	// by default, so that the prefetched entries match their Vary.
+	Header []string
+
+	once    sync.Once
+	queue   chan *http.Request
+	done    chan struct{}
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	queued  map[string]bool
+	stats   PrefetchStats
+}
+
+// NewPrefetcher returns a Prefetcher into c, fetching with transport.
+func NewPrefetcher(c *Cache, transport http.RoundTripper) *Prefetcher {
+	return &Prefetcher{Cache: c, Transport: transport}
+}
+
+func (p *Prefetcher) start() {
+	p.once.Do(func() {
+		size := p.QueueSize
+		if size <= 0 {
+			size = 1024
+		}
+		workers := p.Concurrency
+		if workers <= 0 {
+			workers = 4
+		}
+		p.queue = make(chan *http.Request, size)
+		p.done = make(chan struct{})
+		p.queued = make(map[string]bool)
+		for i := 0; i < workers; i++ {
+			go p.work()
+		}
+	})
+}
+
+func (p *Prefetcher) work() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case req := <-p.queue:
+			p.fetch(req)
+			p.mu.Lock()
+			delete(p.queued, Key(req))
+			p.mu.Unlock()
+			p.pending.Done()
+		}
+	}
+}
+
+func (p *Prefetcher) fetch(req *http.Request) {
+	if e := p.Cache.Lookup(req); e != nil && e.Fresh(p.Cache.now()) {
+		return
+	}
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&p.stats.Failed, 1)
+		return
+	}
+	defer resp.Body.Close()
+	e := p.Cache.entry(req, resp)
+	if e == nil {
+		atomic.AddInt64(&p.stats.Failed, 1)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, p.Cache.maxBodySize()+1))
+	if err != nil || int64(len(body)) > p.Cache.maxBodySize() {
+		atomic.AddInt64(&p.stats.Failed, 1)
+		return
+	}
+	e.Body = body
+	p.Cache.Storage.Set(e.URL, e)
+	atomic.AddInt64(&p.stats.Fetched, 1)
+}
+
+// Enqueue queues the URL u, fetched with header, unless it is already
+// queued. It returns false when the queue is full.
+func (p *Prefetcher) Enqueue(u string, header http.Header) bool {
+	p.start()
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, u, nil)
+	if err != nil || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		return false
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	key := Key(req)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued[key] {
+		return true
+	}
+	p.pending.Add(1)
+	select {
+	case p.queue <- req:
+		p.queued[key] = true
+		return true
+	default:
+		p.pending.Done()
+		atomic.AddInt64(&p.stats.Dropped, 1)
+		return false
+	}
+}
+
+// Warm queues urls, and returns the number of them queued.
+func (p *Prefetcher) Warm(urls ...string) int {
+	n := 0
+	for _, u := range urls {
+		if p.Enqueue(u, nil) {
+			n++
+		}
+	}
+	return n
+}
+
+// Wait waits for the queued URLs to be fetched.
+func (p *Prefetcher) Wait() {
+	p.pending.Wait()
+}
+
+// Close stops the fetches. The queued URLs are dropped.
+func (p *Prefetcher) Close() {
+	p.start()
+	close(p.done)
+	for {
+		select {
+		case <-p.queue:
+			p.pending.Done()
+		default:
+			return
+		}
+	}
+}
+
+// Stats returns the counters of the prefetcher.
+func (p *Prefetcher) Stats() PrefetchStats {
+	return PrefetchStats{
+		Fetched: atomic.LoadInt64(&p.stats.Fetched),
+		Failed:  atomic.LoadInt64(&p.stats.Failed),
+		Dropped: atomic.LoadInt64(&p.stats.Dropped),
+	}
+}
+
+// Links returns the targets of the Link header fields of h with one of
+// the relations rels, resolved against base.
+func Links(h http.Header, base *url.URL, rels ...string) []string {
+	var links []string
+	for _, v := range h.Values("Link") {
+		for v != "" {
+			start := strings.IndexByte(v, '<')
+			end := strings.IndexByte(v, '>')
+			if start < 0 || end < start {
+				break
+			}
+			target := v[start+1 : end]
+			params := v[end+1:]
+			next := len(params)
+			if i := strings.IndexByte(params, '<'); i >= 0 {
+				next = i
+			}
+			v, params = params[next:], params[:next]
+			if hasRel(params, rels) {
+				if u, err := base.Parse(target); err == nil {
+					links = append(links, u.String())
+				}
+			}
+		}
+	}
+	return links
+}
+
+func hasRel(params string, rels []string) bool {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "rel") {
+			continue
+		}
+		for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `",`)) {
+			for _, want := range rels {
+				if strings.EqualFold(rel, want) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// OnResponse queues the resources announced by the Link headers of the
+// responses with the preload or prefetch relations.
+func (p *Prefetcher) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	links := Links(resp.Header, ctx.Req.URL, "preload", "prefetch")
+	if len(links) == 0 {
+		return resp
+	}
+	names := p.Header
+	if names == nil {
+		names = []string{"User-Agent", "Accept-Language"}
+	}
+	header := make(http.Header)
+	for _, name := range names {
+		if v := ctx.Req.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	for _, link := range links {
+		if !p.Enqueue(link, header) {
+			ctx.Logf("cache: prefetch queue full, dropping %s", link)
+		}
+	}
+	return resp
+}
@@ -0,0 +1,67 @@
+package cache_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/cache"
+)
+
+func TestLinks(t *testing.T) {
+	h := http.Header{"Link": {`</style.css>; rel=preload; as=style, <https://cdn.example.com/a,b.js>; rel="preload prefetch"`, `</next>; rel=next`}}
+	base, _ := url.Parse("https://example.com/page")
+	got := cache.Links(h, base, "preload")
+	want := []string{"https://example.com/style.css", "https://cdn.example.com/a,b.js"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Links = %q, want %q", got, want)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var fetched []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/page" {
+			w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	c := cache.New(1 << 20)
+	prefetch := cache.NewPrefetcher(c, http.DefaultTransport)
+	prefetch.Concurrency = 1
+	defer prefetch.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	c.Install(proxy)
+	proxy.OnResponse().DoFunc(prefetch.OnResponse)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	if n := prefetch.Warm(upstream.URL + "/warm"); n != 1 {
+		t.Fatalf("%d URLs queued", n)
+	}
+	prefetch.Wait()
+	if _, status := get(t, client, upstream.URL+"/warm"); status != "HIT" {
+		t.Errorf("warmed URL: %s", status)
+	}
+
+	get(t, client, upstream.URL+"/page")
+	prefetch.Wait()
+	if body, status := get(t, client, upstream.URL+"/style.css"); status != "HIT" || body != "/style.css" {
+		t.Errorf("prefetched URL: %q %s", body, status)
+	}
+	if want := []string{"/warm", "/page", "/style.css"}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched %q, want %q", fetched, want)
+	}
+	if stats := prefetch.Stats(); stats.Fetched != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+}
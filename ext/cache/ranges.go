@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// parseRange parses the Range header s against a body of size bytes. It
+// returns false when it isn't a single byte range, which is ignored, and
+// satisfiable false when the range starts beyond the body.
+func parseRange(s string, size int64) (start, end int64, ok, satisfiable bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(s), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+	if first == "" {
+		// The suffix range of the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end = size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end, true, true
+}
+
+// ifRange returns whether the If-Range header of req, if any, matches e:
+// otherwise the whole entry is sent rather than the range.
+func ifRange(req *http.Request, e *Entry) bool {
+	v := req.Header.Get("If-Range")
+	if v == "" {
+		return true
+	}
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "W/") {
+		// The weak validators can't be used for ranges.
+		etag := e.Header.Get("ETag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && v == etag
+	}
+	return v == e.Header.Get("Last-Modified")
+}
+
+// serveRange restricts resp, the response of e to req, to the range asked
+// by req.
+func serveRange(req *http.Request, e *Entry, resp *http.Response) {
+	if e.StatusCode != http.StatusOK || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if resp.Header.Get("Accept-Ranges") == "" {
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+	if req.Method != http.MethodGet || req.Header.Get("Range") == "" || !ifRange(req, e) {
+		return
+	}
+	size := int64(len(e.Body))
+	start, end, ok, satisfiable := parseRange(req.Header.Get("Range"), size)
+	if !ok {
+		return
+	}
+	if !satisfiable {
+		resp.StatusCode, resp.Status = http.StatusRequestedRangeNotSatisfiable, "416 Requested Range Not Satisfiable"
+		resp.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		resp.Header.Set("Content-Length", "0")
+		resp.Body, resp.ContentLength = http.NoBody, 0
+		return
+	}
+	resp.StatusCode, resp.Status = http.StatusPartialContent, "206 Partial Content"
+	resp.Header.Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(size, 10))
+	resp.Header.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	resp.Body = io.NopCloser(bytes.NewReader(e.Body[start : end+1]))
+	resp.ContentLength = end - start + 1
+}
+
+// flight is a fetch of a whole object for range requests, shared by the
+// parallel range requests to the same URL.
+type flight struct {
+	done  chan struct{}
+	entry *Entry
+}
+
+// flights tracks the fetches of the Cache with CoalesceRanges.
+type flights struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// join returns the flight of key, and whether the caller is the first of
+// the flight, fetching the object.
+func (f *flights) join(key string) (*flight, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fl := f.m[key]; fl != nil {
+		return fl, false
+	}
+	if f.m == nil {
+		f.m = make(map[string]*flight)
+	}
+	fl := &flight{done: make(chan struct{})}
+	f.m[key] = fl
+	return fl, true
+}
+
+func (f *flights) leave(key string, fl *flight) {
+	f.mu.Lock()
+	delete(f.m, key)
+	f.mu.Unlock()
+	close(fl.done)
+}
+
+// coalesce sends the range request req missing the cache upstream as a
+// request of the whole object, shared with the parallel range requests to
+// the same URL, and answers the range from it.
+func (c *Cache) coalesce(req *http.Request, ctx *goproxy.ProxyCtx, next goproxy.RoundTripper) (*http.Response, error) {
+	key := Key(req)
+	fl, first := c.flights.join(key)
+	if !first {
+		select {
+		case <-fl.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if fl.entry != nil && fl.entry.matches(req) {
+			ctx.Logf("cache: coalesced range of %v", req.URL)
+			return c.serve(req, fl.entry, "HIT"), nil
+		}
+		return next.RoundTrip(req, ctx)
+	}
+	defer c.flights.leave(key, fl)
+
+	whole := req.Clone(req.Context())
+	whole.Header.Del("Range")
+	whole.Header.Del("If-Range")
+	resp, err := next.RoundTrip(whole, ctx)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.ContentLength > c.maxBodySize() {
+		// The whole response is an answer to the range request as well.
+		return resp, err
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, c.maxBodySize()+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(data)) > c.maxBodySize() {
+		resp.Body = &struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	e := c.entry(whole, resp)
+	if e == nil {
+		// The response isn't shared, and only answers req.
+		e = &Entry{URL: key, StatusCode: resp.StatusCode, Header: resp.Header.Clone(), Body: data, Stored: c.now()}
+		e.Header.Del("Transfer-Encoding")
+		return c.serve(req, e, "MISS"), nil
+	}
+	e.Body = data
+	c.Storage.Set(key, e)
+	fl.entry = e
+	return c.serve(req, e, "MISS"), nil
+}
@@ -0,0 +1,108 @@
+package cache_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy/ext/cache"
+)
+
+func TestRanges(t *testing.T) {
+	var hits int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", "bytes 0-0/10")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "u")
+			return
+		}
+		io.WriteString(w, "0123456789")
+	}))
+	defer upstream.Close()
+	client, closeProxy := newProxy(cache.New(1 << 20))
+	defer closeProxy()
+
+	// The range requests missing the cache are sent upstream, and their
+	// partial responses aren't stored.
+	if body, status := get(t, client, upstream.URL, "Range", "bytes=0-0"); body != "u" || status != "" {
+		t.Errorf("range miss: %q %s", body, status)
+	}
+	get(t, client, upstream.URL)
+	for _, tt := range []struct {
+		rng, ifRange, body string
+		code               int
+	}{
+		{"bytes=2-4", "", "234", http.StatusPartialContent},
+		{"bytes=7-", "", "789", http.StatusPartialContent},
+		{"bytes=-3", "", "789", http.StatusPartialContent},
+		{"bytes=8-20", `"v1"`, "89", http.StatusPartialContent},
+		{"bytes=2-4", `"v0"`, "0123456789", http.StatusOK},
+		{"bytes=0-1,4-5", "", "0123456789", http.StatusOK},
+		{"bytes=10-", "", "", http.StatusRequestedRangeNotSatisfiable},
+	} {
+		req, _ := http.NewRequest("GET", upstream.URL, nil)
+		req.Header.Set("Range", tt.rng)
+		if tt.ifRange != "" {
+			req.Header.Set("If-Range", tt.ifRange)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.code || string(body) != tt.body || resp.Header.Get("X-Cache") != "HIT" {
+			t.Errorf("%s: %d %q %s, want %d %q", tt.rng, resp.StatusCode, body, resp.Header.Get("X-Cache"), tt.code, tt.body)
+		}
+	}
+	if hits != 2 {
+		t.Errorf("%d upstream requests", hits)
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	var hits int64
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		<-release
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, "0123456789")
+	}))
+	defer upstream.Close()
+	c := cache.New(1 << 20)
+	c.CoalesceRanges = true
+	client, closeProxy := newProxy(c)
+	defer closeProxy()
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 4)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i], _ = get(t, client, upstream.URL, "Range", fmt.Sprintf("bytes=%d-%d", i, i))
+		}(i)
+	}
+	// The requests wait for the first one to fetch the object.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	for i, body := range bodies {
+		if body != fmt.Sprint(i) {
+			t.Errorf("range %d: %q", i, body)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("%d upstream requests", hits)
+	}
+}
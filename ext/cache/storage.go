@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// MemoryStorage keeps the entries in memory, evicting the least recently
+// used ones above its size.
+type MemoryStorage struct {
+	MaxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+	size  int64
+}
+
+// NewMemoryStorage returns a MemoryStorage of maxBytes.
+func NewMemoryStorage(maxBytes int64) *MemoryStorage {
+	return &MemoryStorage{MaxBytes: maxBytes, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get implements Storage.
+func (s *MemoryStorage) Get(key string) *Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entry
+}
+
+// Set implements Storage.
+func (s *MemoryStorage) Set(key string, e *Entry) {
+	size := e.size()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delete(key)
+	if size > s.MaxBytes {
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&memoryItem{key: key, entry: e, size: size})
+	s.size += size
+	for s.size > s.MaxBytes {
+		s.delete(s.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+// Delete implements Storage.
+func (s *MemoryStorage) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delete(key)
+}
+
+func (s *MemoryStorage) delete(key string) {
+	if el, ok := s.entries[key]; ok {
+		s.size -= el.Value.(*memoryItem).size
+		s.lru.Remove(el)
+		delete(s.entries, key)
+	}
+}
+
+// Len returns the number of entries.
+func (s *MemoryStorage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
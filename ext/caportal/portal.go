@@ -0,0 +1,135 @@
+// Package caportal lets the proxy users download and install the MITM
+// certificate authority, by browsing a magic host through the proxy:
+//
+//	caportal.New(&goproxy.GoproxyCa).Install(proxy)
+//
+// Then http://goproxy.local/ shows the installation instructions, and
+// http://goproxy.local/ca.crt is the certificate.
+package caportal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// DefaultHost is the magic host of the portal.
+const DefaultHost = "goproxy.local"
+
+// Portal serves the CA certificate on Host.
+type Portal struct {
+	Host string
+	// Name is the name of the proxy on the instructions page.
+	Name string
+	CA   *x509.Certificate
+}
+
+// New returns a Portal serving the certificate of ca on DefaultHost.
+func New(ca *tls.Certificate) *Portal {
+	leaf := ca.Leaf
+	if leaf == nil {
+		leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+	}
+	return &Portal{Host: DefaultHost, Name: "goproxy", CA: leaf}
+}
+
+var page = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Install the {{.Name}} certificate</title></head>
+<body>
+<h1>Install the {{.Name}} certificate</h1>
+<p>The certificate authority <b>{{.Subject}}</b> lets {{.Name}} inspect your
+HTTPS traffic. Its SHA-256 fingerprint is <code>{{.Fingerprint}}</code>.</p>
+<ul>
+<li><b>Windows:</b> download <a href="/ca.cer">ca.cer</a>, open it, choose
+<i>Install Certificate</i> and place it in the <i>Trusted Root Certification
+Authorities</i> store.</li>
+<li><b>macOS:</b> download <a href="/ca.crt">ca.crt</a>, open it in Keychain
+Access, and set <i>Always Trust</i> in its trust settings.</li>
+<li><b>iOS:</b> download <a href="/ca.crt">ca.crt</a>, install the profile
+from Settings, then enable it in <i>General &gt; About &gt; Certificate Trust
+Settings</i>.</li>
+<li><b>Android:</b> download <a href="/ca.cer">ca.cer</a> and install it from
+<i>Settings &gt; Security &gt; Encryption &amp; credentials</i>.</li>
+<li><b>Linux:</b> download <a href="/ca.crt">ca.crt</a> to
+<code>/usr/local/share/ca-certificates/</code> and run
+<code>update-ca-certificates</code>.</li>
+<li><b>Firefox:</b> import <a href="/ca.crt">ca.crt</a> in <i>Settings &gt;
+Privacy &amp; Security &gt; Certificates</i>.</li>
+</ul>
+</body>
+</html>
+`))
+
+func (p *Portal) fingerprint() string {
+	sum := sha256.Sum256(p.CA.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+func response(req *http.Request, contentType string, body []byte) *http.Response {
+	resp := goproxy.NewResponse(req, contentType, http.StatusOK, string(body))
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// Handle implements goproxy.ReqHandler, serving the portal requests.
+func (p *Portal) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !p.matches(req.URL.Hostname()) {
+		return req, nil
+	}
+	switch req.URL.Path {
+	case "/ca.crt", "/ca.pem":
+		return nil, response(req, "application/x-x509-ca-cert",
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.CA.Raw}))
+	case "/ca.cer", "/ca.der":
+		return nil, response(req, "application/pkix-cert", p.CA.Raw)
+	case "/", "/index.html":
+		var buf bytes.Buffer
+		err := page.Execute(&buf, map[string]string{
+			"Name":        p.Name,
+			"Subject":     p.CA.Subject.String(),
+			"Fingerprint": p.fingerprint(),
+		})
+		if err != nil {
+			return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		return nil, response(req, goproxy.ContentTypeHtml, buf.Bytes())
+	}
+	return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNotFound, "Not found")
+}
+
+func (p *Portal) matches(host string) bool {
+	return strings.EqualFold(strings.TrimSuffix(host, "."), p.Host)
+}
+
+// HandleConnect MITMs the tunnels to the portal, so that it is also served
+// over HTTPS, and lets the other tunnels go to the following handlers.
+func (p *Portal) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	hostname := host
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		hostname = host[:i]
+	}
+	if p.matches(hostname) {
+		return goproxy.MitmConnect, host
+	}
+	return nil, host
+}
+
+// Install serves the portal on proxy. It must be installed before the
+// handlers rejecting unknown destinations.
+func (p *Portal) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnect(p)
+	proxy.OnRequest().Do(p)
+}
@@ -0,0 +1,71 @@
+package caportal_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/caportal"
+)
+
+func get(t *testing.T, client *http.Client, u string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestPortal(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	caportal.New(&goproxy.GoproxyCa).Install(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	resp, body := get(t, client, "http://goproxy.local/ca.crt")
+	block, _ := pem.Decode(body)
+	if resp.StatusCode != http.StatusOK || block == nil || !bytes.Equal(block.Bytes, goproxy.GoproxyCa.Leaf.Raw) {
+		t.Fatalf("Expected the PEM certificate, got %s %q", resp.Status, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-x509-ca-cert" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+
+	_, body = get(t, client, "http://goproxy.local/ca.cer")
+	if _, err := x509.ParseCertificate(body); err != nil {
+		t.Errorf("Expected the DER certificate: %v", err)
+	}
+
+	resp, body = get(t, client, "http://GOPROXY.LOCAL/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `href="/ca.crt"`) {
+		t.Errorf("Expected the instructions page, got %s %q", resp.Status, body)
+	}
+
+	if resp, _ = get(t, client, "http://goproxy.local/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %s", resp.Status)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(goproxy.GoproxyCa.Leaf)
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: pool}
+	_, body = get(t, client, "https://goproxy.local/ca.pem")
+	if block, _ := pem.Decode(body); block == nil {
+		t.Errorf("Expected the certificate over HTTPS, got %q", body)
+	}
+}
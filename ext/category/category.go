@@ -0,0 +1,243 @@
+// Package category classifies the destinations of the proxy requests, for
+// web filtering:
+//
+//	db := category.NewDatabase()
+//	db.Add("facebook.com", "social")
+//	c := category.NewCache(db, time.Hour)
+//	proxy.OnRequest(category.Is(c, "social")).DoFunc(block)
+package category
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Categorizer returns the categories of a URL.
+type Categorizer interface {
+	Categorize(ctx context.Context, u *url.URL) ([]string, error)
+}
+
+// Database is a local categorization database, matching the host names and
+// their subdomains.
+type Database struct {
+	mu      sync.RWMutex
+	domains map[string][]string
+}
+
+// NewDatabase returns an empty Database.
+func NewDatabase() *Database {
+	return &Database{domains: make(map[string][]string)}
+}
+
+// Add adds categories to domain and its subdomains.
+func (d *Database) Add(domain string, categories ...string) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.domains[domain] = append(d.domains[domain], categories...)
+}
+
+// Load reads a database made of lines such as
+//
+//	facebook.com social,chat
+//
+// Empty lines and lines starting with # are ignored.
+func (d *Database) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("category: line %d: expected domain and categories", n)
+		}
+		d.Add(fields[0], strings.Split(fields[1], ",")...)
+	}
+	return scanner.Err()
+}
+
+// Categorize returns the categories of the host of u and of its parent
+// domains.
+func (d *Database) Categorize(_ context.Context, u *url.URL) ([]string, error) {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var categories []string
+	for {
+		categories = append(categories, d.domains[host]...)
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return categories, nil
+		}
+		host = host[i+1:]
+	}
+}
+
+// Remote queries an HTTP categorization service. The URL of the request is
+// sent as the url query parameter of Endpoint, and the service answers with
+// a JSON object such as {"categories": ["news"]}.
+type Remote struct {
+	Endpoint string
+	// Header is added to the lookup requests, for API keys.
+	Header http.Header
+	Client *http.Client
+}
+
+func (r *Remote) Categorize(ctx context.Context, u *url.URL) ([]string, error) {
+	endpoint, err := url.Parse(r.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := endpoint.Query()
+	q.Set("url", u.String())
+	endpoint.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("category: lookup of %s: %s", u, resp.Status)
+	}
+	var result struct {
+		Categories []string `json:"categories"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Categories, nil
+}
+
+// Cache caches the results of a Categorizer for TTL, keyed by host name.
+// Concurrent lookups of the same host share a single query.
+type Cache struct {
+	Categorizer Categorizer
+	TTL         time.Duration
+	// Timeout of the lookups, 2 seconds by default.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	done       chan struct{}
+	categories []string
+	err        error
+	expires    time.Time
+}
+
+// NewCache returns a Cache of c.
+func NewCache(c Categorizer, ttl time.Duration) *Cache {
+	return &Cache{Categorizer: c, TTL: ttl, entries: make(map[string]*cacheEntry)}
+}
+
+func (c *Cache) entry(u *url.URL) *cacheEntry {
+	key := strings.ToLower(u.Hostname())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		select {
+		case <-e.done:
+			if time.Now().Before(e.expires) {
+				return e
+			}
+		default:
+			return e
+		}
+	}
+
+	e := &cacheEntry{done: make(chan struct{})}
+	c.entries[key] = e
+	lookup := *u
+	go func() {
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = 2 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		e.categories, e.err = c.Categorizer.Categorize(ctx, &lookup)
+		ttl := c.TTL
+		if e.err != nil {
+			// Retry failed lookups sooner.
+			ttl /= 10
+		}
+		e.expires = time.Now().Add(ttl)
+		close(e.done)
+	}()
+	return e
+}
+
+// Prefetch starts the lookup of u in the background.
+func (c *Cache) Prefetch(u *url.URL) {
+	c.entry(u)
+}
+
+// Categorize returns the categories of u, waiting for the lookup until ctx
+// is done.
+func (c *Cache) Categorize(ctx context.Context, u *url.URL) ([]string, error) {
+	e := c.entry(u)
+	select {
+	case <-e.done:
+		return e.categories, e.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Is returns a ReqCondition testing whether the destination of the request
+// is in one of the categories. Destinations that can't be categorized don't
+// match.
+func Is(c Categorizer, categories ...string) goproxy.ReqConditionFunc {
+	wanted := make(map[string]bool, len(categories))
+	for _, category := range categories {
+		wanted[category] = true
+	}
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		found, err := c.Categorize(req.Context(), requestURL(req))
+		if err != nil {
+			ctx.Warnf("Cannot categorize %s: %v", req.URL, err)
+			return false
+		}
+		for _, category := range found {
+			if wanted[category] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// requestURL returns the URL of req, including for CONNECT requests whose
+// URL only has a host.
+func requestURL(req *http.Request) *url.URL {
+	if req.URL.Host == "" {
+		return &url.URL{Scheme: "https", Host: req.Host}
+	}
+	return req.URL
+}
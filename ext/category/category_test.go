@@ -0,0 +1,117 @@
+package category_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/category"
+)
+
+func TestDatabase(t *testing.T) {
+	db := category.NewDatabase()
+	err := db.Load(strings.NewReader(`
+# social networks
+facebook.com social
+chat.facebook.com chat,social
+example.org news
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]string{
+		"www.facebook.com":  "social",
+		"chat.facebook.com": "chat,social,social",
+		"FACEBOOK.COM.":     "social",
+		"notfacebook.com":   "",
+		"example.org:8080":  "news",
+	} {
+		found, err := db.Categorize(context.Background(), &url.URL{Scheme: "http", Host: host})
+		if err != nil || strings.Join(found, ",") != expected {
+			t.Errorf("Expected %s to be %q, got %v %v", host, expected, found, err)
+		}
+	}
+	if err := db.Load(strings.NewReader("invalid")); err == nil {
+		t.Error("Expected invalid lines to be rejected")
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	var lookups int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if r.Header.Get("X-Api-Key") != "key" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		u, _ := url.Parse(r.URL.Query().Get("url"))
+		var categories []string
+		if u.Hostname() == "games.example.com" {
+			categories = []string{"games"}
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"categories": categories})
+	}))
+	defer api.Close()
+
+	remote := &category.Remote{Endpoint: api.URL + "/lookup", Header: http.Header{"X-Api-Key": {"key"}}}
+	c := category.NewCache(remote, time.Hour)
+	isGames := category.Is(c, "games", "gambling")
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://games.example.com/play?i=1", nil)
+		if !isGames.HandleReq(req, ctx) {
+			t.Error("Expected games.example.com to be in games")
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	if isGames.HandleReq(req, ctx) {
+		t.Error("Expected www.example.com not to be in games")
+	}
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Errorf("Expected 2 lookups, got %d", n)
+	}
+
+	connect := httptest.NewRequest(http.MethodConnect, "http://games.example.com:443", nil)
+	connect.URL = &url.URL{Host: "games.example.com:443"}
+	if !isGames.HandleReq(connect, ctx) {
+		t.Error("Expected CONNECT requests to be categorized")
+	}
+
+	remote.Header = nil
+	if _, err := category.NewCache(remote, time.Hour).Categorize(context.Background(),
+		&url.URL{Scheme: "http", Host: "games.example.com"}); err == nil {
+		t.Error("Expected lookup errors to be reported")
+	}
+}
+
+type slowCategorizer chan struct{}
+
+func (s slowCategorizer) Categorize(ctx context.Context, u *url.URL) ([]string, error) {
+	<-s
+	return []string{"slow"}, nil
+}
+
+func TestCacheTimeout(t *testing.T) {
+	slow := make(slowCategorizer)
+	c := category.NewCache(slow, time.Hour)
+	u := &url.URL{Scheme: "http", Host: "slow.example.com"}
+	c.Prefetch(u)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Categorize(ctx, u); err != context.DeadlineExceeded {
+		t.Errorf("Expected the lookup to time out, got %v", err)
+	}
+	close(slow)
+	if found, err := c.Categorize(context.Background(), u); err != nil || len(found) != 1 || found[0] != "slow" {
+		t.Errorf("Expected the pending lookup to complete, got %v %v", found, err)
+	}
+}
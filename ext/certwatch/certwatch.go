@@ -0,0 +1,238 @@
+// Package certwatch monitors the certificates of the upstream servers seen
+// through the MITM. It records the chains per host, and fires alerts when a
+// chain violates the pins of its host, or is issued by an unexpected CA:
+//
+//	watch := certwatch.New(func(a certwatch.Alert) {
+//		log.Printf("%s: %s", a.Host, a.Type)
+//	})
+//	watch.Pin("api.example.com", "sha256/YLh1dUR9y6Kja30RrAn7JKnbQG/uEtLMkBgFF2Fuihg=")
+//	watch.Install(proxy)
+package certwatch
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// AlertType is the reason of an Alert.
+type AlertType string
+
+const (
+	// PinViolation is fired when no certificate of a chain matches the pins
+	// of its host.
+	PinViolation AlertType = "pin-violation"
+	// NewIssuer is fired when a known host presents a chain of an issuer
+	// never seen for it.
+	NewIssuer AlertType = "new-issuer"
+	// NewKey is fired when a known host presents a public key never seen
+	// for it, if Watcher.AlertOnNewKey is set.
+	NewKey AlertType = "new-key"
+)
+
+// Alert is an unexpected upstream chain.
+type Alert struct {
+	Type  AlertType
+	Host  string
+	Time  time.Time
+	Chain []*x509.Certificate
+	// Previous is the host record before the chain was seen, nil for a new
+	// host.
+	Previous *Record
+}
+
+// Record is the history of the chains of a host.
+type Record struct {
+	Host      string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Leaf is the last leaf certificate of the host.
+	Leaf *x509.Certificate
+	// Keys and Issuers are the SPKI pins of the leaf keys and of the
+	// issuers seen for the host.
+	Keys    []string
+	Issuers []string
+}
+
+func (r *Record) clone() *Record {
+	c := *r
+	c.Keys = append([]string(nil), r.Keys...)
+	c.Issuers = append([]string(nil), r.Issuers...)
+	return &c
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SPKIPin returns the pin of the public key of cert, in the
+// "sha256/<base64>" format of HTTP public key pinning.
+func SPKIPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Watcher records the upstream chains and checks them.
+type Watcher struct {
+	// OnAlert is called from the response handlers, and should not block.
+	OnAlert func(Alert)
+	// AlertOnNewKey fires NewKey alerts, noisy for the hosts rotating their
+	// keys.
+	AlertOnNewKey bool
+	// MaxHosts bounds the recorded hosts, 10000 by default. The least
+	// recently seen host is forgotten above the limit.
+	MaxHosts int
+
+	mu      sync.Mutex
+	pins    map[string][]string
+	records map[string]*Record
+}
+
+// New returns a Watcher calling onAlert.
+func New(onAlert func(Alert)) *Watcher {
+	return &Watcher{OnAlert: onAlert}
+}
+
+// Pin sets the pins of host, any of which must match a certificate of its
+// chains. A host of "*.example.com" pins the subdomains of example.com.
+func (w *Watcher) Pin(host string, pins ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pins == nil {
+		w.pins = make(map[string][]string)
+	}
+	w.pins[strings.ToLower(host)] = pins
+}
+
+func (w *Watcher) pinsOf(host string) []string {
+	if pins, ok := w.pins[host]; ok {
+		return pins
+	}
+	for domain := host; ; {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return nil
+		}
+		domain = domain[i+1:]
+		if pins, ok := w.pins["*."+domain]; ok {
+			return pins
+		}
+	}
+}
+
+// Record returns a copy of the record of host, nil if it hasn't been seen.
+func (w *Watcher) Record(host string) *Record {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if r, ok := w.records[strings.ToLower(host)]; ok {
+		return r.clone()
+	}
+	return nil
+}
+
+func (w *Watcher) evict() {
+	limit := w.MaxHosts
+	if limit <= 0 {
+		limit = 10000
+	}
+	for len(w.records) >= limit {
+		var oldest *Record
+		for _, r := range w.records {
+			if oldest == nil || r.LastSeen.Before(oldest.LastSeen) {
+				oldest = r
+			}
+		}
+		delete(w.records, oldest.Host)
+	}
+}
+
+// Observe records the chain presented by host, the leaf first, and returns
+// the alerts it fired.
+func (w *Watcher) Observe(host string, chain []*x509.Certificate) []Alert {
+	if len(chain) == 0 {
+		return nil
+	}
+	host = strings.ToLower(host)
+	now := time.Now()
+	key := SPKIPin(chain[0])
+	var issuer string
+	if len(chain) > 1 {
+		issuer = SPKIPin(chain[1])
+	}
+
+	w.mu.Lock()
+	var alerts []Alert
+	alert := func(t AlertType, previous *Record) {
+		alerts = append(alerts, Alert{Type: t, Host: host, Time: now, Chain: chain, Previous: previous})
+	}
+	r, known := w.records[host]
+	var previous *Record
+	if known {
+		previous = r.clone()
+	} else {
+		if w.records == nil {
+			w.records = make(map[string]*Record)
+		}
+		w.evict()
+		r = &Record{Host: host, FirstSeen: now}
+		w.records[host] = r
+	}
+	if pins := w.pinsOf(host); len(pins) > 0 && !matches(chain, pins) {
+		alert(PinViolation, previous)
+	}
+	if issuer != "" && !contains(r.Issuers, issuer) {
+		if known {
+			alert(NewIssuer, previous)
+		}
+		r.Issuers = append(r.Issuers, issuer)
+	}
+	if !contains(r.Keys, key) {
+		if known && w.AlertOnNewKey {
+			alert(NewKey, previous)
+		}
+		r.Keys = append(r.Keys, key)
+	}
+	r.LastSeen = now
+	r.Leaf = chain[0]
+	w.mu.Unlock()
+
+	if w.OnAlert != nil {
+		for _, a := range alerts {
+			w.OnAlert(a)
+		}
+	}
+	return alerts
+}
+
+func matches(chain []*x509.Certificate, pins []string) bool {
+	for _, cert := range chain {
+		if contains(pins, SPKIPin(cert)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle observes the upstream chain of a MITM'd response.
+func (w *Watcher) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if chain := ctx.UpstreamChain(); len(chain) > 0 {
+		w.Observe(ctx.Req.URL.Hostname(), chain)
+	}
+	return resp
+}
+
+// Install observes the MITM'd responses of proxy.
+func (w *Watcher) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnResponse().DoFunc(w.Handle)
+}
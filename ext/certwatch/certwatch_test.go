@@ -0,0 +1,125 @@
+package certwatch_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/certwatch"
+)
+
+func newCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestObserve(t *testing.T) {
+	ca, caKey := newCert(t, "CA", nil, nil)
+	other, otherKey := newCert(t, "Other CA", nil, nil)
+	leaf, _ := newCert(t, "example.com", ca, caKey)
+	rotated, _ := newCert(t, "example.com", ca, caKey)
+	forged, _ := newCert(t, "example.com", other, otherKey)
+
+	var fired []certwatch.AlertType
+	w := certwatch.New(func(a certwatch.Alert) {
+		fired = append(fired, a.Type)
+	})
+	w.AlertOnNewKey = true
+	w.Pin("*.example.com", certwatch.SPKIPin(ca))
+
+	for _, tt := range []struct {
+		host   string
+		chain  []*x509.Certificate
+		alerts []certwatch.AlertType
+	}{
+		{"www.example.com", []*x509.Certificate{leaf, ca}, nil},
+		{"www.example.com", []*x509.Certificate{rotated, ca}, []certwatch.AlertType{certwatch.NewKey}},
+		{"www.example.com", []*x509.Certificate{forged, other}, []certwatch.AlertType{certwatch.PinViolation, certwatch.NewIssuer, certwatch.NewKey}},
+		// The first chain of a host is trusted, unless pinned.
+		{"example.org", []*x509.Certificate{forged, other}, nil},
+		{"api.example.com", []*x509.Certificate{forged, other}, []certwatch.AlertType{certwatch.PinViolation}},
+	} {
+		fired = nil
+		w.Observe(tt.host, tt.chain)
+		if len(fired) != len(tt.alerts) {
+			t.Errorf("Expected the alerts %v for %s, got %v", tt.alerts, tt.host, fired)
+			continue
+		}
+		for i := range fired {
+			if fired[i] != tt.alerts[i] {
+				t.Errorf("Expected the alerts %v for %s, got %v", tt.alerts, tt.host, fired)
+			}
+		}
+	}
+
+	r := w.Record("www.example.com")
+	if r == nil || len(r.Issuers) != 2 || len(r.Keys) != 3 || r.Leaf != forged {
+		t.Errorf("Unexpected record %+v", r)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	alerts := make(chan certwatch.Alert, 1)
+	w := certwatch.New(func(a certwatch.Alert) {
+		alerts <- a
+	})
+	w.Pin("127.0.0.1", "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	w.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case a := <-alerts:
+		if a.Type != certwatch.PinViolation || !a.Chain[0].Equal(upstream.Certificate()) {
+			t.Errorf("Unexpected alert %+v", a)
+		}
+	default:
+		t.Error("Expected a pin violation")
+	}
+}
@@ -0,0 +1,302 @@
+// Package challenge interrupts the requests of the suspicious clients with
+// an interstitial served by the proxy, which they must solve to continue,
+// to slow down the abusive automation:
+//
+//	g := challenge.New(&challenge.ProofOfWork{})
+//	g.Install(proxy, botscore.Above(70))
+//
+// The clients solving the challenge get a pass cookie for the host, and the
+// requests with a valid pass are sent upstream, without the cookie. The
+// ProofOfWork challenge makes the browsers compute hashes with JavaScript,
+// other challenges, such as CAPTCHAs, implement Challenge.
+//
+// The interstitial is served on the hosts of the requests, so the HTTPS
+// requests are only challenged once their tunnel is MITM'd.
+package challenge
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+const (
+	// DefaultPath is the default path of the solutions posted to the
+	// hosts.
+	DefaultPath = "/.goproxy-challenge"
+	// DefaultCookie is the default name of the pass cookie.
+	DefaultCookie = "goproxy_pass"
+)
+
+// Challenge is a challenge of the interstitial.
+type Challenge interface {
+	// Form returns the HTML form of the interstitial, posting the solution
+	// to action with the state field.
+	Form(action, state string) template.HTML
+	// Verify returns whether the form of req, parsed, solves the challenge
+	// of state.
+	Verify(req *http.Request, state string) bool
+}
+
+// Page is the data of the interstitial templates.
+type Page struct {
+	Host string
+	URL  string
+	// Form is the form of the challenge.
+	Form template.HTML
+	// Failed is set when the solution posted was wrong.
+	Failed bool
+	// RequestID is the ID of the request in the proxy logs.
+	RequestID string
+}
+
+// DefaultTemplate is the default interstitial template.
+var DefaultTemplate = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body>
+<h1>Checking your browser before accessing {{.Host}}</h1>
+{{if .Failed}}<p>The challenge failed, please try again.</p>{{end}}
+{{.Form}}
+{{if .RequestID}}<p><small>Request {{.RequestID}}.</small></p>{{end}}
+</body>
+</html>
+`))
+
+// Gate challenges the requests it handles.
+type Gate struct {
+	Challenge Challenge
+	// Key authenticates the states of the challenges and the passes.
+	Key []byte
+	// Path is the path of the solutions posted to the hosts, DefaultPath
+	// by default.
+	Path string
+	// Cookie is the name of the pass cookie, DefaultCookie by default.
+	Cookie string
+	// PassTTL is the validity of the passes, 1 hour by default.
+	PassTTL time.Duration
+	// BindClientIP makes the passes valid only for the IP address of the
+	// client which solved the challenge.
+	BindClientIP bool
+	Template     *template.Template
+	// Status of the interstitial, 403 Forbidden by default.
+	Status int
+	// Clock tells the expiration of the passes, goproxy.SystemClock by
+	// default.
+	Clock goproxy.Clock
+}
+
+// stateTTL is the time to solve a challenge.
+const stateTTL = 5 * time.Minute
+
+// New returns a Gate of c, with a random Key.
+func New(c Challenge) *Gate {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("challenge: can't generate a key: " + err.Error())
+	}
+	return &Gate{Challenge: c, Key: key}
+}
+
+func (g *Gate) now() time.Time {
+	if g.Clock != nil {
+		return g.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (g *Gate) path() string {
+	if g.Path != "" {
+		return g.Path
+	}
+	return DefaultPath
+}
+
+func (g *Gate) cookie() string {
+	if g.Cookie != "" {
+		return g.Cookie
+	}
+	return DefaultCookie
+}
+
+func (g *Gate) binding(req *http.Request) string {
+	if !g.BindClientIP {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// sign returns the token of the fields, authenticated with Key.
+func (g *Gate) sign(fields ...string) string {
+	payload := strings.Join(fields, "|")
+	mac := hmac.New(sha256.New, g.Key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the n fields of token, the first one being its
+// expiration, if it is authentic and not expired.
+func (g *Gate) verify(token string, n int) ([]string, bool) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	mac := hmac.New(sha256.New, g.Key)
+	mac.Write(payload)
+	if err != nil || !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, false
+	}
+	fields := strings.SplitN(string(payload), "|", n)
+	if len(fields) != n {
+		return nil, false
+	}
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || !g.now().Before(time.Unix(expires, 0)) {
+		return nil, false
+	}
+	return fields, true
+}
+
+// passed returns whether req has a valid pass, and removes it from the
+// request.
+func (g *Gate) passed(req *http.Request) bool {
+	var valid bool
+	var kept []string
+	for _, c := range req.Cookies() {
+		if c.Name != g.cookie() {
+			kept = append(kept, c.String())
+			continue
+		}
+		if fields, ok := g.verify(c.Value, 3); ok && strings.EqualFold(fields[1], req.URL.Hostname()) && fields[2] == g.binding(req) {
+			valid = true
+		}
+	}
+	if valid {
+		req.Header.Del("Cookie")
+		if len(kept) > 0 {
+			req.Header.Set("Cookie", strings.Join(kept, "; "))
+		}
+	}
+	return valid
+}
+
+// interstitial returns the interstitial of req, redirecting to target once
+// solved.
+func (g *Gate) interstitial(req *http.Request, ctx *goproxy.ProxyCtx, target string, failed bool) *http.Response {
+	expires := strconv.FormatInt(g.now().Add(stateTTL).Unix(), 10)
+	state := g.sign(expires, g.binding(req), target)
+	page := Page{
+		Host:      req.URL.Hostname(),
+		URL:       target,
+		Form:      g.Challenge.Form(g.path(), state),
+		Failed:    failed,
+		RequestID: ctx.RequestID(),
+	}
+	tmpl := g.Template
+	if tmpl == nil {
+		tmpl = DefaultTemplate
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		ctx.Warnf("challenge: can't render the interstitial: %v", err)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, "Cannot render the challenge")
+	}
+	status := g.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeHtml, status, buf.String())
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// solution handles the solutions posted to Path.
+func (g *Gate) solution(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.URL.Path != g.path() {
+		return req, nil
+	}
+	if req.Method != http.MethodPost {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+	req.Body = http.MaxBytesReader(nil, req.Body, 64<<10)
+	if err := req.ParseForm(); err != nil {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, "Invalid challenge solution")
+	}
+	state := req.PostForm.Get("state")
+	fields, ok := g.verify(state, 3)
+	// The target is on the host, not to redirect elsewhere.
+	var target *url.URL
+	if ok {
+		target, _ = url.Parse(fields[2])
+	}
+	if !ok || fields[1] != g.binding(req) || target == nil || !strings.EqualFold(target.Host, req.URL.Host) {
+		ctx.Logf("challenge: invalid or expired state from %s", req.RemoteAddr)
+		return req, g.interstitial(req, ctx, "/", true)
+	}
+	if !g.Challenge.Verify(req, state) {
+		ctx.Logf("challenge: failed by %s", req.RemoteAddr)
+		return req, g.interstitial(req, ctx, fields[2], true)
+	}
+
+	ttl := g.PassTTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	expires := strconv.FormatInt(g.now().Add(ttl).Unix(), 10)
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusSeeOther, "")
+	resp.Header.Set("Location", fields[2])
+	resp.Header.Set("Cache-Control", "no-store")
+	cookie := &http.Cookie{
+		Name:     g.cookie(),
+		Value:    g.sign(expires, req.URL.Hostname(), g.binding(req)),
+		Path:     "/",
+		MaxAge:   int(ttl / time.Second),
+		HttpOnly: true,
+		Secure:   req.URL.Scheme == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+	ctx.Logf("challenge: passed by %s for %s", req.RemoteAddr, req.URL.Hostname())
+	return req, resp
+}
+
+// Handle implements goproxy.ReqHandler, answering the requests without a
+// valid pass with the interstitial.
+func (g *Gate) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.URL.Path == g.path() {
+		return g.solution(req, ctx)
+	}
+	if g.passed(req) {
+		return req, nil
+	}
+	ctx.Logf("challenge: challenging %s for %s", req.RemoteAddr, req.URL.Hostname())
+	return req, g.interstitial(req, ctx, req.URL.String(), false)
+}
+
+// Install challenges the requests of proxy matching conds. The solutions
+// are handled for all the requests, since those of the challenged clients
+// may not match conds.
+func (g *Gate) Install(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest().Do(goproxy.FuncReqHandler(g.solution))
+	proxy.OnRequest(conds...).Do(g)
+}
@@ -0,0 +1,108 @@
+package challenge_test
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/challenge"
+)
+
+var stateField = regexp.MustCompile(`name="state" value="([^"]+)"`)
+
+// solve returns the nonce solving the proof of work of state.
+func solve(state string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		sum := sha256.Sum256([]byte(state + ":" + strconv.Itoa(nonce)))
+		if binary.BigEndian.Uint32(sum[:4])>>(32-difficulty) == 0 {
+			return strconv.Itoa(nonce)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	var cookies []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		io.WriteString(w, "content")
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	g := challenge.New(&challenge.ProofOfWork{Difficulty: 8})
+	g.Install(proxy, goproxy.UrlHasPrefix(upstream.Listener.Addr().String()+"/protected"))
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Jar: jar}
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(upstream.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get("/protected/page")
+	m := stateField.FindStringSubmatch(body)
+	if resp.StatusCode != http.StatusForbidden || m == nil {
+		t.Fatalf("Expected the interstitial, got %d %q", resp.StatusCode, body)
+	}
+	if len(cookies) != 0 {
+		t.Error("Expected the challenged request not to be sent upstream")
+	}
+	state := m[1]
+
+	postSolution := func(nonce string) (*http.Response, string) {
+		resp, err := client.PostForm(upstream.URL+challenge.DefaultPath, url.Values{"state": {state}, "nonce": {nonce}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	nonce := solve(state, 8)
+	wrong, _ := strconv.Atoi(nonce)
+	for {
+		wrong++
+		sum := sha256.Sum256([]byte(state + ":" + strconv.Itoa(wrong)))
+		if binary.BigEndian.Uint32(sum[:4])>>24 != 0 {
+			break
+		}
+	}
+	if resp, _ := postSolution(strconv.Itoa(wrong)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the wrong solution to be challenged again, got %d", resp.StatusCode)
+	}
+
+	// The client follows the redirection to the page with its pass.
+	resp, body = postSolution(nonce)
+	if resp.StatusCode != http.StatusOK || body != "content" {
+		t.Fatalf("Expected the page once solved, got %d %q", resp.StatusCode, body)
+	}
+	if len(cookies) != 1 || cookies[0] != "" {
+		t.Errorf("Expected the pass not to be sent upstream, got %q", cookies)
+	}
+	if resp, _ := get("/protected/other"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the pass to be valid for the host, got %d", resp.StatusCode)
+	}
+
+	// A forged pass.
+	u, _ := url.Parse(upstream.URL)
+	jar.SetCookies(u, []*http.Cookie{{Name: challenge.DefaultCookie, Value: "forged.pass", Path: "/"}})
+	if resp, _ := get("/protected/page"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the forged pass to be challenged, got %d", resp.StatusCode)
+	}
+}
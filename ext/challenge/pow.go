@@ -0,0 +1,104 @@
+package challenge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// ProofOfWork is a JavaScript challenge: the browsers find a nonce whose
+// SHA-256, with the state, starts with Difficulty zero bits. It takes the
+// browsers a fraction of a second, without user interaction, and makes the
+// scripts without JavaScript fail.
+type ProofOfWork struct {
+	// Difficulty is the number of leading zero bits of the hashes, from 1
+	// to 32, 16 by default. Each bit doubles the hashes computed.
+	Difficulty int
+}
+
+func (p *ProofOfWork) difficulty() int {
+	switch {
+	case p.Difficulty <= 0:
+		return 16
+	case p.Difficulty > 32:
+		return 32
+	}
+	return p.Difficulty
+}
+
+// The form computes the SHA-256 of the ASCII strings in JavaScript, since
+// crypto.subtle is only available to the secure origins.
+var powForm = template.Must(template.New("pow").Parse(`<form id="goproxy-challenge" method="POST" action="{{.Action}}">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="nonce" value="">
+<noscript><p>Enable JavaScript to continue.</p></noscript>
+</form>
+<script>
+(function() {
+var K = [0x428a2f98,0x71374491,0xb5c0fbcf,0xe9b5dba5,0x3956c25b,0x59f111f1,0x923f82a4,0xab1c5ed5,
+0xd807aa98,0x12835b01,0x243185be,0x550c7dc3,0x72be5d74,0x80deb1fe,0x9bdc06a7,0xc19bf174,
+0xe49b69c1,0xefbe4786,0x0fc19dc6,0x240ca1cc,0x2de92c6f,0x4a7484aa,0x5cb0a9dc,0x76f988da,
+0x983e5152,0xa831c66d,0xb00327c8,0xbf597fc7,0xc6e00bf3,0xd5a79147,0x06ca6351,0x14292967,
+0x27b70a85,0x2e1b2138,0x4d2c6dfc,0x53380d13,0x650a7354,0x766a0abb,0x81c2c92e,0x92722c85,
+0xa2bfe8a1,0xa81a664b,0xc24b8b70,0xc76c51a3,0xd192e819,0xd6990624,0xf40e3585,0x106aa070,
+0x19a4c116,0x1e376c08,0x2748774c,0x34b0bcb5,0x391c0cb3,0x4ed8aa4a,0x5b9cca4f,0x682e6ff3,
+0x748f82ee,0x78a5636f,0x84c87814,0x8cc70208,0x90befffa,0xa4506ceb,0xbef9a3f7,0xc67178f2];
+function r(x, n) { return (x >>> n) | (x << (32 - n)); }
+// first returns the first 32 bits of the SHA-256 of s.
+function first(s) {
+	var b = [], i, j;
+	for (i = 0; i < s.length; i++) b.push(s.charCodeAt(i) & 255);
+	var l = b.length * 8;
+	b.push(128);
+	while (b.length % 64 != 56) b.push(0);
+	for (i = 7; i >= 0; i--) b.push(i > 3 ? 0 : (l >>> (i * 8)) & 255);
+	var H = [0x6a09e667,0xbb67ae85,0x3c6ef372,0xa54ff53a,0x510e527f,0x9b05688c,0x1f83d9ab,0x5be0cd19];
+	var w = new Array(64);
+	for (j = 0; j < b.length; j += 64) {
+		for (i = 0; i < 16; i++) w[i] = (b[j+4*i] << 24) | (b[j+4*i+1] << 16) | (b[j+4*i+2] << 8) | b[j+4*i+3];
+		for (i = 16; i < 64; i++) {
+			var x = w[i-15], y = w[i-2];
+			w[i] = (w[i-16] + (r(x, 7) ^ r(x, 18) ^ (x >>> 3)) + w[i-7] + (r(y, 17) ^ r(y, 19) ^ (y >>> 10))) | 0;
+		}
+		var a = H[0], c1 = H[1], c = H[2], d = H[3], e = H[4], f = H[5], g = H[6], h = H[7];
+		for (i = 0; i < 64; i++) {
+			var t1 = (h + (r(e, 6) ^ r(e, 11) ^ r(e, 25)) + ((e & f) ^ (~e & g)) + K[i] + w[i]) | 0;
+			var t2 = ((r(a, 2) ^ r(a, 13) ^ r(a, 22)) + ((a & c1) ^ (a & c) ^ (c1 & c))) | 0;
+			h = g; g = f; f = e; e = (d + t1) | 0; d = c; c = c1; c1 = a; a = (t1 + t2) | 0;
+		}
+		H[0] = (H[0] + a) | 0; H[1] = (H[1] + c1) | 0; H[2] = (H[2] + c) | 0; H[3] = (H[3] + d) | 0;
+		H[4] = (H[4] + e) | 0; H[5] = (H[5] + f) | 0; H[6] = (H[6] + g) | 0; H[7] = (H[7] + h) | 0;
+	}
+	return H[0] >>> 0;
+}
+var form = document.getElementById("goproxy-challenge");
+var state = form.elements.state.value, shift = 32 - {{.Difficulty}};
+for (var nonce = 0; ; nonce++) {
+	if (first(state + ":" + nonce) >>> shift === 0) {
+		form.elements.nonce.value = nonce;
+		form.submit();
+		return;
+	}
+}
+})();
+</script>`))
+
+// Form implements Challenge.
+func (p *ProofOfWork) Form(action, state string) template.HTML {
+	var buf bytes.Buffer
+	_ = powForm.Execute(&buf, map[string]any{"Action": action, "State": state, "Difficulty": p.difficulty()})
+	return template.HTML(buf.String())
+}
+
+// Verify implements Challenge.
+func (p *ProofOfWork) Verify(req *http.Request, state string) bool {
+	nonce := req.PostForm.Get("nonce")
+	if _, err := strconv.ParseUint(nonce, 10, 64); err != nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(state + ":" + nonce))
+	return binary.BigEndian.Uint32(sum[:4])>>(32-p.difficulty()) == 0
+}
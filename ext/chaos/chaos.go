@@ -0,0 +1,171 @@
+// Package chaos injects faults in the proxied traffic (latency, dropped
+// connections, truncated bodies, synthetic errors and bandwidth limits), so
+// that the proxy can be used to test the resilience of its clients. An
+// Emulator applies the Profile of a network, such as 3G or a satellite
+// link, to the requests and tunnels of some clients.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ErrDropped is returned by the upstream round trip of a dropped request.
+// It wraps http.ErrAbortHandler, so that the proxy closes the client
+// connection without answering.
+var ErrDropped = fmt.Errorf("chaos: connection dropped: %w", http.ErrAbortHandler)
+
+// errTruncated is returned by a truncated response body.
+var errTruncated = errors.New("chaos: body truncated")
+
+// Fault describes the faults injected in a request. Several faults can be
+// combined, for example a latency followed by a truncated body.
+type Fault struct {
+	// Latency delays the request before it's sent upstream.
+	Latency time.Duration
+	// LatencyJitter adds a random delay between 0 and LatencyJitter.
+	LatencyJitter time.Duration
+	// Drop closes the client connection without any response.
+	Drop bool
+	// Status, when not zero, answers with a synthetic response with this
+	// status code, without contacting the destination.
+	Status int
+	// Truncate cuts the response body after TruncateAfter bytes.
+	Truncate      bool
+	TruncateAfter int64
+	// BytesPerSecond limits the throughput of the response body.
+	BytesPerSecond int
+	// BandwidthJitter varies the throughput randomly by up to this fraction
+	// of BytesPerSecond (between 0 and 1).
+	BandwidthJitter float64
+}
+
+// Rule injects Fault in a Percentage of the requests matching Condition.
+// A nil Condition matches every request.
+type Rule struct {
+	Condition  goproxy.ReqCondition
+	Percentage float64
+	Fault      Fault
+}
+
+// Injector applies the first matching Rule to every request.
+//
+//	injector := &chaos.Injector{Rules: []chaos.Rule{{
+//		Condition:  goproxy.DstHostIs("api.example.com"),
+//		Percentage: 10,
+//		Fault:      chaos.Fault{Status: http.StatusServiceUnavailable},
+//	}}}
+//	proxy.OnRequest().Do(injector)
+type Injector struct {
+	Rules []Rule
+}
+
+func (r *Rule) matches(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	if r.Condition != nil && !r.Condition.HandleReq(req, ctx) {
+		return false
+	}
+	return r.Percentage >= 100 || rand.Float64()*100 < r.Percentage
+}
+
+// Handle implements goproxy.ReqHandler.
+func (i *Injector) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	for _, rule := range i.Rules {
+		if !rule.matches(req, ctx) {
+			continue
+		}
+		return rule.Fault.inject(req, ctx)
+	}
+	return req, nil
+}
+
+func (f Fault) inject(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	ctx.Logf("chaos: injecting fault %+v in %v", f, req.URL)
+	if delay := f.delay(); delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+		}
+	}
+	if f.Status != 0 {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, f.Status, http.StatusText(f.Status))
+	}
+
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		if f.Drop {
+			return nil, ErrDropped
+		}
+		resp, err := next.RoundTrip(req, ctx)
+		if err != nil {
+			return resp, err
+		}
+		if f.Truncate {
+			resp.Body = &truncatedBody{ReadCloser: resp.Body, remaining: f.TruncateAfter}
+		}
+		if f.BytesPerSecond > 0 {
+			resp.Body = &throttledBody{ReadCloser: resp.Body, rate: f.BytesPerSecond, jitter: f.BandwidthJitter}
+		}
+		return resp, nil
+	})
+	return req, nil
+}
+
+func (f Fault) delay() time.Duration {
+	d := f.Latency
+	if f.LatencyJitter > 0 {
+		d += time.Duration(rand.Int63n(int64(f.LatencyJitter)))
+	}
+	return d
+}
+
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (t *truncatedBody) Read(p []byte) (int, error) {
+	if t.remaining <= 0 {
+		return 0, errTruncated
+	}
+	if int64(len(p)) > t.remaining {
+		p = p[:t.remaining]
+	}
+	n, err := t.ReadCloser.Read(p)
+	t.remaining -= int64(n)
+	return n, err
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	rate   int
+	jitter float64
+}
+
+func (t *throttledBody) Read(p []byte) (int, error) {
+	rate := float64(t.rate)
+	if t.jitter > 0 {
+		rate *= 1 + t.jitter*(2*rand.Float64()-1)
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	// Read at most a tenth of second worth of data at once
+	chunk := int(rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.ReadCloser.Read(p)
+	time.Sleep(time.Duration(float64(n) / rate * float64(time.Second)))
+	return n, err
+}
@@ -0,0 +1,108 @@
+package chaos_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/chaos"
+)
+
+func proxyClient(t *testing.T, injector *chaos.Injector) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(injector)
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	u, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+}
+
+func TestFaults(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("a", 100))
+	}))
+	defer background.Close()
+
+	injector := &chaos.Injector{Rules: []chaos.Rule{
+		{Condition: goproxy.UrlHasPrefix("/status"), Percentage: 100, Fault: chaos.Fault{Status: http.StatusBadGateway}},
+		{Condition: goproxy.UrlHasPrefix("/drop"), Percentage: 100, Fault: chaos.Fault{Drop: true}},
+		{Condition: goproxy.UrlHasPrefix("/truncate"), Percentage: 100, Fault: chaos.Fault{Truncate: true, TruncateAfter: 10}},
+		{Condition: goproxy.UrlHasPrefix("/slow"), Percentage: 100, Fault: chaos.Fault{Latency: 100 * time.Millisecond}},
+		{Condition: goproxy.UrlHasPrefix("/never"), Percentage: 0, Fault: chaos.Fault{Drop: true}},
+	}}
+	client := proxyClient(t, injector)
+
+	resp, err := client.Get(background.URL + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected synthetic 502, got %s", resp.Status)
+	}
+
+	if resp, err := client.Get(background.URL + "/drop"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected dropped connection, got %s", resp.Status)
+	}
+
+	resp, err = client.Get(background.URL + "/truncate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(body) != 10 {
+		t.Errorf("Expected 10 bytes, got %d", len(body))
+	}
+
+	start := time.Now()
+	resp, err = client.Get(background.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("Latency wasn't injected")
+	}
+
+	resp, err = client.Get(background.URL + "/never")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(body) != 100 {
+		t.Errorf("Expected untouched response, got %d bytes", len(body))
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("a", 2000))
+	}))
+	defer background.Close()
+
+	client := proxyClient(t, &chaos.Injector{Rules: []chaos.Rule{
+		{Percentage: 100, Fault: chaos.Fault{BytesPerSecond: 10000}},
+	}})
+	start := time.Now()
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(body) != 2000 {
+		t.Errorf("Expected 2000 bytes, got %d", len(body))
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Bandwidth limit not applied, took %v", elapsed)
+	}
+}
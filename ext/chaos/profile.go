@@ -0,0 +1,260 @@
+package chaos
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Profile emulates the conditions of a network between the clients and the
+// proxy.
+type Profile struct {
+	Name string
+	// Latency is the round trip time added to every exchange, plus a random
+	// delay between 0 and Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Downlink and Uplink bound the throughput to and from the clients, in
+	// bytes per second. Zero doesn't limit it.
+	Downlink int
+	Uplink   int
+	// Loss is the fraction of the packets lost. The losses are approximated
+	// by pacing: the transfer stalls for a retransmission timeout.
+	Loss float64
+}
+
+// The emulation profiles of common networks.
+var (
+	Profile2G        = Profile{Name: "2g", Latency: 800 * time.Millisecond, Jitter: 200 * time.Millisecond, Downlink: 30_000, Uplink: 20_000, Loss: 0.01}
+	Profile3G        = Profile{Name: "3g", Latency: 300 * time.Millisecond, Jitter: 100 * time.Millisecond, Downlink: 200_000, Uplink: 96_000}
+	Profile4G        = Profile{Name: "4g", Latency: 70 * time.Millisecond, Jitter: 20 * time.Millisecond, Downlink: 1_500_000, Uplink: 750_000}
+	ProfileFlakyWiFi = Profile{Name: "flaky-wifi", Latency: 40 * time.Millisecond, Jitter: 150 * time.Millisecond, Downlink: 2_500_000, Uplink: 1_250_000, Loss: 0.03}
+	ProfileSatellite = Profile{Name: "satellite", Latency: 600 * time.Millisecond, Jitter: 50 * time.Millisecond, Downlink: 1_000_000, Uplink: 125_000, Loss: 0.01}
+)
+
+// Profiles are the emulation profiles by name.
+var Profiles = map[string]Profile{
+	Profile2G.Name:        Profile2G,
+	Profile3G.Name:        Profile3G,
+	Profile4G.Name:        Profile4G,
+	ProfileFlakyWiFi.Name: ProfileFlakyWiFi,
+	ProfileSatellite.Name: ProfileSatellite,
+}
+
+// packetSize is the size of the packets whose losses are emulated.
+const packetSize = 1460
+
+func (p Profile) latency() time.Duration {
+	d := p.Latency
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return d
+}
+
+func (p Profile) shaper(rate int) *shaper {
+	return &shaper{rate: rate, loss: p.Loss, stall: p.Latency + 200*time.Millisecond}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// shaper paces a transfer at rate, stalling it for the lost packets.
+type shaper struct {
+	rate  int
+	loss  float64
+	stall time.Duration
+}
+
+// limit bounds a transfer to a tenth of second, or a packet when there are
+// losses.
+func (s *shaper) limit(p []byte) []byte {
+	chunk := len(p)
+	if s.rate > 0 && chunk > s.rate/10 {
+		chunk = s.rate / 10
+	}
+	if s.loss > 0 && chunk > packetSize {
+		chunk = packetSize
+	}
+	if chunk < 1 {
+		chunk = 1
+	}
+	return p[:chunk]
+}
+
+// wait paces the transfer of n bytes.
+func (s *shaper) wait(n int) {
+	var d time.Duration
+	if s.rate > 0 {
+		d = time.Duration(float64(n) / float64(s.rate) * float64(time.Second))
+	}
+	if s.loss > 0 && n > 0 && rand.Float64() < s.loss {
+		d += s.stall
+	}
+	time.Sleep(d)
+}
+
+func (s *shaper) active() bool {
+	return s.rate > 0 || s.loss > 0
+}
+
+type shapedBody struct {
+	io.ReadCloser
+	shaper *shaper
+}
+
+func (b *shapedBody) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return b.ReadCloser.Read(p)
+	}
+	n, err := b.ReadCloser.Read(b.shaper.limit(p))
+	b.shaper.wait(n)
+	return n, err
+}
+
+// shapedConn emulates a profile on a tunnel: the reads following writes
+// are delayed by the latency, as the responses to requests.
+type shapedConn struct {
+	net.Conn
+	profile  Profile
+	down, up *shaper
+	wrote    int32
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&c.wrote, 1, 0) {
+		time.Sleep(c.profile.latency())
+	}
+	if len(p) == 0 || !c.down.active() {
+		return c.Conn.Read(p)
+	}
+	n, err := c.Conn.Read(c.down.limit(p))
+	c.down.wait(n)
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	atomic.StoreInt32(&c.wrote, 1)
+	if !c.up.active() {
+		return c.Conn.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := c.up.limit(p)
+		n, err := c.Conn.Write(chunk)
+		written += n
+		c.up.wait(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ProfileRule applies Profile to the requests matching Condition, such as
+// the requests of a client with goproxy.SrcIpIs. A nil Condition matches
+// every request.
+type ProfileRule struct {
+	Condition goproxy.ReqCondition
+	Profile   Profile
+}
+
+// Emulator applies the Profile of the first matching rule to the requests
+// and the tunnels:
+//
+//	emulator := &chaos.Emulator{Rules: []chaos.ProfileRule{
+//		{Condition: goproxy.SrcIpIs("10.0.0.12"), Profile: chaos.Profile3G},
+//		{Condition: goproxy.ReqHostIs("cdn.example.com:443"), Profile: chaos.ProfileSatellite},
+//	}}
+//	proxy.OnRequest().Do(emulator)
+//	proxy.OnRequest().HandleConnect(emulator)
+//
+// The latency is added once per request, half of it before the request is
+// sent upstream and half before its response. The tunnels are shaped by
+// their ctx.Dialer, so the emulator must be the first CONNECT handler, and
+// the proxy must not have a ConnectDial.
+type Emulator struct {
+	Rules []ProfileRule
+}
+
+func (e *Emulator) profile(req *http.Request, ctx *goproxy.ProxyCtx) (Profile, bool) {
+	for _, rule := range e.Rules {
+		if rule.Condition == nil || rule.Condition.HandleReq(req, ctx) {
+			return rule.Profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// Handle implements goproxy.ReqHandler.
+func (e *Emulator) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	p, ok := e.profile(req, ctx)
+	if !ok {
+		return req, nil
+	}
+	ctx.Logf("chaos: emulating %s for %v", p.Name, req.URL)
+	latency := p.latency()
+	sleep(req.Context(), latency/2)
+	if up := p.shaper(p.Uplink); up.active() && req.Body != nil && req.Body != http.NoBody {
+		req.Body = &shapedBody{ReadCloser: req.Body, shaper: up}
+	}
+
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := next.RoundTrip(req, ctx)
+		sleep(req.Context(), latency-latency/2)
+		if err != nil {
+			return resp, err
+		}
+		// The body of the protocol upgrades is the connection.
+		if down := p.shaper(p.Downlink); down.active() && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp.Body = &shapedBody{ReadCloser: resp.Body, shaper: down}
+		}
+		return resp, nil
+	})
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, shaping the tunnels. It
+// leaves the decision on the CONNECT to the next handlers.
+func (e *Emulator) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	p, ok := e.profile(ctx.Req, ctx)
+	if !ok {
+		return nil, host
+	}
+	ctx.Logf("chaos: emulating %s for the tunnel to %s", p.Name, host)
+	dial := ctx.Dialer
+	ctx.Dialer = func(dctx context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if dial != nil {
+			conn, err = dial(dctx, network, addr)
+		} else {
+			var d net.Dialer
+			conn, err = d.DialContext(dctx, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The TCP handshake.
+		sleep(dctx, p.latency())
+		return &shapedConn{Conn: conn, profile: p, down: p.shaper(p.Downlink), up: p.shaper(p.Uplink)}, nil
+	}
+	return nil, host
+}
@@ -0,0 +1,73 @@
+package chaos_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/chaos"
+)
+
+func TestEmulator(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("a", 2000))
+	})
+	background := httptest.NewServer(handler)
+	defer background.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	slow := chaos.Profile{Name: "slow", Latency: 100 * time.Millisecond, Downlink: 10000}
+	emulator := &chaos.Emulator{Rules: []chaos.ProfileRule{
+		{Condition: goproxy.UrlHasPrefix("/slow"), Profile: slow},
+		{Condition: goproxy.ReqHostIs(strings.TrimPrefix(secure.URL, "https://")), Profile: slow},
+	}}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(emulator)
+	proxy.OnRequest().HandleConnect(emulator)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for _, tt := range []struct {
+		url string
+		min time.Duration
+		max time.Duration
+	}{
+		{background.URL + "/fast", 0, 100 * time.Millisecond},
+		// The latency and 2000 bytes at 10000 bytes per second.
+		{background.URL + "/slow", 300 * time.Millisecond, time.Second},
+		// The TCP handshake, the TLS handshake, the request and the body.
+		{secure.URL, 400 * time.Millisecond, 2 * time.Second},
+	} {
+		start := time.Now()
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		elapsed := time.Since(start)
+		if len(body) != 2000 || elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("%s: %d bytes in %v, want between %v and %v", tt.url, len(body), elapsed, tt.min, tt.max)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	for _, name := range []string{"3g", "flaky-wifi", "satellite"} {
+		if p, ok := chaos.Profiles[name]; !ok || p.Latency == 0 || p.Downlink == 0 {
+			t.Errorf("profile %s: %+v", name, p)
+		}
+	}
+}
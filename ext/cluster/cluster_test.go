@@ -0,0 +1,271 @@
+package cluster_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+	"github.com/InsideOutSec/goproxy/ext/cluster"
+	"github.com/InsideOutSec/goproxy/ext/quota"
+)
+
+// fakeRedis serves the few commands used by the package, ignoring the
+// expirations.
+type fakeRedis struct {
+	net.Listener
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]int64
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{Listener: l, strings: make(map[string]string), hashes: make(map[string]map[string]int64)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return r
+}
+
+func (r *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ := br.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:size])
+		}
+		io.WriteString(c, r.do(args))
+	}
+}
+
+func bulk(s string, ok bool) string {
+	if !ok {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (r *fakeRedis) do(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, ok := r.strings[args[1]]
+		return bulk(v, ok)
+	case "SET":
+		if _, ok := r.strings[args[1]]; ok && len(args) > 3 && args[3] == "NX" {
+			return "$-1\r\n"
+		}
+		r.strings[args[1]] = args[2]
+		return "+OK\r\n"
+	case "INCR":
+		n, _ := strconv.ParseInt(r.strings[args[1]], 10, 64)
+		n++
+		r.strings[args[1]] = strconv.FormatInt(n, 10)
+		return fmt.Sprintf(":%d\r\n", n)
+	case "HINCRBY":
+		if r.hashes[args[1]] == nil {
+			r.hashes[args[1]] = make(map[string]int64)
+		}
+		by, _ := strconv.ParseInt(args[3], 10, 64)
+		r.hashes[args[1]][args[2]] += by
+		return fmt.Sprintf(":%d\r\n", r.hashes[args[1]][args[2]])
+	case "HMGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-2)
+		for _, field := range args[2:] {
+			v, ok := r.hashes[args[1]][field]
+			reply += bulk(strconv.FormatInt(v, 10), ok)
+		}
+		return reply
+	case "PEXPIRE", "EXPIREAT":
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestCertStorage(t *testing.T) {
+	redis := newFakeRedis(t)
+	var signed int
+	gen := func() (*tls.Certificate, error) {
+		signed++
+		cert := goproxy.GoproxyCa
+		return &cert, nil
+	}
+	// Two instances, the second reusing the certificate signed by the
+	// first.
+	for i := 0; i < 2; i++ {
+		store := cluster.NewCertStorage(cluster.NewClient(redis.Addr().String()))
+		for j := 0; j < 2; j++ {
+			cert, err := store.Fetch("example.com", gen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cert.Leaf == nil || cert.PrivateKey == nil {
+				t.Fatal("incomplete certificate")
+			}
+		}
+	}
+	if signed != 1 {
+		t.Errorf("%d certificates signed, want 1", signed)
+	}
+}
+
+func TestQuotaStore(t *testing.T) {
+	redis := newFakeRedis(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	// A client of two instances sharing a quota of three requests.
+	var clients []*http.Client
+	for i := 0; i < 2; i++ {
+		q := quota.New(quota.Limit{Period: quota.Daily, Requests: 3})
+		q.Store = cluster.NewQuotaStore(cluster.NewClient(redis.Addr().String()))
+		proxy := goproxy.NewProxyHttpServer()
+		q.Install(proxy)
+		p := httptest.NewServer(proxy)
+		defer p.Close()
+		clients = append(clients, proxyClient(p.URL))
+	}
+	for i, want := range []int{200, 200, 200, 429} {
+		resp, err := clients[i%2].Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status %d, want %d", i, resp.StatusCode, want)
+		}
+	}
+}
+
+func proxyClient(proxyURL string) *http.Client {
+	return &http.Client{Transport: &http.Transport{Proxy: func(*http.Request) (*url.URL, error) {
+		return url.Parse(proxyURL)
+	}}}
+}
+
+func TestRateLimit(t *testing.T) {
+	redis := newFakeRedis(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var clients []*http.Client
+	for i := 0; i < 2; i++ {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.OnRequest().Do(cluster.RateLimit(cluster.NewClient(redis.Addr().String()), quota.UserOrIP, 2, time.Hour))
+		p := httptest.NewServer(proxy)
+		defer p.Close()
+		clients = append(clients, proxyClient(p.URL))
+	}
+	for i, want := range []int{200, 200, 429} {
+		resp, err := clients[i%2].Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("request %d: status %d, want %d", i, resp.StatusCode, want)
+		}
+		if want == 429 && resp.Header.Get("Retry-After") == "" {
+			t.Error("no Retry-After")
+		}
+	}
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(cluster.RateLimit(cluster.NewClient("127.0.0.1:1"), quota.UserOrIP, 0, time.Hour))
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	resp, err := proxyClient(p.URL).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("status %d without Redis, want 200", resp.StatusCode)
+	}
+}
+
+func TestCachedAuthenticator(t *testing.T) {
+	redis := newFakeRedis(t)
+	var verified int
+	basic := &auth.BasicAuthenticator{Realm: "test", Verify: func(user, passwd string) (*goproxy.Identity, error) {
+		verified++
+		if passwd != "secret" {
+			return nil, errors.New("bad password")
+		}
+		return &goproxy.Identity{Name: user, Groups: []string{"staff"}}, nil
+	}}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	good := base64.StdEncoding.EncodeToString([]byte("bob:secret"))
+	bad := base64.StdEncoding.EncodeToString([]byte("bob:wrong"))
+	for i := 0; i < 2; i++ {
+		a := &cluster.CachedAuthenticator{Authenticator: basic, Client: cluster.NewClient(redis.Addr().String())}
+		id, err := a.Authenticate(req, good)
+		if err != nil || id.Name != "bob" || len(id.Groups) != 1 {
+			t.Fatalf("Authenticate = %+v, %v", id, err)
+		}
+		if _, err := a.Authenticate(req, bad); err == nil {
+			t.Fatal("bad password accepted")
+		}
+	}
+	// The failures aren't cached.
+	if verified != 3 {
+		t.Errorf("%d verifications, want 3", verified)
+	}
+}
+
+func TestSticky(t *testing.T) {
+	redis := newFakeRedis(t)
+	a := &cluster.Sticky{Client: cluster.NewClient(redis.Addr().String()), Name: "upstream", TTL: time.Minute}
+	b := &cluster.Sticky{Client: cluster.NewClient(redis.Addr().String()), Name: "upstream", TTL: time.Minute}
+	ctx := context.Background()
+	if got := a.Get(ctx, "10.0.0.1", func() string { return "up1" }); got != "up1" {
+		t.Errorf("first decision %q", got)
+	}
+	if got := b.Get(ctx, "10.0.0.1", func() string { return "up2" }); got != "up1" {
+		t.Errorf("second instance decided %q, want up1", got)
+	}
+}
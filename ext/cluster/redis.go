@@ -0,0 +1,264 @@
+// Package cluster shares the state of several proxy instances behind a load
+// balancer through Redis, so that they behave as one proxy: certificate
+// storage, quota usage, rate-limit counters, authentication caches and
+// sticky decisions.
+//
+//	redis := cluster.NewClient("redis:6379")
+//	proxy.CertStore = cluster.NewCertStorage(redis)
+//	q := quota.New(limits...)
+//	q.Store = cluster.NewQuotaStore(redis)
+//	proxy.OnRequest().Do(cluster.RateLimit(redis, quota.UserOrIP, 100, time.Minute))
+//	basic := &cluster.CachedAuthenticator{Authenticator: ldapBasic, Client: redis}
+//
+// The instances keep working when Redis is unavailable, with their own
+// state: the requests are then allowed and the certificates signed locally.
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply of the Redis server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+var errProtocol = errors.New("redis: protocol error")
+
+// Client is a minimal Redis client, keeping a pool of idle connections.
+type Client struct {
+	Addr     string
+	Password string
+	DB       int
+	// Timeout bounds the dial and every command, 5 seconds by default.
+	Timeout time.Duration
+	// MaxIdle is the number of idle connections kept, 8 by default.
+	MaxIdle int
+	// Prefix is prepended to the keys, "goproxy:" by default.
+	Prefix string
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewClient returns a Client of the Redis server at addr.
+func NewClient(addr string) *Client {
+	return &Client{Addr: addr}
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (c *Client) key(parts ...string) string {
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "goproxy:"
+	}
+	for i, p := range parts {
+		if i > 0 {
+			prefix += ":"
+		}
+		prefix += p
+	}
+	return prefix
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	d := net.Dialer{Timeout: c.timeout()}
+	nc, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.Password != "" {
+		if _, err := c.do(cn, "AUTH", c.Password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.DB != 0 {
+		if _, err := c.do(cn, "SELECT", strconv.Itoa(c.DB)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	maxIdle := c.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 8
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// Do sends a command and returns its reply: a string for the status
+// replies, an int64, a []byte or nil for the bulk replies, or a []any.
+func (c *Client) Do(ctx context.Context, args ...string) (any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = cn.SetDeadline(deadline)
+	reply, err := c.do(cn, args...)
+	var serverErr Error
+	if err != nil && !errors.As(err, &serverErr) {
+		// The connection is in an unknown state.
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+func (c *Client) do(cn *conn, args ...string) (any, error) {
+	fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(cn.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		replies := make([]any, n)
+		for i := range replies {
+			// The errors of the elements are replies too.
+			replies[i], err = readReply(r)
+			var serverErr Error
+			if err != nil && !errors.As(err, &serverErr) {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, errProtocol
+}
+
+// Int returns an integer reply.
+func Int(reply any, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case nil:
+		return 0, nil
+	}
+	return 0, errProtocol
+}
+
+// Bytes returns a bulk reply, nil for a missing key.
+func Bytes(reply any, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, nil
+	}
+	return nil, errProtocol
+}
@@ -0,0 +1,258 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+	"github.com/InsideOutSec/goproxy/ext/quota"
+)
+
+// CertStorage shares the MITM certificates between the instances, so that
+// they're signed once. The certificates are also kept in memory.
+type CertStorage struct {
+	Client *Client
+	// TTL is the lifetime of the certificates in Redis, 30 days by default.
+	TTL time.Duration
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+// NewCertStorage returns a CertStorage of client.
+func NewCertStorage(client *Client) *CertStorage {
+	return &CertStorage{Client: client, certs: make(map[string]*tls.Certificate)}
+}
+
+func encodeCert(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	_ = pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	return buf.Bytes(), nil
+}
+
+func decodeCert(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
+
+// Fetch returns the certificate of hostname, from memory, Redis, or signed
+// by gen. Redis errors fall back to gen.
+func (s *CertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	s.mu.Lock()
+	cert, ok := s.certs[hostname]
+	s.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	ctx := context.Background()
+	key := s.Client.key("cert", hostname)
+	if data, err := Bytes(s.Client.Do(ctx, "GET", key)); err == nil && data != nil {
+		if cert, err = decodeCert(data); err == nil {
+			s.store(hostname, cert)
+			return cert, nil
+		}
+	}
+
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	if data, err := encodeCert(cert); err == nil {
+		ttl := s.TTL
+		if ttl <= 0 {
+			ttl = 30 * 24 * time.Hour
+		}
+		// Another instance may have signed it meanwhile: the first
+		// certificate wins.
+		reply, err := s.Client.Do(ctx, "SET", key, string(data), "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+		if err == nil && reply == nil {
+			if data, err := Bytes(s.Client.Do(ctx, "GET", key)); err == nil && data != nil {
+				if shared, err := decodeCert(data); err == nil {
+					cert = shared
+				}
+			}
+		}
+	}
+	s.store(hostname, cert)
+	return cert, nil
+}
+
+func (s *CertStorage) store(hostname string, cert *tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs[hostname] = cert
+}
+
+// QuotaStore is a quota.Store sharing the usage of the clients.
+type QuotaStore struct {
+	Client *Client
+}
+
+// NewQuotaStore returns a QuotaStore of client.
+func NewQuotaStore(client *Client) *QuotaStore {
+	return &QuotaStore{Client: client}
+}
+
+func (s *QuotaStore) key(client string, p quota.Period, start time.Time) string {
+	return s.Client.key("quota", p.String(), strconv.FormatInt(start.Unix(), 10), client)
+}
+
+// Usage implements quota.Store.
+func (s *QuotaStore) Usage(client string, p quota.Period, start time.Time) (quota.Usage, error) {
+	reply, err := s.Client.Do(context.Background(), "HMGET", s.key(client, p, start), "bytes", "requests")
+	if err != nil {
+		return quota.Usage{}, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return quota.Usage{}, errProtocol
+	}
+	u := quota.Usage{Start: start}
+	if u.Bytes, err = Int(values[0], nil); err != nil {
+		return quota.Usage{}, err
+	}
+	if u.Requests, err = Int(values[1], nil); err != nil {
+		return quota.Usage{}, err
+	}
+	return u, nil
+}
+
+// Add implements quota.Store. The usage expires a day after the end of
+// its period.
+func (s *QuotaStore) Add(client string, p quota.Period, start time.Time, bytes, requests int64) error {
+	ctx := context.Background()
+	key := s.key(client, p, start)
+	if bytes != 0 {
+		if _, err := s.Client.Do(ctx, "HINCRBY", key, "bytes", strconv.FormatInt(bytes, 10)); err != nil {
+			return err
+		}
+	}
+	if requests != 0 {
+		if _, err := s.Client.Do(ctx, "HINCRBY", key, "requests", strconv.FormatInt(requests, 10)); err != nil {
+			return err
+		}
+	}
+	end := start.AddDate(0, 0, 1)
+	if p == quota.Monthly {
+		end = start.AddDate(0, 1, 0)
+	}
+	_, err := s.Client.Do(ctx, "EXPIREAT", key, strconv.FormatInt(end.Add(24*time.Hour).Unix(), 10))
+	return err
+}
+
+// RateLimit answers 429 Too Many Requests to the clients sending more than
+// limit requests in a window, counted by all the instances. The clients are
+// identified by clientKey, such as quota.UserOrIP. The requests are allowed
+// when Redis fails.
+func RateLimit(client *Client, clientKey func(req *http.Request, ctx *goproxy.ProxyCtx) string, limit int64, window time.Duration) goproxy.FuncReqHandler {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		now := time.Now()
+		slot := now.UnixNano() / int64(window)
+		key := client.key("rate", strconv.FormatInt(slot, 10), clientKey(req, ctx))
+		n, err := Int(client.Do(req.Context(), "INCR", key))
+		if err != nil {
+			ctx.Warnf("Cannot count the request rate: %v", err)
+			return req, nil
+		}
+		if n == 1 {
+			_, _ = client.Do(req.Context(), "PEXPIRE", key, strconv.FormatInt(window.Milliseconds(), 10))
+		}
+		if n <= limit {
+			return req, nil
+		}
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, "Too many requests\n")
+		retry := time.Unix(0, (slot+1)*int64(window)).Sub(now)
+		resp.Header.Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		return req, resp
+	}
+}
+
+// CachedAuthenticator caches the identities verified by an Authenticator of
+// a single-legged scheme, such as Basic or Bearer, sparing its backend the
+// credentials already verified by an instance.
+type CachedAuthenticator struct {
+	auth.Authenticator
+	Client *Client
+	// TTL is the lifetime of the cached identities, 5 minutes by default.
+	TTL time.Duration
+}
+
+// Authenticate returns the cached identity of credentials, or verifies
+// them with the Authenticator.
+func (a *CachedAuthenticator) Authenticate(req *http.Request, credentials string) (*goproxy.Identity, error) {
+	h := sha256.Sum256([]byte(a.Scheme() + "\x00" + credentials))
+	key := a.Client.key("auth", hex.EncodeToString(h[:]))
+	if data, err := Bytes(a.Client.Do(req.Context(), "GET", key)); err == nil && data != nil {
+		var id goproxy.Identity
+		if json.Unmarshal(data, &id) == nil {
+			return &id, nil
+		}
+	}
+	id, err := a.Authenticator.Authenticate(req, credentials)
+	if err != nil || id == nil {
+		return id, err
+	}
+	ttl := a.TTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	if data, err := json.Marshal(id); err == nil {
+		_, _ = a.Client.Do(req.Context(), "SET", key, string(data), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	return id, nil
+}
+
+// Sticky shares decisions between the instances, such as the upstream
+// chosen for a client, for TTL after their last use.
+type Sticky struct {
+	Client *Client
+	Name   string
+	TTL    time.Duration
+}
+
+// Get returns the decision of key, or records the one returned by choose.
+// The decision of choose is returned when Redis fails.
+func (s *Sticky) Get(ctx context.Context, key string, choose func() string) string {
+	k := s.Client.key("sticky", s.Name, key)
+	ttl := strconv.FormatInt(s.TTL.Milliseconds(), 10)
+	if data, err := Bytes(s.Client.Do(ctx, "GET", k)); err == nil && data != nil {
+		_, _ = s.Client.Do(ctx, "PEXPIRE", k, ttl)
+		return string(data)
+	}
+	decision := choose()
+	reply, err := s.Client.Do(ctx, "SET", k, decision, "NX", "PX", ttl)
+	if err == nil && reply == nil {
+		// Another instance decided first.
+		if data, err := Bytes(s.Client.Do(ctx, "GET", k)); err == nil && data != nil {
+			return string(data)
+		}
+	}
+	return decision
+}
@@ -0,0 +1,226 @@
+// Package connpool provides per-destination tuning of the upstream
+// connection pool, instead of sharing a single http.Transport between
+// every host reached through the proxy.
+package connpool
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// HostConfig overrides the base transport settings for a single host.
+// Zero values keep the setting of the base transport.
+type HostConfig struct {
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ExpectContinueTimeout time.Duration
+}
+
+type hostTransport struct {
+	tr *http.Transport
+	// warm holds the prewarmed connections by address (host:port), at most
+	// size of each.
+	mu   sync.Mutex
+	size int
+	warm map[string]chan net.Conn
+}
+
+// warmConns returns the prewarmed connections of addr.
+func (ht *hostTransport) warmConns(addr string) chan net.Conn {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	c, ok := ht.warm[addr]
+	if !ok {
+		c = make(chan net.Conn, ht.size)
+		ht.warm[addr] = c
+	}
+	return c
+}
+
+// Pool is a RoundTripper that keeps a dedicated http.Transport for every
+// destination host, configured from the base transport and the optional
+// HostConfig override of that host.
+type Pool struct {
+	base *http.Transport
+
+	mu      sync.Mutex
+	configs map[string]HostConfig
+	hosts   map[string]*hostTransport
+}
+
+// NewPool creates a Pool whose transports are cloned from base.
+// If base is nil, http.DefaultTransport is used.
+func NewPool(base *http.Transport) *Pool {
+	if base == nil {
+		base, _ = http.DefaultTransport.(*http.Transport)
+	}
+	return &Pool{
+		base:    base,
+		configs: make(map[string]HostConfig),
+		hosts:   make(map[string]*hostTransport),
+	}
+}
+
+// SetHostConfig sets the override used for hostname (without port).
+// The pooled connections of hostname are flushed, so that the new settings
+// apply to the following requests.
+func (p *Pool) SetHostConfig(hostname string, cfg HostConfig) {
+	p.mu.Lock()
+	p.configs[hostname] = cfg
+	p.mu.Unlock()
+	p.Flush(hostname)
+}
+
+func (p *Pool) newHostTransport(hostname string) *hostTransport {
+	ht := &hostTransport{tr: p.base.Clone()}
+	if cfg, ok := p.configs[hostname]; ok {
+		if cfg.MaxIdleConnsPerHost > 0 {
+			ht.tr.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		}
+		if cfg.IdleConnTimeout > 0 {
+			ht.tr.IdleConnTimeout = cfg.IdleConnTimeout
+		}
+		if cfg.TLSHandshakeTimeout > 0 {
+			ht.tr.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+		}
+		if cfg.ExpectContinueTimeout > 0 {
+			ht.tr.ExpectContinueTimeout = cfg.ExpectContinueTimeout
+		}
+	}
+	ht.size = ht.tr.MaxIdleConnsPerHost
+	if ht.size <= 0 {
+		ht.size = http.DefaultMaxIdleConnsPerHost
+	}
+	ht.warm = make(map[string]chan net.Conn)
+
+	dial := p.base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	ht.tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// The connections are prewarmed with TCP, to the address dialed.
+		if network == "tcp" {
+			select {
+			case c := <-ht.warmConns(addr):
+				return c, nil
+			default:
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+	return ht
+}
+
+func (p *Pool) hostTransport(hostname string) *hostTransport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ht, ok := p.hosts[hostname]
+	if !ok {
+		ht = p.newHostTransport(hostname)
+		p.hosts[hostname] = ht
+	}
+	return ht
+}
+
+// Transport returns the transport used for hostname.
+func (p *Pool) Transport(hostname string) *http.Transport {
+	return p.hostTransport(hostname).tr
+}
+
+// RoundTrip implements goproxy.RoundTripper.
+func (p *Pool) RoundTrip(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+	return p.Transport(req.URL.Hostname()).RoundTrip(req)
+}
+
+// Prewarm opens n TCP connections to addr (host:port) in advance, so that
+// the next requests to that address don't pay the connection setup latency.
+// The other ports of the host dial their own connections.
+// Connections beyond the idle capacity of the host are not opened.
+func (p *Pool) Prewarm(ctx context.Context, addr string, n int) error {
+	hostname, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ht := p.hostTransport(hostname)
+	dial := p.base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	for i := 0; i < n; i++ {
+		c, err := dial(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		select {
+		case ht.warmConns(addr) <- c:
+		default:
+			_ = c.Close()
+			return nil
+		}
+	}
+	return nil
+}
+
+// Flush closes the pooled connections of hostname, both idle and prewarmed,
+// and discards its transport.
+func (p *Pool) Flush(hostname string) {
+	p.mu.Lock()
+	ht, ok := p.hosts[hostname]
+	delete(p.hosts, hostname)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	ht.tr.CloseIdleConnections()
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	for _, warm := range ht.warm {
+		closeWarm(warm)
+	}
+}
+
+func closeWarm(warm chan net.Conn) {
+	for {
+		select {
+		case c := <-warm:
+			_ = c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// HTTPTransport returns the pool as an http.RoundTripper, sending the
+// requests with the transport of their host.
+func (p *Pool) HTTPTransport() http.RoundTripper {
+	return poolTransport{p}
+}
+
+type poolTransport struct {
+	p *Pool
+}
+
+func (t poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.p.Transport(req.URL.Hostname()).RoundTrip(req)
+}
+
+// Handler returns a ReqHandler that sends the requests upstream through the
+// pool, as their ctx.Transport: the RoundTrippers of the other handlers
+// are kept, ending with the pool.
+//
+//	pool := connpool.NewPool(proxy.Tr)
+//	pool.SetHostConfig("api.example.com", connpool.HostConfig{MaxIdleConnsPerHost: 64})
+//	proxy.OnRequest().Do(pool.Handler())
+func (p *Pool) Handler() goproxy.ReqHandler {
+	t := p.HTTPTransport()
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Transport = t
+		return req, nil
+	})
+}
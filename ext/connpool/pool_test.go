@@ -0,0 +1,117 @@
+package connpool_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/connpool"
+)
+
+func TestHostConfig(t *testing.T) {
+	pool := connpool.NewPool(&http.Transport{MaxIdleConnsPerHost: 2})
+	pool.SetHostConfig("example.com", connpool.HostConfig{
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     time.Second,
+	})
+
+	if tr := pool.Transport("example.com"); tr.MaxIdleConnsPerHost != 10 || tr.IdleConnTimeout != time.Second {
+		t.Errorf("Override not applied: %d %v", tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+	if tr := pool.Transport("example.org"); tr.MaxIdleConnsPerHost != 2 {
+		t.Errorf("Expected base setting for other hosts, got %d", tr.MaxIdleConnsPerHost)
+	}
+}
+
+func TestPrewarmAndFlush(t *testing.T) {
+	var accepted int32
+	background := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	background.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&accepted, 1)
+		}
+	}
+	background.Start()
+	defer background.Close()
+
+	pool := connpool.NewPool(&http.Transport{})
+	addr := background.Listener.Addr().String()
+	if err := pool.Prewarm(context.Background(), addr, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	var wrapped int32
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			atomic.AddInt32(&wrapped, 1)
+			return ctx.UpstreamRoundTrip(req)
+		})
+		return req, nil
+	})
+	proxy.OnRequest().Do(pool.Handler())
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("Expected the prewarmed connection to be reused, got %d connections", n)
+	}
+	if atomic.LoadInt32(&wrapped) != 1 {
+		t.Errorf("Expected the RoundTripper of the previous handler to be kept")
+	}
+	pool.Flush("127.0.0.1")
+}
+
+func TestPrewarmOtherPort(t *testing.T) {
+	var accepted int32
+	background := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	background.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&accepted, 1)
+		}
+	}
+	background.Start()
+	defer background.Close()
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	pool := connpool.NewPool(&http.Transport{})
+	if err := pool.Prewarm(context.Background(), other.Addr().String(), 1); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, background.URL, nil)
+	resp, err := pool.Transport("127.0.0.1").RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("Expected the connection prewarmed to another port not to be used, got %d connections", n)
+	}
+	pool.Flush("127.0.0.1")
+}
@@ -0,0 +1,72 @@
+// Package conntable serves the connection table of a proxy on its
+// administration listener, to operate the long-lived tunnels:
+//
+//	l, _ := net.Listen("tcp", ":8080")
+//	go http.Serve(proxy.TrackListener(l), proxy)
+//	admin.Handle("/conns", conntable.Handler(proxy))
+//	admin.Handle("/conns/", conntable.Handler(proxy))
+//
+// GET /conns lists the client connections in JSON, filtered by the kind,
+// user, target and min_idle query parameters, such as
+// /conns?kind=tunnel&min_idle=1h. DELETE /conns/<id> terminates a
+// connection.
+package conntable
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Handler returns the administration API of the connection table of proxy.
+// It shouldn't be exposed to the proxy users.
+func Handler(proxy *goproxy.ProxyHttpServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list(proxy, w, r)
+		case http.MethodDelete:
+			id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid connection id", http.StatusBadRequest)
+				return
+			}
+			if err := proxy.CloseConn(id); errors.Is(err, goproxy.ErrUnknownConn) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func list(proxy *goproxy.ProxyHttpServer, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var minIdle time.Duration
+	if s := q.Get("min_idle"); s != "" {
+		var err error
+		if minIdle, err = time.ParseDuration(s); err != nil {
+			http.Error(w, "invalid min_idle", http.StatusBadRequest)
+			return
+		}
+	}
+	conns := []goproxy.ConnInfo{}
+	for _, c := range proxy.Conns() {
+		if (q.Has("kind") && c.Kind != q.Get("kind")) ||
+			(q.Has("user") && c.User != q.Get("user")) ||
+			(q.Has("target") && c.Target != q.Get("target")) ||
+			c.Idle < minIdle {
+			continue
+		}
+		conns = append(conns, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(conns)
+}
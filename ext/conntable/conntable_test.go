@@ -0,0 +1,76 @@
+package conntable_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/conntable"
+)
+
+func TestHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	s := httptest.NewUnstartedServer(proxy)
+	s.Listener = proxy.TrackListener(s.Listener)
+	s.Start()
+	defer s.Close()
+	admin := httptest.NewServer(conntable.Handler(proxy))
+	defer admin.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	target := upstream.Listener.Addr().String()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	buf := bufio.NewReader(c)
+	if resp, err := http.ReadResponse(buf, nil); err != nil || resp.StatusCode != 200 {
+		t.Fatal(resp, err)
+	}
+
+	list := func(query string) []goproxy.ConnInfo {
+		resp, err := http.Get(admin.URL + "/conns" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var conns []goproxy.ConnInfo
+		if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+			t.Fatal(err)
+		}
+		return conns
+	}
+	conns := list("?kind=tunnel")
+	if len(conns) != 1 || conns[0].Target != target {
+		t.Fatalf("tunnels %+v", conns)
+	}
+	if conns := list("?kind=http"); len(conns) != 0 {
+		t.Errorf("http connections %+v", conns)
+	}
+	if conns := list("?min_idle=1h"); len(conns) != 0 {
+		t.Errorf("idle connections %+v", conns)
+	}
+
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/conns/%d", admin.URL, conns[0].ID), nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("DELETE: %d, want %d", resp.StatusCode, want)
+		}
+	}
+	if _, err := buf.ReadByte(); err == nil {
+		t.Error("tunnel still open")
+	}
+}
@@ -0,0 +1,261 @@
+// Package controlplane distributes the configuration of a fleet of proxy
+// instances. Each instance polls a central source for signed policy
+// bundles, and applies them atomically:
+//
+//	var acls controlplane.Value[ACLs]
+//	poller := controlplane.New(&controlplane.HTTPSource{URL: "https://control/bundle"}, publicKey)
+//	poller.Handle("acls", acls.Applier())
+//	poller.Handle("rewrites", rewriteApplier)
+//	go poller.Run(ctx)
+//	admin.Handle("/controlplane", poller.Handler())
+//
+// A bundle is a JSON object of named sections, each decoded by the Applier
+// of its name. All the sections are decoded before any is applied, so that
+// a bundle is applied entirely or not at all. The bundles are signed with
+// ed25519, and a bundle older than the applied one is refused, so that a
+// compromised source can't roll the instances back.
+//
+// The sources are an HTTP endpoint, such as an S3 presigned or public
+// object URL, and a Consul key, watched with blocking queries.
+package controlplane
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errSignature = errors.New("controlplane: invalid bundle signature")
+	errRollback  = errors.New("controlplane: bundle older than the applied one")
+)
+
+// Bundle is a policy bundle.
+type Bundle struct {
+	// Version must increase with every bundle.
+	Version int64 `json:"version"`
+	// Sections are the configurations of the appliers, by name.
+	Sections map[string]json.RawMessage `json:"sections"`
+}
+
+// envelope is the signed form of a Bundle.
+type envelope struct {
+	Bundle    []byte `json:"bundle"`
+	Signature []byte `json:"signature"`
+}
+
+// Sign returns the signed form of a bundle, as served by the sources.
+func Sign(b *Bundle, key ed25519.PrivateKey) ([]byte, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{Bundle: data, Signature: ed25519.Sign(key, data)})
+}
+
+// Open verifies a signed bundle with any of keys, and decodes it.
+func Open(data []byte, keys ...ed25519.PublicKey) (*Bundle, error) {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, e.Bundle, e.Signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errSignature
+	}
+	var b Bundle
+	if err := json.Unmarshal(e.Bundle, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Applier decodes a section of the bundles, and returns the function
+// switching to the decoded configuration. It is called once all the
+// sections are decoded.
+type Applier func(section json.RawMessage) (commit func(), err error)
+
+// Value is a configuration of type T, replaced by the bundles.
+type Value[T any] struct {
+	p atomic.Pointer[T]
+}
+
+// Load returns the current configuration, nil before the first bundle.
+func (v *Value[T]) Load() *T {
+	return v.p.Load()
+}
+
+// Store replaces the configuration.
+func (v *Value[T]) Store(c *T) {
+	v.p.Store(c)
+}
+
+// Applier returns the Applier decoding the sections into a new T.
+func (v *Value[T]) Applier() Applier {
+	return func(section json.RawMessage) (func(), error) {
+		c := new(T)
+		if err := json.Unmarshal(section, c); err != nil {
+			return nil, err
+		}
+		return func() { v.Store(c) }, nil
+	}
+}
+
+// Status is the state of a Poller, served by its Handler.
+type Status struct {
+	// Version is the version of the applied bundle, 0 before the first.
+	Version int64     `json:"version"`
+	Applied time.Time `json:"applied"`
+	Checked time.Time `json:"checked"`
+	// Error is the error of the last poll, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Poller polls a Source for bundles.
+type Poller struct {
+	Source Source
+	// Keys are the public keys verifying the bundles, several during a key
+	// rotation.
+	Keys []ed25519.PublicKey
+	// Interval is the delay between the start of the polls, 30 seconds by
+	// default. The sources blocking until a change for longer are polled
+	// again immediately.
+	Interval time.Duration
+	// OnApply, when set, is called with the applied bundles.
+	OnApply func(*Bundle)
+	// OnError, when set, is called with the polling errors.
+	OnError func(error)
+
+	mu       sync.Mutex
+	appliers map[string]Applier
+	tag      string
+	status   Status
+}
+
+// New returns a Poller of source, verifying the bundles with keys.
+func New(source Source, keys ...ed25519.PublicKey) *Poller {
+	return &Poller{Source: source, Keys: keys, appliers: make(map[string]Applier)}
+}
+
+// Handle sets the Applier of the sections called name. The configurations
+// of the sections missing from a bundle are kept.
+func (p *Poller) Handle(name string, a Applier) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.appliers == nil {
+		p.appliers = make(map[string]Applier)
+	}
+	p.appliers[name] = a
+}
+
+// Status returns the status of the poller.
+func (p *Poller) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Apply verifies and applies a signed bundle.
+func (p *Poller) Apply(data []byte) error {
+	b, err := Open(data, p.Keys...)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b.Version < p.status.Version {
+		return errRollback
+	}
+	if b.Version == p.status.Version && !p.status.Applied.IsZero() {
+		return nil
+	}
+	names := make([]string, 0, len(b.Sections))
+	for name := range b.Sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	commits := make([]func(), 0, len(names))
+	for _, name := range names {
+		a, ok := p.appliers[name]
+		if !ok {
+			// Sections of newer instances, or of other applications.
+			continue
+		}
+		commit, err := a(b.Sections[name])
+		if err != nil {
+			return fmt.Errorf("controlplane: section %s of version %d: %w", name, b.Version, err)
+		}
+		commits = append(commits, commit)
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	p.status.Version = b.Version
+	p.status.Applied = time.Now()
+	if p.OnApply != nil {
+		p.OnApply(b)
+	}
+	return nil
+}
+
+// Poll fetches the bundle once, and applies it if it changed.
+func (p *Poller) Poll(ctx context.Context) error {
+	p.mu.Lock()
+	tag := p.tag
+	p.mu.Unlock()
+	data, tag, err := p.Source.Fetch(ctx, tag)
+	if err == nil && data != nil {
+		err = p.Apply(data)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Checked = time.Now()
+	p.status.Error = ""
+	if err != nil {
+		p.status.Error = err.Error()
+		return err
+	}
+	p.tag = tag
+	return nil
+}
+
+// Run polls the source until ctx is done.
+func (p *Poller) Run(ctx context.Context) {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	for {
+		start := time.Now()
+		if err := p.Poll(ctx); err != nil && ctx.Err() == nil && p.OnError != nil {
+			p.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval - time.Since(start)):
+		}
+	}
+}
+
+// Handler returns the administration API reporting the Status. It
+// shouldn't be exposed to the proxy users.
+func (p *Poller) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Status())
+	})
+}
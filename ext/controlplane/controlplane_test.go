@@ -0,0 +1,163 @@
+package controlplane_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy/ext/controlplane"
+)
+
+type acls struct {
+	Deny []string `json:"deny"`
+}
+
+type rewrites struct {
+	Rules map[string]string `json:"rules"`
+}
+
+// server serves the bundles a test publishes, with their ETag.
+type server struct {
+	mu      sync.Mutex
+	data    []byte
+	version int
+}
+
+func (s *server) publish(t *testing.T, key ed25519.PrivateKey, b *controlplane.Bundle) {
+	data, err := controlplane.Sign(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = data
+	s.version++
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	etag := `"` + strconv.Itoa(s.version) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Write(s.data)
+}
+
+func TestPoller(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	srv := &server{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	var a controlplane.Value[acls]
+	var rw controlplane.Value[rewrites]
+	poller := controlplane.New(&controlplane.HTTPSource{URL: ts.URL}, pub)
+	poller.Handle("acls", a.Applier())
+	poller.Handle("rewrites", rw.Applier())
+	ctx := context.Background()
+
+	srv.publish(t, priv, &controlplane.Bundle{Version: 2, Sections: map[string]json.RawMessage{
+		"acls":     json.RawMessage(`{"deny":["evil.com"]}`),
+		"rewrites": json.RawMessage(`{"rules":{"a":"b"}}`),
+		"unknown":  json.RawMessage(`42`),
+	}})
+	if err := poller.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.Load() == nil || a.Load().Deny[0] != "evil.com" || rw.Load().Rules["a"] != "b" {
+		t.Fatalf("bundle not applied: %+v %+v", a.Load(), rw.Load())
+	}
+	// Unchanged bundles aren't downloaded again.
+	if err := poller.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		key  ed25519.PrivateKey
+		b    *controlplane.Bundle
+	}{
+		{"invalid section", priv, &controlplane.Bundle{Version: 3, Sections: map[string]json.RawMessage{
+			"acls":     json.RawMessage(`{"deny":["other.com"]}`),
+			"rewrites": json.RawMessage(`{"rules":[]}`),
+		}}},
+		{"rollback", priv, &controlplane.Bundle{Version: 1, Sections: map[string]json.RawMessage{
+			"acls": json.RawMessage(`{"deny":["other.com"]}`),
+		}}},
+		{"unknown key", other, &controlplane.Bundle{Version: 4, Sections: map[string]json.RawMessage{
+			"acls": json.RawMessage(`{"deny":["other.com"]}`),
+		}}},
+	} {
+		srv.publish(t, tt.key, tt.b)
+		if err := poller.Poll(ctx); err == nil {
+			t.Errorf("%s: bundle accepted", tt.name)
+		}
+		if a.Load().Deny[0] != "evil.com" {
+			t.Errorf("%s: bundle partially applied", tt.name)
+		}
+	}
+
+	// The sections missing from a bundle keep their configuration.
+	srv.publish(t, priv, &controlplane.Bundle{Version: 5, Sections: map[string]json.RawMessage{
+		"acls": json.RawMessage(`{"deny":[]}`),
+	}})
+	if err := poller.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Load().Deny) != 0 || rw.Load().Rules["a"] != "b" {
+		t.Errorf("version 5 not applied: %+v %+v", a.Load(), rw.Load())
+	}
+
+	rec := httptest.NewRecorder()
+	poller.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var status controlplane.Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != 5 || status.Error != "" || status.Applied.IsZero() {
+		t.Errorf("status %+v", status)
+	}
+}
+
+func TestConsulSource(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	data, _ := controlplane.Sign(&controlplane.Bundle{Version: 1, Sections: map[string]json.RawMessage{
+		"acls": json.RawMessage(`{"deny":["evil.com"]}`),
+	}}, priv)
+	var lastIndex string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/goproxy/bundle" || r.Header.Get("X-Consul-Token") != "token" {
+			http.NotFound(w, r)
+			return
+		}
+		lastIndex = r.URL.Query().Get("index")
+		w.Header().Set("X-Consul-Index", "7")
+		w.Write(data)
+	}))
+	defer ts.Close()
+
+	var a controlplane.Value[acls]
+	poller := controlplane.New(&controlplane.ConsulSource{Addr: ts.URL, Key: "goproxy/bundle", Token: "token"}, pub)
+	poller.Handle("acls", a.Applier())
+	for i := 0; i < 2; i++ {
+		if err := poller.Poll(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.Load() == nil || a.Load().Deny[0] != "evil.com" {
+		t.Errorf("bundle not applied")
+	}
+	if lastIndex != "7" {
+		t.Errorf("blocking query on index %q, want 7", lastIndex)
+	}
+}
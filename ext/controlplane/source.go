@@ -0,0 +1,129 @@
+package controlplane
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Source serves the signed bundles.
+type Source interface {
+	// Fetch returns the signed bundle and its tag, or nil if it hasn't
+	// changed since the fetch of tag, "" for the first fetch.
+	Fetch(ctx context.Context, tag string) (data []byte, newTag string, err error)
+}
+
+func get(ctx context.Context, client *http.Client, u string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// maxBundle bounds the size of the bundles.
+const maxBundle = 64 << 20
+
+func readBundle(resp *http.Response) ([]byte, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("controlplane: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxBundle))
+}
+
+// HTTPSource fetches the bundle at URL, with a conditional request on its
+// ETag. It serves the objects of S3 and the like through public or
+// presigned URLs.
+type HTTPSource struct {
+	URL string
+	// Header is added to the requests, for example an Authorization.
+	Header http.Header
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Fetch implements Source.
+func (s *HTTPSource) Fetch(ctx context.Context, tag string) ([]byte, string, error) {
+	header := s.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if tag != "" {
+		header.Set("If-None-Match", tag)
+	}
+	resp, err := get(ctx, s.Client, s.URL, header)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, tag, nil
+	}
+	data, err := readBundle(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// ConsulSource watches the bundle stored in a Consul key, with blocking
+// queries.
+type ConsulSource struct {
+	// Addr is the URL of the Consul agent, http://127.0.0.1:8500 by default.
+	Addr  string
+	Key   string
+	Token string
+	// Wait bounds a blocking query, 5 minutes by default.
+	Wait time.Duration
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Fetch implements Source. The tag is the modification index of the key.
+func (s *ConsulSource) Fetch(ctx context.Context, tag string) ([]byte, string, error) {
+	addr := s.Addr
+	if addr == "" {
+		addr = "http://127.0.0.1:8500"
+	}
+	wait := s.Wait
+	if wait <= 0 {
+		wait = 5 * time.Minute
+	}
+	q := url.Values{"raw": {""}, "wait": {fmt.Sprintf("%ds", int(wait.Seconds()))}}
+	if tag != "" {
+		q.Set("index", tag)
+	}
+	u := strings.TrimSuffix(addr, "/") + "/v1/kv/" + strings.TrimPrefix(s.Key, "/") + "?" + q.Encode()
+	header := make(http.Header)
+	if s.Token != "" {
+		header.Set("X-Consul-Token", s.Token)
+	}
+	resp, err := get(ctx, s.Client, u, header)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	index := resp.Header.Get("X-Consul-Index")
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, index, nil
+	}
+	data, err := readBundle(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	if index != "" && index == tag {
+		// The blocking query timed out.
+		return nil, tag, nil
+	}
+	return data, index, nil
+}
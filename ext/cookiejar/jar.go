@@ -0,0 +1,201 @@
+// Package cookiejar manages cookies on behalf of the proxy clients, which is
+// useful for cookie-less clients like command line tools and scripts.
+// Every client gets its own isolated jar.
+package cookiejar
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Entry is a cookie stored in a Jar.
+type Entry struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"httpOnly,omitempty"`
+	// HostOnly cookies are sent only to the exact Domain, not to its subdomains.
+	HostOnly bool `json:"hostOnly,omitempty"`
+}
+
+func (e *Entry) key() string {
+	return e.Domain + ";" + e.Path + ";" + e.Name
+}
+
+func (e *Entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !e.Expires.After(now)
+}
+
+// Jar is an http.CookieJar whose content can be inspected and persisted.
+type Jar struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+var _ http.CookieJar = (*Jar)(nil)
+
+func newJar() *Jar {
+	return &Jar{entries: make(map[string]Entry)}
+}
+
+func canonicalHost(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	return strings.TrimSuffix(host, ".")
+}
+
+func defaultPath(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" || p[0] != '/' {
+		return "/"
+	}
+	if i := strings.LastIndex(p, "/"); i > 0 {
+		return p[:i]
+	}
+	return "/"
+}
+
+// SetCookies implements http.CookieJar.
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	host := canonicalHost(u)
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		e := Entry{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+		if e.Path == "" || e.Path[0] != '/' {
+			e.Path = defaultPath(u)
+		}
+		domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+		switch {
+		case domain == "" || net.ParseIP(host) != nil:
+			e.Domain, e.HostOnly = host, true
+		case domain != host && !strings.HasSuffix(host, "."+domain):
+			// A server can't set cookies for an unrelated domain
+			continue
+		default:
+			// Refuse cookies spanning a whole public suffix, like .co.uk
+			if ps, _ := publicsuffix.PublicSuffix(domain); ps == domain {
+				if domain != host {
+					continue
+				}
+				e.HostOnly = true
+			}
+			e.Domain = domain
+		}
+		switch {
+		case c.MaxAge < 0:
+			e.Expires = now
+		case c.MaxAge > 0:
+			e.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			e.Expires = c.Expires
+		}
+		if e.expired(now) {
+			delete(j.entries, e.key())
+			continue
+		}
+		j.entries[e.key()] = e
+	}
+}
+
+func pathMatch(requestPath, cookiePath string) bool {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+	if requestPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(requestPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || requestPath[len(cookiePath)] == '/'
+}
+
+// Cookies implements http.CookieJar.
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	host := canonicalHost(u)
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var matches []Entry
+	for k, e := range j.entries {
+		if e.expired(now) {
+			delete(j.entries, k)
+			continue
+		}
+		if e.Secure && !secure {
+			continue
+		}
+		if e.HostOnly && host != e.Domain {
+			continue
+		}
+		if !e.HostOnly && host != e.Domain && !strings.HasSuffix(host, "."+e.Domain) {
+			continue
+		}
+		if !pathMatch(u.EscapedPath(), e.Path) {
+			continue
+		}
+		matches = append(matches, e)
+	}
+	// RFC 6265: cookies with longer paths are listed first
+	sort.Slice(matches, func(a, b int) bool {
+		if len(matches[a].Path) != len(matches[b].Path) {
+			return len(matches[a].Path) > len(matches[b].Path)
+		}
+		return matches[a].Name < matches[b].Name
+	})
+	cookies := make([]*http.Cookie, 0, len(matches))
+	for _, e := range matches {
+		cookies = append(cookies, &http.Cookie{Name: e.Name, Value: e.Value})
+	}
+	return cookies
+}
+
+// Entries returns the cookies currently stored in the jar.
+func (j *Jar) Entries() []Entry {
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := make([]Entry, 0, len(j.entries))
+	for _, e := range j.entries {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].key() < entries[b].key() })
+	return entries
+}
+
+// Clear removes all the cookies of the jar.
+func (j *Jar) Clear() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = make(map[string]Entry)
+}
+
+func (j *Jar) load(entries []Entry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range entries {
+		j.entries[e.key()] = e
+	}
+}
@@ -0,0 +1,109 @@
+package cookiejar_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/cookiejar"
+)
+
+func TestJarDomainRules(t *testing.T) {
+	jar := cookiejar.NewManager().Jar("client")
+	u, _ := url.Parse("https://www.example.com/a/b")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "other", Value: "3", Domain: "other.com"},
+		{Name: "suffix", Value: "4", Domain: "com"},
+		{Name: "secure", Value: "5", Secure: true},
+	})
+
+	names := func(raw string) map[string]bool {
+		u, _ := url.Parse(raw)
+		m := map[string]bool{}
+		for _, c := range jar.Cookies(u) {
+			m[c.Name] = true
+		}
+		return m
+	}
+	if got := names("https://www.example.com/a/c"); !got["host"] || !got["domain"] || !got["secure"] || len(got) != 3 {
+		t.Errorf("Unexpected cookies %v", got)
+	}
+	if got := names("http://api.example.com/"); !got["domain"] || len(got) != 1 {
+		t.Errorf("Unexpected cookies for subdomain %v", got)
+	}
+	if got := names("https://www.example.com/x"); got["host"] {
+		t.Error("Cookie path not honored")
+	}
+}
+
+func TestManagerProxy(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+			return
+		}
+		c, err := r.Cookie("session")
+		if err != nil {
+			_, _ = io.WriteString(w, "anonymous")
+			return
+		}
+		_, _ = io.WriteString(w, c.Value)
+	}))
+	defer background.Close()
+
+	m := cookiejar.NewManager()
+	proxy := goproxy.NewProxyHttpServer()
+	m.Install(proxy)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(background.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Set-Cookie") != "" {
+		t.Error("Set-Cookie should be hidden from the client")
+	}
+
+	resp, err = client.Get(background.URL + "/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "abc" {
+		t.Errorf("Expected the managed session cookie, got %q", body)
+	}
+
+	var saved bytes.Buffer
+	if err := m.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	restored := cookiejar.NewManager()
+	if err := restored.Load(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if clients := restored.Clients(); len(clients) != 1 || len(restored.Jar(clients[0]).Entries()) != 1 {
+		t.Errorf("Jars not restored: %v", clients)
+	}
+
+	m.Jar(m.Clients()[0]).Clear()
+	resp, err = client.Get(background.URL + "/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "anonymous" {
+		t.Errorf("Expected no cookie after clear, got %q", body)
+	}
+}
@@ -0,0 +1,123 @@
+package cookiejar
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Manager keeps a cookie Jar for every proxy client.
+type Manager struct {
+	// ClientKey identifies the client of a request, the client IP address
+	// by default. It can be replaced to use an authenticated user name.
+	ClientKey func(req *http.Request, ctx *goproxy.ProxyCtx) string
+	// KeepSetCookie, if true, still forwards the Set-Cookie headers to the
+	// clients, instead of hiding the cookies managed by the proxy.
+	KeepSetCookie bool
+
+	mu   sync.Mutex
+	jars map[string]*Jar
+}
+
+// NewManager creates an empty Manager.
+func NewManager() *Manager {
+	return &Manager{ClientKey: ClientIP, jars: make(map[string]*Jar)}
+}
+
+// ClientIP returns the IP address of the client that sent req.
+func ClientIP(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// Jar returns the jar of client, creating it if needed.
+func (m *Manager) Jar(client string) *Jar {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jars[client]
+	if !ok {
+		j = newJar()
+		m.jars[client] = j
+	}
+	return j
+}
+
+// Clients returns the clients having a jar.
+func (m *Manager) Clients() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clients := make([]string, 0, len(m.jars))
+	for c := range m.jars {
+		clients = append(clients, c)
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// Delete removes the jar of client.
+func (m *Manager) Delete(client string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.jars, client)
+}
+
+// Save writes the content of all the jars to w, as JSON.
+func (m *Manager) Save(w io.Writer) error {
+	state := make(map[string][]Entry)
+	for _, client := range m.Clients() {
+		state[client] = m.Jar(client).Entries()
+	}
+	return json.NewEncoder(w).Encode(state)
+}
+
+// Load adds the jars previously written by Save.
+func (m *Manager) Load(r io.Reader) error {
+	var state map[string][]Entry
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	for client, entries := range state {
+		m.Jar(client).load(entries)
+	}
+	return nil
+}
+
+// OnRequest adds the cookies of the client jar to the request.
+func (m *Manager) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	jar := m.Jar(m.ClientKey(req, ctx))
+	for _, c := range jar.Cookies(req.URL) {
+		if _, err := req.Cookie(c.Name); err == nil {
+			// The client value wins
+			continue
+		}
+		req.AddCookie(c)
+	}
+	return req, nil
+}
+
+// OnResponse stores the cookies set by the response in the client jar.
+func (m *Manager) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		m.Jar(m.ClientKey(ctx.Req, ctx)).SetCookies(ctx.Req.URL, cookies)
+		if !m.KeepSetCookie {
+			resp.Header.Del("Set-Cookie")
+		}
+	}
+	return resp
+}
+
+// Install enables the cookie management for all the requests of proxy.
+func (m *Manager) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(m.OnRequest)
+	proxy.OnResponse().DoFunc(m.OnResponse)
+}
@@ -0,0 +1,198 @@
+// Package cors answers the CORS preflights and injects the CORS headers in
+// the responses, for the APIs lacking CORS support fronted by the proxy,
+// per rule:
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("api.example.com:443")).Do(&cors.Policy{
+//		AllowOrigins:     []string{"https://app.example.com", "https://*.example.net"},
+//		AllowMethods:     []string{"GET", "POST", "DELETE"},
+//		AllowCredentials: true,
+//		MaxAge:           time.Hour,
+//	})
+//
+// The preflights are answered by the proxy, without reaching the APIs,
+// unless Passthrough is set. The CORS headers of the responses of the APIs
+// are replaced by those of the policy.
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Policy is the CORS policy of the requests it handles.
+type Policy struct {
+	// AllowOrigins are the origins allowed: "*" for all of them, the
+	// origins, such as "https://app.example.com", or the wildcards of
+	// their subdomains, such as "https://*.example.com".
+	AllowOrigins []string
+	// AllowMethods are the methods allowed to the preflights, GET, HEAD
+	// and POST by default.
+	AllowMethods []string
+	// AllowHeaders are the request headers allowed to the preflights, all
+	// those requested by default.
+	AllowHeaders []string
+	// ExposeHeaders are the response headers exposed to the scripts.
+	ExposeHeaders []string
+	// AllowCredentials allows the requests with credentials, the cookies
+	// and the HTTP authentication.
+	AllowCredentials bool
+	// MaxAge is the time the preflight responses are cached by the
+	// browsers.
+	MaxAge time.Duration
+	// Passthrough sends the preflights upstream, their responses getting
+	// the CORS headers.
+	Passthrough bool
+}
+
+// The CORS headers of the responses, replaced by those of the policies.
+var responseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// Allowed returns whether origin is allowed.
+func (p *Policy) Allowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range p.AllowOrigins {
+		if allowed == "*" && origin != "null" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			if host, ok := strings.CutPrefix(strings.ToLower(origin), strings.ToLower(scheme)+"://"); ok &&
+				strings.HasSuffix(host, "."+strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Policy) methodAllowed(method string) bool {
+	methods := p.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin sets the origin allowed in h.
+func (p *Policy) allowOrigin(h http.Header, origin string) {
+	for _, name := range responseHeaders {
+		h.Del(name)
+	}
+	h.Add("Vary", "Origin")
+	if !p.Allowed(origin) {
+		return
+	}
+	if len(p.AllowOrigins) == 1 && p.AllowOrigins[0] == "*" && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// isPreflight returns whether req is a preflight.
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Preflight returns the response of the preflight req.
+func (p *Policy) Preflight(req *http.Request) *http.Response {
+	origin := req.Header.Get("Origin")
+	method := req.Header.Get("Access-Control-Request-Method")
+	if !p.Allowed(origin) || !p.methodAllowed(method) {
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "CORS preflight rejected")
+		resp.Header.Add("Vary", "Origin")
+		return resp
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNoContent, "")
+	resp.Header.Del("Content-Type")
+	p.allowPreflight(resp.Header, req)
+	return resp
+}
+
+// allowPreflight sets the CORS headers of the response of the preflight req
+// in h.
+func (p *Policy) allowPreflight(h http.Header, req *http.Request) {
+	p.allowOrigin(h, req.Header.Get("Origin"))
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	if !p.Allowed(req.Header.Get("Origin")) {
+		return
+	}
+	if len(p.AllowMethods) > 0 {
+		h.Set("Access-Control-Allow-Methods", strings.Join(p.AllowMethods, ", "))
+	} else {
+		h.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+	}
+	if len(p.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(p.AllowHeaders, ", "))
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+}
+
+// Handle implements goproxy.ReqHandler. It answers the preflights, and
+// sets the CORS headers in the responses of the requests with an Origin.
+func (p *Policy) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if isPreflight(req) && !p.Passthrough {
+		ctx.Logf("cors: answering the preflight of %s", req.Header.Get("Origin"))
+		return req, p.Preflight(req)
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return req, nil
+	}
+	preflight := isPreflight(req)
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := next.RoundTrip(req, ctx)
+		if err != nil || resp == nil {
+			return resp, err
+		}
+		if preflight {
+			// The methods and headers allowed by the API are kept.
+			kept := make(http.Header)
+			for _, name := range []string{"Access-Control-Allow-Methods", "Access-Control-Allow-Headers", "Access-Control-Max-Age"} {
+				kept[name] = resp.Header.Values(name)
+			}
+			p.allowPreflight(resp.Header, req)
+			if p.Allowed(origin) {
+				for name, values := range kept {
+					if len(values) > 0 {
+						resp.Header[name] = values
+					}
+				}
+			}
+			return resp, nil
+		}
+		p.allowOrigin(resp.Header, origin)
+		if p.Allowed(origin) && len(p.ExposeHeaders) > 0 {
+			resp.Header.Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+		}
+		return resp, nil
+	})
+	return req, nil
+}
@@ -0,0 +1,119 @@
+package cors_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/cors"
+)
+
+func TestAllowed(t *testing.T) {
+	p := &cors.Policy{AllowOrigins: []string{"https://app.example.com", "https://*.example.net"}}
+	for origin, expected := range map[string]bool{
+		"https://app.example.com": true,
+		"https://APP.example.com": true,
+		"http://app.example.com":  false,
+		"https://a.b.example.net": true,
+		"https://example.net":     false,
+		"https://evilexample.net": false,
+		"http://www.example.net":  false,
+		"null":                    false,
+		"":                        false,
+	} {
+		if got := p.Allowed(origin); got != expected {
+			t.Errorf("Expected %q allowed to be %v, got %v", origin, expected, got)
+		}
+	}
+	if !(&cors.Policy{AllowOrigins: []string{"*"}}).Allowed("http://any.example.org") {
+		t.Error("Expected all the origins to be allowed by *")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	var reached []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = append(reached, r.Method)
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example.com")
+		w.Header().Set("X-Total", "3")
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(&cors.Policy{
+		AllowOrigins:     []string{"https://app.example.com"},
+		AllowMethods:     []string{"GET", "DELETE"},
+		ExposeHeaders:    []string{"X-Total"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	do := func(method, origin string, header http.Header) *http.Response {
+		req, _ := http.NewRequest(method, upstream.URL, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do(http.MethodOptions, "https://app.example.com", http.Header{
+		"Access-Control-Request-Method":  {"DELETE"},
+		"Access-Control-Request-Headers": {"authorization"},
+	})
+	for name, expected := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, DELETE",
+		"Access-Control-Allow-Headers":     "authorization",
+		"Access-Control-Max-Age":           "3600",
+	} {
+		if got := resp.Header.Get(name); got != expected {
+			t.Errorf("Expected the preflight %s to be %q, got %q", name, expected, got)
+		}
+	}
+	if resp.StatusCode != http.StatusNoContent || len(reached) != 0 {
+		t.Errorf("Expected the preflight to be answered by the proxy, got %d, %v", resp.StatusCode, reached)
+	}
+
+	resp = do(http.MethodOptions, "https://app.example.com", http.Header{"Access-Control-Request-Method": {"PUT"}})
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected the preflight of PUT to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, "https://app.example.com", nil)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected the origin to be allowed, got %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Expose-Headers"); got != "X-Total" {
+		t.Errorf("Expected X-Total to be exposed, got %q", got)
+	}
+	if got := resp.Header.Get("Vary"); got != "Origin" {
+		t.Errorf("Expected the response to vary by Origin, got %q", got)
+	}
+
+	resp = do(http.MethodGet, "https://evil.example.com", nil)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected the CORS headers of the upstream to be removed, got %q", got)
+	}
+
+	// Without Origin, the response is left unchanged.
+	resp = do(http.MethodGet, "", nil)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://upstream.example.com" {
+		t.Errorf("Expected the response to be left unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,212 @@
+// Package daemon runs a proxy as a daemon: it is stopped gracefully by
+// SIGINT and SIGTERM, reloaded by SIGHUP, and reopens its logs on SIGUSR1,
+// for the rotation of the log files. On Windows, it runs as a service when
+// started by the service manager, stopped and reloaded by its controls,
+// and as a console program otherwise.
+//
+//	d := &daemon.Daemon{
+//		Name:     "goproxy",
+//		Reload:   loadConfig,
+//		Reopen:   logs.Reopen,
+//		CrashDir: "/var/lib/goproxy/crashes",
+//	}
+//	srv := &http.Server{Addr: ":8080", Handler: d.Handler(proxy)}
+//	d.Serve = daemon.Server(srv, 30*time.Second)
+//	if err := d.Run(); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// The panics of Serve, and of the handlers wrapped by Handler, are
+// recovered with a crash report.
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Daemon runs a proxy until it is stopped.
+type Daemon struct {
+	// Name is the name of the Windows service.
+	Name string
+	// Serve serves until ctx is canceled, when the daemon is stopped.
+	Serve func(ctx context.Context) error
+	// Reload, when set, is called on SIGHUP, or the parameter change
+	// control of the Windows service, to reload the configuration.
+	Reload func() error
+	// Reopen, when set, is called on SIGUSR1, or the control 128 of the
+	// Windows service, to reopen the log files once rotated.
+	Reopen func() error
+	// CrashDir, when set, is the directory where the crash reports are
+	// written, besides being logged.
+	CrashDir string
+	// OnCrash, when set, is called with the crash reports, for example to
+	// send them.
+	OnCrash func(report []byte)
+	// Logger logs the events of the daemon, to stderr by default.
+	Logger goproxy.Logger
+
+	mu sync.Mutex
+}
+
+// control is a request to the running daemon.
+type control int
+
+const (
+	controlStop control = iota
+	controlReload
+	controlReopen
+)
+
+// ErrPanic is wrapped by the error of Run when Serve panicked.
+var ErrPanic = errors.New("daemon: panic")
+
+func (d *Daemon) logf(format string, v ...any) {
+	if d.Logger != nil {
+		d.Logger.Printf(format, v...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", v...)
+}
+
+// Run runs the daemon until it is stopped, or Serve returns.
+func (d *Daemon) Run() error {
+	if d.Serve == nil {
+		return errors.New("daemon: no Serve function")
+	}
+	return d.run()
+}
+
+// serve runs Serve, handling the controls until it returns.
+func (d *Daemon) serve(controls <-chan control) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				done <- fmt.Errorf("%w: %v", ErrPanic, d.crash(v, debug.Stack()))
+			}
+		}()
+		done <- d.Serve(ctx)
+	}()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case c := <-controls:
+			switch c {
+			case controlStop:
+				d.logf("daemon: stopping")
+				cancel()
+				return <-done
+			case controlReload:
+				d.call("reload", d.Reload)
+			case controlReopen:
+				d.call("reopen", d.Reopen)
+			}
+		}
+	}
+}
+
+func (d *Daemon) call(name string, f func() error) {
+	if f == nil {
+		return
+	}
+	if err := f(); err != nil {
+		d.logf("daemon: %s failed: %v", name, err)
+		return
+	}
+	d.logf("daemon: %s done", name)
+}
+
+// crash reports the panic of v, returning v.
+func (d *Daemon) crash(v any, stack []byte) any {
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "panic: %v\n\n", v)
+	fmt.Fprintf(&report, "time: %s\n", time.Now().UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&report, "go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&report, "args: %s\n\n", strings.Join(os.Args, " "))
+	report.Write(stack)
+
+	// The reports of the concurrent panics aren't interleaved.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.logf("daemon: crash: %s", report.Bytes())
+	if d.CrashDir != "" {
+		name := filepath.Join(d.CrashDir, fmt.Sprintf("crash-%d.txt", time.Now().UnixNano()))
+		if err := os.WriteFile(name, report.Bytes(), 0o600); err != nil {
+			d.logf("daemon: can't write the crash report: %v", err)
+		}
+	}
+	if d.OnCrash != nil {
+		d.OnCrash(report.Bytes())
+	}
+	return v
+}
+
+// Go runs f in a goroutine, reporting its panic rather than crashing the
+// process.
+func (d *Daemon) Go(f func()) {
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				d.crash(v, debug.Stack())
+			}
+		}()
+		f()
+	}()
+}
+
+// Handler returns h reporting its panics, except http.ErrAbortHandler. The
+// connection of the request panicking is closed, as by net/http.
+func (d *Daemon) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v != http.ErrAbortHandler {
+					d.crash(v, debug.Stack())
+				}
+				panic(http.ErrAbortHandler)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Server returns a Serve function serving srv, the proxy server, shut down
+// gracefully within timeout once stopped. Its connections still open are
+// then closed, the hijacked ones, such as the tunnels, excepted.
+func Server(srv *http.Server, timeout time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		errc := make(chan error, 1)
+		go func() { errc <- srv.ListenAndServe() }()
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+		}
+		shutdown, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := srv.Shutdown(shutdown)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = srv.Close()
+		}
+		if serveErr := <-errc; !errors.Is(serveErr, http.ErrServerClosed) {
+			return serveErr
+		}
+		return err
+	}
+}
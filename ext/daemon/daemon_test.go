@@ -0,0 +1,120 @@
+//go:build unix
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(format string, v ...any) { l.t.Logf(format, v...) }
+
+func TestSignals(t *testing.T) {
+	var reloads, reopens atomic.Int32
+	started := make(chan struct{})
+	d := &Daemon{
+		Serve: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			return nil
+		},
+		Reload: func() error { reloads.Add(1); return nil },
+		Reopen: func() error { reopens.Add(1); return nil },
+		Logger: testLogger{t},
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- d.Run() }()
+	<-started
+
+	wait := func(n *atomic.Int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for n.Load() == 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	wait(&reloads)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	wait(&reopens)
+	if reloads.Load() != 1 || reopens.Load() != 1 {
+		t.Errorf("reloads %d, reopens %d", reloads.Load(), reopens.Load())
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return on SIGTERM")
+	}
+}
+
+func TestPanic(t *testing.T) {
+	dir := t.TempDir()
+	var report []byte
+	d := &Daemon{
+		Serve:    func(ctx context.Context) error { panic("boom") },
+		CrashDir: dir,
+		OnCrash:  func(r []byte) { report = r },
+		Logger:   testLogger{t},
+	}
+	err := d.Run()
+	if !errors.Is(err, ErrPanic) {
+		t.Fatalf("got %v", err)
+	}
+	if !strings.HasPrefix(string(report), "panic: boom\n") || !strings.Contains(string(report), "TestPanic") {
+		t.Errorf("report %q", report)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "crash-*.txt"))
+	if len(files) != 1 {
+		t.Fatalf("%d crash reports written", len(files))
+	}
+	if b, _ := os.ReadFile(files[0]); string(b) != string(report) {
+		t.Errorf("crash report written %q", b)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reports := make(chan []byte, 1)
+	d := &Daemon{OnCrash: func(r []byte) { reports <- r }, Logger: testLogger{t}}
+	srv := httptest.NewServer(d.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		panic("handler boom")
+	})))
+	defer srv.Close()
+
+	for _, path := range []string{"/abort", "/boom"} {
+		if resp, err := http.Get(srv.URL + path); err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: got %s, expected the connection closed", path, resp.Status)
+		}
+	}
+	select {
+	case r := <-reports:
+		if !strings.HasPrefix(string(r), "panic: handler boom\n") {
+			t.Errorf("report %q", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no crash report")
+	}
+	select {
+	case r := <-reports:
+		t.Errorf("unexpected report %q", r)
+	default:
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !unix && !windows
+
+package daemon
+
+func (d *Daemon) run() error {
+	return d.console()
+}
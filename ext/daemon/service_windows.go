@@ -0,0 +1,146 @@
+//go:build windows
+
+package daemon
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                     = syscall.NewLazyDLL("advapi32.dll")
+	startServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	registerServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	setServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped      = 1
+	serviceStartPending = 2
+	serviceStopPending  = 3
+	serviceRunning      = 4
+
+	serviceAcceptStop        = 0x1
+	serviceAcceptShutdown    = 0x4
+	serviceAcceptParamChange = 0x8
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+	// serviceControlReopen is the user-defined control reopening the logs,
+	// sent by "sc control <name> 128".
+	serviceControlReopen = 128
+
+	errorCallNotImplemented             = 120
+	errorFailedServiceControllerConnect = 1063
+	errorServiceSpecificError           = 1066
+)
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// service is the state of the service run, since the callbacks of the
+// service manager can't be closures.
+var service struct {
+	d        *Daemon
+	controls chan control
+	status   uintptr
+	err      error
+}
+
+var (
+	serviceMainCallback = syscall.NewCallback(serviceMain)
+	handlerCallback     = syscall.NewCallback(handler)
+)
+
+func (d *Daemon) run() error {
+	name, err := syscall.UTF16PtrFromString(d.Name)
+	if err != nil {
+		return err
+	}
+	service.d = d
+	service.controls = make(chan control, 4)
+	table := []serviceTableEntry{{name: name, proc: serviceMainCallback}, {}}
+	// StartServiceCtrlDispatcher returns once the service is stopped.
+	r, _, err := startServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		var errno syscall.Errno
+		if errors.As(err, &errno) && errno == errorFailedServiceControllerConnect {
+			// Not started by the service manager.
+			return d.console()
+		}
+		return err
+	}
+	return service.err
+}
+
+func serviceMain(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString(service.d.Name)
+	h, _, err := registerServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(name)), handlerCallback, 0)
+	if h == 0 {
+		service.err = err
+		return 0
+	}
+	service.status = h
+	report(serviceStartPending, 0, 0)
+	report(serviceRunning, serviceAcceptStop|serviceAcceptShutdown|serviceAcceptParamChange, 0)
+	service.err = service.d.serve(service.controls)
+	var code uint32
+	if service.err != nil {
+		code = errorServiceSpecificError
+	}
+	report(serviceStopped, 0, code)
+	return 0
+}
+
+func handler(ctl, eventType, eventData, context uintptr) uintptr {
+	var c control
+	switch ctl {
+	case serviceControlStop, serviceControlShutdown:
+		report(serviceStopPending, 0, 0)
+		c = controlStop
+	case serviceControlParamChange:
+		c = controlReload
+	case serviceControlReopen:
+		c = controlReopen
+	case serviceControlInterrogate:
+		return 0
+	default:
+		return errorCallNotImplemented
+	}
+	// The handler mustn't block the dispatcher of the service manager.
+	select {
+	case service.controls <- c:
+	default:
+	}
+	return 0
+}
+
+func report(state, accepts, code uint32) {
+	status := serviceStatus{
+		serviceType:      serviceWin32OwnProcess,
+		currentState:     state,
+		controlsAccepted: accepts,
+	}
+	if code != 0 {
+		status.win32ExitCode = code
+		status.serviceSpecificExitCode = 1
+	}
+	setServiceStatus.Call(service.status, uintptr(unsafe.Pointer(&status)))
+}
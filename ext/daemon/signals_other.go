@@ -0,0 +1,30 @@
+//go:build !unix
+
+package daemon
+
+import (
+	"os"
+	"os/signal"
+)
+
+// console runs the daemon stopped by an interrupt, without reload.
+func (d *Daemon) console() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	controls := make(chan control)
+	go func() {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+		select {
+		case controls <- controlStop:
+		case <-done:
+		}
+	}()
+	return d.serve(controls)
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package daemon
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func (d *Daemon) run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	return d.serve(signalControls(signals, done))
+}
+
+// signalControls translates the signals into controls, until done.
+func signalControls(signals <-chan os.Signal, done <-chan struct{}) <-chan control {
+	controls := make(chan control)
+	go func() {
+		for {
+			var sig os.Signal
+			select {
+			case sig = <-signals:
+			case <-done:
+				return
+			}
+			c := controlStop
+			switch sig {
+			case syscall.SIGHUP:
+				c = controlReload
+			case syscall.SIGUSR1:
+				c = controlReopen
+			}
+			select {
+			case controls <- c:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return controls
+}
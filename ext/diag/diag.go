@@ -0,0 +1,162 @@
+// Package diag exposes the Go diagnostics of a proxy instance on its
+// administration listener: pprof, expvar, the runtime metrics, and a
+// diagnostic bundle gathering what support escalations need in one
+// download:
+//
+//	d := &diag.Diag{
+//		Allow:  []string{"10.0.0.0/8"},
+//		Token:  os.Getenv("DIAG_TOKEN"),
+//		Config: func() any { return redactedConfig() },
+//	}
+//	admin.Handle("/debug/", d.Handler())
+//
+// The endpoints are:
+//
+//	/debug/pprof/    the profiles of net/http/pprof
+//	/debug/vars      the variables of expvar
+//	/debug/runtime   the runtime/metrics samples, in JSON
+//	/debug/bundle    a zip of the goroutines, heap profile, runtime
+//	                 metrics, build information and configuration
+//
+// The profiles reveal the memory of the process, credentials included, so
+// the requests must come from an allowed network, loopback by default, and
+// carry the Token when set. As net/http/pprof and expvar register their
+// handlers on http.DefaultServeMux, it must not be served to the proxy users
+// either.
+package diag
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	rpprof "runtime/pprof"
+	"time"
+
+	"github.com/InsideOutSec/goproxy/ext/admin"
+)
+
+// Diag serves the diagnostics.
+type Diag struct {
+	// Allow lists the networks, in CIDR notation, or addresses the requests
+	// may come from, the loopback ones by default.
+	Allow []string
+	// Token, when set, must be sent as a bearer token.
+	Token string
+	// Authorize, when set, must also accept the requests.
+	Authorize func(req *http.Request) bool
+	// Config returns the configuration snapshot of the bundle, encoded in
+	// JSON. It should not include the secrets.
+	Config func() any
+}
+
+// Handler returns the handler of the diagnostic endpoints, which must be
+// mounted at /debug/.
+func (d *Diag) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = writeMetrics(w)
+	})
+	mux.HandleFunc("/debug/bundle", d.serveBundle)
+	g := &admin.Guard{Allow: d.Allow, Token: d.Token, Authorize: d.Authorize}
+	return g.Handler(mux)
+}
+
+// Metrics returns the samples of the runtime metrics, by name. The
+// histograms are summarized by their count of samples.
+func Metrics() map[string]any {
+	descs := metrics.All()
+	samples := make([]metrics.Sample, len(descs))
+	for i, desc := range descs {
+		samples[i].Name = desc.Name
+	}
+	metrics.Read(samples)
+	values := make(map[string]any, len(samples))
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			values[s.Name] = s.Value.Uint64()
+		case metrics.KindFloat64:
+			values[s.Name] = s.Value.Float64()
+		case metrics.KindFloat64Histogram:
+			var count uint64
+			for _, c := range s.Value.Float64Histogram().Counts {
+				count += c
+			}
+			values[s.Name] = map[string]uint64{"count": count}
+		}
+	}
+	return values
+}
+
+func writeMetrics(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Metrics())
+}
+
+func (d *Diag) serveBundle(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("goproxy-diag-%s.zip", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	_ = d.WriteBundle(w)
+}
+
+type bundleFile struct {
+	name  string
+	write func(io.Writer) error
+}
+
+// WriteBundle writes the diagnostic bundle to w.
+func (d *Diag) WriteBundle(w io.Writer) error {
+	z := zip.NewWriter(w)
+	files := []bundleFile{
+		{"goroutines.txt", func(w io.Writer) error {
+			return rpprof.Lookup("goroutine").WriteTo(w, 2)
+		}},
+		{"heap.pb.gz", func(w io.Writer) error {
+			runtime.GC()
+			return rpprof.Lookup("heap").WriteTo(w, 0)
+		}},
+		{"runtime.json", writeMetrics},
+		{"build.txt", func(w io.Writer) error {
+			info, ok := debug.ReadBuildInfo()
+			if !ok {
+				_, err := fmt.Fprintln(w, runtime.Version())
+				return err
+			}
+			_, err := fmt.Fprint(w, info.String())
+			return err
+		}},
+	}
+	if d.Config != nil {
+		files = append(files, bundleFile{"config.json", func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(d.Config())
+		}})
+	}
+	for _, f := range files {
+		fw, err := z.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if err := f.write(fw); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
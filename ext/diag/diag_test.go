@@ -0,0 +1,97 @@
+package diag_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy/ext/diag"
+)
+
+func TestAccess(t *testing.T) {
+	d := &diag.Diag{Allow: []string{"10.0.0.0/8", "192.168.1.1"}, Token: "secret"}
+	h := d.Handler()
+	for _, tt := range []struct {
+		remote, token string
+		code          int
+	}{
+		{"10.1.2.3:1234", "secret", http.StatusOK},
+		{"192.168.1.1:1234", "secret", http.StatusOK},
+		{"192.168.1.2:1234", "secret", http.StatusForbidden},
+		{"127.0.0.1:1234", "secret", http.StatusForbidden},
+		{"10.1.2.3:1234", "wrong", http.StatusUnauthorized},
+		{"10.1.2.3:1234", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/debug/vars", nil)
+		req.RemoteAddr = tt.remote
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s with %q: %d, want %d", tt.remote, tt.token, rec.Code, tt.code)
+		}
+	}
+
+	// Loopback only by default.
+	h = (&diag.Diag{}).Handler()
+	for remote, code := range map[string]int{"127.0.0.1:1": http.StatusOK, "10.0.0.1:1": http.StatusForbidden} {
+		req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%s: %d, want %d", remote, rec.Code, code)
+		}
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	req := httptest.NewRequest("GET", "/debug/runtime", nil)
+	req.RemoteAddr = "127.0.0.1:1"
+	rec := httptest.NewRecorder()
+	(&diag.Diag{}).Handler().ServeHTTP(rec, req)
+	var values map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &values); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := values["/sched/goroutines:goroutines"]; !ok {
+		t.Errorf("no goroutines metric in %d metrics", len(values))
+	}
+}
+
+func TestBundle(t *testing.T) {
+	d := &diag.Diag{Config: func() any { return map[string]string{"listen": ":8080"} }}
+	req := httptest.NewRequest("GET", "/debug/bundle", nil)
+	req.RemoteAddr = "127.0.0.1:1"
+	rec := httptest.NewRecorder()
+	d.Handler().ServeHTTP(rec, req)
+	body := rec.Body.Bytes()
+	z, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		files[f.Name] = string(data)
+	}
+	for _, name := range []string{"goroutines.txt", "heap.pb.gz", "runtime.json", "build.txt", "config.json"} {
+		if files[name] == "" {
+			t.Errorf("empty %s", name)
+		}
+	}
+	if !strings.Contains(files["goroutines.txt"], "TestBundle") {
+		t.Error("goroutine dump without the test goroutine")
+	}
+	if !strings.Contains(files["config.json"], `":8080"`) {
+		t.Errorf("config %q", files["config.json"])
+	}
+}
@@ -0,0 +1,228 @@
+// Package ech handles the Encrypted Client Hello of TLS. A Resolver
+// retrieves the ECH configurations published by the hosts in their DNS
+// HTTPS records. It is used to send ECH on the upstream handshakes, and to
+// pass through without MITM the tunnels of the hosts publishing ECH, whose
+// clients may encrypt their hello:
+//
+//	resolver := &ech.Resolver{}
+//	proxy.Tr = resolver.Transport(proxy.Tr)
+//	proxy.OnRequest().HandleConnect(resolver.PassThrough())
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//
+// The MITM handshakes ignore the ECH offered by the clients, as the proxy
+// doesn't have the keys of the hosts. The clients then fall back to their
+// outer hello, or fail.
+//
+// The ECH handshakes require Go 1.24. crypto/tls doesn't send GREASE ECH,
+// so the upstream handshakes to the hosts without ECH configuration don't
+// have the extension.
+package ech
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeHTTPS is the DNS HTTPS record type, of RFC 9460.
+const typeHTTPS dnsmessage.Type = 65
+
+// keyECH is the SvcParamKey of the ECH configurations.
+const keyECH = 5
+
+// Resolver looks up the ECH configuration lists of the hosts, caching them
+// for the TTL of their records.
+type Resolver struct {
+	// Server is the address of the DNS server, the first nameserver of
+	// /etc/resolv.conf by default.
+	Server string
+	// Timeout bounds a lookup, 2 seconds by default.
+	Timeout time.Duration
+	// NegativeTTL is the cache duration of the hosts without ECH, 5 minutes
+	// by default.
+	NegativeTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	configs []byte
+	expires time.Time
+}
+
+func defaultServer() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// Lookup returns the ECH configuration list of host, nil if it publishes
+// none.
+func (r *Resolver) Lookup(ctx context.Context, host string) ([]byte, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return nil, nil
+	}
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.configs, nil
+	}
+
+	configs, ttl, err := r.query(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if configs == nil {
+		ttl = r.NegativeTTL
+		if ttl <= 0 {
+			ttl = 5 * time.Minute
+		}
+	}
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[string]cacheEntry)
+	}
+	r.cache[host] = cacheEntry{configs: configs, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return configs, nil
+}
+
+func (r *Resolver) query(ctx context.Context, host string) ([]byte, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(time.Now().UnixNano())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: name, Type: typeHTTPS, Class: dnsmessage.ClassINET})
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	server := r.Server
+	if server == "" {
+		server = defaultServer()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(buf[:n])
+		if err != nil || h.ID != id {
+			continue
+		}
+		if h.RCode == dnsmessage.RCodeNameError {
+			return nil, 0, nil
+		}
+		if h.RCode != dnsmessage.RCodeSuccess {
+			return nil, 0, errors.New("ech: DNS error " + h.RCode.String())
+		}
+		_ = p.SkipAllQuestions()
+		answers, err := p.AllAnswers()
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, a := range answers {
+			unknown, ok := a.Body.(*dnsmessage.UnknownResource)
+			if !ok || a.Header.Type != typeHTTPS {
+				continue
+			}
+			if configs := parseHTTPS(unknown.Data); configs != nil {
+				return configs, time.Duration(a.Header.TTL) * time.Second, nil
+			}
+		}
+		return nil, 0, nil
+	}
+}
+
+// parseHTTPS returns the ECH configuration list of the data of an HTTPS
+// record, nil if it has none.
+func parseHTTPS(data []byte) []byte {
+	if len(data) < 3 || binary.BigEndian.Uint16(data) == 0 {
+		// Alias records have no parameters.
+		return nil
+	}
+	// The target name isn't compressed.
+	i := 2
+	for i < len(data) && data[i] != 0 {
+		i += int(data[i]) + 1
+	}
+	i++
+	for i+4 <= len(data) {
+		key := binary.BigEndian.Uint16(data[i:])
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		i += 4
+		if i+length > len(data) {
+			return nil
+		}
+		if key == keyECH {
+			return append([]byte(nil), data[i:i+length]...)
+		}
+		i += length
+	}
+	return nil
+}
+
+// PassThrough accepts without MITM the tunnels of the hosts publishing ECH
+// configurations, leaving the others to the next handlers.
+func (r *Resolver) PassThrough() goproxy.FuncHttpsHandler {
+	return func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		hostname, _, err := net.SplitHostPort(host)
+		if err != nil {
+			hostname = host
+		}
+		configs, err := r.Lookup(ctx.Req.Context(), hostname)
+		if err != nil {
+			ctx.Warnf("Cannot look up the ECH configuration of %s: %v", hostname, err)
+			return nil, host
+		}
+		if configs != nil {
+			ctx.Logf("Passing through %s, publishing ECH", hostname)
+			return goproxy.OkConnect, host
+		}
+		return nil, host
+	}
+}
@@ -0,0 +1,102 @@
+package ech_test
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/ech"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// httpsRecord returns the data of an HTTPS record for "." with the ECH
+// configuration list configs.
+func httpsRecord(configs []byte) []byte {
+	data := []byte{0, 1, 0}
+	// The ALPN parameter comes before the ECH one.
+	data = append(data, 0, 1, 0, 3, 2, 'h', '2')
+	data = binary.BigEndian.AppendUint16(data, 5)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(configs)))
+	return append(data, configs...)
+}
+
+// dnsServer answers the HTTPS queries of the hosts of records, and NXDOMAIN
+// for the others.
+func dnsServer(t *testing.T, records map[string][]byte) (string, *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	queries := new(int32)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			resp := dnsmessage.Header{ID: h.ID, Response: true}
+			configs, ok := records[q.Name.String()]
+			if !ok {
+				resp.RCode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, resp)
+			_ = b.StartQuestions()
+			_ = b.Question(q)
+			_ = b.StartAnswers()
+			if ok {
+				_ = b.UnknownResource(dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					dnsmessage.UnknownResource{Type: q.Type, Data: httpsRecord(configs)})
+			}
+			msg, _ := b.Finish()
+			_, _ = conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func TestLookup(t *testing.T) {
+	server, queries := dnsServer(t, map[string][]byte{"ech.example.com.": {0, 3, 1, 2, 3}})
+	r := &ech.Resolver{Server: server}
+
+	for i := 0; i < 2; i++ {
+		configs, err := r.Lookup(context.Background(), "ech.example.com")
+		if err != nil || string(configs) != "\x00\x03\x01\x02\x03" {
+			t.Errorf("Unexpected configurations %v: %v", configs, err)
+		}
+		if configs, err := r.Lookup(context.Background(), "plain.example.com"); configs != nil || err != nil {
+			t.Errorf("Expected no configuration, got %v: %v", configs, err)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("Expected the lookups to be cached, got %d queries", n)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	server, _ := dnsServer(t, map[string][]byte{"ech.example.com.": {0, 3, 1, 2, 3}})
+	handler := (&ech.Resolver{Server: server}).PassThrough()
+	ctx := &goproxy.ProxyCtx{Req: &http.Request{}, Proxy: goproxy.NewProxyHttpServer()}
+
+	if action, _ := handler.HandleConnect("ech.example.com:443", ctx); action != goproxy.OkConnect {
+		t.Errorf("Expected the ECH host to pass through, got %v", action)
+	}
+	if action, _ := handler.HandleConnect("plain.example.com:443", ctx); action != nil {
+		t.Errorf("Expected the other hosts to be left to the next handlers, got %v", action)
+	}
+}
@@ -0,0 +1,102 @@
+//go:build go1.24
+
+package ech
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// extensionECH is the TLS extension of the Encrypted Client Hello.
+const extensionECH = 0xfe0d
+
+// Transport returns a copy of base sending ECH on the handshakes with the
+// hosts publishing ECH configurations. A rejected ECH is retried once with
+// the configurations returned by the server.
+func (r *Resolver) Transport(base *http.Transport) *http.Transport {
+	tr := base.Clone()
+	config := tr.TLSClientConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		configs, err := r.Lookup(ctx, host)
+		if err != nil {
+			// The handshake goes on without ECH.
+			configs = nil
+		}
+		handshake := func(configs []byte) (net.Conn, error) {
+			raw, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			c := config.Clone()
+			if c.ServerName == "" {
+				c.ServerName = host
+			}
+			if configs != nil {
+				c.EncryptedClientHelloConfigList = configs
+				c.MinVersion = tls.VersionTLS13
+			}
+			conn := tls.Client(raw, c)
+			if err := conn.HandshakeContext(ctx); err != nil {
+				raw.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+		conn, err := handshake(configs)
+		var rejected *tls.ECHRejectionError
+		if errors.As(err, &rejected) && len(rejected.RetryConfigList) > 0 {
+			conn, err = handshake(rejected.RetryConfigList)
+		}
+		return conn, err
+	}
+	return tr
+}
+
+// OfferedECH returns whether a client hello has the ECH extension, either
+// real or GREASE.
+func OfferedECH(hello *tls.ClientHelloInfo) bool {
+	for _, ext := range hello.Extensions {
+		if ext == extensionECH {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectECH wraps the TLS configuration of a MITM action, calling onECH
+// when the client offers ECH in its hello.
+func DetectECH(
+	tlsConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error),
+	onECH func(host string, ctx *goproxy.ProxyCtx),
+) func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		config, err := tlsConfig(host, ctx)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if OfferedECH(hello) {
+				onECH(host, ctx)
+			}
+			return nil, nil
+		}
+		return config, nil
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !go1.24
+
+package ech
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Transport returns a copy of base. ECH requires Go 1.24.
+func (r *Resolver) Transport(base *http.Transport) *http.Transport {
+	return base.Clone()
+}
+
+// OfferedECH returns false, the extensions of the hellos being known from
+// Go 1.24.
+func OfferedECH(hello *tls.ClientHelloInfo) bool {
+	return false
+}
+
+// DetectECH returns tlsConfig, the extensions of the hellos being known
+// from Go 1.24.
+func DetectECH(
+	tlsConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error),
+	onECH func(host string, ctx *goproxy.ProxyCtx),
+) func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	return tlsConfig
+}
@@ -0,0 +1,94 @@
+//go:build go1.24
+
+package ech_test
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy/ext/ech"
+)
+
+// echKey returns a DHKEM(X25519) ECH key of config id, and its ECHConfig.
+func echKey(t *testing.T, id byte) tls.EncryptedClientHelloKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.PublicKey().Bytes()
+	contents := []byte{id, 0x00, 0x20}
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(pub)))
+	contents = append(contents, pub...)
+	// HKDF-SHA256 and AES-128-GCM.
+	contents = append(contents, 0, 4, 0, 1, 0, 1)
+	contents = append(contents, 0, byte(len("public.example.com")))
+	contents = append(contents, "public.example.com"...)
+	contents = append(contents, 0, 0)
+
+	config := []byte{0xfe, 0x0d}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: key.Bytes(), SendAsRetry: true}
+}
+
+func configList(keys ...tls.EncryptedClientHelloKey) []byte {
+	var configs []byte
+	for _, k := range keys {
+		configs = append(configs, k.Config...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(configs))), configs...)
+}
+
+func TestTransport(t *testing.T) {
+	key := echKey(t, 1)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.ECHAccepted)
+	}))
+	upstream.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	server, _ := dnsServer(t, map[string][]byte{
+		"ech.example.com.":   configList(key),
+		"stale.example.com.": configList(echKey(t, 2)),
+	})
+	r := &ech.Resolver{Server: server}
+	// A rejected ECH is verified for the public name.
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+	tr := r.Transport(&http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, upstream.Listener.Addr().String())
+		},
+	})
+	client := &http.Client{Transport: tr}
+
+	for host, accepted := range map[string]string{
+		"ech.example.com": "true",
+		// The stale configuration is retried with the one of the server.
+		"stale.example.com": "true",
+		"plain.example.com": "false",
+	} {
+		resp, err := client.Get("https://" + host + "/")
+		if err != nil {
+			t.Errorf("Cannot get %s: %v", host, err)
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != accepted {
+			t.Errorf("Expected ECH accepted for %s: %s, got %s", host, accepted, body)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Package egress selects the local source address used for outbound
+// connections, for deployments with several public addresses or interfaces,
+// and routes the destinations through the tunnels established in the
+// process, such as those of WireGuard.
+//
+// The package doesn't establish the WireGuard tunnels itself, and doesn't
+// depend on wireguard-go: it parses their wg-quick configurations, but the
+// devices and their netstacks are created by the callers, as in the example
+// of Tunnels.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Policy decides which source address of a Pool is used for a request.
+type Policy int
+
+const (
+	// RoundRobin rotates through the pool on every request.
+	RoundRobin Policy = iota
+	// StickyDestination always uses the same source address for a given
+	// destination host.
+	StickyDestination
+	// StickyClient always uses the same source address for a given
+	// client IP address.
+	StickyClient
+)
+
+var ErrEmptyPool = errors.New("egress: no usable source address")
+
+// Pool is a set of local source addresses used to originate upstream
+// connections. It keeps one transport per source address, so that pooled
+// keep-alive connections are never shared between different addresses.
+type Pool struct {
+	policy Policy
+	addrs  []net.IP
+	next   uint32
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// NewPool creates a Pool from a list of IP addresses or interface names.
+// All the addresses configured on an interface are added to the pool.
+func NewPool(policy Policy, sources ...string) (*Pool, error) {
+	p := &Pool{policy: policy, transports: make(map[string]*http.Transport)}
+	for _, s := range sources {
+		if ip := net.ParseIP(s); ip != nil {
+			p.addrs = append(p.addrs, ip)
+			continue
+		}
+		iface, err := net.InterfaceByName(s)
+		if err != nil {
+			return nil, fmt.Errorf("egress: invalid source %q: %w", s, err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("egress: cannot list addresses of %q: %w", s, err)
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				p.addrs = append(p.addrs, ipNet.IP)
+			}
+		}
+	}
+	if len(p.addrs) == 0 {
+		return nil, ErrEmptyPool
+	}
+	return p, nil
+}
+
+// Addrs returns the source addresses of the pool.
+func (p *Pool) Addrs() []net.IP {
+	return append([]net.IP(nil), p.addrs...)
+}
+
+// Select returns the source address that the pool policy picks for req.
+func (p *Pool) Select(req *http.Request) net.IP {
+	var key string
+	switch p.policy {
+	case StickyDestination:
+		key = req.URL.Hostname()
+		if key == "" {
+			key = req.Host
+		}
+	case StickyClient:
+		key = req.RemoteAddr
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			key = host
+		}
+	case RoundRobin:
+		n := atomic.AddUint32(&p.next, 1) - 1
+		return p.addrs[n%uint32(len(p.addrs))]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return p.addrs[h.Sum32()%uint32(len(p.addrs))]
+}
+
+// Dialer returns a dial function whose connections originate from ip.
+func Dialer(ip net.IP) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// Restrict the address family, otherwise the dialer could pick
+		// a destination address that can't be reached from ip.
+		if network == "tcp" {
+			if ip.To4() != nil {
+				network = "tcp4"
+			} else {
+				network = "tcp6"
+			}
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+func (p *Pool) transport(proxy *goproxy.ProxyHttpServer, ip net.IP) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := ip.String()
+	if tr, ok := p.transports[key]; ok {
+		return tr
+	}
+	tr := proxy.Tr.Clone()
+	tr.DialContext = Dialer(ip)
+	p.transports[key] = tr
+	return tr
+}
+
+// CloseIdleConnections closes the idle connections of every source address.
+func (p *Pool) CloseIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, tr := range p.transports {
+		tr.CloseIdleConnections()
+	}
+}
+
+// Handler returns a ReqHandler that binds the current request, and the
+// CONNECT tunnels, to a source address of the pool.
+//
+//	pool, _ := egress.NewPool(egress.StickyClient, "192.0.2.10", "192.0.2.11")
+//	proxy.OnRequest().Do(pool.Handler())
+//	proxy.OnRequest().HandleConnect(pool.ConnectHandler())
+func (p *Pool) Handler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ip := p.Select(req)
+		tr := p.transport(ctx.Proxy, ip)
+		ctx.Dialer = tr.DialContext
+		ctx.Transport = tr
+		return req, nil
+	})
+}
+
+// ConnectHandler returns an HttpsHandler that binds the CONNECT tunnel to a
+// source address of the pool. It never decides the fate of the request, so
+// the following CONNECT handlers are still executed.
+func (p *Pool) ConnectHandler() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Dialer = Dialer(p.Select(ctx.Req))
+		return nil, host
+	})
+}
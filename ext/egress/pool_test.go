@@ -0,0 +1,85 @@
+package egress_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/egress"
+)
+
+func TestNewPoolInvalidSource(t *testing.T) {
+	if _, err := egress.NewPool(egress.RoundRobin, "not-an-interface-name"); err == nil {
+		t.Error("Expected an error for an unknown interface")
+	}
+	if _, err := egress.NewPool(egress.RoundRobin); err == nil {
+		t.Error("Expected an error for an empty pool")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	pool, err := egress.NewPool(egress.RoundRobin, "127.0.0.1", "127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	first, second, third := pool.Select(req), pool.Select(req), pool.Select(req)
+	if first.Equal(second) || !first.Equal(third) {
+		t.Errorf("Round robin didn't rotate: %v %v %v", first, second, third)
+	}
+
+	pool, err = egress.NewPool(egress.StickyDestination, "127.0.0.1", "127.0.0.2", "127.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if !pool.Select(req).Equal(pool.Select(req)) {
+			t.Fatal("Sticky destination selected different addresses for the same host")
+		}
+	}
+
+	pool, err = egress.NewPool(egress.StickyClient, "127.0.0.1", "127.0.0.2", "127.0.0.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+	other.RemoteAddr = req.RemoteAddr
+	if !pool.Select(req).Equal(pool.Select(other)) {
+		t.Error("Sticky client selected different addresses for the same client")
+	}
+}
+
+func TestHandlerUsesSourceAddress(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		_, _ = io.WriteString(w, host)
+	}))
+	defer background.Close()
+
+	pool, err := egress.NewPool(egress.RoundRobin, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.CloseIdleConnections()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(pool.Handler())
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(background.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "127.0.0.1" {
+		t.Errorf("Expected request from 127.0.0.1, got %q", body)
+	}
+}
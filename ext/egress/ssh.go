@@ -0,0 +1,196 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH is a Tunnel dialing the destinations from an SSH jump host, as
+// ssh -J, for the hosts only reachable from a bastion:
+//
+//	hostKeys, _ := egress.SSHKnownHosts(os.ExpandEnv("$HOME/.ssh/known_hosts"))
+//	auth, _ := egress.SSHAgent()
+//	bastion := egress.NewSSH("bastion.example.com:22", &ssh.ClientConfig{
+//		User:            "proxy",
+//		Auth:            []ssh.AuthMethod{auth},
+//		HostKeyCallback: hostKeys,
+//	})
+//	tunnels.Add("bastion", bastion, egress.Domains("internal.example.com"))
+//
+// The connection with the jump host is established on the first dial, kept
+// alive, and established again once lost. SSH is safe for concurrent use.
+type SSH struct {
+	// KeepAlive is the interval of the keepalives checking the connection
+	// with the jump host, 30s by default; negative disables them.
+	KeepAlive time.Duration
+
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+// NewSSH returns an SSH dialing from the jump host addr, authenticated with
+// config.
+func NewSSH(addr string, config *ssh.ClientConfig) *SSH {
+	return &SSH{addr: addr, config: config}
+}
+
+// connect returns the connection with the jump host, establishing it if
+// needed.
+func (s *SSH) connect(ctx context.Context) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	if s.client != nil {
+		return s.client, nil
+	}
+	conn, err := (&net.Dialer{Timeout: s.config.Timeout}).DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("egress: ssh %s: %w", s.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.addr, s.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("egress: ssh %s: %w", s.addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	s.client = client
+	go func() {
+		client.Wait()
+		s.drop(client)
+	}()
+	if s.KeepAlive >= 0 {
+		go s.keepAlive(client)
+	}
+	return client, nil
+}
+
+// drop forgets client, if still in use, to connect again on the next dial.
+func (s *SSH) drop(client *ssh.Client) {
+	s.mu.Lock()
+	if s.client == client {
+		s.client = nil
+	}
+	s.mu.Unlock()
+	client.Close()
+}
+
+func (s *SSH) keepAlive(client *ssh.Client) {
+	interval := s.KeepAlive
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			if err == nil {
+				continue
+			}
+		case <-time.After(interval):
+		}
+		// Unanswered: the connection is lost.
+		s.drop(client)
+		return
+	}
+}
+
+// DialContext implements Tunnel, connecting to addr from the jump host. A
+// dial failing on a connection lost is retried once, on a new connection.
+func (s *SSH) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("egress: ssh can't dial %s", network)
+	}
+	for attempt := 0; ; attempt++ {
+		client, err := s.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		// The jump host refusing the destination answers with an
+		// OpenChannelError, on a connection still alive.
+		var refused *ssh.OpenChannelError
+		if errors.As(err, &refused) || ctx.Err() != nil || attempt > 0 {
+			return nil, err
+		}
+		s.drop(client)
+	}
+}
+
+// Close closes the connection with the jump host, and fails the next
+// dials.
+func (s *SSH) Close() error {
+	s.mu.Lock()
+	client := s.client
+	s.client, s.closed = nil, true
+	s.mu.Unlock()
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
+
+// SSHKey returns the authentication with the PEM private key, encrypted
+// with passphrase if not empty.
+func SSHKey(pemBytes []byte, passphrase string) (ssh.AuthMethod, error) {
+	var signer ssh.Signer
+	var err error
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// SSHAgent returns the authentication with the keys of the SSH agent of
+// SSH_AUTH_SOCK, connected until the process exits.
+func SSHAgent() (ssh.AuthMethod, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("egress: SSH_AUTH_SOCK not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("egress: ssh agent: %w", err)
+	}
+	return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), nil
+}
+
+// SSHKnownHosts returns the verification of the host keys of the jump
+// hosts with the known_hosts files.
+func SSHKnownHosts(files ...string) (ssh.HostKeyCallback, error) {
+	return knownhosts.New(files...)
+}
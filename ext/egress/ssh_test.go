@@ -0,0 +1,159 @@
+package egress_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/InsideOutSec/goproxy/ext/egress"
+)
+
+// sshServer is a jump host accepting the password "secret", returning its
+// address and the connections it accepted.
+func sshServer(t *testing.T) (string, ssh.PublicKey, chan net.Conn) {
+	t.Helper()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, io.EOF
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+			go serveSSH(conn, config)
+		}
+	}()
+	return l.Addr().String(), signer.PublicKey(), accepted
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &target) != nil {
+			nc.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, reqs, _ := nc.Accept()
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			io.Copy(ch, upstream)
+			ch.Close()
+		}()
+		go func() {
+			io.Copy(upstream, ch)
+			upstream.Close()
+		}()
+	}
+}
+
+func TestSSH(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		io.WriteString(w, "internal")
+	}))
+	defer backend.Close()
+	addr, hostKey, accepted := sshServer(t)
+
+	bastion := egress.NewSSH(addr, &ssh.ClientConfig{
+		User:            "proxy",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	defer bastion.Close()
+	client := &http.Client{Transport: &http.Transport{DialContext: bastion.DialContext, DisableKeepAlives: true}}
+	get := func() {
+		t.Helper()
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "internal" {
+			t.Errorf("Unexpected body %q", body)
+		}
+	}
+	get()
+	get()
+	conn := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("Expected the connection with the jump host to be reused")
+	default:
+	}
+
+	// A connection lost is established again.
+	conn.Close()
+	get()
+	<-accepted
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+
+	if _, err := bastion.DialContext(context.Background(), "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("Expected the jump host to refuse an unreachable destination")
+	}
+	bastion.Close()
+	if _, err := bastion.DialContext(context.Background(), "tcp", backend.Listener.Addr().String()); err == nil {
+		t.Error("Expected a dial to fail once closed")
+	}
+}
+
+func TestSSHAuthFails(t *testing.T) {
+	addr, hostKey, _ := sshServer(t)
+	bastion := egress.NewSSH(addr, &ssh.ClientConfig{
+		User:            "proxy",
+		Auth:            []ssh.AuthMethod{ssh.Password("wrong")},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+	})
+	if _, err := bastion.DialContext(context.Background(), "tcp", "127.0.0.1:80"); err == nil {
+		t.Error("Expected the authentication to fail")
+	}
+
+	key, _ := ssh.MarshalPrivateKey(ed25519.NewKeyFromSeed(make([]byte, 32)), "")
+	if _, err := egress.SSHKey(pem.EncodeToMemory(key), ""); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,180 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Tunnel dials through a tunnel established in the process, such as the
+// netstack of wireguard-go, whose *netstack.Net is a Tunnel, so that the
+// destinations routed to it don't need any route of the OS.
+type Tunnel interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type tunnelRoute struct {
+	name   string
+	tunnel Tunnel
+	conds  []goproxy.ReqCondition
+
+	mu sync.Mutex
+	tr *http.Transport
+}
+
+func (r *tunnelRoute) match(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	for _, cond := range r.conds {
+		if !cond.HandleReq(req, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// transport returns the transport of the route, a copy of the transport of
+// proxy dialing through the tunnel, directly to the destinations.
+func (r *tunnelRoute) transport(proxy *goproxy.ProxyHttpServer) *http.Transport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tr == nil {
+		r.tr = proxy.Tr.Clone()
+		r.tr.Proxy = nil
+		r.tr.DialContext = r.tunnel.DialContext
+		r.tr.DialTLSContext = nil
+	}
+	return r.tr
+}
+
+// Tunnels routes the requests, and the CONNECT tunnels, to the first Tunnel
+// whose conditions they match, the others going out as usual, for a split
+// tunnel without changing the routes of the OS:
+//
+//	tun, tnet, _ := netstack.CreateNetTUN(cfg.Addresses, cfg.DNS, cfg.MTU)
+//	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, ""))
+//	uapi, _ := cfg.UAPI()
+//	dev.IpcSet(uapi)
+//	dev.Up()
+//
+//	var tunnels egress.Tunnels
+//	tunnels.Add("corp", tnet, egress.Domains("corp.example.com"))
+//	tunnels.Add("corp", tnet, egress.Networks("10.0.0.0/8"))
+//	tunnels.Install(proxy)
+//
+// The routed requests go directly to their destinations through the
+// tunnel, ignoring the upstream proxy of the proxy transport. The CONNECT
+// tunnels are routed unless the proxy ConnectDial is set.
+type Tunnels struct {
+	mu     sync.RWMutex
+	routes []*tunnelRoute
+}
+
+// Add routes the requests matching all of conds to tunnel, named name in
+// the logs of the proxy. The routes are tried in the order they were
+// added.
+func (t *Tunnels) Add(name string, tunnel Tunnel, conds ...goproxy.ReqCondition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = append(t.routes, &tunnelRoute{name: name, tunnel: tunnel, conds: conds})
+}
+
+func (t *Tunnels) route(req *http.Request, ctx *goproxy.ProxyCtx) *tunnelRoute {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.routes {
+		if r.match(req, ctx) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Handler returns a ReqHandler sending the current request through its
+// tunnel, if any.
+func (t *Tunnels) Handler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if r := t.route(req, ctx); r != nil {
+			ctx.Logf("egress: %s routed to tunnel %s", req.URL.Host, r.name)
+			ctx.Transport = r.transport(ctx.Proxy)
+			ctx.Dialer = r.tunnel.DialContext
+		}
+		return req, nil
+	})
+}
+
+// ConnectHandler returns an HttpsHandler dialing the CONNECT tunnel through
+// its tunnel, if any. It never decides the fate of the request, so the
+// following CONNECT handlers are still executed.
+func (t *Tunnels) ConnectHandler() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if r := t.route(ctx.Req, ctx); r != nil {
+			ctx.Logf("egress: %s routed to tunnel %s", host, r.name)
+			ctx.Transport = r.transport(ctx.Proxy)
+			ctx.Dialer = r.tunnel.DialContext
+		}
+		return nil, host
+	})
+}
+
+// Install routes the requests and the CONNECT tunnels of proxy.
+func (t *Tunnels) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(t.Handler())
+	proxy.OnRequest().HandleConnect(t.ConnectHandler())
+}
+
+// CloseIdleConnections closes the idle connections of every tunnel.
+func (t *Tunnels) CloseIdleConnections() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.routes {
+		r.mu.Lock()
+		if r.tr != nil {
+			r.tr.CloseIdleConnections()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Domains returns a condition matching the requests to domains, or to
+// their subdomains.
+func Domains(domains ...string) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		host := strings.ToLower(strings.TrimSuffix(req.URL.Hostname(), "."))
+		for _, d := range domains {
+			d = strings.ToLower(d)
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Networks returns a condition matching the requests to the IP addresses of
+// the networks in CIDR notation. The hostnames aren't resolved. It panics
+// on an invalid network.
+func Networks(cidrs ...string) goproxy.ReqConditionFunc {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("egress: " + err.Error())
+		}
+		networks = append(networks, n)
+	}
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		ip := net.ParseIP(req.URL.Hostname())
+		if ip == nil {
+			return false
+		}
+		for _, n := range networks {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
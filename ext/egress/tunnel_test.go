@@ -0,0 +1,117 @@
+package egress_test
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/egress"
+)
+
+type countingTunnel struct {
+	dials int32
+}
+
+func (c *countingTunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	atomic.AddInt32(&c.dials, 1)
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func TestTunnels(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	tunnel := &countingTunnel{}
+	var tunnels egress.Tunnels
+	tunnels.Add("test", tunnel, egress.Networks("127.0.0.0/8"), goproxy.UrlHasPrefix("/tunnel"))
+	proxy := goproxy.NewProxyHttpServer()
+	tunnels.Install(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, path := range []string{"/tunnel", "/direct", "/tunnel"} {
+		resp, err := client.Get(backend.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	// The connection through the tunnel is kept alive.
+	if n := atomic.LoadInt32(&tunnel.dials); n != 1 {
+		t.Errorf("Expected 1 dial through the tunnel, got %d", n)
+	}
+	tunnels.CloseIdleConnections()
+}
+
+func TestDomains(t *testing.T) {
+	cond := egress.Domains("Example.com")
+	for host, match := range map[string]bool{
+		"example.com":     true,
+		"www.example.com": true,
+		"notexample.com":  false,
+		"example.org":     false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		if cond(req, nil) != match {
+			t.Errorf("%s: expected match %v", host, match)
+		}
+	}
+}
+
+func TestWireGuardConfig(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	cfg, err := egress.ParseWireGuardConfig(strings.NewReader(`
+[Interface]
+PrivateKey = ` + key + `
+Address = 10.0.0.2/32, fd00::2/128
+DNS = 10.0.0.1, corp.example.com
+PostUp = iptables -A FORWARD
+# A comment.
+
+[Peer]
+PublicKey = ` + key + `
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.0.0.0/8, fd00::/64
+PersistentKeepalive = 25
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Addresses) != 2 || cfg.Addresses[0].String() != "10.0.0.2" || len(cfg.DNS) != 1 || cfg.MTU != 1420 {
+		t.Errorf("Unexpected interface %+v", cfg)
+	}
+	uapi, err := cfg.UAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := strings.Repeat("0", 64)
+	expected := "private_key=" + zero + "\nreplace_peers=true\npublic_key=" + zero +
+		"\nendpoint=192.0.2.1:51820\npersistent_keepalive_interval=25\nreplace_allowed_ips=true\nallowed_ip=10.0.0.0/8\nallowed_ip=fd00::/64\n"
+	if uapi != expected {
+		t.Errorf("Unexpected UAPI configuration:\n%s", uapi)
+	}
+
+	for _, invalid := range []string{
+		"[Interface]\nPrivateKey = short\n",
+		"[Interface]\nAddress = 10.0.0.2\n",
+		"[Interface]\nPrivateKey = " + key + "\n[Peer]\nEndpoint = 192.0.2.1:1\n",
+		"[Nope]\n",
+	} {
+		if _, err := egress.ParseWireGuardConfig(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
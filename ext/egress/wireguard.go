@@ -0,0 +1,212 @@
+package egress
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// WireGuardConfig is the configuration of a WireGuard interface, in the
+// format of wg-quick, for the callers to establish the tunnel of Tunnels
+// with wireguard-go: it only holds the configuration, and is no Tunnel.
+type WireGuardConfig struct {
+	PrivateKey []byte
+	ListenPort int
+	// Addresses and DNS are the addresses of the interface and its DNS
+	// servers, as given to netstack.CreateNetTUN.
+	Addresses []netip.Addr
+	DNS       []netip.Addr
+	// MTU is the MTU of the interface, 1420 by default.
+	MTU   int
+	Peers []WireGuardPeer
+}
+
+// WireGuardPeer is a peer of a WireGuardConfig.
+type WireGuardPeer struct {
+	PublicKey    []byte
+	PresharedKey []byte
+	// Endpoint is the host and port of the peer.
+	Endpoint            string
+	AllowedIPs          []netip.Prefix
+	PersistentKeepalive int
+}
+
+func parseKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid key %q", value)
+	}
+	return key, nil
+}
+
+// ParseWireGuardConfig parses the configuration of a WireGuard interface, in
+// the format of wg-quick. The options of wg-quick configuring the system,
+// such as PostUp, are ignored.
+func ParseWireGuardConfig(r io.Reader) (*WireGuardConfig, error) {
+	cfg := &WireGuardConfig{MTU: 1420}
+	var peer *WireGuardPeer
+	section := ""
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.ToLower(strings.TrimSpace(text[1 : len(text)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				cfg.Peers = append(cfg.Peers, WireGuardPeer{})
+				peer = &cfg.Peers[len(cfg.Peers)-1]
+			default:
+				return nil, fmt.Errorf("egress: line %d: unknown section %q", line, section)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("egress: line %d: expected key = value", line)
+		}
+		if err := cfg.set(section, peer, strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("egress: line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cfg.PrivateKey == nil {
+		return nil, fmt.Errorf("egress: no PrivateKey")
+	}
+	for i, p := range cfg.Peers {
+		if p.PublicKey == nil {
+			return nil, fmt.Errorf("egress: peer %d: no PublicKey", i+1)
+		}
+	}
+	return cfg, nil
+}
+
+// list splits the values separated by commas.
+func list(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func (cfg *WireGuardConfig) set(section string, peer *WireGuardPeer, key, value string) error {
+	var err error
+	switch section + "." + key {
+	case "interface.privatekey":
+		cfg.PrivateKey, err = parseKey(value)
+	case "interface.listenport":
+		cfg.ListenPort, err = strconv.Atoi(value)
+	case "interface.mtu":
+		cfg.MTU, err = strconv.Atoi(value)
+	case "interface.address":
+		for _, v := range list(value) {
+			var p netip.Prefix
+			if p, err = netip.ParsePrefix(v); err != nil {
+				var addr netip.Addr
+				if addr, err = netip.ParseAddr(v); err != nil {
+					return err
+				}
+				p = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			cfg.Addresses = append(cfg.Addresses, p.Addr())
+		}
+	case "interface.dns":
+		for _, v := range list(value) {
+			// The names are search domains, of no use to the netstack.
+			if addr, err := netip.ParseAddr(v); err == nil {
+				cfg.DNS = append(cfg.DNS, addr)
+			}
+		}
+	case "peer.publickey":
+		peer.PublicKey, err = parseKey(value)
+	case "peer.presharedkey":
+		peer.PresharedKey, err = parseKey(value)
+	case "peer.endpoint":
+		if _, _, err = net.SplitHostPort(value); err == nil {
+			peer.Endpoint = value
+		}
+	case "peer.allowedips":
+		for _, v := range list(value) {
+			var p netip.Prefix
+			if p, err = netip.ParsePrefix(v); err != nil {
+				return err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, p)
+		}
+	case "peer.persistentkeepalive":
+		if value != "off" {
+			peer.PersistentKeepalive, err = strconv.Atoi(value)
+		}
+	case "interface.table", "interface.preup", "interface.postup", "interface.predown", "interface.postdown", "interface.saveconfig", "interface.fwmark":
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return err
+}
+
+// UAPI returns the configuration in the format of the userspace API of
+// WireGuard, as set by the IpcSet of the wireguard-go devices. The
+// hostnames of the endpoints are resolved.
+func (cfg *WireGuardConfig) UAPI() (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(cfg.PrivateKey))
+	if cfg.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", cfg.ListenPort)
+	}
+	b.WriteString("replace_peers=true\n")
+	for _, p := range cfg.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(p.PublicKey))
+		if p.PresharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hex.EncodeToString(p.PresharedKey))
+		}
+		if p.Endpoint != "" {
+			endpoint, err := resolveEndpoint(p.Endpoint)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "endpoint=%s\n", endpoint)
+		}
+		if p.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", p.PersistentKeepalive)
+		}
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, ip := range p.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", ip)
+		}
+	}
+	return b.String(), nil
+}
+
+// resolveEndpoint returns endpoint with the address of its host, since the
+// userspace API only accepts addresses.
+func resolveEndpoint(endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return endpoint, nil
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return "", fmt.Errorf("egress: endpoint %s: %w", endpoint, err)
+	}
+	return net.JoinHostPort(addrs[0], port), nil
+}
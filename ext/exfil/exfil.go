@@ -0,0 +1,464 @@
+// Package exfil detects the possible exfiltrations, tracking the volume and
+// the entropy of the outbound traffic of every client over sliding
+// windows:
+//
+//	d := exfil.New()
+//	d.Install(proxy)
+//	proxy.Subscribe(alert, goproxy.EventAnomalyDetected)
+//
+// A Detector raises an Alert when a client sends more than MaxBytes over
+// the window, more than MaxHighEntropyBytes of payloads looking encrypted
+// or compressed, or more to a destination than BaselineFactor times the
+// baseline of the destination, learned from the windows of all its
+// clients. The alerts are published as goproxy.EventAnomalyDetected, their
+// Err being the Alert.
+//
+// The requests of the MITM'd tunnels are measured as they are sent, the
+// opaque tunnels by volume only, with the bytes read from their clients
+// once closed, for the listeners wrapped by goproxy.TrackListener.
+package exfil
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// The kinds of the alerts.
+const (
+	KindVolume   = "volume"
+	KindEntropy  = "entropy"
+	KindBaseline = "baseline"
+)
+
+// Alert is a possible exfiltration.
+type Alert struct {
+	Kind   string
+	Client string
+	// Destination is the host of the alerts of KindBaseline, and the last
+	// destination of the others.
+	Destination string
+	// Bytes are the bytes of the kind of the alert sent over Window.
+	Bytes  int64
+	Window time.Duration
+	// Baseline is the baseline of the destination of KindBaseline, in
+	// bytes per window.
+	Baseline float64
+}
+
+func (a *Alert) Error() string {
+	msg := fmt.Sprintf("exfil: %s of %s: %d bytes in %v to %s", a.Kind, a.Client, a.Bytes, a.Window, a.Destination)
+	if a.Kind == KindBaseline {
+		msg += fmt.Sprintf(", baseline %.0f", a.Baseline)
+	}
+	return msg
+}
+
+// DefaultEntropyExempt are the media types of the payloads compressed by
+// nature, whose entropy isn't measured.
+var DefaultEntropyExempt = []string{
+	"image/", "video/", "audio/", "font/",
+	"application/zip", "application/gzip", "application/x-gzip", "application/pdf",
+	"application/octet-stream",
+}
+
+// Detector tracks the outbound traffic of the requests it handles.
+type Detector struct {
+	// Window is the sliding window, 5 minutes by default.
+	Window time.Duration
+	// MaxBytes bounds the bytes sent by a client over Window, 100 MiB by
+	// default.
+	MaxBytes int64
+	// EntropyThreshold is the entropy, in bits per byte, of the payloads
+	// looking encrypted or compressed, 7.5 by default.
+	EntropyThreshold float64
+	// MinEntropySize is the size of the payloads whose entropy is
+	// measured, 1 KiB by default.
+	MinEntropySize int64
+	// MaxHighEntropyBytes bounds the bytes of the payloads above
+	// EntropyThreshold sent by a client over Window, 10 MiB by default.
+	MaxHighEntropyBytes int64
+	// EntropyExempt are the media types, or their prefixes ending with /,
+	// whose entropy isn't measured, DefaultEntropyExempt when nil.
+	EntropyExempt []string
+	// BaselineFactor is the factor of the baseline of a destination above
+	// which a client sending to it is alerted, 10 by default.
+	BaselineFactor float64
+	// MinBaselineBytes are the bytes sent to a destination over Window
+	// below which it isn't compared to its baseline, 1 MiB by default.
+	MinBaselineBytes int64
+	// MinBaselineSamples is the number of windows learned before the
+	// baseline of a destination is used, 10 by default.
+	MinBaselineSamples int
+	// ClientKey returns the client of the requests, by default the name of
+	// their identity or their IP address, as for the opaque tunnels.
+	ClientKey func(ctx *goproxy.ProxyCtx) string
+	// OnAlert, when set, is called with the alerts, besides their events.
+	OnAlert func(a *Alert)
+	Clock   goproxy.Clock
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	baselines map[string]*baseline
+	lastSweep time.Time
+}
+
+// New returns a Detector with the default settings.
+func New() *Detector {
+	return &Detector{}
+}
+
+// buckets is the number of buckets of the sliding windows.
+const buckets = 10
+
+// series is a sum over a sliding window, made of buckets.
+type series struct {
+	counts [buckets]int64
+	// start is the start of the bucket cur.
+	start time.Time
+	cur   int
+}
+
+func (s *series) advance(now time.Time, width time.Duration) {
+	if s.start.IsZero() {
+		s.start = now.Truncate(width)
+		return
+	}
+	for n := 0; n < buckets && now.Sub(s.start) >= width; n++ {
+		s.cur = (s.cur + 1) % buckets
+		s.counts[s.cur] = 0
+		s.start = s.start.Add(width)
+	}
+	if now.Sub(s.start) >= width {
+		s.start = now.Truncate(width)
+	}
+}
+
+func (s *series) add(now time.Time, width time.Duration, n int64) int64 {
+	s.advance(now, width)
+	s.counts[s.cur] += n
+	return s.sum()
+}
+
+func (s *series) sum() int64 {
+	var sum int64
+	for _, c := range s.counts {
+		sum += c
+	}
+	return sum
+}
+
+// baseline is the mean of the bytes sent to a destination by its clients
+// per window.
+type baseline struct {
+	mean    float64
+	samples int
+}
+
+// destination is the traffic of a client to a destination. The window
+// learned, tumbling, is sampled into the baseline of the destination once
+// elapsed.
+type destination struct {
+	sent         series
+	learnedStart time.Time
+	learned      int64
+}
+
+type client struct {
+	sent        series
+	highEntropy series
+	dests       map[string]*destination
+	// alerted are the last alerts, by kind and destination, not to repeat
+	// them within a window.
+	alerted map[string]time.Time
+	last    time.Time
+}
+
+func (d *Detector) now() time.Time {
+	if d.Clock != nil {
+		return d.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (d *Detector) window() time.Duration {
+	if d.Window > 0 {
+		return d.Window
+	}
+	return 5 * time.Minute
+}
+
+func orDefault(v, def int64) int64 {
+	if v > 0 {
+		return v
+	}
+	return def
+}
+
+func (d *Detector) factor() float64 {
+	if d.BaselineFactor > 0 {
+		return d.BaselineFactor
+	}
+	return 10
+}
+
+// Baseline returns the baseline of destination, in bytes per window, and
+// whether it is learned.
+func (d *Detector) Baseline(destination string) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b := d.baselines[strings.ToLower(destination)]
+	if b == nil {
+		return 0, false
+	}
+	return b.mean, b.samples >= d.minSamples()
+}
+
+func (d *Detector) minSamples() int {
+	if d.MinBaselineSamples > 0 {
+		return d.MinBaselineSamples
+	}
+	return 10
+}
+
+// learn samples the window of dest, once elapsed, into the baseline of
+// host.
+func (d *Detector) learn(host string, dest *destination, now time.Time) {
+	if now.Sub(dest.learnedStart) < d.window() {
+		return
+	}
+	if dest.learned > 0 {
+		b := d.baselines[host]
+		if b == nil {
+			b = &baseline{}
+			d.baselines[host] = b
+		}
+		// The mean of the first samples, then their moving average.
+		b.samples++
+		alpha := 1 / float64(b.samples)
+		if alpha < 0.1 {
+			alpha = 0.1
+		}
+		b.mean += alpha * (float64(dest.learned) - b.mean)
+	}
+	dest.learnedStart, dest.learned = now, 0
+}
+
+// sweep forgets the clients idle for two windows.
+func (d *Detector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.window() {
+		return
+	}
+	d.lastSweep = now
+	for key, c := range d.clients {
+		if now.Sub(c.last) > 2*d.window() {
+			for host, dest := range c.dests {
+				d.learn(host, dest, now)
+			}
+			delete(d.clients, key)
+		}
+	}
+}
+
+// Observe records that key sent n bytes to host, highEntropy telling
+// whether they look encrypted or compressed, and returns the alerts raised.
+func (d *Detector) Observe(key, host string, n int64, highEntropy bool) []*Alert {
+	host = strings.ToLower(host)
+	now := d.now()
+	width := d.window() / buckets
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.clients == nil {
+		d.clients = make(map[string]*client)
+		d.baselines = make(map[string]*baseline)
+	}
+	d.sweep(now)
+	c := d.clients[key]
+	if c == nil {
+		c = &client{dests: make(map[string]*destination), alerted: make(map[string]time.Time)}
+		d.clients[key] = c
+	}
+	c.last = now
+	dest := c.dests[host]
+	if dest == nil {
+		dest = &destination{learnedStart: now}
+		c.dests[host] = dest
+	}
+
+	var alerts []*Alert
+	alert := func(kind string, bytes int64, baseline float64) {
+		id := kind
+		if kind == KindBaseline {
+			id += " " + host
+		}
+		if last, ok := c.alerted[id]; ok && now.Sub(last) < d.window() {
+			return
+		}
+		c.alerted[id] = now
+		alerts = append(alerts, &Alert{Kind: kind, Client: key, Destination: host, Bytes: bytes, Window: d.window(), Baseline: baseline})
+	}
+
+	if sent := c.sent.add(now, width, n); sent > orDefault(d.MaxBytes, 100<<20) {
+		alert(KindVolume, sent, 0)
+	}
+	if highEntropy {
+		if sent := c.highEntropy.add(now, width, n); sent > orDefault(d.MaxHighEntropyBytes, 10<<20) {
+			alert(KindEntropy, sent, 0)
+		}
+	}
+	d.learn(host, dest, now)
+	dest.learned += n
+	sent := dest.sent.add(now, width, n)
+	if b := d.baselines[host]; b != nil && b.samples >= d.minSamples() &&
+		sent > orDefault(d.MinBaselineBytes, 1<<20) && float64(sent) > d.factor()*b.mean {
+		alert(KindBaseline, sent, b.mean)
+	}
+	return alerts
+}
+
+func (d *Detector) clientKey(ctx *goproxy.ProxyCtx) string {
+	if d.ClientKey != nil {
+		return d.ClientKey(ctx)
+	}
+	if ctx.Identity != nil && ctx.Identity.Name != "" {
+		return ctx.Identity.Name
+	}
+	return remoteHost(ctx.Req.RemoteAddr)
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (d *Detector) exempt(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	exempt := d.EntropyExempt
+	if exempt == nil {
+		exempt = DefaultEntropyExempt
+	}
+	for _, e := range exempt {
+		if mediaType == e || (strings.HasSuffix(e, "/") && strings.HasPrefix(mediaType, e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Entropy returns the Shannon entropy of the bytes counted by counts, in
+// bits per byte.
+func Entropy(counts *[256]int64) float64 {
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	var h float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(total)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+func (d *Detector) raise(alerts []*Alert, publish func(e *goproxy.Event)) {
+	for _, a := range alerts {
+		if d.OnAlert != nil {
+			d.OnAlert(a)
+		}
+		publish(&goproxy.Event{Type: goproxy.EventAnomalyDetected, Rule: "exfil", Err: a})
+	}
+}
+
+// requestSize returns the size of the request line and the header of req.
+func requestSize(req *http.Request) int64 {
+	n := int64(len(req.Method) + len(req.URL.RequestURI()) + len(req.Proto) + 4)
+	for k, vv := range req.Header {
+		for _, v := range vv {
+			n += int64(len(k) + len(v) + 4)
+		}
+	}
+	return n
+}
+
+// Handle implements goproxy.ReqHandler, measuring the request as its body
+// is sent.
+func (d *Detector) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	key, host := d.clientKey(ctx), req.URL.Hostname()
+	header := requestSize(req)
+	if req.Body == nil || req.Body == http.NoBody {
+		d.raise(d.Observe(key, host, header, false), ctx.Publish)
+		return req, nil
+	}
+	measure := !d.exempt(req.Header.Get("Content-Type"))
+	body := &meter{ReadCloser: req.Body, measure: measure}
+	body.done = func() {
+		minSize := orDefault(d.MinEntropySize, 1<<10)
+		threshold := d.EntropyThreshold
+		if threshold <= 0 {
+			threshold = 7.5
+		}
+		high := measure && body.n >= minSize && Entropy(&body.counts) >= threshold
+		d.raise(d.Observe(key, host, header+body.n, high), ctx.Publish)
+	}
+	req.Body = body
+	return req, nil
+}
+
+// meter counts the bytes of a body, and their histogram when measure is
+// set, calling done once closed.
+type meter struct {
+	io.ReadCloser
+	measure bool
+	n       int64
+	counts  [256]int64
+	done    func()
+	once    sync.Once
+}
+
+func (m *meter) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.n += int64(n)
+	if m.measure {
+		for _, b := range p[:n] {
+			m.counts[b]++
+		}
+	}
+	return n, err
+}
+
+func (m *meter) Close() error {
+	m.once.Do(m.done)
+	return m.ReadCloser.Close()
+}
+
+// connClosed measures the opaque tunnels, by volume only, since their
+// bytes are encrypted anyway.
+func (d *Detector) connClosed(proxy *goproxy.ProxyHttpServer, e *goproxy.Event) {
+	if e.Conn == nil || e.Conn.Kind != goproxy.ConnTunnel || e.Conn.BytesIn == 0 {
+		return
+	}
+	key := e.Conn.User
+	if key == "" {
+		key = remoteHost(e.Conn.RemoteAddr)
+	}
+	host := remoteHost(e.Conn.Target)
+	d.raise(d.Observe(key, host, e.Conn.BytesIn, false), proxy.Publish)
+}
+
+// Install measures the requests and the opaque tunnels of proxy.
+func (d *Detector) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(d)
+	proxy.Subscribe(func(e *goproxy.Event) { d.connClosed(proxy, e) }, goproxy.EventConnClosed)
+}
@@ -0,0 +1,104 @@
+package exfil_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/exfil"
+)
+
+func TestVolume(t *testing.T) {
+	clock := goproxy.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := &exfil.Detector{Window: time.Minute, MaxBytes: 1000, Clock: clock}
+	for i := 0; i < 9; i++ {
+		if alerts := d.Observe("alice", "upload.example.com", 100, false); len(alerts) != 0 {
+			t.Fatalf("Expected no alert under MaxBytes, got %v", alerts[0])
+		}
+		clock.Advance(time.Second)
+	}
+	alerts := d.Observe("alice", "other.example.com", 200, false)
+	if len(alerts) != 1 || alerts[0].Kind != exfil.KindVolume || alerts[0].Bytes != 1100 || alerts[0].Destination != "other.example.com" {
+		t.Fatalf("Expected the volume alert, got %v", alerts)
+	}
+	if alerts := d.Observe("alice", "other.example.com", 200, false); len(alerts) != 0 {
+		t.Error("Expected the alert not to repeat within the window")
+	}
+	if alerts := d.Observe("bob", "other.example.com", 200, false); len(alerts) != 0 {
+		t.Error("Expected the other clients not to be alerted")
+	}
+
+	// The window slides.
+	clock.Advance(2 * time.Minute)
+	if alerts := d.Observe("alice", "upload.example.com", 900, false); len(alerts) != 0 {
+		t.Errorf("Expected the old traffic to be forgotten, got %v", alerts)
+	}
+	clock.Advance(time.Minute)
+	if alerts := d.Observe("alice", "upload.example.com", 1001, false); len(alerts) != 1 {
+		t.Errorf("Expected the volume alert once the window elapsed, got %v", alerts)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	clock := goproxy.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := &exfil.Detector{Window: time.Minute, MinBaselineBytes: 1000, MinBaselineSamples: 5, Clock: clock}
+	// The clients usually send 500 bytes per window to the destination.
+	for i := 0; i < 6; i++ {
+		for c := 0; c < 3; c++ {
+			d.Observe("client"+strconv.Itoa(c), "api.example.com", 500, false)
+		}
+		clock.Advance(time.Minute)
+	}
+	if b, ok := d.Baseline("API.example.com"); !ok || b != 500 {
+		t.Fatalf("Expected the baseline of the destination, got %v %v", b, ok)
+	}
+	if alerts := d.Observe("client0", "api.example.com", 4000, false); len(alerts) != 0 {
+		t.Errorf("Expected no alert under the factor of the baseline, got %v", alerts)
+	}
+	alerts := d.Observe("client0", "api.example.com", 2000, false)
+	if len(alerts) != 1 || alerts[0].Kind != exfil.KindBaseline || alerts[0].Baseline != 500 {
+		t.Fatalf("Expected the baseline alert, got %v", alerts)
+	}
+	if alerts := d.Observe("client1", "new.example.com", 100000, false); len(alerts) != 0 {
+		t.Error("Expected the destinations without baseline not to be compared")
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	var events []*goproxy.Event
+	proxy.Subscribe(func(e *goproxy.Event) { events = append(events, e) }, goproxy.EventAnomalyDetected)
+	d := &exfil.Detector{MaxHighEntropyBytes: 10000}
+	random := make([]byte, 8000)
+	rand.Read(random)
+
+	upload := func(contentType string, body []byte) {
+		req := httptest.NewRequest(http.MethodPost, "http://paste.example.com/", bytes.NewReader(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("Content-Type", contentType)
+		ctx := &goproxy.ProxyCtx{Req: req, Proxy: proxy}
+		req, _ = d.Handle(req, ctx)
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	upload("text/plain", bytes.Repeat([]byte("plain text "), 1000))
+	upload("image/jpeg", random)
+	upload("text/plain", random)
+	if len(events) != 0 {
+		t.Fatalf("Expected no alert under MaxHighEntropyBytes, got %v", events[0].Err)
+	}
+	upload("application/json", random)
+	if len(events) != 1 {
+		t.Fatalf("Expected the entropy alert, got %d", len(events))
+	}
+	alert, ok := events[0].Err.(*exfil.Alert)
+	if !ok || alert.Kind != exfil.KindEntropy || alert.Client != "10.0.0.1" || events[0].Rule != "exfil" || events[0].Req == nil {
+		t.Errorf("Expected the entropy alert of the client, got %+v", events[0])
+	}
+}
@@ -0,0 +1,161 @@
+// Package fronting detects the domain fronting of the MITM'd requests: the
+// SNI of the client handshake naming a host, and the Host header of the
+// requests another one. The fronted requests are allowed, denied or logged:
+//
+//	detector := fronting.New(fronting.Deny)
+//	detector.Allow("cdn.example.com", "*")
+//	detector.Install(proxy)
+//
+// Allowed requests are sent to the host of their CONNECT, with their Host
+// header, so that fronting can be enabled deliberately.
+package fronting
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Action is the decision on a fronted request.
+type Action int
+
+const (
+	// Log logs the fronted requests, and sends them.
+	Log Action = iota
+	// Deny answers the fronted requests with 403 Forbidden.
+	Deny
+	// Allow sends the fronted requests silently.
+	Allow
+)
+
+func (a Action) String() string {
+	switch a {
+	case Deny:
+		return "deny"
+	case Allow:
+		return "allow"
+	default:
+		return "log"
+	}
+}
+
+// Event is a fronted request.
+type Event struct {
+	// SNI is the server name of the client handshake.
+	SNI string
+	// Host is the host of the request.
+	Host   string
+	Action Action
+	Req    *http.Request
+}
+
+// Detector compares the SNI and the Host of the MITM'd requests.
+type Detector struct {
+	// Action is the decision on the fronted requests not allowed by Allow.
+	Action Action
+	// SameDomain doesn't consider fronting the requests whose SNI and Host
+	// share their registrable domain, such as www.example.com and
+	// api.example.com, which the clients reuse connections for.
+	SameDomain bool
+	// OnFronting is called with every fronted request.
+	OnFronting func(Event)
+
+	mu      sync.RWMutex
+	allowed map[string]map[string]bool
+}
+
+// New returns a Detector of action, considering the hosts of a same domain
+// as not fronted.
+func New(action Action) *Detector {
+	return &Detector{Action: action, SameDomain: true}
+}
+
+// Allow allows the requests to host fronted by the SNI front, or to any
+// host when host is "*".
+func (d *Detector) Allow(front, host string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.allowed == nil {
+		d.allowed = make(map[string]map[string]bool)
+	}
+	front = strings.ToLower(front)
+	if d.allowed[front] == nil {
+		d.allowed[front] = make(map[string]bool)
+	}
+	d.allowed[front][strings.ToLower(host)] = true
+}
+
+func (d *Detector) isAllowed(front, host string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	hosts := d.allowed[front]
+	return hosts["*"] || hosts[host]
+}
+
+func hostname(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func sameDomain(a, b string) bool {
+	da, err := publicsuffix.EffectiveTLDPlusOne(a)
+	if err != nil {
+		return false
+	}
+	db, err := publicsuffix.EffectiveTLDPlusOne(b)
+	return err == nil && da == db
+}
+
+// Fronted returns the SNI and the host of a request, and whether they
+// differ. Requests without SNI, such as the plain HTTP ones, aren't
+// fronted.
+func (d *Detector) Fronted(req *http.Request, ctx *goproxy.ProxyCtx) (sni, host string, fronted bool) {
+	state := ctx.ClientTLS()
+	if state == nil || state.ServerName == "" {
+		return "", "", false
+	}
+	sni = hostname(state.ServerName)
+	host = hostname(req.Host)
+	if host == "" {
+		host = hostname(req.URL.Host)
+	}
+	if host == sni || (d.SameDomain && sameDomain(host, sni)) {
+		return sni, host, false
+	}
+	return sni, host, true
+}
+
+// Handle applies the action to the fronted requests.
+func (d *Detector) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	sni, host, fronted := d.Fronted(req, ctx)
+	if !fronted {
+		return req, nil
+	}
+	action := d.Action
+	if d.isAllowed(sni, host) {
+		action = Allow
+	}
+	if d.OnFronting != nil {
+		d.OnFronting(Event{SNI: sni, Host: host, Action: action, Req: req})
+	}
+	switch action {
+	case Deny:
+		ctx.Warnf("Denying %s fronted by %s", host, sni)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Domain fronting is not allowed\n")
+	case Log:
+		ctx.Warnf("Request to %s fronted by %s", host, sni)
+	}
+	return req, nil
+}
+
+// Install checks the requests of proxy.
+func (d *Detector) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(d.Handle)
+}
@@ -0,0 +1,68 @@
+package fronting_test
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/fronting"
+)
+
+func request(sni, host string) (*http.Request, *goproxy.ProxyCtx) {
+	req := httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+	// httptest sets a TLS state for the https URLs.
+	req.TLS = nil
+	if sni != "" {
+		req.TLS = &tls.ConnectionState{ServerName: sni}
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Logger = log.New(io.Discard, "", 0)
+	return req, &goproxy.ProxyCtx{Req: req, Proxy: proxy}
+}
+
+func TestDetector(t *testing.T) {
+	d := fronting.New(fronting.Deny)
+	d.Allow("cdn.example.net", "hidden.example.org")
+	var events []fronting.Event
+	d.OnFronting = func(e fronting.Event) {
+		events = append(events, e)
+	}
+
+	for _, tt := range []struct {
+		sni, host string
+		status    int
+		action    fronting.Action
+	}{
+		{"www.example.com", "www.example.com", 0, -1},
+		{"", "www.example.com", 0, -1},
+		{"www.example.com", "api.example.com:443", 0, -1},
+		{"front.example.net", "hidden.example.org", http.StatusForbidden, fronting.Deny},
+		{"cdn.example.net", "hidden.example.org", 0, fronting.Allow},
+		{"cdn.example.net", "other.example.org", http.StatusForbidden, fronting.Deny},
+	} {
+		events = nil
+		req, ctx := request(tt.sni, tt.host)
+		_, resp := d.Handle(req, ctx)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		if status != tt.status {
+			t.Errorf("Expected status %d for %s fronted by %q, got %d", tt.status, tt.host, tt.sni, status)
+		}
+		if tt.action < 0 && len(events) > 0 {
+			t.Errorf("Expected %s not to be fronted by %q", tt.host, tt.sni)
+		} else if tt.action >= 0 && (len(events) != 1 || events[0].Action != tt.action) {
+			t.Errorf("Expected %s fronted by %q to be %s, got %v", tt.host, tt.sni, tt.action, events)
+		}
+	}
+
+	d.SameDomain = false
+	if _, _, fronted := d.Fronted(request("www.example.com", "api.example.com")); !fronted {
+		t.Error("Expected the hosts of a same domain to be fronted")
+	}
+}
@@ -3,17 +3,32 @@ module github.com/InsideOutSec/goproxy/ext
 go 1.20
 
 require (
-	github.com/InsideOutSec/goproxy v0.0.0-20250131112234-4c355f472587
+	github.com/InsideOutSec/goproxy v0.0.0-20261014092056-3d9a2a1d6b76
+	github.com/go-ldap/ldap/v3 v3.4.10
+	github.com/jcmturner/gofork v1.7.6
+	github.com/jcmturner/gokrb5/v8 v8.4.4
+	github.com/klauspost/compress v1.17.9
 	github.com/stretchr/testify v1.10.0
 	github.com/vadimi/go-http-ntlm/v2 v2.5.0
+	github.com/vadimi/go-ntlm v1.2.1
+	go.etcd.io/bbolt v1.3.8
+	golang.org/x/crypto v0.32.0
 	golang.org/x/net v0.34.0
 	golang.org/x/text v0.21.0
 )
 
 require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-asn1-ber/asn1-ber v1.5.7 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/go-uuid v1.0.3 // indirect
+	github.com/jcmturner/aescts/v2 v2.0.0 // indirect
+	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
+	github.com/jcmturner/goidentity/v6 v6.0.1 // indirect
+	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/vadimi/go-ntlm v1.2.1 // indirect
+	golang.org/x/sys v0.29.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
@@ -5,6 +5,7 @@ import (
     "time"
 
     "github.com/InsideOutSec/goproxy"
+    "github.com/InsideOutSec/goproxy/ext/redact"
 )
 
 // ExportFunc is a function type that users can implement to handle exported entries
@@ -16,6 +17,7 @@ type Logger struct {
     exportInterval  time.Duration
     exportThreshold int
     dataCh          chan Entry
+    redactor        *redact.Redactor
 }
 
 // LoggerOption is a function type for configuring the Logger
@@ -80,6 +82,9 @@ func (l *Logger) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Re
         },
     }
     entry.fillIPAddress(ctx.Req)
+    if l.redactor != nil {
+        redactEntry(l.redactor, &entry)
+    }
     
     l.dataCh <- entry 
     return resp
@@ -6,11 +6,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/redact"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -215,3 +217,51 @@ func TestHarLoggerExportInterval(t *testing.T) {
     assert.Equal(t, 3, len(exports[0]), "Should have exported 3 entries")
 }
 
+
+func TestHarLoggerRedactor(t *testing.T) {
+    var wg sync.WaitGroup
+    wg.Add(1)
+
+    var exportedEntries []Entry
+    exportFunc := func(entries []Entry) {
+        exportedEntries = append(exportedEntries, entries...)
+        wg.Done()
+    }
+
+    redactor := redact.Default.Clone()
+    redactor.BodyPatterns = []*regexp.Regexp{regexp.MustCompile(`"password":"([^"]*)"`)}
+    logger := NewLogger(exportFunc, WithExportThreshold(1), WithRedactor(redactor))
+    defer logger.Stop()
+
+    background := httptest.NewServer(ConstantHandler(`{"password":"hunter2"}`))
+    defer background.Close()
+
+    proxyServer := createTestProxy(logger)
+    defer proxyServer.Close()
+
+    client := createProxyClient(proxyServer.URL)
+    req, err := http.NewRequest(http.MethodGet, background.URL+"/?access_token=s3cr3t&page=2", nil)
+    require.NoError(t, err)
+    req.Header.Set("Authorization", "Bearer s3cr3t")
+    req.AddCookie(&http.Cookie{Name: "session", Value: "s3cr3t"})
+    resp, err := client.Do(req)
+    require.NoError(t, err)
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+
+    wg.Wait()
+    require.Len(t, exportedEntries, 1)
+    entry := exportedEntries[0]
+    assert.NotContains(t, entry.Request.Url, "s3cr3t")
+    assert.Contains(t, entry.Request.Url, "page=2")
+    for _, h := range entry.Request.Headers {
+        assert.NotContains(t, h.Value, "s3cr3t", h.Name)
+    }
+    for _, q := range entry.Request.QueryString {
+        assert.NotContains(t, q.Value, "s3cr3t", q.Name)
+    }
+    for _, c := range entry.Request.Cookies {
+        assert.Equal(t, redact.Mask, c.Value)
+    }
+    assert.Equal(t, `{"password":"[redacted]"}`, entry.Response.Content.Text)
+}
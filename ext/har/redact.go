@@ -0,0 +1,63 @@
+package har
+
+import (
+	"strings"
+
+	"github.com/InsideOutSec/goproxy/ext/redact"
+)
+
+// WithRedactor masks the secrets of the entries with r before they are
+// exported.
+func WithRedactor(r *redact.Redactor) LoggerOption {
+	return func(l *Logger) {
+		l.redactor = r
+	}
+}
+
+func redactPairs(r *redact.Redactor, pairs []NameValuePair, sensitive func(string) bool) {
+	for i := range pairs {
+		if sensitive(pairs[i].Name) {
+			pairs[i].Value = r.Masked()
+		} else {
+			pairs[i].Value = r.Text(pairs[i].Value)
+		}
+	}
+}
+
+func redactCookies(r *redact.Redactor, cookies []Cookie, header string) {
+	if !r.SensitiveHeader(header) {
+		return
+	}
+	for i := range cookies {
+		cookies[i].Value = r.HeaderValue(header, cookies[i].Value)
+	}
+}
+
+// redactEntry masks the secrets of e with r.
+func redactEntry(r *redact.Redactor, e *Entry) {
+	if req := e.Request; req != nil {
+		req.Url = r.URL(req.Url)
+		redactPairs(r, req.Headers, r.SensitiveHeader)
+		redactPairs(r, req.QueryString, r.SensitiveParam)
+		redactCookies(r, req.Cookies, "Cookie")
+		if pd := req.PostData; pd != nil {
+			if strings.HasPrefix(pd.MimeType, "application/x-www-form-urlencoded") {
+				pd.Text = r.Form(pd.Text)
+			}
+			pd.Text = r.Text(pd.Text)
+			for i := range pd.Params {
+				if r.SensitiveParam(pd.Params[i].Name) {
+					pd.Params[i].Value = r.Masked()
+				} else {
+					pd.Params[i].Value = r.Text(pd.Params[i].Value)
+				}
+			}
+		}
+	}
+	if resp := e.Response; resp != nil {
+		resp.RedirectUrl = r.URL(resp.RedirectUrl)
+		redactPairs(r, resp.Headers, r.SensitiveHeader)
+		redactCookies(r, resp.Cookies, "Set-Cookie")
+		resp.Content.Text = r.Text(resp.Content.Text)
+	}
+}
@@ -0,0 +1,242 @@
+// Package hashlist checks the SHA-256 of the downloads against lists of
+// hashes, such as those of the known malware:
+//
+//	malware := hashlist.NewList()
+//	malware.Load(feed)
+//	proxy.OnResponse().Do(&hashlist.Checker{Blocklist: malware})
+//
+// The bodies are hashed as they are streamed to the clients, without being
+// buffered: the last byte is held back until the digest is known, and the
+// downloads listed are then aborted, so that the clients never get them
+// whole. The digests are exposed with Digest once the bodies are read.
+package hashlist
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// List is a list of SHA-256 hashes, with their labels.
+type List struct {
+	mu     sync.RWMutex
+	hashes map[[sha256.Size]byte]string
+}
+
+// NewList returns an empty List.
+func NewList() *List {
+	return &List{hashes: make(map[[sha256.Size]byte]string)}
+}
+
+func parseDigest(digest string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	b, err := hex.DecodeString(digest)
+	if err != nil || len(b) != sha256.Size {
+		return sum, fmt.Errorf("hashlist: invalid SHA-256 %q", digest)
+	}
+	copy(sum[:], b)
+	return sum, nil
+}
+
+// Add adds the hexadecimal SHA-256 digest to the list, with label, such as
+// the name of the malware.
+func (l *List) Add(digest, label string) error {
+	sum, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hashes[sum] = label
+	return nil
+}
+
+// Remove removes digest from the list.
+func (l *List) Remove(digest string) {
+	sum, err := parseDigest(digest)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.hashes, sum)
+}
+
+// Len returns the number of hashes of the list.
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.hashes)
+}
+
+// Lookup returns the label of digest, and whether it is listed.
+func (l *List) Lookup(digest string) (string, bool) {
+	sum, err := parseDigest(digest)
+	if err != nil {
+		return "", false
+	}
+	return l.lookup(sum)
+}
+
+func (l *List) lookup(sum [sha256.Size]byte) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	label, ok := l.hashes[sum]
+	return label, ok
+}
+
+// Load reads a list made of lines such as
+//
+//	275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f eicar
+//
+// as written by sha256sum, the label being optional. Empty lines and lines
+// starting with # are ignored.
+func (l *List) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, label, _ := strings.Cut(line, " ")
+		if err := l.Add(digest, strings.TrimPrefix(strings.TrimSpace(label), "*")); err != nil {
+			return fmt.Errorf("hashlist: line %d: %w", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// ErrListed is the error of the bodies of the downloads aborted.
+var ErrListed = errors.New("hashlist: download blocked")
+
+// Checker checks the bodies of the responses it handles.
+type Checker struct {
+	// Blocklist are the hashes of the downloads blocked.
+	Blocklist *List
+	// Allowlist, when set, are the hashes of the only downloads allowed,
+	// and which aren't checked against the Blocklist.
+	Allowlist *List
+	// LogOnly logs the downloads which would be blocked, without blocking
+	// them.
+	LogOnly bool
+}
+
+type digestKey struct{}
+
+// Digest returns the hexadecimal SHA-256 of the body of the response of
+// ctx, empty until it is read whole.
+func Digest(ctx *goproxy.ProxyCtx) string {
+	digest, _ := ctx.Value(digestKey{}).(string)
+	return digest
+}
+
+// verdict returns the reason to block the body of sum, empty when it is
+// allowed.
+func (c *Checker) verdict(sum [sha256.Size]byte) string {
+	if c.Allowlist != nil {
+		if _, ok := c.Allowlist.lookup(sum); ok {
+			return ""
+		}
+		return "not in the allowlist"
+	}
+	if c.Blocklist != nil {
+		if label, ok := c.Blocklist.lookup(sum); ok {
+			if label == "" {
+				return "in the blocklist"
+			}
+			return "in the blocklist: " + label
+		}
+	}
+	return ""
+}
+
+// Handle implements goproxy.RespHandler, hashing the body of resp.
+func (c *Checker) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return resp
+	}
+	resp.Body = &digestReader{ReadCloser: resp.Body, h: sha256.New(), done: func(sum [sha256.Size]byte) error {
+		digest := hex.EncodeToString(sum[:])
+		ctx.SetValue(digestKey{}, digest)
+		reason := c.verdict(sum)
+		if reason == "" {
+			return nil
+		}
+		if c.LogOnly {
+			ctx.Logf("hashlist: %v (sha256 %s) would be blocked: %s", ctx.Req.URL, digest, reason)
+			return nil
+		}
+		ctx.Warnf("hashlist: aborting %v (sha256 %s): %s", ctx.Req.URL, digest, reason)
+		ctx.Error = &goproxy.ErrBlockedByRule{RuleID: "hashlist", Reason: reason}
+		return fmt.Errorf("%w: %s", ErrListed, reason)
+	}}
+	return resp
+}
+
+// digestReader hashes a body, holding its last byte back until done tells
+// whether it is allowed.
+type digestReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	done func(sum [sha256.Size]byte) error
+
+	held    byte
+	hasHeld bool
+	eof     bool
+	err     error
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if d.eof {
+		if !d.hasHeld {
+			return 0, io.EOF
+		}
+		p[0] = d.held
+		d.hasHeld = false
+		return 1, io.EOF
+	}
+	m, err := d.ReadCloser.Read(p)
+	d.h.Write(p[:m])
+	n := 0
+	if m > 0 {
+		last := p[m-1]
+		if d.hasHeld {
+			copy(p[1:m], p[:m-1])
+			p[0] = d.held
+			n = m
+		} else {
+			n = m - 1
+		}
+		d.held, d.hasHeld = last, true
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	d.eof = true
+	var sum [sha256.Size]byte
+	copy(sum[:], d.h.Sum(nil))
+	if d.err = d.done(sum); d.err != nil {
+		return n, d.err
+	}
+	if d.hasHeld && n < len(p) {
+		p[n] = d.held
+		d.hasHeld = false
+		return n + 1, io.EOF
+	}
+	return n, nil
+}
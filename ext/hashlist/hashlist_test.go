@@ -0,0 +1,118 @@
+package hashlist_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/hashlist"
+)
+
+const malware = "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"
+
+func sha(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestList(t *testing.T) {
+	l := hashlist.NewList()
+	err := l.Load(strings.NewReader("# malware\n" + sha(malware) + " *eicar.com\n\n" + sha("other") + "\n"))
+	if err != nil || l.Len() != 2 {
+		t.Fatalf("Expected 2 hashes, got %d: %v", l.Len(), err)
+	}
+	if label, ok := l.Lookup(strings.ToUpper(sha(malware))); !ok || label != "eicar.com" {
+		t.Errorf("Expected the label of the hash, got %q", label)
+	}
+	l.Remove(sha("other"))
+	if _, ok := l.Lookup(sha("other")); ok {
+		t.Error("Expected the hash to be removed")
+	}
+	if err := l.Load(strings.NewReader("d41d8cd98f00b204e9800998ecf8427e md5\n")); err == nil {
+		t.Error("Expected the MD5 to be rejected")
+	}
+}
+
+func TestChecker(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunked") != "" {
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+	defer upstream.Close()
+
+	blocklist := hashlist.NewList()
+	blocklist.Add(sha(malware), "eicar")
+	checker := &hashlist.Checker{Blocklist: blocklist}
+	var digests []string
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(checker)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		body := resp.Body
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{body, closerFunc(func() error {
+			digests = append(digests, hashlist.Digest(ctx))
+			return body.Close()
+		})}
+		return resp
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(body string, chunked bool) (string, error) {
+		u := upstream.URL + "/?body=" + url.QueryEscape(body)
+		if chunked {
+			u += "&chunked=1"
+		}
+		resp, err := client.Get(u)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	for _, chunked := range []bool{false, true} {
+		digests = nil
+		if body, err := get("clean", chunked); err != nil || body != "clean" {
+			t.Errorf("Expected the clean download, got %q: %v", body, err)
+		}
+		if body, err := get(malware, chunked); err == nil || body == malware {
+			t.Errorf("Expected the malware to be aborted, got %q", body)
+		}
+		if len(digests) != 2 || digests[0] != sha("clean") || digests[1] != sha(malware) {
+			t.Errorf("Expected the digests of the downloads, got %q", digests)
+		}
+	}
+
+	checker.LogOnly = true
+	if body, err := get(malware, false); err != nil || body != malware {
+		t.Errorf("Expected the malware to be logged only, got %q: %v", body, err)
+	}
+	checker.LogOnly = false
+
+	checker.Allowlist = hashlist.NewList()
+	checker.Allowlist.Add(sha("approved"), "")
+	if body, err := get("approved", false); err != nil || body != "approved" {
+		t.Errorf("Expected the approved download, got %q: %v", body, err)
+	}
+	if _, err := get("unknown", false); err == nil {
+		t.Error("Expected the download not in the allowlist to be aborted")
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
@@ -0,0 +1,241 @@
+// Package health serves the liveness and readiness endpoints with which
+// orchestrators manage the proxy instances. Each endpoint runs its checks:
+//
+//	h := health.New()
+//	h.Live("listener", health.Listening("127.0.0.1:8080"))
+//	h.Ready("upstream", health.Reachable("http://intranet.example.com/"))
+//	h.Ready("ca", health.Certificate(&goproxy.GoproxyCa, 7*24*time.Hour))
+//	h.Ready("config", func(ctx context.Context) error { return configErr })
+//	admin.Handle("/", h.Handler())
+//
+// The handler serves /healthz for the liveness checks and /readyz for both
+// the liveness and the readiness checks. They answer 200 OK when all the
+// checks pass, 503 Service Unavailable otherwise, with a line per check:
+//
+//	[+]listener ok
+//	[-]upstream failed: dial tcp 10.0.0.1:80: connect: connection refused
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check returns nil when its subject is healthy.
+type Check func(ctx context.Context) error
+
+type check struct {
+	name  string
+	check Check
+	ready bool
+}
+
+type result struct {
+	name string
+	err  error
+}
+
+// Health runs the liveness and readiness checks.
+type Health struct {
+	// Timeout bounds every check, 2 seconds by default.
+	Timeout time.Duration
+	// CacheTTL is the duration the results are reused for, so that frequent
+	// probes don't hammer the upstreams, 5 seconds by default. A negative
+	// one disables the cache.
+	CacheTTL time.Duration
+
+	mu      sync.Mutex
+	checks  []check
+	cached  map[bool][]result
+	expires map[bool]time.Time
+}
+
+// New returns a Health without checks.
+func New() *Health {
+	return &Health{}
+}
+
+func (h *Health) add(name string, c Check, ready bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, check{name: name, check: c, ready: ready})
+	h.cached, h.expires = nil, nil
+}
+
+// Live adds a liveness check, whose failure calls for a restart of the
+// instance.
+func (h *Health) Live(name string, c Check) {
+	h.add(name, c, false)
+}
+
+// Ready adds a readiness check, whose failure calls for traffic to be sent
+// to other instances.
+func (h *Health) Ready(name string, c Check) {
+	h.add(name, c, true)
+}
+
+// Run runs the liveness checks, and the readiness checks if ready is set,
+// and returns their errors by name, nil for the passing ones.
+func (h *Health) Run(ctx context.Context, ready bool) map[string]error {
+	results := h.run(ctx, ready)
+	errs := make(map[string]error, len(results))
+	for _, r := range results {
+		errs[r.name] = r.err
+	}
+	return errs
+}
+
+func (h *Health) run(ctx context.Context, ready bool) []result {
+	h.mu.Lock()
+	if results, ok := h.cached[ready]; ok && time.Now().Before(h.expires[ready]) {
+		h.mu.Unlock()
+		return results
+	}
+	var checks []check
+	for _, c := range h.checks {
+		if ready || !c.ready {
+			checks = append(checks, c)
+		}
+	}
+	h.mu.Unlock()
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	results := make([]result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c check) {
+			defer wg.Done()
+			results[i] = result{name: c.name, err: c.check(ctx)}
+		}(i, c)
+	}
+	wg.Wait()
+
+	ttl := h.CacheTTL
+	if ttl == 0 {
+		ttl = 5 * time.Second
+	}
+	if ttl > 0 {
+		h.mu.Lock()
+		if h.cached == nil {
+			h.cached = make(map[bool][]result)
+			h.expires = make(map[bool]time.Time)
+		}
+		h.cached[ready] = results
+		h.expires[ready] = time.Now().Add(ttl)
+		h.mu.Unlock()
+	}
+	return results
+}
+
+func (h *Health) serve(w http.ResponseWriter, r *http.Request, ready bool) {
+	results := h.run(r.Context(), ready)
+	var b strings.Builder
+	status := http.StatusOK
+	for _, res := range results {
+		if res.err != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", res.name, res.err)
+		} else {
+			fmt.Fprintf(&b, "[+]%s ok\n", res.name)
+		}
+	}
+	if status == http.StatusOK {
+		b.WriteString("ok\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	fmt.Fprint(w, b.String())
+}
+
+// Handler serves /healthz and /readyz. It should be served on the
+// administration listener, not exposed to the proxy users.
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, false)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, true)
+	})
+	return mux
+}
+
+// Listening checks that a listener accepts TCP connections at addr.
+func Listening(addr string) Check {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// Reachable checks an upstream: a TCP connection for a "host:port", or a
+// HEAD request for an http or https URL, whose status must not be a 5xx.
+func Reachable(target string) Check {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return Listening(target)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+}
+
+// Certificate checks that cert, such as the MITM CA, is valid for at least
+// margin.
+func Certificate(cert *tls.Certificate, margin time.Duration) Check {
+	return func(ctx context.Context) error {
+		leaf := cert.Leaf
+		if leaf == nil {
+			if len(cert.Certificate) == 0 {
+				return errors.New("no certificate")
+			}
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		switch {
+		case now.Before(leaf.NotBefore):
+			return fmt.Errorf("%s is not valid before %s", leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339))
+		case now.Add(margin).After(leaf.NotAfter):
+			return fmt.Errorf("%s expires on %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/health"
+)
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestHealth(t *testing.T) {
+	proxy := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer proxy.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	configErr := errors.New("invalid rule 3")
+	h := health.New()
+	h.CacheTTL = -1
+	h.Live("listener", health.Listening(proxy.Listener.Addr().String()))
+	h.Ready("upstream", health.Reachable(upstream.URL))
+	h.Ready("ca", health.Certificate(&goproxy.GoproxyCa, 24*time.Hour))
+	h.Ready("config", func(ctx context.Context) error { return configErr })
+
+	if code, body := get(t, h.Handler(), "/healthz"); code != http.StatusOK || !strings.Contains(body, "[+]listener ok") {
+		t.Errorf("healthz %d %q", code, body)
+	}
+	code, body := get(t, h.Handler(), "/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(body, "[-]config failed: invalid rule 3") || !strings.Contains(body, "[+]upstream ok") {
+		t.Errorf("readyz %d %q", code, body)
+	}
+
+	configErr = nil
+	if code, body := get(t, h.Handler(), "/readyz"); code != http.StatusOK {
+		t.Errorf("readyz %d %q", code, body)
+	}
+
+	upstream.Close()
+	for _, c := range []health.Check{
+		health.Reachable(upstream.URL),
+		health.Reachable(upstream.Listener.Addr().String()),
+		health.Reachable(down.URL),
+		health.Certificate(&goproxy.GoproxyCa, 100*365*24*time.Hour),
+	} {
+		if err := c(context.Background()); err == nil {
+			t.Error("check passed")
+		}
+	}
+}
+
+func TestHealthCache(t *testing.T) {
+	var runs int
+	h := health.New()
+	h.Live("counter", func(ctx context.Context) error {
+		runs++
+		return nil
+	})
+	for i := 0; i < 3; i++ {
+		h.Run(context.Background(), false)
+	}
+	if runs != 1 {
+		t.Errorf("%d runs, want 1", runs)
+	}
+}
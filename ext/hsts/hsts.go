@@ -0,0 +1,312 @@
+// Package hsts upgrades the plain HTTP requests of the configured hosts to
+// HTTPS upstream, as the browsers do for the HSTS hosts, so that the legacy
+// clients which can't speak TLS reach them securely through the proxy:
+//
+//	u := hsts.New("intranet.example.com", "api.example.net")
+//	if _, err := u.List.LoadPreload(preloadFile); err != nil {
+//		log.Fatal(err)
+//	}
+//	u.Downgrade = true
+//	u.Install(proxy)
+//
+// The client is still answered in plain HTTP. With Downgrade, the responses
+// are rewritten for it to stay on HTTP: the links of the Location headers
+// to the upgraded hosts, and the Secure cookies, which it wouldn't send
+// back otherwise.
+package hsts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+type entry struct {
+	subdomains bool
+	// expires is zero for the hosts never expiring, the configured and
+	// preloaded ones.
+	expires time.Time
+}
+
+// List is a list of the HSTS hosts. It is safe for concurrent use.
+type List struct {
+	// Clock tells the expiry of the learned hosts, goproxy.SystemClock by
+	// default.
+	Clock goproxy.Clock
+
+	mu      sync.RWMutex
+	entries map[string]entry
+}
+
+// NewList returns a List of hosts, their subdomains included.
+func NewList(hosts ...string) *List {
+	l := &List{}
+	for _, host := range hosts {
+		l.Add(host, true)
+	}
+	return l
+}
+
+func (l *List) now() time.Time {
+	if l.Clock != nil {
+		return l.Clock.Now()
+	}
+	return time.Now()
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Add adds host, with its subdomains when includeSubdomains is set.
+func (l *List) Add(host string, includeSubdomains bool) {
+	l.set(normalize(host), entry{subdomains: includeSubdomains})
+}
+
+func (l *List) set(host string, e entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.entries == nil {
+		l.entries = make(map[string]entry)
+	}
+	l.entries[host] = e
+}
+
+// Len returns the number of hosts of the list.
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.entries)
+}
+
+// Match returns whether the requests to host are upgraded.
+func (l *List) Match(host string) bool {
+	host = normalize(host)
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	now := l.now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for name, exact := host, true; name != ""; exact = false {
+		if e, ok := l.entries[name]; ok && (exact || e.subdomains) {
+			if e.expires.IsZero() || now.Before(e.expires) {
+				return true
+			}
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return false
+}
+
+// preload is the format of the HSTS preload list of Chromium,
+// transport_security_state_static.json.
+type preload struct {
+	Entries []struct {
+		Name              string `json:"name"`
+		Mode              string `json:"mode"`
+		IncludeSubdomains bool   `json:"include_subdomains"`
+	} `json:"entries"`
+}
+
+// LoadPreload adds the hosts of the HSTS preload list of Chromium read from
+// r, in the format of its transport_security_state_static.json, returning
+// their number. Only the entries forcing HTTPS are added, the others only
+// pin keys.
+func (l *List) LoadPreload(r io.Reader) (int, error) {
+	// The file has comment lines, which aren't JSON.
+	var data bytes.Buffer
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); !bytes.HasPrefix(bytes.TrimSpace(line), []byte("//")) {
+			data.Write(line)
+			data.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	var list preload
+	if err := json.Unmarshal(data.Bytes(), &list); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range list.Entries {
+		if e.Mode == "force-https" {
+			l.Add(e.Name, e.IncludeSubdomains)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Observe learns the Strict-Transport-Security header received from host
+// over HTTPS. Its max-age of zero removes the learned host, but not the
+// configured ones.
+func (l *List) Observe(host, header string) {
+	maxAge := int64(-1)
+	subdomains := false
+	for _, directive := range strings.Split(header, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "max-age":
+			if n, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(value), `"`), 10, 64); err == nil && n >= 0 {
+				maxAge = n
+			}
+		case "includesubdomains":
+			subdomains = true
+		}
+	}
+	if maxAge < 0 {
+		return
+	}
+	host = normalize(host)
+	if net.ParseIP(host) != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[host]; ok && e.expires.IsZero() {
+		return
+	}
+	if maxAge == 0 {
+		delete(l.entries, host)
+		return
+	}
+	if l.entries == nil {
+		l.entries = make(map[string]entry)
+	}
+	l.entries[host] = entry{subdomains: subdomains, expires: l.now().Add(time.Duration(maxAge) * time.Second)}
+}
+
+// Upgrader upgrades the plain HTTP requests to the hosts of its List.
+type Upgrader struct {
+	List *List
+	// Learn adds the hosts sending the Strict-Transport-Security header
+	// over HTTPS, in the MITM'd tunnels or the upgraded requests, to the
+	// List.
+	Learn bool
+	// Downgrade rewrites the responses to the upgraded requests for the
+	// clients staying on HTTP.
+	Downgrade bool
+}
+
+// New returns an Upgrader of hosts, their subdomains included.
+func New(hosts ...string) *Upgrader {
+	return &Upgrader{List: NewList(hosts...)}
+}
+
+// Handle implements goproxy.ReqHandler. The requests to the hosts of the
+// List are sent upstream over HTTPS, the port 80 replaced by 443, as
+// RFC 6797 does.
+func (u *Upgrader) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.URL.Scheme != "http" || !u.List.Match(req.URL.Hostname()) {
+		return req, nil
+	}
+	ctx.Logf("Upgrading the request to %s to HTTPS", req.URL.Host)
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		out := req.Clone(req.Context())
+		out.URL.Scheme = "https"
+		if out.URL.Port() == "80" {
+			out.URL.Host = out.URL.Hostname()
+			if strings.Contains(out.URL.Host, ":") {
+				out.URL.Host = "[" + out.URL.Host + "]"
+			}
+		}
+		resp, err := next.RoundTrip(out, ctx)
+		if err != nil || resp == nil {
+			return resp, err
+		}
+		if u.Learn {
+			u.observe(out.URL.Hostname(), resp)
+		}
+		if u.Downgrade {
+			downgrade(resp, out.URL)
+		}
+		return resp, nil
+	})
+	return req, nil
+}
+
+func (u *Upgrader) observe(host string, resp *http.Response) {
+	if header := resp.Header.Get("Strict-Transport-Security"); header != "" {
+		u.List.Observe(host, header)
+	}
+}
+
+// HandleResponse is a goproxy.FuncRespHandler, learning the HSTS hosts
+// of the MITM'd tunnels with Learn.
+func (u *Upgrader) HandleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if u.Learn && resp != nil && ctx.Req != nil && ctx.Req.URL.Scheme == "https" {
+		u.observe(ctx.Req.URL.Hostname(), resp)
+	}
+	return resp
+}
+
+// Install upgrades the requests of proxy.
+func (u *Upgrader) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(u)
+	proxy.OnResponse().DoFunc(u.HandleResponse)
+}
+
+// downgrade rewrites resp, received from upstream over HTTPS, for the
+// client of the plain HTTP request to upstream.
+func downgrade(resp *http.Response, upstream *url.URL) {
+	// The header is ignored over HTTP, but would tell the clients that the
+	// host is reachable over HTTPS.
+	resp.Header.Del("Strict-Transport-Security")
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := resp.Header.Get(name); v != "" {
+			if u, err := url.Parse(v); err == nil && u.Scheme == "https" && sameHost(u, upstream) {
+				u.Scheme = "http"
+				if u.Port() == "443" {
+					u.Host = strings.TrimSuffix(u.Host, ":443")
+				}
+				resp.Header.Set(name, u.String())
+			}
+		}
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = insecure(cookie)
+	}
+}
+
+func sameHost(u, upstream *url.URL) bool {
+	port := func(u *url.URL) string {
+		if p := u.Port(); p != "" {
+			return p
+		}
+		return "443"
+	}
+	return strings.EqualFold(u.Hostname(), upstream.Hostname()) && port(u) == port(upstream)
+}
+
+// insecure removes the Secure attribute of the Set-Cookie value, and the
+// SameSite=None attribute requiring it, so that the cookie is sent back
+// over HTTP.
+func insecure(cookie string) string {
+	attrs := strings.Split(cookie, ";")
+	kept := []string{attrs[0]}
+	for _, attr := range attrs[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		if strings.EqualFold(name, "Secure") ||
+			(strings.EqualFold(name, "SameSite") && strings.EqualFold(strings.TrimSpace(value), "None")) {
+			continue
+		}
+		kept = append(kept, attr)
+	}
+	return strings.Join(kept, ";")
+}
@@ -0,0 +1,113 @@
+package hsts_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/hsts"
+)
+
+const preload = `// A comment.
+{
+  "entries": [
+    // Another comment.
+    { "name": "preloaded.example", "policy": "test", "mode": "force-https", "include_subdomains": true },
+    { "name": "pinned.example", "policy": "test", "pins": "test" }
+  ]
+}
+`
+
+func TestList(t *testing.T) {
+	clock := goproxy.NewFakeClock(time.Unix(1e9, 0))
+	l := hsts.NewList("example.com")
+	l.Clock = clock
+	if n, err := l.LoadPreload(strings.NewReader(preload)); err != nil || n != 1 {
+		t.Fatalf("Expected 1 preloaded host, got %d, %v", n, err)
+	}
+	l.Add("exact.example", false)
+	l.Observe("learned.example", `max-age=60; includeSubDomains`)
+	l.Observe("ignored.example", `includeSubDomains`)
+	// The configured hosts aren't removed.
+	l.Observe("example.com", `max-age=0`)
+
+	for host, expected := range map[string]bool{
+		"example.com":         true,
+		"WWW.Example.com.":    true,
+		"notexample.com":      false,
+		"a.preloaded.example": true,
+		"pinned.example":      false,
+		"exact.example":       true,
+		"sub.exact.example":   false,
+		"sub.learned.example": true,
+		"ignored.example":     false,
+		"127.0.0.1":           false,
+		"com":                 false,
+	} {
+		if got := l.Match(host); got != expected {
+			t.Errorf("Expected Match(%q) to be %v, got %v", host, expected, got)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if l.Match("learned.example") {
+		t.Error("Expected the learned host to expire")
+	}
+	l.Observe("learned.example", `max-age=60`)
+	l.Observe("learned.example", `max-age=0`)
+	if l.Match("learned.example") {
+		t.Error("Expected the learned host to be removed")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	var scheme string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		scheme = "https"
+		w.Header().Set("Strict-Transport-Security", "max-age=600")
+		w.Header().Set("Location", "https://"+req.Host+"/next")
+		w.Header().Add("Set-Cookie", "session=1; Path=/; Secure; SameSite=None")
+		w.Header().Add("Set-Cookie", "theme=dark; HttpOnly")
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	target := "http://localhost:" + u.Port() + "/"
+
+	up := hsts.New("localhost")
+	up.Downgrade = true
+	proxy := goproxy.NewProxyHttpServer()
+	up.Install(proxy)
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{
+		Transport:     &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if scheme != "https" || resp.StatusCode != http.StatusFound {
+		t.Fatalf("Expected the request to be upgraded, got %d", resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != target+"next" {
+		t.Errorf("Expected the location to stay on HTTP, got %s", location)
+	}
+	if resp.Header.Get("Strict-Transport-Security") != "" {
+		t.Error("Expected the HSTS header to be removed")
+	}
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) != 2 || cookies[0] != "session=1; Path=/" || cookies[1] != "theme=dark; HttpOnly" {
+		t.Errorf("Expected the Secure attributes to be removed, got %q", cookies)
+	}
+}
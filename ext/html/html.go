@@ -54,6 +54,10 @@ func HandleStringReader(f func(r io.Reader, ctx *goproxy.ProxyCtx) io.Reader) go
 		if ctx.Error != nil {
 			return nil
 		}
+		if resp.StatusCode == http.StatusPartialContent {
+			// A fragment of the body can't be decoded.
+			return resp
+		}
 		charsetName := ctx.Charset()
 		if charsetName == "" {
 			charsetName = "utf-8"
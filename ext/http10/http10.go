@@ -0,0 +1,119 @@
+// Package http10 adapts the proxy to the HTTP/1.0 clients and servers of
+// the legacy devices, per destination:
+//
+//	proxy.OnRequest(goproxy.DstHostIs("plc.factory.local")).Do(&http10.Shim{Server: true})
+//	proxy.OnRequest(goproxy.SrcIpIs("10.1.2.3")).Do(&http10.Shim{Buffer: true})
+//
+// The proxy answers the HTTP/1.0 clients without chunked encoding, and
+// closes their connection after the responses of unknown length. The Shim
+// keeps it alive by buffering these responses to send their length.
+package http10
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Shim adapts the requests to the HTTP/1.0 servers, and the responses to
+// the HTTP/1.0 clients.
+type Shim struct {
+	// Server marks the destinations only speaking HTTP/1.0. The request
+	// bodies of unknown length are buffered to be sent with their length,
+	// the Expect headers are removed, and the connections aren't reused.
+	Server bool
+	// Buffer buffers the responses of unknown length to the HTTP/1.0
+	// clients asking to keep their connection alive, so that it is kept
+	// alive.
+	Buffer bool
+	// MaxBufferSize bounds the buffered bodies, 1 MiB by default. The
+	// requests with larger bodies are answered with 411 Length Required,
+	// and the larger responses are delimited by closing the connection.
+	MaxBufferSize int64
+}
+
+func (s *Shim) maxBufferSize() int64 {
+	if s.MaxBufferSize <= 0 {
+		return 1 << 20
+	}
+	return s.MaxBufferSize
+}
+
+// buffer reads body up to the limit. It returns the reader of the whole
+// body and false when it is larger.
+func buffer(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if int64(len(data)) > limit {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}, false, nil
+	}
+	body.Close()
+	return data, io.NopCloser(bytes.NewReader(data)), true, nil
+}
+
+func bodyless(req *http.Request, resp *http.Response) bool {
+	return req.Method == http.MethodHead ||
+		(resp.StatusCode >= 100 && resp.StatusCode < 200) ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified
+}
+
+// Handle implements goproxy.ReqHandler.
+func (s *Shim) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if s.Server {
+		// The HTTP/1.0 servers don't answer 100 Continue, nor read chunked
+		// bodies.
+		req.Header.Del("Expect")
+		req.Close = true
+		if req.Body != nil && req.Body != http.NoBody && req.ContentLength < 0 {
+			data, body, ok, err := buffer(req.Body, s.maxBufferSize())
+			if err != nil {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, err.Error())
+			}
+			if !ok {
+				body.Close()
+				ctx.Warnf("http10: the body of %v is too large to be buffered", req.URL)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusLengthRequired,
+					"The destination requires the length of the request body.")
+			}
+			req.Body = body
+			req.ContentLength = int64(len(data))
+			req.TransferEncoding = nil
+		}
+	}
+
+	client := ctx.Req
+	if !s.Buffer || client == nil || client.ProtoAtLeast(1, 1) || client.Close {
+		return req, nil
+	}
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := next.RoundTrip(req, ctx)
+		if err != nil || resp.ContentLength >= 0 || bodyless(req, resp) {
+			return resp, err
+		}
+		data, body, ok, err := buffer(resp.Body, s.maxBufferSize())
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = body
+		if ok {
+			resp.ContentLength = int64(len(data))
+			resp.TransferEncoding = nil
+			resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+		} else {
+			ctx.Logf("http10: the response of %v is too large to keep the connection alive", req.URL)
+		}
+		return resp, nil
+	})
+	return req, nil
+}
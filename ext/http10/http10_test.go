@@ -0,0 +1,103 @@
+package http10_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/http10"
+)
+
+func TestBufferKeepsClientAlive(t *testing.T) {
+	want := strings.Repeat("hello world ", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A flushed response has no length, copied by the proxy larger
+		// than the buffer of net/http.
+		io.WriteString(w, want[:5])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, want[5:])
+	}))
+	defer upstream.Close()
+
+	for _, shim := range []*http10.Shim{nil, {Buffer: true}} {
+		proxy := goproxy.NewProxyHttpServer()
+		if shim != nil {
+			proxy.OnRequest().Do(shim)
+		}
+		s := httptest.NewServer(proxy)
+
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			io.WriteString(conn, "GET "+upstream.URL+"/ HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				if shim == nil && i == 1 {
+					// The connection was closed after the first response.
+					break
+				}
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != want {
+				t.Errorf("body of %d bytes", len(body))
+			}
+			if len(resp.TransferEncoding) > 0 {
+				t.Errorf("chunked response to an HTTP/1.0 client")
+			}
+			if shim != nil && resp.ContentLength != int64(len(want)) {
+				t.Errorf("Content-Length = %d", resp.ContentLength)
+			}
+			if shim == nil && i == 1 {
+				t.Error("connection kept alive without a response length")
+			}
+		}
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestServerBuffersRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, strconv.FormatInt(r.ContentLength, 10)+" "+strings.Join(r.TransferEncoding, ",")+" "+string(body))
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(&http10.Shim{Server: true, MaxBufferSize: 16})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	for body, want := range map[string]string{
+		"short body":                    "10  short body",
+		"a body larger than the buffer": "411",
+	} {
+		// The reader hides the length of the body, which is sent chunked.
+		resp, err := client.Post(upstream.URL, "text/plain", io.MultiReader(strings.NewReader(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want == "411" {
+			if resp.StatusCode != http.StatusLengthRequired {
+				t.Errorf("status = %d for a large body", resp.StatusCode)
+			}
+		} else if string(got) != want {
+			t.Errorf("upstream got %q, want %q", got, want)
+		}
+	}
+}
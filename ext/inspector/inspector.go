@@ -0,0 +1,465 @@
+// Package inspector streams the traffic of the proxy to live inspection
+// UIs. It records a summary of every flow, and serves:
+//
+//	GET  /events      WebSocket stream of the Event values, as JSON
+//	GET  /flows       the recorded flows
+//	GET  /flows/{id}  the detail of a flow, with its body previews
+//	POST /pause       stops recording the traffic
+//	POST /resume      resumes recording
+//
+// For instance:
+//
+//	in := inspector.New()
+//	in.Guard.Token = os.Getenv("INSPECTOR_TOKEN")
+//	in.Install(proxy)
+//	go http.ListenAndServe("127.0.0.1:8081", in.Handler())
+//
+// The flows are the decrypted traffic of the proxy, so the API is guarded
+// by Guard: loopback only by default, and rejecting the cross-site pages,
+// the WebSocket handshakes included.
+package inspector
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/admin"
+	"github.com/InsideOutSec/goproxy/ext/redact"
+	"golang.org/x/net/websocket"
+)
+
+// Event types.
+const (
+	EventRequest  = "request"
+	EventResponse = "response"
+	EventError    = "error"
+)
+
+// Message is a request or a response of a flow.
+type Message struct {
+	Header http.Header `json:"header"`
+	// Body is the beginning of the body, up to the preview limit.
+	Body      []byte `json:"body,omitempty"`
+	BodySize  int64  `json:"bodySize"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// Event is a step of a flow, pushed to the WebSocket clients. The body
+// previews are only included in the flow details.
+type Event struct {
+	Type       string        `json:"type"`
+	FlowID     int64         `json:"flowId"`
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Client     string        `json:"client"`
+	Status     int           `json:"status,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	ErrorClass string        `json:"errorClass,omitempty"`
+}
+
+// Flow is a recorded exchange.
+type Flow struct {
+	ID         int64         `json:"id"`
+	Start      time.Time     `json:"start"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Client     string        `json:"client"`
+	Request    *Message      `json:"request"`
+	Status     int           `json:"status,omitempty"`
+	Response   *Message      `json:"response,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	ErrorClass string        `json:"errorClass,omitempty"`
+}
+
+// RedactHeaders are the headers masked by Redact.
+var RedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Redact masks the values of the RedactHeaders, and the secrets masked by
+// redact.Default.
+func Redact(f *Flow) {
+	RedactWith(redact.Default)(f)
+	for _, m := range []*Message{f.Request, f.Response} {
+		if m == nil {
+			continue
+		}
+		for _, name := range RedactHeaders {
+			if values := m.Header.Values(name); len(values) > 0 {
+				m.Header[http.CanonicalHeaderKey(name)] = []string{redact.Mask}
+			}
+		}
+	}
+}
+
+// RedactWith returns the function masking the secrets of the flows with r,
+// to set as the Redact of an Inspector.
+func RedactWith(r *redact.Redactor) func(f *Flow) {
+	return func(f *Flow) {
+		f.URL = r.URL(f.URL)
+		for _, m := range []*Message{f.Request, f.Response} {
+			if m == nil {
+				continue
+			}
+			m.Header = r.Header(m.Header)
+			m.Body = r.Body(m.Body)
+		}
+	}
+}
+
+// Inspector records the flows of the proxy.
+type Inspector struct {
+	// PreviewLimit is the size of the body previews, 4096 bytes by default.
+	PreviewLimit int
+	// MaxFlows is the number of recorded flows, the oldest ones being
+	// forgotten. Defaults to 1000.
+	MaxFlows int
+	// Redact removes personal information from the flows before they are
+	// exposed. Defaults to Redact.
+	Redact func(f *Flow)
+	// Guard checks the requests of Handler.
+	Guard admin.Guard
+
+	paused int32
+
+	mu          sync.Mutex
+	flows       map[int64]*Flow
+	order       []int64
+	subscribers map[chan Event]bool
+}
+
+// New returns an Inspector with the default settings.
+func New() *Inspector {
+	return &Inspector{
+		PreviewLimit: 4096,
+		MaxFlows:     1000,
+		Redact:       Redact,
+		flows:        make(map[int64]*Flow),
+		subscribers:  make(map[chan Event]bool),
+	}
+}
+
+// Pause stops recording the flows.
+func (in *Inspector) Pause() {
+	atomic.StoreInt32(&in.paused, 1)
+}
+
+// Resume resumes recording the flows.
+func (in *Inspector) Resume() {
+	atomic.StoreInt32(&in.paused, 0)
+}
+
+// Paused returns whether the recording is paused.
+func (in *Inspector) Paused() bool {
+	return atomic.LoadInt32(&in.paused) == 1
+}
+
+func (in *Inspector) publish(e Event) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for ch := range in.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// Slow clients miss events rather than slowing the proxy.
+		}
+	}
+}
+
+// Subscribe returns a channel of the events, until cancel is called.
+func (in *Inspector) Subscribe() (events <-chan Event, cancel func()) {
+	ch := make(chan Event, 256)
+	in.mu.Lock()
+	in.subscribers[ch] = true
+	in.mu.Unlock()
+	return ch, func() {
+		in.mu.Lock()
+		delete(in.subscribers, ch)
+		in.mu.Unlock()
+	}
+}
+
+// Flow returns a copy of the flow id, with the redactions applied.
+func (in *Inspector) Flow(id int64) (*Flow, bool) {
+	in.mu.Lock()
+	f, ok := in.flows[id]
+	var c Flow
+	if ok {
+		c = *f
+		c.Request = f.Request.clone()
+		c.Response = f.Response.clone()
+	}
+	in.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if in.Redact != nil {
+		in.Redact(&c)
+	}
+	return &c, true
+}
+
+// Flows returns the recorded flows, oldest first, without their messages.
+func (in *Inspector) Flows() []Flow {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	flows := make([]Flow, 0, len(in.order))
+	for _, id := range in.order {
+		f := *in.flows[id]
+		f.Request, f.Response = nil, nil
+		if in.Redact != nil {
+			in.Redact(&f)
+		}
+		flows = append(flows, f)
+	}
+	return flows
+}
+
+func (m *Message) clone() *Message {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	c.Header = m.Header.Clone()
+	c.Body = append([]byte(nil), m.Body...)
+	return &c
+}
+
+func (in *Inspector) record(f *Flow) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.flows[f.ID] = f
+	in.order = append(in.order, f.ID)
+	max := in.MaxFlows
+	if max <= 0 {
+		max = 1000
+	}
+	for len(in.order) > max {
+		delete(in.flows, in.order[0])
+		in.order = in.order[1:]
+	}
+}
+
+func (in *Inspector) limit() int {
+	if in.PreviewLimit <= 0 {
+		return 4096
+	}
+	return in.PreviewLimit
+}
+
+// previewBody captures the beginning of a body while it is read.
+type previewBody struct {
+	io.ReadCloser
+	limit   int
+	preview bytes.Buffer
+	size    int64
+	once    sync.Once
+	done    func(b *previewBody)
+}
+
+func (b *previewBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := b.limit - b.preview.Len(); room > 0 {
+		b.preview.Write(p[:minInt(n, room)])
+	}
+	b.size += int64(n)
+	if err == io.EOF {
+		b.once.Do(func() { b.done(b) })
+	}
+	return n, err
+}
+
+func (b *previewBody) Close() error {
+	b.once.Do(func() { b.done(b) })
+	return b.ReadCloser.Close()
+}
+
+func (b *previewBody) message(header http.Header) *Message {
+	return &Message{
+		Header:    header,
+		Body:      append([]byte(nil), b.preview.Bytes()...),
+		BodySize:  b.size,
+		Truncated: b.size > int64(b.preview.Len()),
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (in *Inspector) event(typ string, f *Flow) Event {
+	if in.Redact != nil {
+		summary := *f
+		summary.Request, summary.Response = nil, nil
+		in.Redact(&summary)
+		f = &summary
+	}
+	return Event{
+		Type:       typ,
+		FlowID:     f.ID,
+		Time:       time.Now(),
+		Method:     f.Method,
+		URL:        f.URL,
+		Client:     f.Client,
+		Status:     f.Status,
+		Duration:   f.Duration,
+		Error:      f.Error,
+		ErrorClass: f.ErrorClass,
+	}
+}
+
+// OnRequest records the request of a flow.
+func (in *Inspector) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if in.Paused() {
+		return req, nil
+	}
+	f := &Flow{
+		ID:      ctx.Session,
+		Start:   time.Now(),
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Client:  req.RemoteAddr,
+		Request: &Message{Header: req.Header.Clone()},
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &previewBody{ReadCloser: req.Body, limit: in.limit(), done: func(b *previewBody) {
+			in.mu.Lock()
+			f.Request = b.message(f.Request.Header)
+			in.mu.Unlock()
+		}}
+	}
+	in.record(f)
+	in.publish(in.event(EventRequest, f))
+	return req, nil
+}
+
+// OnResponse records the response of a flow, published once its body is
+// sent.
+func (in *Inspector) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	in.mu.Lock()
+	f, ok := in.flows[ctx.Session]
+	in.mu.Unlock()
+	if !ok {
+		return resp
+	}
+	finish := func(m *Message) {
+		in.mu.Lock()
+		f.Duration = time.Since(f.Start)
+		if resp == nil {
+			if ctx.Error != nil {
+				f.Error = ctx.Error.Error()
+				f.ErrorClass = goproxy.ErrorClass(ctx.Error)
+			}
+		} else {
+			f.Status = resp.StatusCode
+			f.Response = m
+		}
+		e := in.event(EventResponse, f)
+		in.mu.Unlock()
+		if resp == nil {
+			e.Type = EventError
+		}
+		in.publish(e)
+	}
+	switch {
+	case resp == nil:
+		finish(nil)
+	case resp.Body == nil || resp.Body == http.NoBody:
+		finish(&Message{Header: resp.Header.Clone()})
+	default:
+		header := resp.Header.Clone()
+		resp.Body = &previewBody{ReadCloser: resp.Body, limit: in.limit(), done: func(b *previewBody) {
+			finish(b.message(header))
+		}}
+	}
+	return resp
+}
+
+// Install records the traffic of proxy.
+func (in *Inspector) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(in.OnRequest)
+	proxy.OnResponse().DoFunc(in.OnResponse)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// errForeignOrigin rejects the WebSocket handshakes of the cross-site pages.
+var errForeignOrigin = errors.New("inspector: foreign origin")
+
+// Handler returns the HTTP and WebSocket API of the inspector, guarded by
+// Guard. It shouldn't be exposed to the proxy users.
+func (in *Inspector) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/events", websocket.Server{Handshake: func(config *websocket.Config, req *http.Request) error {
+		if !in.Guard.OriginAllowed(req) {
+			return errForeignOrigin
+		}
+		var err error
+		config.Origin, err = websocket.Origin(config, req)
+		return err
+	}, Handler: func(ws *websocket.Conn) {
+		events, cancel := in.Subscribe()
+		defer cancel()
+		// Detect the closed connections, the clients don't send anything.
+		closed := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, ws)
+			close(closed)
+		}()
+		for {
+			select {
+			case e := <-events:
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}})
+	mux.HandleFunc("/flows", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, in.Flows())
+	})
+	mux.HandleFunc("/flows/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/flows/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid flow id", http.StatusBadRequest)
+			return
+		}
+		f, ok := in.Flow(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, f)
+	})
+	control := func(f func()) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			f()
+			writeJSON(w, map[string]bool{"paused": in.Paused()})
+		}
+	}
+	mux.HandleFunc("/pause", control(in.Pause))
+	mux.HandleFunc("/resume", control(in.Resume))
+	return in.Guard.Handler(mux)
+}
@@ -0,0 +1,141 @@
+package inspector_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/inspector"
+	"golang.org/x/net/websocket"
+)
+
+func TestInspector(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		io.WriteString(w, strings.Repeat("x", 100)+string(body))
+	}))
+	defer upstream.Close()
+
+	in := inspector.New()
+	in.PreviewLimit = 10
+	proxy := goproxy.NewProxyHttpServer()
+	in.Install(proxy)
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+	api := httptest.NewServer(in.Handler())
+	defer api.Close()
+
+	ws, err := websocket.Dial(strings.Replace(api.URL, "http", "ws", 1)+"/events", "", api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	u, _ := url.Parse(proxySrv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	req, _ := http.NewRequest(http.MethodPost, upstream.URL+"/submit", strings.NewReader("hello"))
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var events [2]inspector.Event
+	for i := range events {
+		if err := websocket.JSON.Receive(ws, &events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events[0].Type != inspector.EventRequest || events[0].Method != http.MethodPost ||
+		events[1].Type != inspector.EventResponse || events[1].Status != http.StatusOK ||
+		events[0].FlowID != events[1].FlowID {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+
+	detail, err := http.Get(api.URL + "/flows/" + strconv.FormatInt(events[0].FlowID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer detail.Body.Close()
+	var f inspector.Flow
+	if err := json.NewDecoder(detail.Body).Decode(&f); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Request.Body) != "hello" || f.Request.Truncated {
+		t.Errorf("Unexpected request preview %+v", f.Request)
+	}
+	if f.Response.BodySize != 105 || len(f.Response.Body) != 10 || !f.Response.Truncated {
+		t.Errorf("Unexpected response preview %+v", f.Response)
+	}
+	if f.Request.Header.Get("Authorization") != "[redacted]" || f.Response.Header.Get("Set-Cookie") != "[redacted]" {
+		t.Error("Expected the credentials to be redacted")
+	}
+
+	pause, err := http.Post(api.URL+"/pause", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pause.Body.Close()
+	resp, err = client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := len(in.Flows()); n != 1 {
+		t.Errorf("Expected the paused inspector not to record flows, got %d", n)
+	}
+}
+
+func TestHandlerGuard(t *testing.T) {
+	in := inspector.New()
+	in.Guard.Token = "secret"
+	api := httptest.NewServer(in.Handler())
+	defer api.Close()
+	events := strings.Replace(api.URL, "http", "ws", 1) + "/events"
+
+	// A cross-site page can't stream the flows, even with the token.
+	if ws, err := websocket.Dial(events+"?access_token=secret", "", "https://evil.example"); err == nil {
+		ws.Close()
+		t.Error("Expected the foreign origin to be rejected")
+	}
+	if ws, err := websocket.Dial(events, "", api.URL); err == nil {
+		ws.Close()
+		t.Error("Expected the handshake without the token to be rejected")
+	}
+	ws, err := websocket.Dial(events+"?access_token=secret", "", api.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, api.URL+"/pause", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Origin", "https://evil.example")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || in.Paused() {
+		t.Errorf("Expected the cross-site pause to be forbidden, got %d", resp.StatusCode)
+	}
+	resp, err = http.Get(api.URL + "/flows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the flows to require the token, got %d", resp.StatusCode)
+	}
+}
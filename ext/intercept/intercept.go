@@ -0,0 +1,340 @@
+// Package intercept holds the selected requests and responses until an
+// operator decides to forward them, possibly modified, or to drop them:
+//
+//	in := intercept.New()
+//	proxy.OnRequest(goproxy.DstHostIs("api.example.com")).Do(in.RequestHandler())
+//	proxy.OnResponse(goproxy.StatusCodeIs(500)).Do(in.ResponseHandler())
+//	go http.ListenAndServe("127.0.0.1:8082", in.Handler())
+//
+// The held messages are listed by GET /pending, and decided by POSTing a
+// Decision to /pending/{id}, in JSON. The API is guarded by Guard, loopback
+// only by default, and the decisions must be sent as application/json,
+// which the cross-site forms can't send.
+package intercept
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/admin"
+)
+
+// Action is the fate of a held message.
+type Action string
+
+const (
+	// Allow forwards the message, with the modifications of the decision.
+	Allow Action = "allow"
+	// Drop closes the client connection, without forwarding the message.
+	Drop Action = "drop"
+)
+
+// ErrUnknownMessage is returned when deciding a message which isn't held.
+var ErrUnknownMessage = errors.New("intercept: unknown message")
+
+// Message is a held request or response.
+type Message struct {
+	ID       int64       `json:"id"`
+	Response bool        `json:"response"`
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Status   int         `json:"status,omitempty"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+}
+
+// Decision releases a held message. The fields other than Action replace
+// those of the message when they are set.
+type Decision struct {
+	Action Action      `json:"action"`
+	Method string      `json:"method,omitempty"`
+	URL    string      `json:"url,omitempty"`
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   *[]byte     `json:"body,omitempty"`
+}
+
+type held struct {
+	msg      Message
+	decision chan Decision
+}
+
+// Interceptor holds the messages given to its handlers.
+type Interceptor struct {
+	// Timeout is how long a message is held, 5 minutes by default.
+	Timeout time.Duration
+	// OnTimeout is the decision applied after the timeout, Allow by
+	// default.
+	OnTimeout Action
+	// MaxBody is the body size above which the messages are forwarded
+	// without being held, 10MB by default.
+	MaxBody int64
+	// Guard checks the requests of Handler.
+	Guard admin.Guard
+
+	mu   sync.Mutex
+	next int64
+	held map[int64]*held
+}
+
+// New returns an Interceptor with the default settings.
+func New() *Interceptor {
+	return &Interceptor{held: make(map[int64]*held)}
+}
+
+// Pending returns the held messages, oldest first.
+func (in *Interceptor) Pending() []Message {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	msgs := make([]Message, 0, len(in.held))
+	for _, h := range in.held {
+		msgs = append(msgs, h.msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs
+}
+
+// Decide releases the held message id.
+func (in *Interceptor) Decide(id int64, d Decision) error {
+	in.mu.Lock()
+	h, ok := in.held[id]
+	delete(in.held, id)
+	in.mu.Unlock()
+	if !ok {
+		return ErrUnknownMessage
+	}
+	h.decision <- d
+	return nil
+}
+
+// hold waits for the decision on msg.
+func (in *Interceptor) hold(msg Message, ctx *goproxy.ProxyCtx) Decision {
+	h := &held{msg: msg, decision: make(chan Decision, 1)}
+	in.mu.Lock()
+	if in.held == nil {
+		in.held = make(map[int64]*held)
+	}
+	in.next++
+	h.msg.ID = in.next
+	in.held[h.msg.ID] = h
+	in.mu.Unlock()
+
+	timeout := in.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var done <-chan struct{}
+	if ctx.Req != nil {
+		done = ctx.Req.Context().Done()
+	}
+	select {
+	case d := <-h.decision:
+		return d
+	case <-timer.C:
+		ctx.Warnf("No decision on intercepted message %d, applying %s", h.msg.ID, in.onTimeout())
+	case <-done:
+	}
+	in.mu.Lock()
+	delete(in.held, h.msg.ID)
+	in.mu.Unlock()
+	// Decide may have been called meanwhile.
+	select {
+	case d := <-h.decision:
+		return d
+	default:
+		return Decision{Action: in.onTimeout()}
+	}
+}
+
+func (in *Interceptor) onTimeout() Action {
+	if in.OnTimeout == "" {
+		return Allow
+	}
+	return in.OnTimeout
+}
+
+func (in *Interceptor) maxBody() int64 {
+	if in.MaxBody <= 0 {
+		return 10 << 20
+	}
+	return in.MaxBody
+}
+
+// readBody reads body if it isn't larger than the limit. Otherwise it
+// returns a reader of the whole body and ok is false.
+func (in *Interceptor) readBody(body io.ReadCloser) (data []byte, rest io.ReadCloser, ok bool, err error) {
+	if body == nil || body == http.NoBody {
+		return nil, body, true, nil
+	}
+	data, err = io.ReadAll(io.LimitReader(body, in.maxBody()+1))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if int64(len(data)) > in.maxBody() {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}, false, nil
+	}
+	body.Close()
+	return data, nil, true, nil
+}
+
+var errDropped = fmt.Errorf("intercept: message dropped: %w", http.ErrAbortHandler)
+
+// RequestHandler returns a ReqHandler holding the requests.
+func (in *Interceptor) RequestHandler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		body, rest, ok, err := in.readBody(req.Body)
+		if err != nil {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+		}
+		if !ok {
+			ctx.Logf("Not intercepting the large body of %s", req.URL)
+			req.Body = rest
+			return req, nil
+		}
+		d := in.hold(Message{
+			Time:   time.Now(),
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: req.Header.Clone(),
+			Body:   body,
+		}, ctx)
+
+		if d.Action == Drop {
+			ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+				return nil, errDropped
+			})
+			return req, nil
+		}
+		if d.Method != "" {
+			req.Method = d.Method
+		}
+		if d.URL != "" {
+			u, err := url.Parse(d.URL)
+			if err != nil {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, err.Error())
+			}
+			req.URL = u
+			req.Host = u.Host
+		}
+		if d.Header != nil {
+			req.Header = d.Header
+		}
+		if d.Body != nil {
+			body = *d.Body
+			req.Header.Del("Content-Encoding")
+		}
+		if body != nil || d.Body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			req.TransferEncoding = nil
+		}
+		return req, nil
+	})
+}
+
+// ResponseHandler returns a RespHandler holding the responses.
+func (in *Interceptor) ResponseHandler() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil {
+			return nil
+		}
+		body, rest, ok, err := in.readBody(resp.Body)
+		if err != nil {
+			ctx.Error = err
+			return nil
+		}
+		if !ok {
+			ctx.Logf("Not intercepting the large body of %s", ctx.Req.URL)
+			resp.Body = rest
+			return resp
+		}
+		d := in.hold(Message{
+			Response: true,
+			Time:     time.Now(),
+			Method:   ctx.Req.Method,
+			URL:      ctx.Req.URL.String(),
+			Status:   resp.StatusCode,
+			Header:   resp.Header.Clone(),
+			Body:     body,
+		}, ctx)
+
+		if d.Action == Drop {
+			ctx.Error = errDropped
+			return nil
+		}
+		if d.Status != 0 {
+			resp.StatusCode = d.Status
+			resp.Status = strconv.Itoa(d.Status) + " " + http.StatusText(d.Status)
+		}
+		if d.Header != nil {
+			resp.Header = d.Header
+		}
+		if d.Body != nil {
+			body = *d.Body
+			resp.Header.Del("Content-Encoding")
+			resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.TransferEncoding = nil
+		return resp
+	})
+}
+
+// Handler returns the administration API of the interceptor, guarded by
+// Guard. It shouldn't be exposed to the proxy users.
+func (in *Interceptor) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pending", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(in.Pending())
+	})
+	mux.HandleFunc("/pending/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+			http.Error(w, "the decision must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/pending/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid message id", http.StatusBadRequest)
+			return
+		}
+		var d Decision
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if d.Action != Allow && d.Action != Drop {
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+		if err := in.Decide(id, d); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return in.Guard.Handler(mux)
+}
@@ -0,0 +1,188 @@
+package intercept_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/intercept"
+)
+
+type result struct {
+	body string
+	err  error
+}
+
+func setup(t *testing.T, in *intercept.Interceptor) (client *http.Client, upstream string, api string, done func()) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Header.Get("X-Edited")+":"+string(body))
+	}))
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(in.RequestHandler())
+	proxy.OnResponse().Do(in.ResponseHandler())
+	proxySrv := httptest.NewServer(proxy)
+	apiSrv := httptest.NewServer(in.Handler())
+	u, _ := url.Parse(proxySrv.URL)
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	return client, backend.URL, apiSrv.URL, func() {
+		apiSrv.Close()
+		proxySrv.Close()
+		backend.Close()
+	}
+}
+
+func post(client *http.Client, u, body string) <-chan result {
+	ch := make(chan result, 1)
+	go func() {
+		resp, err := client.Post(u, "text/plain", bytes.NewBufferString(body))
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		ch <- result{body: string(b), err: err}
+	}()
+	return ch
+}
+
+// next waits for a held message.
+func next(t *testing.T, api string) intercept.Message {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		resp, err := http.Get(api + "/pending")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msgs []intercept.Message
+		err = json.NewDecoder(resp.Body).Decode(&msgs)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) > 0 {
+			return msgs[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("No message was held")
+	return intercept.Message{}
+}
+
+func decide(t *testing.T, api string, id int64, d intercept.Decision) {
+	t.Helper()
+	body, _ := json.Marshal(d)
+	resp, err := http.Post(api+"/pending/"+strconv.FormatInt(id, 10), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected decision status %s", resp.Status)
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	in := intercept.New()
+	client, upstream, api, done := setup(t, in)
+	defer done()
+
+	ch := post(client, upstream, "original")
+	msg := next(t, api)
+	if msg.Response || msg.Method != http.MethodPost || string(msg.Body) != "original" {
+		t.Fatalf("Unexpected held request %+v", msg)
+	}
+	edited := []byte("edited")
+	header := msg.Header.Clone()
+	header.Set("X-Edited", "yes")
+	decide(t, api, msg.ID, intercept.Decision{Action: intercept.Allow, Header: header, Body: &edited})
+
+	msg = next(t, api)
+	if !msg.Response || msg.Status != http.StatusOK || string(msg.Body) != "yes:edited" {
+		t.Fatalf("Unexpected held response %+v", msg)
+	}
+	replaced := []byte("replaced")
+	decide(t, api, msg.ID, intercept.Decision{Action: intercept.Allow, Status: http.StatusTeapot, Body: &replaced})
+
+	if r := <-ch; r.err != nil || r.body != "replaced" {
+		t.Errorf("Expected the edited response, got %q %v", r.body, r.err)
+	}
+
+	ch = post(client, upstream, "dropped")
+	msg = next(t, api)
+	decide(t, api, msg.ID, intercept.Decision{Action: intercept.Drop})
+	if r := <-ch; r.err == nil {
+		t.Errorf("Expected the dropped request to fail, got %q", r.body)
+	}
+}
+
+func TestInterceptTimeout(t *testing.T) {
+	in := intercept.New()
+	in.Timeout = 20 * time.Millisecond
+	client, upstream, _, done := setup(t, in)
+	defer done()
+
+	if r := <-post(client, upstream, "body"); r.err != nil || r.body != ":body" {
+		t.Errorf("Expected the messages to be allowed after the timeout, got %q %v", r.body, r.err)
+	}
+	if err := in.Decide(1, intercept.Decision{Action: intercept.Allow}); err != intercept.ErrUnknownMessage {
+		t.Errorf("Expected the timed out message to be forgotten, got %v", err)
+	}
+}
+
+func TestHandlerGuard(t *testing.T) {
+	in := intercept.New()
+	in.Guard.Token = "secret"
+	client, upstream, api, done := setup(t, in)
+	defer done()
+
+	ch := post(client, upstream, "held")
+	var msg intercept.Message
+	for i := 0; i < 200; i++ {
+		if pending := in.Pending(); len(pending) > 0 {
+			msg = pending[0]
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	u := api + "/pending/" + strconv.FormatInt(msg.ID, 10)
+	for _, tt := range []struct {
+		token, contentType, origin string
+		code                       int
+	}{
+		// A cross-site form can't drive the decisions.
+		{"secret", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType},
+		{"secret", "application/json", "https://evil.example", http.StatusForbidden},
+		{"", "application/json", "", http.StatusUnauthorized},
+		{"secret", "application/json; charset=utf-8", "", http.StatusNoContent},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, u, strings.NewReader(`{"action":"drop"}`))
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%q %q from %q: %d, want %d", tt.token, tt.contentType, tt.origin, resp.StatusCode, tt.code)
+		}
+	}
+	if r := <-ch; r.err == nil {
+		t.Errorf("Expected the dropped request to fail, got %q", r.body)
+	}
+}
@@ -0,0 +1,302 @@
+package limitation
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Class is a priority class of the requests.
+type Class struct {
+	Name string
+	// Limit bounds the concurrent requests of the class. Zero only bounds
+	// them by the Limit of the Admission.
+	Limit int
+	// QueueSize bounds the requests waiting for admission, beyond which
+	// they are rejected. Zero doesn't bound them.
+	QueueSize int
+	// MaxWait bounds the wait of the requests, zero waiting until they are
+	// canceled.
+	MaxWait time.Duration
+}
+
+// ClassRule classifies the requests matching Condition in Class.
+type ClassRule struct {
+	Condition goproxy.ReqCondition
+	Class     string
+}
+
+// RespClassRule reclassifies the requests whose response matches
+// Condition, such as goproxy.ContentTypeIs("video/mp4"), in Class. The
+// response is held until it is admitted in its new class.
+type RespClassRule struct {
+	Condition goproxy.RespCondition
+	Class     string
+}
+
+// ClassStats are the counters of a class.
+type ClassStats struct {
+	Name     string `json:"name"`
+	Active   int    `json:"active"`
+	Waiting  int    `json:"waiting"`
+	Admitted int64  `json:"admitted"`
+	Rejected int64  `json:"rejected"`
+}
+
+// Admission admits the requests by priority classes, bounding their
+// concurrency, so that the bulk transfers don't starve the interactive
+// requests:
+//
+//	admission := &limitation.Admission{
+//		Limit: 256,
+//		Classes: []limitation.Class{
+//			{Name: "interactive"},
+//			{Name: "bulk", Limit: 16, MaxWait: time.Minute},
+//		},
+//		Rules: []limitation.ClassRule{
+//			{Condition: goproxy.UserInGroup("batch"), Class: "bulk"},
+//		},
+//		RespRules: []limitation.RespClassRule{
+//			{Condition: goproxy.ContentTypeIs("application/octet-stream"), Class: "bulk"},
+//		},
+//	}
+//	proxy.OnRequest().Do(admission)
+//
+// The Classes are ordered by priority: when a request completes, the
+// waiting requests of the first class that may run are admitted first.
+// The requests matching no rule are in the first class. The rejected
+// requests are answered with 503 Service Unavailable.
+type Admission struct {
+	// Limit bounds the concurrent requests of all the classes, zero
+	// doesn't bound them.
+	Limit     int
+	Classes   []Class
+	Rules     []ClassRule
+	RespRules []RespClassRule
+
+	once    sync.Once
+	mu      sync.Mutex
+	active  int
+	classes map[string]*classState
+}
+
+type classState struct {
+	Class
+	priority int
+	active   int
+	waiting  *list.List
+	admitted int64
+	rejected int64
+}
+
+type waiter struct {
+	ready    chan struct{}
+	admitted bool
+}
+
+func (a *Admission) init() {
+	a.once.Do(func() {
+		a.classes = make(map[string]*classState, len(a.Classes))
+		for i, c := range a.Classes {
+			a.classes[c.Name] = &classState{Class: c, priority: i, waiting: list.New()}
+		}
+		if len(a.Classes) == 0 {
+			a.classes[""] = &classState{waiting: list.New()}
+		}
+	})
+}
+
+func (a *Admission) class(name string) *classState {
+	if c, ok := a.classes[name]; ok {
+		return c
+	}
+	if len(a.Classes) > 0 {
+		return a.classes[a.Classes[0].Name]
+	}
+	return a.classes[""]
+}
+
+func (a *Admission) classify(req *http.Request, ctx *goproxy.ProxyCtx) *classState {
+	for _, rule := range a.Rules {
+		if rule.Condition == nil || rule.Condition.HandleReq(req, ctx) {
+			return a.class(rule.Class)
+		}
+	}
+	return a.class("")
+}
+
+// runnable returns whether a request of c may run. The caller holds a.mu.
+func (a *Admission) runnable(c *classState) bool {
+	return (a.Limit <= 0 || a.active < a.Limit) && (c.Limit <= 0 || c.active < c.Limit)
+}
+
+// preempted returns whether a class of higher priority than c has waiting
+// requests that may run. The caller holds a.mu.
+func (a *Admission) preempted(c *classState) bool {
+	for _, other := range a.classes {
+		if other.priority < c.priority && other.waiting.Len() > 0 && a.runnable(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch admits the waiting requests that may run, by priority. The
+// caller holds a.mu.
+func (a *Admission) dispatch() {
+	for {
+		var next *classState
+		for _, c := range a.classes {
+			if c.waiting.Len() > 0 && a.runnable(c) && (next == nil || c.priority < next.priority) {
+				next = c
+			}
+		}
+		if next == nil {
+			return
+		}
+		w := next.waiting.Remove(next.waiting.Front()).(*waiter)
+		w.admitted = true
+		a.admit(next)
+		close(w.ready)
+	}
+}
+
+func (a *Admission) admit(c *classState) {
+	c.active++
+	c.admitted++
+	a.active++
+}
+
+// acquire waits for the admission of a request in c, and returns the
+// function releasing it, nil if the request is rejected.
+func (a *Admission) acquire(ctx context.Context, c *classState) func() {
+	release := func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		c.active--
+		a.active--
+		a.dispatch()
+	}
+	a.mu.Lock()
+	if c.waiting.Len() == 0 && a.runnable(c) && !a.preempted(c) {
+		a.admit(c)
+		a.mu.Unlock()
+		return release
+	}
+	if c.QueueSize > 0 && c.waiting.Len() >= c.QueueSize {
+		c.rejected++
+		a.mu.Unlock()
+		return nil
+	}
+	w := &waiter{ready: make(chan struct{})}
+	elem := c.waiting.PushBack(w)
+	a.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if c.MaxWait > 0 {
+		timer := time.NewTimer(c.MaxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-w.ready:
+		return release
+	case <-ctx.Done():
+	case <-timeout:
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if w.admitted {
+		return release
+	}
+	c.waiting.Remove(elem)
+	c.rejected++
+	return nil
+}
+
+func rejected(req *http.Request) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable, "The proxy is overloaded, retry later.")
+	resp.Header.Set("Retry-After", "1")
+	return resp
+}
+
+// Handle implements goproxy.ReqHandler. The requests are released when
+// their handling by the proxy completes.
+func (a *Admission) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	a.init()
+	c := a.classify(req, ctx)
+	release := a.acquire(req.Context(), c)
+	if release == nil {
+		ctx.Warnf("limitation: rejecting %v of class %s", req.URL, c.Name)
+		return req, rejected(req)
+	}
+	var mu sync.Mutex
+	done := false
+	go func() {
+		<-req.Context().Done()
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		release()
+	}()
+	if len(a.RespRules) == 0 {
+		return req, nil
+	}
+
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		resp, err := next.RoundTrip(req, ctx)
+		if err != nil {
+			return resp, err
+		}
+		for _, rule := range a.RespRules {
+			if !rule.Condition.HandleResp(resp, ctx) {
+				continue
+			}
+			to := a.class(rule.Class)
+			if to == c {
+				break
+			}
+			mu.Lock()
+			if !done {
+				release()
+			}
+			acquired := a.acquire(req.Context(), to)
+			if acquired == nil {
+				// The request context releases nothing.
+				release = func() {}
+				mu.Unlock()
+				resp.Body.Close()
+				ctx.Warnf("limitation: rejecting the response of %v of class %s", req.URL, to.Name)
+				return rejected(req), nil
+			}
+			release = acquired
+			mu.Unlock()
+			break
+		}
+		return resp, nil
+	})
+	return req, nil
+}
+
+// Stats returns the counters of the classes, by priority.
+func (a *Admission) Stats() []ClassStats {
+	a.init()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := make([]ClassStats, len(a.classes))
+	for _, c := range a.classes {
+		stats[c.priority] = ClassStats{
+			Name:     c.Name,
+			Active:   c.active,
+			Waiting:  c.waiting.Len(),
+			Admitted: c.admitted,
+			Rejected: c.rejected,
+		}
+	}
+	return stats
+}
@@ -0,0 +1,129 @@
+package limitation_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/limitation"
+)
+
+func waitStats(t *testing.T, a *limitation.Admission, want string) {
+	t.Helper()
+	var got string
+	for i := 0; i < 100; i++ {
+		var parts []string
+		for _, s := range a.Stats() {
+			parts = append(parts, s.Name+":"+strings.Repeat("a", s.Active)+strings.Repeat("w", s.Waiting))
+		}
+		if got = strings.Join(parts, " "); got == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("stats %q, want %q", got, want)
+}
+
+func TestAdmission(t *testing.T) {
+	a := &limitation.Admission{
+		Limit: 1,
+		Classes: []limitation.Class{
+			{Name: "interactive"},
+			{Name: "bulk", QueueSize: 1},
+		},
+		Rules: []limitation.ClassRule{{
+			Condition: goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+				return req.URL.Path == "/bulk"
+			}),
+			Class: "bulk",
+		}},
+	}
+	request := func(path string) (*http.Request, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		return httptest.NewRequest("GET", "http://example.com"+path, nil).WithContext(ctx), cancel
+	}
+	admitted := make(chan string, 3)
+	handle := func(req *http.Request) {
+		if _, resp := a.Handle(req, &goproxy.ProxyCtx{}); resp == nil {
+			admitted <- req.URL.Path
+		}
+	}
+
+	bulk1, cancel1 := request("/bulk")
+	handle(bulk1)
+	bulk2, cancel2 := request("/bulk")
+	defer cancel2()
+	go handle(bulk2)
+	waitStats(t, a, "interactive: bulk:aw")
+	page, cancelPage := request("/page")
+	go handle(page)
+	waitStats(t, a, "interactive:w bulk:aw")
+
+	// The queue of the bulk class is full.
+	bulk3, cancel3 := request("/bulk")
+	defer cancel3()
+	if _, resp := a.Handle(bulk3, &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}); resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("request beyond the queue admitted")
+	}
+
+	cancel1()
+	waitStats(t, a, "interactive:a bulk:w")
+	cancelPage()
+	waitStats(t, a, "interactive: bulk:a")
+	for _, want := range []string{"/bulk", "/page", "/bulk"} {
+		if got := <-admitted; got != want {
+			t.Errorf("admitted %s, want %s", got, want)
+		}
+	}
+	if stats := a.Stats(); stats[1].Admitted != 2 || stats[1].Rejected != 1 {
+		t.Errorf("bulk stats %+v", stats[1])
+	}
+}
+
+func TestAdmissionResponseClass(t *testing.T) {
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// Enough data to flush the response of the proxy.
+		w.Write(make([]byte, 64<<10))
+		w.(http.Flusher).Flush()
+		<-unblock
+	}))
+	defer upstream.Close()
+	defer close(unblock)
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(&limitation.Admission{
+		Classes: []limitation.Class{
+			{Name: "interactive"},
+			{Name: "bulk", Limit: 1, MaxWait: 50 * time.Millisecond},
+		},
+		RespRules: []limitation.RespClassRule{{
+			Condition: goproxy.ContentTypeIs("application/octet-stream"),
+			Class:     "bulk",
+		}},
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+
+	first, err := client.Get(upstream.URL + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Body.Close()
+	second, err := client.Get(upstream.URL + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Body.Close()
+	if first.StatusCode != http.StatusOK || second.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("statuses %d and %d", first.StatusCode, second.StatusCode)
+	}
+}
@@ -0,0 +1,249 @@
+// Package membudget bounds the memory the handlers use to buffer bodies.
+// All the buffers of a Budget share its limit: a buffer waits for memory to
+// be released when the limit is reached, and larger bodies are spilled to
+// temporary files:
+//
+//	budget := membudget.New(256<<20, 4<<20)
+//	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+//		buf, err := budget.BufferResponse(resp, ctx)
+//		...
+//	})
+package membudget
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ErrTooLarge is returned when a buffer would exceed the limit of its
+// budget, and can't spill to disk.
+var ErrTooLarge = errors.New("membudget: buffer larger than the budget")
+
+// Budget is the memory shared by the buffers.
+type Budget struct {
+	// Limit is the memory of all the buffers.
+	Limit int64
+	// SpillThreshold is the size above which a buffer is moved to a
+	// temporary file. Zero never spills.
+	SpillThreshold int64
+	// TempDir is the directory of the temporary files, os.TempDir() by
+	// default.
+	TempDir string
+
+	mu      sync.Mutex
+	used    int64
+	changed chan struct{}
+}
+
+// New returns a Budget of limit bytes, whose buffers spill to disk above
+// spillThreshold bytes.
+func New(limit, spillThreshold int64) *Budget {
+	return &Budget{Limit: limit, SpillThreshold: spillThreshold}
+}
+
+// Used returns the memory used by the buffers.
+func (b *Budget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// tryAcquire reserves n bytes if they are available.
+func (b *Budget) tryAcquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.Limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// Acquire reserves n bytes, waiting for them to be released by the other
+// buffers until ctx is done.
+func (b *Budget) Acquire(ctx context.Context, n int64) error {
+	if n > b.Limit {
+		return ErrTooLarge
+	}
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.Limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		if b.changed == nil {
+			b.changed = make(chan struct{})
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release returns n bytes to the budget.
+func (b *Budget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	if b.changed != nil {
+		close(b.changed)
+		b.changed = nil
+	}
+}
+
+// Buffer is a body buffer accounted in a Budget. It must be closed to
+// release its memory, or remove its temporary file.
+type Buffer struct {
+	budget   *Budget
+	ctx      context.Context
+	mem      bytes.Buffer
+	reserved int64
+	file     *os.File
+	size     int64
+}
+
+// NewBuffer returns an empty Buffer, waiting for memory until ctx is done.
+func (b *Budget) NewBuffer(ctx context.Context) *Buffer {
+	return &Buffer{budget: b, ctx: ctx}
+}
+
+func (buf *Buffer) spill() error {
+	f, err := os.CreateTemp(buf.budget.TempDir, "goproxy-body-*")
+	if err != nil {
+		return err
+	}
+	// The file stays readable until closed.
+	_ = os.Remove(f.Name())
+	if _, err := f.Write(buf.mem.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	buf.file = f
+	buf.mem = bytes.Buffer{}
+	buf.budget.Release(buf.reserved)
+	buf.reserved = 0
+	return nil
+}
+
+func (buf *Buffer) Write(p []byte) (int, error) {
+	if buf.file == nil && buf.budget.SpillThreshold > 0 && buf.size+int64(len(p)) > buf.budget.SpillThreshold {
+		if err := buf.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if buf.file == nil && !buf.budget.tryAcquire(int64(len(p))) {
+		// Waiting while holding memory could deadlock the buffers, which
+		// then move to disk when they can.
+		if buf.reserved > 0 && buf.budget.SpillThreshold > 0 {
+			if err := buf.spill(); err != nil {
+				return 0, err
+			}
+		} else if err := buf.budget.Acquire(buf.ctx, int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	if buf.file != nil {
+		n, err := buf.file.Write(p)
+		buf.size += int64(n)
+		return n, err
+	}
+	buf.reserved += int64(len(p))
+	n, _ := buf.mem.Write(p)
+	buf.size += int64(n)
+	return n, nil
+}
+
+// Len returns the size of the buffered data.
+func (buf *Buffer) Len() int64 {
+	return buf.size
+}
+
+// Spilled returns whether the buffer was moved to a temporary file.
+func (buf *Buffer) Spilled() bool {
+	return buf.file != nil
+}
+
+// Reader returns a reader of the buffered data. Closing it closes the
+// Buffer.
+func (buf *Buffer) Reader() io.ReadCloser {
+	var r io.Reader = bytes.NewReader(buf.mem.Bytes())
+	if buf.file != nil {
+		r = io.NewSectionReader(buf.file, 0, buf.size)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, buf}
+}
+
+// Close releases the memory of the buffer.
+func (buf *Buffer) Close() error {
+	if buf.reserved > 0 {
+		buf.budget.Release(buf.reserved)
+		buf.reserved = 0
+	}
+	buf.mem = bytes.Buffer{}
+	if buf.file != nil {
+		err := buf.file.Close()
+		buf.file = nil
+		return err
+	}
+	return nil
+}
+
+// ReadAll buffers r.
+func (b *Budget) ReadAll(ctx context.Context, r io.Reader) (*Buffer, error) {
+	buf := b.NewBuffer(ctx)
+	if _, err := io.Copy(buf, r); err != nil {
+		buf.Close()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// BufferResponse reads the body of resp into a Buffer, and replaces it with
+// a reader of the buffer releasing it once the response is sent. The
+// returned Buffer must not be closed by the caller.
+func (b *Budget) BufferResponse(resp *http.Response, ctx *goproxy.ProxyCtx) (*Buffer, error) {
+	reqCtx := context.Background()
+	if ctx.Req != nil {
+		reqCtx = ctx.Req.Context()
+	}
+	buf, err := b.ReadAll(reqCtx, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = buf.Reader()
+	resp.ContentLength = buf.Len()
+	return buf, nil
+}
+
+// BufferRequest reads the body of req into a Buffer, released once the
+// request is sent.
+func (b *Budget) BufferRequest(req *http.Request) (*Buffer, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return b.NewBuffer(req.Context()), nil
+	}
+	buf, err := b.ReadAll(req.Context(), req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = buf.Reader()
+	req.ContentLength = buf.Len()
+	return buf, nil
+}
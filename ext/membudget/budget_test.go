@@ -0,0 +1,87 @@
+package membudget_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/membudget"
+)
+
+func TestBufferResponse(t *testing.T) {
+	b := membudget.New(1024, 100)
+	b.TempDir = t.TempDir()
+	ctx := &goproxy.ProxyCtx{}
+
+	small := &http.Response{Body: io.NopCloser(strings.NewReader("small body"))}
+	buf, err := b.BufferResponse(small, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Spilled() || b.Used() != 10 || small.ContentLength != 10 {
+		t.Errorf("Expected the small body in memory, used %d", b.Used())
+	}
+
+	large := &http.Response{Body: io.NopCloser(strings.NewReader(strings.Repeat("x", 500)))}
+	buf, err = b.BufferResponse(large, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !buf.Spilled() || b.Used() != 10 {
+		t.Errorf("Expected the large body to be spilled, used %d", b.Used())
+	}
+	body, _ := io.ReadAll(large.Body)
+	large.Body.Close()
+	if len(body) != 500 {
+		t.Errorf("Expected the spilled body to be readable, got %d bytes", len(body))
+	}
+
+	body, _ = io.ReadAll(small.Body)
+	small.Body.Close()
+	if string(body) != "small body" || b.Used() != 0 {
+		t.Errorf("Expected the memory to be released, got %q, used %d", body, b.Used())
+	}
+}
+
+func TestBackPressure(t *testing.T) {
+	b := membudget.New(100, 0)
+	first, err := b.ReadAll(context.Background(), bytes.NewReader(make([]byte, 80)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.ReadAll(ctx, bytes.NewReader(make([]byte, 50))); err != context.DeadlineExceeded {
+		t.Errorf("Expected the buffer to wait for memory, got %v", err)
+	}
+	if b.Used() != 80 {
+		t.Errorf("Expected the failed buffer to release its memory, used %d", b.Used())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		buf, err := b.ReadAll(context.Background(), bytes.NewReader(make([]byte, 50)))
+		if err == nil {
+			buf.Close()
+		}
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected the buffer to wait for memory")
+	case <-time.After(20 * time.Millisecond):
+	}
+	first.Close()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if _, err := b.ReadAll(context.Background(), bytes.NewReader(make([]byte, 200))); err != membudget.ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+}
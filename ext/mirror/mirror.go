@@ -0,0 +1,146 @@
+// Package mirror duplicates selected proxied requests to a secondary
+// upstream (shadow traffic), for canary testing and analytics.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+const (
+	defaultMaxBodySize   = 1 << 20
+	defaultMaxConcurrent = 64
+	defaultTimeout       = 30 * time.Second
+)
+
+// Mirror asynchronously sends a copy of the requests to Target.
+// The mirrored responses are discarded, and a slow or failing target never
+// affects the primary request: when too many mirrored requests are in flight,
+// new copies are dropped. A Mirror must be created with New.
+type Mirror struct {
+	// Target is the scheme and host receiving the copies, the path and the
+	// query of the original requests are kept.
+	Target *url.URL
+	// SampleRate is the fraction of the requests that are mirrored,
+	// between 0 and 1.
+	SampleRate float64
+	// Header, when not empty, is added to the copies with the value "1",
+	// so that the target can recognize shadow traffic.
+	Header string
+	// MaxBodySize is the largest request body that is buffered for
+	// mirroring, requests with bigger bodies aren't mirrored.
+	MaxBodySize int64
+	// Timeout bounds the duration of a mirrored request.
+	Timeout time.Duration
+	// Transport is used to send the copies, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+
+	sem chan struct{}
+}
+
+// New creates a Mirror sending a sampleRate fraction of the requests
+// to target.
+func New(target string, sampleRate float64) (*Mirror, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		Target:      u,
+		SampleRate:  sampleRate,
+		Header:      "X-Goproxy-Mirror",
+		MaxBodySize: defaultMaxBodySize,
+		Timeout:     defaultTimeout,
+		sem:         make(chan struct{}, defaultMaxConcurrent),
+	}, nil
+}
+
+func (m *Mirror) sampled() bool {
+	return m.SampleRate >= 1 || (m.SampleRate > 0 && rand.Float64() < m.SampleRate)
+}
+
+// Handle implements goproxy.ReqHandler. It can be used with conditions to
+// restrict the mirrored requests:
+//
+//	m, _ := mirror.New("http://canary.internal", 0.1)
+//	proxy.OnRequest(goproxy.DstHostIs("api.example.com")).Do(m)
+func (m *Mirror) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !m.sampled() {
+		return req, nil
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength < 0 || req.ContentLength > m.MaxBodySize {
+			return req, nil
+		}
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, m.MaxBodySize+1))
+		_ = req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil || int64(len(body)) > m.MaxBodySize {
+			return req, nil
+		}
+	}
+
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		ctx.Logf("mirror: too many requests in flight, dropping copy of %v", req.URL)
+		return req, nil
+	}
+
+	shadow, err := m.shadowRequest(req, body)
+	if err != nil {
+		<-m.sem
+		ctx.Warnf("mirror: cannot create copy of %v: %v", req.URL, err)
+		return req, nil
+	}
+	go m.send(ctx, shadow)
+	return req, nil
+}
+
+func (m *Mirror) shadowRequest(req *http.Request, body []byte) (*http.Request, error) {
+	u := *req.URL
+	u.Scheme = m.Target.Scheme
+	u.Host = m.Target.Host
+
+	// The copy must outlive the original request
+	shadow, err := http.NewRequestWithContext(context.Background(), req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	shadow.Header = req.Header.Clone()
+	shadow.Header.Del("Proxy-Authorization")
+	shadow.Header.Del("Proxy-Connection")
+	if m.Header != "" {
+		shadow.Header.Set(m.Header, "1")
+	}
+	shadow.Host = req.Host
+	return shadow, nil
+}
+
+func (m *Mirror) send(ctx *goproxy.ProxyCtx, shadow *http.Request) {
+	defer func() { <-m.sem }()
+
+	tr := m.Transport
+	if tr == nil {
+		tr = http.DefaultTransport
+	}
+	c, cancel := context.WithTimeout(shadow.Context(), m.Timeout)
+	defer cancel()
+	resp, err := tr.RoundTrip(shadow.WithContext(c))
+	if err != nil {
+		ctx.Logf("mirror: copy of %v failed: %v", shadow.URL, err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
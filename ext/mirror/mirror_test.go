@@ -0,0 +1,76 @@
+package mirror_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/mirror"
+)
+
+type mirrored struct {
+	path, body, tag string
+}
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	defer primary.Close()
+
+	copies := make(chan mirrored, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		copies <- mirrored{r.URL.Path, string(body), r.Header.Get("X-Goproxy-Mirror")}
+		http.Error(w, "the shadow response must be ignored", http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	m, err := mirror.New(shadow.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(m)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(primary.URL+"/upload", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "payload" || resp.StatusCode != http.StatusOK {
+		t.Errorf("Primary response altered: %s %q", resp.Status, body)
+	}
+
+	select {
+	case c := <-copies:
+		if c.path != "/upload" || c.body != "payload" || c.tag != "1" {
+			t.Errorf("Unexpected mirrored request %+v", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request wasn't mirrored")
+	}
+}
+
+func TestMirrorSampling(t *testing.T) {
+	m, err := mirror.New("http://127.0.0.1:1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	// With a zero sample rate the request must not be touched
+	if r, resp := m.Handle(req, &goproxy.ProxyCtx{}); r != req || resp != nil {
+		t.Error("Unexpected change of the request")
+	}
+}
@@ -0,0 +1,349 @@
+// Package mitmca generates and exports the CA of the MITM, for the
+// provisioning of its clients:
+//
+//	ca, err := mitmca.Generate(mitmca.Options{
+//		CommonName:          "Example MITM CA",
+//		PermittedDNSDomains: []string{"example.com"},
+//	})
+//	certPEM, keyPEM, err := mitmca.EncodePEM(ca)
+//	fmt.Println(mitmca.Fingerprint(ca.Leaf, crypto.SHA256))
+//
+// The CA is constrained: by default it signs only the certificates of the
+// hosts, not other CAs, and its name constraints limit the hosts to those
+// of its domains, so that its key, if leaked, can't be used to intercept
+// the traffic of the other domains. goproxy.MitmWithinCA intercepts only
+// the hosts permitted by the constraints of the CA.
+package mitmca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	_ "crypto/sha1"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// KeyType is the type of the key of a CA.
+type KeyType string
+
+const (
+	ECDSA   KeyType = "ecdsa"
+	RSA     KeyType = "rsa"
+	Ed25519 KeyType = "ed25519"
+)
+
+// Options are the options of Generate.
+type Options struct {
+	// CommonName is the name of the CA, "goproxy MITM CA" by default.
+	CommonName   string
+	Organization string
+	// Validity is the period of validity of the CA, ten years by default.
+	Validity time.Duration
+	// KeyType is the type of the key, ECDSA P-256 by default.
+	KeyType KeyType
+	// MaxPathLen is the number of intermediate CAs allowed below the CA,
+	// zero by default so that the CA signs only the host certificates. A
+	// negative MaxPathLen doesn't limit them.
+	MaxPathLen int
+	// PermittedDNSDomains and PermittedIPRanges, if not empty, are the only
+	// domains, with their subdomains, and the IP ranges of the certificates
+	// valid under the CA. The certificates of the Excluded ones aren't.
+	PermittedDNSDomains []string
+	ExcludedDNSDomains  []string
+	PermittedIPRanges   []*net.IPNet
+	ExcludedIPRanges    []*net.IPNet
+	// Clock tells the start of the validity, the system clock by default.
+	Clock goproxy.Clock
+}
+
+// Generate generates a CA, whose Leaf is set.
+func Generate(opts Options) (*tls.Certificate, error) {
+	var key crypto.Signer
+	var err error
+	switch opts.KeyType {
+	case ECDSA, "":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case RSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case Ed25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("mitmca: unknown key type %q", opts.KeyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	subject := pkix.Name{CommonName: opts.CommonName}
+	if subject.CommonName == "" {
+		subject.CommonName = "goproxy MITM CA"
+	}
+	if opts.Organization != "" {
+		subject.Organization = []string{opts.Organization}
+	}
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = 10 * 365 * 24 * time.Hour
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = goproxy.SystemClock
+	}
+	now := clock.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		// Tolerates the clocks of the clients slightly late.
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            opts.MaxPathLen,
+		MaxPathLenZero:        opts.MaxPathLen == 0,
+
+		PermittedDNSDomains: opts.PermittedDNSDomains,
+		ExcludedDNSDomains:  opts.ExcludedDNSDomains,
+		PermittedIPRanges:   opts.PermittedIPRanges,
+		ExcludedIPRanges:    opts.ExcludedIPRanges,
+	}
+	if opts.MaxPathLen < 0 {
+		template.MaxPathLen = -1
+	}
+	// Critical, so that the clients not supporting them reject the hosts
+	// rather than ignoring the constraints.
+	template.PermittedDNSDomainsCritical = len(opts.PermittedDNSDomains)+len(opts.ExcludedDNSDomains)+
+		len(opts.PermittedIPRanges)+len(opts.ExcludedIPRanges) > 0
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// ParseConstraints splits names, domains or IP ranges in CIDR notation, into
+// the domains and the ranges of the Options.
+func ParseConstraints(names []string) (domains []string, ranges []*net.IPNet, err error) {
+	for _, name := range names {
+		if strings.Contains(name, "/") {
+			_, ipnet, err := net.ParseCIDR(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			ranges = append(ranges, ipnet)
+			continue
+		}
+		if ip := net.ParseIP(name); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * len(ip)
+			} else {
+				ip = ip.To4()
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		domains = append(domains, strings.TrimPrefix(name, "*."))
+	}
+	return domains, ranges, nil
+}
+
+// EncodePEM returns the PEM encoding of the certificate and of the PKCS #8
+// key of ca, as loaded by tls.X509KeyPair.
+func EncodePEM(ca *tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	var certs bytes.Buffer
+	for _, der := range ca.Certificate {
+		pem.Encode(&certs, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return certs.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// Load loads the CA of the PEM files certFile and keyFile, setting its Leaf.
+func Load(certFile, keyFile string) (*tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &ca, nil
+}
+
+// Format is the format of an exported certificate.
+type Format string
+
+const (
+	PEM Format = "pem"
+	DER Format = "der"
+	// MobileConfig is the configuration profile installing the CA on the
+	// Apple devices.
+	MobileConfig Format = "mobileconfig"
+)
+
+// Export writes cert to w in format, without its key.
+func Export(w io.Writer, cert *x509.Certificate, format Format) error {
+	var err error
+	switch format {
+	case PEM:
+		err = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	case DER:
+		_, err = w.Write(cert.Raw)
+	case MobileConfig:
+		_, err = w.Write(mobileConfig(cert))
+	default:
+		err = fmt.Errorf("mitmca: unknown format %q", format)
+	}
+	return err
+}
+
+// uuid returns a UUID derived from data, so that a profile exported again
+// replaces the one installed.
+func uuid(data ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(data, "\x00")))
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+	h := strings.ToUpper(hex.EncodeToString(sum[:16]))
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func mobileConfig(cert *x509.Certificate) []byte {
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = "goproxy MITM CA"
+	}
+	fingerprint := Fingerprint(cert, crypto.SHA256)
+	id := "com.github.insideoutsec.goproxy.ca." + strings.ToLower(strings.ReplaceAll(fingerprint, ":", "")[:16])
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>ca.cer</string>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDescription</key>
+			<string>Adds the CA of the proxy</string>
+			<key>PayloadDisplayName</key>
+			<string>%s</string>
+			<key>PayloadIdentifier</key>
+			<string>%s.cert</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>%s</string>
+	<key>PayloadIdentifier</key>
+	<string>%s</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`, base64.StdEncoding.EncodeToString(cert.Raw), xmlEscape(name), id, uuid(fingerprint, "cert"),
+		xmlEscape(name), id, uuid(fingerprint, "profile"))
+	return b.Bytes()
+}
+
+// Fingerprint returns the fingerprint of cert with hash, in the usual
+// uppercase hexadecimal separated by colons, such as shown by the browsers.
+func Fingerprint(cert *x509.Certificate, hash crypto.Hash) string {
+	h := hash.New()
+	h.Write(cert.Raw)
+	sum := strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+	var b strings.Builder
+	for i := 0; i < len(sum); i += 2 {
+		if i > 0 {
+			b.WriteByte(':')
+		}
+		b.WriteString(sum[i : i+2])
+	}
+	return b.String()
+}
+
+// SPKIPin returns the base64 SHA-256 of the public key of cert, as pinned
+// by curl --pinnedpubkey "sha256//<pin>" and the pinning of the devices,
+// unchanged when the CA is reissued with the same key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ErrNoCertificate is returned by ParsePEM when there is no certificate.
+var ErrNoCertificate = errors.New("mitmca: no PEM certificate")
+
+// ParsePEM parses the certificates of data, first of the chain first.
+func ParsePEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, ErrNoCertificate
+	}
+	return certs, nil
+}
@@ -0,0 +1,131 @@
+package mitmca_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/mitmca"
+)
+
+// sign returns a certificate of host signed by ca.
+func sign(t *testing.T, ca *tls.Certificate, host string) *x509.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Leaf, key.Public(), ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestGenerate(t *testing.T) {
+	domains, ranges, err := mitmca.ParseConstraints([]string{"example.com", "*.example.org", "10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 || domains[1] != "example.org" || len(ranges) != 2 || ranges[1].String() != "192.0.2.1/32" {
+		t.Fatalf("parsed %v %v", domains, ranges)
+	}
+	clock := goproxy.NewFakeClock(time.Now())
+	ca, err := mitmca.Generate(mitmca.Options{
+		CommonName:          "test CA",
+		PermittedDNSDomains: domains,
+		ExcludedDNSDomains:  []string{"secret.example.com"},
+		PermittedIPRanges:   ranges,
+		Clock:               clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Leaf.IsCA || !ca.Leaf.MaxPathLenZero || !ca.Leaf.PermittedDNSDomainsCritical || ca.Leaf.Subject.CommonName != "test CA" {
+		t.Errorf("generated %+v", ca.Leaf)
+	}
+	if !ca.Leaf.NotAfter.Equal(clock.Now().Add(10 * 365 * 24 * time.Hour).Truncate(time.Second)) {
+		t.Errorf("valid until %s", ca.Leaf.NotAfter)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	for host, valid := range map[string]bool{
+		"www.example.com":    true,
+		"example.org":        true,
+		"secret.example.com": false,
+		"example.net":        false,
+	} {
+		_, err := sign(t, ca, host).Verify(x509.VerifyOptions{Roots: roots, DNSName: host})
+		if (err == nil) != valid {
+			t.Errorf("%s: verified with %v", host, err)
+		}
+	}
+
+	certPEM, keyPEM, err := mitmca.EncodePEM(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	ca, err := mitmca.Generate(mitmca.Options{CommonName: "A & B CA", KeyType: mitmca.RSA, MaxPathLen: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Leaf.MaxPathLen != -1 || ca.Leaf.MaxPathLenZero {
+		t.Errorf("path length %d", ca.Leaf.MaxPathLen)
+	}
+
+	var pemOut, derOut, profile bytes.Buffer
+	for w, format := range map[*bytes.Buffer]mitmca.Format{&pemOut: mitmca.PEM, &derOut: mitmca.DER, &profile: mitmca.MobileConfig} {
+		if err := mitmca.Export(w, ca.Leaf, format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if certs, err := mitmca.ParsePEM(pemOut.Bytes()); err != nil || !certs[0].Equal(ca.Leaf) {
+		t.Errorf("PEM export parsed %v", err)
+	}
+	if !bytes.Equal(derOut.Bytes(), ca.Leaf.Raw) {
+		t.Error("unexpected DER export")
+	}
+	if s := profile.String(); !strings.Contains(s, "com.apple.security.root") || !strings.Contains(s, "A &amp; B CA") {
+		t.Errorf("profile %s", s)
+	}
+	if err := mitmca.Export(&profile, ca.Leaf, "p12"); err == nil {
+		t.Error("exported in an unknown format")
+	}
+	if _, err := mitmca.ParsePEM([]byte("junk")); err != mitmca.ErrNoCertificate {
+		t.Errorf("parsed junk with %v", err)
+	}
+
+	fp := mitmca.Fingerprint(ca.Leaf, crypto.SHA256)
+	if len(fp) != 32*3-1 || strings.ToUpper(fp) != fp || strings.Count(fp, ":") != 31 {
+		t.Errorf("fingerprint %s", fp)
+	}
+	if len(mitmca.Fingerprint(ca.Leaf, crypto.SHA1)) != 20*3-1 {
+		t.Error("unexpected SHA-1 fingerprint")
+	}
+	if len(mitmca.SPKIPin(ca.Leaf)) != 44 {
+		t.Errorf("pin %s", mitmca.SPKIPin(ca.Leaf))
+	}
+}
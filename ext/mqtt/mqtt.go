@@ -0,0 +1,464 @@
+// Package mqtt inspects the MQTT sessions relayed by the proxy, over
+// WebSocket or tunneled with CONNECT, exposing the topics and the payloads
+// of their packets for the policies of the IoT traffic:
+//
+//	in := &mqtt.Inspector{
+//		Block:    []string{"factory/+/firmware/#"},
+//		OnPacket: func(p *mqtt.Packet, ctx *goproxy.ProxyCtx) bool { ... },
+//	}
+//	// MQTT over WebSocket, once the HTTPS connections are MITM'd.
+//	proxy.OnRequest().Do(in)
+//	// MQTT over TCP, tunneled with CONNECT, and over TLS on 8883.
+//	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(":1883$"))).
+//		HandleConnect(&tcpintercept.Interceptor{Module: in.Module()})
+//	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(":8883$"))).
+//		HandleConnect(&tcpintercept.Interceptor{Module: tcpintercept.TLS(in.Module())})
+//
+// The versions 3.1, 3.1.1 and 5 of the protocol are decoded. The session
+// is relayed as it is from the first bytes which can't be decoded.
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/tcpintercept"
+)
+
+// PacketType is the type of an MQTT control packet.
+type PacketType byte
+
+// The types of the MQTT control packets.
+const (
+	CONNECT     PacketType = 1
+	CONNACK     PacketType = 2
+	PUBLISH     PacketType = 3
+	PUBACK      PacketType = 4
+	PUBREC      PacketType = 5
+	PUBREL      PacketType = 6
+	PUBCOMP     PacketType = 7
+	SUBSCRIBE   PacketType = 8
+	SUBACK      PacketType = 9
+	UNSUBSCRIBE PacketType = 10
+	UNSUBACK    PacketType = 11
+	PINGREQ     PacketType = 12
+	PINGRESP    PacketType = 13
+	DISCONNECT  PacketType = 14
+	AUTH        PacketType = 15
+)
+
+var packetTypeNames = [...]string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+func (t PacketType) String() string {
+	return packetTypeNames[t&0xf]
+}
+
+// maxPacketSize bounds the packets buffered to be decoded; the session is
+// relayed as it is from a larger one.
+const maxPacketSize = 16 << 20
+
+var errMalformed = errors.New("mqtt: malformed packet")
+
+// Packet is a decoded MQTT control packet.
+type Packet struct {
+	Type PacketType
+	// Flags are the lower bits of the fixed header.
+	Flags byte
+	// FromClient is whether the packet is sent by the client.
+	FromClient bool
+
+	// Topic, Payload, QoS and Retain are those of the PUBLISH packets.
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+	// Filters are the topic filters of the SUBSCRIBE and UNSUBSCRIBE
+	// packets.
+	Filters []string
+	// ClientID and Username are those of the CONNECT packets.
+	ClientID string
+	Username string
+
+	// Raw is the whole packet, as relayed.
+	Raw []byte
+}
+
+// Inspector inspects the MQTT sessions.
+type Inspector struct {
+	// Block lists the topic filters, with the + and # wildcards, whose
+	// PUBLISH packets are dropped in both directions. The publishes with
+	// QoS 1 or 2 dropped aren't acknowledged, and are retried by their
+	// sender.
+	Block []string
+	// OnPacket, when set, is called with the packets of the sessions not
+	// blocked, concurrently for both directions of a session. The packet
+	// is dropped when it returns false.
+	OnPacket func(p *Packet, ctx *goproxy.ProxyCtx) bool
+}
+
+// Match returns whether topic matches filter, a topic filter with the +
+// and # wildcards. The topics starting with $ aren't matched by the
+// filters starting with a wildcard.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+func (in *Inspector) blocked(topic string) bool {
+	for _, f := range in.Block {
+		if Match(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep returns whether p is relayed.
+func (in *Inspector) keep(p *Packet, ctx *goproxy.ProxyCtx) bool {
+	if p.Type == PUBLISH && in.blocked(p.Topic) {
+		ctx.Logf("mqtt: dropping PUBLISH to %s", p.Topic)
+		return false
+	}
+	return in.OnPacket == nil || in.OnPacket(p, ctx)
+}
+
+// session is the state of an inspected MQTT session.
+type session struct {
+	in  *Inspector
+	ctx *goproxy.ProxyCtx
+	// level is the protocol level of the session, learned from its
+	// CONNECT packet.
+	level   atomic.Int32
+	streams [2]stream
+}
+
+// stream buffers the data of a direction of a session until its packets
+// are complete.
+type stream struct {
+	buf    []byte
+	broken bool
+	// aliases are the topics of the Topic Aliases of MQTT 5.
+	aliases map[int]string
+	// text is whether a fragmented text message is being relayed, over
+	// WebSocket.
+	text bool
+}
+
+func (in *Inspector) newSession(ctx *goproxy.ProxyCtx) *session {
+	s := &session{in: in, ctx: ctx}
+	s.level.Store(4)
+	return s
+}
+
+func (s *session) stream(fromClient bool) *stream {
+	if fromClient {
+		return &s.streams[0]
+	}
+	return &s.streams[1]
+}
+
+// filter returns the data to relay of p, read in a direction of the
+// session: the complete packets kept, the others being buffered.
+func (s *session) filter(fromClient bool, p []byte) []byte {
+	st := s.stream(fromClient)
+	if st.broken {
+		return p
+	}
+	st.buf = append(st.buf, p...)
+	var out []byte
+	for {
+		n, size, err := header(st.buf)
+		if err == nil && size > maxPacketSize {
+			err = errMalformed
+		}
+		if err != nil || n == 0 {
+			if err != nil {
+				s.ctx.Warnf("mqtt: relaying the rest of the session undecoded: %v", err)
+				st.broken = true
+				out = append(out, st.buf...)
+				st.buf = nil
+			}
+			break
+		}
+		if len(st.buf) < n+size {
+			break
+		}
+		raw := st.buf[:n+size]
+		pkt, err := s.decode(raw, n, fromClient)
+		if err != nil {
+			s.ctx.Warnf("mqtt: relaying the rest of the session undecoded: %v", err)
+			st.broken = true
+			out = append(out, st.buf...)
+			st.buf = nil
+			break
+		}
+		if s.in.keep(pkt, s.ctx) {
+			out = append(out, raw...)
+		}
+		st.buf = st.buf[n+size:]
+	}
+	if len(st.buf) == 0 {
+		st.buf = nil
+	} else {
+		// Don't retain the packets relayed.
+		st.buf = append([]byte(nil), st.buf...)
+	}
+	return out
+}
+
+// header decodes the fixed header of the packet starting b, returning its
+// length and the remaining length, or a zero length when incomplete.
+func header(b []byte) (n, size int, err error) {
+	if len(b) < 2 {
+		return 0, 0, nil
+	}
+	if b[0]>>4 == 0 {
+		return 0, 0, errMalformed
+	}
+	size, n, err = varint(b[1:])
+	if n == 0 {
+		return 0, 0, err
+	}
+	return n + 1, size, nil
+}
+
+// varint decodes the variable byte integer starting b, returning its
+// length, or zero when incomplete.
+func varint(b []byte) (v, n int, err error) {
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, nil
+		}
+		v |= int(b[i]&0x7f) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errMalformed
+}
+
+// reader decodes the fields of a packet.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() int {
+	if b := r.bytes(2); b != nil {
+		return int(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(r.uint16()))
+}
+
+// properties skips the properties of the MQTT 5 packets.
+func (r *reader) properties() {
+	if r.err != nil {
+		return
+	}
+	size, n, err := varint(r.b)
+	if err != nil || n == 0 {
+		r.err = errMalformed
+		return
+	}
+	r.bytes(n)
+	r.bytes(size)
+}
+
+// topicAlias returns the Topic Alias of the properties of a PUBLISH
+// packet, or zero.
+func (r *reader) topicAlias() int {
+	if r.err != nil {
+		return 0
+	}
+	size, n, err := varint(r.b)
+	if err != nil || n == 0 {
+		r.err = errMalformed
+		return 0
+	}
+	r.bytes(n)
+	props := &reader{b: r.bytes(size)}
+	alias := 0
+	for props.err == nil && len(props.b) > 0 {
+		switch id := props.byte(); id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a:
+			props.byte()
+		case 0x13, 0x21, 0x22:
+			props.uint16()
+		case 0x23:
+			alias = props.uint16()
+		case 0x02, 0x11, 0x18, 0x27:
+			props.bytes(4)
+		case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1a, 0x1c, 0x1f:
+			props.bytes(props.uint16())
+		case 0x26:
+			props.string()
+			props.string()
+		case 0x0b:
+			_, n, err := varint(props.b)
+			if err != nil || n == 0 {
+				props.err = errMalformed
+			}
+			props.bytes(n)
+		default:
+			props.err = errMalformed
+		}
+	}
+	if props.err != nil {
+		r.err = props.err
+	}
+	return alias
+}
+
+// decode decodes raw, a whole packet whose fixed header is n bytes long.
+func (s *session) decode(raw []byte, n int, fromClient bool) (*Packet, error) {
+	p := &Packet{Type: PacketType(raw[0] >> 4), Flags: raw[0] & 0xf, FromClient: fromClient, Raw: raw}
+	r := &reader{b: raw[n:]}
+	v5 := s.level.Load() == 5
+	switch p.Type {
+	case CONNECT:
+		r.string()
+		level := r.byte()
+		flags := r.byte()
+		r.uint16()
+		if level == 5 {
+			r.properties()
+		}
+		p.ClientID = r.string()
+		if flags&0x04 != 0 {
+			if level == 5 {
+				r.properties()
+			}
+			r.string()
+			r.bytes(r.uint16())
+		}
+		if flags&0x80 != 0 {
+			p.Username = r.string()
+		}
+		if r.err == nil {
+			s.level.Store(int32(level))
+		}
+	case PUBLISH:
+		p.QoS = p.Flags >> 1 & 0x3
+		p.Retain = p.Flags&0x1 != 0
+		p.Topic = r.string()
+		if p.QoS > 0 {
+			r.uint16()
+		}
+		if v5 {
+			// The topics may be replaced by their aliases, set by the
+			// PUBLISH packets of their direction.
+			if alias := r.topicAlias(); alias != 0 && r.err == nil {
+				st := s.stream(fromClient)
+				if p.Topic != "" {
+					if st.aliases == nil {
+						st.aliases = make(map[int]string)
+					}
+					st.aliases[alias] = p.Topic
+				} else {
+					p.Topic = st.aliases[alias]
+				}
+			}
+		}
+		p.Payload = r.b
+	case SUBSCRIBE, UNSUBSCRIBE:
+		r.uint16()
+		if v5 {
+			r.properties()
+		}
+		for r.err == nil && len(r.b) > 0 {
+			p.Filters = append(p.Filters, r.string())
+			if p.Type == SUBSCRIBE {
+				r.byte()
+			}
+		}
+	}
+	return p, r.err
+}
+
+// Handle implements goproxy.ReqHandler, inspecting the WebSocket
+// connections of the MQTT clients, which offer an mqtt subprotocol.
+func (in *Inspector) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	for _, v := range req.Header.Values("Sec-Websocket-Protocol") {
+		if strings.Contains(strings.ToLower(v), "mqtt") {
+			ctx.WebSocketHandler = &wsHandler{in.newSession(ctx)}
+			break
+		}
+	}
+	return req, nil
+}
+
+// wsHandler inspects the binary messages of an MQTT WebSocket connection,
+// which may carry several packets, or parts of them. The packets kept are
+// relayed in binary messages of their own.
+type wsHandler struct {
+	s *session
+}
+
+func (h *wsHandler) HandleFrame(f *goproxy.WebSocketFrame, ctx *goproxy.ProxyCtx) *goproxy.WebSocketFrame {
+	st := h.s.stream(f.FromClient)
+	switch {
+	case f.Opcode == goproxy.WebSocketText:
+		st.text = !f.Fin
+		return f
+	case f.Opcode == goproxy.WebSocketContinuation && st.text:
+		st.text = !f.Fin
+		return f
+	case f.Opcode != goproxy.WebSocketBinary && f.Opcode != goproxy.WebSocketContinuation:
+		return f
+	}
+	out := h.s.filter(f.FromClient, f.Payload)
+	if len(out) == 0 {
+		return nil
+	}
+	return &goproxy.WebSocketFrame{Fin: true, Opcode: goproxy.WebSocketBinary, Payload: out, FromClient: f.FromClient}
+}
+
+// Module returns a tcpintercept.Module inspecting the MQTT sessions over
+// TCP.
+func (in *Inspector) Module() tcpintercept.Module {
+	return tcpintercept.ModuleFunc(func(s *tcpintercept.Session) error {
+		return s.RelayFunc(in.newSession(s.Ctx).filter)
+	})
+}
@@ -0,0 +1,276 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/mqtt"
+	"github.com/InsideOutSec/goproxy/ext/tcpintercept"
+)
+
+// packet encodes an MQTT packet of the first byte b0 and the fields body.
+func packet(b0 byte, body ...[]byte) []byte {
+	payload := bytes.Join(body, nil)
+	b := []byte{b0}
+	n := len(payload)
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, payload...)
+}
+
+func str(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func connect(level byte, clientID string) []byte {
+	fields := [][]byte{str("MQTT"), {level, 0x02, 0, 60}}
+	if level == 5 {
+		fields = append(fields, []byte{0})
+	}
+	return packet(0x10, append(fields, str(clientID))...)
+}
+
+func publish(topic, payload string) []byte {
+	return packet(0x30, str(topic), []byte(payload))
+}
+
+var pingreq = packet(0xc0)
+
+func TestMatch(t *testing.T) {
+	for _, tt := range []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	} {
+		if got := mqtt.Match(tt.filter, tt.topic); got != tt.match {
+			t.Errorf("Match(%q, %q) = %v", tt.filter, tt.topic, got)
+		}
+	}
+}
+
+// recorder records the packets inspected.
+type recorder struct {
+	mu      sync.Mutex
+	packets []*mqtt.Packet
+}
+
+func (r *recorder) OnPacket(p *mqtt.Packet, ctx *goproxy.ProxyCtx) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.packets = append(r.packets, p)
+	return string(p.Payload) != "drop"
+}
+
+func (r *recorder) topics() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var topics []string
+	for _, p := range r.packets {
+		if p.Type == mqtt.PUBLISH {
+			topics = append(topics, p.Topic)
+		}
+	}
+	return topics
+}
+
+// echo is a broker echoing its clients.
+func echo(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTCP(t *testing.T) {
+	rec := &recorder{}
+	in := &mqtt.Inspector{Block: []string{"secret/#"}, OnPacket: rec.OnPacket}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(&tcpintercept.Interceptor{Module: in.Module()})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	host := echo(t)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+
+	sent := bytes.Join([][]byte{
+		connect(4, "sensor-1"),
+		publish("secret/key", "k"),
+		publish("home/temp", "21"),
+		publish("home/temp", "drop"),
+		pingreq,
+	}, nil)
+	// The packets are split across the reads of the proxy.
+	for _, b := range sent {
+		conn.Write([]byte{b})
+	}
+	want := bytes.Join([][]byte{connect(4, "sensor-1"), publish("home/temp", "21"), pingreq}, nil)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("relayed %q, want %q", got, want)
+	}
+	rec.mu.Lock()
+	if p := rec.packets[0]; p.Type != mqtt.CONNECT || p.ClientID != "sensor-1" {
+		t.Errorf("CONNECT inspected as %+v", p)
+	}
+	rec.mu.Unlock()
+}
+
+func TestTopicAlias(t *testing.T) {
+	rec := &recorder{}
+	in := &mqtt.Inspector{Block: []string{"secret/#"}, OnPacket: rec.OnPacket}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(&tcpintercept.Interceptor{Module: in.Module()})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	host := echo(t)
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+
+	// The second PUBLISH of the topic only refers to its alias.
+	alias := []byte{3, 0x23, 0, 1}
+	sent := bytes.Join([][]byte{
+		connect(5, "sensor-2"),
+		packet(0x30, str("secret/key"), alias, []byte("k1")),
+		packet(0x30, str(""), alias, []byte("k2")),
+		packet(0x30, str("home/temp"), []byte{0}, []byte("21")),
+		pingreq,
+	}, nil)
+	conn.Write(sent)
+	want := bytes.Join([][]byte{connect(5, "sensor-2"), packet(0x30, str("home/temp"), []byte{0}, []byte("21")), pingreq}, nil)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("relayed %q, want %q", got, want)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	upstream := httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+			_ = websocket.Message.Send(ws, msg)
+		}
+	}))
+	defer upstream.Close()
+	rec := &recorder{}
+	in := &mqtt.Inspector{Block: []string{"secret/#"}, OnPacket: rec.OnPacket}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().Do(in)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	host := upstream.Listener.Addr().String()
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	config, err := websocket.NewConfig("wss://"+host+"/mqtt", "https://"+host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"mqtt"}
+	ws, err := websocket.NewClient(config, tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// A message with a blocked publish, and another one split across two
+	// messages.
+	both := append(publish("secret/key", "k"), publish("home/temp", "21")...)
+	websocket.Message.Send(ws, both[:len(both)-3])
+	websocket.Message.Send(ws, both[len(both)-3:])
+	websocket.Message.Send(ws, pingreq)
+
+	var got []byte
+	for _, want := range [][]byte{publish("home/temp", "21"), pingreq} {
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	}
+	if topics := rec.topics(); len(topics) != 2 || topics[0] != "home/temp" {
+		t.Errorf("inspected the publishes of %q", topics)
+	}
+}
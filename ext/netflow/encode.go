@@ -0,0 +1,227 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// record is a unidirectional TCP flow record.
+type record struct {
+	src, dst   netip.AddrPort
+	octets     uint64
+	start, end time.Time
+}
+
+// is4 returns whether the record is exported with the IPv4 template, the
+// IPv4 addresses being mapped to IPv6 otherwise.
+func (r *record) is4() bool {
+	return r.src.Addr().Is4() && r.dst.Addr().Is4()
+}
+
+// The information elements of the templates, with their lengths. NetFlow v9
+// has the same numbers for them, but for the times, which are the uptime of
+// the exporter in milliseconds.
+const (
+	ieOctetDeltaCount          = 1
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieLastSwitched             = 21
+	ieFirstSwitched            = 22
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+
+	protocolTCP = 6
+
+	template4 = 256
+	template6 = 257
+)
+
+type field struct {
+	id, length uint16
+}
+
+func (e *encoder) fields(v6 bool) []field {
+	addrLen := uint16(4)
+	src, dst := uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address)
+	if v6 {
+		addrLen, src, dst = 16, ieSourceIPv6Address, ieDestinationIPv6Address
+	}
+	fields := []field{
+		{src, addrLen}, {dst, addrLen},
+		{ieSourceTransportPort, 2}, {ieDestinationTransportPort, 2},
+		{ieProtocolIdentifier, 1}, {ieOctetDeltaCount, 8},
+	}
+	if e.version == V9 {
+		return append(fields, field{ieFirstSwitched, 4}, field{ieLastSwitched, 4})
+	}
+	return append(fields, field{ieFlowStartMilliseconds, 8}, field{ieFlowEndMilliseconds, 8})
+}
+
+func (e *encoder) recordSize(v6 bool) int {
+	size := 0
+	for _, f := range e.fields(v6) {
+		size += int(f.length)
+	}
+	return size
+}
+
+func (e *encoder) headerSize() int {
+	if e.version == V9 {
+		return 20
+	}
+	return 16
+}
+
+// templateSetSize is the size of the set of the two templates.
+func (e *encoder) templateSetSize() int {
+	return 4 + 2*4 + 4*(len(e.fields(false))+len(e.fields(true)))
+}
+
+// encoder encodes the messages of an exporter.
+type encoder struct {
+	version Version
+	domain  uint32
+	// boot is the time the NetFlow uptime counts from.
+	boot time.Time
+	// sequence counts the packets of NetFlow, and the data records of
+	// IPFIX.
+	sequence      uint32
+	templatesSent time.Time
+}
+
+// encode returns the message of the first records fitting in maxSize, at
+// least one, and their number, with the templates when templates is true.
+func (e *encoder) encode(now time.Time, records []record, templates bool, maxSize int) ([]byte, int) {
+	size := e.headerSize()
+	if templates {
+		size += e.templateSetSize()
+	}
+	var n, n4, n6 int
+	for ; n < len(records); n++ {
+		v6 := !records[n].is4()
+		add := e.recordSize(v6)
+		if v6 && n6 == 0 || !v6 && n4 == 0 {
+			// The set header, and its padding for NetFlow.
+			add += 4 + 3
+		}
+		if n > 0 && size+add > maxSize {
+			break
+		}
+		size += add
+		if v6 {
+			n6++
+		} else {
+			n4++
+		}
+	}
+
+	msg := make([]byte, e.headerSize(), size)
+	count := n
+	if templates {
+		msg = e.appendTemplates(msg)
+		e.templatesSent = now
+		count += 2
+	}
+	for _, v6 := range []bool{false, true} {
+		if v6 && n6 == 0 || !v6 && n4 == 0 {
+			continue
+		}
+		id := uint16(template4)
+		if v6 {
+			id = template6
+		}
+		set := len(msg)
+		msg = binary.BigEndian.AppendUint16(msg, id)
+		msg = append(msg, 0, 0)
+		for i := range records[:n] {
+			if records[i].is4() != v6 {
+				msg = e.appendRecord(msg, &records[i])
+			}
+		}
+		if e.version == V9 {
+			for (len(msg)-set)%4 != 0 {
+				msg = append(msg, 0)
+			}
+		}
+		binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+	}
+
+	if e.version == V9 {
+		e.sequence++
+		binary.BigEndian.PutUint16(msg[0:], uint16(V9))
+		binary.BigEndian.PutUint16(msg[2:], uint16(count))
+		binary.BigEndian.PutUint32(msg[4:], e.uptime(now))
+		binary.BigEndian.PutUint32(msg[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[12:], e.sequence)
+		binary.BigEndian.PutUint32(msg[16:], e.domain)
+	} else {
+		binary.BigEndian.PutUint16(msg[0:], uint16(IPFIX))
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(msg[8:], e.sequence)
+		binary.BigEndian.PutUint32(msg[12:], e.domain)
+		e.sequence += uint32(n)
+	}
+	return msg, n
+}
+
+func (e *encoder) appendTemplates(msg []byte) []byte {
+	set := len(msg)
+	// The template sets are set 2 of IPFIX, and flowset 0 of NetFlow.
+	id := uint16(2)
+	if e.version == V9 {
+		id = 0
+	}
+	msg = binary.BigEndian.AppendUint16(msg, id)
+	msg = append(msg, 0, 0)
+	for _, v6 := range []bool{false, true} {
+		fields := e.fields(v6)
+		tid := uint16(template4)
+		if v6 {
+			tid = template6
+		}
+		msg = binary.BigEndian.AppendUint16(msg, tid)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(fields)))
+		for _, f := range fields {
+			msg = binary.BigEndian.AppendUint16(msg, f.id)
+			msg = binary.BigEndian.AppendUint16(msg, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+	return msg
+}
+
+func (e *encoder) appendRecord(msg []byte, r *record) []byte {
+	if r.is4() {
+		src, dst := r.src.Addr().As4(), r.dst.Addr().As4()
+		msg = append(append(msg, src[:]...), dst[:]...)
+	} else {
+		src, dst := r.src.Addr().As16(), r.dst.Addr().As16()
+		msg = append(append(msg, src[:]...), dst[:]...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, r.src.Port())
+	msg = binary.BigEndian.AppendUint16(msg, r.dst.Port())
+	msg = append(msg, protocolTCP)
+	msg = binary.BigEndian.AppendUint64(msg, r.octets)
+	if e.version == V9 {
+		msg = binary.BigEndian.AppendUint32(msg, e.uptime(r.start))
+		return binary.BigEndian.AppendUint32(msg, e.uptime(r.end))
+	}
+	msg = binary.BigEndian.AppendUint64(msg, uint64(r.start.UnixMilli()))
+	return binary.BigEndian.AppendUint64(msg, uint64(r.end.UnixMilli()))
+}
+
+// uptime returns the NetFlow uptime of t, in milliseconds, 0 for the times
+// before the boot of the exporter.
+func (e *encoder) uptime(t time.Time) uint32 {
+	if t.Before(e.boot) {
+		return 0
+	}
+	return uint32(t.Sub(e.boot).Milliseconds())
+}
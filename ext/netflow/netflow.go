@@ -0,0 +1,373 @@
+// Package netflow exports the flows proxied, the tunnels and the plain HTTP
+// exchanges, as NetFlow v9 or IPFIX records to a UDP collector, so that the
+// network monitoring pipelines account for the traffic of the proxy:
+//
+//	e := &netflow.Exporter{Collector: "10.0.0.5:4739"}
+//	e.Install(proxy)
+//	go e.Run(ctx)
+//	http.Serve(proxy.TrackListener(l), proxy)
+//
+// Each flow is exported as two TCP records, from the client to the
+// destination with the bytes sent by the client, and back with those sent
+// to it, the empty direction being omitted. The tunnels are exported once
+// closed, from the connections of the listeners wrapped by TrackListener,
+// the MITM'd requests being accounted as their tunnel. The destinations are
+// resolved by the exporter, being exported as the unspecified address when
+// they can't be.
+package netflow
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Version is the version of the records exported.
+type Version int
+
+const (
+	// IPFIX is the IPFIX protocol, RFC 7011, which is the default.
+	IPFIX Version = 10
+	// V9 is NetFlow version 9, RFC 3954.
+	V9 Version = 9
+)
+
+// Flow is a flow proxied.
+type Flow struct {
+	// Client is the address of the client, such as "10.0.0.1:51234", and
+	// Server the host and the port of the destination, such as
+	// "example.com:443".
+	Client string
+	Server string
+	// BytesIn are sent by the client, BytesOut to it.
+	BytesIn  int64
+	BytesOut int64
+	Start    time.Time
+	End      time.Time
+}
+
+// Exporter exports the flows to a collector. The flows are queued by
+// Export, and sent by Run.
+type Exporter struct {
+	// Collector is the UDP address of the collector, such as
+	// "10.0.0.5:4739".
+	Collector string
+	// Version is IPFIX by default.
+	Version Version
+	// ObservationDomain is the observation domain of the IPFIX messages,
+	// or the source ID of the NetFlow packets.
+	ObservationDomain uint32
+	// MaxMessageSize bounds the UDP datagrams, 1400 bytes by default.
+	MaxMessageSize int
+	// Interval is the maximum delay of the flows queued, 5 seconds by
+	// default.
+	Interval time.Duration
+	// TemplateInterval is the interval of the templates resent, the
+	// collectors forgetting them, 1 minute by default.
+	TemplateInterval time.Duration
+	// QueueSize bounds the flows queued, 4096 by default, the others being
+	// dropped.
+	QueueSize int
+	// Resolver resolves the destinations, net.DefaultResolver by default.
+	Resolver *net.Resolver
+	OnError  func(err error)
+	Clock    goproxy.Clock
+
+	once    sync.Once
+	queue   chan Flow
+	dropped atomic.Int64
+	names   map[string]resolved
+}
+
+type resolved struct {
+	addr    netip.Addr
+	expires time.Time
+}
+
+const (
+	// resolvedTTL is the duration of the destinations resolved, at most
+	// maxResolved of them.
+	resolvedTTL = 5 * time.Minute
+	maxResolved = 4096
+	// maxPending bounds the records pending until the next interval.
+	maxPending = 1024
+)
+
+func (e *Exporter) init() {
+	e.once.Do(func() {
+		size := e.QueueSize
+		if size <= 0 {
+			size = 4096
+		}
+		e.queue = make(chan Flow, size)
+		e.names = make(map[string]resolved)
+	})
+}
+
+func (e *Exporter) now() time.Time {
+	if e.Clock != nil {
+		return e.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (e *Exporter) version() Version {
+	if e.Version == V9 {
+		return V9
+	}
+	return IPFIX
+}
+
+func (e *Exporter) maxMessageSize() int {
+	if e.MaxMessageSize > 0 {
+		return e.MaxMessageSize
+	}
+	return 1400
+}
+
+func (e *Exporter) interval() time.Duration {
+	if e.Interval > 0 {
+		return e.Interval
+	}
+	return 5 * time.Second
+}
+
+func (e *Exporter) templateInterval() time.Duration {
+	if e.TemplateInterval > 0 {
+		return e.TemplateInterval
+	}
+	return time.Minute
+}
+
+func (e *Exporter) onError(err error) {
+	if e.OnError != nil {
+		e.OnError(err)
+	}
+}
+
+// Export queues f, without blocking. It returns false when the queue is
+// full, f being dropped.
+func (e *Exporter) Export(f Flow) bool {
+	e.init()
+	select {
+	case e.queue <- f:
+		return true
+	default:
+		e.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped returns the number of the flows dropped, the queue being full.
+func (e *Exporter) Dropped() int64 {
+	return e.dropped.Load()
+}
+
+// Run sends the flows queued to the collector until ctx is done, sending
+// those left then.
+func (e *Exporter) Run(ctx context.Context) {
+	e.init()
+	enc := &encoder{version: e.version(), domain: e.ObservationDomain, boot: e.now()}
+	var conn net.Conn
+	var pending []record
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if conn == nil {
+			var err error
+			if conn, err = net.Dial("udp", e.Collector); err != nil {
+				e.onError(err)
+				pending = pending[:0]
+				return
+			}
+		}
+		now := e.now()
+		for records := pending; len(records) > 0; {
+			templates := enc.templatesSent.IsZero() || now.Sub(enc.templatesSent) >= e.templateInterval()
+			msg, n := enc.encode(now, records, templates, e.maxMessageSize())
+			if _, err := conn.Write(msg); err != nil {
+				e.onError(err)
+			}
+			records = records[n:]
+		}
+		pending = pending[:0]
+	}
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	ticker := time.NewTicker(e.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			for len(e.queue) > 0 {
+				pending = append(pending, e.records(context.Background(), <-e.queue)...)
+			}
+			flush()
+			return
+		case f := <-e.queue:
+			pending = append(pending, e.records(ctx, f)...)
+			if len(pending) >= maxPending {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// records returns the records of f.
+func (e *Exporter) records(ctx context.Context, f Flow) []record {
+	client := clientAddr(f.Client)
+	host, port := splitServer(f.Server)
+	server := netip.AddrPortFrom(e.resolve(ctx, host), port)
+	if !server.Addr().IsValid() {
+		if client.Addr().Is6() {
+			server = netip.AddrPortFrom(netip.IPv6Unspecified(), port)
+		} else {
+			server = netip.AddrPortFrom(netip.IPv4Unspecified(), port)
+		}
+	}
+	var records []record
+	if f.BytesIn > 0 || f.BytesOut <= 0 {
+		records = append(records, record{src: client, dst: server, octets: uint64(f.BytesIn), start: f.Start, end: f.End})
+	}
+	if f.BytesOut > 0 {
+		records = append(records, record{src: server, dst: client, octets: uint64(f.BytesOut), start: f.Start, end: f.End})
+	}
+	return records
+}
+
+// resolve returns the address of host, resolved at most every resolvedTTL,
+// the invalid address when it can't be.
+func (e *Exporter) resolve(ctx context.Context, host string) netip.Addr {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap()
+	}
+	now := e.now()
+	if r, ok := e.names[host]; ok && now.Before(r.expires) {
+		return r.addr
+	}
+	resolver := e.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var addr netip.Addr
+	if addrs, err := resolver.LookupNetIP(ctx, "ip", host); err == nil && len(addrs) > 0 {
+		addr = addrs[0].Unmap()
+	}
+	if len(e.names) >= maxResolved {
+		e.names = make(map[string]resolved)
+	}
+	e.names[host] = resolved{addr: addr, expires: now.Add(resolvedTTL)}
+	return addr
+}
+
+func clientAddr(addr string) netip.AddrPort {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+}
+
+func splitServer(server string) (string, uint16) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return server, 0
+	}
+	p, _ := net.LookupPort("tcp", port)
+	return host, uint16(p)
+}
+
+type startKey struct{}
+
+// HandleRequest is a goproxy.FuncReqHandler, timing the plain HTTP
+// exchanges.
+func (e *Exporter) HandleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	ctx.SetValue(startKey{}, e.now())
+	return req, nil
+}
+
+// countingBody counts the bytes read from the response body, once closed.
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+	once sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() { b.done(b.n) })
+	return b.ReadCloser.Close()
+}
+
+// HandleResponse is a goproxy.FuncRespHandler, exporting the plain HTTP
+// exchanges once their response body is sent.
+func (e *Exporter) HandleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	req := ctx.Req
+	if req == nil || ctx.IsMitm() || req.Method == http.MethodConnect {
+		return resp
+	}
+	f := Flow{Client: req.RemoteAddr, Server: req.URL.Host}
+	if req.URL.Port() == "" {
+		f.Server = net.JoinHostPort(req.URL.Hostname(), req.URL.Scheme)
+	}
+	if req.ContentLength > 0 {
+		f.BytesIn = req.ContentLength
+	}
+	f.Start, _ = ctx.Value(startKey{}).(time.Time)
+	if f.Start.IsZero() {
+		f.Start = e.now()
+	}
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+		f.End = e.now()
+		e.Export(f)
+		return resp
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64) {
+		f.BytesOut, f.End = n, e.now()
+		e.Export(f)
+	}}
+	return resp
+}
+
+// connClosed exports the tunnels.
+func (e *Exporter) connClosed(ev *goproxy.Event) {
+	if ev.Conn == nil || ev.Conn.Target == "" {
+		return
+	}
+	e.Export(Flow{
+		Client:   ev.Conn.RemoteAddr,
+		Server:   ev.Conn.Target,
+		BytesIn:  ev.Conn.BytesIn,
+		BytesOut: ev.Conn.BytesOut,
+		Start:    ev.Conn.Opened,
+		End:      ev.Time,
+	})
+}
+
+// Install exports the plain HTTP exchanges and the tunnels of proxy.
+func (e *Exporter) Install(proxy *goproxy.ProxyHttpServer) {
+	e.init()
+	proxy.OnRequest().DoFunc(e.HandleRequest)
+	proxy.OnResponse().DoFunc(e.HandleResponse)
+	proxy.Subscribe(e.connClosed, goproxy.EventConnClosed)
+}
@@ -0,0 +1,203 @@
+package netflow_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/netflow"
+)
+
+type flowRecord struct {
+	src, dst netip.AddrPort
+	octets   uint64
+}
+
+func (r flowRecord) String() string {
+	return fmt.Sprintf("%v>%v:%d", r.src, r.dst, r.octets)
+}
+
+// decode decodes the data records of the messages, with the templates they
+// define.
+func decode(t *testing.T, msgs [][]byte) (version int, records []flowRecord) {
+	templates := make(map[uint16][][2]uint16)
+	for _, msg := range msgs {
+		version = int(binary.BigEndian.Uint16(msg))
+		header := 16
+		if version == 9 {
+			header = 20
+		} else if int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+			t.Fatalf("Expected the length of the message, got %d", binary.BigEndian.Uint16(msg[2:]))
+		}
+		for sets := msg[header:]; len(sets) >= 4; {
+			id, length := binary.BigEndian.Uint16(sets), int(binary.BigEndian.Uint16(sets[2:]))
+			set := sets[4:length]
+			sets = sets[length:]
+			if id == 0 || id == 2 {
+				for len(set) >= 4 {
+					tid, count := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+					var fields [][2]uint16
+					for i := 0; i < count; i++ {
+						fields = append(fields, [2]uint16{binary.BigEndian.Uint16(set[4+4*i:]), binary.BigEndian.Uint16(set[6+4*i:])})
+					}
+					templates[tid] = fields
+					set = set[4+4*count:]
+				}
+				continue
+			}
+			fields, ok := templates[id]
+			if !ok {
+				t.Fatalf("Expected the template %d", id)
+			}
+			size := 0
+			for _, f := range fields {
+				size += int(f[1])
+			}
+			for len(set) >= size {
+				var r flowRecord
+				var src, dst netip.Addr
+				var sport, dport uint16
+				for _, f := range fields {
+					v := set[:f[1]]
+					set = set[f[1]:]
+					switch f[0] {
+					case 8, 27:
+						src, _ = netip.AddrFromSlice(v)
+					case 12, 28:
+						dst, _ = netip.AddrFromSlice(v)
+					case 7:
+						sport = binary.BigEndian.Uint16(v)
+					case 11:
+						dport = binary.BigEndian.Uint16(v)
+					case 1:
+						r.octets = binary.BigEndian.Uint64(v)
+					case 4:
+						if v[0] != 6 {
+							t.Errorf("Expected TCP, got %d", v[0])
+						}
+					}
+				}
+				r.src, r.dst = netip.AddrPortFrom(src, sport), netip.AddrPortFrom(dst, dport)
+				records = append(records, r)
+			}
+		}
+	}
+	return version, records
+}
+
+// collect runs e to a collector until the records expected are received.
+func collect(t *testing.T, e *netflow.Exporter, expected int, export func()) (int, []flowRecord) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	e.Collector = l.LocalAddr().String()
+	e.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Run(ctx)
+	export()
+
+	var msgs [][]byte
+	for {
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 65536)
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, buf[:n])
+		if version, records := decode(t, msgs); len(records) >= expected {
+			return version, records
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	server := netip.MustParseAddrPort(upstream.Listener.Addr().String())
+
+	e := &netflow.Exporter{}
+	proxy := goproxy.NewProxyHttpServer()
+	e.Install(proxy)
+	p := httptest.NewUnstartedServer(proxy)
+	p.Listener = proxy.TrackListener(p.Listener)
+	p.Start()
+	defer p.Close()
+
+	var clients []string
+	_, records := collect(t, e, 4, func() {
+		proxyURL, _ := url.Parse(p.URL)
+		tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Post(upstream.URL, "text/plain", strings.NewReader("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		c, err := net.Dial("tcp", p.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", server, server)
+		if resp, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || resp.StatusCode != 200 {
+			t.Fatal(resp, err)
+		}
+		clients = append(clients, c.LocalAddr().String())
+		c.Close()
+	})
+
+	sort.Slice(records, func(i, j int) bool { return records[i].octets < records[j].octets })
+	if len(records) != 4 {
+		t.Fatalf("Expected the records of the exchange and of the tunnel, got %v", records)
+	}
+	if r := records[0]; r.octets != 4 || r.dst != server {
+		t.Errorf("Expected the bytes sent by the client, got %v", r)
+	}
+	if r := records[1]; r.octets != 5 || r.src != server {
+		t.Errorf("Expected the bytes sent to the client, got %v", r)
+	}
+	tunnel := netip.MustParseAddrPort(clients[0])
+	for _, r := range records[2:] {
+		if r.src != tunnel && r.dst != tunnel || r.src != server && r.dst != server {
+			t.Errorf("Expected the records of the tunnel, got %v", r)
+		}
+	}
+}
+
+func TestV9(t *testing.T) {
+	e := &netflow.Exporter{Version: netflow.V9, MaxMessageSize: 200}
+	start := time.Now()
+	version, records := collect(t, e, 20, func() {
+		for i := 0; i < 10; i++ {
+			e.Export(netflow.Flow{Client: "[2001:db8::1]:40000", Server: "192.0.2.1:443", BytesIn: 100, BytesOut: 1000, Start: start, End: start})
+		}
+	})
+	if version != 9 {
+		t.Errorf("Expected NetFlow v9, got %d", version)
+	}
+	if r := records[0]; r.src.String() != "[2001:db8::1]:40000" || r.dst.String() != "[::ffff:192.0.2.1]:443" || r.octets != 100 {
+		t.Errorf("Expected the IPv6 record, got %v", r)
+	}
+	if e.Dropped() != 0 {
+		t.Errorf("Expected no flow dropped, got %d", e.Dropped())
+	}
+}
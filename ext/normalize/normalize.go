@@ -0,0 +1,94 @@
+// Package normalize rewrites the identifying request headers of all the
+// clients to a common profile, reducing their fingerprinting surface.
+//
+// The handler applies both to plain HTTP requests and to the requests of
+// MITM'd HTTPS connections. The header ordering is normalized by net/http
+// itself, which always writes the headers sorted by name.
+package normalize
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Profile is the set of header values sent for every client.
+// Empty values leave the client header untouched.
+type Profile struct {
+	UserAgent      string
+	Accept         string
+	AcceptLanguage string
+	// Remove lists the headers that are always dropped, a trailing *
+	// matches every header with that prefix.
+	Remove []string
+	// Allow, if not empty, is the exhaustive list of forwarded headers,
+	// the other ones are dropped. A trailing * is accepted too.
+	Allow []string
+}
+
+// clientHintHeaders leak the browser, platform and hardware details.
+var clientHintHeaders = []string{"Sec-Ch-*", "X-Client-Data", "Dnt", "Sec-Gpc", "X-Requested-With"}
+
+var (
+	// FirefoxDesktop mimics a recent Firefox release on Windows.
+	FirefoxDesktop = Profile{
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0",
+		Accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.5",
+		Remove:         clientHintHeaders,
+	}
+	// ChromeDesktop mimics a recent Chrome release on Windows.
+	ChromeDesktop = Profile{
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+		Accept: "text/html,application/xhtml+xml,application/xml;q=0.9," +
+			"image/avif,image/webp,image/apng,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.9",
+		Remove:         clientHintHeaders,
+	}
+)
+
+func matchHeader(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// essentialHeaders are never removed by an Allow list, since the requests
+// can't work without them.
+var essentialHeaders = []string{
+	"Host", "Content-Type", "Content-Length", "Content-Encoding", "Transfer-Encoding",
+	"Authorization", "Cookie", "Connection", "Upgrade", "Sec-Websocket-*",
+	"Range", "If-*",
+}
+
+// Handle implements goproxy.ReqHandler.
+func (p Profile) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	for name := range req.Header {
+		if matchHeader(p.Remove, name) ||
+			(len(p.Allow) > 0 && !matchHeader(p.Allow, name) && !matchHeader(essentialHeaders, name)) {
+			delete(req.Header, name)
+		}
+	}
+	if p.UserAgent != "" {
+		req.Header.Set("User-Agent", p.UserAgent)
+	}
+	if p.Accept != "" && req.Header.Get("Accept") != "" {
+		// Keep the specific types asked by API clients
+		if strings.Contains(req.Header.Get("Accept"), "text/html") {
+			req.Header.Set("Accept", p.Accept)
+		}
+	}
+	if p.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", p.AcceptLanguage)
+	}
+	return req, nil
+}
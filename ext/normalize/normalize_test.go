@@ -0,0 +1,51 @@
+package normalize_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/normalize"
+)
+
+func TestProfile(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	req.Header.Set("Accept-Language", "fr-CH")
+	req.Header.Set("Accept", "text/html,*/*")
+	req.Header.Set("Sec-CH-UA-Platform", "Linux")
+	req.Header.Set("DNT", "1")
+	req.Header.Set("Cookie", "a=b")
+
+	normalize.FirefoxDesktop.Handle(req, &goproxy.ProxyCtx{})
+	if req.Header.Get("User-Agent") != normalize.FirefoxDesktop.UserAgent ||
+		req.Header.Get("Accept-Language") != normalize.FirefoxDesktop.AcceptLanguage ||
+		req.Header.Get("Accept") != normalize.FirefoxDesktop.Accept {
+		t.Errorf("Headers not normalized: %v", req.Header)
+	}
+	if req.Header.Get("Sec-CH-UA-Platform") != "" || req.Header.Get("DNT") != "" {
+		t.Errorf("Identifying headers not removed: %v", req.Header)
+	}
+	if req.Header.Get("Cookie") != "a=b" {
+		t.Error("Unrelated header removed")
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Custom", "1")
+	req.Header.Set("X-Trace-Id", "2")
+	req.Header.Set("Accept", "application/json")
+
+	profile := normalize.Profile{Allow: []string{"X-Trace-*", "Accept"}, Accept: "text/html"}
+	profile.Handle(req, &goproxy.ProxyCtx{})
+	if req.Header.Get("X-Custom") != "" || req.Header.Get("X-Trace-Id") == "" ||
+		req.Header.Get("Content-Type") == "" {
+		t.Errorf("Allow list not applied: %v", req.Header)
+	}
+	if req.Header.Get("Accept") != "application/json" {
+		t.Error("API Accept header shouldn't be rewritten")
+	}
+}
@@ -0,0 +1,143 @@
+// Package offload terminates the TLS of the legacy clients on the proxy,
+// which always connects upstream with modern TLS, for the devices stuck
+// with plain HTTP or the TLS versions and cipher suites the servers no
+// longer accept:
+//
+//	o := offload.New()
+//	o.RootCAs = pool
+//	o.Install(proxy)
+//
+// The clients speak plain HTTP, upgraded to HTTPS upstream, or TLS 1.0 and
+// later with the MITM'd tunnels, SSL 3.0 being unsupported by crypto/tls.
+// Their requests are sent in HTTP/2 to the servers supporting it. Unlike
+// the proxy transport, the upstream certificates are verified, since the
+// clients can't verify them anymore.
+//
+// The clients predating ECDSA need the MITM certificates signed by an RSA
+// CA, as GoproxyCa. Those not sending SNI get the certificate of the host
+// of their CONNECT request.
+package offload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/tlspolicy"
+)
+
+// Offload terminates the TLS of the clients.
+type Offload struct {
+	// Client is the policy of the MITM handshakes with the clients,
+	// tlspolicy.Legacy when zero.
+	Client tlspolicy.Policy
+	// Upstream is the policy of the handshakes with the servers, TLS 1.3
+	// only when zero.
+	Upstream tlspolicy.Policy
+	// RootCAs verifies the certificates of the servers, the system roots
+	// when nil.
+	RootCAs *x509.CertPool
+	// CA signs the MITM certificates, GoproxyCa by default.
+	CA *tls.Certificate
+	// Upgrade sends the plain HTTP requests upstream over HTTPS, the client
+	// still answered in plain HTTP.
+	Upgrade bool
+	// HTTP1 sends the requests upstream in HTTP/1.1 only.
+	HTTP1 bool
+
+	once sync.Once
+	tr   *http.Transport
+}
+
+// New returns an Offload of the legacy clients, upgrading their plain HTTP
+// requests.
+func New() *Offload {
+	return &Offload{Upgrade: true}
+}
+
+func isZero(p tlspolicy.Policy) bool {
+	return p.MinVersion == 0 && p.MaxVersion == 0 && len(p.CipherSuites) == 0 && len(p.CurvePreferences) == 0
+}
+
+func (o *Offload) clientPolicy() tlspolicy.Policy {
+	if isZero(o.Client) {
+		return tlspolicy.Legacy
+	}
+	return o.Client
+}
+
+func (o *Offload) ca() *tls.Certificate {
+	if o.CA != nil {
+		return o.CA
+	}
+	return &goproxy.GoproxyCa
+}
+
+// transport returns the transport of the upstream requests, a copy of the
+// transport of proxy verifying the certificates.
+func (o *Offload) transport(proxy *goproxy.ProxyHttpServer) *http.Transport {
+	o.once.Do(func() {
+		o.tr = proxy.Tr.Clone()
+		o.tr.TLSClientConfig = &tls.Config{RootCAs: o.RootCAs}
+		if isZero(o.Upstream) {
+			o.tr.TLSClientConfig.MinVersion = tls.VersionTLS13
+		} else {
+			o.Upstream.Apply(o.tr.TLSClientConfig)
+		}
+		o.tr.ForceAttemptHTTP2 = !o.HTTP1
+	})
+	return o.tr
+}
+
+var versionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// Handle implements goproxy.ReqHandler, sending the requests upstream with
+// the transport of the offload.
+func (o *Offload) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if o.Upgrade && req.URL.Scheme == "http" {
+		req.URL.Scheme = "https"
+		if req.URL.Port() == "80" {
+			req.URL.Host = strings.TrimSuffix(req.URL.Host, ":80")
+		}
+		ctx.Logf("Offloading the TLS of the plain HTTP request to %s", req.URL.Host)
+	} else if req.TLS != nil && req.TLS.Version < tls.VersionTLS12 {
+		ctx.Logf("Offloading the %s of the client of %s", versionNames[req.TLS.Version], req.URL.Host)
+	}
+	if req.URL.Scheme == "https" {
+		ctx.Transport = o.transport(ctx.Proxy)
+	}
+	return req, nil
+}
+
+// MitmTLSConfig returns the TLS configuration of the MITM handshakes with
+// the clients, with the client policy.
+func (o *Offload) MitmTLSConfig() func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	sign := goproxy.TLSConfigFromCA(o.ca())
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		config, err := sign(host, ctx)
+		if err != nil {
+			return nil, err
+		}
+		o.clientPolicy().Apply(config)
+		return config, nil
+	}
+}
+
+// HandleConnect implements goproxy.HttpsHandler, MITM'ing the tunnels.
+func (o *Offload) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: o.MitmTLSConfig()}, host
+}
+
+// Install offloads the TLS of the clients of proxy.
+func (o *Offload) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnect(o)
+	proxy.OnRequest().Do(o)
+}
@@ -0,0 +1,69 @@
+package offload_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/offload"
+)
+
+func TestOffload(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Proto)
+		if req.TLS.Version == tls.VersionTLS13 {
+			io.WriteString(w, " TLS 1.3")
+		}
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.TLS = &tls.Config{MinVersion: tls.VersionTLS13}
+	upstream.StartTLS()
+	defer upstream.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(upstream.Certificate())
+
+	o := offload.New()
+	o.RootCAs = pool
+	proxy := goproxy.NewProxyHttpServer()
+	o.Install(proxy)
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+
+	get := func(client *http.Client, url string) string {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// A plain HTTP client.
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	target := strings.Replace(upstream.URL, "https:", "http:", 1)
+	if body := get(client, target); body != "HTTP/2.0 TLS 1.3" {
+		t.Errorf("Expected the plain HTTP request to be sent over TLS 1.3, got %s", body)
+	}
+
+	// A TLS 1.0 client.
+	client = &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS10,
+			MaxVersion:         tls.VersionTLS10,
+			CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA},
+		},
+	}}
+	if body := get(client, upstream.URL); body != "HTTP/2.0 TLS 1.3" {
+		t.Errorf("Expected the TLS 1.0 request to be sent over TLS 1.3, got %s", body)
+	}
+}
@@ -0,0 +1,152 @@
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Exporter captures the exchanges handled by the proxy into a Writer.
+// Bodies are captured while they are streamed, so the exporter doesn't delay
+// the traffic, but they're buffered in memory until the exchange completes.
+type Exporter struct {
+	w *Writer
+	// MaxBodySize limits the captured bytes of each body, 0 means no limit.
+	MaxBodySize int
+}
+
+// NewExporter creates an Exporter writing to w.
+func NewExporter(w *Writer) *Exporter {
+	return &Exporter{w: w}
+}
+
+// Install registers the exporter on every request and response of proxy.
+// Use it with a MITM HttpsHandler to export decrypted HTTPS exchanges.
+func (e *Exporter) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(e.OnRequest)
+	proxy.OnResponse().DoFunc(e.OnResponse)
+}
+
+type captureBody struct {
+	io.ReadCloser
+	limit int
+	mu    sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	if c.limit <= 0 || c.buf.Len() < c.limit {
+		chunk := p[:n]
+		if c.limit > 0 && c.buf.Len()+n > c.limit {
+			chunk = chunk[:c.limit-c.buf.Len()]
+		}
+		c.buf.Write(chunk)
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *captureBody) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+// OnRequest is a request handler, recording the request body as it's sent.
+func (e *Exporter) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &captureBody{ReadCloser: req.Body, limit: e.MaxBodySize}
+	}
+	return req, nil
+}
+
+type responseBody struct {
+	*captureBody
+	once   sync.Once
+	finish func(body []byte)
+}
+
+func (r *responseBody) Read(p []byte) (int, error) {
+	n, err := r.captureBody.Read(p)
+	if err != nil {
+		r.once.Do(func() { r.finish(r.bytes()) })
+	}
+	return n, err
+}
+
+func (r *responseBody) Close() error {
+	err := r.captureBody.Close()
+	r.once.Do(func() { r.finish(r.bytes()) })
+	return err
+}
+
+// OnResponse is a response handler, writing the exchange once the response
+// body has been sent to the client.
+func (e *Exporter) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	req := ctx.Req
+	start := time.Now()
+	client, server := ClientEndpoint(req.RemoteAddr), ServerEndpoint(req.URL.Host)
+
+	finish := func(respBody []byte) {
+		var reqBody []byte
+		if c, ok := req.Body.(*captureBody); ok {
+			reqBody = c.bytes()
+		}
+		request, err := dumpRequest(req, reqBody)
+		if err != nil {
+			ctx.Warnf("pcap: cannot dump request: %v", err)
+			return
+		}
+		response, err := dumpResponse(resp, respBody)
+		if err != nil {
+			ctx.Warnf("pcap: cannot dump response: %v", err)
+			return
+		}
+		if err := e.w.WriteExchange(start, client, server, request, response); err != nil {
+			ctx.Warnf("pcap: cannot write exchange: %v", err)
+		}
+	}
+	if resp.Body == nil {
+		finish(nil)
+		return resp
+	}
+	resp.Body = &responseBody{
+		captureBody: &captureBody{ReadCloser: resp.Body, limit: e.MaxBodySize},
+		finish:      finish,
+	}
+	return resp
+}
+
+// dumpRequest serializes the request with its captured body. The body is
+// stored decoded, so the framing headers are rewritten to match it.
+func dumpRequest(req *http.Request, body []byte) ([]byte, error) {
+	r := req.Clone(req.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Transfer-Encoding")
+	r.RequestURI = req.URL.RequestURI()
+	return httputil.DumpRequest(r, true)
+}
+
+func dumpResponse(resp *http.Response, body []byte) ([]byte, error) {
+	r := *resp
+	r.Header = resp.Header.Clone()
+	r.Header.Del("Transfer-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.TransferEncoding = nil
+	r.ContentLength = int64(len(body))
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return httputil.DumpResponse(&r, true)
+}
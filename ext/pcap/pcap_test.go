@@ -0,0 +1,112 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/pcap"
+)
+
+type block struct {
+	kind uint32
+	body []byte
+}
+
+func readBlocks(t *testing.T, b []byte) []block {
+	t.Helper()
+	var blocks []block
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("Truncated block: %d bytes", len(b))
+		}
+		kind := binary.LittleEndian.Uint32(b)
+		total := binary.LittleEndian.Uint32(b[4:])
+		if total%4 != 0 || int(total) > len(b) || binary.LittleEndian.Uint32(b[total-4:]) != total {
+			t.Fatalf("Invalid block length %d", total)
+		}
+		blocks = append(blocks, block{kind, b[8 : total-4]})
+		b = b[total:]
+	}
+	return blocks
+}
+
+// payload concatenates the TCP payloads of the enhanced packet blocks.
+func payload(blocks []block) string {
+	var sb strings.Builder
+	for _, b := range blocks {
+		if b.kind != 6 {
+			continue
+		}
+		captured := binary.LittleEndian.Uint32(b.body[12:])
+		packet := b.body[20 : 20+captured]
+		sb.Write(packet[40:])
+	}
+	return sb.String()
+}
+
+func TestWriteExchange(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 3000\r\n\r\n" + strings.Repeat("x", 3000)
+	err = w.WriteExchange(time.Now(), pcap.ClientEndpoint("127.0.0.1:4000"), pcap.ServerEndpoint("example.com"),
+		[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), []byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	if blocks[0].kind != 0x0A0D0D0A || blocks[1].kind != 1 {
+		t.Fatal("Missing pcapng headers")
+	}
+	// Handshake, 1 request segment, 3 response segments, close
+	if n := len(blocks) - 2; n != 10 {
+		t.Errorf("Expected 10 packets, got %d", n)
+	}
+	if got := payload(blocks); got != "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"+response {
+		t.Errorf("Unexpected payload %q", got)
+	}
+}
+
+func TestExporter(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte("echo:"), body...))
+	}))
+	defer background.Close()
+
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	pcap.NewExporter(w).Install(proxy)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Post(background.URL+"/path", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	got := payload(readBlocks(t, buf.Bytes()))
+	if !strings.HasPrefix(got, "POST /path HTTP/1.1\r\n") || !strings.Contains(got, "\r\n\r\nping") ||
+		!strings.HasSuffix(got, "echo:ping") {
+		t.Errorf("Unexpected payload %q", got)
+	}
+}
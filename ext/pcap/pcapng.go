@@ -0,0 +1,247 @@
+// Package pcap exports the HTTP exchanges seen by the proxy, including the
+// decrypted MITM'd ones, as synthetic pcapng captures, so that they can be
+// analysed with standard network tools like Wireshark or tshark.
+package pcap
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	blockSectionHeader   = 0x0A0D0D0A
+	blockInterface       = 0x00000001
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1A2B3C4D
+	linkTypeRaw          = 101
+	maxSegmentSize       = 1460
+	tcpFlagFin           = 0x01
+	tcpFlagSyn           = 0x02
+	tcpFlagPsh           = 0x08
+	tcpFlagAck           = 0x10
+	ipv4HeaderLen        = 20
+	tcpHeaderLen         = 20
+	defaultServerPort    = 80
+	synthesizedNetPrefix = 198 // 198.18.0.0/15 is reserved for benchmarking
+)
+
+// Writer writes synthetic TCP/IPv4 flows to a pcapng stream.
+// It's safe for concurrent use.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter writes the pcapng section and interface headers to w, and
+// returns a Writer appending the packets to it.
+// w can be a regular file or a named pipe read by a live capture tool.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	// Unknown section length
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	if err := pw.writeBlock(blockSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	if err := pw.writeBlock(blockInterface, idb); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *Writer) writeBlock(blockType uint32, body []byte) error {
+	padded := (len(body) + 3) &^ 3
+	total := 12 + padded
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	_, err := pw.w.Write(b)
+	return err
+}
+
+func (pw *Writer) writePacket(ts time.Time, packet []byte) error {
+	body := make([]byte, 20+len(packet))
+	micros := uint64(ts.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(body[0:], 0)
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	copy(body[20:], packet)
+	return pw.writeBlock(blockEnhancedPacket, body)
+}
+
+// Endpoint is one side of a synthetic flow.
+type Endpoint struct {
+	IP   net.IP
+	Port uint16
+}
+
+// ClientEndpoint converts a remote address in host:port form to an Endpoint.
+// Addresses that aren't IPv4 are mapped to 10.0.0.1.
+func ClientEndpoint(remoteAddr string) Endpoint {
+	e := Endpoint{IP: net.IPv4(10, 0, 0, 1)}
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return e
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		e.IP = ip
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		e.Port = uint16(p)
+	}
+	return e
+}
+
+// ServerEndpoint returns the Endpoint used for host. IPv4 literals are kept,
+// other hosts get a stable address in the 198.18.0.0/15 range.
+// The port is always 80, the payload being decrypted HTTP.
+func ServerEndpoint(host string) Endpoint {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return Endpoint{IP: ip, Port: defaultServerPort}
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(host))
+	sum := h.Sum32()
+	return Endpoint{
+		IP:   net.IPv4(synthesizedNetPrefix, 18|byte(sum>>16)&1, byte(sum>>8), byte(sum)),
+		Port: defaultServerPort,
+	}
+}
+
+type flow struct {
+	pw       *Writer
+	ts       time.Time
+	src, dst Endpoint
+	seq, ack uint32
+	ipID     uint16
+}
+
+func (f *flow) send(fromClient bool, flags byte, payload []byte) error {
+	src, dst := f.src, f.dst
+	seq, ack := f.seq, f.ack
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	f.ipID++
+	packet := buildPacket(src, dst, seq, ack, flags, f.ipID, payload)
+
+	advance := uint32(len(payload))
+	if flags&(tcpFlagSyn|tcpFlagFin) != 0 {
+		advance++
+	}
+	if fromClient {
+		f.seq += advance
+	} else {
+		f.ack += advance
+	}
+	// Keep the packets ordered in time inside the flow
+	f.ts = f.ts.Add(time.Microsecond)
+	return f.pw.writePacket(f.ts, packet)
+}
+
+func (f *flow) data(fromClient bool, payload []byte) error {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > maxSegmentSize {
+			n = maxSegmentSize
+		}
+		if err := f.send(fromClient, tcpFlagAck|tcpFlagPsh, payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// WriteExchange writes a complete TCP flow between client and server: the
+// handshake, the request bytes, the response bytes and the connection close.
+func (pw *Writer) WriteExchange(ts time.Time, client, server Endpoint, request, response []byte) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	f := &flow{pw: pw, ts: ts, src: client, dst: server, seq: 1000, ack: 5000}
+	steps := []func() error{
+		func() error { return f.send(true, tcpFlagSyn, nil) },
+		func() error { return f.send(false, tcpFlagSyn|tcpFlagAck, nil) },
+		func() error { return f.send(true, tcpFlagAck, nil) },
+		func() error { return f.data(true, request) },
+		func() error { return f.data(false, response) },
+		func() error { return f.send(false, tcpFlagFin|tcpFlagAck, nil) },
+		func() error { return f.send(true, tcpFlagFin|tcpFlagAck, nil) },
+		func() error { return f.send(false, tcpFlagAck, nil) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func buildPacket(src, dst Endpoint, seq, ack uint32, flags byte, id uint16, payload []byte) []byte {
+	total := ipv4HeaderLen + tcpHeaderLen + len(payload)
+	p := make([]byte, total)
+
+	ip := p[:ipv4HeaderLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(total))
+	binary.BigEndian.PutUint16(ip[4:], id)
+	ip[8] = 64
+	ip[9] = 6 // TCP
+	copy(ip[12:16], src.IP.To4())
+	copy(ip[16:20], dst.IP.To4())
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	tcp := p[ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], src.Port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	if flags&tcpFlagAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	tcp[12] = (tcpHeaderLen / 4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[tcpHeaderLen:], payload)
+
+	var pseudo uint32
+	pseudo += uint32(binary.BigEndian.Uint16(ip[12:])) + uint32(binary.BigEndian.Uint16(ip[14:]))
+	pseudo += uint32(binary.BigEndian.Uint16(ip[16:])) + uint32(binary.BigEndian.Uint16(ip[18:]))
+	pseudo += 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, pseudo))
+	return p
+}
@@ -0,0 +1,182 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Edge dials the upstream connections of a proxy through a Gateway.
+type Edge struct {
+	// Addr is the address of the gateway.
+	Addr string
+	// TLSConfig is the configuration of the sessions with the gateway,
+	// with the client certificate of the edge.
+	TLSConfig *tls.Config
+	// Conns is the number of sessions with the gateway, 2 by default.
+	Conns int
+	// Codec compresses the sessions, Zstd by default.
+	Codec Codec
+	// Dialer dials the gateway, a net.Dialer by default.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	// OffloadTLS makes the gateway establish the TLS connections of the
+	// HTTPS requests of the proxy, such as the MITM'd ones, so that they
+	// are compressed in the session. The gateway then verifies the
+	// upstream certificates, and ProxyCtx.UpstreamTLS returns nil.
+	OffloadTLS bool
+
+	mu       sync.Mutex
+	dialing  sync.Mutex
+	sessions []*session
+	closed   bool
+}
+
+var errEdgeClosed = errors.New("peer: edge closed")
+
+// session returns the live session with the fewest streams, dialing a new
+// one while there are fewer than Conns.
+func (e *Edge) session(ctx context.Context) (*session, error) {
+	conns := e.Conns
+	if conns <= 0 {
+		conns = 2
+	}
+	e.mu.Lock()
+	live := e.sessions[:0]
+	for _, s := range e.sessions {
+		if s.Err() == nil {
+			live = append(live, s)
+		}
+	}
+	e.sessions = live
+	closed, n := e.closed, len(live)
+	e.mu.Unlock()
+	if closed {
+		return nil, errEdgeClosed
+	}
+	if n < conns {
+		e.dialing.Lock()
+		defer e.dialing.Unlock()
+		e.mu.Lock()
+		n = len(e.sessions)
+		e.mu.Unlock()
+		if n < conns {
+			s, err := e.dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			if e.closed {
+				s.close(errEdgeClosed)
+				return nil, errEdgeClosed
+			}
+			e.sessions = append(e.sessions, s)
+			return s, nil
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var best *session
+	for _, s := range e.sessions {
+		if best == nil || s.count() < best.count() {
+			best = s
+		}
+	}
+	if best == nil {
+		return nil, errSessionClosed
+	}
+	return best, nil
+}
+
+func (e *Edge) dial(ctx context.Context) (*session, error) {
+	var conn net.Conn
+	var err error
+	if e.Dialer != nil {
+		conn, err = e.Dialer(ctx, "tcp", e.Addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", e.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := e.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(e.Addr)
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	codec := e.Codec
+	if codec == nil {
+		codec = Zstd
+	}
+	if _, err := tlsConn.Write([]byte(preface + codec.Name() + "\n")); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	w, err := codec.NewWriter(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	r, err := codec.NewReader(bufio.NewReader(tlsConn))
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	s := newSession(tlsConn, w, r)
+	go s.run()
+	return s, nil
+}
+
+// DialContext opens a connection to addr through the gateway.
+func (e *Edge) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s, err := e.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(ctx, network, addr)
+}
+
+// DialTLSContext opens a TLS connection to addr established by the gateway.
+// The connection is in clear between the peers, in the session.
+func (e *Edge) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return e.DialContext(ctx, "tls", addr)
+}
+
+// Install makes proxy dial its upstream connections and tunnels through the
+// gateway.
+func (e *Edge) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.Tr.DialContext = e.DialContext
+	if e.OffloadTLS {
+		proxy.Tr.DialTLSContext = e.DialTLSContext
+	}
+	proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+		return e.DialContext(req.Context(), network, addr)
+	}
+}
+
+// Close closes the sessions with the gateway.
+func (e *Edge) Close() error {
+	e.mu.Lock()
+	sessions := e.sessions
+	e.sessions, e.closed = nil, true
+	e.mu.Unlock()
+	for _, s := range sessions {
+		s.close(errEdgeClosed)
+	}
+	return nil
+}
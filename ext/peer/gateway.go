@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errPreface = errors.New("peer: invalid session preface")
+
+// Gateway serves the sessions of the edges, dialing their connections.
+type Gateway struct {
+	// Dial dials the targets of the edges, a net.Dialer by default.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// DialTimeout bounds the dials, 30 seconds by default.
+	DialTimeout time.Duration
+	// TLSConfig is the configuration of the TLS connections offloaded by
+	// the edges, verifying the upstream certificates by default.
+	TLSConfig *tls.Config
+	// Codecs are the codecs accepted besides Zstd, Flate and Identity.
+	Codecs []Codec
+}
+
+// Serve serves the sessions of the connections accepted on l, which should
+// be a TLS listener authenticating the edges.
+func (g *Gateway) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go g.ServeConn(conn)
+	}
+}
+
+func (g *Gateway) codec(name string) Codec {
+	for _, c := range append([]Codec{Zstd, Flate, Identity}, g.Codecs...) {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// ServeConn serves the session of conn, until it is closed.
+func (g *Gateway) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, preface) {
+		return errPreface
+	}
+	codec := g.codec(strings.TrimSuffix(line[len(preface):], "\n"))
+	if codec == nil {
+		return errPreface
+	}
+	conn.SetReadDeadline(time.Time{})
+	w, err := codec.NewWriter(conn)
+	if err != nil {
+		return err
+	}
+	r, err := codec.NewReader(br)
+	if err != nil {
+		return err
+	}
+	s := newSession(conn, w, r)
+	// The edges open the odd streams.
+	s.nextID = 2
+	s.accept = g.accept
+	s.run()
+	if err := s.Err(); !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (g *Gateway) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	offload := network == "tls"
+	if offload {
+		network = "tcp"
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("unsupported network " + network)
+	}
+	var conn net.Conn
+	var err error
+	if g.Dial != nil {
+		conn, err = g.Dial(ctx, network, addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil || !offload {
+		return conn, err
+	}
+	config := g.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	// The edge speaks HTTP/1.1 on the offloaded connections.
+	config.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// accept dials the target of a stream, and copies the data until both
+// sides are closed.
+func (g *Gateway) accept(st *stream, network, addr string) {
+	timeout := g.DialTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-st.s.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	target, err := g.dial(ctx, network, addr)
+	cancel()
+	if err != nil {
+		st.s.remove(st)
+		st.s.send(frame{typ: frameReset, id: st.id, payload: []byte(err.Error())})
+		return
+	}
+	defer target.Close()
+	defer st.Close()
+	if err := st.s.send(frame{typ: frameOK, id: st.id}); err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := io.Copy(target, st); err != nil {
+			// The stream is closed, not half-closed.
+			target.Close()
+		} else if hc, ok := target.(interface{ CloseWrite() error }); ok {
+			hc.CloseWrite()
+		} else {
+			target.Close()
+		}
+	}()
+	io.Copy(st, target)
+	st.CloseWrite()
+	wg.Wait()
+}
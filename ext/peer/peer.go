@@ -0,0 +1,96 @@
+// Package peer is a protocol between two goproxy instances, an edge and a
+// gateway, carrying the upstream connections of the edge multiplexed over a
+// few long-lived TLS connections, compressed. It saves the handshakes and
+// the bandwidth of a WAN link between the proxies:
+//
+//	// On the gateway.
+//	l, _ := tls.Listen("tcp", ":7443", serverConfig)
+//	go (&peer.Gateway{}).Serve(l)
+//
+//	// On the edge.
+//	edge := &peer.Edge{Addr: "gateway.example.com:7443", TLSConfig: clientConfig}
+//	edge.Install(proxy)
+//
+// The gateway dials the addresses requested by any edge: its listener
+// should require client certificates, with tls.RequireAndVerifyClientCert.
+//
+// The sessions are compressed with zstd by default. A Codec for another
+// algorithm can be plugged in on both peers.
+package peer
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// preface starts the sessions, followed by the name of the codec and a new
+// line. The rest of the session is compressed.
+const preface = "GOPROXY-PEER/1 "
+
+// Writer is a compressing writer, whose Flush writes the pending data.
+type Writer interface {
+	io.Writer
+	Flush() error
+}
+
+// Codec compresses the sessions.
+type Codec interface {
+	// Name identifies the codec in the preface of the sessions.
+	Name() string
+	NewWriter(w io.Writer) (Writer, error)
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+// Zstd is the codec of zstd, at its fastest level, which is the default.
+var Zstd Codec = zstdCodec{}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) NewWriter(w io.Writer) (Writer, error) {
+	// Without concurrency, the frames are compressed by the goroutine of
+	// the session, rather than by goroutines left to their Close.
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+}
+
+// Flate is the codec of compress/flate, at a level trading the ratio for
+// the speed.
+var Flate Codec = flateCodec{level: flate.BestSpeed}
+
+type flateCodec struct {
+	level int
+}
+
+func (c flateCodec) Name() string { return "deflate" }
+
+func (c flateCodec) NewWriter(w io.Writer) (Writer, error) {
+	return flate.NewWriter(w, c.level)
+}
+
+func (c flateCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+// Identity is the codec without compression, for the links compressed by
+// other means.
+var Identity Codec = identityCodec{}
+
+type identityCodec struct{}
+
+func (identityCodec) Name() string { return "identity" }
+
+func (identityCodec) NewWriter(w io.Writer) (Writer, error) {
+	return bufio.NewWriterSize(w, maxFrame+headerSize), nil
+}
+
+func (identityCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return r, nil
+}
@@ -0,0 +1,120 @@
+package peer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/peer"
+)
+
+var payload = bytes.Repeat([]byte("compressible payload "), 50000)
+
+func startGateway(t *testing.T, g *peer.Gateway) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{goproxy.GoproxyCa}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go g.Serve(l)
+	return l.Addr().String()
+}
+
+func startEdge(t *testing.T, edge *peer.Edge, proxy *goproxy.ProxyHttpServer) *http.Client {
+	edge.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	edge.Install(proxy)
+	s := httptest.NewServer(proxy)
+	t.Cleanup(func() {
+		s.Close()
+		edge.Close()
+	})
+	u, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+func check(t *testing.T, client *http.Client, u string) {
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || !bytes.Equal(body, payload) {
+		t.Errorf("%s: %d bytes, %v", u, len(body), err)
+	}
+}
+
+func TestPeer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	var dials int
+	var mu sync.Mutex
+	edge := &peer.Edge{Addr: startGateway(t, &peer.Gateway{}), Conns: 1}
+	edge.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dials++
+		mu.Unlock()
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+	client := startEdge(t, edge, goproxy.NewProxyHttpServer())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			check(t, client, plain.URL)
+		}()
+		go func() {
+			defer wg.Done()
+			check(t, client, secure.URL)
+		}()
+	}
+	wg.Wait()
+	if dials != 1 {
+		t.Errorf("%d sessions dialed, want 1", dials)
+	}
+
+	_, err := edge.DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	var dialErr *peer.DialError
+	if !errors.As(err, &dialErr) {
+		t.Errorf("dial error %v", err)
+	}
+}
+
+func TestOffloadTLS(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			t.Error("request without TLS")
+		}
+		w.Write(payload)
+	}))
+	defer secure.Close()
+
+	gateway := &peer.Gateway{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	edge := &peer.Edge{Addr: startGateway(t, gateway), OffloadTLS: true}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client := startEdge(t, edge, proxy)
+	check(t, client, secure.URL)
+}
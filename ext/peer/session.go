@@ -0,0 +1,577 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The frames of a session, after the preface, are a type byte, a stream ID
+// and a payload length, both big endian uint32, and the payload.
+const (
+	// frameOpen opens a stream to the "network address" of the payload.
+	frameOpen = iota
+	// frameOK acknowledges the dial of a stream.
+	frameOK
+	frameData
+	// frameWindow grants the uint32 of the payload more bytes of data.
+	frameWindow
+	// frameFin half-closes a stream.
+	frameFin
+	// frameClose closes a stream.
+	frameClose
+	// frameReset fails the dial of a stream, with the error message of the
+	// payload.
+	frameReset
+)
+
+const (
+	headerSize = 9
+	maxFrame   = 16 << 10
+	// window is the data buffered by a stream that isn't read.
+	window = 256 << 10
+)
+
+var (
+	errSessionClosed = errors.New("peer: session closed")
+	errStreamClosed  = errors.New("peer: stream closed")
+	errProtocol      = errors.New("peer: protocol error")
+)
+
+type frame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+// session multiplexes the streams over a compressed connection between the
+// peers. The frames are written by a single goroutine, which flushes the
+// compressor once the pending frames are written, so that the frames of
+// the concurrent streams are batched.
+type session struct {
+	conn net.Conn
+	w    Writer
+	r    *bufio.Reader
+	out  chan frame
+	// accept, on the gateway, dials the streams opened by the edge.
+	accept func(st *stream, network, addr string)
+
+	mu      sync.Mutex
+	streams map[uint32]*stream
+	nextID  uint32
+	err     error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSession(conn net.Conn, w Writer, r io.Reader) *session {
+	s := &session{
+		conn:    conn,
+		w:       w,
+		r:       bufio.NewReaderSize(r, maxFrame+headerSize),
+		out:     make(chan frame, 64),
+		streams: make(map[uint32]*stream),
+		nextID:  1,
+		closed:  make(chan struct{}),
+	}
+	return s
+}
+
+func (s *session) run() {
+	go s.writeLoop()
+	s.readLoop()
+}
+
+// close terminates the session and its streams with err.
+func (s *session) close(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = nil
+		s.mu.Unlock()
+		close(s.closed)
+		s.conn.Close()
+		for _, st := range streams {
+			st.fail(err)
+		}
+	})
+}
+
+// Err returns the error that closed the session, nil while it is open.
+func (s *session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *session) writeLoop() {
+	var header [headerSize]byte
+	write := func(f frame) error {
+		header[0] = f.typ
+		binary.BigEndian.PutUint32(header[1:], f.id)
+		binary.BigEndian.PutUint32(header[5:], uint32(len(f.payload)))
+		if _, err := s.w.Write(header[:]); err != nil {
+			return err
+		}
+		_, err := s.w.Write(f.payload)
+		return err
+	}
+	for {
+		var f frame
+		select {
+		case f = <-s.out:
+		case <-s.closed:
+			return
+		}
+		err := write(f)
+	batch:
+		for err == nil {
+			select {
+			case f = <-s.out:
+				err = write(f)
+			default:
+				break batch
+			}
+		}
+		if err == nil {
+			err = s.w.Flush()
+		}
+		if err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *session) send(f frame) error {
+	select {
+	case s.out <- f:
+		return nil
+	case <-s.closed:
+		return errSessionClosed
+	}
+}
+
+func (s *session) readLoop() {
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.r, header[:]); err != nil {
+			s.close(err)
+			return
+		}
+		typ, id := header[0], binary.BigEndian.Uint32(header[1:])
+		n := binary.BigEndian.Uint32(header[5:])
+		if n > maxFrame {
+			s.close(errProtocol)
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(s.r, payload); err != nil {
+			s.close(err)
+			return
+		}
+		if err := s.handle(typ, id, payload); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *session) handle(typ byte, id uint32, payload []byte) error {
+	if typ == frameOpen {
+		if s.accept == nil {
+			return errProtocol
+		}
+		network, addr, ok := bytes.Cut(payload, []byte{' '})
+		if !ok {
+			return errProtocol
+		}
+		st := newStream(s, id, string(addr))
+		s.mu.Lock()
+		if _, dup := s.streams[id]; dup || s.streams == nil {
+			s.mu.Unlock()
+			return errProtocol
+		}
+		s.streams[id] = st
+		s.mu.Unlock()
+		go s.accept(st, string(network), string(addr))
+		return nil
+	}
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	if st == nil {
+		// The frames of the streams closed locally are dropped.
+		return nil
+	}
+	switch typ {
+	case frameOK:
+		st.ack(nil)
+	case frameReset:
+		st.ack(&DialError{Addr: st.addr, Msg: string(payload)})
+		s.remove(st)
+	case frameData:
+		return st.receive(payload)
+	case frameWindow:
+		if len(payload) != 4 {
+			return errProtocol
+		}
+		st.grant(int(binary.BigEndian.Uint32(payload)))
+	case frameFin:
+		st.finish(io.EOF)
+	case frameClose:
+		st.finish(errStreamClosed)
+		s.remove(st)
+	default:
+		return errProtocol
+	}
+	return nil
+}
+
+// open opens a stream to addr, waiting for the dial of the gateway.
+func (s *session) open(ctx context.Context, network, addr string) (*stream, error) {
+	s.mu.Lock()
+	if s.streams == nil {
+		s.mu.Unlock()
+		return nil, errSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id, addr)
+	s.streams[id] = st
+	s.mu.Unlock()
+	if err := s.send(frame{typ: frameOpen, id: id, payload: []byte(network + " " + addr)}); err != nil {
+		return nil, err
+	}
+	select {
+	case err := <-st.opened:
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	case <-ctx.Done():
+		st.Close()
+		return nil, ctx.Err()
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+func (s *session) remove(st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams != nil && s.streams[st.id] == st {
+		delete(s.streams, st.id)
+	}
+}
+
+func (s *session) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// DialError is the error of the dial of a stream by the gateway.
+type DialError struct {
+	Addr string
+	Msg  string
+}
+
+func (e *DialError) Error() string {
+	return "peer: gateway dial " + e.Addr + ": " + e.Msg
+}
+
+// stream is a connection multiplexed in a session. The data sent is bounded
+// by the window granted by the remote stream as it is read.
+type stream struct {
+	s    *session
+	id   uint32
+	addr string
+
+	opened chan error
+
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	rerr   error
+	werr   error
+	credit int
+	// unacked is the data read and not granted back yet.
+	unacked   int
+	finSent   bool
+	closeSent bool
+
+	readable chan struct{}
+	writable chan struct{}
+	rd, wd   deadline
+}
+
+func newStream(s *session, id uint32, addr string) *stream {
+	return &stream{
+		s:        s,
+		id:       id,
+		addr:     addr,
+		opened:   make(chan error, 1),
+		credit:   window,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		rd:       makeDeadline(),
+		wd:       makeDeadline(),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (st *stream) ack(err error) {
+	select {
+	case st.opened <- err:
+	default:
+	}
+}
+
+func (st *stream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.rerr != nil {
+		return nil
+	}
+	if st.buf.Len()+len(data) > window {
+		return errProtocol
+	}
+	st.buf.Write(data)
+	signal(st.readable)
+	return nil
+}
+
+func (st *stream) grant(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	signal(st.writable)
+}
+
+// finish ends the reads once the buffered data is read with err, and the
+// writes too unless it is the half-close io.EOF.
+func (st *stream) finish(err error) {
+	st.mu.Lock()
+	if st.rerr == nil {
+		st.rerr = err
+	}
+	if err != io.EOF && st.werr == nil {
+		st.werr = err
+	}
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+}
+
+func (st *stream) fail(err error) {
+	st.ack(err)
+	st.mu.Lock()
+	st.buf.Reset()
+	st.rerr, st.werr = err, err
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+}
+
+func (st *stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.unacked += n
+			var grant []byte
+			if st.unacked >= window/4 && st.rerr == nil {
+				grant = binary.BigEndian.AppendUint32(nil, uint32(st.unacked))
+				st.unacked = 0
+			}
+			st.mu.Unlock()
+			if grant != nil {
+				st.s.send(frame{typ: frameWindow, id: st.id, payload: grant})
+			}
+			return n, nil
+		}
+		err := st.rerr
+		st.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-st.readable:
+		case <-st.rd.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (st *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		if st.werr != nil || st.finSent {
+			err := st.werr
+			st.mu.Unlock()
+			if err == nil {
+				err = errStreamClosed
+			}
+			return written, err
+		}
+		n := st.credit
+		if n > len(p) {
+			n = len(p)
+		}
+		if n > maxFrame {
+			n = maxFrame
+		}
+		st.credit -= n
+		st.mu.Unlock()
+		if n == 0 {
+			select {
+			case <-st.writable:
+				continue
+			case <-st.wd.wait():
+				return written, os.ErrDeadlineExceeded
+			}
+		}
+		data := make([]byte, n)
+		copy(data, p)
+		if err := st.s.send(frame{typ: frameData, id: st.id, payload: data}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream, as the tunnels of the proxy do.
+func (st *stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.closeSent {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	return st.s.send(frame{typ: frameFin, id: st.id})
+}
+
+// CloseRead is a no-op, the remote stream stops writing on its Close.
+func (st *stream) CloseRead() error {
+	return nil
+}
+
+func (st *stream) Close() error {
+	st.mu.Lock()
+	if st.closeSent {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closeSent = true
+	if st.rerr == nil {
+		st.rerr = net.ErrClosed
+	}
+	if st.werr == nil {
+		st.werr = net.ErrClosed
+	}
+	st.buf.Reset()
+	st.mu.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+	st.s.remove(st)
+	st.s.send(frame{typ: frameClose, id: st.id})
+	return nil
+}
+
+func (st *stream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *stream) RemoteAddr() net.Addr { return streamAddr(st.addr) }
+
+func (st *stream) SetDeadline(t time.Time) error {
+	st.rd.set(t)
+	st.wd.set(t)
+	return nil
+}
+
+func (st *stream) SetReadDeadline(t time.Time) error {
+	st.rd.set(t)
+	return nil
+}
+
+func (st *stream) SetWriteDeadline(t time.Time) error {
+	st.wd.set(t)
+	return nil
+}
+
+// streamAddr is the target address of a stream.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "peer" }
+func (a streamAddr) String() string  { return string(a) }
+
+// deadline is a deadline of a stream, whose channel is closed after it.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, wait for the close of the channel.
+		<-d.cancel
+	}
+	d.timer = nil
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
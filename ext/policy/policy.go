@@ -0,0 +1,188 @@
+// Package policy applies per-user policy profiles: access control, rate
+// limiting, MITM decision and request logging are chosen from the identity
+// established by the authentication handlers.
+package policy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Profile is the policy applied to a set of users.
+type Profile struct {
+	Name string
+	// Allow, if not nil, must match for the request to be accepted.
+	Allow goproxy.ReqCondition
+	// Deny rejects the matching requests.
+	Deny goproxy.ReqCondition
+	// RequestsPerSecond limits the request rate of every user of the
+	// profile, with bursts of up to Burst requests. Zero disables the limit.
+	RequestsPerSecond float64
+	Burst             int
+	// Mitm enables the interception of the CONNECT requests.
+	Mitm bool
+	// LogRequests logs every request of the profile users, even when the
+	// proxy isn't verbose.
+	LogRequests bool
+}
+
+// GroupProfile assigns a profile to the members of a group.
+type GroupProfile struct {
+	Group   string
+	Profile *Profile
+}
+
+// Policy selects the Profile of each request from ctx.Identity: first by user
+// name, then by the first matching group, and finally Default.
+// Anonymous requests get the Anonymous profile, if any, or are rejected.
+type Policy struct {
+	Users     map[string]*Profile
+	Groups    []GroupProfile
+	Default   *Profile
+	Anonymous *Profile
+	// Clock tells the time of the rate limits, goproxy.SystemClock by
+	// default.
+	Clock goproxy.Clock
+
+	mu       sync.Mutex
+	limiters map[string]*bucket
+}
+
+// ProfileFor returns the profile applied to the request of ctx, nil if the
+// request isn't allowed by any profile.
+func (p *Policy) ProfileFor(ctx *goproxy.ProxyCtx) *Profile {
+	id := ctx.Identity
+	if id == nil {
+		return p.Anonymous
+	}
+	if profile, ok := p.Users[id.Name]; ok {
+		return profile
+	}
+	for _, g := range p.Groups {
+		if id.InGroup(g.Group) {
+			return g.Profile
+		}
+	}
+	return p.Default
+}
+
+// ProfileIs returns a ReqCondition testing whether the request is governed by
+// the profile with the given name.
+func (p *Policy) ProfileIs(name string) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		profile := p.ProfileFor(ctx)
+		return profile != nil && profile.Name == name
+	}
+}
+
+func (p *Policy) allow(profile *Profile, ctx *goproxy.ProxyCtx) bool {
+	if profile.RequestsPerSecond <= 0 {
+		return true
+	}
+	key := profile.Name
+	if ctx.Identity != nil {
+		key += "/" + ctx.Identity.Name
+	}
+
+	p.mu.Lock()
+	if p.limiters == nil {
+		p.limiters = make(map[string]*bucket)
+	}
+	b, ok := p.limiters[key]
+	if !ok {
+		b = newBucket(profile.RequestsPerSecond, profile.Burst)
+		p.limiters[key] = b
+	}
+	p.mu.Unlock()
+	if p.Clock != nil {
+		return b.take(p.Clock.Now())
+	}
+	return b.take(time.Now())
+}
+
+func forbidden(req *http.Request, reason string) *http.Response {
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, reason)
+}
+
+// HandleRequest enforces the profile of the request.
+func (p *Policy) HandleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	profile := p.ProfileFor(ctx)
+	if profile == nil {
+		return nil, forbidden(req, "No policy for this user")
+	}
+	if profile.LogRequests {
+		user := "-"
+		if ctx.Identity != nil {
+			user = ctx.Identity.Name
+		}
+		ctx.Warnf("policy %s: %s %s %s", profile.Name, user, req.Method, req.URL)
+	}
+	if profile.Deny != nil && profile.Deny.HandleReq(req, ctx) {
+		ctx.Error = &goproxy.ErrBlockedByRule{RuleID: profile.Name, Reason: "denied"}
+		return nil, forbidden(req, "Request denied by policy "+profile.Name)
+	}
+	if profile.Allow != nil && !profile.Allow.HandleReq(req, ctx) {
+		ctx.Error = &goproxy.ErrBlockedByRule{RuleID: profile.Name, Reason: "not allowed"}
+		return nil, forbidden(req, "Request not allowed by policy "+profile.Name)
+	}
+	if !p.allow(profile, ctx) {
+		return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+	return req, nil
+}
+
+// HandleConnect enforces the profile of a CONNECT request and decides whether
+// it's MITM'd.
+func (p *Policy) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if _, resp := p.HandleRequest(ctx.Req, ctx); resp != nil {
+		ctx.Resp = resp
+		return goproxy.RejectConnect, host
+	}
+	if p.ProfileFor(ctx).Mitm {
+		return goproxy.MitmConnect, host
+	}
+	return goproxy.OkConnect, host
+}
+
+// Install registers the policy on proxy. It must be called after the
+// authentication handlers, so that the identity is known.
+func (p *Policy) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(p.HandleRequest)
+	proxy.OnRequest().HandleConnectFunc(p.HandleConnect)
+}
+
+// bucket is a token bucket rate limiter.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *bucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
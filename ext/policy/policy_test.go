@@ -0,0 +1,108 @@
+package policy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/auth"
+	"github.com/InsideOutSec/goproxy/ext/policy"
+)
+
+func newProxy(t *testing.T, p *policy.Policy) *url.URL {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	auth.ProxyBasic(proxy, "test", func(user, passwd string) bool {
+		return passwd == "secret"
+	})
+	p.Install(proxy)
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	u, _ := url.Parse(s.URL)
+	return u
+}
+
+func get(t *testing.T, proxyURL *url.URL, user, target string) int {
+	t.Helper()
+	u := *proxyURL
+	u.User = url.UserPassword(user, "secret")
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&u)}}
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestProfiles(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer background.Close()
+
+	admin := &policy.Profile{Name: "admin"}
+	restricted := &policy.Profile{
+		Name: "restricted",
+		Deny: goproxy.UrlHasPrefix(background.Listener.Addr().String() + "/admin"),
+	}
+	u := newProxy(t, &policy.Policy{
+		Users:   map[string]*policy.Profile{"root": admin},
+		Default: restricted,
+	})
+
+	if code := get(t, u, "root", background.URL+"/admin"); code != http.StatusOK {
+		t.Errorf("Expected admin to be allowed, got %d", code)
+	}
+	if code := get(t, u, "bob", background.URL+"/admin"); code != http.StatusForbidden {
+		t.Errorf("Expected restricted user to be denied, got %d", code)
+	}
+	if code := get(t, u, "bob", background.URL+"/public"); code != http.StatusOK {
+		t.Errorf("Expected restricted user to access public pages, got %d", code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer background.Close()
+
+	clock := goproxy.NewFakeClock(time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC))
+	u := newProxy(t, &policy.Policy{
+		Default: &policy.Profile{Name: "limited", RequestsPerSecond: 0.001, Burst: 2},
+		Clock:   clock,
+	})
+
+	for i := 0; i < 2; i++ {
+		if code := get(t, u, "alice", background.URL); code != http.StatusOK {
+			t.Fatalf("Request %d: expected 200, got %d", i, code)
+		}
+	}
+	if code := get(t, u, "alice", background.URL); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", code)
+	}
+	if code := get(t, u, "carol", background.URL); code != http.StatusOK {
+		t.Errorf("Expected other users to have their own limit, got %d", code)
+	}
+	clock.Advance(1000 * time.Second)
+	if code := get(t, u, "alice", background.URL); code != http.StatusOK {
+		t.Errorf("Expected the limit to be refilled, got %d", code)
+	}
+}
+
+func TestIdentityConditions(t *testing.T) {
+	ctx := &goproxy.ProxyCtx{Identity: &goproxy.Identity{Name: "alice", Groups: []string{"staff"}}}
+	if !goproxy.UserIs("alice").HandleReq(nil, ctx) {
+		t.Error("Expected UserIs to match")
+	}
+	if !goproxy.UserInGroup("admins", "staff").HandleReq(nil, ctx) {
+		t.Error("Expected UserInGroup to match")
+	}
+	if goproxy.IsAuthenticated.HandleReq(nil, &goproxy.ProxyCtx{}) {
+		t.Error("Expected anonymous request not to be authenticated")
+	}
+}
@@ -0,0 +1,109 @@
+// Package privacy removes tracking information from the outbound requests:
+// cookies, the Referer header and the well known tracking query parameters.
+package privacy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// DefaultTrackingParams are the query parameters removed by default.
+// A trailing * matches every parameter with that prefix.
+var DefaultTrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+	"mc_cid", "mc_eid", "yclid", "igshid", "_hsenc", "_hsmi", "mkt_tok",
+	"oly_anon_id", "oly_enc_id", "vero_id", "twclid", "ttclid",
+}
+
+// Stripper removes the configured tracking data from the requests.
+type Stripper struct {
+	// Params are the query parameters to remove, with optional trailing *.
+	Params []string
+	// Cookies are the names of the cookies to remove. A single "*" removes
+	// every cookie.
+	Cookies []string
+	// StripReferer removes the Referer header.
+	StripReferer bool
+	// Exempt lists the domains whose requests aren't modified, the
+	// subdomains of an exempted domain are exempted too.
+	Exempt []string
+}
+
+// NewStripper returns a Stripper removing the default tracking parameters and
+// the Referer header.
+func NewStripper() *Stripper {
+	return &Stripper{
+		Params:       DefaultTrackingParams,
+		StripReferer: true,
+	}
+}
+
+func matchName(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == "*" || p == name {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Stripper) exempted(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range s.Exempt {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle implements goproxy.ReqHandler.
+func (s *Stripper) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if s.exempted(req.URL.Hostname()) {
+		return req, nil
+	}
+
+	if len(s.Params) > 0 && req.URL.RawQuery != "" {
+		s.stripQuery(req)
+	}
+	if s.StripReferer {
+		req.Header.Del("Referer")
+	}
+	if len(s.Cookies) > 0 {
+		s.stripCookies(req)
+	}
+	return req, nil
+}
+
+// stripQuery removes the parameters keeping the order and the encoding of
+// the remaining ones, since url.Values would reorder them.
+func (s *Stripper) stripQuery(req *http.Request) {
+	parts := strings.Split(req.URL.RawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		name, _, _ := strings.Cut(part, "=")
+		if matchName(s.Params, name) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	req.URL.RawQuery = strings.Join(kept, "&")
+}
+
+func (s *Stripper) stripCookies(req *http.Request) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !matchName(s.Cookies, c.Name) {
+			req.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package privacy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/privacy"
+)
+
+func TestStripper(t *testing.T) {
+	s := privacy.NewStripper()
+	s.Cookies = []string{"_ga", "_fb*"}
+	s.Exempt = []string{"trusted.com"}
+
+	req := httptest.NewRequest(http.MethodGet,
+		"http://example.com/page?id=1&utm_source=news&fbclid=abc&b=%20x&UTM_Medium=mail", nil)
+	req.Header.Set("Referer", "http://other.com/")
+	req.Header.Set("Cookie", "_ga=1; session=2; _fbp=3")
+	s.Handle(req, &goproxy.ProxyCtx{})
+
+	if req.URL.RawQuery != "id=1&b=%20x" {
+		t.Errorf("Unexpected query %q", req.URL.RawQuery)
+	}
+	if req.Header.Get("Referer") != "" {
+		t.Error("Referer not removed")
+	}
+	if cookie := req.Header.Get("Cookie"); cookie != "session=2" {
+		t.Errorf("Unexpected cookies %q", cookie)
+	}
+
+	exempted := httptest.NewRequest(http.MethodGet, "http://www.trusted.com/?utm_source=x", nil)
+	exempted.Header.Set("Referer", "http://other.com/")
+	s.Handle(exempted, &goproxy.ProxyCtx{})
+	if exempted.URL.RawQuery != "utm_source=x" || exempted.Header.Get("Referer") == "" {
+		t.Error("Exempted domain was modified")
+	}
+}
@@ -0,0 +1,463 @@
+// Package quota enforces daily and monthly caps on the traffic of the proxy
+// users:
+//
+//	q := quota.New(quota.Limit{Period: quota.Monthly, Bytes: 10 << 30})
+//	q.Install(proxy)
+//	http.Serve(proxy.TrackListener(l), proxy)
+//
+// The opaque tunnels are counted once closed, from the connections of the
+// listeners wrapped by TrackListener, the MITM'd requests being counted as
+// the others.
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Period is the accounting period of a Limit.
+type Period int
+
+const (
+	Daily Period = iota
+	Monthly
+)
+
+func (p Period) String() string {
+	if p == Monthly {
+		return "monthly"
+	}
+	return "daily"
+}
+
+// start returns the beginning of the period containing t.
+func (p Period) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if p == Monthly {
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Limit caps the bytes and requests of a client over a period. A zero cap is
+// unlimited.
+type Limit struct {
+	Period   Period
+	Bytes    int64
+	Requests int64
+}
+
+// Usage is the consumption of a client over a period.
+type Usage struct {
+	Start    time.Time `json:"start"`
+	Bytes    int64     `json:"bytes"`
+	Requests int64     `json:"requests"`
+}
+
+// Store keeps the usage of the clients outside of the process, to share it
+// between proxy instances.
+type Store interface {
+	// Usage returns the usage of client for the period p starting at start.
+	Usage(client string, p Period, start time.Time) (Usage, error)
+	// Add adds bytes and requests to the usage of client for the period p
+	// starting at start.
+	Add(client string, p Period, start time.Time, bytes, requests int64) error
+}
+
+// Quota tracks the usage of every client against Limits. The bytes of the
+// request and response bodies are counted, once the response is sent, and
+// those of the tunnels once closed, so a client can exceed its byte cap by
+// one response or tunnel. The zero Quota is unlimited.
+type Quota struct {
+	Limits []Limit
+	// ClientKey identifies the client of a request, UserOrIP by default.
+	ClientKey func(req *http.Request, ctx *goproxy.ProxyCtx) string
+	// WarningThreshold is the fraction of a cap from which the
+	// WarningHeader is added to the responses. Defaults to 0.8.
+	WarningThreshold float64
+	// WarningHeader defaults to X-Quota-Warning.
+	WarningHeader string
+	// Exceeded returns the response sent once a cap is reached. Defaults to
+	// a 429 Too Many Requests.
+	Exceeded func(req *http.Request, ctx *goproxy.ProxyCtx, limit Limit) *http.Response
+	// Store, when set, keeps the usage instead of the memory of the Quota,
+	// whose Clients, Reset, Save and Load then don't apply. The requests
+	// are allowed when the Store fails.
+	Store Store
+	// Clock tells the time of the periods, goproxy.SystemClock by default.
+	Clock goproxy.Clock
+
+	mu      sync.Mutex
+	clients map[string]map[Period]*Usage
+	// tunnels are the clients of the tunnels open, by client address.
+	tunnels map[string]string
+}
+
+// maxTunnels bounds the tunnels open remembered, those of the listeners not
+// wrapped by TrackListener never being closed.
+const maxTunnels = 65536
+
+func (q *Quota) now() time.Time {
+	if q.Clock != nil {
+		return q.Clock.Now()
+	}
+	return time.Now()
+}
+
+// New creates a Quota enforcing limits.
+func New(limits ...Limit) *Quota {
+	return &Quota{
+		Limits:    limits,
+		ClientKey: UserOrIP,
+		clients:   make(map[string]map[Period]*Usage),
+	}
+}
+
+func (q *Quota) clientKey(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	if q.ClientKey != nil {
+		return q.ClientKey(req, ctx)
+	}
+	return UserOrIP(req, ctx)
+}
+
+// UserOrIP returns the name of the authenticated user, or the IP address of
+// the client.
+func UserOrIP(req *http.Request, ctx *goproxy.ProxyCtx) string {
+	if ctx.Identity != nil {
+		return ctx.Identity.Name
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// usage must be called with the lock held.
+func (q *Quota) usage(client string, p Period, now time.Time) *Usage {
+	if q.clients == nil {
+		q.clients = make(map[string]map[Period]*Usage)
+	}
+	periods, ok := q.clients[client]
+	if !ok {
+		periods = make(map[Period]*Usage)
+		q.clients[client] = periods
+	}
+	start := p.start(now)
+	u, ok := periods[p]
+	if !ok || !u.Start.Equal(start) {
+		u = &Usage{Start: start}
+		periods[p] = u
+	}
+	return u
+}
+
+func (q *Quota) storeUsage(client string, p Period, now time.Time) (Usage, error) {
+	start := p.start(now)
+	u, err := q.Store.Usage(client, p, start)
+	u.Start = start
+	return u, err
+}
+
+// periods returns the distinct periods of the limits.
+func (q *Quota) periods() []Period {
+	var periods []Period
+	seen := make(map[Period]bool)
+	for _, l := range q.Limits {
+		if !seen[l.Period] {
+			seen[l.Period] = true
+			periods = append(periods, l.Period)
+		}
+	}
+	return periods
+}
+
+// Usage returns the usage of client for the period p.
+func (q *Quota) Usage(client string, p Period) Usage {
+	if q.Store != nil {
+		u, _ := q.storeUsage(client, p, q.now())
+		return u
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.usage(client, p, q.now())
+}
+
+// Clients returns the clients with a recorded usage.
+func (q *Quota) Clients() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	clients := make([]string, 0, len(q.clients))
+	for c := range q.clients {
+		clients = append(clients, c)
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// Reset forgets the usage of client.
+func (q *Quota) Reset(client string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.clients, client)
+}
+
+// Save writes the usage of all the clients to w, as JSON.
+func (q *Quota) Save(w io.Writer) error {
+	q.mu.Lock()
+	state := make(map[string]map[string]Usage, len(q.clients))
+	for client, periods := range q.clients {
+		state[client] = make(map[string]Usage, len(periods))
+		for p, u := range periods {
+			state[client][p.String()] = *u
+		}
+	}
+	q.mu.Unlock()
+	return json.NewEncoder(w).Encode(state)
+}
+
+// Load restores the usage previously written by Save. The usages of past
+// periods are reset on their next use.
+func (q *Quota) Load(r io.Reader) error {
+	var state map[string]map[string]Usage
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.clients == nil {
+		q.clients = make(map[string]map[Period]*Usage)
+	}
+	for client, periods := range state {
+		for name, u := range periods {
+			p := Daily
+			if name == Monthly.String() {
+				p = Monthly
+			}
+			if q.clients[client] == nil {
+				q.clients[client] = make(map[Period]*Usage)
+			}
+			u := u
+			q.clients[client][p] = &u
+		}
+	}
+	return nil
+}
+
+// exceededBody marks the responses of the exhausted quotas, which aren't
+// counted.
+type exceededBody struct {
+	io.ReadCloser
+}
+
+func (q *Quota) exceeded(req *http.Request, ctx *goproxy.ProxyCtx, limit Limit) *http.Response {
+	var resp *http.Response
+	if q.Exceeded != nil {
+		resp = q.Exceeded(req, ctx, limit)
+	} else {
+		resp = goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests,
+			fmt.Sprintf("Your %s quota is exhausted", limit.Period))
+	}
+	if resp != nil && resp.Body != nil {
+		resp.Body = exceededBody{resp.Body}
+	}
+	return resp
+}
+
+// OnRequest rejects the requests of the clients that reached a cap, and
+// counts the others.
+func (q *Quota) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if resp := q.admit(req, ctx, q.clientKey(req, ctx), 1); resp != nil {
+		return nil, resp
+	}
+	return req, nil
+}
+
+// HandleConnect is a goproxy.FuncHttpsHandler rejecting the CONNECT of the
+// clients that reached a cap with the Exceeded response. The tunnels are
+// counted once closed.
+func (q *Quota) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	client := q.clientKey(ctx.Req, ctx)
+	if resp := q.admit(ctx.Req, ctx, client, 0); resp != nil {
+		ctx.Resp = resp
+		return goproxy.RejectConnect, host
+	}
+	q.mu.Lock()
+	if q.tunnels == nil || len(q.tunnels) >= maxTunnels {
+		q.tunnels = make(map[string]string)
+	}
+	q.tunnels[ctx.Req.RemoteAddr] = client
+	q.mu.Unlock()
+	return nil, host
+}
+
+// admit returns the Exceeded response when client reached a cap, or counts
+// its requests.
+func (q *Quota) admit(req *http.Request, ctx *goproxy.ProxyCtx, client string, requests int64) *http.Response {
+	now := q.now()
+	if q.Store != nil {
+		return q.storeAdmit(req, ctx, client, now, requests)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, l := range q.Limits {
+		u := q.usage(client, l.Period, now)
+		if (l.Bytes > 0 && u.Bytes >= l.Bytes) || (l.Requests > 0 && u.Requests >= l.Requests) {
+			return q.exceeded(req, ctx, l)
+		}
+	}
+	for _, p := range q.periods() {
+		q.usage(client, p, now).Requests += requests
+	}
+	return nil
+}
+
+func (q *Quota) storeAdmit(req *http.Request, ctx *goproxy.ProxyCtx, client string, now time.Time, requests int64) *http.Response {
+	for _, l := range q.Limits {
+		u, err := q.storeUsage(client, l.Period, now)
+		if err != nil {
+			ctx.Warnf("Cannot read the quota of %s: %v", client, err)
+			continue
+		}
+		if (l.Bytes > 0 && u.Bytes >= l.Bytes) || (l.Requests > 0 && u.Requests >= l.Requests) {
+			return q.exceeded(req, ctx, l)
+		}
+	}
+	if requests == 0 {
+		return nil
+	}
+	for _, p := range q.periods() {
+		if err := q.Store.Add(client, p, p.start(now), 0, requests); err != nil {
+			ctx.Warnf("Cannot count the request of %s: %v", client, err)
+		}
+	}
+	return nil
+}
+
+// add counts n bytes and requests for client.
+func (q *Quota) add(client string, n, requests int64) {
+	now := q.now()
+	if q.Store != nil {
+		for _, p := range q.periods() {
+			_ = q.Store.Add(client, p, p.start(now), n, requests)
+		}
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, p := range q.periods() {
+		u := q.usage(client, p, now)
+		u.Bytes += n
+		u.Requests += requests
+	}
+}
+
+// connClosed counts the opaque tunnels, as one request.
+func (q *Quota) connClosed(e *goproxy.Event) {
+	if e.Conn == nil {
+		return
+	}
+	q.mu.Lock()
+	client, ok := q.tunnels[e.Conn.RemoteAddr]
+	delete(q.tunnels, e.Conn.RemoteAddr)
+	q.mu.Unlock()
+	if ok && e.Conn.Kind == goproxy.ConnTunnel {
+		q.add(client, e.Conn.BytesIn+e.Conn.BytesOut, 1)
+	}
+}
+
+// warning returns the warning for the usage of client, if any.
+func (q *Quota) warning(client string) string {
+	threshold := q.WarningThreshold
+	if threshold <= 0 {
+		threshold = 0.8
+	}
+	now := q.now()
+	usage := func(p Period) Usage {
+		u, _ := q.storeUsage(client, p, now)
+		return u
+	}
+	if q.Store == nil {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		usage = func(p Period) Usage {
+			return *q.usage(client, p, now)
+		}
+	}
+	for _, l := range q.Limits {
+		u := usage(l.Period)
+		if l.Bytes > 0 && float64(u.Bytes) >= threshold*float64(l.Bytes) {
+			return fmt.Sprintf("%s bytes %d/%d", l.Period, u.Bytes, l.Bytes)
+		}
+		if l.Requests > 0 && float64(u.Requests) >= threshold*float64(l.Requests) {
+			return fmt.Sprintf("%s requests %d/%d", l.Period, u.Requests, l.Requests)
+		}
+	}
+	return ""
+}
+
+// countingBody counts the bytes read from the response body.
+type countingBody struct {
+	io.ReadCloser
+	q      *Quota
+	client string
+	n      int64
+	done   bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	if !b.done {
+		b.done = true
+		b.q.add(b.client, b.n, 0)
+	}
+	return b.ReadCloser.Close()
+}
+
+// OnResponse adds the warning header, and counts the bytes of the exchange.
+func (q *Quota) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	if _, ok := resp.Body.(exceededBody); ok {
+		return resp
+	}
+	client := q.clientKey(ctx.Req, ctx)
+	if ctx.Req.ContentLength > 0 {
+		q.add(client, ctx.Req.ContentLength, 0)
+	}
+	if warning := q.warning(client); warning != "" {
+		header := q.WarningHeader
+		if header == "" {
+			header = "X-Quota-Warning"
+		}
+		resp.Header.Set(header, warning)
+	}
+	if resp.Body != nil {
+		resp.Body = &countingBody{ReadCloser: resp.Body, q: q, client: client}
+	}
+	return resp
+}
+
+// Install enforces the quota on all the requests and tunnels of proxy. It
+// must be called after the authentication handlers, so that the users are
+// known, and before the CONNECT handlers.
+func (q *Quota) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnectFunc(q.HandleConnect)
+	proxy.OnRequest().DoFunc(q.OnRequest)
+	proxy.OnResponse().DoFunc(q.OnResponse)
+	proxy.Subscribe(q.connClosed, goproxy.EventConnClosed)
+}
@@ -0,0 +1,226 @@
+package quota_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/quota"
+)
+
+func TestQuota(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("x", 100))
+	}))
+	defer background.Close()
+
+	q := quota.New(
+		quota.Limit{Period: quota.Daily, Bytes: 250},
+		quota.Limit{Period: quota.Monthly, Requests: 10},
+	)
+	proxy := goproxy.NewProxyHttpServer()
+	q.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	var statuses []int
+	var warnings []string
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(background.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+		warnings = append(warnings, resp.Header.Get("X-Quota-Warning"))
+	}
+	if statuses[2] != http.StatusOK || statuses[3] != http.StatusTooManyRequests {
+		t.Errorf("Expected the fourth request to exceed the quota, got %v", statuses)
+	}
+	if warnings[1] != "" || warnings[2] == "" {
+		t.Errorf("Expected a warning on the third response, got %q", warnings)
+	}
+	if u := q.Usage("127.0.0.1", quota.Monthly); u.Requests != 3 || u.Bytes != 300 {
+		t.Errorf("Unexpected monthly usage %+v", u)
+	}
+
+	var saved bytes.Buffer
+	if err := q.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	restored := quota.New(q.Limits...)
+	if err := restored.Load(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if u := restored.Usage("127.0.0.1", quota.Daily); u.Bytes != 300 {
+		t.Errorf("Expected usage to survive a restart, got %+v", u)
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	// The zero Quota counts with UserOrIP.
+	q := &quota.Quota{Limits: []quota.Limit{{Period: quota.Daily, Bytes: 100}}}
+	proxy := goproxy.NewProxyHttpServer()
+	q.Install(proxy)
+	closed := make(chan struct{}, 1)
+	proxy.Subscribe(func(*goproxy.Event) { closed <- struct{}{} }, goproxy.EventConnClosed)
+	s := httptest.NewUnstartedServer(proxy)
+	s.Listener = proxy.TrackListener(s.Listener)
+	s.Start()
+	defer s.Close()
+
+	connect := func() (net.Conn, int) {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, resp.StatusCode
+	}
+	c, code := connect()
+	if code != http.StatusOK {
+		t.Fatalf("Expected the tunnel to be established, got %d", code)
+	}
+	payload := strings.Repeat("x", 100)
+	io.WriteString(c, payload)
+	if _, err := io.ReadFull(c, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	<-closed
+
+	if u := q.Usage("127.0.0.1", quota.Daily); u.Requests != 1 || u.Bytes < 200 {
+		t.Errorf("Expected the bytes of the tunnel to be counted, got %+v", u)
+	}
+	c, code = connect()
+	c.Close()
+	if code != http.StatusTooManyRequests {
+		t.Errorf("Expected the next tunnel to exceed the quota, got %d", code)
+	}
+}
+
+func TestExceeded(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	q := quota.New(quota.Limit{Period: quota.Daily, Requests: 1})
+	var limits []quota.Limit
+	q.Exceeded = func(req *http.Request, ctx *goproxy.ProxyCtx, limit quota.Limit) *http.Response {
+		limits = append(limits, limit)
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusPaymentRequired, "upgrade your plan")
+	}
+	q.Install(proxy)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "ok")
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	var bodies []string
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		bodies = append(bodies, fmt.Sprintf("%d %s", resp.StatusCode, body))
+	}
+	if bodies[0] != "200 ok" || bodies[1] != "402 upgrade your plan" {
+		t.Errorf("Expected the Exceeded response, got %q", bodies)
+	}
+	if len(limits) != 1 || limits[0].Requests != 1 {
+		t.Errorf("Expected the limit reached, got %+v", limits)
+	}
+	// The Exceeded responses aren't counted.
+	if u := q.Usage("127.0.0.1", quota.Daily); u.Requests != 1 || u.Bytes != 2 {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 3, 31, 23, 0, 0, 0, time.UTC)}
+	q := quota.New(quota.Limit{Period: quota.Daily, Bytes: 1000}, quota.Limit{Period: quota.Monthly, Bytes: 1000})
+	q.Clock = clock
+	proxy := goproxy.NewProxyHttpServer()
+	q.Install(proxy)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, strings.Repeat("x", 10))
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var saved bytes.Buffer
+	if err := q.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	// The zero Quota loads the usage too.
+	restored := &quota.Quota{Limits: q.Limits, Clock: clock}
+	if err := restored.Load(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if clients := restored.Clients(); len(clients) != 1 || clients[0] != "127.0.0.1" {
+		t.Errorf("Expected the client to be restored, got %q", clients)
+	}
+	for _, p := range []quota.Period{quota.Daily, quota.Monthly} {
+		if u := restored.Usage("127.0.0.1", p); u.Requests != 1 || u.Bytes != 10 {
+			t.Errorf("Expected the %s usage to be restored, got %+v", p, u)
+		}
+	}
+
+	// The usages of the past periods are reset.
+	clock.now = clock.now.Add(2 * time.Hour)
+	for _, p := range []quota.Period{quota.Daily, quota.Monthly} {
+		if u := restored.Usage("127.0.0.1", p); u.Requests != 0 || u.Bytes != 0 {
+			t.Errorf("Expected the %s usage of the past period to be reset, got %+v", p, u)
+		}
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
@@ -0,0 +1,278 @@
+// Package redact masks the secrets of the traffic in the outputs of the
+// proxy: its log, the HAR captures and the inspector flows. A Redactor
+// masks the credential headers, the credential parameters of the URLs and
+// the configured body patterns:
+//
+//	proxy.Logger = redact.Default.Logger(proxy.Logger)
+//
+//	// The captures also mask the card numbers of the bodies.
+//	capture := redact.Default.Clone()
+//	capture.BodyPatterns = []*regexp.Regexp{regexp.MustCompile(`\b(?:\d[ -]?){13,16}\b`)}
+//	logger := har.NewLogger(export, har.WithRedactor(capture))
+//
+// Every output has its own Redactor, whose settings override the defaults.
+package redact
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Mask replaces the redacted values.
+const Mask = "[redacted]"
+
+// DefaultHeaders are the headers masked by default.
+var DefaultHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+	"X-Api-Key", "Api-Key", "X-Auth-Token", "X-Csrf-Token", "X-Amz-Security-Token",
+}
+
+// DefaultParams are the URL query parameters masked by default.
+var DefaultParams = []string{
+	"access_token", "id_token", "refresh_token", "client_secret", "api_key", "apikey",
+	"password", "token", "sig", "signature", "X-Amz-Signature", "X-Amz-Security-Token",
+}
+
+// Default is the Redactor with the default settings.
+var Default = &Redactor{}
+
+// Redactor masks the secrets of headers, URLs, bodies and log lines.
+type Redactor struct {
+	// Headers are the masked headers, DefaultHeaders when nil.
+	Headers []string
+	// Params are the masked URL query parameters, DefaultParams when nil.
+	// They are compared case-insensitively.
+	Params []string
+	// BodyPatterns are masked in the bodies and the log lines. When a
+	// pattern has groups, only the first one is masked, for example the
+	// value of `"password":\s*"([^"]*)"`.
+	BodyPatterns []*regexp.Regexp
+	// Mask replaces the redacted values, Mask by default.
+	Mask string
+
+	once     sync.Once
+	headers  map[string]bool
+	params   map[string]bool
+	lineHdr  *regexp.Regexp
+	lineArgs *regexp.Regexp
+}
+
+// Clone returns a copy of r, to override its settings for an output.
+func (r *Redactor) Clone() *Redactor {
+	return &Redactor{
+		Headers:      cloneStrings(r.Headers),
+		Params:       cloneStrings(r.Params),
+		BodyPatterns: append([]*regexp.Regexp(nil), r.BodyPatterns...),
+		Mask:         r.Mask,
+	}
+}
+
+// cloneStrings copies s, keeping it nil or empty.
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+func quoteAll(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = regexp.QuoteMeta(name)
+	}
+	return strings.Join(quoted, "|")
+}
+
+func (r *Redactor) init() {
+	r.once.Do(func() {
+		headers := r.Headers
+		if headers == nil {
+			headers = DefaultHeaders
+		}
+		params := r.Params
+		if params == nil {
+			params = DefaultParams
+		}
+		r.headers = make(map[string]bool, len(headers))
+		for _, h := range headers {
+			r.headers[http.CanonicalHeaderKey(h)] = true
+		}
+		r.params = make(map[string]bool, len(params))
+		for _, p := range params {
+			r.params[strings.ToLower(p)] = true
+		}
+		if len(headers) > 0 {
+			r.lineHdr = regexp.MustCompile(`(?i)\b((?:` + quoteAll(headers) + `)\s*[:=]\s*)[^\r\n]*`)
+		}
+		if len(params) > 0 {
+			r.lineArgs = regexp.MustCompile(`(?i)([?&;](?:` + quoteAll(params) + `)=)[^&\s"'#]*`)
+		}
+	})
+}
+
+func (r *Redactor) mask() string {
+	if r.Mask != "" {
+		return r.Mask
+	}
+	return Mask
+}
+
+// Masked returns the string replacing the redacted values.
+func (r *Redactor) Masked() string {
+	return r.mask()
+}
+
+// replacement is the replacement of the patterns keeping their first group.
+func (r *Redactor) replacement() string {
+	return "${1}" + strings.ReplaceAll(r.mask(), "$", "$$")
+}
+
+// SensitiveHeader returns whether the header name is masked.
+func (r *Redactor) SensitiveHeader(name string) bool {
+	r.init()
+	return r.headers[http.CanonicalHeaderKey(name)]
+}
+
+// SensitiveParam returns whether the URL query parameter name is masked.
+func (r *Redactor) SensitiveParam(name string) bool {
+	r.init()
+	return r.params[strings.ToLower(name)]
+}
+
+// Header returns a copy of h with the sensitive headers masked.
+func (r *Redactor) Header(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	redacted := make(http.Header, len(h))
+	for name, values := range h {
+		if r.SensitiveHeader(name) {
+			values = []string{r.mask()}
+		} else {
+			values = append([]string(nil), values...)
+			for i, v := range values {
+				values[i] = r.Text(v)
+			}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// HeaderValue returns the value of the header name, masked if it is
+// sensitive.
+func (r *Redactor) HeaderValue(name, value string) string {
+	if r.SensitiveHeader(name) {
+		return r.mask()
+	}
+	return r.Text(value)
+}
+
+// Query returns a copy of values with the sensitive parameters masked.
+func (r *Redactor) Query(values url.Values) url.Values {
+	redacted := make(url.Values, len(values))
+	for name, vs := range values {
+		if r.SensitiveParam(name) {
+			masked := make([]string, len(vs))
+			for i := range masked {
+				masked[i] = r.mask()
+			}
+			vs = masked
+		}
+		redacted[name] = vs
+	}
+	return redacted
+}
+
+// URL returns s with its password and sensitive query parameters masked.
+func (r *Redactor) URL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return r.Line(s)
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), r.mask())
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = r.Form(u.RawQuery)
+	}
+	return u.String()
+}
+
+// Form returns the URL-encoded query or form s with the sensitive
+// parameters masked.
+func (r *Redactor) Form(s string) string {
+	r.init()
+	if r.lineArgs == nil {
+		return s
+	}
+	return r.lineArgs.ReplaceAllString("?"+s, r.replacement())[1:]
+}
+
+// Body returns b with the BodyPatterns masked.
+func (r *Redactor) Body(b []byte) []byte {
+	for _, re := range r.BodyPatterns {
+		b = maskPattern(re, b, []byte(r.mask()))
+	}
+	return b
+}
+
+// Text returns s with the BodyPatterns masked.
+func (r *Redactor) Text(s string) string {
+	if len(r.BodyPatterns) == 0 {
+		return s
+	}
+	return string(r.Body([]byte(s)))
+}
+
+func maskPattern(re *regexp.Regexp, b, mask []byte) []byte {
+	matches := re.FindAllSubmatchIndex(b, -1)
+	if matches == nil {
+		return b
+	}
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) >= 4 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		out = append(out, b[last:start]...)
+		out = append(out, mask...)
+		last = end
+	}
+	return append(out, b[last:]...)
+}
+
+// Line returns a log line with the values of the sensitive headers and URL
+// parameters, and the BodyPatterns, masked.
+func (r *Redactor) Line(s string) string {
+	r.init()
+	if r.lineHdr != nil {
+		s = r.lineHdr.ReplaceAllString(s, r.replacement())
+	}
+	if r.lineArgs != nil {
+		s = r.lineArgs.ReplaceAllString(s, r.replacement())
+	}
+	return r.Text(s)
+}
+
+type logger struct {
+	r    *Redactor
+	next goproxy.Logger
+}
+
+func (l logger) Printf(format string, v ...any) {
+	l.next.Printf("%s", l.r.Line(fmt.Sprintf(format, v...)))
+}
+
+// Logger returns a goproxy.Logger masking the lines printed to next.
+func (r *Redactor) Logger(next goproxy.Logger) goproxy.Logger {
+	return logger{r: r, next: next}
+}
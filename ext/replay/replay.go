@@ -0,0 +1,411 @@
+// Package replay records the exchanges of the proxy, replays them against
+// another host or with mutated headers, and compares the responses:
+//
+//	rec := replay.NewRecorder(100)
+//	rec.Install(proxy)
+//	...
+//	for _, ex := range rec.Exchanges() {
+//		diff, err := replay.Compare(context.Background(), ex, replay.Host("staging.example.com"))
+//		if err == nil && !diff.Equal() {
+//			log.Printf("%s %s differs: %+v", ex.Request.Method, ex.Request.URL, diff)
+//		}
+//	}
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Request is a recorded request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Response is a recorded response.
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// Exchange is a recorded request and its response, which is nil when the
+// request failed.
+type Exchange struct {
+	Request  Request   `json:"request"`
+	Response *Response `json:"response,omitempty"`
+}
+
+// Recorder records the last exchanges of the proxy.
+type Recorder struct {
+	// MaxBody is the size above which the bodies aren't recorded, 1MB by
+	// default. The exchanges with larger bodies are skipped.
+	MaxBody int64
+
+	size int
+
+	mu        sync.Mutex
+	pending   map[int64]*Exchange
+	exchanges []*Exchange
+}
+
+// NewRecorder returns a Recorder of the last size exchanges.
+func NewRecorder(size int) *Recorder {
+	return &Recorder{size: size, pending: make(map[int64]*Exchange)}
+}
+
+func (r *Recorder) maxBody() int64 {
+	if r.MaxBody <= 0 {
+		return 1 << 20
+	}
+	return r.MaxBody
+}
+
+// readBody reads body, restoring it into *into. It returns nil when the
+// body is too large to be recorded.
+func (r *Recorder) readBody(into *io.ReadCloser) ([]byte, bool) {
+	body := *into
+	if body == nil || body == http.NoBody {
+		return nil, true
+	}
+	data, err := io.ReadAll(io.LimitReader(body, r.maxBody()+1))
+	rest := io.MultiReader(bytes.NewReader(data), body)
+	*into = struct {
+		io.Reader
+		io.Closer
+	}{rest, body}
+	return data, err == nil && int64(len(data)) <= r.maxBody()
+}
+
+// OnRequest records the request of an exchange.
+func (r *Recorder) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	body, ok := r.readBody(&req.Body)
+	if !ok {
+		return req, nil
+	}
+	r.mu.Lock()
+	r.pending[ctx.Session] = &Exchange{Request: Request{
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Header: req.Header.Clone(),
+		Body:   body,
+	}}
+	r.mu.Unlock()
+	return req, nil
+}
+
+// OnResponse completes the exchange with its response.
+func (r *Recorder) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	r.mu.Lock()
+	ex, ok := r.pending[ctx.Session]
+	delete(r.pending, ctx.Session)
+	r.mu.Unlock()
+	if !ok {
+		return resp
+	}
+	if resp != nil {
+		body, ok := r.readBody(&resp.Body)
+		if !ok {
+			return resp
+		}
+		ex.Response = &Response{Status: resp.StatusCode, Header: resp.Header.Clone(), Body: body}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges = append(r.exchanges, ex)
+	if len(r.exchanges) > r.size {
+		r.exchanges = r.exchanges[len(r.exchanges)-r.size:]
+	}
+	return resp
+}
+
+// Install records the exchanges of proxy.
+func (r *Recorder) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(r.OnRequest)
+	proxy.OnResponse().DoFunc(r.OnResponse)
+}
+
+// Exchanges returns the recorded exchanges, oldest first.
+func (r *Recorder) Exchanges() []*Exchange {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Exchange(nil), r.exchanges...)
+}
+
+// Option alters a replayed request.
+type Option func(req *http.Request)
+
+// Host sends the request to host, which may include a port, instead of the
+// recorded one.
+func Host(host string) Option {
+	return func(req *http.Request) {
+		req.URL.Host = host
+		req.Host = host
+	}
+}
+
+// Scheme replaces the scheme of the request URL.
+func Scheme(scheme string) Option {
+	return func(req *http.Request) {
+		req.URL.Scheme = scheme
+	}
+}
+
+// SetHeader sets a request header.
+func SetHeader(name, value string) Option {
+	return func(req *http.Request) {
+		req.Header.Set(name, value)
+	}
+}
+
+// DelHeader removes a request header.
+func DelHeader(name string) Option {
+	return func(req *http.Request) {
+		req.Header.Del(name)
+	}
+}
+
+// Client sends the replayed requests. It doesn't follow the redirections,
+// so that they can be compared.
+var Client = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// NewRequest returns the request of ex, altered by opts.
+func NewRequest(ctx context.Context, ex *Exchange, opts ...Option) (*http.Request, error) {
+	u, err := url.Parse(ex.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, ex.Request.Method, u.String(), bytes.NewReader(ex.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = ex.Request.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	// The transport computes them itself.
+	req.Header.Del("Content-Length")
+	req.Header.Del("Accept-Encoding")
+	for _, opt := range opts {
+		opt(req)
+	}
+	return req, nil
+}
+
+// Replay sends the request of ex again, altered by opts.
+func Replay(ctx context.Context, ex *Exchange, opts ...Option) (*Response, error) {
+	req, err := NewRequest(ctx, ex, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Status: resp.StatusCode, Header: resp.Header, Body: body}, nil
+}
+
+// HeaderDiff is a header whose values differ.
+type HeaderDiff struct {
+	Name  string   `json:"name"`
+	Left  []string `json:"left"`
+	Right []string `json:"right"`
+}
+
+// BodyDiff is a difference between the bodies. For JSON bodies, Path is the
+// location of the differing value, such as "$.items[2].id", and Left and
+// Right are the JSON encoding of the values. For the other bodies, Path is
+// "line N", and Left and Right are the differing lines.
+type BodyDiff struct {
+	Path  string `json:"path"`
+	Left  string `json:"left,omitempty"`
+	Right string `json:"right,omitempty"`
+}
+
+// Diff is the structured difference between two responses.
+type Diff struct {
+	LeftStatus  int          `json:"leftStatus"`
+	RightStatus int          `json:"rightStatus"`
+	Headers     []HeaderDiff `json:"headers,omitempty"`
+	Body        []BodyDiff   `json:"body,omitempty"`
+}
+
+// Equal returns whether the responses are identical, ignoring the headers
+// given to DiffResponses.
+func (d *Diff) Equal() bool {
+	return d.LeftStatus == d.RightStatus && len(d.Headers) == 0 && len(d.Body) == 0
+}
+
+// DefaultIgnoredHeaders change between the responses of identical requests.
+var DefaultIgnoredHeaders = []string{"Date", "Expires", "Last-Modified", "Set-Cookie", "Age", "Etag", "Content-Length", "X-Request-Id"}
+
+// DiffResponses compares two responses, ignoring the given headers, or the
+// DefaultIgnoredHeaders when none is given.
+func DiffResponses(left, right *Response, ignore ...string) *Diff {
+	if len(ignore) == 0 {
+		ignore = DefaultIgnoredHeaders
+	}
+	ignored := make(map[string]bool, len(ignore))
+	for _, h := range ignore {
+		ignored[http.CanonicalHeaderKey(h)] = true
+	}
+	d := &Diff{LeftStatus: left.Status, RightStatus: right.Status}
+
+	names := make(map[string]bool)
+	for name := range left.Header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range right.Header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !ignored[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		l, r := left.Header.Values(name), right.Header.Values(name)
+		if !reflect.DeepEqual(l, r) {
+			d.Headers = append(d.Headers, HeaderDiff{Name: name, Left: l, Right: r})
+		}
+	}
+
+	var lv, rv any
+	if json.Unmarshal(left.Body, &lv) == nil && json.Unmarshal(right.Body, &rv) == nil {
+		diffJSON("$", lv, rv, &d.Body)
+	} else if !bytes.Equal(left.Body, right.Body) {
+		diffLines(string(left.Body), string(right.Body), &d.Body)
+	}
+	return d
+}
+
+func encode(v any) string {
+	if v == nil {
+		return "null"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func diffJSON(path string, l, r any, diffs *[]BodyDiff) {
+	switch lv := l.(type) {
+	case map[string]any:
+		rv, ok := r.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for k := range lv {
+			keys[k] = true
+		}
+		for k := range rv {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			lc, lok := lv[k]
+			rc, rok := rv[k]
+			switch {
+			case !lok:
+				*diffs = append(*diffs, BodyDiff{Path: path + "." + k, Right: encode(rc)})
+			case !rok:
+				*diffs = append(*diffs, BodyDiff{Path: path + "." + k, Left: encode(lc)})
+			default:
+				diffJSON(path+"."+k, lc, rc, diffs)
+			}
+		}
+		return
+	case []any:
+		rv, ok := r.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(lv) || i < len(rv); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(lv):
+				*diffs = append(*diffs, BodyDiff{Path: p, Right: encode(rv[i])})
+			case i >= len(rv):
+				*diffs = append(*diffs, BodyDiff{Path: p, Left: encode(lv[i])})
+			default:
+				diffJSON(p, lv[i], rv[i], diffs)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(l, r) {
+		*diffs = append(*diffs, BodyDiff{Path: path, Left: encode(l), Right: encode(r)})
+	}
+}
+
+// diffLines reports the differing lines, after the longest common prefix
+// and suffix.
+func diffLines(left, right string, diffs *[]BodyDiff) {
+	l, r := strings.Split(left, "\n"), strings.Split(right, "\n")
+	start := 0
+	for start < len(l) && start < len(r) && l[start] == r[start] {
+		start++
+	}
+	le, re := len(l), len(r)
+	for le > start && re > start && l[le-1] == r[re-1] {
+		le--
+		re--
+	}
+	for i := 0; start+i < le || start+i < re; i++ {
+		d := BodyDiff{Path: fmt.Sprintf("line %d", start+i+1)}
+		if start+i < le {
+			d.Left = l[start+i]
+		}
+		if start+i < re {
+			d.Right = r[start+i]
+		}
+		*diffs = append(*diffs, d)
+	}
+}
+
+// Compare replays ex with opts and compares the response with the recorded
+// one. When ex has no recorded response, the unaltered request is replayed
+// first.
+func Compare(ctx context.Context, ex *Exchange, opts ...Option) (*Diff, error) {
+	left := ex.Response
+	if left == nil {
+		var err error
+		if left, err = Replay(ctx, ex); err != nil {
+			return nil, err
+		}
+	}
+	right, err := Replay(ctx, ex, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return DiffResponses(left, right), nil
+}
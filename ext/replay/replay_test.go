@@ -0,0 +1,91 @@
+package replay_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/replay"
+)
+
+func TestRecordAndCompare(t *testing.T) {
+	prod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"version": 1, "items": [1, 2], "echo": "`+string(body)+`"}`)
+	}))
+	defer prod.Close()
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Staging", r.Header.Get("X-Debug"))
+		io.WriteString(w, `{"version": 2, "items": [1, 2, 3], "echo": "`+string(body)+`"}`)
+	}))
+	defer staging.Close()
+
+	rec := replay.NewRecorder(10)
+	proxy := goproxy.NewProxyHttpServer()
+	rec.Install(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	resp, err := client.Post(prod.URL+"/api", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	exchanges := rec.Exchanges()
+	if len(exchanges) != 1 || string(exchanges[0].Request.Body) != "ping" || exchanges[0].Response.Status != http.StatusOK {
+		t.Fatalf("Unexpected recorded exchanges %+v", exchanges)
+	}
+
+	diff, err := replay.Compare(context.Background(), exchanges[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Equal() {
+		t.Errorf("Expected the replayed response to be identical, got %+v", diff)
+	}
+
+	stagingURL, _ := url.Parse(staging.URL)
+	diff, err = replay.Compare(context.Background(), exchanges[0],
+		replay.Host(stagingURL.Host), replay.SetHeader("X-Debug", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Headers) != 1 || diff.Headers[0].Name != "X-Staging" || diff.Headers[0].Right[0] != "1" {
+		t.Errorf("Unexpected header differences %+v", diff.Headers)
+	}
+	expected := []replay.BodyDiff{
+		{Path: "$.items[2]", Right: "3"},
+		{Path: "$.version", Left: "1", Right: "2"},
+	}
+	if len(diff.Body) != len(expected) {
+		t.Fatalf("Unexpected body differences %+v", diff.Body)
+	}
+	for i := range expected {
+		if diff.Body[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], diff.Body[i])
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	left := &replay.Response{Status: 200, Body: []byte("a\nb\nc\nd")}
+	right := &replay.Response{Status: 404, Body: []byte("a\nB\nc\nd")}
+	diff := replay.DiffResponses(left, right)
+	if diff.Equal() || diff.LeftStatus != 200 || diff.RightStatus != 404 {
+		t.Errorf("Expected the statuses to differ, got %+v", diff)
+	}
+	if len(diff.Body) != 1 || diff.Body[0] != (replay.BodyDiff{Path: "line 2", Left: "b", Right: "B"}) {
+		t.Errorf("Unexpected line differences %+v", diff.Body)
+	}
+}
@@ -0,0 +1,217 @@
+// Package retry makes the proxy honor the Retry-After of the overloaded
+// upstreams, delaying and retrying the requests rather than propagating the
+// 429 and 503 responses to the clients unable to retry by themselves:
+//
+//	proxy.OnRequest().Do(&retry.Retrier{})
+//
+// While an upstream asks for a delay, the concurrency of the requests to it
+// is reduced, so that the proxy doesn't hammer it as soon as the delay
+// expires.
+package retry
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Retrier retries the requests answered with a Retry-After.
+type Retrier struct {
+	// MaxRetries bounds the retries of a request, 3 by default.
+	MaxRetries int
+	// MaxDelay bounds the delay honored before a retry, beyond which the
+	// response is propagated to the client, 30 seconds by default.
+	MaxDelay time.Duration
+	// BaseDelay is the delay of the first retry of the responses without
+	// Retry-After, doubled at every retry, one second by default.
+	BaseDelay time.Duration
+	// Statuses are the retried statuses, 429 and 503 by default.
+	Statuses []int
+	// MaxBodySize bounds the request bodies buffered to be sent again, 64
+	// KiB by default. The requests with larger bodies aren't retried.
+	MaxBodySize int64
+	// Concurrency bounds the concurrent requests to a host while it asks
+	// for a delay, 1 by default.
+	Concurrency int
+
+	mu    sync.Mutex
+	hosts map[string]*backoff
+}
+
+// backoff is the state of a host asking for a delay.
+type backoff struct {
+	until time.Time
+	sem   chan struct{}
+}
+
+func (r *Retrier) retried(status int) bool {
+	statuses := r.Statuses
+	if statuses == nil {
+		statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryAfter returns the delay of a Retry-After header, in seconds or an
+// HTTP date, and whether there is a valid one.
+func RetryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// delay records the delay asked by host.
+func (r *Retrier) delay(host string, d time.Duration) {
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	until := time.Now().Add(d)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[string]*backoff)
+	}
+	b := r.hosts[host]
+	if b == nil {
+		b = &backoff{sem: make(chan struct{}, concurrency)}
+		r.hosts[host] = b
+	}
+	if until.After(b.until) {
+		b.until = until
+	}
+}
+
+// wait waits for the delay asked by host, and returns the function
+// releasing the request once it is answered.
+func (r *Retrier) wait(req *http.Request, host string) (func(), error) {
+	r.mu.Lock()
+	b := r.hosts[host]
+	if b != nil && !time.Now().Before(b.until) && len(b.sem) == 0 {
+		delete(r.hosts, host)
+		b = nil
+	}
+	r.mu.Unlock()
+	if b == nil {
+		return func() {}, nil
+	}
+	select {
+	case b.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	r.mu.Lock()
+	until := b.until
+	r.mu.Unlock()
+	if d := time.Until(until); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			<-b.sem
+			return nil, req.Context().Err()
+		}
+	}
+	return func() { <-b.sem }, nil
+}
+
+func (r *Retrier) limits() (int, time.Duration, time.Duration, int64) {
+	retries, maxDelay, base, maxBody := r.MaxRetries, r.MaxDelay, r.BaseDelay, r.MaxBodySize
+	if retries == 0 {
+		retries = 3
+	}
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	if base <= 0 {
+		base = time.Second
+	}
+	if maxBody <= 0 {
+		maxBody = 64 << 10
+	}
+	return retries, maxDelay, base, maxBody
+}
+
+// Handle implements goproxy.ReqHandler.
+func (r *Retrier) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	retries, maxDelay, base, maxBody := r.limits()
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength < 0 || req.ContentLength > maxBody {
+			retries = 0
+		} else {
+			var err error
+			if body, err = io.ReadAll(io.LimitReader(req.Body, maxBody+1)); err != nil || int64(len(body)) > maxBody {
+				// The body is sent as read, without retries.
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+				body, retries = nil, 0
+			} else {
+				req.Body.Close()
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+	}
+
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		host := req.URL.Host
+		for attempt := 0; ; attempt++ {
+			release, err := r.wait(req, host)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := next.RoundTrip(req, ctx)
+			release()
+			if err != nil || !r.retried(resp.StatusCode) {
+				return resp, err
+			}
+			d, ok := RetryAfter(resp.Header, time.Now())
+			if !ok {
+				d = base << attempt
+				d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+			}
+			r.delay(host, d)
+			if attempt >= retries || d > maxDelay {
+				return resp, nil
+			}
+			ctx.Logf("retry: %v answered %d, retrying in %v", req.URL, resp.StatusCode, d)
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			if body != nil {
+				req = req.Clone(req.Context())
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+	})
+	return req, nil
+}
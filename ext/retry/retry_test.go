@@ -0,0 +1,142 @@
+package retry_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/retry"
+)
+
+func proxyClient(t *testing.T, r *retry.Retrier) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(r)
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	u, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+}
+
+func TestRetry(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		attempts[r.URL.Path]++
+		n := attempts[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/later" && n == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/backoff" && n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/long":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	client := proxyClient(t, &retry.Retrier{BaseDelay: 10 * time.Millisecond})
+
+	for _, tt := range []struct {
+		path     string
+		status   int
+		attempts int
+	}{
+		{"/later", http.StatusOK, 2},
+		{"/backoff", http.StatusOK, 3},
+		{"/long", http.StatusServiceUnavailable, 1},
+	} {
+		resp, err := client.Post(upstream.URL+tt.path, "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || attempts[tt.path] != tt.attempts || string(body) != "payload" {
+			t.Errorf("%s: %d %q after %d attempts", tt.path, resp.StatusCode, body, attempts[tt.path])
+		}
+	}
+}
+
+func TestConcurrencyReduction(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive, requests int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		first := requests == 1
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer upstream.Close()
+	// The delay is longer than MaxDelay: the first response is propagated.
+	client := proxyClient(t, &retry.Retrier{MaxDelay: time.Millisecond})
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(upstream.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond || maxActive != 1 {
+		t.Errorf("requests done in %v with %d concurrent", elapsed, maxActive)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for v, want := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 Jan 2024 00:00:30 GMT": 30 * time.Second,
+		"Sun, 31 Dec 2023 00:00:00 GMT": 0,
+	} {
+		if d, ok := retry.RetryAfter(http.Header{"Retry-After": {v}}, now); !ok || d != want {
+			t.Errorf("RetryAfter(%q) = %v, %v", v, d, ok)
+		}
+	}
+	if _, ok := retry.RetryAfter(http.Header{"Retry-After": {"soon"}}, now); ok {
+		t.Error("invalid Retry-After accepted")
+	}
+}
@@ -0,0 +1,315 @@
+// Package revocation checks the revocation of the upstream certificates
+// during MITM. The stapled OCSP response of the server is preferred, then
+// the OCSP responder of the certificate is queried, with a fallback to its
+// CRL:
+//
+//	checker := revocation.New(revocation.HardFail)
+//	checker.Install(proxy)
+//
+// Handlers can inspect the upstream chain with ctx.UpstreamChain().
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Policy decides the handshakes whose revocation status can't be known.
+type Policy int
+
+const (
+	// SoftFail accepts the certificates whose status is unknown.
+	SoftFail Policy = iota
+	// HardFail rejects the certificates whose status is unknown.
+	HardFail
+)
+
+// Status is the revocation status of a certificate.
+type Status int
+
+const (
+	Unknown Status = iota
+	Good
+	Revoked
+)
+
+func (s Status) String() string {
+	switch s {
+	case Good:
+		return "good"
+	case Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrRevoked is returned by VerifyConnection for a revoked certificate,
+// whatever the policy.
+var ErrRevoked = errors.New("revocation: certificate revoked")
+
+// maxResponseSize bounds the OCSP responses and the CRLs.
+const maxResponseSize = 10 << 20
+
+// Checker checks the revocation of certificates, caching the results until
+// the next update of their OCSP response or CRL.
+type Checker struct {
+	Policy Policy
+	// Client queries the OCSP responders and downloads the CRLs,
+	// http.DefaultClient by default. It mustn't use the checked proxy.
+	Client *http.Client
+	// Timeout bounds a check, 5 seconds by default.
+	Timeout time.Duration
+	// DisableCRL disables the CRL fallback.
+	DisableCRL bool
+	// CacheTTL is the cache duration of the results without a next update,
+	// and of the unknown results, one hour by default.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	status  Status
+	expires time.Time
+}
+
+// New returns a Checker of policy.
+func New(policy Policy) *Checker {
+	return &Checker{Policy: policy}
+}
+
+func (c *Checker) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+func (c *Checker) ttl() time.Duration {
+	if c.CacheTTL > 0 {
+		return c.CacheTTL
+	}
+	return time.Hour
+}
+
+func cacheKey(cert, issuer *x509.Certificate) string {
+	h := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(h[:]) + ":" + cert.SerialNumber.String()
+}
+
+func (c *Checker) cached(key string) (Status, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return Unknown, false
+	}
+	return e.status, true
+}
+
+func (c *Checker) store(key string, status Status, nextUpdate time.Time) {
+	expires := time.Now().Add(c.ttl())
+	if status != Unknown && nextUpdate.After(time.Now()) {
+		expires = nextUpdate
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[string]cacheEntry)
+	}
+	c.cache[key] = cacheEntry{status: status, expires: expires}
+}
+
+// Check returns the revocation status of cert issued by issuer, using the
+// stapled OCSP response when there is one. The error tells why the status
+// is unknown.
+func (c *Checker) Check(ctx context.Context, cert, issuer *x509.Certificate, staple []byte) (Status, error) {
+	key := cacheKey(cert, issuer)
+	if len(staple) > 0 {
+		if resp, err := ocsp.ParseResponseForCert(staple, cert, issuer); err == nil && resp.Status != ocsp.Unknown {
+			status := ocspStatus(resp)
+			c.store(key, status, resp.NextUpdate)
+			return status, nil
+		}
+	}
+	if status, ok := c.cached(key); ok {
+		return status, nil
+	}
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	status, nextUpdate, err := c.queryOCSP(ctx, cert, issuer)
+	if status == Unknown && !c.DisableCRL && len(cert.CRLDistributionPoints) > 0 {
+		var crlErr error
+		if status, nextUpdate, crlErr = c.queryCRL(ctx, cert, issuer); crlErr != nil {
+			err = errors.Join(err, crlErr)
+		} else {
+			err = nil
+		}
+	}
+	if err == nil && status == Unknown {
+		err = errors.New("revocation: status unknown to the OCSP responders and CRLs")
+	}
+	c.store(key, status, nextUpdate)
+	return status, err
+}
+
+func ocspStatus(resp *ocsp.Response) Status {
+	switch resp.Status {
+	case ocsp.Good:
+		return Good
+	case ocsp.Revoked:
+		return Revoked
+	default:
+		return Unknown
+	}
+}
+
+func (c *Checker) fetch(req *http.Request) ([]byte, error) {
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("revocation: %s returned %s", req.URL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+}
+
+func (c *Checker) queryOCSP(ctx context.Context, cert, issuer *x509.Certificate) (Status, time.Time, error) {
+	if len(cert.OCSPServer) == 0 {
+		return Unknown, time.Time{}, nil
+	}
+	body, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return Unknown, time.Time{}, err
+	}
+	var errs []error
+	for _, server := range cert.OCSPServer {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(body))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/ocsp-request")
+		der, err := c.fetch(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if status := ocspStatus(resp); status != Unknown {
+			return status, resp.NextUpdate, nil
+		}
+	}
+	return Unknown, time.Time{}, errors.Join(errs...)
+}
+
+func (c *Checker) queryCRL(ctx context.Context, cert, issuer *x509.Certificate) (Status, time.Time, error) {
+	var errs []error
+	for _, point := range cert.CRLDistributionPoints {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, point, nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		der, err := c.fetch(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, revoked := range crl.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return Revoked, crl.NextUpdate, nil
+			}
+		}
+		return Good, crl.NextUpdate, nil
+	}
+	return Unknown, time.Time{}, errors.Join(errs...)
+}
+
+// chain returns the leaf and issuer of a connection, from its verified
+// chains when the certificates were verified.
+func chain(cs tls.ConnectionState) (cert, issuer *x509.Certificate) {
+	certs := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		certs = cs.VerifiedChains[0]
+	}
+	if len(certs) < 2 {
+		return nil, nil
+	}
+	return certs[0], certs[1]
+}
+
+// VerifyConnection checks the certificate of an upstream connection, as a
+// tls.Config.VerifyConnection function.
+func (c *Checker) VerifyConnection(cs tls.ConnectionState) error {
+	cert, issuer := chain(cs)
+	if cert == nil {
+		if c.Policy == HardFail {
+			return fmt.Errorf("revocation: no issuer in the chain of %s", cs.ServerName)
+		}
+		return nil
+	}
+	status, err := c.Check(context.Background(), cert, issuer, cs.OCSPResponse)
+	switch {
+	case status == Revoked:
+		return fmt.Errorf("%w: %s, serial %s", ErrRevoked, cs.ServerName, cert.SerialNumber)
+	case status == Unknown && c.Policy == HardFail:
+		return fmt.Errorf("revocation: unknown status of %s: %w", cs.ServerName, err)
+	}
+	return nil
+}
+
+// Install checks the upstream connections of the MITM'd requests of
+// proxy, keeping the VerifyConnection function already in place.
+func (c *Checker) Install(proxy *goproxy.ProxyHttpServer) {
+	config := &tls.Config{}
+	if proxy.Tr.TLSClientConfig != nil {
+		config = proxy.Tr.TLSClientConfig.Clone()
+	}
+	previous := config.VerifyConnection
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if previous != nil {
+			if err := previous(cs); err != nil {
+				return err
+			}
+		}
+		return c.VerifyConnection(cs)
+	}
+	proxy.Tr.TLSClientConfig = config
+}
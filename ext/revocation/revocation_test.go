@@ -0,0 +1,170 @@
+package revocation_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy/ext/revocation"
+	"golang.org/x/crypto/ocsp"
+)
+
+type pki struct {
+	t       *testing.T
+	ca      *x509.Certificate
+	key     crypto.Signer
+	revoked map[int64]bool
+	// ocspUp makes the responder answer, instead of failing.
+	ocspUp  bool
+	queries int32
+	server  *httptest.Server
+}
+
+func newPKI(t *testing.T) *pki {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+	p := &pki{t: t, ca: ca, key: key, revoked: map[int64]bool{}, ocspUp: true}
+	p.server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *pki) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/crl" {
+		list := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+		for serial := range p.revoked {
+			list.RevokedCertificates = append(list.RevokedCertificates, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		der, _ := x509.CreateRevocationList(rand.Reader, list, p.ca, p.key)
+		_, _ = w.Write(der)
+		return
+	}
+	atomic.AddInt32(&p.queries, 1)
+	if !p.ocspUp {
+		http.Error(w, "down", http.StatusInternalServerError)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	req, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _ = w.Write(p.response(req.SerialNumber.Int64()))
+}
+
+func (p *pki) response(serial int64) []byte {
+	template := ocsp.Response{Status: ocsp.Good, SerialNumber: big.NewInt(serial), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+	if p.revoked[serial] {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = time.Now()
+	}
+	der, err := ocsp.CreateResponse(p.ca, p.ca, template, p.key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return der
+}
+
+func (p *pki) leaf(serial int64, withOCSP, withCRL bool) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if withOCSP {
+		template.OCSPServer = []string{p.server.URL + "/ocsp"}
+	}
+	if withCRL {
+		template.CRLDistributionPoints = []string{p.server.URL + "/crl"}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, key.Public(), p.key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestOCSP(t *testing.T) {
+	p := newPKI(t)
+	p.revoked[3] = true
+	c := revocation.New(revocation.HardFail)
+
+	good := p.leaf(2, true, false)
+	if status, err := c.Check(context.Background(), good, p.ca, p.response(2)); status != revocation.Good || err != nil {
+		t.Errorf("Expected the stapled response to be good, got %v: %v", status, err)
+	}
+	if atomic.LoadInt32(&p.queries) != 0 {
+		t.Errorf("Expected the stapled response to be preferred, got %d queries", p.queries)
+	}
+
+	revoked := p.leaf(3, true, false)
+	err := c.VerifyConnection(tls.ConnectionState{ServerName: "example.com", PeerCertificates: []*x509.Certificate{revoked, p.ca}})
+	if !errors.Is(err, revocation.ErrRevoked) {
+		t.Errorf("Expected ErrRevoked, got %v", err)
+	}
+	if status, _ := c.Check(context.Background(), revoked, p.ca, nil); status != revocation.Revoked || atomic.LoadInt32(&p.queries) != 1 {
+		t.Errorf("Expected the result to be cached, got %v after %d queries", status, p.queries)
+	}
+}
+
+func TestCRLFallback(t *testing.T) {
+	p := newPKI(t)
+	p.revoked[3] = true
+	p.ocspUp = false
+	c := revocation.New(revocation.HardFail)
+
+	if status, err := c.Check(context.Background(), p.leaf(3, true, true), p.ca, nil); status != revocation.Revoked || err != nil {
+		t.Errorf("Expected the CRL to revoke the certificate, got %v: %v", status, err)
+	}
+	if status, err := c.Check(context.Background(), p.leaf(2, true, true), p.ca, nil); status != revocation.Good || err != nil {
+		t.Errorf("Expected the CRL to accept the certificate, got %v: %v", status, err)
+	}
+
+	c.DisableCRL = true
+	if status, err := c.Check(context.Background(), p.leaf(4, true, true), p.ca, nil); status != revocation.Unknown || err == nil {
+		t.Errorf("Expected an unknown status, got %v: %v", status, err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p := newPKI(t)
+	cs := tls.ConnectionState{ServerName: "example.com", PeerCertificates: []*x509.Certificate{p.leaf(2, false, false), p.ca}}
+
+	if err := revocation.New(revocation.SoftFail).VerifyConnection(cs); err != nil {
+		t.Errorf("Expected the soft-fail policy to accept an unknown status, got %v", err)
+	}
+	if err := revocation.New(revocation.HardFail).VerifyConnection(cs); err == nil {
+		t.Error("Expected the hard-fail policy to reject an unknown status")
+	}
+}
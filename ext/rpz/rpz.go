@@ -0,0 +1,305 @@
+// Package rpz rewrites the destination hosts before they are dialed, as
+// the DNS response policy zones do, to sinkhole the bad domains to a block
+// server, or to redirect the legacy host names to the new ones:
+//
+//	z := rpz.NewZone()
+//	z.Add(rpz.Rule{Name: "*.malware.example", Action: rpz.Sinkhole, Target: "blockpage.internal:8080"})
+//	z.Add(rpz.Rule{Name: "legacy.example.com", Action: rpz.Rewrite, Target: "app.example.com"})
+//	z.Install(proxy)
+//
+// The rules apply to the HTTP requests, MITM'd or not, and to the CONNECT
+// tunnels, whose hosts are kept for their certificates while their
+// connections are dialed to the rewritten addresses. The zones are loaded
+// from the RPZ zone files with Load.
+package rpz
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Action is the action of a rule.
+type Action int
+
+const (
+	// Rewrite sends the requests to the Target host, as an alias: the HTTP
+	// requests are rewritten to it, Host included, and the tunnels dialed
+	// to it.
+	Rewrite Action = iota
+	// Sinkhole dials the Target address, such as a block server, in place
+	// of the host, the requests keeping their Host.
+	Sinkhole
+	// NXDomain fails the resolution of the host, as NXDOMAIN.
+	NXDomain
+	// Passthru exempts the host from the rules of its parent domains.
+	Passthru
+)
+
+func (a Action) String() string {
+	switch a {
+	case Sinkhole:
+		return "sinkhole"
+	case NXDomain:
+		return "nxdomain"
+	case Passthru:
+		return "passthru"
+	}
+	return "rewrite"
+}
+
+// Rule is a rule of a zone.
+type Rule struct {
+	// Name is the host matched, or *. and its parent domain to match the
+	// subdomains, as in the zones. The exact names win over the wildcards,
+	// and the closest wildcards over the others.
+	Name   string
+	Action Action
+	// Target is the host of Rewrite, or the address of Sinkhole, with the
+	// port of the request unless given.
+	Target string
+}
+
+// Zone is a set of rules.
+type Zone struct {
+	mu        sync.RWMutex
+	exact     map[string]Rule
+	wildcards map[string]Rule
+}
+
+// NewZone returns an empty Zone.
+func NewZone() *Zone {
+	return &Zone{exact: make(map[string]Rule), wildcards: make(map[string]Rule)}
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Add adds r to the zone, replacing the rule of the same name.
+func (z *Zone) Add(r Rule) {
+	r.Name = normalize(r.Name)
+	r.Target = strings.TrimSuffix(r.Target, ".")
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if parent, ok := strings.CutPrefix(r.Name, "*."); ok {
+		z.wildcards[parent] = r
+		return
+	}
+	z.exact[r.Name] = r
+}
+
+// Len returns the number of rules of the zone.
+func (z *Zone) Len() int {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return len(z.exact) + len(z.wildcards)
+}
+
+// Lookup returns the rule of host, if any.
+func (z *Zone) Lookup(host string) (Rule, bool) {
+	host = normalize(host)
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if r, ok := z.exact[host]; ok {
+		return r, true
+	}
+	for {
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return Rule{}, false
+		}
+		host = host[i+1:]
+		if r, ok := z.wildcards[host]; ok {
+			return r, true
+		}
+	}
+}
+
+// Load reads the rules of an RPZ zone file:
+//
+//	$ORIGIN rpz.example.
+//	bad.example.com      CNAME .              ; NXDOMAIN
+//	*.bad.example.com    CNAME *.             ; NODATA, as NXDOMAIN
+//	ok.bad.example.com   CNAME rpz-passthru.
+//	legacy.example.com   CNAME app.example.com.
+//	ads.example.com      A     192.0.2.53     ; sinkhole
+//
+// The owner names are relative to the origin. The rules of the other
+// records, such as SOA and NS, are ignored.
+func (z *Zone) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	origin := ""
+	inParens := false
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		if inParens {
+			inParens = !strings.Contains(line, ")")
+			continue
+		}
+		if strings.Contains(line, "(") && !strings.Contains(line, ")") {
+			inParens = true
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) > 1 {
+				origin = normalize(fields[1])
+			}
+			continue
+		case "$TTL", "$INCLUDE":
+			continue
+		}
+		owner := normalize(fields[0])
+		if owner == "@" {
+			continue
+		}
+		if strings.HasSuffix(fields[0], ".") && origin != "" {
+			owner, _ = strings.CutSuffix(owner, "."+origin)
+		}
+		// The TTL and the class are optional.
+		fields = fields[1:]
+		for len(fields) > 0 && (isTTL(fields[0]) || strings.EqualFold(fields[0], "IN")) {
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("rpz: line %d: expected a type and its data", n)
+		}
+		rule := Rule{Name: owner}
+		switch data := strings.ToLower(fields[1]); strings.ToUpper(fields[0]) {
+		case "CNAME":
+			switch data {
+			case ".", "*.", "rpz-drop.":
+				rule.Action = NXDomain
+			case "rpz-passthru.", "rpz-tcp-only.":
+				rule.Action = Passthru
+			default:
+				rule.Action, rule.Target = Rewrite, data
+			}
+		case "A", "AAAA":
+			ip := net.ParseIP(fields[1])
+			if ip == nil {
+				return fmt.Errorf("rpz: line %d: invalid address %s", n, fields[1])
+			}
+			rule.Action, rule.Target = Sinkhole, ip.String()
+		default:
+			continue
+		}
+		z.Add(rule)
+	}
+	return scanner.Err()
+}
+
+func isTTL(field string) bool {
+	for _, c := range field {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return field != ""
+}
+
+// target returns the address of addr, host:port, rewritten by r.
+func (r Rule) target(addr string) string {
+	if _, _, err := net.SplitHostPort(r.Target); err == nil {
+		return r.Target
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return r.Target
+	}
+	return net.JoinHostPort(strings.Trim(r.Target, "[]"), port)
+}
+
+// Resolve returns addr, host:port, rewritten by the zone, or the
+// *net.DNSError of NXDomain.
+func (z *Zone) Resolve(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	r, ok := z.Lookup(host)
+	if !ok {
+		return addr, nil
+	}
+	switch r.Action {
+	case NXDomain:
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	case Rewrite, Sinkhole:
+		return r.target(addr), nil
+	}
+	return addr, nil
+}
+
+// Dialer returns a dialer of the addresses resolved by the zone, with next,
+// or with the transport of proxy when nil.
+func (z *Zone) Dialer(proxy *goproxy.ProxyHttpServer, next func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addr, err := z.Resolve(addr)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		switch {
+		case next != nil:
+			return next(ctx, network, addr)
+		case proxy != nil && proxy.Tr != nil && proxy.Tr.DialContext != nil:
+			return proxy.Tr.DialContext(ctx, network, addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// Handle implements goproxy.ReqHandler, rewriting the host of req.
+func (z *Zone) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	r, ok := z.Lookup(req.URL.Hostname())
+	if !ok || r.Action == Passthru {
+		return req, nil
+	}
+	ctx.Logf("rpz: %s %s by %s", r.Action, req.URL.Host, r.Name)
+	if r.Action == Rewrite {
+		host := r.Target
+		if req.URL.Port() != "" {
+			host = r.target(req.URL.Host)
+		}
+		req.URL.Host = host
+		req.Host = host
+		return req, nil
+	}
+	ctx.Dialer = z.Dialer(ctx.Proxy, ctx.Dialer)
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, dialing the tunnels to
+// the rewritten addresses. It never decides the fate of the request, so
+// the following CONNECT handlers are still executed.
+func (z *Zone) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	if r, ok := z.Lookup(hostname); ok && r.Action != Passthru {
+		ctx.Logf("rpz: %s the tunnel to %s by %s", r.Action, host, r.Name)
+		ctx.Dialer = z.Dialer(ctx.Proxy, ctx.Dialer)
+	}
+	return nil, host
+}
+
+// Install rewrites the hosts of the requests and the tunnels of proxy.
+func (z *Zone) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(z)
+	proxy.OnRequest().HandleConnect(z)
+}
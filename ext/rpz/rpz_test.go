@@ -0,0 +1,108 @@
+package rpz_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/rpz"
+)
+
+const zone = `$TTL 300
+$ORIGIN rpz.example.
+@ IN SOA localhost. admin.localhost. (
+	1 3600 600 86400 300 )
+@ IN NS localhost.
+
+bad.example.com         CNAME .             ; NXDOMAIN
+*.bad.example.com       CNAME *.
+ok.bad.example.com      CNAME rpz-passthru.
+legacy.example.com. 60 IN CNAME app.example.com.
+ads.example.com.rpz.example. A 192.0.2.53
+v6.example.com          AAAA 2001:db8::1
+`
+
+func TestZone(t *testing.T) {
+	z := rpz.NewZone()
+	if err := z.Load(strings.NewReader(zone)); err != nil {
+		t.Fatal(err)
+	}
+	if z.Len() != 6 {
+		t.Errorf("Expected 6 rules, got %d", z.Len())
+	}
+	for _, c := range []struct{ addr, expected string }{
+		{"example.com:80", "example.com:80"},
+		{"legacy.example.com:443", "app.example.com:443"},
+		{"ADS.example.com:80", "192.0.2.53:80"},
+		{"v6.example.com:443", "[2001:db8::1]:443"},
+		{"ok.bad.example.com:80", "ok.bad.example.com:80"},
+	} {
+		if addr, err := z.Resolve(c.addr); err != nil || addr != c.expected {
+			t.Errorf("Expected %s to resolve to %s, got %s: %v", c.addr, c.expected, addr, err)
+		}
+	}
+	for _, addr := range []string{"bad.example.com:80", "www.bad.example.com:443"} {
+		var dnsErr *net.DNSError
+		if _, err := z.Resolve(addr); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("Expected %s to be NXDOMAIN, got %v", addr, err)
+		}
+	}
+	if err := z.Load(strings.NewReader("bad.example.com A nowhere\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("Expected the invalid address to fail, got %v", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	block := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "blocked "+r.Host)
+	}))
+	defer block.Close()
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tls "+r.Host)
+	}))
+	defer upstream.Close()
+
+	z := rpz.NewZone()
+	z.Add(rpz.Rule{Name: "*.malware.test", Action: rpz.Sinkhole, Target: block.Listener.Addr().String()})
+	z.Add(rpz.Rule{Name: "legacy.test", Action: rpz.Rewrite, Target: block.Listener.Addr().String()})
+	z.Add(rpz.Rule{Name: "gone.test", Action: rpz.NXDomain})
+	z.Add(rpz.Rule{Name: "secure.test", Action: rpz.Sinkhole, Target: upstream.Listener.Addr().String()})
+	proxy := goproxy.NewProxyHttpServer()
+	z.Install(proxy)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	proxyURL, _ := url.Parse(srv.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	get := func(u string) (int, string) {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if _, body := get("http://www.malware.test/x"); body != "blocked www.malware.test" {
+		t.Errorf("Expected the request to be sinkholed with its Host, got %q", body)
+	}
+	if _, body := get("http://legacy.test/"); body != "blocked "+block.Listener.Addr().String() {
+		t.Errorf("Expected the request to be rewritten, got %q", body)
+	}
+	if status, _ := get("http://gone.test/"); status == http.StatusOK {
+		t.Error("Expected the NXDOMAIN host to fail")
+	}
+	if _, body := get("https://secure.test/"); body != "tls secure.test" {
+		t.Errorf("Expected the tunnel to be sinkholed, got %q", body)
+	}
+}
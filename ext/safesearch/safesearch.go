@@ -0,0 +1,201 @@
+// Package safesearch enforces the safe search modes of the search engines,
+// and the restricted mode of YouTube:
+//
+//	e := safesearch.New()
+//	proxy.OnRequest().Do(e)
+//	proxy.OnRequest().HandleConnect(e.ConnectHandler())
+//
+// The queries and cookies are rewritten when the requests can be read, in
+// plain HTTP or MITM'd tunnels. Otherwise the search engines are reached
+// through the addresses enforcing safe search, as the DNS overrides
+// recommended by the search engines would do.
+package safesearch
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// YouTubeMode is the YouTube restricted mode.
+type YouTubeMode int
+
+const (
+	YouTubeOff YouTubeMode = iota
+	YouTubeModerate
+	YouTubeStrict
+)
+
+// Enforcer rewrites the requests to the search engines.
+type Enforcer struct {
+	Google     bool
+	Bing       bool
+	DuckDuckGo bool
+	YouTube    YouTubeMode
+	// Override connects to the safe search addresses of the search engines,
+	// such as forcesafesearch.google.com, instead of their usual addresses.
+	Override bool
+
+	once sync.Once
+	tr   *http.Transport
+}
+
+// New returns an Enforcer of every search engine, with the strict YouTube
+// restricted mode.
+func New() *Enforcer {
+	return &Enforcer{Google: true, Bing: true, DuckDuckGo: true, YouTube: YouTubeStrict, Override: true}
+}
+
+func isGoogle(host string) bool {
+	tld, ok := strings.CutPrefix(strings.TrimPrefix(host, "www."), "google.")
+	if !ok {
+		return false
+	}
+	// The country domains, such as google.fr or google.co.uk.
+	labels := strings.Split(tld, ".")
+	if len(labels) > 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 3 {
+			return false
+		}
+	}
+	return true
+}
+
+var youtubeHosts = map[string]bool{
+	"www.youtube.com":          true,
+	"m.youtube.com":            true,
+	"youtube.com":              true,
+	"youtubei.googleapis.com":  true,
+	"youtube.googleapis.com":   true,
+	"www.youtube-nocookie.com": true,
+}
+
+// SafeHost returns the host enforcing safe search for host, or "" when host
+// isn't a search engine enforced by e.
+func (e *Enforcer) SafeHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case e.YouTube == YouTubeStrict && youtubeHosts[host]:
+		return "restrict.youtube.com"
+	case e.YouTube == YouTubeModerate && youtubeHosts[host]:
+		return "restrictmoderate.youtube.com"
+	case e.Google && isGoogle(host):
+		return "forcesafesearch.google.com"
+	case e.Bing && (host == "www.bing.com" || host == "bing.com"):
+		return "strict.bing.com"
+	case e.DuckDuckGo && (host == "duckduckgo.com" || host == "www.duckduckgo.com"):
+		return "safe.duckduckgo.com"
+	}
+	return ""
+}
+
+// setParam sets a query parameter, keeping the order of the others.
+func setParam(rawQuery, name, value string) string {
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		if k, _, _ := strings.Cut(part, "="); part != "" && k != name {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(append(kept, name+"="+value), "&")
+}
+
+// strictBingCookie rewrites the adult filter of the Bing preferences.
+func strictBingCookie(req *http.Request) {
+	cookies := req.Cookies()
+	found := false
+	for _, c := range cookies {
+		if c.Name == "SRCHHPGUSR" {
+			found = true
+			c.Value = setParam(c.Value, "ADLT", "STRICT")
+		}
+	}
+	if !found {
+		return
+	}
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+}
+
+// Handle implements goproxy.ReqHandler.
+func (e *Enforcer) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	host := strings.ToLower(strings.TrimSuffix(req.URL.Hostname(), "."))
+	search := req.URL.Path == "/search"
+	switch {
+	case youtubeHosts[host]:
+		switch e.YouTube {
+		case YouTubeStrict:
+			req.Header.Set("YouTube-Restrict", "Strict")
+		case YouTubeModerate:
+			req.Header.Set("YouTube-Restrict", "Moderate")
+		}
+	case e.Google && isGoogle(host):
+		if search {
+			req.URL.RawQuery = setParam(req.URL.RawQuery, "safe", "active")
+		}
+	case e.Bing && (host == "bing.com" || strings.HasSuffix(host, ".bing.com")):
+		if search {
+			req.URL.RawQuery = setParam(req.URL.RawQuery, "adlt", "strict")
+		}
+		strictBingCookie(req)
+	case e.DuckDuckGo && (host == "duckduckgo.com" || host == "www.duckduckgo.com"):
+		req.URL.RawQuery = setParam(req.URL.RawQuery, "kp", "1")
+	}
+
+	if e.Override && e.SafeHost(host) != "" {
+		tr := e.transport(ctx.Proxy)
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			return tr.RoundTrip(req)
+		})
+	}
+	return req, nil
+}
+
+// dial wraps a dial function to connect to the safe search addresses.
+func (e *Enforcer) dial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if safe := e.SafeHost(host); safe != "" {
+				addr = net.JoinHostPort(safe, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+func (e *Enforcer) transport(proxy *goproxy.ProxyHttpServer) *http.Transport {
+	e.once.Do(func() {
+		e.tr = proxy.Tr.Clone()
+		e.tr.DialContext = e.dial(proxy.Tr.DialContext)
+	})
+	return e.tr
+}
+
+// ConnectHandler returns an HttpsHandler connecting the tunnels of the
+// search engines to their safe search addresses. It never decides the fate
+// of the request, so the following CONNECT handlers are still executed.
+func (e *Enforcer) ConnectHandler() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if e.Override {
+			dial := ctx.Dialer
+			if dial == nil && ctx.Proxy.Tr != nil {
+				dial = ctx.Proxy.Tr.DialContext
+			}
+			ctx.Dialer = e.dial(dial)
+		}
+		return nil, host
+	})
+}
@@ -0,0 +1,77 @@
+package safesearch_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/safesearch"
+)
+
+func TestRewrite(t *testing.T) {
+	e := safesearch.New()
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+
+	for url, expected := range map[string]string{
+		"http://www.google.com/search?q=cats&safe=off": "q=cats&safe=active",
+		"http://www.google.co.uk/search?q=cats":        "q=cats&safe=active",
+		"http://www.bing.com/search?q=cats&adlt=off":   "q=cats&adlt=strict",
+		"http://duckduckgo.com/?q=cats":                "q=cats&kp=1",
+		"http://www.google.com/maps?q=paris":           "q=paris",
+		"http://google.com.example.net/search?q=cats":  "q=cats",
+	} {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req, _ = e.Handle(req, ctx)
+		if req.URL.RawQuery != expected {
+			t.Errorf("Expected %s to be rewritten to %q, got %q", url, expected, req.URL.RawQuery)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.bing.com/", nil)
+	req.Header.Set("Cookie", "SRCHHPGUSR=CW=1200&ADLT=OFF; other=1")
+	req, _ = e.Handle(req, ctx)
+	if c, _ := req.Cookie("SRCHHPGUSR"); c == nil || c.Value != "CW=1200&ADLT=STRICT" {
+		t.Errorf("Expected the Bing adult filter to be strict, got %v", c)
+	}
+	if c, _ := req.Cookie("other"); c == nil {
+		t.Error("Expected the other cookies to be kept")
+	}
+
+	e.YouTube = safesearch.YouTubeModerate
+	req = httptest.NewRequest(http.MethodGet, "http://www.youtube.com/watch?v=1", nil)
+	req, _ = e.Handle(req, ctx)
+	if h := req.Header.Get("YouTube-Restrict"); h != "Moderate" {
+		t.Errorf("Expected the YouTube restricted header, got %q", h)
+	}
+}
+
+func TestConnectOverride(t *testing.T) {
+	e := safesearch.New()
+	errDialed := errors.New("dialed")
+	var dialed []string
+	ctx := &goproxy.ProxyCtx{
+		Proxy: goproxy.NewProxyHttpServer(),
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return nil, errDialed
+		},
+	}
+	if action, _ := e.ConnectHandler().HandleConnect("www.google.de:443", ctx); action != nil {
+		t.Error("Expected the CONNECT handler not to decide the action")
+	}
+	for _, addr := range []string{"www.google.de:443", "www.youtube.com:443", "www.bing.com:443", "example.com:443"} {
+		if _, err := ctx.Dialer(context.Background(), "tcp", addr); err != errDialed {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"forcesafesearch.google.com:443", "restrict.youtube.com:443", "strict.bing.com:443", "example.com:443"}
+	for i := range expected {
+		if dialed[i] != expected[i] {
+			t.Errorf("Expected %s to be dialed, got %s", expected[i], dialed[i])
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package sampling decides which requests run the expensive observability
+// features, such as the body capture or the HAR export:
+//
+//	d := sampling.New(sampling.Any(
+//		sampling.TraceFlags(),
+//		sampling.All(sampling.Probability(0.01), sampling.PerHost(1, 5)),
+//	))
+//	proxy.OnRequest(d.Sampled()).DoFunc(logger.OnRequest)
+//	proxy.OnResponse(d.Sampled()).DoFunc(logger.OnResponse)
+//
+// The decision is taken once per request, so the request and response
+// handlers of a sampled request all run.
+package sampling
+
+import (
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Sampler decides whether a request is sampled.
+type Sampler interface {
+	Sample(req *http.Request, ctx *goproxy.ProxyCtx) bool
+}
+
+// SamplerFunc is a function Sampler.
+type SamplerFunc func(req *http.Request, ctx *goproxy.ProxyCtx) bool
+
+func (f SamplerFunc) Sample(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	return f(req, ctx)
+}
+
+// traceID returns the W3C or B3 trace identifier of req.
+func traceID(req *http.Request) string {
+	if parts := strings.Split(req.Header.Get("Traceparent"), "-"); len(parts) == 4 {
+		return parts[1]
+	}
+	return req.Header.Get("X-B3-Traceid")
+}
+
+// Probability samples a fraction p of the requests. The decision is derived
+// from the trace identifier of the request, when it has one, so that every
+// proxy sampling with the same probability takes the same decision for a
+// trace.
+func Probability(p float64) Sampler {
+	return SamplerFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		h := fnv.New64a()
+		if id := traceID(req); id != "" {
+			_, _ = h.Write([]byte(id))
+		} else {
+			_, _ = h.Write([]byte(strconv.FormatInt(ctx.Session, 10)))
+		}
+		return float64(h.Sum64()>>11)/(1<<53) < p
+	})
+}
+
+// TraceFlags samples the requests whose trace is sampled by the client, as
+// told by the W3C traceparent flags or by the B3 headers.
+func TraceFlags() Sampler {
+	return SamplerFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		if parts := strings.Split(req.Header.Get("Traceparent"), "-"); len(parts) == 4 {
+			flags, err := strconv.ParseUint(parts[3], 16, 8)
+			return err == nil && flags&1 == 1
+		}
+		if req.Header.Get("X-B3-Flags") == "1" {
+			return true
+		}
+		return req.Header.Get("X-B3-Sampled") == "1"
+	})
+}
+
+// PerHost samples up to perSecond requests per second to every host, with
+// bursts of burst requests.
+func PerHost(perSecond float64, burst int) Sampler {
+	type bucket struct {
+		tokens float64
+		last   time.Time
+	}
+	var mu sync.Mutex
+	buckets := make(map[string]*bucket)
+	return SamplerFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		host := req.URL.Hostname()
+		if host == "" {
+			host, _, _ = net.SplitHostPort(req.Host)
+		}
+		now := time.Now()
+		mu.Lock()
+		defer mu.Unlock()
+		b, ok := buckets[host]
+		if !ok {
+			b = &bucket{tokens: float64(burst), last: now}
+			buckets[host] = b
+		}
+		b.tokens += now.Sub(b.last).Seconds() * perSecond
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.last = now
+		if b.tokens < 1 {
+			return false
+		}
+		b.tokens--
+		return true
+	})
+}
+
+// Any samples the requests sampled by any of samplers. The samplers are
+// tried in order, until one samples the request.
+func Any(samplers ...Sampler) Sampler {
+	return SamplerFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		for _, s := range samplers {
+			if s.Sample(req, ctx) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// All samples the requests sampled by all of samplers. The samplers are
+// tried in order, until one doesn't sample the request, so rate limiting
+// samplers should come last.
+func All(samplers ...Sampler) Sampler {
+	return SamplerFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		for _, s := range samplers {
+			if !s.Sample(req, ctx) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// decisionTTL is how long the decisions are remembered.
+const decisionTTL = 10 * time.Minute
+
+type decision struct {
+	sampled bool
+	time    time.Time
+}
+
+// Decider remembers the decisions of a Sampler for the requests.
+type Decider struct {
+	Sampler Sampler
+
+	mu        sync.Mutex
+	decisions map[int64]decision
+	swept     time.Time
+}
+
+// New returns a Decider of s.
+func New(s Sampler) *Decider {
+	return &Decider{Sampler: s, decisions: make(map[int64]decision)}
+}
+
+// IsSampled returns whether the request of ctx is sampled, deciding it on
+// the first call.
+func (d *Decider) IsSampled(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	now := time.Now()
+	d.mu.Lock()
+	if dec, ok := d.decisions[ctx.Session]; ok {
+		d.mu.Unlock()
+		return dec.sampled
+	}
+	d.mu.Unlock()
+
+	sampled := req != nil && d.Sampler.Sample(req, ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.decisions == nil {
+		d.decisions = make(map[int64]decision)
+	}
+	if dec, ok := d.decisions[ctx.Session]; ok {
+		return dec.sampled
+	}
+	d.decisions[ctx.Session] = decision{sampled: sampled, time: now}
+	if now.Sub(d.swept) > decisionTTL {
+		d.swept = now
+		for session, dec := range d.decisions {
+			if now.Sub(dec.time) > decisionTTL {
+				delete(d.decisions, session)
+			}
+		}
+	}
+	return sampled
+}
+
+// Sampled returns a condition matching the sampled requests, and their
+// responses.
+func (d *Decider) Sampled() goproxy.ReqConditionFunc {
+	return d.IsSampled
+}
+
+// NotSampled returns a condition matching the other requests.
+func (d *Decider) NotSampled() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return !d.IsSampled(req, ctx)
+	}
+}
@@ -0,0 +1,86 @@
+package sampling_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/sampling"
+)
+
+func request(session int64, url string) (*http.Request, *goproxy.ProxyCtx) {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	return req, &goproxy.ProxyCtx{Req: req, Session: session}
+}
+
+func TestProbability(t *testing.T) {
+	s := sampling.Probability(0.25)
+	sampled := 0
+	for i := int64(0); i < 10000; i++ {
+		if s.Sample(request(i, "http://example.com/")) {
+			sampled++
+		}
+	}
+	if sampled < 2300 || sampled > 2700 {
+		t.Errorf("Expected about 2500 sampled requests, got %d", sampled)
+	}
+
+	// The decision only depends on the trace.
+	for i := 0; i < 20; i++ {
+		traceparent := fmt.Sprintf("00-%032x-00f067aa0ba902b7-00", i)
+		req, ctx := request(1, "http://example.com/")
+		req.Header.Set("Traceparent", traceparent)
+		other, otherCtx := request(2, "http://other.example.com/")
+		other.Header.Set("Traceparent", traceparent)
+		if s.Sample(req, ctx) != s.Sample(other, otherCtx) {
+			t.Errorf("Expected the requests of trace %d to share the decision", i)
+		}
+	}
+}
+
+func TestTraceFlags(t *testing.T) {
+	s := sampling.TraceFlags()
+	for _, tt := range []struct {
+		header, value string
+		sampled       bool
+	}{
+		{"Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+		{"X-B3-Sampled", "1", true},
+		{"X-B3-Sampled", "0", false},
+		{"X-Other", "1", false},
+	} {
+		req, ctx := request(1, "http://example.com/")
+		req.Header.Set(tt.header, tt.value)
+		if s.Sample(req, ctx) != tt.sampled {
+			t.Errorf("Expected %s: %s to be sampled: %v", tt.header, tt.value, tt.sampled)
+		}
+	}
+}
+
+func TestPerHostAndDecider(t *testing.T) {
+	d := sampling.New(sampling.PerHost(0.001, 2))
+	cond := d.Sampled()
+	sampled := map[string]int{}
+	session := int64(0)
+	for i := 0; i < 10; i++ {
+		for _, host := range []string{"a.example.com", "b.example.com"} {
+			session++
+			req, ctx := request(session, "http://"+host+"/")
+			if cond.HandleReq(req, ctx) {
+				sampled[host]++
+				// The response of a sampled request is sampled too.
+				if !cond.HandleResp(&http.Response{}, ctx) {
+					t.Error("Expected the decision to be remembered")
+				}
+			} else if cond.HandleResp(&http.Response{}, ctx) {
+				t.Error("Expected the decision to be remembered")
+			}
+		}
+	}
+	if sampled["a.example.com"] != 2 || sampled["b.example.com"] != 2 {
+		t.Errorf("Expected 2 sampled requests per host, got %v", sampled)
+	}
+}
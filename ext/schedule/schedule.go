@@ -0,0 +1,299 @@
+// Package schedule provides time-based conditions, such as
+//
+//	hours := schedule.MustWeekly(loc, "Mon-Fri 09:00-17:30")
+//	proxy.OnRequest(schedule.During(hours), goproxy.DstHostIs("www.facebook.com")).
+//		DoFunc(block)
+package schedule
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Schedule tells whether a point in time is within the schedule.
+type Schedule interface {
+	Active(t time.Time) bool
+}
+
+// Now is the clock of the conditions, replaced by the tests, for example
+// by the Now of a goproxy.FakeClock.
+var Now = goproxy.SystemClock.Now
+
+// During returns a condition matching while s is active.
+func During(s Schedule) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return s.Active(Now())
+	}
+}
+
+// Outside returns a condition matching while s isn't active.
+func Outside(s Schedule) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return !s.Active(Now())
+	}
+}
+
+// Window is a daily time range, on some days of the week. End may be before
+// Start for ranges spanning midnight, which then end on the next day.
+type Window struct {
+	Days  [7]bool
+	Start time.Duration
+	End   time.Duration
+}
+
+// Weekly is a set of weekly windows, in a time zone.
+type Weekly struct {
+	Windows  []Window
+	Location *time.Location
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := dayNames[from]
+		if !ok {
+			return days, fmt.Errorf("schedule: unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = dayNames[to]; !ok {
+				return days, fmt.Errorf("schedule: unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, err := strconv.Atoi(h)
+	if !ok || err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("schedule: invalid time %q", s)
+	}
+	minutes, err := strconv.Atoi(m)
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("schedule: invalid time %q", s)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// ParseWindow parses a window such as "Mon-Fri 09:00-17:30", "Sat,Sun
+// 00:00-24:00" or "Mon-Thu 22:00-06:00". The days are optional.
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		w.Days = [7]bool{true, true, true, true, true, true, true}
+	case 2:
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return w, err
+		}
+		w.Days = days
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("schedule: invalid window %q", s)
+	}
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("schedule: invalid window %q", s)
+	}
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// NewWeekly parses the windows of a Weekly schedule. A nil loc is the local
+// time zone.
+func NewWeekly(loc *time.Location, windows ...string) (*Weekly, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	s := &Weekly{Location: loc}
+	for _, spec := range windows {
+		w, err := ParseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.Windows = append(s.Windows, w)
+	}
+	return s, nil
+}
+
+// MustWeekly is like NewWeekly but panics if a window can't be parsed.
+func MustWeekly(loc *time.Location, windows ...string) *Weekly {
+	s, err := NewWeekly(loc, windows...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func (s *Weekly) Active(t time.Time) bool {
+	if s.Location != nil {
+		t = t.In(s.Location)
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	yesterday := (t.Weekday() + 6) % 7
+	for _, w := range s.Windows {
+		if w.Start <= w.End {
+			if w.Days[t.Weekday()] && offset >= w.Start && offset < w.End {
+				return true
+			}
+			continue
+		}
+		// Spanning midnight: the evening of a listed day, or the morning
+		// after it.
+		if (w.Days[t.Weekday()] && offset >= w.Start) || (w.Days[yesterday] && offset < w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cron is a schedule active during the minutes matching a cron expression
+// of five fields: minute, hour, day of month, month and day of week. For
+// instance "* 9-17 * * 1-5" is active from 9:00 to 17:59 on weekdays.
+//
+// As in cron, when both the day of month and the day of week are
+// restricted, a day matching either is active.
+type Cron struct {
+	minute, hour, dom, month, dow field
+	// eitherDay is set when both day fields are restricted.
+	eitherDay bool
+	Location  *time.Location
+}
+
+// field is the set of values matched by a cron field.
+type field uint64
+
+func parseField(s string, min, max int) (field, error) {
+	var f field
+	for _, part := range strings.Split(s, ",") {
+		expr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("schedule: invalid step %q", part)
+			}
+		}
+		lo, hi := min, max
+		if expr != "*" {
+			from, to, isRange := strings.Cut(expr, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("schedule: invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("schedule: invalid value %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("schedule: value out of range %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << uint(v)
+		}
+	}
+	return f, nil
+}
+
+func (f field) has(v int) bool {
+	return f&(1<<uint(v)) != 0
+}
+
+// ParseCron parses a cron expression. A nil loc is the local time zone.
+func ParseCron(expr string, loc *time.Location) (*Cron, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule: expected 5 fields in %q", expr)
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	c := &Cron{Location: loc}
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if c.dow.has(7) {
+		// Both 0 and 7 are Sunday.
+		c.dow |= 1
+	}
+	c.eitherDay = fields[2] != "*" && fields[4] != "*"
+	return c, nil
+}
+
+// MustCron is like ParseCron but panics if the expression can't be parsed.
+func MustCron(expr string, loc *time.Location) *Cron {
+	c, err := ParseCron(expr, loc)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c *Cron) Active(t time.Time) bool {
+	if c.Location != nil {
+		t = t.In(c.Location)
+	}
+	day := c.dom.has(t.Day()) && c.dow.has(int(t.Weekday()))
+	if c.eitherDay {
+		day = c.dom.has(t.Day()) || c.dow.has(int(t.Weekday()))
+	}
+	return day && c.minute.has(t.Minute()) && c.hour.has(t.Hour()) && c.month.has(int(t.Month()))
+}
+
+// Any is active when any of its schedules is.
+type Any []Schedule
+
+func (a Any) Active(t time.Time) bool {
+	for _, s := range a {
+		if s.Active(t) {
+			return true
+		}
+	}
+	return false
+}
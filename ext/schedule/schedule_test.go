@@ -0,0 +1,79 @@
+package schedule_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/schedule"
+)
+
+// 2024-01-01 is a Monday.
+func at(day int, hour, minute int) time.Time {
+	return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestWeekly(t *testing.T) {
+	s := schedule.MustWeekly(time.UTC, "Mon-Fri 09:00-17:30", "Fri 22:00-02:00")
+	for _, tc := range []struct {
+		t      time.Time
+		active bool
+	}{
+		{at(1, 9, 0), true},
+		{at(1, 8, 59), false},
+		{at(1, 17, 30), false},
+		{at(6, 12, 0), false}, // Saturday
+		{at(5, 23, 0), true},  // Friday night
+		{at(6, 1, 0), true},   // Saturday morning, after Friday
+		{at(2, 1, 0), false},  // Tuesday morning, after Monday
+	} {
+		if s.Active(tc.t) != tc.active {
+			t.Errorf("Active(%v) != %v", tc.t, tc.active)
+		}
+	}
+
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip(err)
+	}
+	s = schedule.MustWeekly(paris, "09:00-10:00")
+	if !s.Active(at(1, 8, 30)) {
+		t.Error("Expected the time zone of the schedule to be used")
+	}
+
+	if _, err := schedule.NewWeekly(nil, "Funday 09:00-10:00"); err == nil {
+		t.Error("Expected invalid day to be rejected")
+	}
+}
+
+func TestCron(t *testing.T) {
+	c := schedule.MustCron("*/15 9-17 * * 1-5", time.UTC)
+	if !c.Active(at(1, 9, 30)) || c.Active(at(1, 9, 31)) || c.Active(at(7, 9, 30)) {
+		t.Error("Unexpected cron match")
+	}
+	// Either the 1st of the month or a Sunday.
+	c = schedule.MustCron("* * 1 * 0", time.UTC)
+	if !c.Active(at(1, 0, 0)) || !c.Active(at(7, 0, 0)) || c.Active(at(2, 0, 0)) {
+		t.Error("Expected the day fields to be ORed")
+	}
+	if _, err := schedule.ParseCron("61 * * * *", nil); err == nil {
+		t.Error("Expected out of range minute to be rejected")
+	}
+}
+
+func TestConditions(t *testing.T) {
+	defer func(now func() time.Time) { schedule.Now = now }(schedule.Now)
+	schedule.Now = func() time.Time { return at(1, 10, 0) }
+
+	hours := schedule.MustWeekly(time.UTC, "Mon-Fri 09:00-17:00")
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ctx := &goproxy.ProxyCtx{Req: req}
+	if !schedule.During(hours).HandleReq(req, ctx) || schedule.Outside(hours).HandleReq(req, ctx) {
+		t.Error("Expected business hours")
+	}
+	if schedule.During(schedule.Any{}).HandleReq(req, ctx) {
+		t.Error("Expected empty schedule to never be active")
+	}
+}
@@ -0,0 +1,170 @@
+// Package secheaders injects the security headers in the responses, to
+// harden the legacy applications behind the proxy, per rule:
+//
+//	proxy.OnResponse(goproxy.ReqHostIs("legacy.example.com")).Do(&secheaders.Headers{
+//		CSP:            "default-src 'self'; frame-ancestors 'none'",
+//		FrameOptions:   "DENY",
+//		HSTS:           "max-age=31536000",
+//		ReferrerPolicy: "strict-origin-when-cross-origin",
+//		NoSniff:        true,
+//		Remove:         []string{"Server", "X-Powered-By"},
+//	})
+//
+// The headers already sent by the applications are kept, unless Override
+// is set. The Content-Security-Policy is merged instead, directive by
+// directive: the directives missing from the policy of the application are
+// added, and the sources of those it has are added to theirs.
+package secheaders
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Headers are the security headers of the responses.
+type Headers struct {
+	// CSP is the Content-Security-Policy merged into that of the
+	// responses.
+	CSP string
+	// CSPReportOnly sets CSP in Content-Security-Policy-Report-Only, to
+	// test it before enforcing it.
+	CSPReportOnly bool
+	// FrameOptions is the X-Frame-Options, DENY or SAMEORIGIN.
+	FrameOptions string
+	// HSTS is the Strict-Transport-Security of the HTTPS responses, such
+	// as "max-age=31536000; includeSubDomains".
+	HSTS string
+	// ReferrerPolicy is the Referrer-Policy.
+	ReferrerPolicy string
+	// NoSniff sets X-Content-Type-Options to nosniff.
+	NoSniff bool
+	// Override replaces the headers of the responses, and the directives
+	// of their CSP, instead of keeping them.
+	Override bool
+	// Remove lists the headers removed from the responses, such as those
+	// revealing the software of the applications.
+	Remove []string
+}
+
+func (h *Headers) set(header http.Header, name, value string) {
+	if value != "" && (h.Override || header.Get(name) == "") {
+		header.Set(name, value)
+	}
+}
+
+// Handle implements goproxy.RespHandler.
+func (h *Headers) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	for _, name := range h.Remove {
+		resp.Header.Del(name)
+	}
+	if h.CSP != "" {
+		name := "Content-Security-Policy"
+		if h.CSPReportOnly {
+			name = "Content-Security-Policy-Report-Only"
+		}
+		values := resp.Header.Values(name)
+		if len(values) == 0 {
+			resp.Header.Set(name, h.CSP)
+		} else {
+			// The other policies of the response are enforced as well.
+			values[0] = MergeCSP(values[0], h.CSP, h.Override)
+		}
+	}
+	h.set(resp.Header, "X-Frame-Options", h.FrameOptions)
+	h.set(resp.Header, "Referrer-Policy", h.ReferrerPolicy)
+	if h.NoSniff {
+		h.set(resp.Header, "X-Content-Type-Options", "nosniff")
+	}
+	// The browsers ignore it over HTTP.
+	if ctx.Req != nil && ctx.Req.URL.Scheme == "https" {
+		h.set(resp.Header, "Strict-Transport-Security", h.HSTS)
+	}
+	return resp
+}
+
+// directive is a directive of a CSP.
+type directive struct {
+	name    string
+	sources []string
+}
+
+// parseCSP returns the directives of policy, by name, in their order. The
+// directive names are lowercased, and those repeated are ignored, as by
+// the browsers.
+func parseCSP(policy string) []directive {
+	var directives []directive
+	seen := make(map[string]bool)
+	for _, d := range strings.Split(policy, ";") {
+		fields := strings.Fields(d)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		directives = append(directives, directive{name: name, sources: fields[1:]})
+	}
+	return directives
+}
+
+func formatCSP(directives []directive) string {
+	parts := make([]string, len(directives))
+	for i, d := range directives {
+		parts[i] = strings.Join(append([]string{d.name}, d.sources...), " ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// union returns the sources of a and b, without 'none' when there are
+// others, since it is then ignored.
+func union(a, b []string) []string {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, s := range append(append([]string(nil), a...), b...) {
+		key := strings.ToLower(s)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		sources = append(sources, s)
+	}
+	if len(sources) > 1 {
+		for i, s := range sources {
+			if strings.EqualFold(s, "'none'") {
+				sources = append(sources[:i], sources[i+1:]...)
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// MergeCSP merges the directives of the policy added into policy: those
+// missing are added, and the sources of those it has are added to its
+// sources, or replace them with override.
+func MergeCSP(policy, added string, override bool) string {
+	directives := parseCSP(policy)
+	index := make(map[string]int, len(directives))
+	for i, d := range directives {
+		index[d.name] = i
+	}
+	for _, d := range parseCSP(added) {
+		i, ok := index[d.name]
+		switch {
+		case !ok:
+			directives = append(directives, d)
+		case override:
+			directives[i].sources = d.sources
+		default:
+			directives[i].sources = union(directives[i].sources, d.sources)
+		}
+	}
+	return formatCSP(directives)
+}
@@ -0,0 +1,70 @@
+package secheaders_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/secheaders"
+)
+
+func TestMergeCSP(t *testing.T) {
+	for _, c := range []struct {
+		policy, added string
+		override      bool
+		expected      string
+	}{
+		{"", "default-src 'self'", false, "default-src 'self'"},
+		{"script-src 'self'", "default-src 'none'; script-src cdn.example.com", false, "script-src 'self' cdn.example.com; default-src 'none'"},
+		{"script-src 'self'", "script-src cdn.example.com", true, "script-src cdn.example.com"},
+		{"img-src 'none'", "img-src 'self'", false, "img-src 'self'"},
+		{"Frame-Ancestors 'self'; frame-ancestors *", "frame-ancestors 'SELF' ; upgrade-insecure-requests", false, "frame-ancestors 'self'; upgrade-insecure-requests"},
+	} {
+		if got := secheaders.MergeCSP(c.policy, c.added, c.override); got != c.expected {
+			t.Errorf("Expected %q merged with %q to be %q, got %q", c.policy, c.added, c.expected, got)
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	h := &secheaders.Headers{
+		CSP:            "frame-ancestors 'none'",
+		FrameOptions:   "DENY",
+		HSTS:           "max-age=600",
+		ReferrerPolicy: "no-referrer",
+		NoSniff:        true,
+		Remove:         []string{"Server"},
+	}
+	handle := func(url string, header http.Header) http.Header {
+		ctx := &goproxy.ProxyCtx{Req: httptest.NewRequest(http.MethodGet, url, nil)}
+		resp := &http.Response{StatusCode: http.StatusOK, Header: header}
+		return h.Handle(resp, ctx).Header
+	}
+
+	header := handle("http://legacy.example.com/", http.Header{
+		"Server":                  {"Apache/1.3"},
+		"X-Frame-Options":         {"SAMEORIGIN"},
+		"Content-Security-Policy": {"default-src 'self'", "script-src 'self'"},
+	})
+	for name, expected := range map[string]string{
+		"Server":                    "",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "no-referrer",
+		"X-Content-Type-Options":    "nosniff",
+		"Strict-Transport-Security": "",
+	} {
+		if got := header.Get(name); got != expected {
+			t.Errorf("Expected %s to be %q, got %q", name, expected, got)
+		}
+	}
+	if csp := header.Values("Content-Security-Policy"); len(csp) != 2 || csp[0] != "default-src 'self'; frame-ancestors 'none'" || csp[1] != "script-src 'self'" {
+		t.Errorf("Expected the CSP to be merged into the first policy, got %q", csp)
+	}
+
+	h.Override = true
+	header = handle("https://legacy.example.com/", http.Header{"X-Frame-Options": {"SAMEORIGIN"}})
+	if header.Get("X-Frame-Options") != "DENY" || header.Get("Strict-Transport-Security") != "max-age=600" {
+		t.Errorf("Expected the headers to be overridden, got %v", header)
+	}
+}
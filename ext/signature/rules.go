@@ -0,0 +1,639 @@
+package signature
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Rules are signatures written in a subset of the YARA language, scanned
+// in pure Go:
+//
+//	rule EICAR : malware {
+//		meta:
+//			action = "block"
+//		strings:
+//			$text = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE" nocase
+//			$header = { 58 35 4F ?? 50 }
+//			$regex = /X5O!P%@AP\[4\\PZX54\(P\^\)7CC\)7\}/
+//		condition:
+//			$text or ($header and $regex)
+//	}
+//
+// The text strings take the nocase and wide modifiers, the hex strings the
+// ?? and nibble wildcards, without jumps nor alternatives, and the regular
+// expressions the i and s flags, in the syntax of the regexp package. The
+// conditions combine the strings with and, or, not and parentheses, and
+// the sets with "any of them", "all of them", "2 of ($a, $b, $c)" and the
+// $prefix* wildcards.
+type Rules struct {
+	rules []*rule
+}
+
+type rule struct {
+	name      string
+	tags      []string
+	meta      map[string]string
+	strings   []*pattern
+	condition node
+}
+
+// pattern is a string of a rule.
+type pattern struct {
+	id string
+	// text, lowered when nocase, or bytes and their masks of a hex string.
+	text   []byte
+	nocase bool
+	mask   []byte
+	re     *regexp.Regexp
+}
+
+func (p *pattern) match(data, lower []byte) bool {
+	switch {
+	case p.re != nil:
+		return p.re.Match(data)
+	case p.mask != nil:
+		return matchHex(data, p.text, p.mask)
+	case p.nocase:
+		return bytes.Contains(lower, p.text)
+	}
+	return bytes.Contains(data, p.text)
+}
+
+// matchHex returns whether data contains the bytes of text, but for the
+// bits not in mask.
+func matchHex(data, text, mask []byte) bool {
+	for i := 0; i+len(text) <= len(data); i++ {
+		j := 0
+		for ; j < len(text); j++ {
+			if data[i+j]&mask[j] != text[j] {
+				break
+			}
+		}
+		if j == len(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// node is a node of a condition, evaluated with the matches of the
+// strings.
+type node interface {
+	eval(matched map[string]bool) bool
+}
+
+type stringNode string
+
+func (n stringNode) eval(matched map[string]bool) bool { return matched[string(n)] }
+
+type notNode struct{ n node }
+
+func (n notNode) eval(matched map[string]bool) bool { return !n.n.eval(matched) }
+
+type andNode struct{ l, r node }
+
+func (n andNode) eval(matched map[string]bool) bool { return n.l.eval(matched) && n.r.eval(matched) }
+
+type orNode struct{ l, r node }
+
+func (n orNode) eval(matched map[string]bool) bool { return n.l.eval(matched) || n.r.eval(matched) }
+
+type boolNode bool
+
+func (n boolNode) eval(map[string]bool) bool { return bool(n) }
+
+// ofNode is "n of (set)", n being -1 for all.
+type ofNode struct {
+	n   int
+	ids []string
+}
+
+func (n ofNode) eval(matched map[string]bool) bool {
+	count := 0
+	for _, id := range n.ids {
+		if matched[id] {
+			count++
+		}
+	}
+	if n.n < 0 {
+		return count == len(n.ids)
+	}
+	return count >= n.n
+}
+
+// Compile compiles the rules of src.
+func Compile(src string) (*Rules, error) {
+	p := &parser{tokens: tokenize(src)}
+	rules := &Rules{}
+	names := make(map[string]bool)
+	for !p.done() {
+		r, err := p.rule()
+		if err != nil {
+			return nil, err
+		}
+		if names[r.name] {
+			return nil, fmt.Errorf("signature: duplicate rule %s", r.name)
+		}
+		names[r.name] = true
+		rules.rules = append(rules.rules, r)
+	}
+	return rules, nil
+}
+
+// Len returns the number of rules.
+func (rules *Rules) Len() int {
+	return len(rules.rules)
+}
+
+// Scan implements Scanner.
+func (rules *Rules) Scan(data []byte) ([]Match, error) {
+	var lower []byte
+	var matches []Match
+	for _, r := range rules.rules {
+		matched := make(map[string]bool, len(r.strings))
+		for _, s := range r.strings {
+			if s.nocase && lower == nil {
+				lower = bytes.ToLower(data)
+			}
+			matched[s.id] = s.match(data, lower)
+		}
+		if r.condition.eval(matched) {
+			matches = append(matches, Match{Rule: r.name, Tags: r.tags, Meta: r.meta, Action: ParseAction(r.meta["action"])})
+		}
+	}
+	return matches, nil
+}
+
+type token struct {
+	kind  byte // 'i'dentifier, '$'string id, '"'text, '{'hex, '/'regexp, 'n'umber, or the punctuation
+	value string
+	line  int
+}
+
+// tokenize splits src into tokens, the strings, hex strings and regular
+// expressions being single tokens.
+func tokenize(src string) []token {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				end = len(src) - i - 4
+			}
+			line += strings.Count(src[i:i+end+4], "\n")
+			i += end + 4
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j > len(src) {
+				j = len(src)
+			}
+			tokens = append(tokens, token{'"', src[i:min(j+1, len(src))], line})
+			i = j + 1
+		case c == '/':
+			j := i + 1
+			for j < len(src) && src[j] != '/' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			k := j + 1
+			for k < len(src) && (src[k] == 'i' || src[k] == 's') {
+				k++
+			}
+			k = min(k, len(src))
+			tokens = append(tokens, token{'/', src[i:k], line})
+			i = k
+		case c == '{' && isHexString(src[i+1:]):
+			j := strings.IndexByte(src[i:], '}')
+			tokens = append(tokens, token{'{', src[i+1 : i+j], line})
+			i += j + 1
+		case c == '$' || c == '_' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '*' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			kind := byte('i')
+			switch {
+			case c == '$':
+				kind = '$'
+			case unicode.IsDigit(rune(c)):
+				kind = 'n'
+			}
+			tokens = append(tokens, token{kind, src[i:j], line})
+			i = j
+		default:
+			tokens = append(tokens, token{c, string(c), line})
+			i++
+		}
+	}
+	return tokens
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// isHexString returns whether s, following a {, is a hex string rather than
+// the body of a rule.
+func isHexString(s string) bool {
+	end := strings.IndexByte(s, '}')
+	if end < 0 {
+		return false
+	}
+	body := strings.TrimSpace(s[:end])
+	if body == "" {
+		return false
+	}
+	for _, c := range body {
+		if !unicode.IsSpace(c) && c != '?' && !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	if !p.done() {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	line := 0
+	if !p.done() {
+		line = p.peek().line
+	} else if len(p.tokens) > 0 {
+		line = p.tokens[len(p.tokens)-1].line
+	}
+	return fmt.Errorf("signature: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) expect(kind byte, value string) error {
+	t := p.next()
+	if t.kind != kind || (value != "" && t.value != value) {
+		if value == "" {
+			value = string(kind)
+		}
+		p.pos--
+		return p.errorf("expected %s, got %q", value, t.value)
+	}
+	return nil
+}
+
+func (p *parser) rule() (*rule, error) {
+	for p.peek().kind == 'i' && (p.peek().value == "private" || p.peek().value == "global") {
+		p.next()
+	}
+	if err := p.expect('i', "rule"); err != nil {
+		return nil, err
+	}
+	name := p.next()
+	if name.kind != 'i' {
+		p.pos--
+		return nil, p.errorf("expected the name of the rule")
+	}
+	r := &rule{name: name.value, meta: map[string]string{}, condition: boolNode(false)}
+	if p.peek().kind == ':' {
+		p.next()
+		for p.peek().kind == 'i' {
+			r.tags = append(r.tags, p.next().value)
+		}
+	}
+	if err := p.expect('{', "{"); err != nil {
+		return nil, err
+	}
+	hasCondition := false
+	for p.peek().kind != '}' {
+		section := p.next()
+		if section.kind != 'i' {
+			p.pos--
+			return nil, p.errorf("expected meta, strings or condition of rule %s", r.name)
+		}
+		if err := p.expect(':', ":"); err != nil {
+			return nil, err
+		}
+		var err error
+		switch section.value {
+		case "meta":
+			err = p.meta(r)
+		case "strings":
+			err = p.strings(r)
+		case "condition":
+			r.condition, err = p.or(r)
+			hasCondition = true
+		default:
+			p.pos--
+			err = p.errorf("unknown section %s of rule %s", section.value, r.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	if !hasCondition {
+		return nil, p.errorf("rule %s without condition", r.name)
+	}
+	return r, nil
+}
+
+// section returns whether a new section, or the end of the rule, starts.
+func (p *parser) section() bool {
+	t := p.peek()
+	if t.kind == '}' || p.done() {
+		return true
+	}
+	return t.kind == 'i' && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == ':'
+}
+
+func (p *parser) meta(r *rule) error {
+	for !p.section() {
+		key := p.next()
+		if key.kind != 'i' {
+			p.pos--
+			return p.errorf("expected a meta key")
+		}
+		if err := p.expect('=', "="); err != nil {
+			return err
+		}
+		v := p.next()
+		switch v.kind {
+		case '"':
+			s, err := strconv.Unquote(v.value)
+			if err != nil {
+				p.pos--
+				return p.errorf("invalid string %s", v.value)
+			}
+			r.meta[key.value] = s
+		case 'n', 'i':
+			r.meta[key.value] = v.value
+		default:
+			p.pos--
+			return p.errorf("invalid value of meta %s", key.value)
+		}
+	}
+	return nil
+}
+
+func (p *parser) strings(r *rule) error {
+	for !p.section() {
+		id := p.next()
+		if id.kind != '$' || strings.Contains(id.value, "*") {
+			p.pos--
+			return p.errorf("expected a string identifier")
+		}
+		if err := p.expect('=', "="); err != nil {
+			return err
+		}
+		s := &pattern{id: id.value}
+		v := p.next()
+		var err error
+		switch v.kind {
+		case '"':
+			err = p.text(s, v.value)
+		case '{':
+			err = hexPattern(s, v.value)
+		case '/':
+			err = regexpPattern(s, v.value)
+		default:
+			p.pos--
+			return p.errorf("expected the value of %s", id.value)
+		}
+		if err != nil {
+			p.pos--
+			return p.errorf("%s: %v", id.value, err)
+		}
+		r.strings = append(r.strings, s)
+	}
+	return nil
+}
+
+// text parses the text string quoted and its modifiers.
+func (p *parser) text(s *pattern, quoted string) error {
+	text, err := strconv.Unquote(quoted)
+	if err != nil {
+		return fmt.Errorf("invalid string %s", quoted)
+	}
+	var wide bool
+	for p.peek().kind == 'i' && !p.section() {
+		switch modifier := p.next().value; modifier {
+		case "nocase":
+			s.nocase = true
+		case "wide":
+			wide = true
+		case "ascii", "fullword", "private":
+		default:
+			return fmt.Errorf("unsupported modifier %s", modifier)
+		}
+	}
+	s.text = []byte(text)
+	if s.nocase {
+		s.text = bytes.ToLower(s.text)
+	}
+	if wide {
+		w := make([]byte, 0, 2*len(s.text))
+		for _, c := range s.text {
+			w = append(w, c, 0)
+		}
+		s.text = w
+	}
+	return nil
+}
+
+func hexPattern(s *pattern, body string) error {
+	digits := strings.Join(strings.Fields(body), "")
+	if len(digits)%2 != 0 {
+		return fmt.Errorf("odd hex string")
+	}
+	for i := 0; i < len(digits); i += 2 {
+		var b, mask byte
+		for _, c := range []byte(digits[i : i+2]) {
+			b, mask = b<<4, mask<<4
+			if c != '?' {
+				v, _ := strconv.ParseUint(string(c), 16, 8)
+				b, mask = b|byte(v), mask|0xf
+			}
+		}
+		s.text = append(s.text, b)
+		s.mask = append(s.mask, mask)
+	}
+	if bytes.Count(s.mask, []byte{0}) == len(s.mask) {
+		return fmt.Errorf("hex string of wildcards only")
+	}
+	return nil
+}
+
+func regexpPattern(s *pattern, literal string) error {
+	end := strings.LastIndexByte(literal, '/')
+	if end <= 0 {
+		return fmt.Errorf("unterminated regular expression")
+	}
+	expr := literal[1:end]
+	if flags := literal[end+1:]; flags != "" {
+		expr = "(?" + flags + ")" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	s.re = re
+	return nil
+}
+
+// or parses the conditions, and having precedence over or.
+func (p *parser) or(r *rule) (node, error) {
+	l, err := p.and(r)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == 'i' && p.peek().value == "or" {
+		p.next()
+		right, err := p.and(r)
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, right}
+	}
+	return l, nil
+}
+
+func (p *parser) and(r *rule) (node, error) {
+	l, err := p.unary(r)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == 'i' && p.peek().value == "and" {
+		p.next()
+		right, err := p.unary(r)
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, right}
+	}
+	return l, nil
+}
+
+func (p *parser) unary(r *rule) (node, error) {
+	t := p.next()
+	switch {
+	case t.kind == 'i' && t.value == "not":
+		n, err := p.unary(r)
+		return notNode{n}, err
+	case t.kind == '(':
+		n, err := p.or(r)
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(')', ")")
+	case t.kind == 'i' && (t.value == "true" || t.value == "false"):
+		return boolNode(t.value == "true"), nil
+	case t.kind == '$':
+		ids := r.ids(t.value)
+		if len(ids) != 1 || strings.Contains(t.value, "*") {
+			p.pos--
+			return nil, p.errorf("unknown string %s", t.value)
+		}
+		return stringNode(t.value), nil
+	case t.kind == 'n' || (t.kind == 'i' && (t.value == "any" || t.value == "all")):
+		n := 1
+		switch t.value {
+		case "all":
+			n = -1
+		case "any":
+		default:
+			n, _ = strconv.Atoi(t.value)
+		}
+		if err := p.expect('i', "of"); err != nil {
+			return nil, err
+		}
+		ids, err := p.set(r)
+		if err != nil {
+			return nil, err
+		}
+		return ofNode{n, ids}, nil
+	}
+	p.pos--
+	return nil, p.errorf("unexpected %q in the condition", t.value)
+}
+
+// set parses "them" or a parenthesized list of string identifiers.
+func (p *parser) set(r *rule) ([]string, error) {
+	if t := p.peek(); t.kind == 'i' && t.value == "them" {
+		p.next()
+		return r.ids("$*"), nil
+	}
+	if err := p.expect('(', "("); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for {
+		t := p.next()
+		matching := r.ids(t.value)
+		if t.kind != '$' || len(matching) == 0 {
+			p.pos--
+			return nil, p.errorf("unknown string %s", t.value)
+		}
+		ids = append(ids, matching...)
+		if p.peek().kind != ',' {
+			break
+		}
+		p.next()
+	}
+	return ids, p.expect(')', ")")
+}
+
+// ids returns the identifiers of the strings of r matching id, ending with
+// * for a prefix.
+func (r *rule) ids(id string) []string {
+	var ids []string
+	prefix, wildcard := strings.CutSuffix(id, "*")
+	for _, s := range r.strings {
+		if s.id == id || (wildcard && strings.HasPrefix(s.id, prefix)) {
+			ids = append(ids, s.id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,257 @@
+// Package signature scans the request and response bodies with signature
+// rules, for the security teams using the proxy as an inspection point:
+//
+//	rules, err := signature.Compile(src)
+//	stage := signature.NewStage(rules)
+//	stage.Install(proxy)
+//
+// The rules are written in a subset of the YARA language, scanned in pure
+// Go, see Rules. Any other engine, such as the bindings of libyara,
+// implements Scanner. The action of a rule matching is its "action" meta:
+// "block" rejects the request or the response, "log" logs it, and "allow"
+// lets it through, whatever the other rules matching.
+//
+// The bodies are scanned as sent, with their Content-Encoding, up to
+// MaxBodySize.
+//
+// The rules are reloaded, atomically, with Swap or LoadFile, for example on
+// SIGHUP with the Reload of the daemon package, the bodies being scanned
+// entirely by the rules in place when they were read.
+package signature
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Action is the verdict of a rule matching.
+type Action int
+
+const (
+	// Log logs the bodies matching.
+	Log Action = iota
+	// Block rejects the requests or the responses whose bodies match.
+	Block
+	// Allow lets the bodies matching through, whatever the other rules.
+	Allow
+)
+
+func (a Action) String() string {
+	switch a {
+	case Block:
+		return "block"
+	case Allow:
+		return "allow"
+	}
+	return "log"
+}
+
+// ParseAction returns the Action named s, Log by default.
+func ParseAction(s string) Action {
+	switch strings.ToLower(s) {
+	case "block":
+		return Block
+	case "allow":
+		return Allow
+	}
+	return Log
+}
+
+// Match is a rule matching a body.
+type Match struct {
+	Rule   string
+	Tags   []string
+	Meta   map[string]string
+	Action Action
+}
+
+// Scanner scans the bodies.
+type Scanner interface {
+	// Scan returns the rules matching data.
+	Scan(data []byte) ([]Match, error)
+}
+
+// Verdict returns the action of matches: Allow when one of them allows,
+// else Block when one of them blocks, else Log.
+func Verdict(matches []Match) Action {
+	verdict := Log
+	for _, m := range matches {
+		switch m.Action {
+		case Allow:
+			return Allow
+		case Block:
+			verdict = Block
+		}
+	}
+	return verdict
+}
+
+type scannerRef struct{ Scanner }
+
+// Stage scans the bodies of the requests and responses it handles.
+type Stage struct {
+	// MaxBodySize bounds the bodies scanned, 8 MiB by default. The larger
+	// bodies are sent without being scanned.
+	MaxBodySize int64
+	// SkipRequests and SkipResponses disable the scanning of the request
+	// and the response bodies.
+	SkipRequests  bool
+	SkipResponses bool
+	// OnMatch, when set, is called with the rules matching every body, for
+	// example to audit them.
+	OnMatch func(ctx *goproxy.ProxyCtx, matches []Match)
+
+	scanner atomic.Pointer[scannerRef]
+}
+
+// NewStage returns a Stage scanning with s.
+func NewStage(s Scanner) *Stage {
+	st := &Stage{}
+	st.Swap(s)
+	return st
+}
+
+// Scanner returns the scanner in place.
+func (st *Stage) Scanner() Scanner {
+	if ref := st.scanner.Load(); ref != nil {
+		return ref.Scanner
+	}
+	return nil
+}
+
+// Swap replaces the scanner in place by s, returning the previous one.
+func (st *Stage) Swap(s Scanner) Scanner {
+	if old := st.scanner.Swap(&scannerRef{s}); old != nil {
+		return old.Scanner
+	}
+	return nil
+}
+
+// LoadFile compiles the Rules of the file at path and swaps them in. The
+// rules in place are kept when the file is invalid.
+func (st *Stage) LoadFile(path string) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rules, err := Compile(string(src))
+	if err != nil {
+		return err
+	}
+	st.Swap(rules)
+	return nil
+}
+
+type matchesKey struct{}
+
+// Matches returns the rules matching the bodies of the request of ctx, and
+// of its response once scanned.
+func Matches(ctx *goproxy.ProxyCtx) []Match {
+	matches, _ := ctx.Value(matchesKey{}).([]Match)
+	return matches
+}
+
+// scan scans the body, returning the rule blocking it, if any.
+func (st *Stage) scan(body *io.ReadCloser, length *int64, what string, ctx *goproxy.ProxyCtx) (*Match, error) {
+	s := st.Scanner()
+	if s == nil || *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	limit := st.MaxBodySize
+	if limit <= 0 {
+		limit = 8 << 20
+	}
+	if *length > limit {
+		return nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(*body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), *body), *body}
+		return nil, nil
+	}
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	*length = int64(len(data))
+
+	matches, err := s.Scan(data)
+	if err != nil {
+		ctx.Warnf("signature: can't scan the %s body of %v: %v", what, ctx.Req.URL, err)
+		return nil, nil
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	ctx.SetValue(matchesKey{}, append(Matches(ctx), matches...))
+	if st.OnMatch != nil {
+		st.OnMatch(ctx, matches)
+	}
+	var blocking *Match
+	for i, m := range matches {
+		ctx.Logf("signature: rule %s (%s) matches the %s body of %v", m.Rule, m.Action, what, ctx.Req.URL)
+		if m.Action == Block && blocking == nil {
+			blocking = &matches[i]
+		}
+	}
+	if Verdict(matches) != Block {
+		return nil, nil
+	}
+	return blocking, nil
+}
+
+func blocked(req *http.Request, ctx *goproxy.ProxyCtx, m *Match) *http.Response {
+	ctx.Warnf("signature: rule %s blocks %v", m.Rule, req.URL)
+	ctx.Error = &goproxy.ErrBlockedByRule{RuleID: m.Rule, Reason: "signature matched"}
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by signature "+m.Rule)
+}
+
+// HandleRequest is a goproxy.FuncReqHandler, scanning the request body.
+func (st *Stage) HandleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if st.SkipRequests {
+		return req, nil
+	}
+	m, err := st.scan(&req.Body, &req.ContentLength, "request", ctx)
+	if err != nil {
+		ctx.Warnf("signature: can't read the request body of %v: %v", req.URL, err)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, "Cannot read the request body")
+	}
+	if m != nil {
+		return req, blocked(req, ctx, m)
+	}
+	return req, nil
+}
+
+// HandleResponse is a goproxy.FuncRespHandler, scanning the response body.
+func (st *Stage) HandleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if st.SkipResponses || resp == nil {
+		return resp
+	}
+	m, err := st.scan(&resp.Body, &resp.ContentLength, "response", ctx)
+	if err != nil {
+		ctx.Warnf("signature: can't read the response body of %v: %v", ctx.Req.URL, err)
+		resp.Body.Close()
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot read the response body")
+	}
+	if m != nil {
+		resp.Body.Close()
+		return blocked(ctx.Req, ctx, m)
+	}
+	return resp
+}
+
+// Install scans the bodies of proxy.
+func (st *Stage) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(st.HandleRequest)
+	proxy.OnResponse().DoFunc(st.HandleResponse)
+}
@@ -0,0 +1,176 @@
+package signature_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/signature"
+)
+
+const rules = `
+// The EICAR test file.
+rule EICAR : malware test {
+	meta:
+		action = "block"
+		description = "EICAR test file"
+	strings:
+		$text = "eicar-standard-antivirus-test-file" nocase
+		$header = { 58 35 4F ?? 50 25 }
+		$regex = /X5O!P%@AP\[4\\PZX54\(P\^\)7CC\)7\}/
+	condition:
+		$text or ($header and $regex)
+}
+
+/* Executables, in any of their encodings. */
+rule Executable {
+	meta:
+		action = "log"
+	strings:
+		$mz = { 4D 5A }
+		$pe = "This program cannot be run in DOS mode"
+		$pe_wide = "This program cannot be run in DOS mode" wide
+	condition:
+		$mz and any of ($pe*)
+}
+
+rule Trusted {
+	meta:
+		action = "allow"
+	strings:
+		$a = "signed-by-us"
+		$b = "release"
+		$c = "build"
+	condition:
+		2 of them and not $c
+}
+`
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func TestRules(t *testing.T) {
+	r, err := signature.Compile(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 3 {
+		t.Errorf("Expected 3 rules, got %d", r.Len())
+	}
+	for data, expected := range map[string][]string{
+		eicar:                                    {"EICAR"},
+		strings.ToLower(eicar):                   {"EICAR"},
+		"X5O\x00P% X5O!P%@AP[4\\PZX54(P^)7CC)7}": {"EICAR"},
+		"MZ\x90\x00This program cannot be run in DOS mode": {"Executable"},
+		"MZ\x90\x00T\x00h\x00i\x00s\x00 \x00p\x00r\x00o\x00g\x00r\x00a\x00m\x00 \x00c\x00a\x00n\x00n\x00o\x00t\x00 \x00b\x00e\x00 \x00r\x00u\x00n\x00 \x00i\x00n\x00 \x00D\x00O\x00S\x00 \x00m\x00o\x00d\x00e\x00": {"Executable"},
+		"This program cannot be run in DOS mode": nil,
+		"signed-by-us release " + eicar:          {"EICAR", "Trusted"},
+		"signed-by-us release build":             nil,
+	} {
+		matches, err := r.Scan([]byte(data))
+		var names []string
+		for _, m := range matches {
+			names = append(names, m.Rule)
+		}
+		if err != nil || strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected %q to match %q, got %q", data, expected, names)
+		}
+	}
+	matches, _ := r.Scan([]byte(eicar))
+	if m := matches[0]; m.Action != signature.Block || m.Meta["description"] != "EICAR test file" || strings.Join(m.Tags, ",") != "malware,test" {
+		t.Errorf("Expected the meta and tags of the rule, got %+v", m)
+	}
+	matches, _ = r.Scan([]byte("signed-by-us release " + eicar))
+	if signature.Verdict(matches) != signature.Allow {
+		t.Error("Expected the allowing rule to win")
+	}
+
+	for _, src := range []string{
+		`rule A { condition: $a }`,
+		`rule A { strings: $a = "a" condition: }`,
+		`rule A { strings: $a = { 4D 5 } condition: $a }`,
+		`rule A { strings: $a = /(/ condition: $a }`,
+		`rule A { strings: $a = "a" xor condition: $a }`,
+		`rule A { strings: $a = "a" }`,
+		`rule A { condition: true } rule A { condition: false }`,
+	} {
+		if _, err := signature.Compile(src); err == nil {
+			t.Errorf("Expected %q not to compile", src)
+		}
+	}
+}
+
+func TestStage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, r.URL.Query().Get("body"))
+	}))
+	defer upstream.Close()
+
+	r, err := signature.Compile(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audited []string
+	stage := signature.NewStage(r)
+	stage.OnMatch = func(ctx *goproxy.ProxyCtx, matches []signature.Match) {
+		for _, m := range matches {
+			audited = append(audited, m.Rule)
+		}
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	stage.Install(proxy)
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	request := func(upload, download string) int {
+		resp, err := client.Post(upstream.URL+"/?body="+url.QueryEscape(download), "text/plain", strings.NewReader(upload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := request("clean", "clean"); status != http.StatusOK {
+		t.Errorf("Expected the clean request to pass, got %d", status)
+	}
+	if status := request(eicar, "clean"); status != http.StatusForbidden {
+		t.Errorf("Expected the upload to be blocked, got %d", status)
+	}
+	if status := request("clean", eicar); status != http.StatusForbidden {
+		t.Errorf("Expected the download to be blocked, got %d", status)
+	}
+	if status := request("clean", "MZ This program cannot be run in DOS mode"); status != http.StatusOK {
+		t.Errorf("Expected the logging rule not to block, got %d", status)
+	}
+	if strings.Join(audited, ",") != "EICAR,EICAR,Executable" {
+		t.Errorf("Expected the matches to be audited, got %q", audited)
+	}
+
+	// The rules are reloaded, the invalid ones being ignored.
+	path := filepath.Join(t.TempDir(), "rules.yar")
+	os.WriteFile(path, []byte(`rule Invalid { condition: $a }`), 0o600)
+	if err := stage.LoadFile(path); err == nil {
+		t.Error("Expected the invalid rules to be refused")
+	}
+	if status := request(eicar, "clean"); status != http.StatusForbidden {
+		t.Errorf("Expected the previous rules to be kept, got %d", status)
+	}
+	os.WriteFile(path, []byte(`rule Secret { meta: action = "block" strings: $s = "top secret" condition: $s }`), 0o600)
+	if err := stage.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if status := request(eicar, "clean"); status != http.StatusOK {
+		t.Errorf("Expected the new rules to be in place, got %d", status)
+	}
+	if status := request("top secret", "clean"); status != http.StatusForbidden {
+		t.Errorf("Expected the new rule to block, got %d", status)
+	}
+}
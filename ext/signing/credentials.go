@@ -0,0 +1,143 @@
+package signing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are AWS credentials.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is the token of the temporary credentials.
+	SessionToken string
+	// Expires is when the temporary credentials expire, zero for the
+	// permanent ones.
+	Expires time.Time
+}
+
+// CredentialsProvider provides the credentials signing the requests.
+type CredentialsProvider interface {
+	Retrieve(ctx context.Context) (Credentials, error)
+}
+
+// StaticCredentials provides the same credentials.
+type StaticCredentials Credentials
+
+func (c StaticCredentials) Retrieve(context.Context) (Credentials, error) {
+	return Credentials(c), nil
+}
+
+// EnvCredentials returns the credentials of the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+func EnvCredentials() (StaticCredentials, error) {
+	c := StaticCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return c, errors.New("signing: no AWS credentials in the environment")
+	}
+	return c, nil
+}
+
+// InstanceRole provides the credentials of the IAM role of the EC2 instance
+// running the proxy, from the instance metadata service with IMDSv2. They
+// are refreshed 5 minutes before they expire.
+type InstanceRole struct {
+	// Endpoint is the metadata service, http://169.254.169.254 by default.
+	Endpoint string
+	// Client sends the requests to the metadata service,
+	// http.DefaultClient by default.
+	Client *http.Client
+
+	mu     sync.Mutex
+	cached Credentials
+}
+
+func (r *InstanceRole) get(ctx context.Context, method, path, token string) (string, error) {
+	endpoint := r.Endpoint
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	} else {
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("signing: metadata service answered %s to %s", resp.Status, path)
+	}
+	return string(body), nil
+}
+
+func (r *InstanceRole) Retrieve(ctx context.Context) (Credentials, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cached.AccessKeyID != "" && time.Now().Add(5*time.Minute).Before(r.cached.Expires) {
+		return r.cached, nil
+	}
+	token, err := r.get(ctx, http.MethodPut, "/latest/api/token", "")
+	if err != nil {
+		return Credentials{}, err
+	}
+	const path = "/latest/meta-data/iam/security-credentials/"
+	roles, err := r.get(ctx, http.MethodGet, path, token)
+	if err != nil {
+		return Credentials{}, err
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(roles), "\n")
+	if role == "" {
+		return Credentials{}, errors.New("signing: no IAM role on the instance")
+	}
+	doc, err := r.get(ctx, http.MethodGet, path+role, token)
+	if err != nil {
+		return Credentials{}, err
+	}
+	var creds struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(doc), &creds); err != nil {
+		return Credentials{}, fmt.Errorf("signing: invalid credentials of role %s: %w", role, err)
+	}
+	if creds.Code != "Success" {
+		return Credentials{}, fmt.Errorf("signing: credentials of role %s: %s", role, creds.Code)
+	}
+	r.cached = Credentials{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.Token,
+		Expires:         creds.Expiration,
+	}
+	return r.cached, nil
+}
@@ -0,0 +1,112 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// HMAC signs the requests with the HMAC-SHA256 HTTP signatures of the
+// draft-cavage-http-signatures scheme, in a Signature header:
+//
+//	Signature: keyId="proxy",algorithm="hmac-sha256",headers="(request-target) host date digest",signature="..."
+//
+// The Date and, when signed, the Digest headers are set by the signer.
+type HMAC struct {
+	KeyID string
+	Key   []byte
+	// Headers are the signed headers, "(request-target)", "host", "date"
+	// and "digest" by default.
+	Headers []string
+	// Header is the header of the signature, Signature by default, or
+	// Authorization for the schemes expecting "Authorization: Signature ...".
+	Header string
+	// MaxBodySize bounds the bodies hashed in the Digest, 10 MiB by default.
+	MaxBodySize int64
+	// Now returns the signing time, time.Now by default.
+	Now func() time.Time
+}
+
+func (h *HMAC) headers() []string {
+	if h.Headers != nil {
+		return h.Headers
+	}
+	return []string{"(request-target)", "host", "date", "digest"}
+}
+
+// Sign signs req, whose body is body when the digest is signed.
+func (h *HMAC) Sign(req *http.Request, body []byte) error {
+	now := time.Now()
+	if h.Now != nil {
+		now = h.Now()
+	}
+	names := h.headers()
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		var value string
+		switch name {
+		case "(request-target)":
+			value = strings.ToLower(req.Method) + " " + req.URL.RequestURI()
+		case "host":
+			value = requestHost(req)
+		case "date":
+			value = now.UTC().Format(http.TimeFormat)
+			req.Header.Set("Date", value)
+		case "digest":
+			sum := sha256.Sum256(body)
+			value = "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+			req.Header.Set("Digest", value)
+		default:
+			values := req.Header.Values(name)
+			if len(values) == 0 {
+				return fmt.Errorf("signing: no %s header to sign", name)
+			}
+			value = strings.Join(values, ", ")
+		}
+		lines = append(lines, name+": "+value)
+	}
+	mac := hmac.New(sha256.New, h.Key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	signature := fmt.Sprintf(`keyId="%s",algorithm="hmac-sha256",headers="%s",signature="%s"`,
+		h.KeyID, strings.ToLower(strings.Join(names, " ")), base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	header := h.Header
+	if header == "" {
+		header = "Signature"
+	}
+	if strings.EqualFold(header, "Authorization") {
+		signature = "Signature " + signature
+	}
+	req.Header.Set(header, signature)
+	return nil
+}
+
+// Handle implements goproxy.ReqHandler.
+func (h *HMAC) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	signing(ctx, func(req *http.Request) error {
+		limit := h.MaxBodySize
+		if limit <= 0 {
+			limit = 10 << 20
+		}
+		var body []byte
+		for _, name := range h.headers() {
+			if strings.EqualFold(name, "digest") {
+				var ok bool
+				var err error
+				if body, ok, err = readBody(req, limit); err != nil {
+					return err
+				} else if !ok {
+					return ErrBodyTooLarge
+				}
+			}
+		}
+		return h.Sign(req, body)
+	})
+	return req, nil
+}
@@ -0,0 +1,232 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ErrInvalidSignature is the error of the responses whose signature a
+// ResponseVerifier rejects.
+var ErrInvalidSignature = errors.New("signing: invalid response signature")
+
+// DefaultResponseHeader is the default header of the response signatures.
+const DefaultResponseHeader = "X-Response-Signature"
+
+// ResponseSigner signs the responses with Ed25519, in a detached signature
+// header, so that the downstream proxies of a chain detect with a
+// ResponseVerifier the responses tampered with in between:
+//
+//	proxy.OnResponse().Do(&signing.ResponseSigner{KeyID: "edge-1", Key: key})
+//
+// The signature covers the method, host and target of the request, the
+// status, the time of the signature, the Content-Type and Content-Encoding,
+// and the SHA-256 digest of the body:
+//
+//	X-Response-Signature: keyId="edge-1",algorithm="ed25519",created="1714557600",digest="SHA-256=...",signature="..."
+//
+// Register it last, for the changes of the other handlers to be signed.
+type ResponseSigner struct {
+	KeyID string
+	Key   ed25519.PrivateKey
+	// Header is the header of the signature, DefaultResponseHeader by
+	// default.
+	Header string
+	// MaxBodySize bounds the bodies hashed in the digest, 10 MiB by
+	// default. The larger responses are sent unsigned.
+	MaxBodySize int64
+	// Now returns the signing time, time.Now by default.
+	Now func() time.Time
+}
+
+func responseHeader(header string) string {
+	if header == "" {
+		return DefaultResponseHeader
+	}
+	return header
+}
+
+func maxBodySize(limit int64) int64 {
+	if limit <= 0 {
+		return 10 << 20
+	}
+	return limit
+}
+
+// responseRequest returns the request of resp, as sent upstream.
+func responseRequest(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Request {
+	if resp.Request != nil {
+		return resp.Request
+	}
+	return ctx.Req
+}
+
+// responseSigningString returns the string signed of resp, answering req.
+func responseSigningString(resp *http.Response, req *http.Request, created, digest string) string {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	return strings.Join([]string{
+		"(request-target): " + strings.ToLower(req.Method) + " " + req.URL.RequestURI(),
+		"host: " + host,
+		"(status): " + strconv.Itoa(resp.StatusCode),
+		"(created): " + created,
+		"content-type: " + resp.Header.Get("Content-Type"),
+		"content-encoding: " + resp.Header.Get("Content-Encoding"),
+		"digest: " + digest,
+	}, "\n")
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Sign signs resp, answering req, whose body is body.
+func (s *ResponseSigner) Sign(resp *http.Response, req *http.Request, body []byte) {
+	now := time.Now()
+	if s.Now != nil {
+		now = s.Now()
+	}
+	created := strconv.FormatInt(now.Unix(), 10)
+	digest := bodyDigest(body)
+	signature := ed25519.Sign(s.Key, []byte(responseSigningString(resp, req, created, digest)))
+	resp.Header.Set(responseHeader(s.Header), fmt.Sprintf(`keyId="%s",algorithm="ed25519",created="%s",digest="%s",signature="%s"`,
+		s.KeyID, created, digest, base64.StdEncoding.EncodeToString(signature)))
+}
+
+// Handle implements goproxy.RespHandler.
+func (s *ResponseSigner) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	body, ok, err := bufferBody(&resp.Body, &resp.ContentLength, maxBodySize(s.MaxBodySize))
+	if err != nil {
+		ctx.Warnf("signing: can't read the response of %v: %v", ctx.Req.URL, err)
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot read the response")
+	}
+	if !ok {
+		ctx.Logf("signing: the response of %v is too large to be signed", ctx.Req.URL)
+		return resp
+	}
+	s.Sign(resp, responseRequest(resp, ctx), body)
+	return resp
+}
+
+// parseParams parses the comma-separated key="value" parameters of a
+// signature header.
+func parseParams(header string) map[string]string {
+	params := make(map[string]string)
+	for _, p := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if ok {
+			params[k] = strings.Trim(v, `"`)
+		}
+	}
+	return params
+}
+
+// ResponseVerifier verifies the signatures of the responses of the upstream
+// proxies signed by a ResponseSigner. The responses with an invalid
+// signature are replaced with a 502 Bad Gateway, with ErrInvalidSignature
+// in ProxyCtx.Error:
+//
+//	proxy.OnResponse().Do(&signing.ResponseVerifier{Keys: map[string]ed25519.PublicKey{"edge-1": key}})
+//
+// The responses are verified as received, so the transport must not
+// decompress them: set Tr.DisableCompression. Register it first, before the
+// handlers changing the responses. The signature is kept, for the next
+// proxies of the chain.
+type ResponseVerifier struct {
+	// Keys are the public keys of the signers, by key ID.
+	Keys map[string]ed25519.PublicKey
+	// Header is the header of the signature, DefaultResponseHeader by
+	// default.
+	Header string
+	// Required rejects the unsigned responses too.
+	Required bool
+	// MaxAge rejects the signatures older, and those created later, to
+	// bound the replays. 5 minutes by default, negative for no limit.
+	MaxAge time.Duration
+	// MaxBodySize bounds the bodies verified, 10 MiB by default. The
+	// signed responses which are larger are rejected.
+	MaxBodySize int64
+	// Now returns the verification time, time.Now by default.
+	Now func() time.Time
+}
+
+// Verify verifies the signature of resp, answering req, whose body is
+// body. It returns nil for the unsigned responses unless Required.
+func (v *ResponseVerifier) Verify(resp *http.Response, req *http.Request, body []byte) error {
+	header := resp.Header.Get(responseHeader(v.Header))
+	if header == "" {
+		if v.Required {
+			return fmt.Errorf("%w: unsigned response", ErrInvalidSignature)
+		}
+		return nil
+	}
+	params := parseParams(header)
+	key, ok := v.Keys[params["keyId"]]
+	if !ok {
+		return fmt.Errorf("%w: unknown key %q", ErrInvalidSignature, params["keyId"])
+	}
+	if params["algorithm"] != "ed25519" {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidSignature, params["algorithm"])
+	}
+	created, err := strconv.ParseInt(params["created"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid creation time", ErrInvalidSignature)
+	}
+	maxAge := v.MaxAge
+	if maxAge == 0 {
+		maxAge = 5 * time.Minute
+	}
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	if age := now.Sub(time.Unix(created, 0)); maxAge > 0 && (age > maxAge || age < -maxAge) {
+		return fmt.Errorf("%w: created %v ago", ErrInvalidSignature, age.Round(time.Second))
+	}
+	digest := bodyDigest(body)
+	if params["digest"] != digest {
+		return fmt.Errorf("%w: body digest mismatch", ErrInvalidSignature)
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil || !ed25519.Verify(key, []byte(responseSigningString(resp, req, params["created"], digest)), signature) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// Handle implements goproxy.RespHandler.
+func (v *ResponseVerifier) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || resp.Header.Get(responseHeader(v.Header)) == "" && !v.Required {
+		return resp
+	}
+	body, ok, err := bufferBody(&resp.Body, &resp.ContentLength, maxBodySize(v.MaxBodySize))
+	switch {
+	case err != nil:
+		err = fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	case !ok:
+		err = fmt.Errorf("%w: response too large to be verified", ErrInvalidSignature)
+	default:
+		err = v.Verify(resp, responseRequest(resp, ctx), body)
+	}
+	if err == nil {
+		return resp
+	}
+	resp.Body.Close()
+	ctx.Warnf("signing: rejecting the response of %v: %v", ctx.Req.URL, err)
+	ctx.Error = err
+	return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Response signature verification failed")
+}
@@ -0,0 +1,238 @@
+package signing_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/signing"
+)
+
+var exampleCredentials = signing.StaticCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+func TestSigV4Vanilla(t *testing.T) {
+	// The get-vanilla case of the AWS Signature Version 4 test suite.
+	req := httptest.NewRequest("GET", "http://example.amazonaws.com/", nil)
+	req.Header = http.Header{}
+	signer := &signing.SigV4{Credentials: exampleCredentials, Region: "us-east-1", Service: "service"}
+	sum := sha256.Sum256(nil)
+	if err := signer.Sign(req, hex.EncodeToString(sum[:]), time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %s, want %s", got, want)
+	}
+}
+
+func proxyClient(t *testing.T, handler goproxy.ReqHandler) *http.Client {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(handler)
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+	u, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+}
+
+func TestSigV4Proxy(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	signer := &signing.SigV4{
+		Credentials: signing.StaticCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"},
+		Region:      "eu-west-1",
+		Service:     "s3",
+		Now:         func() time.Time { return now },
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got := r.Header.Get("Authorization")
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) || r.Header.Get("X-Amz-Security-Token") != "token" {
+			t.Errorf("headers %v", r.Header)
+		}
+		// The signature is computed again from the received request.
+		r.URL.Scheme, r.URL.Host = "http", r.Host
+		if err := signer.Sign(r, hex.EncodeToString(sum[:]), now); err != nil || r.Header.Get("Authorization") != got {
+			t.Errorf("Authorization %s, want %s", got, r.Header.Get("Authorization"))
+		}
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	client := proxyClient(t, signer)
+	req, _ := http.NewRequest("PUT", upstream.URL+"/my key?b=2&a=1", strings.NewReader("object"))
+	req.Header.Set("Authorization", "Bearer client")
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "object" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	signer := &signing.HMAC{KeyID: "proxy", Key: []byte("key"), Now: func() time.Time { return now }}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		digest := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+		signed := strings.Join([]string{
+			"(request-target): post /api?x=1",
+			"host: " + r.Host,
+			"date: Wed, 01 May 2024 10:00:00 GMT",
+			"digest: " + digest,
+		}, "\n")
+		mac := hmac.New(sha256.New, []byte("key"))
+		mac.Write([]byte(signed))
+		want := `keyId="proxy",algorithm="hmac-sha256",headers="(request-target) host date digest",signature="` +
+			base64.StdEncoding.EncodeToString(mac.Sum(nil)) + `"`
+		if got := r.Header.Get("Signature"); got != want || r.Header.Get("Digest") != digest {
+			t.Errorf("Signature %s, want %s", got, want)
+		}
+	}))
+	defer upstream.Close()
+
+	resp, err := proxyClient(t, signer).Post(upstream.URL+"/api?x=1", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestInstanceRole(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var fetches int
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+			io.WriteString(w, "imds-token")
+		case r.Header.Get("X-Aws-Ec2-Metadata-Token") != "imds-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			io.WriteString(w, "proxy-role")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/proxy-role":
+			fetches++
+			io.WriteString(w, `{"Code":"Success","AccessKeyId":"ASIA","SecretAccessKey":"secret","Token":"session","Expiration":"`+expires.Format(time.RFC3339)+`"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer imds.Close()
+
+	role := &signing.InstanceRole{Endpoint: imds.URL}
+	for i := 0; i < 2; i++ {
+		creds, err := role.Retrieve(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds.AccessKeyID != "ASIA" || creds.SessionToken != "session" || !creds.Expires.Equal(expires) {
+			t.Errorf("credentials %+v", creds)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("credentials fetched %d times", fetches)
+	}
+}
+
+// chain returns a client of a downstream proxy verifying the responses of
+// the upstream proxy, signing them, through a middle proxy changing them
+// with tamper.
+func chain(t *testing.T, signer *signing.ResponseSigner, verifier *signing.ResponseVerifier, tamper goproxy.FuncRespHandler) *http.Client {
+	t.Helper()
+	next := func(proxy *goproxy.ProxyHttpServer) *url.URL {
+		s := httptest.NewServer(proxy)
+		t.Cleanup(s.Close)
+		u, _ := url.Parse(s.URL)
+		return u
+	}
+	upstream := goproxy.NewProxyHttpServer()
+	if signer != nil {
+		upstream.OnResponse().Do(signer)
+	}
+	middle := goproxy.NewProxyHttpServer()
+	middle.Tr.Proxy = http.ProxyURL(next(upstream))
+	if tamper != nil {
+		middle.OnResponse().Do(tamper)
+	}
+	downstream := goproxy.NewProxyHttpServer()
+	downstream.Tr.Proxy = http.ProxyURL(next(middle))
+	downstream.Tr.DisableCompression = true
+	downstream.OnResponse().Do(verifier)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(next(downstream))}}
+}
+
+func TestResponseSignature(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "balance: 100")
+	}))
+	defer server.Close()
+	signer := &signing.ResponseSigner{KeyID: "edge-1", Key: key}
+	verifier := &signing.ResponseVerifier{Keys: map[string]ed25519.PublicKey{"edge-1": pub}, Required: true}
+	get := func(client *http.Client) (int, string) {
+		resp, err := client.Get(server.URL + "/account?id=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get(chain(t, signer, verifier, nil)); status != http.StatusOK || body != "balance: 100" {
+		t.Errorf("Expected the signed response, got %d %q", status, body)
+	}
+
+	tamper := func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(strings.NewReader("balance: 999"))
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return resp
+	}
+	if status, body := get(chain(t, signer, verifier, tamper)); status != http.StatusBadGateway {
+		t.Errorf("Expected the tampered response to be rejected, got %d %q", status, body)
+	}
+
+	if status, _ := get(chain(t, nil, verifier, nil)); status != http.StatusBadGateway {
+		t.Errorf("Expected the unsigned response to be rejected, got %d", status)
+	}
+
+	// The signatures of a replay of another response don't match.
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	req := httptest.NewRequest(http.MethodGet, "http://bank.example.com/account?id=1", nil)
+	signer.Sign(resp, req, []byte("balance: 100"))
+	if err := verifier.Verify(resp, req, []byte("balance: 100")); err != nil {
+		t.Errorf("Expected the signature to be valid, got %v", err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://bank.example.com/account?id=2", nil)
+	if err := verifier.Verify(resp, req, []byte("balance: 100")); !errors.Is(err, signing.ErrInvalidSignature) {
+		t.Errorf("Expected the signature of another request to be invalid, got %v", err)
+	}
+	verifier.Now = func() time.Time { return time.Now().Add(time.Hour) }
+	req = httptest.NewRequest(http.MethodGet, "http://bank.example.com/account?id=1", nil)
+	if err := verifier.Verify(resp, req, []byte("balance: 100")); !errors.Is(err, signing.ErrInvalidSignature) {
+		t.Errorf("Expected the old signature to be invalid, got %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+// Package signing signs the requests sent upstream by the proxy, with AWS
+// Signature Version 4 or HMAC HTTP signatures, so that the clients can
+// reach the endpoints requiring them without holding the secrets:
+//
+//	signer := &signing.SigV4{Credentials: &signing.InstanceRole{}, Region: "eu-west-1", Service: "s3"}
+//	proxy.OnRequest(goproxy.DstHostIs("my-bucket.s3.eu-west-1.amazonaws.com")).Do(signer)
+//
+// The requests are signed as they are sent upstream, after the changes of
+// the other handlers. The HTTPS requests must be MITM'd to be signed.
+//
+// The responses are signed with Ed25519 by a ResponseSigner, for the
+// downstream proxies of a chain to verify them with a ResponseVerifier.
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// UnsignedPayload is the payload hash of the S3 requests whose body isn't
+// signed.
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// ErrBodyTooLarge is returned for the requests whose body exceeds the
+// MaxBodySize of the signer, and can't be sent unsigned.
+var ErrBodyTooLarge = errors.New("signing: request body too large to be signed")
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat  = "20060102T150405Z"
+)
+
+// SigV4 signs the requests with AWS Signature Version 4.
+type SigV4 struct {
+	Credentials CredentialsProvider
+	Region      string
+	Service     string
+	// MaxBodySize bounds the bodies hashed to be signed, 10 MiB by default.
+	// The larger S3 bodies are sent as UnsignedPayload, the others fail.
+	MaxBodySize int64
+	// Now returns the signing time, time.Now by default.
+	Now func() time.Time
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode encodes s as AWS does, every byte but the unreserved ones, and
+// the slashes unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *SigV4) canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if s.Service == "s3" {
+		// S3 encodes the paths once.
+		path = u.Path
+	}
+	if path == "" {
+		return "/"
+	}
+	return uriEncode(path, false)
+}
+
+func canonicalQuery(u *url.URL) string {
+	values, _ := url.ParseQuery(u.RawQuery)
+	var pairs []string
+	for k, vs := range values {
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// signedHeaders returns the headers of req to sign. The headers that the
+// proxy or the transport may change, such as User-Agent, are not signed.
+func signedHeaders(req *http.Request) ([]string, map[string]string) {
+	values := map[string]string{"host": requestHost(req)}
+	for k, vs := range req.Header {
+		name := strings.ToLower(k)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "content-md5" {
+			trimmed := make([]string, len(vs))
+			for i, v := range vs {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			values[name] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, values
+}
+
+// Sign signs req, whose body has the hex SHA-256 payloadHash or is
+// UnsignedPayload, at now.
+func (s *SigV4) Sign(req *http.Request, payloadHash string, now time.Time) error {
+	creds, err := s.Credentials.Retrieve(req.Context())
+	if err != nil {
+		return err
+	}
+	now = now.UTC()
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	names, values := signedHeaders(req)
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(s.canonicalURI(req.URL) + "\n")
+	canonical.WriteString(canonicalQuery(req.URL) + "\n")
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(values[name]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + payloadHash)
+
+	scope := date + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	toSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonical.String()))
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, creds.AccessKeyID, scope, signed, signature))
+	return nil
+}
+
+// readBody reads the body of req up to limit, replacing it with a copy. It
+// returns false for the bodies beyond limit, which are still sent whole.
+func readBody(req *http.Request, limit int64) ([]byte, bool, error) {
+	return bufferBody(&req.Body, &req.ContentLength, limit)
+}
+
+// bufferBody reads *body, of length *length, up to limit, replacing it with
+// a copy, as readBody.
+func bufferBody(body *io.ReadCloser, length *int64, limit int64) ([]byte, bool, error) {
+	if *body == nil || *body == http.NoBody {
+		return []byte{}, true, nil
+	}
+	if *length > limit {
+		return nil, false, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(*body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > limit {
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), *body), *body}
+		return nil, false, nil
+	}
+	(*body).Close()
+	*body = io.NopCloser(bytes.NewReader(data))
+	*length = int64(len(data))
+	return data, true, nil
+}
+
+func (s *SigV4) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Handle implements goproxy.ReqHandler.
+func (s *SigV4) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	signing(ctx, func(req *http.Request) error {
+		limit := s.MaxBodySize
+		if limit <= 0 {
+			limit = 10 << 20
+		}
+		body, ok, err := readBody(req, limit)
+		if err != nil {
+			return err
+		}
+		payloadHash := UnsignedPayload
+		if ok {
+			payloadHash = hashHex(body)
+		} else if s.Service != "s3" {
+			return ErrBodyTooLarge
+		}
+		return s.Sign(req, payloadHash, s.now())
+	})
+	return req, nil
+}
+
+// signing makes the requests of ctx signed by sign when they are sent
+// upstream.
+func signing(ctx *goproxy.ProxyCtx, sign func(req *http.Request) error) {
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		if err := sign(req); err != nil {
+			ctx.Warnf("signing: can't sign %v: %v", req.URL, err)
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		return next.RoundTrip(req, ctx)
+	})
+}
@@ -0,0 +1,220 @@
+// Package snipolicy decides the fate of the TLS tunnels from the SNI of
+// their ClientHello, rather than assuming that every TLS session is HTTPS,
+// for the custom protocols over TLS:
+//
+//	p := &snipolicy.Policy{Rules: []snipolicy.Rule{
+//		{Hosts: []string{"*.internal.example.com"}, ALPN: []string{"h2", "http/1.1"}, Action: snipolicy.Mitm},
+//		{Hosts: []string{"db.example.com"}, Action: snipolicy.Terminate, Interceptor: &tcpintercept.Interceptor{OnData: audit}},
+//		{Hosts: []string{"*.miner.example"}, Action: snipolicy.Block},
+//	}}
+//	proxy.OnRequest().HandleConnect(p)
+//
+// The tunnels are sniffed once accepted, the transparent flows as well,
+// since they are CONNECT requests to the proxy. The tunnels of the other
+// protocols are handled as with goproxy.ConnectSniff.
+package snipolicy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/tcpintercept"
+)
+
+// Action is the fate of a TLS tunnel.
+type Action int
+
+const (
+	// Tunnel relays the TLS session as it is.
+	Tunnel Action = iota
+	// Mitm intercepts the TLS session as HTTPS.
+	Mitm
+	// Terminate terminates the TLS session with the certificates of the
+	// proxy CA, and re-encrypts it to the server, the clear byte stream
+	// being handed to the Module of the Interceptor of the rule.
+	Terminate
+	// Block closes the tunnel.
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Mitm:
+		return "mitm"
+	case Terminate:
+		return "terminate"
+	case Block:
+		return "block"
+	}
+	return "tunnel"
+}
+
+// Rule is a rule of a policy.
+type Rule struct {
+	// Hosts are the server names matched, *. and a domain matching its
+	// subdomains. Empty, the rule matches all the server names. The
+	// clients sending no SNI are matched by the host of their CONNECT.
+	Hosts []string
+	// ALPN, if not empty, lists the protocols of which the client must
+	// offer one.
+	ALPN   []string
+	Action Action
+	// Interceptor terminates the sessions of Terminate, its Module, Raw by
+	// default, serving them once upgraded to TLS. The ALPN protocols of the
+	// client are offered to the server, unless set in its ServerTLSConfig.
+	Interceptor *tcpintercept.Interceptor
+}
+
+func matchHost(pattern, name string) bool {
+	pattern = strings.ToLower(pattern)
+	if parent, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(name, "."+parent)
+	}
+	return name == pattern
+}
+
+// Match returns whether r matches the server name, and the ALPN protocols
+// offered.
+func (r *Rule) Match(serverName string, alpn []string) bool {
+	if len(r.Hosts) > 0 {
+		name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+		matched := false
+		for _, h := range r.Hosts {
+			if matched = matchHost(h, name); matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.ALPN) == 0 {
+		return true
+	}
+	for _, want := range r.ALPN {
+		for _, proto := range alpn {
+			if proto == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Policy decides the fate of the TLS tunnels.
+type Policy struct {
+	// Rules are matched in order, the first matching deciding.
+	Rules []Rule
+	// Default is the action of the tunnels matching no rule, Tunnel by
+	// default.
+	Default Action
+	// OnBlock, when set, is called with the blocked tunnels, to log or
+	// count them.
+	OnBlock func(hello *goproxy.ClientHello, host string, ctx *goproxy.ProxyCtx)
+}
+
+// Decide returns the rule of the ClientHello of a tunnel to host, nil for
+// the Default.
+func (p *Policy) Decide(hello *goproxy.ClientHello, host string) *Rule {
+	name := hello.ServerName
+	if name == "" {
+		if name = host; strings.Contains(host, ":") {
+			name, _, _ = net.SplitHostPort(host)
+		}
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Match(name, hello.ALPN) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, sniffing all the tunnels.
+func (p *Policy) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	action := *goproxy.SniffConnect
+	var (
+		hello *goproxy.ClientHello
+		rule  *Rule
+	)
+	action.Sniff = func(proto goproxy.Protocol, prefix []byte, host string, ctx *goproxy.ProxyCtx) goproxy.ConnectActionLiteral {
+		if proto != goproxy.ProtocolTLS {
+			return goproxy.ConnectSniff
+		}
+		var ok bool
+		if hello, ok = goproxy.SniffClientHello(prefix); !ok {
+			ctx.Warnf("snipolicy: invalid ClientHello of the tunnel to %s", host)
+			hello = &goproxy.ClientHello{}
+		}
+		rule = p.Decide(hello, host)
+		decision := p.Default
+		if rule != nil {
+			decision = rule.Action
+		}
+		ctx.Logf("snipolicy: %s tunnel to %s, SNI %q, ALPN %q", decision, host, hello.ServerName, hello.ALPN)
+		switch decision {
+		case Mitm:
+			return goproxy.ConnectMitm
+		case Terminate:
+			return goproxy.ConnectHijack
+		case Block:
+			ctx.Warnf("snipolicy: blocked tunnel to %s, SNI %q", host, hello.ServerName)
+			if p.OnBlock != nil {
+				p.OnBlock(hello, host, ctx)
+			}
+			return goproxy.ConnectReject
+		}
+		return goproxy.ConnectAccept
+	}
+	action.Hijack = func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+		defer client.Close()
+		if err := terminate(rule, hello, client, host, ctx); err != nil {
+			ctx.Warnf("snipolicy: session to %s: %v", host, err)
+		}
+	}
+	return &action, host
+}
+
+// terminate serves the session of client to host with the Interceptor of
+// rule, nil for the Default.
+func terminate(rule *Rule, hello *goproxy.ClientHello, client net.Conn, host string, ctx *goproxy.ProxyCtx) error {
+	in := tcpintercept.Interceptor{}
+	if rule != nil && rule.Interceptor != nil {
+		in = *rule.Interceptor
+	}
+	module := in.Module
+	if module == nil {
+		module = tcpintercept.Raw
+	}
+	in.Module = tcpintercept.TLS(module)
+
+	server := &tls.Config{}
+	if in.ServerTLSConfig != nil {
+		server = in.ServerTLSConfig.Clone()
+	}
+	if server.ServerName == "" {
+		server.ServerName = hello.ServerName
+	}
+	if server.NextProtos == nil {
+		server.NextProtos = hello.ALPN
+	}
+	in.ServerTLSConfig = server
+
+	clientConfig := in.TLSConfig
+	if clientConfig == nil {
+		clientConfig = goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)
+	}
+	in.TLSConfig = func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		config, err := clientConfig(host, ctx)
+		if err != nil || len(hello.ALPN) == 0 {
+			return config, err
+		}
+		config = config.Clone()
+		config.NextProtos = hello.ALPN
+		return config, nil
+	}
+	return in.ServeConn(client, host, ctx)
+}
@@ -0,0 +1,140 @@
+package snipolicy_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/snipolicy"
+	"github.com/InsideOutSec/goproxy/ext/tcpintercept"
+)
+
+// serveEcho serves a line echo protocol over TLS, with the certificate of
+// the CA, telling it apart from those signed for the MITM.
+func serveEcho(t *testing.T) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{goproxy.GoproxyCa},
+		NextProtos:   []string{"echo/1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					io.WriteString(c, "echo: "+line)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, proxy, host, sni string) (*tls.Conn, error) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %v %v", host, resp, err)
+	}
+	c := tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: true, NextProtos: []string{"echo/1"}})
+	return c, c.Handshake()
+}
+
+func TestPolicy(t *testing.T) {
+	echo := serveEcho(t)
+	var blocked atomic.Int32
+	p := &snipolicy.Policy{
+		Rules: []snipolicy.Rule{
+			{Hosts: []string{"blocked.test"}, Action: snipolicy.Block},
+			{Hosts: []string{"*.term.test"}, ALPN: []string{"echo/1"}, Action: snipolicy.Terminate, Interceptor: &tcpintercept.Interceptor{
+				ServerTLSConfig: &tls.Config{InsecureSkipVerify: true},
+				Module: tcpintercept.ModuleFunc(func(s *tcpintercept.Session) error {
+					return s.RelayFunc(func(fromClient bool, p []byte) []byte {
+						if fromClient {
+							return bytes.ToUpper(p)
+						}
+						return p
+					})
+				}),
+			}},
+		},
+		OnBlock: func(hello *goproxy.ClientHello, host string, ctx *goproxy.ProxyCtx) { blocked.Add(1) },
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.SniffTimeout = 100 * time.Millisecond
+	proxy.OnRequest().HandleConnect(p)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+
+	if _, err := dial(t, addr, echo, "blocked.test"); err == nil || blocked.Load() != 1 {
+		t.Errorf("Expected the tunnel to be blocked, got %v", err)
+	}
+
+	c, err := dial(t, addr, echo, "plain.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert := c.ConnectionState().PeerCertificates[0]; !cert.IsCA {
+		t.Error("Expected the tunnel to reach the server")
+	}
+
+	c, err = dial(t, addr, echo, "db.term.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := c.ConnectionState()
+	if cert := state.PeerCertificates[0]; cert.IsCA {
+		t.Error("Expected the session to be terminated by the proxy")
+	}
+	if state.NegotiatedProtocol != "echo/1" {
+		t.Errorf("Expected the ALPN protocol of the client, got %q", state.NegotiatedProtocol)
+	}
+	io.WriteString(c, "ping\n")
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != "echo: PING\n" {
+		t.Errorf("Expected the stream to be handled, got %q: %v", line, err)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	p := &snipolicy.Policy{Rules: []snipolicy.Rule{
+		{Hosts: []string{"*.example.com"}, ALPN: []string{"h2", "http/1.1"}, Action: snipolicy.Mitm},
+		{Hosts: []string{"10.0.0.1"}, Action: snipolicy.Block},
+	}}
+	if r := p.Decide(&goproxy.ClientHello{ServerName: "WWW.example.com", ALPN: []string{"h2"}}, "10.0.0.2:443"); r == nil || r.Action != snipolicy.Mitm {
+		t.Errorf("Expected the HTTPS sessions to be MITM'd, got %v", r)
+	}
+	if r := p.Decide(&goproxy.ClientHello{ServerName: "db.example.com", ALPN: []string{"postgresql"}}, "10.0.0.2:443"); r != nil {
+		t.Errorf("Expected the other protocols to be tunneled, got %v", r)
+	}
+	if r := p.Decide(&goproxy.ClientHello{}, "10.0.0.1:443"); r == nil || r.Action != snipolicy.Block {
+		t.Errorf("Expected the host of the CONNECT without SNI, got %v", r)
+	}
+}
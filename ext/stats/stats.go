@@ -0,0 +1,378 @@
+// Package stats aggregates the traffic of the proxy into rolling top-N
+// tables, the top hosts by bytes, the top clients by requests and the
+// breakdown of the status codes, for the squid-style reports of the
+// operators:
+//
+//	s := stats.New()
+//	s.Install(proxy)
+//	admin.Handle("/stats", s.Handler())
+//
+// GET /stats reports the last Window in JSON, the n and window query
+// parameters restricting the entries of the tables and the period, such as
+// /stats?n=20&window=10m. The opaque tunnels are counted as requests of
+// status "tunnel", with the bytes of both directions.
+package stats
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Other is the key counting the hosts and the clients beyond MaxKeys.
+const Other = "(other)"
+
+// Table is a table of the statistics.
+type Table int
+
+const (
+	Hosts Table = iota
+	Clients
+)
+
+// Order is the order of the entries of a top-N table.
+type Order int
+
+const (
+	ByBytes Order = iota
+	ByRequests
+)
+
+// Entry is an entry of a table.
+type Entry struct {
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Report is the statistics of a period.
+type Report struct {
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Requests int64     `json:"requests"`
+	Bytes    int64     `json:"bytes"`
+	// TopHosts are the hosts by bytes, and TopClients the clients by
+	// requests.
+	TopHosts   []Entry `json:"top_hosts"`
+	TopClients []Entry `json:"top_clients"`
+	// Statuses are the requests by status code, "error" for those failed
+	// and "tunnel" for the opaque tunnels.
+	Statuses map[string]int64 `json:"statuses"`
+}
+
+type counter struct {
+	requests, bytes int64
+}
+
+type bucket struct {
+	start    time.Time
+	tables   [2]map[string]*counter
+	statuses map[string]int64
+	total    counter
+}
+
+// Stats aggregates the traffic over a rolling window.
+type Stats struct {
+	// Window is the period aggregated, 1 hour by default, in Buckets
+	// buckets, 12 by default, the oldest expiring as a whole.
+	Window  time.Duration
+	Buckets int
+	// N is the number of entries of the top-N tables of the reports, 10 by
+	// default.
+	N int
+	// MaxKeys bounds the hosts and the clients counted by bucket, 10000
+	// by default, the others being counted as Other.
+	MaxKeys int
+	// ClientKey returns the client of the requests, by default the name of
+	// their identity or their IP address, as for the opaque tunnels.
+	ClientKey func(ctx *goproxy.ProxyCtx) string
+	Clock     goproxy.Clock
+
+	mu      sync.Mutex
+	buckets []*bucket
+}
+
+// New returns the Stats of the defaults.
+func New() *Stats {
+	return &Stats{}
+}
+
+func (s *Stats) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock.Now()
+	}
+	return time.Now()
+}
+
+func (s *Stats) window() time.Duration {
+	if s.Window > 0 {
+		return s.Window
+	}
+	return time.Hour
+}
+
+func (s *Stats) bucketSize() time.Duration {
+	n := s.Buckets
+	if n <= 0 {
+		n = 12
+	}
+	return s.window() / time.Duration(n)
+}
+
+func (s *Stats) maxKeys() int {
+	if s.MaxKeys > 0 {
+		return s.MaxKeys
+	}
+	return 10000
+}
+
+// current returns the bucket of now, expiring those out of the window. It
+// must be called with the lock held.
+func (s *Stats) current(now time.Time) *bucket {
+	start := now.Truncate(s.bucketSize())
+	if len(s.buckets) > 0 && s.buckets[len(s.buckets)-1].start.Equal(start) {
+		return s.buckets[len(s.buckets)-1]
+	}
+	oldest := start.Add(-s.window()).Add(s.bucketSize())
+	i := 0
+	for i < len(s.buckets) && s.buckets[i].start.Before(oldest) {
+		i++
+	}
+	s.buckets = s.buckets[i:]
+	b := &bucket{
+		start:    start,
+		tables:   [2]map[string]*counter{make(map[string]*counter), make(map[string]*counter)},
+		statuses: make(map[string]int64),
+	}
+	s.buckets = append(s.buckets, b)
+	return b
+}
+
+func (s *Stats) count(table map[string]*counter, key string, requests, bytes int64) {
+	c := table[key]
+	if c == nil {
+		if len(table) >= s.maxKeys() {
+			key = Other
+		}
+		if c = table[key]; c == nil {
+			c = &counter{}
+			table[key] = c
+		}
+	}
+	c.requests += requests
+	c.bytes += bytes
+}
+
+// Add counts the requests of client to host, of status when requests isn't
+// zero, and their bytes.
+func (s *Stats) Add(client, host, status string, requests, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.current(s.now())
+	s.count(b.tables[Hosts], host, requests, bytes)
+	s.count(b.tables[Clients], client, requests, bytes)
+	if requests != 0 {
+		b.statuses[status] += requests
+	}
+	b.total.requests += requests
+	b.total.bytes += bytes
+}
+
+// Top returns the n first entries of table over the last period, by order.
+func (s *Stats) Top(table Table, order Order, n int, period time.Duration) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.top(table, order, n, s.since(period))
+}
+
+// since returns the start of the last period, within the window.
+func (s *Stats) since(period time.Duration) time.Time {
+	now := s.now()
+	if period <= 0 || period > s.window() {
+		period = s.window()
+	}
+	return now.Add(-period).Truncate(s.bucketSize())
+}
+
+// top must be called with the lock held.
+func (s *Stats) top(table Table, order Order, n int, since time.Time) []Entry {
+	sums := make(map[string]*Entry)
+	for _, b := range s.buckets {
+		if b.start.Before(since) {
+			continue
+		}
+		for key, c := range b.tables[table] {
+			e := sums[key]
+			if e == nil {
+				e = &Entry{Key: key}
+				sums[key] = e
+			}
+			e.Requests += c.requests
+			e.Bytes += c.bytes
+		}
+	}
+	entries := make([]Entry, 0, len(sums))
+	for _, e := range sums {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if order == ByRequests && a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Key < b.Key
+	})
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// Report returns the report of the last period, the whole window when
+// zero, with the n first entries of the tables, N when zero.
+func (s *Stats) Report(n int, period time.Duration) *Report {
+	if n <= 0 {
+		if n = s.N; n <= 0 {
+			n = 10
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since := s.since(period)
+	r := &Report{
+		Since:      since,
+		Until:      s.now(),
+		TopHosts:   s.top(Hosts, ByBytes, n, since),
+		TopClients: s.top(Clients, ByRequests, n, since),
+		Statuses:   make(map[string]int64),
+	}
+	for _, b := range s.buckets {
+		if b.start.Before(since) {
+			continue
+		}
+		r.Requests += b.total.requests
+		r.Bytes += b.total.bytes
+		for status, n := range b.statuses {
+			r.Statuses[status] += n
+		}
+	}
+	return r
+}
+
+func (s *Stats) clientKey(ctx *goproxy.ProxyCtx) string {
+	if s.ClientKey != nil {
+		return s.ClientKey(ctx)
+	}
+	if ctx.Identity != nil && ctx.Identity.Name != "" {
+		return ctx.Identity.Name
+	}
+	return remoteHost(ctx.Req.RemoteAddr)
+}
+
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// countingBody counts the bytes read from the response body, once closed.
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+	once sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() { b.done(b.n) })
+	return b.ReadCloser.Close()
+}
+
+// HandleResponse is a goproxy.FuncRespHandler, counting the exchange.
+func (s *Stats) HandleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if ctx.Req == nil {
+		return resp
+	}
+	client, host := s.clientKey(ctx), ctx.Req.URL.Hostname()
+	var sent int64
+	if ctx.Req.ContentLength > 0 {
+		sent = ctx.Req.ContentLength
+	}
+	if resp == nil {
+		s.Add(client, host, "error", 1, sent)
+		return resp
+	}
+	s.Add(client, host, strconv.Itoa(resp.StatusCode), 1, sent)
+	if resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64) { s.Add(client, host, "", 0, n) }}
+	}
+	return resp
+}
+
+// connClosed counts the opaque tunnels.
+func (s *Stats) connClosed(e *goproxy.Event) {
+	if e.Conn == nil || e.Conn.Kind != goproxy.ConnTunnel {
+		return
+	}
+	client := e.Conn.User
+	if client == "" {
+		client = remoteHost(e.Conn.RemoteAddr)
+	}
+	s.Add(client, remoteHost(e.Conn.Target), "tunnel", 1, e.Conn.BytesIn+e.Conn.BytesOut)
+}
+
+// Install counts the exchanges and the opaque tunnels of proxy.
+func (s *Stats) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnResponse().DoFunc(s.HandleResponse)
+	proxy.Subscribe(s.connClosed, goproxy.EventConnClosed)
+}
+
+// Handler returns the administration API of the reports. It shouldn't be
+// exposed to the proxy users.
+func (s *Stats) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		var n int
+		if v := q.Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		var period time.Duration
+		if v := q.Get("window"); v != "" {
+			var err error
+			if period, err = time.ParseDuration(v); err != nil || period <= 0 {
+				http.Error(w, "invalid window", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Report(n, period))
+	})
+}
@@ -0,0 +1,112 @@
+package stats_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/stats"
+)
+
+func TestProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+
+	s := stats.New()
+	proxy := goproxy.NewProxyHttpServer()
+	s.Install(proxy)
+	p := httptest.NewServer(proxy)
+	defer p.Close()
+	proxyURL, _ := url.Parse(p.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		resp, err := client.Get(upstream.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	admin := httptest.NewServer(s.Handler())
+	defer admin.Close()
+	resp, err := http.Get(admin.URL + "?n=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report stats.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 3 || report.Statuses["200"] != 2 || report.Statuses["404"] != 1 {
+		t.Errorf("Expected the requests by status, got %+v", report)
+	}
+	if len(report.TopHosts) != 1 || report.TopHosts[0].Key != "127.0.0.1" || report.TopHosts[0].Bytes < 10 {
+		t.Errorf("Expected the bytes of the host, got %+v", report.TopHosts)
+	}
+	if len(report.TopClients) != 1 || report.TopClients[0].Requests != 3 {
+		t.Errorf("Expected the requests of the client, got %+v", report.TopClients)
+	}
+
+	if resp, _ := http.Get(admin.URL + "?window=forever"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the invalid window to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestTop(t *testing.T) {
+	clock := goproxy.NewFakeClock(time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC))
+	s := &stats.Stats{Window: time.Hour, Buckets: 6, MaxKeys: 2, Clock: clock}
+	s.Add("alice", "a.example", "200", 1, 1000)
+	s.Add("bob", "b.example", "200", 3, 10)
+	clock.Advance(30 * time.Minute)
+	s.Add("bob", "c.example", "tunnel", 1, 500)
+	s.Add("carol", "d.example", "200", 1, 1)
+
+	var top []string
+	for _, e := range s.Top(stats.Hosts, stats.ByBytes, 3, 0) {
+		top = append(top, e.Key)
+	}
+	if expected := "a.example, c.example, b.example"; strings.Join(top, ", ") != expected {
+		t.Errorf("Expected the hosts %q, got %q", expected, strings.Join(top, ", "))
+	}
+	if e := s.Top(stats.Clients, stats.ByRequests, 1, 0); len(e) != 1 || e[0].Key != "bob" || e[0].Requests != 4 {
+		t.Errorf("Expected the top client, got %+v", e)
+	}
+	if e := s.Top(stats.Hosts, stats.ByBytes, 0, 10*time.Minute); len(e) != 2 || e[0].Key != "c.example" {
+		t.Errorf("Expected the hosts of the last period, got %+v", e)
+	}
+
+	clock.Advance(45 * time.Minute)
+	s.Add("dave", "e.example", "200", 1, 1)
+	r := s.Report(0, 0)
+	if r.Requests != 3 || r.Statuses["tunnel"] != 1 || r.Statuses["200"] != 2 {
+		t.Errorf("Expected the oldest buckets to expire, got %+v", r)
+	}
+	if e := s.Top(stats.Clients, stats.ByRequests, 0, 0); len(e) != 3 || e[2].Key != "dave" {
+		t.Errorf("Expected the clients of the window, got %+v", e)
+	}
+
+	s.Add("erin", "f.example", "200", 1, 1)
+	s.Add("frank", "g.example", "200", 1, 1)
+	var hosts []string
+	for _, e := range s.Top(stats.Hosts, stats.ByBytes, 0, 10*time.Minute) {
+		hosts = append(hosts, e.Key)
+	}
+	if expected := "(other), e.example, f.example"; strings.Join(hosts, ", ") != expected {
+		t.Errorf("Expected the hosts beyond MaxKeys to be counted as others, got %q", strings.Join(hosts, ", "))
+	}
+}
@@ -0,0 +1,140 @@
+// Package stub serves templated responses for selected requests, letting the
+// proxy act as a mock server for some endpoints while proxying the others.
+package stub
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// maxRequestBody limits the request body exposed to the templates.
+const maxRequestBody = 1 << 20
+
+// Stub is a response served for the requests matching Condition.
+// Body and the Header values are text/template templates, executed with
+// a RequestData value.
+type Stub struct {
+	Condition goproxy.ReqCondition
+	Status    int
+	Header    map[string]string
+	Body      string
+	// Latency delays the stubbed response.
+	Latency time.Duration
+
+	body   *template.Template
+	header map[string]*template.Template
+}
+
+// RequestData is the data available to the templates, for example
+// {{.Query.Get "id"}} or {{index .Header "X-User"}}.
+type RequestData struct {
+	Method string
+	URL    *url.URL
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   string
+}
+
+// Server answers the requests matching one of its stubs.
+type Server struct {
+	stubs []*Stub
+}
+
+// New compiles the templates of stubs and returns a Server trying them in
+// order. It implements goproxy.ReqHandler:
+//
+//	s, err := stub.New(stub.Stub{
+//		Condition: goproxy.UrlIs("api.example.com/v1/user"),
+//		Status:    http.StatusOK,
+//		Header:    map[string]string{"Content-Type": "application/json"},
+//		Body:      `{"id": "{{.Query.Get "id"}}"}`,
+//	})
+//	proxy.OnRequest().Do(s)
+func New(stubs ...Stub) (*Server, error) {
+	s := &Server{}
+	for i := range stubs {
+		st := stubs[i]
+		var err error
+		if st.body, err = template.New("body").Parse(st.Body); err != nil {
+			return nil, fmt.Errorf("stub %d: %w", i, err)
+		}
+		st.header = make(map[string]*template.Template, len(st.Header))
+		for name, value := range st.Header {
+			if st.header[name], err = template.New(name).Parse(value); err != nil {
+				return nil, fmt.Errorf("stub %d, header %s: %w", i, name, err)
+			}
+		}
+		if st.Status == 0 {
+			st.Status = http.StatusOK
+		}
+		s.stubs = append(s.stubs, &st)
+	}
+	return s, nil
+}
+
+// Handle implements goproxy.ReqHandler.
+func (s *Server) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	for _, st := range s.stubs {
+		if st.Condition != nil && !st.Condition.HandleReq(req, ctx) {
+			continue
+		}
+		resp, err := st.respond(req)
+		if err != nil {
+			ctx.Warnf("stub: cannot render response for %v: %v", req.URL, err)
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		if st.Latency > 0 {
+			timer := time.NewTimer(st.Latency)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+			}
+		}
+		return req, resp
+	}
+	return req, nil
+}
+
+func (st *Stub) respond(req *http.Request) (*http.Response, error) {
+	data := RequestData{
+		Method: req.Method,
+		URL:    req.URL,
+		Host:   req.URL.Host,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query(),
+		Header: req.Header,
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxRequestBody))
+		if err != nil {
+			return nil, err
+		}
+		data.Body = string(body)
+	}
+
+	var body bytes.Buffer
+	if err := st.body.Execute(&body, data); err != nil {
+		return nil, err
+	}
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, st.Status, body.String())
+	for name, tmpl := range st.header {
+		var value bytes.Buffer
+		if err := tmpl.Execute(&value, data); err != nil {
+			return nil, err
+		}
+		resp.Header.Set(name, value.String())
+	}
+	resp.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+	return resp, nil
+}
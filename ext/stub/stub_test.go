@@ -0,0 +1,66 @@
+package stub_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/stub"
+)
+
+func TestStub(t *testing.T) {
+	background := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "real")
+	}))
+	defer background.Close()
+
+	s, err := stub.New(stub.Stub{
+		Condition: goproxy.UrlHasPrefix("/mock"),
+		Status:    http.StatusCreated,
+		Header:    map[string]string{"Content-Type": "application/json", "X-Path": "{{.Path}}"},
+		Body:      `{"id":"{{.Query.Get "id"}}","body":"{{.Body}}"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(s)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Post(background.URL+"/mock/user?id=42", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/json" ||
+		resp.Header.Get("X-Path") != "/mock/user" {
+		t.Errorf("Unexpected response %s %v", resp.Status, resp.Header)
+	}
+	if string(body) != `{"id":"42","body":"hi"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+
+	resp, err = client.Get(background.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "real" {
+		t.Errorf("Expected proxied response, got %s", body)
+	}
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	if _, err := stub.New(stub.Stub{Body: "{{.Missing"}); err == nil {
+		t.Error("Expected template parsing error")
+	}
+}
@@ -0,0 +1,107 @@
+package tcpintercept
+
+import (
+	"strings"
+)
+
+// SMTP relays the SMTP sessions, upgraded by STARTTLS when the client and
+// the server agree to.
+var SMTP ModuleFunc = func(s *Session) error {
+	// The greeting of the server.
+	if _, err := smtpReply(s); err != nil {
+		return err
+	}
+	for {
+		line, err := s.ClientLine()
+		if err != nil {
+			return err
+		}
+		verb := ""
+		if fields := strings.Fields(line); len(fields) > 0 {
+			verb = strings.ToUpper(fields[0])
+		}
+		if verb != "EHLO" && verb != "HELO" && verb != "STARTTLS" {
+			// The session goes on in clear.
+			return s.Relay()
+		}
+		code, err := smtpReply(s)
+		if err != nil {
+			return err
+		}
+		if verb == "STARTTLS" {
+			if code == "220" {
+				if err := s.StartTLS(); err != nil {
+					return err
+				}
+			}
+			return s.Relay()
+		}
+	}
+}
+
+// smtpReply relays a reply of the server, whose lines but the last have a
+// dash after the code, and returns its code.
+func smtpReply(s *Session) (string, error) {
+	for {
+		line, err := s.ServerLine()
+		if err != nil {
+			return "", err
+		}
+		if len(line) < 4 || line[3] != '-' {
+			if len(line) < 3 {
+				return line, nil
+			}
+			return line[:3], nil
+		}
+	}
+}
+
+// IMAP relays the IMAP sessions, upgraded by STARTTLS when the client and
+// the server agree to.
+var IMAP ModuleFunc = func(s *Session) error {
+	// The greeting of the server.
+	if _, err := s.ServerLine(); err != nil {
+		return err
+	}
+	for {
+		line, err := s.ClientLine()
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return s.Relay()
+		}
+		tag, command := fields[0], strings.ToUpper(fields[1])
+		if command != "CAPABILITY" && command != "NOOP" && command != "STARTTLS" {
+			// The session goes on in clear.
+			return s.Relay()
+		}
+		status, err := imapResponse(s, tag)
+		if err != nil {
+			return err
+		}
+		if command == "STARTTLS" {
+			if status == "OK" {
+				if err := s.StartTLS(); err != nil {
+					return err
+				}
+			}
+			return s.Relay()
+		}
+	}
+}
+
+// imapResponse relays the responses of the server to the command tag, until
+// the tagged one, and returns its status.
+func imapResponse(s *Session, tag string) (string, error) {
+	for {
+		line, err := s.ServerLine()
+		if err != nil {
+			return "", err
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == tag {
+			return strings.ToUpper(fields[1]), nil
+		}
+	}
+}
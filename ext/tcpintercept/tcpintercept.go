@@ -0,0 +1,295 @@
+// Package tcpintercept intercepts the TCP protocols other than HTTP, with
+// pluggable protocol modules relaying the sessions between the clients and
+// the servers. The SMTP and IMAP modules follow the STARTTLS upgrade of
+// their sessions, MITM'd with the certificates of the proxy CA, so that the
+// mail traffic can be inspected:
+//
+//	in := &tcpintercept.Interceptor{
+//		Module: tcpintercept.SMTP,
+//		OnData: func(s *tcpintercept.Session, fromClient bool, p []byte) { ... },
+//	}
+//	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(":(25|587)$"))).HandleConnect(in)
+//
+// The clients must trust the proxy CA, as for the HTTPS MITM.
+package tcpintercept
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Module speaks a protocol in a session, relaying it between the client and
+// the server.
+type Module interface {
+	Serve(s *Session) error
+}
+
+// ModuleFunc is a Module function.
+type ModuleFunc func(s *Session) error
+
+// Serve implements Module.
+func (f ModuleFunc) Serve(s *Session) error {
+	return f(s)
+}
+
+// Raw relays the sessions as they are.
+var Raw ModuleFunc = func(s *Session) error {
+	return s.Relay()
+}
+
+// TLS returns a Module upgrading the sessions to TLS right away, for the
+// protocols over implicit TLS, before handing them to m.
+func TLS(m Module) Module {
+	return ModuleFunc(func(s *Session) error {
+		if err := s.StartTLS(); err != nil {
+			return err
+		}
+		return m.Serve(s)
+	})
+}
+
+// Interceptor intercepts the sessions of a protocol.
+type Interceptor struct {
+	// Module handles the sessions, Raw by default.
+	Module Module
+	// TLSConfig returns the TLS configuration of the sessions with the
+	// clients upgraded by StartTLS, goproxy.TLSConfigFromCA of the
+	// goproxy.GoproxyCa by default.
+	TLSConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)
+	// ServerTLSConfig is the TLS configuration of the sessions with the
+	// servers, whose ServerName is the host of the session by default.
+	ServerTLSConfig *tls.Config
+	// OnData, when set, is called with the data relayed, in clear once
+	// upgraded, concurrently for both directions. It must not retain p.
+	OnData func(s *Session, fromClient bool, p []byte)
+	// Dial opens the connections to the servers, with the dialer of the
+	// proxy by default.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+var defaultTLSConfig = goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)
+
+func (in *Interceptor) module() Module {
+	if in.Module != nil {
+		return in.Module
+	}
+	return Raw
+}
+
+func (in *Interceptor) dial(ctx *goproxy.ProxyCtx, addr string) (net.Conn, error) {
+	switch {
+	case in.Dial != nil:
+		return in.Dial("tcp", addr)
+	case ctx.Dialer != nil:
+		return ctx.Dialer(ctx.Req.Context(), "tcp", addr)
+	case ctx.Proxy.ConnectDial != nil:
+		return ctx.Proxy.ConnectDial("tcp", addr)
+	case ctx.Proxy.Tr != nil && ctx.Proxy.Tr.DialContext != nil:
+		return ctx.Proxy.Tr.DialContext(ctx.Req.Context(), "tcp", addr)
+	}
+	return net.Dial("tcp", addr)
+}
+
+// HandleConnect implements goproxy.HttpsHandler, intercepting the tunnels.
+func (in *Interceptor) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			defer client.Close()
+			if _, err := io.WriteString(client, "HTTP/1.0 200 OK\r\n\r\n"); err != nil {
+				return
+			}
+			if err := in.ServeConn(client, host, ctx); err != nil {
+				ctx.Warnf("tcpintercept: session to %s: %v", host, err)
+			}
+		},
+	}, host
+}
+
+// ServeConn intercepts the session of client to host, a host:port. ctx must
+// have the Proxy, and the Req giving the context of the dial.
+func (in *Interceptor) ServeConn(client net.Conn, host string, ctx *goproxy.ProxyCtx) error {
+	server, err := in.dial(ctx, host)
+	if err != nil {
+		return err
+	}
+	s := &Session{
+		Host:   host,
+		Ctx:    ctx,
+		Client: client,
+		Server: server,
+		in:     in,
+		client: bufio.NewReader(client),
+		server: bufio.NewReader(server),
+	}
+	defer s.close()
+	ctx.Logf("tcpintercept: intercepting session to %s", host)
+	return in.module().Serve(s)
+}
+
+// Session is an intercepted session between a client and a server.
+type Session struct {
+	// Host is the destination of the session, a host:port.
+	Host string
+	Ctx  *goproxy.ProxyCtx
+	// Client and Server are the connections of the session, replaced by
+	// their TLS connections once upgraded by StartTLS.
+	Client, Server net.Conn
+	// TLS reports whether the session was upgraded.
+	TLS bool
+
+	in             *Interceptor
+	client, server *bufio.Reader
+}
+
+func (s *Session) close() {
+	s.Client.Close()
+	s.Server.Close()
+}
+
+func (s *Session) observe(fromClient bool, p []byte) {
+	if s.in.OnData != nil && len(p) > 0 {
+		s.in.OnData(s, fromClient, p)
+	}
+}
+
+// ClientLine reads a line of the client, with its line ending, and
+// forwards it to the server.
+func (s *Session) ClientLine() (string, error) {
+	return s.forwardLine(s.client, s.Server, true)
+}
+
+// ServerLine reads a line of the server, with its line ending, and forwards
+// it to the client.
+func (s *Session) ServerLine() (string, error) {
+	return s.forwardLine(s.server, s.Client, false)
+}
+
+func (s *Session) forwardLine(r *bufio.Reader, w io.Writer, fromClient bool) (string, error) {
+	line, err := r.ReadString('\n')
+	if line != "" {
+		s.observe(fromClient, []byte(line))
+		if _, werr := io.WriteString(w, line); werr != nil {
+			return line, werr
+		}
+	}
+	return line, err
+}
+
+// bufferedConn reads a connection through the reader buffering it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// StartTLS upgrades the session to TLS, once the client and the server
+// agreed to: the server is verified with ServerTLSConfig, and the client is
+// presented a certificate of the interceptor.
+func (s *Session) StartTLS() error {
+	hostname, _, err := net.SplitHostPort(s.Host)
+	if err != nil {
+		hostname = s.Host
+	}
+	config := &tls.Config{}
+	if s.in.ServerTLSConfig != nil {
+		config = s.in.ServerTLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = hostname
+	}
+	server := tls.Client(&bufferedConn{Conn: s.Server, r: s.server}, config)
+	if err := server.Handshake(); err != nil {
+		return err
+	}
+
+	tlsConfig := s.in.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = defaultTLSConfig
+	}
+	clientConfig, err := tlsConfig(s.Host, s.Ctx)
+	if err != nil {
+		return err
+	}
+	client := tls.Server(&bufferedConn{Conn: s.Client, r: s.client}, clientConfig)
+	if err := client.Handshake(); err != nil {
+		return err
+	}
+
+	s.Client, s.Server = client, server
+	s.client, s.server = bufio.NewReader(client), bufio.NewReader(server)
+	s.TLS = true
+	s.Ctx.Logf("tcpintercept: session to %s upgraded to TLS", s.Host)
+	return nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Relay relays the rest of the session in both directions, until both
+// sides are done.
+func (s *Session) Relay() error {
+	return s.RelayFunc(nil)
+}
+
+// RelayFunc is Relay replacing the data relayed by the result of f, which
+// may buffer it until it can be forwarded. The data is observed by OnData
+// before f.
+func (s *Session) RelayFunc(f func(fromClient bool, p []byte) []byte) error {
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	relay := func(i int, r *bufio.Reader, w net.Conn, fromClient bool) {
+		defer wg.Done()
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				s.observe(fromClient, buf[:n])
+				out := buf[:n]
+				if f != nil {
+					out = f(fromClient, out)
+				}
+				if len(out) > 0 {
+					if _, werr := w.Write(out); werr != nil {
+						// Unblock the other direction.
+						errs[i] = werr
+						s.close()
+						return
+					}
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					errs[i] = err
+				}
+				if cw, ok := w.(closeWriter); ok {
+					_ = cw.CloseWrite()
+				} else {
+					_ = w.Close()
+				}
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go relay(0, s.client, s.Server, true)
+	relay(1, s.server, s.Client, false)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
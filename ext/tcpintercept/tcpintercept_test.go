@@ -0,0 +1,204 @@
+package tcpintercept_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/tcpintercept"
+)
+
+// script is a mail server answering the lines of its client, upgrading the
+// connection when answering starttls.
+type script struct {
+	greeting  string
+	replies   map[string]string
+	starttls  string
+	tlsConfig *tls.Config
+}
+
+func (sc *script) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.WriteString(c, sc.greeting)
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					reply, ok := sc.replies[strings.TrimSpace(line)]
+					if !ok {
+						return
+					}
+					io.WriteString(c, reply)
+					if strings.TrimSpace(line) == sc.starttls {
+						tc := tls.Server(c, sc.tlsConfig)
+						if tc.Handshake() != nil {
+							return
+						}
+						c, r = tc, bufio.NewReader(tc)
+					}
+				}
+			}(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+type recorder struct {
+	mu   sync.Mutex
+	data strings.Builder
+}
+
+func (r *recorder) OnData(s *tcpintercept.Session, fromClient bool, p []byte) {
+	if s.TLS && fromClient {
+		r.mu.Lock()
+		r.data.Write(p)
+		r.mu.Unlock()
+	}
+}
+
+func (r *recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.data.String()
+}
+
+// session opens a session to host through the interceptor, and runs the
+// steps of the client.
+func session(t *testing.T, in *tcpintercept.Interceptor, host string, steps func(w io.Writer, r *bufio.Reader)) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(in)
+	s := httptest.NewServer(proxy)
+	t.Cleanup(s.Close)
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	steps(conn, r)
+}
+
+func expect(t *testing.T, r *bufio.Reader, want string) {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil || line != want {
+		t.Fatalf("got %q %v, want %q", line, err, want)
+	}
+}
+
+// upgrade starts the TLS session of the client, checking that the
+// interceptor presents a certificate of the proxy CA.
+func upgrade(t *testing.T, conn net.Conn) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	ca, _ := x509.ParseCertificate(goproxy.GoproxyCa.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	tc := tls.Client(conn, &tls.Config{ServerName: "127.0.0.1", RootCAs: roots})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return tc, bufio.NewReader(tc)
+}
+
+func TestSMTP(t *testing.T) {
+	sc := &script{
+		greeting: "220 mx.example.com ESMTP\r\n",
+		replies: map[string]string{
+			"EHLO client":          "250-mx.example.com\r\n250 STARTTLS\r\n",
+			"STARTTLS":             "220 go ahead\r\n",
+			"MAIL FROM:<a@b.test>": "250 ok\r\n",
+		},
+		starttls:  "STARTTLS",
+		tlsConfig: serverTLS(t),
+	}
+	rec := &recorder{}
+	in := &tcpintercept.Interceptor{
+		Module:          tcpintercept.SMTP,
+		ServerTLSConfig: &tls.Config{InsecureSkipVerify: true},
+		OnData:          rec.OnData,
+	}
+	session(t, in, sc.serve(t), func(w io.Writer, r *bufio.Reader) {
+		expect(t, r, "220 mx.example.com ESMTP\r\n")
+		io.WriteString(w, "EHLO client\r\n")
+		expect(t, r, "250-mx.example.com\r\n")
+		expect(t, r, "250 STARTTLS\r\n")
+		io.WriteString(w, "STARTTLS\r\n")
+		expect(t, r, "220 go ahead\r\n")
+		tc, tr := upgrade(t, w.(net.Conn))
+		io.WriteString(tc, "MAIL FROM:<a@b.test>\r\n")
+		expect(t, tr, "250 ok\r\n")
+	})
+	if got := rec.String(); got != "MAIL FROM:<a@b.test>\r\n" {
+		t.Errorf("inspected %q", got)
+	}
+}
+
+func TestIMAP(t *testing.T) {
+	sc := &script{
+		greeting: "* OK IMAP4rev1 ready\r\n",
+		replies: map[string]string{
+			"a1 CAPABILITY":   "* CAPABILITY IMAP4rev1 STARTTLS\r\na1 OK done\r\n",
+			"a2 STARTTLS":     "a2 OK begin TLS\r\n",
+			"a3 LOGIN u pass": "a3 OK logged in\r\n",
+		},
+		starttls:  "a2 STARTTLS",
+		tlsConfig: serverTLS(t),
+	}
+	rec := &recorder{}
+	in := &tcpintercept.Interceptor{
+		Module:          tcpintercept.IMAP,
+		ServerTLSConfig: &tls.Config{InsecureSkipVerify: true},
+		OnData:          rec.OnData,
+	}
+	session(t, in, sc.serve(t), func(w io.Writer, r *bufio.Reader) {
+		expect(t, r, "* OK IMAP4rev1 ready\r\n")
+		io.WriteString(w, "a1 CAPABILITY\r\n")
+		expect(t, r, "* CAPABILITY IMAP4rev1 STARTTLS\r\n")
+		expect(t, r, "a1 OK done\r\n")
+		io.WriteString(w, "a2 STARTTLS\r\n")
+		expect(t, r, "a2 OK begin TLS\r\n")
+		tc, tr := upgrade(t, w.(net.Conn))
+		io.WriteString(tc, "a3 LOGIN u pass\r\n")
+		expect(t, tr, "a3 OK logged in\r\n")
+	})
+	if got := rec.String(); got != "a3 LOGIN u pass\r\n" {
+		t.Errorf("inspected %q", got)
+	}
+}
+
+// serverTLS returns the TLS configuration of a test server.
+func serverTLS(t *testing.T) *tls.Config {
+	s := httptest.NewTLSServer(nil)
+	t.Cleanup(s.Close)
+	return s.TLS.Clone()
+}
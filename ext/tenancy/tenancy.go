@@ -0,0 +1,272 @@
+// Package tenancy isolates the tenants of a proxy shared by several
+// customers. Each tenant, identified by the listener its clients connect
+// to, their credentials or their client certificate, has its own MITM CA,
+// certificate cache, cookie jars, quotas and logs:
+//
+//	tenants := tenancy.New(tenancy.ByIdentity("tenant"))
+//	tenants.Add(&tenancy.Tenant{ID: "acme", CA: &acmeCA, Quota: quota.New(limits...)})
+//	tenants.Add(&tenancy.Tenant{ID: "globex", CA: &globexCA, Logger: globexLog})
+//	tenants.Install(proxy)
+//	proxy.OnRequest().HandleConnect(tenants.MitmConnect())
+//
+// The requests of unknown tenants are rejected, unless there is a Default
+// tenant.
+package tenancy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/cookiejar"
+	"github.com/InsideOutSec/goproxy/ext/quota"
+)
+
+var errUnknownTenant = errors.New("tenancy: unknown tenant")
+
+// Resolver returns the tenant ID of a request, "" when unknown.
+type Resolver func(req *http.Request, ctx *goproxy.ProxyCtx) string
+
+// clientRequest returns the request of the client connection with the
+// proxy: the CONNECT request of the MITM'd requests.
+func clientRequest(req *http.Request, ctx *goproxy.ProxyCtx) *http.Request {
+	if connect := ctx.ConnectRequest(); connect != nil {
+		return connect
+	}
+	return req
+}
+
+// ByListener resolves the tenants by the address of the listener accepting
+// their connections, such as "10.0.0.1:8080".
+func ByListener(tenants map[string]string) Resolver {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+		addr, ok := clientRequest(req, ctx).Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok {
+			return ""
+		}
+		return tenants[addr.String()]
+	}
+}
+
+// ByIdentity resolves the tenants by the attribute of the authenticated
+// user, or by the user name when attribute is "".
+func ByIdentity(attribute string) Resolver {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+		if ctx.Identity == nil {
+			return ""
+		}
+		if attribute == "" {
+			return ctx.Identity.Name
+		}
+		return ctx.Identity.Attributes[attribute]
+	}
+}
+
+// ByClientCert resolves the tenants by the certificate presented by the
+// clients to a proxy listening with TLS. The tenant is the first
+// organization of the certificate, unless name is set.
+func ByClientCert(name func(cert *x509.Certificate) string) Resolver {
+	if name == nil {
+		name = func(cert *x509.Certificate) string {
+			if len(cert.Subject.Organization) == 0 {
+				return ""
+			}
+			return cert.Subject.Organization[0]
+		}
+	}
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) string {
+		state := clientRequest(req, ctx).TLS
+		if state == nil || len(state.PeerCertificates) == 0 {
+			return ""
+		}
+		return name(state.PeerCertificates[0])
+	}
+}
+
+// Tenant is the isolated state of a tenant.
+type Tenant struct {
+	ID string
+	// CA signs the MITM certificates of the tenant, goproxy.GoproxyCa by
+	// default.
+	CA *tls.Certificate
+	// Certs caches the MITM certificates of the tenant, in memory by
+	// default.
+	Certs goproxy.CertStorage
+	// Cookies, when set, manages the cookies of the tenant clients.
+	Cookies *cookiejar.Manager
+	// Quota, when set, caps the traffic of the tenant clients.
+	Quota *quota.Quota
+	// Logger, when set, receives the logs of the tenant requests instead of
+	// the proxy Logger.
+	Logger goproxy.Logger
+
+	once      sync.Once
+	tlsConfig func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error)
+}
+
+// TLSConfig returns the MITM TLS configuration of host, signed by the
+// tenant CA.
+func (t *Tenant) TLSConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	t.once.Do(func() {
+		ca := t.CA
+		if ca == nil {
+			ca = &goproxy.GoproxyCa
+		}
+		if t.Certs == nil {
+			t.Certs = &memoryStorage{certs: make(map[string]*tls.Certificate)}
+		}
+		t.tlsConfig = goproxy.TLSConfigFromCAWithStorage(ca, t.Certs)
+	})
+	return t.tlsConfig(host, ctx)
+}
+
+// memoryStorage is the default certificate cache of the tenants.
+type memoryStorage struct {
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+func (s *memoryStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cert, ok := s.certs[hostname]; ok {
+		return cert, nil
+	}
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	s.certs[hostname] = cert
+	return cert, nil
+}
+
+// Tenants resolves the tenant of every request.
+type Tenants struct {
+	Resolve Resolver
+	// Default is the tenant of the requests of unknown tenants, which are
+	// rejected when nil.
+	Default *Tenant
+
+	mu      sync.RWMutex
+	tenants map[string]*Tenant
+}
+
+// New returns empty Tenants resolved by resolve.
+func New(resolve Resolver) *Tenants {
+	return &Tenants{Resolve: resolve, tenants: make(map[string]*Tenant)}
+}
+
+// Add adds or replaces a tenant.
+func (ts *Tenants) Add(t *Tenant) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tenants[t.ID] = t
+}
+
+// Remove removes the tenant id.
+func (ts *Tenants) Remove(id string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.tenants, id)
+}
+
+// Tenant returns the tenant id, nil if unknown.
+func (ts *Tenants) Tenant(id string) *Tenant {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.tenants[id]
+}
+
+// Lookup returns the tenant of a request, the Default one if it can't be
+// resolved.
+func (ts *Tenants) Lookup(req *http.Request, ctx *goproxy.ProxyCtx) *Tenant {
+	if t := ts.Tenant(ts.Resolve(req, ctx)); t != nil {
+		return t
+	}
+	return ts.Default
+}
+
+// HandleConnect rejects the tunnels of unknown tenants, and leaves the
+// others to the next handlers with the tenant logger.
+func (ts *Tenants) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	t := ts.Lookup(ctx.Req, ctx)
+	if t == nil {
+		ctx.Warnf("Rejecting CONNECT %s of an unknown tenant", host)
+		return goproxy.RejectConnect, host
+	}
+	if t.Logger != nil {
+		ctx.Logger = t.Logger
+	}
+	return nil, host
+}
+
+// TLSConfig returns the MITM TLS configuration of host, signed by the CA of
+// the tenant of ctx.
+func (ts *Tenants) TLSConfig(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	t := ts.Lookup(ctx.Req, ctx)
+	if t == nil {
+		return nil, errUnknownTenant
+	}
+	return t.TLSConfig(host, ctx)
+}
+
+// MitmConnect MITMs the tunnels with the CA of their tenant.
+func (ts *Tenants) MitmConnect() goproxy.FuncHttpsHandler {
+	return func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: ts.TLSConfig}, host
+	}
+}
+
+// OnRequest rejects the requests of unknown tenants, and applies the quota
+// and cookies of the tenant to the others.
+func (ts *Tenants) OnRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	t := ts.Lookup(req, ctx)
+	if t == nil {
+		ctx.Warnf("Rejecting %s of an unknown tenant", req.URL)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Unknown tenant\n")
+	}
+	if t.Logger != nil {
+		ctx.Logger = t.Logger
+	}
+	if t.Quota != nil {
+		var resp *http.Response
+		if req, resp = t.Quota.OnRequest(req, ctx); resp != nil {
+			return req, resp
+		}
+	}
+	if t.Cookies != nil {
+		return t.Cookies.OnRequest(req, ctx)
+	}
+	return req, nil
+}
+
+// OnResponse applies the cookies and quota of the tenant to the responses.
+func (ts *Tenants) OnResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil {
+		return resp
+	}
+	t := ts.Lookup(ctx.Req, ctx)
+	if t == nil {
+		return resp
+	}
+	if t.Cookies != nil {
+		resp = t.Cookies.OnResponse(resp, ctx)
+	}
+	if t.Quota != nil {
+		resp = t.Quota.OnResponse(resp, ctx)
+	}
+	return resp
+}
+
+// Install isolates the tenants of proxy. It must be called after the
+// authentication handlers, so that the users are known, and before the
+// MITM decision.
+func (ts *Tenants) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnectFunc(ts.HandleConnect)
+	proxy.OnRequest().DoFunc(ts.OnRequest)
+	proxy.OnResponse().DoFunc(ts.OnResponse)
+}
@@ -0,0 +1,134 @@
+package tenancy_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/tenancy"
+)
+
+func newCA(t *testing.T, name string) *tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Printf(format string, v ...any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log.New(&b.Buffer, "", 0).Printf(format, v...)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.Buffer.String()
+}
+
+func TestTenants(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Verbose = true
+	proxy.Logger = log.New(io.Discard, "", 0)
+	acme := httptest.NewServer(proxy)
+	defer acme.Close()
+	globex := httptest.NewServer(proxy)
+	defer globex.Close()
+	unknown := httptest.NewServer(proxy)
+	defer unknown.Close()
+
+	tenants := tenancy.New(tenancy.ByListener(map[string]string{
+		acme.Listener.Addr().String():   "acme",
+		globex.Listener.Addr().String(): "globex",
+	}))
+	acmeCA, globexCA := newCA(t, "Acme CA"), newCA(t, "Globex CA")
+	acmeLog, globexLog := &syncBuffer{}, &syncBuffer{}
+	tenants.Add(&tenancy.Tenant{ID: "acme", CA: acmeCA, Logger: acmeLog})
+	tenants.Add(&tenancy.Tenant{ID: "globex", CA: globexCA, Logger: globexLog})
+	tenants.Install(proxy)
+	proxy.OnRequest().HandleConnect(tenants.MitmConnect())
+
+	client := func(server *httptest.Server, ca *tls.Certificate) *http.Client {
+		proxyURL, _ := url.Parse(server.URL)
+		roots := x509.NewCertPool()
+		if ca != nil {
+			roots.AddCert(ca.Leaf)
+		}
+		return &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	for _, tt := range []struct {
+		server *httptest.Server
+		ca     *tls.Certificate
+		log    *syncBuffer
+	}{
+		{acme, acmeCA, acmeLog},
+		{globex, globexCA, globexLog},
+	} {
+		resp, err := client(tt.server, tt.ca).Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.TLS.PeerCertificates[0].Issuer.CommonName != tt.ca.Leaf.Subject.CommonName {
+			t.Errorf("Expected a certificate of %s, got %s", tt.ca.Leaf.Subject.CommonName, resp.TLS.PeerCertificates[0].Issuer)
+		}
+	}
+	if acmeLog.String() == "" || globexLog.String() == "" {
+		t.Error("Expected the tenants to have their logs")
+	}
+
+	if _, err := client(unknown, acmeCA).Get(upstream.URL); err == nil {
+		t.Error("Expected the tunnels of unknown tenants to be rejected")
+	}
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+	resp, err := client(unknown, nil).Get(plain.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the requests of unknown tenants to be rejected, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,377 @@
+package threatintel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Format is the format of a feed.
+type Format int
+
+const (
+	// FormatPlain is a list of indicators, one per line. The domains, IP
+	// addresses, CIDR ranges and URLs are told apart by their syntax, the
+	// hosts files and the ||domain^ rules of the ad blockers being
+	// accepted. Everything after a # is a comment.
+	FormatPlain Format = iota
+	// FormatMISP is the JSON export of MISP events or attributes, whose
+	// attributes of the domain, hostname, ip-src, ip-dst, domain|ip and url
+	// types are the indicators, but those not flagged to_ids.
+	FormatMISP
+	// FormatSTIX is a STIX 2.1 bundle, whose indicators of the STIX pattern
+	// type are those comparing the values of a domain-name, an ipv4-addr,
+	// an ipv6-addr or a url, ORed. The revoked and expired indicators are
+	// ignored.
+	FormatSTIX
+	// FormatTAXII is the objects of a TAXII 2.1 collection, the URL of the
+	// feed being the objects endpoint of the collection, whose STIX
+	// indicators are read as for FormatSTIX, following the pages.
+	FormatTAXII
+)
+
+// ParseIndicator returns the indicator of value, a domain, an IP address,
+// a CIDR range or a URL, normalized.
+func ParseIndicator(value string) (Indicator, bool) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "||") {
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "||"), "^")
+	}
+	if value == "" {
+		return Indicator{}, false
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return Indicator{Type: TypeIP, Value: addr.Unmap().String()}, true
+	}
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		prefix = prefix.Masked()
+		if prefix.IsSingleIP() {
+			return Indicator{Type: TypeIP, Value: prefix.Addr().Unmap().String()}, true
+		}
+		return Indicator{Type: TypeCIDR, Value: prefix.String()}, true
+	}
+	if strings.Contains(value, "/") || strings.Contains(value, "?") {
+		key, ok := urlKey(value)
+		if !ok {
+			return Indicator{}, false
+		}
+		return Indicator{Type: TypeURL, Value: key}, true
+	}
+	domain := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(value, "*."), "."))
+	if domain == "" || strings.ContainsAny(domain, " :@*") {
+		return Indicator{}, false
+	}
+	return Indicator{Type: TypeDomain, Value: domain}, true
+}
+
+// urlKey returns the key of the URL raw, without its scheme, nor its
+// fragment.
+func urlKey(raw string) (string, bool) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	key := host + path
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key, true
+}
+
+// ParsePlain parses the indicators of r, of FormatPlain.
+func ParsePlain(r io.Reader) ([]Indicator, error) {
+	var indicators []Indicator
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "!") {
+			continue
+		}
+		value := fields[0]
+		if len(fields) > 1 && (value == "0.0.0.0" || value == "127.0.0.1" || value == "::") {
+			// A hosts file.
+			value = fields[1]
+		}
+		if ind, ok := ParseIndicator(value); ok {
+			indicators = append(indicators, ind)
+		}
+	}
+	return indicators, scanner.Err()
+}
+
+type mispAttribute struct {
+	Type    string          `json:"type"`
+	Value   string          `json:"value"`
+	Comment string          `json:"comment"`
+	ToIDS   json.RawMessage `json:"to_ids"`
+}
+
+type mispEvent struct {
+	Info      string          `json:"info"`
+	Attribute []mispAttribute `json:"Attribute"`
+	Object    []struct {
+		Attribute []mispAttribute `json:"Attribute"`
+	} `json:"Object"`
+}
+
+// ParseMISP parses the indicators of r, of FormatMISP.
+func ParseMISP(r io.Reader) ([]Indicator, error) {
+	var export struct {
+		Response  json.RawMessage `json:"response"`
+		Event     *mispEvent      `json:"Event"`
+		Attribute []mispAttribute `json:"Attribute"`
+	}
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("threatintel: invalid MISP export: %w", err)
+	}
+	var events []mispEvent
+	if export.Event != nil {
+		events = append(events, *export.Event)
+	}
+	attributes := export.Attribute
+	if len(export.Response) > 0 {
+		var list []struct {
+			Event mispEvent `json:"Event"`
+		}
+		var search struct {
+			Attribute []mispAttribute `json:"Attribute"`
+		}
+		if err := json.Unmarshal(export.Response, &list); err == nil {
+			for _, e := range list {
+				events = append(events, e.Event)
+			}
+		} else if err := json.Unmarshal(export.Response, &search); err == nil {
+			attributes = append(attributes, search.Attribute...)
+		} else {
+			return nil, fmt.Errorf("threatintel: invalid MISP response: %w", err)
+		}
+	}
+
+	var indicators []Indicator
+	add := func(a mispAttribute, info string) {
+		if ids := strings.TrimSpace(string(a.ToIDS)); ids == "false" || ids == `"0"` || ids == "0" {
+			return
+		}
+		description := a.Comment
+		if description == "" {
+			description = info
+		}
+		var values []string
+		switch a.Type {
+		case "domain", "hostname", "ip-src", "ip-dst", "url", "link", "uri":
+			values = []string{a.Value}
+		case "domain|ip":
+			values = strings.Split(a.Value, "|")
+		case "ip-src|port", "ip-dst|port", "hostname|port":
+			host, _, _ := strings.Cut(a.Value, "|")
+			values = []string{host}
+		}
+		for _, v := range values {
+			if ind, ok := ParseIndicator(v); ok {
+				ind.Description = description
+				indicators = append(indicators, ind)
+			}
+		}
+	}
+	for _, a := range attributes {
+		add(a, "")
+	}
+	for _, e := range events {
+		for _, a := range e.Attribute {
+			add(a, e.Info)
+		}
+		for _, o := range e.Object {
+			for _, a := range o.Attribute {
+				add(a, e.Info)
+			}
+		}
+	}
+	return indicators, nil
+}
+
+type stixObject struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Pattern     string `json:"pattern"`
+	PatternType string `json:"pattern_type"`
+	Revoked     bool   `json:"revoked"`
+	ValidUntil  string `json:"valid_until"`
+}
+
+// stixComparison matches the comparisons of the values of the STIX
+// patterns.
+var stixComparison = regexp.MustCompile(`(domain-name|ipv4-addr|ipv6-addr|url):value\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// stixIndicators returns the indicators of objects, at now.
+func stixIndicators(objects []stixObject, now time.Time) []Indicator {
+	var indicators []Indicator
+	for _, o := range objects {
+		if o.Type != "indicator" || o.Revoked || (o.PatternType != "" && o.PatternType != "stix") {
+			continue
+		}
+		if until, err := time.Parse(time.RFC3339, o.ValidUntil); err == nil && !now.Before(until) {
+			continue
+		}
+		// The conjunctions would match more than they tell.
+		if strings.Contains(o.Pattern, " AND ") || strings.Contains(o.Pattern, " FOLLOWEDBY ") {
+			continue
+		}
+		description := o.Name
+		if description == "" {
+			description = o.Description
+		}
+		for _, m := range stixComparison.FindAllStringSubmatch(o.Pattern, -1) {
+			value := strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(m[2])
+			if ind, ok := ParseIndicator(value); ok {
+				ind.Description = description
+				indicators = append(indicators, ind)
+			}
+		}
+	}
+	return indicators
+}
+
+// ParseSTIX parses the indicators of r, of FormatSTIX.
+func ParseSTIX(r io.Reader) ([]Indicator, error) {
+	var bundle struct {
+		Objects []stixObject `json:"objects"`
+	}
+	if err := json.NewDecoder(r).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("threatintel: invalid STIX bundle: %w", err)
+	}
+	return stixIndicators(bundle.Objects, time.Now()), nil
+}
+
+// maxFeed bounds the size of the feeds, and of the pages of the TAXII
+// collections.
+const maxFeed = 64 << 20
+
+// errNotModified is returned by get when the feed didn't change since the
+// fetch of its tag.
+var errNotModified = errors.New("threatintel: not modified")
+
+func (f *Feed) get(ctx context.Context, u, accept, tag string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range f.Header {
+		req.Header[k] = v
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if tag != "" {
+		req.Header.Set("If-None-Match", tag)
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, tag, errNotModified
+	default:
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("threatintel: feed %s: %s", f.Name, resp.Status)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, maxFeed), resp.Body}, resp.Header.Get("ETag"), nil
+}
+
+// fetch returns the indicators of the feed, and its tag, errNotModified
+// when it didn't change since the fetch of tag.
+func (f *Feed) fetch(ctx context.Context, tag string) ([]Indicator, string, error) {
+	if f.Format == FormatTAXII {
+		indicators, err := f.fetchTAXII(ctx)
+		return indicators, "", err
+	}
+	body, tag, err := f.get(ctx, f.URL, "", tag)
+	if err != nil {
+		return nil, tag, err
+	}
+	defer body.Close()
+	var indicators []Indicator
+	switch f.Format {
+	case FormatMISP:
+		indicators, err = ParseMISP(body)
+	case FormatSTIX:
+		indicators, err = ParseSTIX(body)
+	default:
+		indicators, err = ParsePlain(body)
+	}
+	return indicators, tag, err
+}
+
+// maxPages bounds the pages of the TAXII collections.
+const maxPages = 1000
+
+func (f *Feed) fetchTAXII(ctx context.Context) ([]Indicator, error) {
+	var indicators []Indicator
+	next := ""
+	for page := 0; page < maxPages; page++ {
+		u, err := url.Parse(f.URL)
+		if err != nil {
+			return nil, err
+		}
+		if next != "" {
+			q := u.Query()
+			q.Set("next", next)
+			u.RawQuery = q.Encode()
+		}
+		body, _, err := f.get(ctx, u.String(), "application/taxii+json;version=2.1", "")
+		if err != nil {
+			return nil, err
+		}
+		var envelope struct {
+			More    bool         `json:"more"`
+			Next    string       `json:"next"`
+			Objects []stixObject `json:"objects"`
+		}
+		err = json.NewDecoder(body).Decode(&envelope)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("threatintel: invalid TAXII envelope: %w", err)
+		}
+		indicators = append(indicators, stixIndicators(envelope.Objects, time.Now())...)
+		if !envelope.More || envelope.Next == "" {
+			return indicators, nil
+		}
+		next = envelope.Next
+	}
+	return nil, fmt.Errorf("threatintel: feed %s: more than %d pages", f.Name, maxPages)
+}
@@ -0,0 +1,371 @@
+// Package threatintel matches the traffic against the indicators of
+// compromise of threat intelligence feeds, the domains, IP addresses and
+// URLs known to be malicious:
+//
+//	intel := threatintel.New(
+//		&threatintel.Feed{Name: "urlhaus", URL: "https://urlhaus.abuse.ch/downloads/text/"},
+//		&threatintel.Feed{Name: "misp", URL: mispExport, Format: threatintel.FormatMISP, Action: threatintel.Alert},
+//	)
+//	go intel.Run(ctx)
+//	intel.Install(proxy)
+//
+// The feeds are refreshed every Interval, a feed failing keeping its
+// previous indicators, and swapped atomically into a Set of hash maps,
+// looked up in constant time for every request. The domains match their
+// subdomains, the CIDR ranges their addresses, and the URLs, whatever their
+// scheme, the same URL or, when they have no query, the URLs with a query.
+//
+// The requests matching the indicators of a feed with the Block action are
+// rejected, those of the Alert action published as
+// goproxy.EventAnomalyDetected, their Err being the Hit.
+package threatintel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Type is the type of an indicator.
+type Type string
+
+const (
+	TypeDomain Type = "domain"
+	TypeIP     Type = "ip"
+	TypeCIDR   Type = "cidr"
+	TypeURL    Type = "url"
+)
+
+// Action is the action of the requests matching the indicators of a feed.
+type Action int
+
+const (
+	// Block rejects the requests.
+	Block Action = iota
+	// Alert publishes the requests as goproxy.EventAnomalyDetected, and
+	// lets them through.
+	Alert
+)
+
+func (a Action) String() string {
+	if a == Alert {
+		return "alert"
+	}
+	return "block"
+}
+
+// Indicator is an indicator of compromise.
+type Indicator struct {
+	Type Type
+	// Value is the domain, the IP address, the CIDR range, or the URL
+	// without its scheme.
+	Value string
+	// Feed is the name of the feed of the indicator, and Action its
+	// action.
+	Feed        string
+	Action      Action
+	Description string
+}
+
+// Hit is a request matching an indicator.
+type Hit struct {
+	Indicator *Indicator
+	// Target is the host or the URL matching.
+	Target string
+}
+
+func (h *Hit) Error() string {
+	msg := "threatintel: " + h.Target + " matches the " + string(h.Indicator.Type) + " " + h.Indicator.Value + " of feed " + h.Indicator.Feed
+	if h.Indicator.Description != "" {
+		msg += " (" + h.Indicator.Description + ")"
+	}
+	return msg
+}
+
+// Set is a set of indicators, looked up in constant time.
+type Set struct {
+	domains  map[string]*Indicator
+	ips      map[netip.Addr]*Indicator
+	prefixes map[netip.Prefix]*Indicator
+	// bits are the lengths of the prefixes, longest first.
+	bits []int
+	urls map[string]*Indicator
+	len  int
+}
+
+// NewSet returns the Set of indicators. For the duplicates, the indicators
+// with the Block action win.
+func NewSet(indicators []Indicator) *Set {
+	s := &Set{
+		domains:  make(map[string]*Indicator),
+		ips:      make(map[netip.Addr]*Indicator),
+		prefixes: make(map[netip.Prefix]*Indicator),
+		urls:     make(map[string]*Indicator),
+	}
+	bits := make(map[int]bool)
+	for i := range indicators {
+		ind := &indicators[i]
+		keep := func(current *Indicator) bool {
+			return current == nil || (current.Action != Block && ind.Action == Block)
+		}
+		switch ind.Type {
+		case TypeDomain:
+			if keep(s.domains[ind.Value]) {
+				s.domains[ind.Value] = ind
+			}
+		case TypeIP:
+			addr, err := netip.ParseAddr(ind.Value)
+			if err == nil && keep(s.ips[addr]) {
+				s.ips[addr] = ind
+			}
+		case TypeCIDR:
+			prefix, err := netip.ParsePrefix(ind.Value)
+			if err == nil && keep(s.prefixes[prefix]) {
+				s.prefixes[prefix] = ind
+				bits[prefix.Bits()] = true
+			}
+		case TypeURL:
+			if keep(s.urls[ind.Value]) {
+				s.urls[ind.Value] = ind
+			}
+		}
+	}
+	for b := range bits {
+		s.bits = append(s.bits, b)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(s.bits)))
+	s.len = len(s.domains) + len(s.ips) + len(s.prefixes) + len(s.urls)
+	return s
+}
+
+// Len returns the number of indicators of the set.
+func (s *Set) Len() int {
+	return s.len
+}
+
+// LookupIP returns the indicator matching addr, nil if none.
+func (s *Set) LookupIP(addr netip.Addr) *Indicator {
+	addr = addr.Unmap()
+	if ind := s.ips[addr]; ind != nil {
+		return ind
+	}
+	for _, b := range s.bits {
+		if b > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(b)
+		if err != nil {
+			continue
+		}
+		if ind := s.prefixes[prefix]; ind != nil {
+			return ind
+		}
+	}
+	return nil
+}
+
+// LookupHost returns the indicator matching host, an IP address or a domain
+// matched with its parent domains, nil if none.
+func (s *Set) LookupHost(host string) *Indicator {
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return s.LookupIP(addr)
+	}
+	for {
+		if ind := s.domains[host]; ind != nil {
+			return ind
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return nil
+		}
+		host = host[i+1:]
+	}
+}
+
+// LookupURL returns the indicator matching u, or its host, nil if none.
+func (s *Set) LookupURL(u *url.URL) *Indicator {
+	if len(s.urls) > 0 {
+		if key, ok := urlKey(u.String()); ok {
+			if ind := s.urls[key]; ind != nil {
+				return ind
+			}
+			if base, _, ok := strings.Cut(key, "?"); ok {
+				if ind := s.urls[base]; ind != nil {
+					return ind
+				}
+			}
+		}
+	}
+	return s.LookupHost(u.Hostname())
+}
+
+// Feed is a threat intelligence feed.
+type Feed struct {
+	Name string
+	// URL is the URL of the feed, fetched with a conditional request on its
+	// ETag.
+	URL    string
+	Format Format
+	Action Action
+	// Header is added to the requests, for example the Authorization of
+	// the MISP or TAXII servers.
+	Header http.Header
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Intel matches the requests it handles against the indicators of feeds.
+type Intel struct {
+	Feeds []*Feed
+	// Interval is the delay between the refreshes of the feeds, 1 hour by
+	// default.
+	Interval time.Duration
+	// OnError, when set, is called with the errors of the refreshes.
+	OnError func(error)
+
+	set     atomic.Pointer[Set]
+	mu      sync.Mutex
+	updates map[string][]Indicator
+	tags    map[string]string
+}
+
+// New returns an Intel of feeds.
+func New(feeds ...*Feed) *Intel {
+	return &Intel{Feeds: feeds}
+}
+
+// Set returns the indicators in place.
+func (in *Intel) Set() *Set {
+	if s := in.set.Load(); s != nil {
+		return s
+	}
+	return NewSet(nil)
+}
+
+// Update replaces the indicators of the feed called name, for example of
+// a local list, by indicators.
+func (in *Intel) Update(name string, action Action, indicators []Indicator) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.update(name, action, indicators)
+}
+
+func (in *Intel) update(name string, action Action, indicators []Indicator) {
+	if in.updates == nil {
+		in.updates = make(map[string][]Indicator)
+	}
+	for i := range indicators {
+		indicators[i].Feed, indicators[i].Action = name, action
+	}
+	in.updates[name] = indicators
+	var all []Indicator
+	names := make([]string, 0, len(in.updates))
+	for name := range in.updates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		all = append(all, in.updates[name]...)
+	}
+	in.set.Store(NewSet(all))
+}
+
+// Refresh fetches the feeds. The feeds failing keep their previous
+// indicators, their errors being returned.
+func (in *Intel) Refresh(ctx context.Context) error {
+	var errs []error
+	for _, f := range in.Feeds {
+		in.mu.Lock()
+		tag := in.tags[f.URL]
+		in.mu.Unlock()
+		indicators, tag, err := f.fetch(ctx, tag)
+		if errors.Is(err, errNotModified) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		in.mu.Lock()
+		if in.tags == nil {
+			in.tags = make(map[string]string)
+		}
+		in.tags[f.URL] = tag
+		in.update(f.Name, f.Action, indicators)
+		in.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// Run refreshes the feeds until ctx is done.
+func (in *Intel) Run(ctx context.Context) {
+	interval := in.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for {
+		start := time.Now()
+		if err := in.Refresh(ctx); err != nil && ctx.Err() == nil && in.OnError != nil {
+			in.OnError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval - time.Since(start)):
+		}
+	}
+}
+
+// hit returns the response of the request of ctx matching ind, nil when it
+// is let through.
+func hit(ctx *goproxy.ProxyCtx, req *http.Request, ind *Indicator, target string) *http.Response {
+	h := &Hit{Indicator: ind, Target: target}
+	if ind.Action == Alert {
+		ctx.Warnf("%v", h)
+		ctx.Publish(&goproxy.Event{Type: goproxy.EventAnomalyDetected, Req: req, Rule: "threatintel", Err: h})
+		return nil
+	}
+	ctx.Warnf("%v, blocked", h)
+	ctx.Error = &goproxy.ErrBlockedByRule{RuleID: "threatintel:" + ind.Feed, Reason: h.Error()}
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked: known malicious destination")
+}
+
+// Handle implements goproxy.ReqHandler, matching the URL of req.
+func (in *Intel) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if ind := in.Set().LookupURL(req.URL); ind != nil {
+		return req, hit(ctx, req, ind, req.URL.String())
+	}
+	return req, nil
+}
+
+// HandleConnect implements goproxy.HttpsHandler, matching the host of the
+// tunnels, whose requests are matched as well when MITM'd.
+func (in *Intel) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	hostname := host
+	if u, err := url.Parse("//" + host); err == nil {
+		hostname = u.Hostname()
+	}
+	if ind := in.Set().LookupHost(hostname); ind != nil {
+		if resp := hit(ctx, ctx.Req, ind, host); resp != nil {
+			ctx.Resp = resp
+			return goproxy.RejectConnect, host
+		}
+	}
+	return nil, host
+}
+
+// Install matches the requests and the tunnels of proxy.
+func (in *Intel) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(in)
+	proxy.OnRequest().HandleConnect(in)
+}
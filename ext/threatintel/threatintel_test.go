@@ -0,0 +1,182 @@
+package threatintel_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/threatintel"
+)
+
+const plain = `# Malicious hosts
+evil.example.com
+0.0.0.0 tracker.example.net # hosts file
+||ads.example.org^
+198.51.100.7
+203.0.113.0/24
+http://files.example.com/payload.exe
+`
+
+const misp = `{"response": [{"Event": {"info": "Phishing campaign", "Attribute": [
+	{"type": "domain", "value": "phish.example.com", "to_ids": true},
+	{"type": "ip-dst|port", "value": "192.0.2.1|8080", "to_ids": true},
+	{"type": "domain", "value": "benign.example.com", "to_ids": false},
+	{"type": "email-src", "value": "attacker@example.com", "to_ids": true}
+], "Object": [{"Attribute": [{"type": "url", "value": "https://phish.example.com/login?id=1", "to_ids": true, "comment": "Login page"}]}]}}]}`
+
+const stix = `{"type": "bundle", "objects": [
+	{"type": "indicator", "name": "C2", "pattern_type": "stix", "pattern": "[domain-name:value = 'c2.example.com'] OR [ipv4-addr:value = '192.0.2.0/28']"},
+	{"type": "indicator", "name": "Revoked", "revoked": true, "pattern": "[domain-name:value = 'revoked.example.com']"},
+	{"type": "indicator", "name": "Expired", "valid_until": "2020-01-01T00:00:00Z", "pattern": "[domain-name:value = 'expired.example.com']"},
+	{"type": "indicator", "name": "Conjunction", "pattern": "[domain-name:value = 'cdn.example.com' AND url:value = 'x']"},
+	{"type": "domain-name", "value": "observed.example.com"}
+]}`
+
+func values(indicators []threatintel.Indicator) string {
+	var vs []string
+	for _, ind := range indicators {
+		vs = append(vs, string(ind.Type)+" "+ind.Value)
+	}
+	return strings.Join(vs, ", ")
+}
+
+func TestFormats(t *testing.T) {
+	indicators, err := threatintel.ParsePlain(strings.NewReader(plain))
+	expected := "domain evil.example.com, domain tracker.example.net, domain ads.example.org, ip 198.51.100.7, cidr 203.0.113.0/24, url files.example.com/payload.exe"
+	if err != nil || values(indicators) != expected {
+		t.Errorf("Expected the plain indicators %q, got %q: %v", expected, values(indicators), err)
+	}
+
+	indicators, err = threatintel.ParseMISP(strings.NewReader(misp))
+	expected = "domain phish.example.com, ip 192.0.2.1, url phish.example.com/login?id=1"
+	if err != nil || values(indicators) != expected {
+		t.Errorf("Expected the MISP indicators %q, got %q: %v", expected, values(indicators), err)
+	}
+	if indicators[0].Description != "Phishing campaign" || indicators[2].Description != "Login page" {
+		t.Errorf("Expected the descriptions of the MISP attributes, got %+v", indicators)
+	}
+
+	indicators, err = threatintel.ParseSTIX(strings.NewReader(stix))
+	expected = "domain c2.example.com, cidr 192.0.2.0/28"
+	if err != nil || values(indicators) != expected {
+		t.Errorf("Expected the STIX indicators %q, got %q: %v", expected, values(indicators), err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	indicators, _ := threatintel.ParsePlain(strings.NewReader(plain))
+	s := threatintel.NewSet(indicators)
+	if s.Len() != 6 {
+		t.Errorf("Expected 6 indicators, got %d", s.Len())
+	}
+	for target, expected := range map[string]string{
+		"http://evil.example.com/":                  "evil.example.com",
+		"https://cdn.EVIL.example.com./x":           "evil.example.com",
+		"http://example.com/":                       "",
+		"http://198.51.100.7:8080/":                 "198.51.100.7",
+		"http://[::ffff:203.0.113.99]/":             "203.0.113.0/24",
+		"http://203.0.114.1/":                       "",
+		"https://files.example.com/payload.exe?v=2": "files.example.com/payload.exe",
+		"http://files.example.com/other.exe":        "",
+		"http://files.example.com:8080/payload.exe": "",
+	} {
+		u, _ := url.Parse(target)
+		ind := s.LookupURL(u)
+		if (ind == nil && expected != "") || (ind != nil && ind.Value != expected) {
+			t.Errorf("Expected %s to match %q, got %+v", target, expected, ind)
+		}
+	}
+	if s.LookupIP(netip.MustParseAddr("203.0.113.1")) == nil {
+		t.Error("Expected the address of the range to match")
+	}
+}
+
+func TestIntel(t *testing.T) {
+	var requests []string
+	feeds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("If-None-Match")+" "+r.URL.Query().Get("next"))
+		switch r.URL.Path {
+		case "/plain":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			fmt.Fprint(w, "blocked.example.com\n")
+		case "/misp":
+			fmt.Fprint(w, misp)
+		case "/taxii/collections/1/objects/":
+			if r.Header.Get("Accept") != "application/taxii+json;version=2.1" {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			if r.URL.Query().Get("next") == "" {
+				fmt.Fprint(w, `{"more": true, "next": "2", "objects": [{"type": "indicator", "pattern": "[domain-name:value = 'page1.example.com']"}]}`)
+			} else {
+				fmt.Fprint(w, `{"more": false, "objects": [{"type": "indicator", "pattern": "[url:value = 'http://page2.example.com/x']"}]}`)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer feeds.Close()
+
+	intel := threatintel.New(
+		&threatintel.Feed{Name: "plain", URL: feeds.URL + "/plain"},
+		&threatintel.Feed{Name: "misp", URL: feeds.URL + "/misp", Format: threatintel.FormatMISP, Action: threatintel.Alert},
+		&threatintel.Feed{Name: "taxii", URL: feeds.URL + "/taxii/collections/1/objects/", Format: threatintel.FormatTAXII},
+	)
+	if err := intel.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := intel.Set().Len(); n != 6 {
+		t.Errorf("Expected 6 indicators, got %d", n)
+	}
+	intel.Feeds = append(intel.Feeds, &threatintel.Feed{Name: "missing", URL: feeds.URL + "/missing"})
+	if err := intel.Refresh(context.Background()); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected the error of the missing feed, got %v", err)
+	}
+	if n := intel.Set().Len(); n != 6 {
+		t.Errorf("Expected the indicators to be kept, got %d", n)
+	}
+	if requests[4] != `/plain "v1" ` {
+		t.Errorf("Expected the conditional request of the feed, got %q", requests)
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	var alerts []string
+	proxy.Subscribe(func(e *goproxy.Event) { alerts = append(alerts, e.Err.Error()) }, goproxy.EventAnomalyDetected)
+	handle := func(target string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		ctx := &goproxy.ProxyCtx{Req: req, Proxy: proxy}
+		_, resp := intel.Handle(req, ctx)
+		return resp
+	}
+	if resp := handle("http://www.blocked.example.com/"); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected the blocked domain to be rejected")
+	}
+	if resp := handle("http://page2.example.com/x?a=b"); resp == nil {
+		t.Error("Expected the URL of the second TAXII page to be rejected")
+	}
+	if resp := handle("https://phish.example.com/"); resp != nil || len(alerts) != 1 || !strings.Contains(alerts[0], "feed misp (Phishing campaign)") {
+		t.Errorf("Expected the alert of the MISP indicator, got %q", alerts)
+	}
+	if resp := handle("http://example.com/"); resp != nil {
+		t.Error("Expected the other domains to pass")
+	}
+
+	req := httptest.NewRequest(http.MethodConnect, "http://page1.example.com:443", nil)
+	ctx := &goproxy.ProxyCtx{Req: req, Proxy: proxy}
+	if action, _ := intel.HandleConnect("page1.example.com:443", ctx); action != goproxy.RejectConnect || ctx.Resp == nil {
+		t.Error("Expected the tunnel to the blocked domain to be rejected")
+	}
+	if action, _ := intel.HandleConnect("example.com:443", ctx); action != nil {
+		t.Error("Expected the other tunnels to pass")
+	}
+}
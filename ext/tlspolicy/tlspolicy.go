@@ -0,0 +1,182 @@
+// Package tlspolicy configures the TLS versions, cipher suites and curves
+// of the MITM handshakes with the clients, and of the handshakes with the
+// upstream servers, per destination:
+//
+//	policies := &tlspolicy.Policies{
+//		Client:   tlspolicy.Policy{MinVersion: tls.VersionTLS12},
+//		Upstream: tlspolicy.Policy{MinVersion: tls.VersionTLS12},
+//	}
+//	policies.Set("*.legacy.example.com", tlspolicy.Legacy)
+//	policies.Install(proxy)
+//	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+//		return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: policies.MitmTLSConfig(&goproxy.GoproxyCa)}, host
+//	}))
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Policy is the TLS parameters of a handshake. Its zero values keep the
+// defaults of crypto/tls.
+type Policy struct {
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+}
+
+// Legacy is the compatibility policy of the appliances only speaking TLS
+// 1.0 and 1.1, with the CBC cipher suites they support.
+var Legacy = Policy{
+	MinVersion: tls.VersionTLS10,
+	CipherSuites: []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	},
+}
+
+// Apply sets the parameters of the policy in config.
+func (p Policy) Apply(config *tls.Config) {
+	if p.MinVersion != 0 {
+		config.MinVersion = p.MinVersion
+	}
+	if p.MaxVersion != 0 {
+		config.MaxVersion = p.MaxVersion
+	}
+	if len(p.CipherSuites) > 0 {
+		config.CipherSuites = append([]uint16(nil), p.CipherSuites...)
+	}
+	if len(p.CurvePreferences) > 0 {
+		config.CurvePreferences = append([]tls.CurveID(nil), p.CurvePreferences...)
+	}
+}
+
+// Policies are the policies of the client and upstream handshakes.
+type Policies struct {
+	// Client is the policy of the MITM handshakes with the clients.
+	Client Policy
+	// Upstream is the default policy of the upstream handshakes.
+	Upstream Policy
+
+	mu           sync.Mutex
+	destinations map[string]Policy
+	transports   map[string]*http.Transport
+	base         *http.Transport
+}
+
+// Set sets the upstream policy of host, replacing the default one. A host
+// of "*.example.com" sets the policy of the subdomains of example.com.
+func (p *Policies) Set(host string, policy Policy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.destinations == nil {
+		p.destinations = make(map[string]Policy)
+	}
+	host = strings.ToLower(host)
+	p.destinations[host] = policy
+	delete(p.transports, host)
+}
+
+// lookup returns the key and policy of the destination of host.
+func (p *Policies) lookup(host string) (string, Policy, bool) {
+	host = strings.ToLower(host)
+	if policy, ok := p.destinations[host]; ok {
+		return host, policy, true
+	}
+	for domain := host; ; {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return "", Policy{}, false
+		}
+		domain = domain[i+1:]
+		if policy, ok := p.destinations["*."+domain]; ok {
+			return "*." + domain, policy, true
+		}
+	}
+}
+
+// MitmTLSConfig returns the TLS configuration of the MITM handshakes signed
+// by ca, with the client policy.
+func (p *Policies) MitmTLSConfig(ca *tls.Certificate) func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+	sign := goproxy.TLSConfigFromCA(ca)
+	return func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+		config, err := sign(host, ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.Client.Apply(config)
+		return config, nil
+	}
+}
+
+// transport returns the transport of the destination of host, nil when it
+// uses the proxy one.
+func (p *Policies) transport(host string) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, policy, ok := p.lookup(host)
+	if !ok || p.base == nil {
+		return nil
+	}
+	if tr, ok := p.transports[key]; ok {
+		return tr
+	}
+	tr := p.base.Clone()
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	policy.Apply(tr.TLSClientConfig)
+	if p.transports == nil {
+		p.transports = make(map[string]*http.Transport)
+	}
+	p.transports[key] = tr
+	return tr
+}
+
+// Handle sends the requests to the destinations having a policy with a
+// transport of that policy, unless the request already has a Transport.
+func (p *Policies) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if ctx.Transport != nil || req.URL.Scheme != "https" {
+		return req, nil
+	}
+	if tr := p.transport(req.URL.Hostname()); tr != nil {
+		ctx.Transport = tr
+	}
+	return req, nil
+}
+
+// Install applies the upstream policy to the transport of proxy, and the
+// destination policies to its requests. The destination transports are
+// copies of the proxy transport at installation, which must be configured
+// beforehand.
+func (p *Policies) Install(proxy *goproxy.ProxyHttpServer) {
+	p.mu.Lock()
+	p.base = proxy.Tr.Clone()
+	p.transports = nil
+	p.mu.Unlock()
+
+	tr := proxy.Tr.Clone()
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	p.Upstream.Apply(tr.TLSClientConfig)
+	proxy.Tr = tr
+	proxy.OnRequest().DoFunc(p.Handle)
+}
@@ -0,0 +1,58 @@
+package tlspolicy_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/tlspolicy"
+)
+
+func TestPolicies(t *testing.T) {
+	legacy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "legacy")
+	}))
+	legacy.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10}
+	legacy.StartTLS()
+	defer legacy.Close()
+
+	policies := &tlspolicy.Policies{
+		Client:   tlspolicy.Policy{MaxVersion: tls.VersionTLS12},
+		Upstream: tlspolicy.Policy{MinVersion: tls.VersionTLS12},
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	policies.Install(proxy)
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: policies.MitmTLSConfig(&goproxy.GoproxyCa)}, host
+	}))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	if resp, err := client.Get(legacy.URL); err == nil {
+		resp.Body.Close()
+		t.Error("Expected the upstream policy to reject TLS 1.0")
+	}
+
+	policies.Set("127.0.0.1", tlspolicy.Legacy)
+	resp, err := client.Get(legacy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "legacy" {
+		t.Errorf("Expected the legacy policy to accept TLS 1.0, got %q", body)
+	}
+	if resp.TLS.Version != tls.VersionTLS12 {
+		t.Errorf("Expected the client policy to negotiate TLS 1.2, got %x", resp.TLS.Version)
+	}
+}
@@ -0,0 +1,189 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// JSONFunc transforms a JSON value, whose numbers are json.Number, and
+// returns the value to encode.
+type JSONFunc func(v any, ctx *goproxy.ProxyCtx) (any, error)
+
+// XMLFunc transforms the tokens of an XML document, as returned by the
+// RawToken of an xml.Decoder: the Space of their names are the namespace
+// prefixes. It returns the tokens to encode.
+type XMLFunc func(tokens []xml.Token, ctx *goproxy.ProxyCtx) ([]xml.Token, error)
+
+// HTMLFunc transforms the tree of an HTML document in place.
+type HTMLFunc func(doc *html.Node, ctx *goproxy.ProxyCtx) error
+
+// TextFunc transforms a text and returns the text to encode.
+type TextFunc func(s string, ctx *goproxy.ProxyCtx) (string, error)
+
+// decoded is a body decoded for the transformers of its kind.
+type decoded struct {
+	kind kind
+	json any
+	xml  []xml.Token
+	html *html.Node
+	text string
+}
+
+// toUTF8 decodes data from the charset label, UTF-8 by default.
+func toUTF8(data []byte, label string) ([]byte, error) {
+	label = strings.ToLower(strings.TrimSpace(label))
+	if label == "" || label == "utf-8" || label == "utf8" {
+		return data, nil
+	}
+	enc, _ := charset.Lookup(label)
+	if enc == nil {
+		return nil, fmt.Errorf("transform: unsupported charset %s", label)
+	}
+	return enc.NewDecoder().Bytes(data)
+}
+
+// run runs steps on data, in the charset label, and returns the UTF-8
+// result.
+func run(steps []step, data []byte, label string, ctx *goproxy.ProxyCtx) ([]byte, error) {
+	data, err := toUTF8(data, label)
+	if err != nil {
+		return nil, err
+	}
+	// The XML documents are decoded from their declared encoding unless
+	// the Content-Type has a charset, or they were encoded to UTF-8.
+	utf8 := label != ""
+	var d *decoded
+	for _, s := range steps {
+		if d != nil && d.kind != s.kind {
+			if data, err = encode(d); err != nil {
+				return nil, err
+			}
+			utf8 = utf8 || d.kind == kindXML
+			d = nil
+		}
+		if d == nil {
+			if d, err = decode(s.kind, data, utf8); err != nil {
+				return nil, err
+			}
+		}
+		switch s.kind {
+		case kindJSON:
+			d.json, err = s.json(d.json, ctx)
+		case kindXML:
+			d.xml, err = s.xml(d.xml, ctx)
+		case kindHTML:
+			err = s.html(d.html, ctx)
+		case kindText:
+			d.text, err = s.text(d.text, ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encode(d)
+}
+
+func decode(k kind, data []byte, utf8 bool) (*decoded, error) {
+	d := &decoded{kind: k}
+	switch k {
+	case kindJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&d.json); err != nil {
+			return nil, err
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errors.New("transform: data after the JSON value")
+		}
+	case kindXML:
+		dec := xml.NewDecoder(bytes.NewReader(data))
+		dec.CharsetReader = charset.NewReaderLabel
+		if utf8 {
+			dec.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) { return r, nil }
+		}
+		for {
+			tok, err := dec.RawToken()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			d.xml = append(d.xml, xml.CopyToken(tok))
+		}
+	case kindHTML:
+		doc, err := html.Parse(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		d.html = doc
+	case kindText:
+		d.text = string(data)
+	}
+	return d, nil
+}
+
+var xmlEncoding = regexp.MustCompile(`encoding\s*=\s*("[^"]*"|'[^']*')`)
+
+// rawName returns the name of a raw token, with its prefix, to encode.
+func rawName(n xml.Name) xml.Name {
+	if n.Space == "" {
+		return n
+	}
+	return xml.Name{Local: n.Space + ":" + n.Local}
+}
+
+func encode(d *decoded) ([]byte, error) {
+	var buf bytes.Buffer
+	switch d.kind {
+	case kindJSON:
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(d.json); err != nil {
+			return nil, err
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+	case kindXML:
+		enc := xml.NewEncoder(&buf)
+		for _, tok := range d.xml {
+			switch t := tok.(type) {
+			case xml.StartElement:
+				start := xml.StartElement{Name: rawName(t.Name), Attr: make([]xml.Attr, len(t.Attr))}
+				for i, a := range t.Attr {
+					start.Attr[i] = xml.Attr{Name: rawName(a.Name), Value: a.Value}
+				}
+				tok = start
+			case xml.EndElement:
+				tok = xml.EndElement{Name: rawName(t.Name)}
+			case xml.ProcInst:
+				if t.Target == "xml" {
+					// The encoded document is UTF-8.
+					tok = xml.ProcInst{Target: "xml", Inst: xmlEncoding.ReplaceAll(t.Inst, []byte(`encoding="UTF-8"`))}
+				}
+			}
+			if err := enc.EncodeToken(tok); err != nil {
+				return nil, err
+			}
+		}
+		if err := enc.Flush(); err != nil {
+			return nil, err
+		}
+	case kindHTML:
+		if err := html.Render(&buf, d.html); err != nil {
+			return nil, err
+		}
+	case kindText:
+		buf.WriteString(d.text)
+	}
+	return buf.Bytes(), nil
+}
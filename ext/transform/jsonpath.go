@@ -0,0 +1,242 @@
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Path is a compiled JSONPath. It supports the root $, the members .name
+// and ['name'], the elements [n], negative from the end, the wildcards .*
+// and [*], and the recursive descent ..name, for example
+// $.items[*].owner or $..password.
+type Path struct {
+	expr string
+	segs []segment
+}
+
+type segment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+	descend  bool
+}
+
+// CompilePath compiles the JSONPath expr.
+func CompilePath(expr string) (*Path, error) {
+	s := strings.TrimSpace(expr)
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("transform: JSONPath %q doesn't start with $", expr)
+	}
+	p := &Path{expr: expr}
+	s = s[1:]
+	for s != "" {
+		var seg segment
+		switch {
+		case strings.HasPrefix(s, ".."):
+			seg.descend = true
+			s = s[2:]
+			if strings.HasPrefix(s, "[") {
+				break
+			}
+			s = "." + s
+			fallthrough
+		case s[0] == '.':
+			s = s[1:]
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			name := s[:end]
+			s = s[end:]
+			if name == "" {
+				return nil, fmt.Errorf("transform: empty member in JSONPath %q", expr)
+			}
+			if name == "*" {
+				seg.wildcard = true
+			} else {
+				seg.name = name
+			}
+			p.segs = append(p.segs, seg)
+			continue
+		}
+		if !strings.HasPrefix(s, "[") {
+			return nil, fmt.Errorf("transform: invalid JSONPath %q at %q", expr, s)
+		}
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil, fmt.Errorf("transform: unterminated [ in JSONPath %q", expr)
+		}
+		sel := strings.TrimSpace(s[1:end])
+		s = s[end+1:]
+		switch {
+		case sel == "*":
+			seg.wildcard = true
+		case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+			seg.name = sel[1 : len(sel)-1]
+		default:
+			n, err := strconv.Atoi(sel)
+			if err != nil {
+				return nil, fmt.Errorf("transform: invalid selector [%s] in JSONPath %q", sel, expr)
+			}
+			seg.index, seg.isIndex = n, true
+		}
+		p.segs = append(p.segs, seg)
+	}
+	return p, nil
+}
+
+// MustCompilePath is like CompilePath but panics if expr is invalid.
+func MustCompilePath(expr string) *Path {
+	p, err := CompilePath(expr)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p *Path) String() string {
+	return p.expr
+}
+
+// visit is called on the nodes matched by a path, found is false for the
+// missing last member of an object. It returns the new value of the node,
+// and false to remove it, or not to create it.
+type visit func(v any, found bool) (any, bool)
+
+// walk calls f on the nodes of v matched by segs, and returns the new v and
+// whether it is kept.
+func walk(v any, segs []segment, f visit) (any, bool) {
+	if len(segs) == 0 {
+		return f(v, true)
+	}
+	seg, rest := segs[0], segs[1:]
+	if seg.descend {
+		here := seg
+		here.descend = false
+		v, _ = walk(v, append([]segment{here}, rest...), existing(f))
+		switch x := v.(type) {
+		case map[string]any:
+			for k, child := range x {
+				x[k], _ = walk(child, segs, f)
+			}
+		case []any:
+			for i, child := range x {
+				x[i], _ = walk(child, segs, f)
+			}
+		}
+		return v, true
+	}
+
+	switch x := v.(type) {
+	case map[string]any:
+		if seg.isIndex {
+			return v, true
+		}
+		if seg.wildcard {
+			for k, child := range x {
+				if nv, ok := walk(child, rest, f); ok {
+					x[k] = nv
+				} else {
+					delete(x, k)
+				}
+			}
+			return v, true
+		}
+		child, found := x[seg.name]
+		var nv any
+		var ok bool
+		switch {
+		case found:
+			nv, ok = walk(child, rest, f)
+		case len(rest) == 0:
+			nv, ok = f(nil, false)
+		case rest[0].name != "" && !rest[0].descend:
+			// The missing objects are created if their members are.
+			created := map[string]any{}
+			walk(created, rest, f)
+			nv, ok = created, len(created) > 0
+		default:
+			return v, true
+		}
+		if ok {
+			x[seg.name] = nv
+		} else if found {
+			delete(x, seg.name)
+		}
+		return v, true
+	case []any:
+		if seg.name != "" {
+			return v, true
+		}
+		if seg.wildcard {
+			kept := x[:0]
+			for _, child := range x {
+				if nv, ok := walk(child, rest, f); ok {
+					kept = append(kept, nv)
+				}
+			}
+			return kept, true
+		}
+		i := seg.index
+		if i < 0 {
+			i += len(x)
+		}
+		if i < 0 || i >= len(x) {
+			return v, true
+		}
+		nv, ok := walk(x[i], rest, f)
+		if ok {
+			x[i] = nv
+			return v, true
+		}
+		return append(x[:i], x[i+1:]...), true
+	}
+	return v, true
+}
+
+// existing calls f on the found nodes only, so that the recursive descents
+// don't create members.
+func existing(f visit) visit {
+	return func(v any, found bool) (any, bool) {
+		if !found {
+			return nil, false
+		}
+		return f(v, true)
+	}
+}
+
+// Get returns the values of v matched by p.
+func (p *Path) Get(v any) []any {
+	var values []any
+	walk(v, p.segs, func(v any, found bool) (any, bool) {
+		if found {
+			values = append(values, v)
+		}
+		return v, found
+	})
+	return values
+}
+
+// Set sets the values of v matched by p to the value returned by f, which
+// may be called with a nil value for a missing member of an object, to
+// create it with its missing parents. It returns the new v.
+func (p *Path) Set(v any, f func(old any) any) any {
+	nv, _ := walk(v, p.segs, func(old any, found bool) (any, bool) {
+		return f(old), true
+	})
+	return nv
+}
+
+// Remove removes the values of v matched by p, and returns the new v, nil
+// if p is the root.
+func (p *Path) Remove(v any) any {
+	nv, ok := walk(v, p.segs, func(any, bool) (any, bool) {
+		return nil, false
+	})
+	if !ok {
+		return nil
+	}
+	return nv
+}
@@ -0,0 +1,96 @@
+package transform_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy/ext/transform"
+)
+
+func parse(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func format(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestPath(t *testing.T) {
+	doc := `{"items":[{"id":1,"owner":{"name":"a"}},{"id":2,"owner":{"name":"b"}}],"meta":{"name":"m"}}`
+	for expr, want := range map[string][]any{
+		"$.items[*].id":      {1.0, 2.0},
+		"$.items[-1].id":     {2.0},
+		"$['meta'].name":     {"m"},
+		"$.items[5].id":      nil,
+		"$.missing.id":       nil,
+		"$.meta.*":           {"m"},
+		"$..owner.name":      {"a", "b"},
+		"$.items[0].owner.*": {"a"},
+	} {
+		got := transform.MustCompilePath(expr).Get(parse(t, doc))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %v, want %v", expr, got, want)
+		}
+	}
+	if got := transform.MustCompilePath("$..name").Get(parse(t, doc)); len(got) != 3 {
+		t.Errorf("$..name = %v", got)
+	}
+
+	for _, expr := range []string{"items", "$.", "$[x]", "$.a[1"} {
+		if _, err := transform.CompilePath(expr); err == nil {
+			t.Errorf("CompilePath(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestPathSetRemove(t *testing.T) {
+	v := parse(t, `{"a":{"b":1},"list":[1,2,3]}`)
+	v = transform.MustCompilePath("$.a.c").Set(v, func(any) any { return "new" })
+	v = transform.MustCompilePath("$.a.b").Set(v, func(old any) any { return old.(float64) + 1 })
+	v = transform.MustCompilePath("$.list[1]").Remove(v)
+	v = transform.MustCompilePath("$.list[7].x").Set(v, func(any) any { return 1 })
+	if got, want := format(v), `{"a":{"b":2,"c":"new"},"list":[1,3]}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := transform.MustCompilePath("$").Remove(v); got != nil {
+		t.Errorf("removing the root = %v", got)
+	}
+}
+
+func TestJSONRules(t *testing.T) {
+	var rules []transform.JSONRule
+	err := json.Unmarshal([]byte(`[
+		{"response": true, "url": "/v1/", "op": "remove", "path": "$.debug"},
+		{"response": true, "op": "set", "path": "$.meta.proxy", "value": {"name": "goproxy"}},
+		{"response": true, "op": "redact", "path": "$.users[*]", "keys": "(?i)^email$"},
+		{"response": true, "op": "redact", "path": "$.token"},
+		{"response": true, "url": "/v2/", "op": "remove", "path": "$.meta"}
+	]`), &rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &transform.Registry{}
+	if err := r.JSONRules("application/json", rules...); err != nil {
+		t.Fatal(err)
+	}
+	client, upstream, done := newProxy(t, r, "application/json", "",
+		[]byte(`{"debug":1,"token":"t","users":[{"name":"a","Email":"a@example.com"}]}`))
+	defer done()
+
+	body, _ := get(t, client, upstream+"/v1/users")
+	want := `{"meta":{"proxy":{"name":"goproxy"}},"token":"[redacted]","users":[{"Email":"[redacted]","name":"a"}]}`
+	if body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+
+	if err := r.JSONRules("application/json", transform.JSONRule{Op: "rename", Path: "$.a"}); err == nil {
+		t.Error("unknown op accepted")
+	}
+}
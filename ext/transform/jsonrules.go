@@ -0,0 +1,180 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/redact"
+)
+
+// JSONOp is the mutation of a JSONRule.
+type JSONOp string
+
+const (
+	// OpSet sets the matched values to the Value of the rule, creating the
+	// missing last member.
+	OpSet JSONOp = "set"
+	// OpRemove removes the matched values.
+	OpRemove JSONOp = "remove"
+	// OpRedact masks the matched values, or their members whose name
+	// matches the Keys of the rule.
+	OpRedact JSONOp = "redact"
+)
+
+// JSONRule is a declarative mutation of the JSON bodies. The rules may be
+// loaded from a configuration file:
+//
+//	[
+//		{"url": "^api\\.example\\.com/v1/", "response": true, "op": "remove", "path": "$.debug"},
+//		{"method": "POST", "op": "set", "path": "$.client.version", "value": "2.0"},
+//		{"response": true, "op": "redact", "path": "$..user", "keys": "(?i)^(email|phone)$"}
+//	]
+type JSONRule struct {
+	// Condition, if set, must match the request.
+	Condition goproxy.ReqCondition `json:"-"`
+	// Method, if set, is the method of the request.
+	Method string `json:"method,omitempty"`
+	// URL, if set, is a regular expression matching the host and path of
+	// the request, as goproxy.UrlMatches.
+	URL string `json:"url,omitempty"`
+	// Response mutates the response bodies rather than the request bodies.
+	Response bool   `json:"response,omitempty"`
+	Op       JSONOp `json:"op"`
+	Path     string `json:"path"`
+	// Value is the value set by OpSet.
+	Value any `json:"value,omitempty"`
+	// Keys is a regular expression of the names of the members masked by
+	// OpRedact in the matched values. The matched values are masked when it
+	// is empty.
+	Keys string `json:"keys,omitempty"`
+}
+
+type jsonRule struct {
+	JSONRule
+	url   *regexp.Regexp
+	path  *Path
+	value []byte
+	keys  *regexp.Regexp
+}
+
+func compileRule(i int, rule JSONRule) (*jsonRule, error) {
+	r := &jsonRule{JSONRule: rule}
+	var err error
+	if rule.URL != "" {
+		if r.url, err = regexp.Compile(rule.URL); err != nil {
+			return nil, fmt.Errorf("transform: JSON rule %d: %w", i, err)
+		}
+	}
+	if r.path, err = CompilePath(rule.Path); err != nil {
+		return nil, fmt.Errorf("transform: JSON rule %d: %w", i, err)
+	}
+	switch rule.Op {
+	case OpSet:
+		// The value is decoded for every body, which may then be mutated.
+		if r.value, err = json.Marshal(rule.Value); err != nil {
+			return nil, fmt.Errorf("transform: JSON rule %d: %w", i, err)
+		}
+	case OpRemove:
+	case OpRedact:
+		if rule.Keys != "" {
+			if r.keys, err = regexp.Compile(rule.Keys); err != nil {
+				return nil, fmt.Errorf("transform: JSON rule %d: %w", i, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("transform: JSON rule %d: unknown op %q", i, rule.Op)
+	}
+	return r, nil
+}
+
+func (r *jsonRule) matches(ctx *goproxy.ProxyCtx) bool {
+	if r.Response != (ctx.Resp != nil) {
+		return false
+	}
+	req := ctx.Req
+	if r.Method != "" && !strings.EqualFold(r.Method, req.Method) {
+		return false
+	}
+	if r.url != nil && !r.url.MatchString(req.URL.Path) && !r.url.MatchString(req.URL.Host+req.URL.Path) {
+		return false
+	}
+	return r.Condition == nil || r.Condition.HandleReq(req, ctx)
+}
+
+// redactKeys masks the values of the members of v whose name matches keys.
+func redactKeys(v any, keys *regexp.Regexp) {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, child := range x {
+			if keys.MatchString(k) {
+				x[k] = redact.Mask
+			} else {
+				redactKeys(child, keys)
+			}
+		}
+	case []any:
+		for _, child := range x {
+			redactKeys(child, keys)
+		}
+	}
+}
+
+func (r *jsonRule) apply(v any) any {
+	switch r.Op {
+	case OpSet:
+		return r.path.Set(v, func(any) any {
+			dec := json.NewDecoder(bytes.NewReader(r.value))
+			dec.UseNumber()
+			var value any
+			_ = dec.Decode(&value)
+			return value
+		})
+	case OpRemove:
+		return r.path.Remove(v)
+	}
+	v, _ = walk(v, r.path.segs, existing(func(old any, _ bool) (any, bool) {
+		if r.keys == nil {
+			return redact.Mask, true
+		}
+		redactKeys(old, r.keys)
+		return old, true
+	}))
+	return v
+}
+
+// JSONRules appends the JSON rules to the chain of contentType, usually
+// "application/json". The rules matching the message are applied in order.
+func (r *Registry) JSONRules(contentType string, rules ...JSONRule) error {
+	compiled := make([]*jsonRule, len(rules))
+	for i, rule := range rules {
+		var err error
+		if compiled[i], err = compileRule(i, rule); err != nil {
+			return err
+		}
+	}
+	r.add(contentType, step{
+		kind: kindJSON,
+		json: func(v any, ctx *goproxy.ProxyCtx) (any, error) {
+			for _, rule := range compiled {
+				if rule.matches(ctx) {
+					v = rule.apply(v)
+				}
+			}
+			return v, nil
+		},
+		// The bodies matching no rule aren't decoded.
+		match: func(ctx *goproxy.ProxyCtx) bool {
+			for _, rule := range compiled {
+				if rule.matches(ctx) {
+					return true
+				}
+			}
+			return false
+		},
+	})
+	return nil
+}
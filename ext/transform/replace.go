@@ -0,0 +1,261 @@
+package transform
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	xtransform "golang.org/x/text/transform"
+)
+
+// Replacer replaces texts in the bodies of the messages as they are
+// streamed, without buffering them, the matches spanning their chunks
+// included:
+//
+//	r := transform.NewReplacer("http://cdn.example.com/", "https://cdn.example.net/")
+//	proxy.OnResponse().Do(r.ResponseHandler())
+//
+// The text bodies are decoded from the charset of their Content-Type, and
+// encoded back in it, the characters it can't encode replaced. The gzip
+// and deflate bodies are decompressed.
+type Replacer struct {
+	// ContentTypes are the media types of the bodies replaced, with the
+	// wildcards of Registry, the text types by default, and all the types
+	// with Binary.
+	ContentTypes []string
+	// Binary replaces the bytes of the bodies, without decoding their
+	// charset, for the patterns which aren't text.
+	Binary bool
+
+	olds, news [][]byte
+	maxLen     int
+}
+
+// DefaultTextTypes are the default ContentTypes of the Replacer.
+var DefaultTextTypes = []string{
+	"text/*",
+	"application/json", "*+json",
+	"application/xml", "*+xml",
+	"application/javascript", "application/x-javascript",
+}
+
+// NewReplacer returns a Replacer of the pairs of old and new strings. The
+// leftmost matches are replaced, the first pair winning when several match
+// at the same position, as with strings.NewReplacer. It panics if given an
+// odd number of arguments, or an empty old string.
+func NewReplacer(oldnew ...string) *Replacer {
+	if len(oldnew)%2 == 1 {
+		panic("transform: odd argument count to NewReplacer")
+	}
+	r := &Replacer{}
+	for i := 0; i < len(oldnew); i += 2 {
+		if oldnew[i] == "" {
+			panic("transform: empty old string in NewReplacer")
+		}
+		r.olds = append(r.olds, []byte(oldnew[i]))
+		r.news = append(r.news, []byte(oldnew[i+1]))
+		if len(oldnew[i]) > r.maxLen {
+			r.maxLen = len(oldnew[i])
+		}
+	}
+	return r
+}
+
+// Reader returns the reader of src with the replacements.
+func (r *Replacer) Reader(src io.Reader) io.Reader {
+	if len(r.olds) == 0 {
+		return src
+	}
+	return &replaceReader{r: r, src: src}
+}
+
+// replaceReader replaces the matches of src. It holds back the bytes which
+// may start a match continuing in the next chunk.
+type replaceReader struct {
+	r   *Replacer
+	src io.Reader
+	in  []byte
+	out []byte
+	eof bool
+	err error
+}
+
+func (rr *replaceReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.eof {
+			if len(rr.in) == 0 {
+				if rr.err != nil {
+					return 0, rr.err
+				}
+				return 0, io.EOF
+			}
+		} else {
+			rr.fill()
+		}
+		rr.replace()
+	}
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+func (rr *replaceReader) fill() {
+	buf := make([]byte, 32<<10)
+	n, err := rr.src.Read(buf)
+	rr.in = append(rr.in, buf[:n]...)
+	if err != nil {
+		rr.eof = true
+		if err != io.EOF {
+			rr.err = err
+		}
+	}
+}
+
+// replace moves the bytes of in which can't start a match continuing
+// beyond it to out, replacing the matches.
+func (rr *replaceReader) replace() {
+	safe := len(rr.in)
+	if !rr.eof {
+		safe -= rr.r.maxLen - 1
+	}
+	out := rr.out[:0]
+	for safe > 0 {
+		i, k := rr.r.index(rr.in, safe)
+		if i < 0 {
+			out = append(out, rr.in[:safe]...)
+			rr.in = rr.in[safe:]
+			break
+		}
+		out = append(out, rr.in[:i]...)
+		out = append(out, rr.r.news[k]...)
+		end := i + len(rr.r.olds[k])
+		rr.in = rr.in[end:]
+		safe -= end
+	}
+	rr.out = out
+	// Not to keep the chunks read.
+	rr.in = append([]byte(nil), rr.in...)
+}
+
+// index returns the position of the leftmost match in data starting before
+// limit, and the index of its pair, or -1.
+func (r *Replacer) index(data []byte, limit int) (int, int) {
+	i, k := -1, -1
+	for j, old := range r.olds {
+		end := limit + len(old) - 1
+		if i >= 0 {
+			// Only the earlier matches are searched.
+			end = i + len(old) - 1
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		if n := bytes.Index(data[:end], old); n >= 0 && (i < 0 || n < i) {
+			i, k = n, j
+		}
+	}
+	return i, k
+}
+
+func matchesType(types []string, mediaType string) bool {
+	for _, t := range types {
+		switch t = strings.ToLower(t); {
+		case t == "*" || t == mediaType:
+			return true
+		case strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]):
+			return true
+		case strings.HasPrefix(t, "*+") && strings.HasSuffix(mediaType, t[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// body returns the body replaced, and whether it is, after updating h.
+func (r *Replacer) body(h http.Header, body io.ReadCloser, ctx *goproxy.ProxyCtx) (io.ReadCloser, bool) {
+	if body == nil || body == http.NoBody || len(r.olds) == 0 {
+		return body, false
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil && !r.Binary {
+		return body, false
+	}
+	types := r.ContentTypes
+	if types == nil && !r.Binary {
+		types = DefaultTextTypes
+	}
+	if types != nil && !matchesType(types, mediaType) {
+		return body, false
+	}
+
+	var src io.Reader = body
+	switch ce := strings.ToLower(h.Get("Content-Encoding")); ce {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			ctx.Warnf("transform: not replacing the %s body: %v", mediaType, err)
+			return body, false
+		}
+		src = zr
+	case "deflate":
+		src = flate.NewReader(body)
+	default:
+		ctx.Logf("transform: not replacing the %s body encoded with %s", mediaType, ce)
+		return body, false
+	}
+
+	var enc encoding.Encoding
+	if label := strings.ToLower(params["charset"]); !r.Binary && label != "" && label != "utf-8" && label != "utf8" {
+		if enc, _ = charset.Lookup(label); enc == nil {
+			ctx.Warnf("transform: not replacing the body in the unsupported charset %s", label)
+			return body, false
+		}
+	}
+	if enc != nil {
+		src = xtransform.NewReader(src, enc.NewDecoder())
+		src = xtransform.NewReader(r.Reader(src), encoding.ReplaceUnsupported(enc.NewEncoder()))
+	} else {
+		src = r.Reader(src)
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	return struct {
+		io.Reader
+		io.Closer
+	}{src, body}, true
+}
+
+// RequestHandler returns a ReqHandler replacing the request bodies.
+func (r *Replacer) RequestHandler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if body, ok := r.body(req.Header, req.Body, ctx); ok {
+			req.Body = body
+			req.ContentLength = -1
+		}
+		return req, nil
+	})
+}
+
+// ResponseHandler returns a RespHandler replacing the response bodies. The
+// partial contents are left unchanged, see goproxy.DisableRanges.
+func (r *Replacer) ResponseHandler() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || ctx.Req.Method == http.MethodHead || resp.StatusCode == http.StatusPartialContent {
+			return resp
+		}
+		if body, ok := r.body(resp.Header, resp.Body, ctx); ok {
+			resp.Body = body
+			resp.ContentLength = -1
+			resp.Uncompressed = false
+		}
+		return resp
+	})
+}
@@ -0,0 +1,100 @@
+package transform_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/transform"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestReplacerReader(t *testing.T) {
+	r := transform.NewReplacer("abc", "X", "a", "Y", "bcd", "Z")
+	for in, expected := range map[string]string{
+		"":           "",
+		"abc":        "X",
+		"xxabcdabxa": "xxXdYbxY",
+		"bcdabcbcd":  "ZXZ",
+		"aaab":       "YYYb",
+		"no hit.":    "no hit.",
+	} {
+		// One byte at a time, for the matches spanning the chunks.
+		out, err := io.ReadAll(r.Reader(iotest.OneByteReader(strings.NewReader(in))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != expected {
+			t.Errorf("Expected %q to be replaced by %q, got %q", in, expected, out)
+		}
+		if got := strings.NewReplacer("abc", "X", "a", "Y", "bcd", "Z").Replace(in); got != expected {
+			t.Errorf("Expected %q, as strings.Replacer, got %q", expected, got)
+		}
+	}
+
+	// The errors of the source are returned after its data.
+	out, err := io.ReadAll(r.Reader(iotest.TimeoutReader(strings.NewReader("abc"))))
+	if err != iotest.ErrTimeout || string(out) != "X" {
+		t.Errorf("Expected the timeout, got %q, %v", out, err)
+	}
+}
+
+func replaceResponse(t *testing.T, r *transform.Replacer, contentType, encoding string, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	ctx := &goproxy.ProxyCtx{Req: req, Proxy: goproxy.NewProxyHttpServer()}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	if encoding != "" {
+		resp.Header.Set("Content-Encoding", encoding)
+	}
+	resp = r.ResponseHandler().Handle(resp, ctx)
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, out
+}
+
+func TestReplacerCharset(t *testing.T) {
+	r := transform.NewReplacer("café", "thé €")
+	latin1, _ := charmap.ISO8859_1.NewEncoder().String("un café, s'il vous plaît")
+	resp, out := replaceResponse(t, r, "text/plain; charset=iso-8859-1", "", []byte(latin1))
+	// The ISO-8859-1 label is Windows-1252, as for the browsers.
+	expected, _ := charmap.Windows1252.NewEncoder().String("un thé €, s'il vous plaît")
+	if string(out) != expected {
+		t.Errorf("Expected the body to stay in Windows-1252, got %q", out)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Error("Expected the length of the body to be unknown")
+	}
+
+	resp, out = replaceResponse(t, r, "application/json", "gzip", gzipped(`{"drink":"café"}`))
+	if string(out) != `{"drink":"thé €"}` || resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected the gzip body to be decompressed and replaced, got %q", out)
+	}
+
+	// Not a text.
+	_, out = replaceResponse(t, r, "image/png", "", []byte("café"))
+	if string(out) != "café" {
+		t.Errorf("Expected the image to be left unchanged, got %q", out)
+	}
+}
+
+func TestReplacerBinary(t *testing.T) {
+	r := transform.NewReplacer("\x00\xff\x10", "\x01")
+	r.Binary = true
+	_, out := replaceResponse(t, r, "application/octet-stream", "", []byte("\x10\x00\xff\x10\x00"))
+	if string(out) != "\x10\x01\x00" {
+		t.Errorf("Expected the bytes to be replaced, got %q", out)
+	}
+}
@@ -0,0 +1,258 @@
+// Package transform rewrites the bodies of the messages with chains of
+// transformers registered by content type. The transformers receive the
+// decoded bodies, a JSON value, the XML tokens, the HTML tree or the UTF-8
+// text, rather than their bytes:
+//
+//	r := &transform.Registry{}
+//	r.JSON("application/json", func(v any, ctx *goproxy.ProxyCtx) (any, error) {
+//		if m, ok := v.(map[string]any); ok {
+//			delete(m, "tracking")
+//		}
+//		return v, nil
+//	})
+//	r.HTML("text/html", func(doc *html.Node, ctx *goproxy.ProxyCtx) error {
+//		...
+//	})
+//	proxy.OnResponse().Do(r.ResponseHandler())
+//
+// The content types are the media types, such as "application/json",
+// the wildcards of their subtypes, such as "text/*", or of their suffixes,
+// such as "*+json". The chains of the exact types run before those of the
+// wildcards. A body is decoded once for the consecutive transformers of the
+// same kind, and encoded after the last one.
+//
+// The JSONRules set, remove or redact the values of the JSON bodies
+// selected by JSONPath, without writing transformers. The Replacer replaces
+// texts in the bodies as they are streamed, without buffering them.
+package transform
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Registry maps content types to their chains of transformers. It may
+// transform the requests with RequestHandler and the responses with
+// ResponseHandler.
+type Registry struct {
+	// MaxBodySize bounds the transformed bodies, 10 MiB by default. The
+	// larger bodies are forwarded untouched.
+	MaxBodySize int64
+
+	mu     sync.RWMutex
+	chains map[string][]step
+}
+
+type kind int
+
+const (
+	kindJSON kind = iota
+	kindXML
+	kindHTML
+	kindText
+)
+
+// step is a transformer of a chain.
+type step struct {
+	kind kind
+	json JSONFunc
+	xml  XMLFunc
+	html HTMLFunc
+	text TextFunc
+	// match, if set, selects the messages to which the step applies.
+	match func(ctx *goproxy.ProxyCtx) bool
+}
+
+func (r *Registry) add(contentType string, s step) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.chains == nil {
+		r.chains = make(map[string][]step)
+	}
+	contentType = strings.ToLower(contentType)
+	r.chains[contentType] = append(r.chains[contentType], s)
+}
+
+// JSON appends f to the chain of contentType.
+func (r *Registry) JSON(contentType string, f JSONFunc) {
+	r.add(contentType, step{kind: kindJSON, json: f})
+}
+
+// XML appends f to the chain of contentType.
+func (r *Registry) XML(contentType string, f XMLFunc) {
+	r.add(contentType, step{kind: kindXML, xml: f})
+}
+
+// HTML appends f to the chain of contentType.
+func (r *Registry) HTML(contentType string, f HTMLFunc) {
+	r.add(contentType, step{kind: kindHTML, html: f})
+}
+
+// Text appends f to the chain of contentType.
+func (r *Registry) Text(contentType string, f TextFunc) {
+	r.add(contentType, step{kind: kindText, text: f})
+}
+
+// steps returns the transformers of the media type mediaType applying to
+// the message of ctx.
+func (r *Registry) steps(mediaType string, ctx *goproxy.ProxyCtx) []step {
+	r.mu.RLock()
+	chains := [][]step{r.chains[mediaType]}
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 {
+		chains = append(chains, r.chains[mediaType[:i]+"/*"])
+	}
+	if i := strings.LastIndexByte(mediaType, '+'); i >= 0 {
+		chains = append(chains, r.chains["*"+mediaType[i:]])
+	}
+	r.mu.RUnlock()
+	var steps []step
+	for _, chain := range chains {
+		for _, s := range chain {
+			if s.match == nil || s.match(ctx) {
+				steps = append(steps, s)
+			}
+		}
+	}
+	return steps
+}
+
+func (r *Registry) maxBodySize() int64 {
+	if r.MaxBodySize <= 0 {
+		return 10 << 20
+	}
+	return r.MaxBodySize
+}
+
+var errTooLarge = errors.New("transform: body too large")
+
+// readBody reads body up to the limit, decoding its encoding. It returns
+// the reader of the whole body when it isn't read.
+func (r *Registry) readBody(body io.ReadCloser, encoding string) ([]byte, io.ReadCloser, error) {
+	limit := r.maxBodySize()
+	raw, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, http.NoBody, err
+	}
+	if int64(len(raw)) > limit {
+		return nil, struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), body), body}, errTooLarge
+	}
+	body.Close()
+	rest := io.NopCloser(bytes.NewReader(raw))
+
+	var dec io.Reader
+	switch encoding {
+	case "", "identity":
+		return raw, rest, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, rest, err
+		}
+		dec = zr
+	case "deflate":
+		dec = flate.NewReader(bytes.NewReader(raw))
+	default:
+		return nil, rest, errors.New("transform: unsupported content encoding " + encoding)
+	}
+	decoded, err := io.ReadAll(io.LimitReader(dec, limit+1))
+	if err != nil {
+		return nil, rest, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, rest, errTooLarge
+	}
+	return decoded, rest, nil
+}
+
+// apply runs the chain of the content type of h on body. It returns the
+// transformed body and its content type, or the reader of the untouched
+// body and false.
+func (r *Registry) apply(h http.Header, body io.ReadCloser, ctx *goproxy.ProxyCtx) ([]byte, string, io.ReadCloser, bool) {
+	if body == nil || body == http.NoBody {
+		return nil, "", body, false
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return nil, "", body, false
+	}
+	steps := r.steps(mediaType, ctx)
+	if len(steps) == 0 {
+		return nil, "", body, false
+	}
+	data, rest, err := r.readBody(body, strings.ToLower(h.Get("Content-Encoding")))
+	if errors.Is(err, errTooLarge) {
+		ctx.Logf("transform: not transforming the large %s body", mediaType)
+		return nil, "", rest, false
+	}
+	if err != nil {
+		ctx.Warnf("transform: not transforming the %s body: %v", mediaType, err)
+		return nil, "", rest, false
+	}
+	out, err := run(steps, data, params["charset"], ctx)
+	if err != nil {
+		ctx.Warnf("transform: can't transform the %s body: %v", mediaType, err)
+		return nil, "", rest, false
+	}
+	if _, ok := params["charset"]; ok {
+		params["charset"] = "utf-8"
+	}
+	return out, mime.FormatMediaType(mediaType, params), nil, true
+}
+
+// setBody sets the transformed body in h.
+func setBody(h http.Header, body []byte, contentType string) {
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// RequestHandler returns a ReqHandler transforming the request bodies.
+func (r *Registry) RequestHandler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		out, contentType, rest, ok := r.apply(req.Header, req.Body, ctx)
+		if !ok {
+			req.Body = rest
+			return req, nil
+		}
+		setBody(req.Header, out, contentType)
+		req.Body = io.NopCloser(bytes.NewReader(out))
+		req.ContentLength = int64(len(out))
+		req.TransferEncoding = nil
+		return req, nil
+	})
+}
+
+// ResponseHandler returns a RespHandler transforming the response bodies.
+// The partial contents are left unchanged, see goproxy.DisableRanges.
+func (r *Registry) ResponseHandler() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || ctx.Req.Method == http.MethodHead || resp.StatusCode == http.StatusPartialContent {
+			return resp
+		}
+		out, contentType, rest, ok := r.apply(resp.Header, resp.Body, ctx)
+		if !ok {
+			resp.Body = rest
+			return resp
+		}
+		setBody(resp.Header, out, contentType)
+		resp.Body = io.NopCloser(bytes.NewReader(out))
+		resp.ContentLength = int64(len(out))
+		resp.TransferEncoding = nil
+		resp.Uncompressed = false
+		return resp
+	})
+}
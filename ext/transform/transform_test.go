@@ -0,0 +1,196 @@
+package transform_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/transform"
+	"golang.org/x/net/html"
+)
+
+func newProxy(t *testing.T, r *transform.Registry, contentType, encoding string, body []byte) (*http.Client, string, func()) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		if req.Method == http.MethodPost {
+			w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+			io.Copy(w, req.Body)
+			return
+		}
+		w.Write(body)
+	}))
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(r.RequestHandler())
+	proxy.OnResponse().Do(r.ResponseHandler())
+	s := httptest.NewServer(proxy)
+	u, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u), DisableCompression: true}}
+	return client, upstream.URL, func() {
+		s.Close()
+		upstream.Close()
+	}
+}
+
+func get(t *testing.T, client *http.Client, u string) (string, http.Header) {
+	t.Helper()
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body), resp.Header
+}
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestJSON(t *testing.T) {
+	r := &transform.Registry{}
+	r.JSON("application/json", func(v any, ctx *goproxy.ProxyCtx) (any, error) {
+		m := v.(map[string]any)
+		delete(m, "tracking")
+		m["proxied"] = true
+		return m, nil
+	})
+	client, upstream, done := newProxy(t, r, "application/json", "gzip",
+		gzipped(`{"id": 12345678901234567890, "tracking": "x", "html": "<b>"}`))
+	defer done()
+
+	body, h := get(t, client, upstream)
+	if want := `{"html":"<b>","id":12345678901234567890,"proxied":true}`; body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+	if h.Get("Content-Encoding") != "" {
+		t.Errorf("Content-Encoding = %q", h.Get("Content-Encoding"))
+	}
+}
+
+func TestWildcardsAndChain(t *testing.T) {
+	var order []string
+	r := &transform.Registry{}
+	r.Text("*+json", func(s string, ctx *goproxy.ProxyCtx) (string, error) {
+		order = append(order, "suffix")
+		return strings.ReplaceAll(s, "old", "new"), nil
+	})
+	r.JSON("application/problem+json", func(v any, ctx *goproxy.ProxyCtx) (any, error) {
+		order = append(order, "exact")
+		v.(map[string]any)["detail"] = "old"
+		return v, nil
+	})
+	client, upstream, done := newProxy(t, r, "application/problem+json", "", []byte(`{"title":"old"}`))
+	defer done()
+
+	body, _ := get(t, client, upstream)
+	if body != `{"detail":"new","title":"new"}` {
+		t.Errorf("body = %s", body)
+	}
+	if strings.Join(order, ",") != "exact,suffix" {
+		t.Errorf("order = %v", order)
+	}
+}
+
+func TestXML(t *testing.T) {
+	r := &transform.Registry{}
+	r.XML("text/xml", func(tokens []xml.Token, ctx *goproxy.ProxyCtx) ([]xml.Token, error) {
+		for i, tok := range tokens {
+			if c, ok := tok.(xml.CharData); ok && string(c) == "café" {
+				tokens[i] = xml.CharData("tea")
+			}
+		}
+		return tokens, nil
+	})
+	doc := "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" +
+		`<s:Envelope xmlns:s="urn:soap"><s:Body a="1">caf` + "\xe9" + `</s:Body></s:Envelope>`
+	client, upstream, done := newProxy(t, r, "text/xml", "", []byte(doc))
+	defer done()
+
+	body, _ := get(t, client, upstream)
+	want := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		`<s:Envelope xmlns:s="urn:soap"><s:Body a="1">tea</s:Body></s:Envelope>`
+	if body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+}
+
+func TestHTMLCharset(t *testing.T) {
+	r := &transform.Registry{}
+	r.HTML("text/html", func(doc *html.Node, ctx *goproxy.ProxyCtx) error {
+		var walk func(n *html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.ElementNode && n.Data == "script" {
+				n.Parent.RemoveChild(n)
+				return
+			}
+			for c := n.FirstChild; c != nil; {
+				next := c.NextSibling
+				walk(c)
+				c = next
+			}
+		}
+		walk(doc)
+		return nil
+	})
+	client, upstream, done := newProxy(t, r, "text/html; charset=iso-8859-1", "",
+		[]byte("<p>caf\xe9</p><script>track()</script>"))
+	defer done()
+
+	body, h := get(t, client, upstream)
+	if want := "<html><head></head><body><p>café</p></body></html>"; body != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+	if h.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", h.Get("Content-Type"))
+	}
+}
+
+func TestRequestAndErrors(t *testing.T) {
+	r := &transform.Registry{}
+	r.Text("text/plain", func(s string, ctx *goproxy.ProxyCtx) (string, error) {
+		if s == "fail" {
+			return "", errors.New("refused")
+		}
+		return strings.ToUpper(s), nil
+	})
+	r.JSON("application/json", func(v any, ctx *goproxy.ProxyCtx) (any, error) {
+		return "unreachable", nil
+	})
+	client, upstream, done := newProxy(t, r, "application/json", "", []byte(`{invalid`))
+	defer done()
+
+	if body, _ := get(t, client, upstream); body != `{invalid` {
+		t.Errorf("invalid JSON body = %s", body)
+	}
+	for in, want := range map[string]string{"hello": "HELLO", "fail": "fail"} {
+		resp, err := client.Post(upstream, "text/plain", strings.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		// The upstream echoes the request, whose response is transformed again.
+		if string(body) != want {
+			t.Errorf("POST %s = %s, want %s", in, body, want)
+		}
+	}
+}
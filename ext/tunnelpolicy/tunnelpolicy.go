@@ -0,0 +1,70 @@
+// Package tunnelpolicy restricts the protocols tunneled with CONNECT,
+// sniffed from their first bytes, since an open CONNECT on :443 is
+// routinely abused to tunnel SSH, mail or peer-to-peer traffic:
+//
+//	p := &tunnelpolicy.Policy{Deny: []goproxy.Protocol{goproxy.ProtocolSSH, goproxy.ProtocolBitTorrent}}
+//	proxy.OnRequest().HandleConnect(p)
+//
+// The denied tunnels are closed once sniffed, after their CONNECT has been
+// accepted.
+package tunnelpolicy
+
+import (
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Policy allows or denies the tunnels by protocol.
+type Policy struct {
+	// Allow, if not empty, lists the only protocols allowed.
+	Allow []goproxy.Protocol
+	// Deny lists the protocols denied.
+	Deny []goproxy.Protocol
+	// Mitm intercepts the allowed TLS and HTTP tunnels, which are relayed
+	// otherwise.
+	Mitm bool
+	// OnDeny, when set, is called with the denied tunnels, to log or count
+	// them.
+	OnDeny func(proto goproxy.Protocol, host string, ctx *goproxy.ProxyCtx)
+}
+
+func contains(protos []goproxy.Protocol, proto goproxy.Protocol) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns whether the tunnels of proto are allowed.
+func (p *Policy) Allowed(proto goproxy.Protocol) bool {
+	if len(p.Allow) > 0 && !contains(p.Allow, proto) {
+		return false
+	}
+	return !contains(p.Deny, proto)
+}
+
+// Sniff is the Sniff func of the ConnectAction of the policy.
+func (p *Policy) Sniff(proto goproxy.Protocol, prefix []byte, host string, ctx *goproxy.ProxyCtx) goproxy.ConnectActionLiteral {
+	if !p.Allowed(proto) {
+		ctx.Warnf("tunnelpolicy: denied %v tunnel to %s", proto, host)
+		if p.OnDeny != nil {
+			p.OnDeny(proto, host, ctx)
+		}
+		return goproxy.ConnectReject
+	}
+	if p.Mitm {
+		return goproxy.ConnectSniff
+	}
+	return goproxy.ConnectAccept
+}
+
+// HandleConnect implements goproxy.HttpsHandler, sniffing all the tunnels.
+// It can be combined with the conditions of the CONNECT requests:
+//
+//	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(":443$"))).HandleConnect(p)
+func (p *Policy) HandleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	action := *goproxy.SniffConnect
+	action.Sniff = p.Sniff
+	return &action, host
+}
@@ -0,0 +1,107 @@
+package tunnelpolicy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/tunnelpolicy"
+)
+
+// serve runs a server greeting its clients with greeting, if any, and
+// echoing them.
+func serve(t *testing.T, greeting string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, greeting)
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func tunnel(t *testing.T, proxy, host string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %v %v", host, resp, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, r
+}
+
+func TestPolicy(t *testing.T) {
+	var denied int64
+	p := &tunnelpolicy.Policy{
+		Deny: []goproxy.Protocol{goproxy.ProtocolSSH, goproxy.ProtocolSMTP, goproxy.ProtocolBitTorrent},
+		OnDeny: func(proto goproxy.Protocol, host string, ctx *goproxy.ProxyCtx) {
+			atomic.AddInt64(&denied, 1)
+		},
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.SniffTimeout = 100 * time.Millisecond
+	proxy.OnRequest().HandleConnect(p)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+
+	ssh := serve(t, "SSH-2.0-OpenSSH_9.6\r\n")
+	smtp := serve(t, "220 mx.example.com ESMTP ready\r\n")
+	echo := serve(t, "")
+
+	for name, tt := range map[string]struct {
+		host, send string
+	}{
+		"ssh":        {ssh, "SSH-2.0-OpenSSH_9.6\r\n"},
+		"smtp":       {smtp, ""},
+		"bittorrent": {echo, "\x13BitTorrent protocol\x00\x00\x00\x00\x00\x00\x00\x00"},
+	} {
+		conn, r := tunnel(t, addr, tt.host)
+		if tt.send != "" {
+			io.WriteString(conn, tt.send)
+		}
+		if b, err := io.ReadAll(r); err != nil || len(b) > 0 {
+			t.Errorf("%s tunnel not closed: %q %v", name, b, err)
+		}
+	}
+	if n := atomic.LoadInt64(&denied); n != 3 {
+		t.Errorf("%d tunnels denied", n)
+	}
+
+	conn, r := tunnel(t, addr, echo)
+	io.WriteString(conn, "\x00ping\n")
+	if line, err := r.ReadString('\n'); err != nil || line != "\x00ping\n" {
+		t.Errorf("allowed tunnel: %q %v", line, err)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	p := &tunnelpolicy.Policy{Allow: []goproxy.Protocol{goproxy.ProtocolTLS, goproxy.ProtocolHTTP}}
+	if !p.Allowed(goproxy.ProtocolTLS) || p.Allowed(goproxy.ProtocolUnknown) || p.Allowed(goproxy.ProtocolSSH) {
+		t.Error("only TLS and HTTP should be allowed")
+	}
+}
@@ -0,0 +1,274 @@
+// Package upload decomposes the request bodies into their parts, the files
+// and fields of the multipart forms and the base64 payloads, such as the
+// data URLs, so that the DLP and antivirus rules act on every file rather
+// than on the raw body:
+//
+//	d := upload.New()
+//	d.Scan = func(p *upload.Part, ctx *goproxy.ProxyCtx) error {
+//		if bytes.HasPrefix(p.Data, []byte("MZ")) {
+//			return errors.New("executable upload")
+//		}
+//		return nil
+//	}
+//	proxy.OnRequest().Do(d)
+//	proxy.OnRequest(upload.FilenameMatches("*.exe", "*.dll")).DoFunc(block)
+//
+// The parts are exposed to the following rules with Parts. The bodies are
+// buffered, up to MaxBodySize, and still sent upstream unchanged.
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// Part is a file or a field of a request body.
+type Part struct {
+	// Field is the name of the form field, empty for the whole bodies.
+	Field string
+	// Filename is the name of the uploaded file, empty for the fields.
+	Filename string
+	// ContentType is the type declared by the client.
+	ContentType string
+	// DetectedType is the type detected from the content, as by
+	// http.DetectContentType.
+	DetectedType string
+	// Encoding is "base64" for the decoded payloads.
+	Encoding string
+	Size     int64
+	// SHA256 is the hash of the content, in hexadecimal.
+	SHA256 string
+	// Data is the content, decoded.
+	Data []byte
+}
+
+// Decomposer decomposes the request bodies.
+type Decomposer struct {
+	// MaxBodySize bounds the bodies decomposed, 32 MiB by default.
+	MaxBodySize int64
+	// BlockOversize rejects the bodies above MaxBodySize, which can't be
+	// scanned, instead of sending them without parts.
+	BlockOversize bool
+	// Scan, when set, scans every part: an error rejects the request with
+	// 403 Forbidden, the error being the reason.
+	Scan func(p *Part, ctx *goproxy.ProxyCtx) error
+}
+
+// New returns a Decomposer with the default settings.
+func New() *Decomposer {
+	return &Decomposer{}
+}
+
+type partsKey struct{}
+
+// Parts returns the parts of the body of the request of ctx, nil when it
+// wasn't decomposed.
+func Parts(ctx *goproxy.ProxyCtx) []*Part {
+	parts, _ := ctx.Value(partsKey{}).([]*Part)
+	return parts
+}
+
+// maxDepth bounds the nesting of the multipart parts.
+const maxDepth = 3
+
+// dataURL matches the base64 data URLs, such as those of the images pasted
+// in the rich text editors.
+var dataURL = regexp.MustCompile(`data:([a-zA-Z0-9!#$&^_.+-]+/[a-zA-Z0-9!#$&^_.+-]+)?(?:;[a-zA-Z0-9-]+=[^;,]+)*;base64,([A-Za-z0-9+/]+={0,2})`)
+
+func newPart(field, filename, contentType, encoding string, data []byte) *Part {
+	sum := sha256.Sum256(data)
+	return &Part{
+		Field:        field,
+		Filename:     filename,
+		ContentType:  contentType,
+		DetectedType: http.DetectContentType(data),
+		Encoding:     encoding,
+		Size:         int64(len(data)),
+		SHA256:       hex.EncodeToString(sum[:]),
+		Data:         data,
+	}
+}
+
+// dataURLs returns the parts of the data URLs of data.
+func dataURLs(field string, data []byte) []*Part {
+	var parts []*Part
+	for _, m := range dataURL.FindAllSubmatch(data, -1) {
+		decoded, err := base64.StdEncoding.DecodeString(string(m[2]))
+		if err != nil {
+			continue
+		}
+		parts = append(parts, newPart(field, "", string(m[1]), "base64", decoded))
+	}
+	return parts
+}
+
+// Decompose returns the parts of body, of type contentType.
+func Decompose(contentType string, body []byte) []*Part {
+	return decompose("", contentType, "", body, 0)
+}
+
+func decompose(field, contentType, encoding string, body []byte, depth int) []*Part {
+	if strings.EqualFold(encoding, "base64") {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+		if err == nil {
+			body = decoded
+		} else {
+			encoding = ""
+		}
+	}
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxDepth:
+		var parts []*Part
+		r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := r.NextRawPart()
+			if err != nil {
+				break
+			}
+			// The raw parts keep their Content-Transfer-Encoding.
+			data, err := io.ReadAll(p)
+			if err != nil {
+				break
+			}
+			name := p.FormName()
+			if name == "" {
+				name = field
+			}
+			if filename := p.FileName(); filename != "" {
+				partEncoding := p.Header.Get("Content-Transfer-Encoding")
+				if strings.EqualFold(partEncoding, "base64") {
+					if decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil))); err == nil {
+						parts = append(parts, newPart(name, filename, p.Header.Get("Content-Type"), "base64", decoded))
+						continue
+					}
+				}
+				parts = append(parts, newPart(name, filename, p.Header.Get("Content-Type"), "", data))
+				continue
+			}
+			parts = append(parts, decompose(name, p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), data, depth+1)...)
+		}
+		return parts
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		var parts []*Part
+		for name, vs := range values {
+			for _, v := range vs {
+				parts = append(parts, dataURLs(name, []byte(v))...)
+			}
+		}
+		return parts
+	}
+	parts := []*Part{newPart(field, "", contentType, encoding, body)}
+	return append(parts, dataURLs(field, body)...)
+}
+
+// Handle implements goproxy.ReqHandler, exposing the parts of the body.
+func (d *Decomposer) Handle(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	limit := d.MaxBodySize
+	if limit <= 0 {
+		limit = 32 << 20
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		ctx.Warnf("upload: can't read the body of %v: %v", req.URL, err)
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, "Cannot read the request body")
+	}
+	if int64(len(body)) > limit {
+		if d.BlockOversize {
+			req.Body.Close()
+			ctx.Error = &goproxy.ErrBlockedByRule{RuleID: "upload", Reason: "body too large to be scanned"}
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusRequestEntityTooLarge, "Request body too large to be scanned")
+		}
+		ctx.Logf("upload: the body of %v is too large to be decomposed", req.URL)
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return req, nil
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	parts := Decompose(req.Header.Get("Content-Type"), body)
+	ctx.SetValue(partsKey{}, parts)
+	if d.Scan == nil {
+		return req, nil
+	}
+	for _, p := range parts {
+		if err := d.Scan(p, ctx); err != nil {
+			ctx.Warnf("upload: rejecting %q of %v: %v", p.Filename, req.URL, err)
+			ctx.Error = &goproxy.ErrBlockedByRule{RuleID: "upload", Reason: err.Error()}
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Upload rejected: "+err.Error())
+		}
+	}
+	return req, nil
+}
+
+// HasPart returns a ReqCondition testing whether a part of the body of the
+// request, decomposed by a Decomposer, matches.
+func HasPart(match func(p *Part) bool) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		for _, p := range Parts(ctx) {
+			if match(p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// FilenameMatches returns a ReqCondition testing whether a file of the body
+// has a name matching one of the patterns of path.Match, case-insensitively.
+func FilenameMatches(patterns ...string) goproxy.ReqConditionFunc {
+	return HasPart(func(p *Part) bool {
+		name := strings.ToLower(p.Filename)
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), name); ok && name != "" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// DetectedTypeIs returns a ReqCondition testing whether a part of the body
+// has one of the media types detected, whatever the type declared.
+func DetectedTypeIs(types ...string) goproxy.ReqConditionFunc {
+	return HasPart(func(p *Part) bool {
+		mediaType, _, _ := mime.ParseMediaType(p.DetectedType)
+		for _, t := range types {
+			if strings.EqualFold(t, mediaType) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// LargerThan returns a ReqCondition testing whether a part of the body is
+// larger than size bytes.
+func LargerThan(size int64) goproxy.ReqConditionFunc {
+	return HasPart(func(p *Part) bool {
+		return p.Size > size
+	})
+}
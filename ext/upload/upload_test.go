@@ -0,0 +1,119 @@
+package upload_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/ext/upload"
+)
+
+func multipartBody(t *testing.T) (string, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("comment", "see attached")
+	f, _ := w.CreateFormFile("file", "report.pdf")
+	f.Write([]byte("%PDF-1.7 report"))
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="tool"; filename="Tool.EXE"`)
+	h.Set("Content-Type", "image/png")
+	h.Set("Content-Transfer-Encoding", "base64")
+	f, _ = w.CreatePart(h)
+	f.Write([]byte(base64.StdEncoding.EncodeToString([]byte("MZ\x90\x00 binary"))))
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n image"))
+	w.WriteField("html", `<p><img src="data:image/png;base64,`+png+`"></p>`)
+	w.Close()
+	return w.FormDataContentType(), buf.Bytes()
+}
+
+func TestDecompose(t *testing.T) {
+	contentType, body := multipartBody(t)
+	parts := upload.Decompose(contentType, body)
+	if len(parts) != 5 {
+		t.Fatalf("Expected 5 parts, got %d", len(parts))
+	}
+	for i, expected := range []struct {
+		field, filename, detected, encoding string
+		data                                string
+	}{
+		{"comment", "", "text/plain; charset=utf-8", "", "see attached"},
+		{"file", "report.pdf", "application/pdf", "", "%PDF-1.7 report"},
+		{"tool", "Tool.EXE", "application/octet-stream", "base64", "MZ\x90\x00 binary"},
+		{"html", "", "text/html; charset=utf-8", "", ""},
+		{"html", "", "image/png", "base64", "\x89PNG\r\n\x1a\n image"},
+	} {
+		p := parts[i]
+		if p.Field != expected.field || p.Filename != expected.filename || p.DetectedType != expected.detected || p.Encoding != expected.encoding {
+			t.Errorf("Expected part %d to be %+v, got %+v", i, expected, p)
+		}
+		if expected.data != "" && (string(p.Data) != expected.data || p.Size != int64(len(expected.data))) {
+			t.Errorf("Expected part %d to be %q, got %q", i, expected.data, p.Data)
+		}
+	}
+	if len(parts[1].SHA256) != 64 {
+		t.Errorf("Expected the SHA-256 of the parts, got %q", parts[1].SHA256)
+	}
+}
+
+func TestDecomposer(t *testing.T) {
+	contentType, body := multipartBody(t)
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://upload.example.com/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		return req
+	}
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+	d := upload.New()
+	req, resp := d.Handle(newRequest(), ctx)
+	if resp != nil || len(upload.Parts(ctx)) != 5 {
+		t.Fatalf("Expected the parts of the body, got %d", len(upload.Parts(ctx)))
+	}
+	var forwarded bytes.Buffer
+	forwarded.ReadFrom(req.Body)
+	if !bytes.Equal(forwarded.Bytes(), body) {
+		t.Error("Expected the body to be sent unchanged")
+	}
+	if !upload.FilenameMatches("*.exe")(req, ctx) || upload.FilenameMatches("*.zip")(req, ctx) {
+		t.Error("Expected the executable to match its filename")
+	}
+	if !upload.DetectedTypeIs("application/pdf")(req, ctx) || !upload.LargerThan(10)(req, ctx) || upload.LargerThan(100)(req, ctx) {
+		t.Error("Expected the conditions on the parts to match")
+	}
+
+	d.Scan = func(p *upload.Part, ctx *goproxy.ProxyCtx) error {
+		if bytes.HasPrefix(p.Data, []byte("MZ")) {
+			return errors.New("executable upload")
+		}
+		return nil
+	}
+	ctx = &goproxy.ProxyCtx{Proxy: ctx.Proxy}
+	if _, resp = d.Handle(newRequest(), ctx); resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatal("Expected the executable to be rejected")
+	}
+	var blocked *goproxy.ErrBlockedByRule
+	if !errors.As(ctx.Error, &blocked) || blocked.Reason != "executable upload" {
+		t.Errorf("Expected the request to be blocked, got %v", ctx.Error)
+	}
+
+	d.MaxBodySize = 10
+	d.BlockOversize = true
+	if _, resp = d.Handle(newRequest(), ctx); resp == nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Expected the oversize body to be rejected")
+	}
+	d.BlockOversize = false
+	ctx = &goproxy.ProxyCtx{Proxy: ctx.Proxy}
+	req, resp = d.Handle(newRequest(), ctx)
+	forwarded.Reset()
+	forwarded.ReadFrom(req.Body)
+	if resp != nil || upload.Parts(ctx) != nil || !strings.HasPrefix(forwarded.String(), "--") || forwarded.Len() != len(body) {
+		t.Error("Expected the oversize body to be sent whole, without parts")
+	}
+}
@@ -0,0 +1,253 @@
+package goproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TLSFingerprint is the fingerprint of the TLS client hello of a MITM'd
+// client, identifying its TLS library whatever its User-Agent claims.
+type TLSFingerprint struct {
+	// JA3 is the JA3 string of the hello: its version, cipher suites,
+	// extensions, curves and point formats, without the GREASE values.
+	JA3 string
+	// JA3Hash is the MD5 of JA3, in hexadecimal, as in the JA3 lists.
+	JA3Hash string
+	// JA4 is the JA4 fingerprint of the hello, such as
+	// t13d1516h2_8daaf6152771_e5627efa2ab1. Unlike JA3, it doesn't change
+	// with the order of the extensions, which the browsers randomize.
+	JA4 string
+	// ServerName is the SNI of the hello.
+	ServerName string
+	// ALPN are the protocols offered by the client.
+	ALPN []string
+}
+
+// isGREASE returns whether v is a GREASE value of RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	kept := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// truncatedHash returns the first 12 hexadecimal digits of the SHA-256 of
+// s, or 000000000000 for an empty s, as JA4.
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// fingerprintHello returns the fingerprint of hello, whose extensions are
+// those of raw, the ClientHello record read from the client. It returns nil
+// when raw isn't a whole ClientHello.
+func fingerprintHello(hello *tls.ClientHelloInfo, raw []byte) *TLSFingerprint {
+	parsed, ok := SniffClientHello(raw)
+	if !ok {
+		return nil
+	}
+	extensions := withoutGREASE(parsed.Extensions)
+	ciphers := withoutGREASE(hello.CipherSuites)
+	var version uint16
+	for _, v := range withoutGREASE(hello.SupportedVersions) {
+		if v > version {
+			version = v
+		}
+	}
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		if !isGREASE(uint16(c)) {
+			curves = append(curves, uint16(c))
+		}
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+
+	fp := &TLSFingerprint{ServerName: hello.ServerName, ALPN: hello.SupportedProtos}
+	// The legacy version of the TLS 1.3 hellos is TLS 1.2.
+	legacyVersion := version
+	if legacyVersion > tls.VersionTLS12 {
+		legacyVersion = tls.VersionTLS12
+	}
+	fp.JA3 = fmt.Sprintf("%d,%s,%s,%s,%s", legacyVersion,
+		joinDecimal(ciphers), joinDecimal(extensions), joinDecimal(curves), joinDecimal(points))
+	sum := md5.Sum([]byte(fp.JA3))
+	fp.JA3Hash = hex.EncodeToString(sum[:])
+
+	versions := map[uint16]string{
+		tls.VersionTLS10: "10", tls.VersionTLS11: "11", tls.VersionTLS12: "12", tls.VersionTLS13: "13",
+	}
+	tlsVersion, ok := versions[version]
+	if !ok {
+		tlsVersion = "00"
+	}
+	sni := "i"
+	if hello.ServerName != "" && net.ParseIP(hello.ServerName) == nil {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		p := hello.SupportedProtos[0]
+		alpn = alpnChars(p[0], p[len(p)-1])
+	}
+	count := func(n int) string {
+		if n > 99 {
+			n = 99
+		}
+		return fmt.Sprintf("%02d", n)
+	}
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	// The SNI and ALPN extensions are in the first part only.
+	var sortedExtensions []uint16
+	for _, e := range extensions {
+		if e != 0x0000 && e != 0x0010 {
+			sortedExtensions = append(sortedExtensions, e)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+	signatures := make([]uint16, 0, len(hello.SignatureSchemes))
+	for _, s := range hello.SignatureSchemes {
+		if !isGREASE(uint16(s)) {
+			signatures = append(signatures, uint16(s))
+		}
+	}
+	extensionsPart := joinHex(sortedExtensions)
+	if len(signatures) > 0 {
+		extensionsPart += "_" + joinHex(signatures)
+	}
+	fp.JA4 = "t" + tlsVersion + sni + count(len(ciphers)) + count(len(extensions)) + alpn +
+		"_" + truncatedHash(joinHex(sortedCiphers)) + "_" + truncatedHash(extensionsPart)
+	return fp
+}
+
+// alpnChars returns the ALPN part of JA4 of the protocol starting with
+// first and ending with last: those characters, or the first and last
+// hexadecimal digits of their bytes when they aren't alphanumeric.
+func alpnChars(first, last byte) string {
+	alnum := func(b byte) bool {
+		return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+	}
+	if alnum(first) && alnum(last) {
+		return string([]byte{first, last})
+	}
+	return hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+}
+
+// helloRecorder records the first bytes read from the client, until the
+// ClientHello is fingerprinted, at most maxHelloRecord.
+type helloRecorder struct {
+	net.Conn
+	buf  []byte
+	done bool
+}
+
+func (c *helloRecorder) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if !c.done {
+		if len(c.buf)+n > maxHelloRecord {
+			c.done, c.buf = true, nil
+		} else {
+			c.buf = append(c.buf, p[:n]...)
+		}
+	}
+	return n, err
+}
+
+// fingerprinting returns conn recording the ClientHello, and a copy of
+// config recording its fingerprint in *fp.
+func fingerprinting(conn net.Conn, config *tls.Config, fp **TLSFingerprint) (net.Conn, *tls.Config) {
+	rec := &helloRecorder{Conn: conn}
+	config = config.Clone()
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		// The handshake reads the ClientHello whole before calling
+		// GetConfigForClient.
+		if !rec.done {
+			*fp = fingerprintHello(hello, rec.buf)
+			rec.done, rec.buf = true, nil
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+	return rec, config
+}
+
+// ClientFingerprint returns the fingerprint of the TLS client hello of a
+// MITM'd request. It returns nil for the other requests.
+func (ctx *ProxyCtx) ClientFingerprint() *TLSFingerprint {
+	return ctx.fingerprint
+}
+
+// JA3Is returns a ReqCondition testing whether the JA3 hash of the TLS
+// client hello of a MITM'd request is one of hashes.
+func JA3Is(hashes ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		fp := ctx.ClientFingerprint()
+		if fp == nil {
+			return false
+		}
+		for _, h := range hashes {
+			if strings.EqualFold(h, fp.JA3Hash) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// JA4Is returns a ReqCondition testing whether the JA4 fingerprint of the
+// TLS client hello of a MITM'd request is one of fingerprints.
+func JA4Is(fingerprints ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		fp := ctx.ClientFingerprint()
+		if fp == nil {
+			return false
+		}
+		for _, f := range fingerprints {
+			if f == fp.JA4 {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,272 @@
+// Package goproxytest provides utilities to test the handlers of a proxy.
+// New starts a proxy MITM'ing the HTTPS requests, recording the exchanges
+// of its clients:
+//
+//	p := goproxytest.New(t, func(proxy *goproxy.ProxyHttpServer) {
+//		proxy.OnRequest(goproxy.ReqHostIs("ads.example.com:443")).DoFunc(block)
+//	})
+//	client := p.Client()
+//	client.Get("https://ads.example.com/banner")
+//	p.ExpectBlocked(t, http.MethodGet, "https://ads.example.com/banner")
+//
+// The clients of the proxy trust its CA, and the proxy doesn't verify the
+// certificates of the servers, so that it can reach the httptest servers.
+package goproxytest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+)
+
+// ExpectTimeout bounds the wait for the exchanges of the assertions, which
+// are recorded once the response is sent to the client, possibly after the
+// client has read it.
+var ExpectTimeout = time.Second
+
+// Exchange is a request handled by the proxy.
+type Exchange struct {
+	// Method, URL and Header are those of the request received by the
+	// proxy, before its handlers.
+	Method string
+	URL    *url.URL
+	Header http.Header
+	// Mitm is whether the request was MITM'd.
+	Mitm bool
+	// Upstream is the request sent upstream by the proxy, without its body,
+	// nil when the handlers answered it.
+	Upstream *http.Request
+	// StatusCode and RespHeader are those of the response sent to the
+	// client, zero when the request failed with Err.
+	StatusCode int
+	RespHeader http.Header
+	Err        error
+}
+
+// Blocked returns whether the request was answered by the handlers without
+// reaching upstream.
+func (e *Exchange) Blocked() bool {
+	return e.Upstream == nil
+}
+
+// Proxy is a proxy started for a test.
+type Proxy struct {
+	*goproxy.ProxyHttpServer
+	Server *httptest.Server
+	// URL is the URL of the proxy, as set in the Proxy of the clients.
+	URL *url.URL
+
+	mu        sync.Mutex
+	pending   map[*goproxy.ProxyCtx]*Exchange
+	exchanges []*Exchange
+	changed   chan struct{}
+}
+
+// logger logs the messages of the proxy in the test, until it is done.
+type logger struct {
+	mu   sync.Mutex
+	t    testing.TB
+	done bool
+}
+
+func (l *logger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.done {
+		l.t.Logf(format, v...)
+	}
+}
+
+// New starts a proxy, configured by setup, if not nil, and stopped at the
+// end of the test. The CONNECT requests not handled by the handlers of
+// setup are MITM'd.
+func New(t testing.TB, setup func(proxy *goproxy.ProxyHttpServer)) *Proxy {
+	t.Helper()
+	proxy := goproxy.NewProxyHttpServer()
+	l := &logger{t: t}
+	proxy.Logger = l
+	proxy.Tr.Proxy = nil
+	p := &Proxy{
+		ProxyHttpServer: proxy,
+		pending:         make(map[*goproxy.ProxyCtx]*Exchange),
+		changed:         make(chan struct{}),
+	}
+	proxy.Subscribe(p.record, goproxy.EventRequestStarted, goproxy.EventRequestCompleted)
+	// Run first, to see the requests going upstream after the handlers.
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		next := ctx.NextRoundTripper()
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			p.sent(req, ctx)
+			return next.RoundTrip(req, ctx)
+		})
+		return req, nil
+	})
+	if setup != nil {
+		setup(proxy)
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+
+	p.Server = httptest.NewServer(proxy)
+	p.URL, _ = url.Parse(p.Server.URL)
+	t.Cleanup(func() {
+		p.Server.Close()
+		l.mu.Lock()
+		l.done = true
+		l.mu.Unlock()
+	})
+	return p
+}
+
+func (p *Proxy) record(e *goproxy.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.Type {
+	case goproxy.EventRequestStarted:
+		p.pending[e.Ctx] = &Exchange{
+			Method: e.Req.Method,
+			URL:    cloneURL(e.Req.URL),
+			Header: e.Req.Header.Clone(),
+			Mitm:   e.Ctx.IsMitm(),
+		}
+	case goproxy.EventRequestCompleted:
+		x := p.pending[e.Ctx]
+		if x == nil {
+			return
+		}
+		delete(p.pending, e.Ctx)
+		if e.Resp != nil {
+			x.StatusCode = e.Resp.StatusCode
+			x.RespHeader = e.Resp.Header.Clone()
+		} else {
+			x.Err = e.Err
+		}
+		p.exchanges = append(p.exchanges, x)
+		close(p.changed)
+		p.changed = make(chan struct{})
+	}
+}
+
+func (p *Proxy) sent(req *http.Request, ctx *goproxy.ProxyCtx) {
+	upstream := req.Clone(req.Context())
+	upstream.Body = nil
+	p.mu.Lock()
+	if x := p.pending[ctx]; x != nil {
+		x.Upstream = upstream
+	}
+	p.mu.Unlock()
+}
+
+func cloneURL(u *url.URL) *url.URL {
+	c := *u
+	if u.User != nil {
+		user := *u.User
+		c.User = &user
+	}
+	return &c
+}
+
+// Transport returns a transport using the proxy, trusting its CA.
+func (p *Proxy) Transport() *http.Transport {
+	tr := &http.Transport{}
+	p.Trust(tr)
+	return tr
+}
+
+// Client returns a client using the proxy, trusting its CA.
+func (p *Proxy) Client() *http.Client {
+	return &http.Client{Transport: p.Transport()}
+}
+
+// Trust makes tr use the proxy, and trust the CA of its MITM besides the
+// roots tr already trusts.
+func (p *Proxy) Trust(tr *http.Transport) {
+	tr.Proxy = http.ProxyURL(p.URL)
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	roots := tr.TLSClientConfig.RootCAs
+	if roots == nil {
+		roots, _ = x509.SystemCertPool()
+		if roots == nil {
+			roots = x509.NewCertPool()
+		}
+	} else {
+		roots = roots.Clone()
+	}
+	if ca, err := x509.ParseCertificate(goproxy.GoproxyCa.Certificate[0]); err == nil {
+		roots.AddCert(ca)
+	}
+	tr.TLSClientConfig.RootCAs = roots
+}
+
+// Exchanges returns the exchanges recorded, in the order they completed.
+func (p *Proxy) Exchanges() []*Exchange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Exchange(nil), p.exchanges...)
+}
+
+// Reset forgets the exchanges recorded.
+func (p *Proxy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exchanges = nil
+}
+
+// Find waits up to ExpectTimeout for an exchange of method and rawURL,
+// matching the URL received by the proxy, and returns it, nil if none.
+func (p *Proxy) Find(method, rawURL string) *Exchange {
+	deadline := time.NewTimer(ExpectTimeout)
+	defer deadline.Stop()
+	for {
+		p.mu.Lock()
+		for _, x := range p.exchanges {
+			if x.Method == method && x.URL.String() == rawURL {
+				p.mu.Unlock()
+				return x
+			}
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return nil
+		}
+	}
+}
+
+// ExpectRequest fails t unless a request of method to rawURL was sent
+// upstream, and returns its exchange.
+func (p *Proxy) ExpectRequest(t testing.TB, method, rawURL string) *Exchange {
+	t.Helper()
+	x := p.Find(method, rawURL)
+	switch {
+	case x == nil:
+		t.Errorf("goproxytest: no request %s %s", method, rawURL)
+	case x.Blocked():
+		t.Errorf("goproxytest: request %s %s blocked with %d, expected to be sent upstream", method, rawURL, x.StatusCode)
+	}
+	return x
+}
+
+// ExpectBlocked fails t unless a request of method to rawURL was answered
+// by the handlers, without reaching upstream, and returns its exchange.
+func (p *Proxy) ExpectBlocked(t testing.TB, method, rawURL string) *Exchange {
+	t.Helper()
+	x := p.Find(method, rawURL)
+	switch {
+	case x == nil:
+		t.Errorf("goproxytest: no request %s %s", method, rawURL)
+	case !x.Blocked():
+		t.Errorf("goproxytest: request %s %s sent upstream, expected to be blocked", method, rawURL)
+	}
+	return x
+}
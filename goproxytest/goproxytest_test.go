@@ -0,0 +1,97 @@
+package goproxytest_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/InsideOutSec/goproxy"
+	"github.com/InsideOutSec/goproxy/goproxytest"
+)
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestProxy(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello "+r.Header.Get("X-Test"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	p := goproxytest.New(t, func(proxy *goproxy.ProxyHttpServer) {
+		proxy.OnRequest(goproxy.UrlHasPrefix("/blocked")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked")
+		})
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			req.Header.Set("X-Test", "proxy")
+			return req, nil
+		})
+	})
+	client := p.Client()
+
+	for _, base := range []string{plain.URL, secure.URL} {
+		if code, body := get(t, client, base+"/ok"); code != http.StatusOK || body != "hello proxy" {
+			t.Errorf("got %d %q", code, body)
+		}
+		x := p.ExpectRequest(t, http.MethodGet, base+"/ok")
+		if x != nil && x.Upstream.Header.Get("X-Test") != "proxy" {
+			t.Errorf("upstream header %q", x.Upstream.Header.Get("X-Test"))
+		}
+		if x != nil && x.Mitm != strings.HasPrefix(base, "https:") {
+			t.Errorf("%s: mitm %v", base, x.Mitm)
+		}
+
+		if code, _ := get(t, client, base+"/blocked"); code != http.StatusForbidden {
+			t.Errorf("got %d", code)
+		}
+		if x := p.ExpectBlocked(t, http.MethodGet, base+"/blocked"); x != nil && x.StatusCode != http.StatusForbidden {
+			t.Errorf("recorded %d", x.StatusCode)
+		}
+	}
+	if n := len(p.Exchanges()); n != 4 {
+		t.Errorf("recorded %d exchanges", n)
+	}
+	p.Reset()
+	if n := len(p.Exchanges()); n != 0 {
+		t.Errorf("recorded %d exchanges after Reset", n)
+	}
+}
+
+func TestExpectFails(t *testing.T) {
+	p := goproxytest.New(t, nil)
+	timeout := goproxytest.ExpectTimeout
+	goproxytest.ExpectTimeout = 10 * time.Millisecond
+	defer func() { goproxytest.ExpectTimeout = timeout }()
+	ft := &fakeT{TB: t}
+	p.ExpectRequest(ft, http.MethodGet, "http://example.com/")
+	if !ft.failed {
+		t.Error("ExpectRequest didn't fail without request")
+	}
+}
+
+// fakeT records the failures of the assertions.
+type fakeT struct {
+	testing.TB
+	failed bool
+}
+
+func (f *fakeT) Errorf(format string, args ...any) {
+	f.failed = true
+}
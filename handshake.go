@@ -0,0 +1,87 @@
+package goproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// HandshakeStats are the counters of the MITM handshakes.
+type HandshakeStats struct {
+	// Active is the number of handshakes in progress, including the
+	// signature of their certificate.
+	Active int64
+	// Queued is the number of handshakes waiting for a slot.
+	Queued    int64
+	Completed int64
+	Failed    int64
+	// Rejected is the number of tunnels rejected after waiting
+	// HandshakeQueueTimeout.
+	Rejected int64
+}
+
+// handshakeLimiter bounds the concurrent MITM handshakes.
+type handshakeLimiter struct {
+	stats HandshakeStats
+	slots chan struct{}
+}
+
+func (proxy *ProxyHttpServer) handshakes() *handshakeLimiter {
+	proxy.handshakeOnce.Do(func() {
+		proxy.handshake = &handshakeLimiter{}
+		if proxy.MaxHandshakes > 0 {
+			proxy.handshake.slots = make(chan struct{}, proxy.MaxHandshakes)
+		}
+	})
+	return proxy.handshake
+}
+
+// acquireHandshake waits for a handshake slot, for HandshakeQueueTimeout at
+// most.
+func (proxy *ProxyHttpServer) acquireHandshake() bool {
+	l := proxy.handshakes()
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			atomic.AddInt64(&l.stats.Queued, 1)
+			timeout := time.NewTimer(proxy.HandshakeQueueTimeout)
+			select {
+			case l.slots <- struct{}{}:
+				timeout.Stop()
+				atomic.AddInt64(&l.stats.Queued, -1)
+			case <-timeout.C:
+				atomic.AddInt64(&l.stats.Queued, -1)
+				atomic.AddInt64(&l.stats.Rejected, 1)
+				return false
+			}
+		}
+	}
+	atomic.AddInt64(&l.stats.Active, 1)
+	return true
+}
+
+// releaseHandshake frees the slot of a finished handshake.
+func (proxy *ProxyHttpServer) releaseHandshake(err error) {
+	l := proxy.handshakes()
+	atomic.AddInt64(&l.stats.Active, -1)
+	if err != nil {
+		atomic.AddInt64(&l.stats.Failed, 1)
+	} else {
+		atomic.AddInt64(&l.stats.Completed, 1)
+	}
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// HandshakeStats returns the counters of the MITM handshakes.
+func (proxy *ProxyHttpServer) HandshakeStats() HandshakeStats {
+	l := proxy.handshakes()
+	return HandshakeStats{
+		Active:    atomic.LoadInt64(&l.stats.Active),
+		Queued:    atomic.LoadInt64(&l.stats.Queued),
+		Completed: atomic.LoadInt64(&l.stats.Completed),
+		Failed:    atomic.LoadInt64(&l.stats.Failed),
+		Rejected:  atomic.LoadInt64(&l.stats.Rejected),
+	}
+}
@@ -1,6 +1,7 @@
 package goproxy
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"strings"
@@ -10,12 +11,18 @@ import (
 func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request) {
 	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy}
 
-	ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
 	if !r.URL.IsAbs() {
+		ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
 		proxy.NonproxyHandler.ServeHTTP(w, r)
 		return
 	}
-	r, resp := proxy.filterRequest(r, ctx)
+	start := proxy.requestStarted(ctx)
+	ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
+	var resp *http.Response
+	defer func() { proxy.requestCompleted(ctx, resp, start) }()
+	keepTrailers(r)
+	r, resp = proxy.filterRequest(r, ctx)
+	proxy.trackRequest(r, ctx)
 
 	if resp == nil {
 		if !proxy.KeepHeader {
@@ -25,7 +32,7 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 		var err error
 		resp, err = ctx.RoundTrip(r)
 		if err != nil {
-			ctx.Error = err
+			ctx.Error = classifyError(err)
 		}
 	}
 
@@ -39,15 +46,25 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 	resp = proxy.filterResponse(resp, ctx)
 
 	if resp == nil {
+		if errors.Is(ctx.Error, http.ErrAbortHandler) {
+			// The request handlers asked to drop the client connection,
+			// without sending any response.
+			ctx.Logf("Aborting connection to client: %v", ctx.Error)
+			abortConn(ctx, w)
+			return
+		}
 		var errorString string
+		if proxy.RequestIDHeader != "" {
+			w.Header().Set(proxy.RequestIDHeader, ctx.RequestID())
+		}
 		if ctx.Error != nil {
 			errorString = "error read response " + r.URL.Host + " : " + ctx.Error.Error()
-			ctx.Logf(errorString)
-			http.Error(w, ctx.Error.Error(), http.StatusInternalServerError)
+			ctx.Logf("%s (%s)", errorString, ErrorClass(ctx.Error))
+			http.Error(w, ctx.Error.Error()+"\nrequest ID: "+ctx.RequestID(), http.StatusInternalServerError)
 		} else {
 			errorString = "error read response " + r.URL.Host
 			ctx.Logf(errorString)
-			http.Error(w, errorString, http.StatusInternalServerError)
+			http.Error(w, errorString+"\nrequest ID: "+ctx.RequestID(), http.StatusInternalServerError)
 		}
 		return
 	}
@@ -61,7 +78,23 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 	if origBody != resp.Body {
 		resp.Header.Del("Content-Length")
 	}
+	if !ctx.Req.ProtoAtLeast(1, 1) {
+		// The connections of the HTTP/1.0 clients are kept alive by
+		// net/http when they ask for it and the response length is known,
+		// regardless of the upstream connection.
+		resp.Header.Del("Connection")
+		resp.Header.Del("Keep-Alive")
+	}
 	copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
+	// The trailers known before the body are announced, the others are
+	// sent as well once the body is copied.
+	announced := make(map[string]bool, len(resp.Trailer))
+	if len(resp.Trailer) > 0 {
+		w.Header().Set("Trailer", trailerNames(resp.Trailer))
+		for k := range resp.Trailer {
+			announced[k] = true
+		}
+	}
 	w.WriteHeader(resp.StatusCode)
 
 	if isWebSocketHandshake(resp.Header) {
@@ -89,9 +122,48 @@ func (proxy *ProxyHttpServer) handleHttp(w http.ResponseWriter, r *http.Request)
 		copyWriter = &flushWriter{w: w}
 	}
 
-	nr, err := io.Copy(copyWriter, resp.Body)
+	nr, err := copyBuffer(copyWriter, resp.Body)
 	if err := resp.Body.Close(); err != nil {
 		ctx.Warnf("Can't close response body %v", err)
 	}
+	for k, vv := range resp.Trailer {
+		if !announced[k] {
+			k = http.TrailerPrefix + k
+		}
+		w.Header()[k] = vv
+	}
 	ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+	if err != nil {
+		// The connection is aborted, for the client not to take the body
+		// read so far, when chunked, for the whole body. What was written
+		// is flushed first, the client getting at least the header.
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		abortConn(ctx, w)
+	}
+}
+
+// abortConn closes the client connection of w, without completing the
+// response. It doesn't panic with http.ErrAbortHandler, which only the
+// net/http servers recover from, not the connections served by the proxy
+// itself, except for the HTTP/2 streams, which can't be hijacked: net/http
+// resets them.
+func abortConn(ctx *ProxyCtx, w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		if ctx.Req.ProtoMajor == 2 {
+			panic(http.ErrAbortHandler)
+		}
+		ctx.Warnf("Can't abort connection to client: %T can't be hijacked", w)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		ctx.Warnf("Can't abort connection to client: %v", err)
+		return
+	}
+	if err := conn.Close(); err != nil {
+		ctx.Warnf("Can't close connection to client: %v", err)
+	}
 }
@@ -15,9 +15,11 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/InsideOutSec/goproxy/internal/http1parser"
 	"github.com/InsideOutSec/goproxy/internal/signer"
+	"golang.org/x/net/publicsuffix"
 )
 
 type ConnectActionLiteral int
@@ -29,6 +31,7 @@ const (
 	ConnectHijack
 	ConnectHTTPMitm
 	ConnectProxyAuthHijack
+	ConnectSniff
 )
 
 var (
@@ -36,6 +39,7 @@ var (
 	MitmConnect     = &ConnectAction{Action: ConnectMitm, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
 	HTTPMitmConnect = &ConnectAction{Action: ConnectHTTPMitm, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
 	RejectConnect   = &ConnectAction{Action: ConnectReject, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
+	SniffConnect    = &ConnectAction{Action: ConnectSniff, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
 )
 
 var _errorRespMaxLength int64 = 500
@@ -44,10 +48,26 @@ var _errorRespMaxLength int64 = 500
 // When Action is ConnectHijack, it is up to the implementer to send the
 // HTTP 200, or any other valid http response back to the client from within the
 // Hijack func.
+//
+// When Action is ConnectSniff, the tunnel is established and its protocol is
+// sniffed from the first bytes of the client, or of the server when the
+// client is silent: TLS is MITM'd, plain HTTP is handled as with
+// ConnectHTTPMitm, and the other protocols are relayed as with
+// ConnectAccept. Sniff, when set, decides instead from the sniffed
+// protocol and prefix, ConnectSniff keeping this default; the Hijack func
+// then receives a tunnel already established. The prefix of TLS is the
+// whole first record, whose ClientHello is parsed by SniffClientHello.
+//
+// When Action is ConnectMitm and Stream is set, the session is handed to
+// Stream once decrypted, rather than read as HTTP: the upstream session is
+// opened during the handshake of the client, with the TLSClientConfig of
+// the proxy Tr.
 type ConnectAction struct {
 	Action    ConnectActionLiteral
 	Hijack    func(req *http.Request, client net.Conn, ctx *ProxyCtx)
 	TLSConfig func(host string, ctx *ProxyCtx) (*tls.Config, error)
+	Sniff     func(proto Protocol, prefix []byte, host string, ctx *ProxyCtx) ConnectActionLiteral
+	Stream    StreamHandler
 }
 
 func stripPort(s string) string {
@@ -86,7 +106,10 @@ func (proxy *ProxyHttpServer) dial(ctx *ProxyCtx, network, addr string) (c net.C
 	return net.Dial(network, addr)
 }
 
+// connectDial opens the connection of the tunnels, its error wrapping its
+// class.
 func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	defer func() { err = classifyError(err) }()
 	if proxy.ConnectDialWithReq == nil && proxy.ConnectDial == nil {
 		return proxy.dial(ctx, network, addr)
 	}
@@ -119,9 +142,10 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		panic("Cannot hijack connection " + e.Error())
 	}
 
-	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
+	httpsHandlers := ctx.rules().httpsHandlers
+	ctx.Logf("Running %d CONNECT handlers", len(httpsHandlers))
 	todo, host := OkConnect, r.URL.Host
-	for i, h := range proxy.httpsHandlers {
+	for i, h := range httpsHandlers {
 		newtodo, newhost := h.HandleConnect(host, ctx)
 
 		// If found a result, break the loop immediately
@@ -131,28 +155,57 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			break
 		}
 	}
+	proxy.trackConnect(r, ctx, todo.Action.connKind(), host)
+	proxy.connect(todo, host, r, proxyClient, nil, ctx, false)
+}
+
+// connect handles the CONNECT r to host as decided by todo. The 200
+// response was already sent to the client of an established tunnel, and
+// target, when not nil, is the connection to host opened to sniff it.
+func (proxy *ProxyHttpServer) connect(todo *ConnectAction, host string, r *http.Request, proxyClient, target net.Conn, ctx *ProxyCtx, established bool) {
+	if target != nil && todo.Action != ConnectAccept {
+		_ = target.Close()
+	}
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
-		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
-		if err != nil {
-			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
-			httpError(proxyClient, ctx, err)
+		if !proxy.acquireTunnel() {
+			ctx.Warnf("Rejecting CONNECT to %s: %d tunnels are open", host, proxy.MaxTunnels)
+			_, _ = io.WriteString(proxyClient, "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n")
+			proxyClient.Close()
+			if target != nil {
+				_ = target.Close()
+			}
 			return
 		}
+		targetSiteCon := target
+		if targetSiteCon == nil {
+			var err error
+			if targetSiteCon, err = proxy.connectDial(ctx, "tcp", host); err != nil {
+				proxy.releaseTunnel()
+				ctx.Warnf("Error dialing to %s: %s (%s)", host, err.Error(), ErrorClass(err))
+				httpError(proxyClient, ctx, err)
+				return
+			}
+		}
 		ctx.Logf("Accepting CONNECT to %s", host)
-		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+		if !established {
+			_, _ = proxyClient.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+		}
 
 		targetTCP, targetOK := targetSiteCon.(halfClosable)
 		proxyClientTCP, clientOK := proxyClient.(halfClosable)
 		if targetOK && clientOK {
 			go func() {
+				defer proxy.releaseTunnel()
 				var wg sync.WaitGroup
 				wg.Add(2)
 				go copyAndClose(ctx, targetTCP, proxyClientTCP, &wg)
-				go copyAndClose(ctx, proxyClientTCP, targetTCP, &wg)
+				// Copy the other direction in this goroutine, rather than
+				// starting a third one.
+				copyAndClose(ctx, proxyClientTCP, targetTCP, &wg)
 				wg.Wait()
 				// Make sure to close the underlying TCP socket.
 				// CloseRead() and CloseWrite() keep it open until its timeout,
@@ -177,7 +230,15 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			// side of the connection breaks out of its io.Copy loop. The other side
 			// of the connection remains open until it either times out or is reset by
 			// the client.
+			// The tunnel is released once both copies are done.
+			remaining := int32(2)
+			done := func() {
+				if atomic.AddInt32(&remaining, -1) == 0 {
+					proxy.releaseTunnel()
+				}
+			}
 			go func() {
+				defer done()
 				err := copyOrWarn(ctx, targetSiteCon, proxyClient)
 				if err != nil && proxy.ConnectionErrHandler != nil {
 					proxy.ConnectionErrHandler(proxyClient, ctx, err)
@@ -186,6 +247,7 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			}()
 
 			go func() {
+				defer done()
 				_ = copyOrWarn(ctx, proxyClient, targetSiteCon)
 				_ = proxyClient.Close()
 			}()
@@ -194,8 +256,12 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	case ConnectHijack:
 		todo.Hijack(r, proxyClient, ctx)
 	case ConnectHTTPMitm:
-		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		if !established {
+			_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		}
 		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
+		ctx.mitm = true
+		ctx.connectReq = r
 
 		var targetSiteCon net.Conn
 		var remote *bufio.Reader
@@ -265,7 +331,15 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			}
 		}
 	case ConnectMitm:
-		_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		if !proxy.acquireHandshake() {
+			ctx.Warnf("Rejecting CONNECT to %s: %d handshakes in progress", host, proxy.MaxHandshakes)
+			_, _ = io.WriteString(proxyClient, "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n")
+			proxyClient.Close()
+			return
+		}
+		if !established {
+			_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		}
 		ctx.Logf("Assuming CONNECT is TLS, mitm proxying it")
 		// this goes in a separate goroutine, so that the net/http server won't think we're
 		// still handling the request even after hijacking the connection. Those HTTP CONNECT
@@ -276,20 +350,56 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			var err error
 			tlsConfig, err = todo.TLSConfig(host, ctx)
 			if err != nil {
+				proxy.releaseHandshake(err)
 				httpError(proxyClient, ctx, err)
 				return
 			}
 		}
+		var upstream *tls.Conn
+		if todo.Stream != nil {
+			tlsConfig = proxy.streaming(tlsConfig, host, ctx, &upstream)
+		}
+		var fingerprint *TLSFingerprint
+		var clientConn net.Conn
+		clientConn, tlsConfig = fingerprinting(proxyClient, tlsConfig, &fingerprint)
+		if proxy.keyLogWriter != nil {
+			tlsConfig = proxy.withKeyLog(tlsConfig)
+		}
 		go func() {
 			// TODO: cache connections to the remote website
-			rawClientTls := tls.Server(proxyClient, tlsConfig)
+			rawClientTls := tls.Server(clientConn, tlsConfig)
 			defer rawClientTls.Close()
-			if err := rawClientTls.Handshake(); err != nil {
+			if proxy.HandshakeTimeout > 0 {
+				_ = proxyClient.SetDeadline(time.Now().Add(proxy.HandshakeTimeout))
+			}
+			err := rawClientTls.Handshake()
+			proxy.releaseHandshake(err)
+			if err != nil {
+				if upstream != nil {
+					_ = upstream.Close()
+				}
 				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
 				return
 			}
+			if proxy.HandshakeTimeout > 0 {
+				_ = proxyClient.SetDeadline(time.Time{})
+			}
+			clientState := rawClientTls.ConnectionState()
+			proxy.trackHandshake(r, &clientState)
+			ctx.Publish(&Event{Type: EventMitmEstablished, Host: host})
+			if todo.Stream != nil {
+				proxy.serveStream(todo.Stream, rawClientTls, upstream, host, ctx)
+				return
+			}
 
 			clientTlsReader := http1parser.NewRequestReader(proxy.PreventCanonicalization, rawClientTls)
+			defer clientTlsReader.Release()
+			// Buffer the responses, so that their status line, headers and
+			// chunks aren't sent in separate TLS records.
+			clientTlsWriter := newBufioWriter(rawClientTls)
+			defer putBufioWriter(clientTlsWriter)
+			tunnel := &tunnelTransport{}
+			defer tunnel.close()
 			for !clientTlsReader.IsEOF() {
 				req, err := clientTlsReader.ReadRequest()
 				ctx := &ProxyCtx{
@@ -298,6 +408,14 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					Proxy:        proxy,
 					UserData:     ctx.UserData,
 					RoundTripper: ctx.RoundTripper,
+					Transport:    ctx.Transport,
+					Dialer:       ctx.Dialer,
+					Identity:     ctx.Identity,
+					Logger:       ctx.Logger,
+					mitm:         true,
+					connectReq:   r,
+					fingerprint:  fingerprint,
+					tunnel:       tunnel,
 				}
 				if err != nil && !errors.Is(err, io.EOF) {
 					ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
@@ -309,12 +427,14 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				// since we're converting the request, need to carry over the
 				// original connecting IP as well
 				req.RemoteAddr = r.RemoteAddr
+				req.TLS = &clientState
 				ctx.Logf("req %v", r.Host)
 
 				if !strings.HasPrefix(req.URL.String(), "https://") {
 					req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
 				}
 
+				keepTrailers(req)
 				if continueLoop := func(req *http.Request) bool {
 					// Since we handled the request parsing by our own, we manually
 					// need to set a cancellable context when we finished the request
@@ -326,6 +446,21 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					// Bug fix which goproxy fails to provide request
 					// information URL in the context when does HTTPS MITM
 					ctx.Req = req
+					// The HTTP/2 connections are relayed as a whole.
+					var sent *http.Response
+					if req.Method != "PRI" {
+						start := proxy.requestStarted(ctx)
+						defer func() { proxy.requestCompleted(ctx, sent, start) }()
+					}
+
+					// As net/http, answer 100 Continue to the clients expecting it
+					// when their body is read, after the upstream approved it.
+					var expect *continueReader
+					if req.ProtoAtLeast(1, 1) && req.ContentLength != 0 &&
+						strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+						expect = &continueReader{ReadCloser: req.Body, w: rawClientTls}
+						req.Body = expect
+					}
 
 					req, resp := proxy.filterRequest(req, ctx)
 					if resp == nil {
@@ -372,19 +507,37 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 							return ctx.RoundTrip(req)
 						}()
 						if err != nil {
-							ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
+							ctx.Error = classifyError(err)
+							ctx.Warnf("Cannot read TLS response from mitm'd server %v (%s)", err, ErrorClass(err))
 							return false
 						}
 						ctx.Logf("resp %v", resp.Status)
 					}
+					origBody := resp.Body
 					resp = proxy.filterResponse(resp, ctx)
 					defer resp.Body.Close()
+					sent = resp
+
+					// The HTTP/1.0 clients don't support chunked encoding: their
+					// response bodies are delimited by their length when it is
+					// known, or by closing the connection.
+					clientReq := ctx.Req
+					http10 := !clientReq.ProtoAtLeast(1, 1)
+					bodyless := resp.Request.Method == http.MethodHead ||
+						(resp.StatusCode >= 100 && resp.StatusCode < 200) ||
+						resp.StatusCode == http.StatusNoContent ||
+						resp.StatusCode == http.StatusNotModified
+					keepAlive := http10 && !clientReq.Close && (bodyless || (origBody == resp.Body && resp.ContentLength >= 0))
 
 					text := resp.Status
 					statusCode := strconv.Itoa(resp.StatusCode) + " "
 					text = strings.TrimPrefix(text, statusCode)
-					// always use 1.1 to support chunked encoding
-					if _, err := io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
+					// use 1.1 to support chunked encoding, but with the 1.0 clients
+					proto := "HTTP/1.1"
+					if http10 {
+						proto = "HTTP/1.0"
+					}
+					if _, err := io.WriteString(clientTlsWriter, proto+" "+statusCode+text+"\r\n"); err != nil {
 						ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
 						return false
 					}
@@ -397,6 +550,13 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						// RFC7230: A server MUST NOT send a Content-Length header field in any response
 						// with a status code of 1xx (Informational) or 204 (No Content)
 						resp.Header.Del("Content-Length")
+					} else if http10 {
+						resp.Header.Del("Transfer-Encoding")
+						if keepAlive {
+							resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+						} else {
+							resp.Header.Del("Content-Length")
+						}
 					} else {
 						// Since we don't know the length of resp, return chunked encoded response
 						// TODO: use a more reasonable scheme
@@ -404,17 +564,27 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						resp.Header.Set("Transfer-Encoding", "chunked")
 					}
 					// Force connection close otherwise chrome will keep CONNECT tunnel open forever
-					if !isWebsocket {
+					if keepAlive {
+						resp.Header.Del("Keep-Alive")
+						resp.Header.Set("Connection", "keep-alive")
+					} else if !isWebsocket {
 						resp.Header.Set("Connection", "close")
 					}
-					if err := resp.Header.Write(rawClientTls); err != nil {
+					if !http10 && !bodyless && !isWebsocket && len(resp.Trailer) > 0 {
+						resp.Header.Set("Trailer", trailerNames(resp.Trailer))
+					}
+					if err := resp.Header.Write(clientTlsWriter); err != nil {
 						ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
 						return false
 					}
-					if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
+					if _, err = io.WriteString(clientTlsWriter, "\r\n"); err != nil {
 						ctx.Warnf("Cannot write TLS response header end from mitm'd client: %v", err)
 						return false
 					}
+					if err := clientTlsWriter.Flush(); err != nil {
+						ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
+						return false
+					}
 
 					if isWebsocket {
 						ctx.Logf("Response looks like websocket upgrade.")
@@ -434,15 +604,25 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 						return false
 					}
 
-					if resp.Request.Method == http.MethodHead ||
-						(resp.StatusCode >= 100 && resp.StatusCode < 200) ||
-						resp.StatusCode == http.StatusNoContent ||
-						resp.StatusCode == http.StatusNotModified {
+					if bodyless {
 						// Don't write out a response body, when it's not allowed
 						// in RFC7230
+						if http10 {
+							return keepAlive
+						}
+					} else if http10 {
+						if _, err := copyBuffer(clientTlsWriter, resp.Body); err != nil {
+							ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
+							return false
+						}
+						if err := clientTlsWriter.Flush(); err != nil {
+							ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
+							return false
+						}
+						return keepAlive
 					} else {
-						chunked := newChunkedWriter(rawClientTls)
-						if _, err := io.Copy(chunked, resp.Body); err != nil {
+						chunked := newChunkedWriter(clientTlsWriter)
+						if _, err := copyBuffer(chunked, resp.Body); err != nil {
 							ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
 							return false
 						}
@@ -450,13 +630,23 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 							ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
 							return false
 						}
-						if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
+						if err := resp.Trailer.Write(clientTlsWriter); err != nil {
+							ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
+							return false
+						}
+						if _, err = io.WriteString(clientTlsWriter, "\r\n"); err != nil {
 							ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
 							return false
 						}
+						if err := clientTlsWriter.Flush(); err != nil {
+							ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
+							return false
+						}
 					}
 
-					return true
+					// The client may still send the body that wasn't asked for,
+					// the connection can't be reused.
+					return expect == nil || expect.sent()
 				}(req); !continueLoop {
 					return
 				}
@@ -473,6 +663,39 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			}
 		}
 		_ = proxyClient.Close()
+	case ConnectSniff:
+		if !established {
+			_, _ = proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		}
+		conn, proto, prefix := sniff(proxyClient, proxy.sniffTimeout(), sniffProtocol)
+		var target net.Conn
+		if len(prefix) == 0 {
+			// The client is silent, waiting for the server to speak first.
+			addr := host
+			if !hasPort.MatchString(addr) {
+				addr += ":80"
+			}
+			var err error
+			if target, err = proxy.connectDial(ctx, "tcp", addr); err != nil {
+				ctx.Warnf("Error dialing to %s: %s", addr, err.Error())
+				_ = proxyClient.Close()
+				return
+			}
+			target, proto, prefix = sniff(target, proxy.sniffTimeout(), sniffServerProtocol)
+		}
+		next := *todo
+		next.Action = proto.connectAction()
+		if todo.Sniff != nil {
+			if action := todo.Sniff(proto, prefix, host, ctx); action != ConnectSniff {
+				next.Action = action
+			}
+		}
+		if next.Action == ConnectProxyAuthHijack {
+			next.Action = ConnectAccept
+		}
+		ctx.Logf("Sniffed %v on CONNECT to %s", proto, host)
+		proxy.trackConnect(r, ctx, next.Action.connKind(), host)
+		proxy.connect(&next, host, r, conn, target, ctx, true)
 	}
 }
 
@@ -496,7 +719,7 @@ func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
 }
 
 func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader) error {
-	_, err := io.Copy(dst, src)
+	_, err := copyBuffer(dst, src)
 	if err != nil && errors.Is(err, net.ErrClosed) {
 		// Discard closed connection errors
 		err = nil
@@ -507,7 +730,7 @@ func copyOrWarn(ctx *ProxyCtx, dst io.Writer, src io.Reader) error {
 }
 
 func copyAndClose(ctx *ProxyCtx, dst, src halfClosable, wg *sync.WaitGroup) {
-	_, err := io.Copy(dst, src)
+	_, err := copyBuffer(dst, src)
 	if err != nil && !errors.Is(err, net.ErrClosed) {
 		ctx.Warnf("Error copying to client: %s", err.Error())
 	}
@@ -570,12 +793,12 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(
 			}
 			defer resp.Body.Close()
 			if resp.StatusCode != http.StatusOK {
-				resp, err := io.ReadAll(io.LimitReader(resp.Body, _errorRespMaxLength))
+				body, err := io.ReadAll(io.LimitReader(resp.Body, _errorRespMaxLength))
 				if err != nil {
 					return nil, err
 				}
 				_ = c.Close()
-				return nil, errors.New("proxy refused connection" + string(resp))
+				return nil, proxyRefused(resp.StatusCode, body)
 			}
 			return c, nil
 		}
@@ -622,7 +845,7 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(
 					return nil, err
 				}
 				_ = c.Close()
-				return nil, errors.New("proxy refused connection" + string(body))
+				return nil, proxyRefused(resp.StatusCode, body)
 			}
 			return c, nil
 		}
@@ -631,19 +854,48 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(
 }
 
 func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
+	return TLSConfigFromCAWithStorage(ca, nil)
+}
+
+// TLSConfigFromCAWithStorage is TLSConfigFromCA caching the certificates in
+// store instead of the proxy CertStore, for example to keep the
+// certificates of several CAs apart. A nil store uses the proxy CertStore.
+//
+// When ca is name-constrained, the hosts outside its constraints are warned
+// about, since the clients reject their certificates, and the wildcard
+// certificates outside its constraints are replaced by those of the hosts.
+func TLSConfigFromCAWithStorage(ca *tls.Certificate, store CertStorage) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
 	return func(host string, ctx *ProxyCtx) (*tls.Config, error) {
 		var err error
 		var cert *tls.Certificate
+		// Not before, since the package CAs are only parsed by init.
+		leaf := caLeaf(ca)
 
 		hostname := stripPort(host)
 		config := defaultTLSConfig.Clone()
 		ctx.Logf("signing for %s", stripPort(host))
+		if leaf != nil && !CAPermits(leaf, hostname) {
+			ctx.Warnf("MITM of %s outside the name constraints of the CA %q, its certificate will be rejected", hostname, leaf.Subject.CommonName)
+		}
 
+		key, hosts := hostname, []string{hostname}
+		if ctx.Proxy != nil && ctx.Proxy.WildcardCerts {
+			if domain := wildcardDomain(hostname); domain != "" && (leaf == nil || CAPermits(leaf, domain)) {
+				key, hosts = "*."+domain, []string{domain, "*." + domain}
+			}
+		}
 		genCert := func() (*tls.Certificate, error) {
-			return signer.SignHost(*ca, []string{hostname})
+			if ctx.Proxy != nil {
+				return signer.SignHostAt(*ca, hosts, ctx.Proxy.certNow())
+			}
+			return signer.SignHost(*ca, hosts)
+		}
+		certStore := store
+		if certStore == nil {
+			certStore = ctx.certStore
 		}
-		if ctx.certStore != nil {
-			cert, err = ctx.certStore.Fetch(hostname, genCert)
+		if certStore != nil {
+			cert, err = certStore.Fetch(key, genCert)
 		} else {
 			cert, err = genCert()
 		}
@@ -658,6 +910,26 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 	}
 }
 
+// wildcardDomain returns the domain whose wildcard certificate covers
+// hostname: its parent, or hostname itself when it is a registrable domain.
+// A wildcard only matches one label, so the hosts below a subdomain use the
+// wildcard of that subdomain. It returns "" for IP addresses and the public
+// suffixes, which are signed as they are.
+func wildcardDomain(hostname string) string {
+	if net.ParseIP(hostname) != nil {
+		return ""
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	if err != nil {
+		return ""
+	}
+	if hostname == registrable {
+		return hostname
+	}
+	return hostname[strings.Index(hostname, ".")+1:]
+}
+
 func (proxy *ProxyHttpServer) initializeTLSconnection(
 	ctx *ProxyCtx,
 	targetConn net.Conn,
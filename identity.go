@@ -0,0 +1,65 @@
+package goproxy
+
+import "net/http"
+
+// Identity describes the authenticated user of a proxy client.
+// It's set on ProxyCtx by the authentication handlers (Basic, client
+// certificates, tokens...) and is available to the following handlers and
+// conditions. The identity established on a CONNECT request is kept for all
+// the requests of the MITM'd connection.
+type Identity struct {
+	// Name is the user name.
+	Name string
+	// Method is the authentication scheme that established the identity,
+	// for example "basic" or "mtls".
+	Method string
+	// Groups are the groups the user belongs to, when the authentication
+	// backend provides them.
+	Groups []string
+	// Attributes holds additional backend specific information.
+	Attributes map[string]string
+}
+
+// InGroup reports whether the identity belongs to group.
+func (id *Identity) InGroup(group string) bool {
+	if id == nil {
+		return false
+	}
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// UserIs returns a ReqCondition testing whether the request was sent by one
+// of the given authenticated users.
+func UserIs(names ...string) ReqConditionFunc {
+	nameSet := make(map[string]bool)
+	for _, n := range names {
+		nameSet[n] = true
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return ctx.Identity != nil && nameSet[ctx.Identity.Name]
+	}
+}
+
+// UserInGroup returns a ReqCondition testing whether the authenticated user
+// belongs to one of the given groups.
+func UserInGroup(groups ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, g := range groups {
+			if ctx.Identity.InGroup(g) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// IsAuthenticated is a ReqCondition testing whether an identity has been
+// established for the request.
+var IsAuthenticated ReqConditionFunc = func(req *http.Request, ctx *ProxyCtx) bool {
+	return ctx.Identity != nil
+}
@@ -7,25 +7,42 @@ import (
 	"io"
 	"net/http"
 	"net/textproto"
+	"sync"
+	"sync/atomic"
 )
 
+var bufioReaderPool sync.Pool
+
+func newBufioReader(r io.Reader) *bufio.Reader {
+	if br, ok := bufioReaderPool.Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
 type RequestReader struct {
 	preventCanonicalization bool
 	reader                  *bufio.Reader
 	// Used only when preventCanonicalization value is true
 	cloned *bytes.Buffer
+	// Set once the buffered reader was taken over by Reader
+	detached bool
+	// bodies counts the bodies of the requests read not closed yet, which
+	// may still be read from the buffered reader by the transport.
+	bodies atomic.Int32
 }
 
 func NewRequestReader(preventCanonicalization bool, conn io.Reader) *RequestReader {
 	if !preventCanonicalization {
 		return &RequestReader{
 			preventCanonicalization: false,
-			reader:                  bufio.NewReader(conn),
+			reader:                  newBufioReader(conn),
 		}
 	}
 
 	var cloned bytes.Buffer
-	reader := bufio.NewReader(io.TeeReader(conn, &cloned))
+	reader := newBufioReader(io.TeeReader(conn, &cloned))
 	return &RequestReader{
 		preventCanonicalization: true,
 		reader:                  reader,
@@ -43,12 +60,49 @@ func (r *RequestReader) IsEOF() bool {
 // Reader is used to take over the buffered connection data
 // (e.g. with HTTP/2 data).
 // After calling this function, make sure to consume all the data related
-// to the current request.
+// to the current request. The buffer isn't released to the pool afterwards.
 func (r *RequestReader) Reader() *bufio.Reader {
+	r.detached = true
 	return r.reader
 }
 
+// Release returns the buffer of the reader to a pool, once the connection
+// is done. The reader, and the requests read, must not be used afterwards.
+// The buffer isn't released while the body of a request read isn't closed.
+func (r *RequestReader) Release() {
+	if r.reader == nil || r.detached || r.bodies.Load() > 0 {
+		return
+	}
+	r.reader.Reset(nil)
+	bufioReaderPool.Put(r.reader)
+	r.reader = nil
+}
+
 func (r *RequestReader) ReadRequest() (*http.Request, error) {
+	req, err := r.readRequest()
+	if err != nil {
+		return nil, err
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		r.bodies.Add(1)
+		req.Body = &requestBody{ReadCloser: req.Body, r: r}
+	}
+	return req, nil
+}
+
+// requestBody counts the bodies not closed of the reader.
+type requestBody struct {
+	io.ReadCloser
+	r    *RequestReader
+	once sync.Once
+}
+
+func (b *requestBody) Close() error {
+	b.once.Do(func() { b.r.bodies.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+func (r *RequestReader) readRequest() (*http.Request, error) {
 	if !r.preventCanonicalization {
 		// Just call the HTTP library function if the preventCanonicalization
 		// configuration is disabled
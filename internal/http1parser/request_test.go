@@ -202,3 +202,21 @@ func TestReadRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestReleaseWithOpenBody(t *testing.T) {
+	parser := http1parser.NewRequestReader(false, strings.NewReader(_data))
+	req, err := parser.ReadRequest()
+	require.NoError(t, err)
+
+	// The transport may still read the body once the connection is done.
+	parser.Release()
+	other := http1parser.NewRequestReader(false, strings.NewReader(_data2))
+	_, err = other.ReadRequest()
+	require.NoError(t, err)
+	other.Release()
+
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"hello":"world"}`, string(body))
+	require.NoError(t, req.Body.Close())
+}
@@ -32,6 +32,12 @@ func hashSorted(lst []string) []byte {
 }
 
 func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err error) {
+	return SignHostAt(ca, hosts, time.Now())
+}
+
+// SignHostAt is SignHost for a certificate valid at now, from 30 days
+// before for a year.
+func SignHostAt(ca tls.Certificate, hosts []string, now time.Time) (cert *tls.Certificate, err error) {
 	// Use the provided CA for certificate generation.
 	// Use already parsed Leaf certificate when present.
 	x509ca := ca.Leaf
@@ -41,7 +47,6 @@ func SignHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		}
 	}
 
-	now := time.Now()
 	start := now.Add(-30 * 24 * time.Hour) // -30 days
 	end := now.Add(365 * 24 * time.Hour)   // 365 days
 
@@ -0,0 +1,60 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"sync"
+)
+
+// lockedWriter serializes the writes of the concurrent TLS sessions, so
+// that the key log lines are never interleaved.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// EnableTLSKeyLog writes the secrets of the TLS sessions handled by the proxy
+// to w, using the NSS key log format (the one of SSLKEYLOGFILE), so that
+// captured traffic can be decrypted with tools like Wireshark.
+// Both the client-facing MITM sessions and the sessions with the destination
+// servers are logged.
+// Anyone with access to w can decrypt the traffic, so this must be used only
+// for troubleshooting.
+func (proxy *ProxyHttpServer) EnableTLSKeyLog(w io.Writer) {
+	proxy.keyLogWriter = &lockedWriter{w: w}
+	if proxy.Tr == nil {
+		return
+	}
+	cfg := &tls.Config{}
+	if proxy.Tr.TLSClientConfig != nil {
+		cfg = proxy.Tr.TLSClientConfig.Clone()
+	}
+	cfg.KeyLogWriter = proxy.keyLogWriter
+	proxy.Tr.TLSClientConfig = cfg
+}
+
+// withKeyLog returns a copy of config, which may be shared by several
+// connections, logging the secrets of its sessions, as well as those of the
+// configs returned by its GetConfigForClient.
+func (proxy *ProxyHttpServer) withKeyLog(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.KeyLogWriter = proxy.keyLogWriter
+	if next := config.GetConfigForClient; next != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := next(hello)
+			if c == nil || err != nil {
+				return c, err
+			}
+			c = c.Clone()
+			c.KeyLogWriter = proxy.keyLogWriter
+			return c, nil
+		}
+	}
+	return config
+}
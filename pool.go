@@ -0,0 +1,43 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers of the copy loops, the same as
+// io.Copy.
+const copyBufferSize = 32 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyBuffer is io.Copy with a pooled buffer. The buffer isn't used when
+// src or dst can copy by themselves, as TCP connections do with splice.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	b := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
+
+var bufioWriterPool sync.Pool
+
+// newBufioWriter returns a pooled bufio.Writer of w, to be released with
+// putBufioWriter.
+func newBufioWriter(w io.Writer) *bufio.Writer {
+	if bw, ok := bufioWriterPool.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, copyBufferSize)
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	bufioWriterPool.Put(bw)
+}
@@ -7,6 +7,9 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -14,15 +17,14 @@ type ProxyHttpServer struct {
 	// session variable must be aligned in i386
 	// see http://golang.org/src/pkg/sync/atomic/doc.go#L41
 	sess int64
+	// open tunnels, aligned as sess
+	tunnels int64
 	// KeepDestinationHeaders indicates the proxy should retain any headers present in the http.Response before proxying
 	KeepDestinationHeaders bool
 	// setting Verbose to true will log information on each request sent to the proxy
 	Verbose         bool
 	Logger          Logger
 	NonproxyHandler http.Handler
-	reqHandlers     []ReqHandler
-	respHandlers    []RespHandler
-	httpsHandlers   []HttpsHandler
 	Tr              *http.Transport
 	// ConnectionErrHandler will be invoked to return a custom response
 	// to clients (written using conn parameter), when goproxy fails to connect
@@ -51,6 +53,49 @@ type ProxyHttpServer struct {
 	// Accept-Encoding header. To disable this behavior, set
 	// Tr.DisableCompression to true.
 	KeepAcceptEncoding bool
+	// MaxTunnels caps the number of concurrent CONNECT tunnels relayed
+	// without MITM. It is a cap, not a relay scheduler: each tunnel is still
+	// relayed by two goroutines, which MaxTunnels bounds to twice its value.
+	// The tunnels above the cap are rejected with 503 Service Unavailable.
+	// Zero is unlimited.
+	MaxTunnels int
+	// MaxHandshakes limits the number of concurrent MITM handshakes,
+	// including the signature of their certificate, so that a burst of new
+	// connections can't starve the established ones. The tunnels above the
+	// limit wait for HandshakeQueueTimeout, then are rejected with 503
+	// Service Unavailable, right away with a zero timeout. Zero is unlimited.
+	MaxHandshakes         int
+	HandshakeQueueTimeout time.Duration
+	// HandshakeTimeout bounds the duration of the MITM handshakes with the
+	// clients. Zero is unlimited.
+	HandshakeTimeout time.Duration
+	// SniffTimeout bounds the wait for the first bytes of the tunnels
+	// handled with ConnectSniff, one second by default. The tunnels still
+	// silent, where the server speaks first, are relayed.
+	SniffTimeout time.Duration
+	// WildcardCerts makes the MITM sign one wildcard certificate per
+	// domain, such as *.example.com covering example.com and all its direct
+	// subdomains, instead of one certificate per host. This shrinks the
+	// CertStore and the signing load of the sites using many subdomains.
+	WildcardCerts bool
+	// CertClock is the clock of the validity of the MITM certificates,
+	// valid from 30 days before its time for a year, SystemClock by
+	// default. A SkewClock moves their validity for the clients whose
+	// clock is wrong.
+	CertClock Clock
+	// RequestIDHeader, such as "X-Request-Id", propagates the request IDs
+	// of ProxyCtx.RequestID: the ID of a request is taken from this header
+	// when the client sent a valid one, and is set in the header of the
+	// request sent upstream. Empty, the IDs aren't propagated.
+	RequestIDHeader string
+
+	keyLogWriter  io.Writer
+	handshakeOnce sync.Once
+	handshake     *handshakeLimiter
+	connsOnce     sync.Once
+	conns         *connTable
+	events        eventBus
+	rules         atomic.Pointer[Rules]
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
@@ -69,7 +114,7 @@ func copyHeaders(dst, src http.Header, keepDestHeaders bool) {
 
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	req = r
-	for _, h := range proxy.reqHandlers {
+	for _, h := range ctx.rules().reqHandlers {
 		req, resp = h.Handle(req, ctx)
 		// non-nil resp means the handler decided to skip sending the request
 		// and return canned response instead.
@@ -82,7 +127,7 @@ func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req
 
 func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *ProxyCtx) (resp *http.Response) {
 	resp = respOrig
-	for _, h := range proxy.respHandlers {
+	for _, h := range ctx.rules().respHandlers {
 		ctx.Resp = resp
 		resp = h.Handle(resp, ctx)
 	}
@@ -149,8 +194,33 @@ func NewProxyHttpServer() *ProxyHttpServer {
 		NonproxyHandler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
 		}),
-		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
+		// The request bodies expecting 100 Continue are sent upstream once
+		// it is received, so that they are read from the clients only then.
+		Tr: &http.Transport{
+			TLSClientConfig:       tlsClientSkipVerify,
+			Proxy:                 http.ProxyFromEnvironment,
+			ExpectContinueTimeout: time.Second,
+		},
 	}
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 	return &proxy
 }
+
+// acquireTunnel reserves a tunnel below MaxTunnels.
+func (proxy *ProxyHttpServer) acquireTunnel() bool {
+	n := atomic.AddInt64(&proxy.tunnels, 1)
+	if proxy.MaxTunnels > 0 && n > int64(proxy.MaxTunnels) {
+		atomic.AddInt64(&proxy.tunnels, -1)
+		return false
+	}
+	return true
+}
+
+func (proxy *ProxyHttpServer) releaseTunnel() {
+	atomic.AddInt64(&proxy.tunnels, -1)
+}
+
+// ActiveTunnels returns the number of CONNECT tunnels relayed without MITM.
+func (proxy *ProxyHttpServer) ActiveTunnels() int {
+	return int(atomic.LoadInt64(&proxy.tunnels))
+}
@@ -18,12 +18,15 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/InsideOutSec/goproxy"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
 )
 
 var (
@@ -873,6 +876,194 @@ func TestProxyWithCertStorage(t *testing.T) {
 	}
 }
 
+func TestWildcardCerts(t *testing.T) {
+	tcs := newTestCertStorage()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = tcs
+	proxy.WildcardCerts = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.Tr = &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, https.Listener.Addr().String())
+		},
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyUrl, _ := url.Parse(s.URL)
+	goproxyCA := x509.NewCertPool()
+	goproxyCA.AddCert(goproxy.GoproxyCa.Leaf)
+	// A new transport per request, to handshake each time.
+	newClient := func() *http.Client {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: goproxyCA}, Proxy: http.ProxyURL(proxyUrl)}
+		return &http.Client{Transport: tr}
+	}
+
+	for _, host := range []string{"example.com", "a.example.com", "B.example.com"} {
+		assert.Equal(t, "bobo", string(getOrFail(t, "https://"+host+"/bobo", newClient())))
+	}
+	assert.Equal(t, 1, tcs.statMisses())
+	assert.Equal(t, 2, tcs.statHits())
+	require.Contains(t, tcs.certs, "*.example.com")
+	assert.ElementsMatch(t, []string{"example.com", "*.example.com"}, tcs.certs["*.example.com"].Leaf.DNSNames)
+
+	// A wildcard only matches one label.
+	assert.Equal(t, "bobo", string(getOrFail(t, "https://x.a.example.com/bobo", newClient())))
+	assert.Contains(t, tcs.certs, "*.a.example.com")
+	assert.Equal(t, 2, tcs.statMisses())
+}
+
+func TestTLSState(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var upstream, client *tls.ConnectionState
+	var chain []*x509.Certificate
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		upstream, client, chain = ctx.UpstreamTLS(), ctx.ClientTLS(), ctx.UpstreamChain()
+		return resp
+	})
+	proxyClient, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", proxyClient)))
+	require.NotNil(t, upstream)
+	require.NotEmpty(t, chain)
+	assert.Equal(t, https.Certificate().Raw, chain[0].Raw)
+	assert.NotZero(t, upstream.CipherSuite)
+	require.NotNil(t, client)
+	assert.True(t, client.HandshakeComplete)
+	assert.Empty(t, client.PeerCertificates)
+
+	// Plain HTTP requests have no TLS state.
+	upstream, client = nil, nil
+	assert.Equal(t, "bobo", string(getOrFail(t, srv.URL+"/bobo", proxyClient)))
+	assert.Nil(t, upstream)
+	assert.Nil(t, client)
+}
+
+// lockedBuffer is a bytes.Buffer written by the proxy goroutines and read
+// by the tests.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConnectRequestAndLogger(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Verbose = true
+	var logs lockedBuffer
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Logger = log.New(&logs, "", 0)
+		return goproxy.MitmConnect, host
+	})
+	var connect *http.Request
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		connect = ctx.ConnectRequest()
+		ctx.Logf("request of the tunnel")
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+	require.NotNil(t, connect)
+	assert.Equal(t, http.MethodConnect, connect.Method)
+	assert.Contains(t, logs.String(), "request of the tunnel")
+
+	assert.Equal(t, "bobo", string(getOrFail(t, srv.URL+"/bobo", client)))
+	assert.Nil(t, connect)
+}
+
+func TestConnTable(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	s := httptest.NewUnstartedServer(proxy)
+	s.Listener = proxy.TrackListener(s.Listener)
+	s.Start()
+	defer s.Close()
+	proxyURL, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	assert.Equal(t, "bobo", string(getOrFail(t, srv.URL+"/bobo", client)))
+	conns := proxy.Conns()
+	require.Len(t, conns, 1)
+	assert.Equal(t, goproxy.ConnHTTP, conns[0].Kind)
+	assert.Equal(t, "HTTP/1.1", conns[0].Protocol)
+	assert.Equal(t, int64(1), conns[0].Requests)
+	assert.NotZero(t, conns[0].BytesIn)
+	assert.NotZero(t, conns[0].BytesOut)
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	writeConnect(c)
+	buf := bufio.NewReader(c)
+	resp, err := http.ReadResponse(buf, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var tunnel goproxy.ConnInfo
+	for _, info := range proxy.Conns() {
+		if info.RemoteAddr == c.LocalAddr().String() {
+			tunnel = info
+		}
+	}
+	assert.Equal(t, goproxy.ConnTunnel, tunnel.Kind)
+	assert.Equal(t, srv.Listener.Addr().String(), tunnel.Target)
+
+	require.NoError(t, proxy.CloseConn(tunnel.ID))
+	_, err = buf.ReadByte()
+	assert.Error(t, err)
+	assert.ErrorIs(t, proxy.CloseConn(tunnel.ID), goproxy.ErrUnknownConn)
+	assert.Len(t, proxy.Conns(), 1)
+}
+
+func TestTiming(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var timing *goproxy.Timing
+	var ctxs []*goproxy.ProxyCtx
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		timing = ctx.Timing()
+		ctxs = append(ctxs, ctx)
+		return resp
+	})
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+	require.NotNil(t, timing)
+	assert.False(t, timing.Reused)
+	assert.Equal(t, https.Listener.Addr().String(), timing.RemoteAddr)
+	assert.NotZero(t, timing.Connect())
+	assert.NotZero(t, timing.TLS())
+	assert.NotZero(t, timing.TTFB())
+	assert.True(t, timing.BodyDone.IsZero())
+	// The body is done once copied to the client.
+	done := ctxs[0].Timing()
+	assert.False(t, done.BodyDone.IsZero())
+	assert.GreaterOrEqual(t, done.Total(), done.TTFB())
+
+	// The requests answered by the handlers have no timing.
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "local")
+	})
+	assert.Equal(t, "local", string(getOrFail(t, srv.URL+"/bobo", client)))
+	assert.Nil(t, timing)
+}
+
 func TestHttpsMitmURLRewrite(t *testing.T) {
 	scheme := "https"
 
@@ -1087,3 +1278,1206 @@ func TestMITMRequestCancel(t *testing.T) {
 		assert.Fail(t, "request hasn't been cancelled")
 	}
 }
+
+func TestTLSKeyLog(t *testing.T) {
+	var keyLog bytes.Buffer
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.EnableTLSKeyLog(&keyLog)
+
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	if resp := string(getOrFail(t, https.URL+"/bobo", client)); resp != "bobo" {
+		t.Error("Wrong response when mitm", resp, "expected bobo")
+	}
+	l.Close()
+
+	// One session with the client, and another one with the server
+	clientRandoms := make(map[string]bool)
+	for _, line := range strings.Split(keyLog.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			clientRandoms[fields[1]] = true
+		}
+	}
+	if len(clientRandoms) != 2 {
+		t.Errorf("Expected secrets of 2 TLS sessions, got %d:\n%s", len(clientRandoms), keyLog.String())
+	}
+}
+
+func TestTLSKeyLogSharedConfig(t *testing.T) {
+	var keyLog bytes.Buffer
+	var inner *tls.Config
+	// The configs returned by TLSConfig may be shared by the connections,
+	// and select others with GetConfigForClient.
+	shared := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) { return inner, nil },
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return &goproxy.ConnectAction{
+			Action: goproxy.ConnectMitm,
+			TLSConfig: func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+				var err error
+				inner, err = goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)(host, ctx)
+				return shared, err
+			},
+		}, host
+	})
+	proxy.EnableTLSKeyLog(&keyLog)
+
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+	l.Close()
+
+	assert.Nil(t, shared.KeyLogWriter)
+	assert.Nil(t, inner.KeyLogWriter)
+	clientRandoms := make(map[string]bool)
+	for _, line := range strings.Split(keyLog.String(), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			clientRandoms[fields[1]] = true
+		}
+	}
+	assert.Len(t, clientRandoms, 2, keyLog.String())
+}
+
+func TestMaxTunnels(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MaxTunnels = 1
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	connect := func() (net.Conn, int) {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err)
+		_, _ = io.WriteString(c, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		require.NoError(t, err)
+		return c, resp.StatusCode
+	}
+
+	first, status := connect()
+	assert.Equal(t, http.StatusOK, status)
+	second, status := connect()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	second.Close()
+	assert.Equal(t, 1, proxy.ActiveTunnels())
+
+	first.Close()
+	for i := 0; i < 100 && proxy.ActiveTunnels() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, status := connect()
+	defer third.Close()
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestMaxHandshakes(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MaxHandshakes = 1
+	proxy.HandshakeQueueTimeout = 50 * time.Millisecond
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	connect := func() (net.Conn, int) {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		require.NoError(t, err)
+		_, _ = io.WriteString(c, "CONNECT "+https.Listener.Addr().String()+" HTTP/1.1\r\nHost: "+https.Listener.Addr().String()+"\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		require.NoError(t, err)
+		return c, resp.StatusCode
+	}
+
+	// The first tunnel never handshakes, holding the only slot.
+	stalled, status := connect()
+	assert.Equal(t, http.StatusOK, status)
+	rejected, status := connect()
+	rejected.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, int64(1), proxy.HandshakeStats().Rejected)
+
+	stalled.Close()
+	for i := 0; i < 100 && proxy.HandshakeStats().Active > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+	stats := proxy.HandshakeStats()
+	assert.Equal(t, int64(1), stats.Failed)
+	assert.Equal(t, int64(1), stats.Completed)
+}
+
+func BenchmarkHttpRequest(b *testing.B) {
+	client, s := oneShotProxy(goproxy.NewProxyHttpServer())
+	defer s.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := get(srv.URL+"/bobo", client); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMitmRequest(b *testing.B) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := get(https.URL+"/bobo", client); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTunnel(b *testing.B) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	s := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer s.Close()
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	_, _ = io.WriteString(c, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		b.Fatal("Cannot CONNECT through proxy", err)
+	}
+
+	payload := bytes.Repeat([]byte("x"), 64*1024)
+	received := make([]byte, len(payload))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		go func() {
+			_, _ = c.Write(payload)
+		}()
+		if _, err := io.ReadFull(br, received); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// mitmConn returns a TLS connection to host through the MITM proxy l.
+func mitmConn(t *testing.T, l *httptest.Server, host string) (*tls.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	require.NoError(t, err)
+	connectResp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, connectResp.StatusCode)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+func TestMitmHTTP10Client(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse(goproxy.UrlHasPrefix(https.Listener.Addr().String() + "/query")).DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			// The length of the new body is unknown.
+			resp.Body = io.NopCloser(strings.NewReader("changed"))
+			return resp
+		})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+
+	host := https.Listener.Addr().String()
+	tlsConn, r := mitmConn(t, l, host)
+	send := func(path, connection string) *http.Response {
+		t.Helper()
+		req := "GET " + path + " HTTP/1.0\r\nHost: " + host + "\r\n"
+		if connection != "" {
+			req += "Connection: " + connection + "\r\n"
+		}
+		_, err := io.WriteString(tlsConn, req+"\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/1.0", resp.Proto)
+		assert.Empty(t, resp.TransferEncoding)
+		return resp
+	}
+
+	// The response of known length keeps the connection alive.
+	resp := send("/bobo", "keep-alive")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "bobo", string(body))
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+
+	// The response of unknown length is delimited by closing the connection.
+	resp = send("/query?result=x", "keep-alive")
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(body))
+	assert.Equal(t, "close", resp.Header.Get("Connection"))
+}
+
+func TestMitmExpectContinue(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/denied" {
+			// The body isn't read, no 100 Continue is sent.
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	host := upstream.Listener.Addr().String()
+
+	tlsConn, r := mitmConn(t, l, host)
+	_, err := io.WriteString(tlsConn, "POST /echo HTTP/1.1\r\nHost: "+host+
+		"\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusContinue, resp.StatusCode)
+	_, err = io.WriteString(tlsConn, "hello")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// The final response is sent without waiting for the body.
+	tlsConn, r = mitmConn(t, l, host)
+	_, err = io.WriteString(tlsConn, "POST /denied HTTP/1.1\r\nHost: "+host+
+		"\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF, "connection not closed after the unread body")
+}
+
+func TestTrailers(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", r.Trailer.Get("X-Checksum"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse().Do(goproxy.HandleTrailers(func(trailer http.Header, ctx *goproxy.ProxyCtx) {
+		trailer.Set("X-Proxy", trailer.Get("Grpc-Status"))
+	}))
+
+	for _, upstream := range []*httptest.Server{plain, secure} {
+		client, l := oneShotProxy(proxy)
+		mitm := upstream == secure
+		// The reader hides the length of the body, which is sent chunked.
+		req, err := http.NewRequest(http.MethodPost, upstream.URL, io.MultiReader(strings.NewReader("hello")))
+		require.NoError(t, err)
+		req.Trailer = http.Header{"X-Checksum": nil}
+		req.Body = &trailerSetter{ReadCloser: req.Body, set: func() { req.Trailer.Set("X-Checksum", "abc") }}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		l.Close()
+
+		assert.Equal(t, "hello", string(body), "mitm=%v", mitm)
+		assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"), "mitm=%v", mitm)
+		assert.Equal(t, "abc", resp.Trailer.Get("Grpc-Message"), "mitm=%v", mitm)
+		assert.Equal(t, "0", resp.Trailer.Get("X-Proxy"), "mitm=%v", mitm)
+	}
+}
+
+// trailerSetter sets the trailers of a request once its body is read.
+type trailerSetter struct {
+	io.ReadCloser
+	set func()
+}
+
+func (t *trailerSetter) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err == io.EOF {
+		t.set()
+	}
+	return n, err
+}
+
+func TestDisableRanges(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlHasPrefix(upstream.Listener.Addr().String() + "/whole")).Do(goproxy.DisableRanges)
+	proxy.OnResponse().Do(goproxy.HandleBytes(func(b []byte, ctx *goproxy.ProxyCtx) []byte {
+		return bytes.ToUpper(append(b, "x"...))
+	}))
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	for path, want := range map[string]string{
+		// The partial content is left unchanged.
+		"/part":  "234",
+		"/whole": "0123456789X",
+	} {
+		req, err := http.NewRequest(http.MethodGet, upstream.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Range", "bytes=2-4")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, want, string(body), path)
+		if path == "/whole" {
+			assert.Empty(t, resp.Header.Get("Accept-Ranges"))
+		}
+	}
+}
+
+func TestNextRoundTripper(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join(r.Header.Values("X-Handlers"), ","))
+	}))
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	for _, name := range []string{"a", "b"} {
+		name := name
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			next := ctx.NextRoundTripper()
+			ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+				req.Header.Add("X-Handlers", name)
+				return next.RoundTrip(req, ctx)
+			})
+			return req, nil
+		})
+	}
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	// The RoundTripper of the last handler wraps those of the previous ones.
+	assert.Equal(t, "b,a", string(getOrFail(t, upstream.URL, client)))
+}
+
+func TestSniffConnect(t *testing.T) {
+	// The echo server is an unknown protocol, and speaks first.
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.WriteString(c, "ready\n")
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	sniffed := make(chan goproxy.Protocol, 4)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.SniffTimeout = 100 * time.Millisecond
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		action := *goproxy.SniffConnect
+		action.Sniff = func(proto goproxy.Protocol, prefix []byte, host string, ctx *goproxy.ProxyCtx) goproxy.ConnectActionLiteral {
+			sniffed <- proto
+			assert.Equal(t, proto, goproxy.SniffProtocol(prefix))
+			return goproxy.ConnectSniff
+		}
+		return &action, host
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Handled", "true")
+		return resp
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+
+	tunnel := func(host string) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.Listener.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		require.NoError(t, err)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return conn, r
+	}
+
+	// TLS is MITM'd.
+	tlsConn, r := mitmConn(t, l, https.Listener.Addr().String())
+	_, err = io.WriteString(tlsConn, "GET /bobo HTTP/1.1\r\nHost: "+https.Listener.Addr().String()+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "true", resp.Header.Get("X-Handled"))
+	assert.Equal(t, goproxy.ProtocolTLS, <-sniffed)
+
+	// Plain HTTP is handled by the proxy.
+	conn, r := tunnel(srv.Listener.Addr().String())
+	_, err = io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+srv.Listener.Addr().String()+"\r\n\r\n")
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "bobo", string(body))
+	assert.Equal(t, "true", resp.Header.Get("X-Handled"))
+	assert.Equal(t, goproxy.ProtocolHTTP, <-sniffed)
+
+	// The silent client of a server speaking first is relayed, as well as
+	// the unknown protocols.
+	conn, r = tunnel(echo.Addr().String())
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+	assert.Equal(t, goproxy.ProtocolUnknown, <-sniffed)
+	_, err = io.WriteString(conn, "\x00ping\n")
+	require.NoError(t, err)
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\x00ping\n", line)
+}
+
+func TestSniffProtocol(t *testing.T) {
+	for prefix, want := range map[string]goproxy.Protocol{
+		"\x16\x03\x01\x02\x00":             goproxy.ProtocolTLS,
+		"GET / HTTP/1.1\r\n":               goproxy.ProtocolHTTP,
+		"PROPFIND /dav HTTP/1.1\r\n":       goproxy.ProtocolHTTP,
+		"SSH-2.0-OpenSSH_9.6\r\n":          goproxy.ProtocolSSH,
+		"\x13BitTorrent protocol\x00\x00":  goproxy.ProtocolBitTorrent,
+		"GETX / HTTP/1.1":                  goproxy.ProtocolUnknown,
+		"\x00\x01":                         goproxy.ProtocolUnknown,
+		"220 mx.example.com ESMTP ready\n": goproxy.ProtocolUnknown,
+	} {
+		assert.Equal(t, want, goproxy.SniffProtocol([]byte(prefix)), "%q", prefix)
+	}
+	for prefix, want := range map[string]goproxy.Protocol{
+		"220 mx.example.com ESMTP ready\r\n": goproxy.ProtocolSMTP,
+		"220 ftp.example.com FTP ready\r\n":  goproxy.ProtocolUnknown,
+		"SSH-2.0-OpenSSH_9.6\r\n":            goproxy.ProtocolSSH,
+	} {
+		assert.Equal(t, want, goproxy.SniffServerProtocol([]byte(prefix)), "%q", prefix)
+	}
+}
+
+func TestStreamConnect(t *testing.T) {
+	// A line echo protocol over TLS.
+	echo, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{goproxy.GoproxyCa},
+		NextProtos:   []string{"echo/1"},
+	})
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					_, _ = io.WriteString(c, "echo: "+line)
+				}
+			}()
+		}
+	}()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		action := *goproxy.MitmConnect
+		action.Stream = goproxy.FuncStreamHandler(func(client, upstream io.ReadWriteCloser, ctx *goproxy.ProxyCtx) error {
+			line, err := bufio.NewReader(client).ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(upstream, strings.ToUpper(line)); err != nil {
+				return err
+			}
+			return goproxy.RelayStream(client, upstream, ctx)
+		})
+		return &action, host
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"echo/1"}})
+	require.NoError(t, tlsConn.Handshake())
+	state := tlsConn.ConnectionState()
+	assert.False(t, state.PeerCertificates[0].IsCA, "the session is MITM'd")
+	assert.Equal(t, "echo/1", state.NegotiatedProtocol)
+
+	r := bufio.NewReader(tlsConn)
+	for _, tt := range []struct{ send, want string }{{"ping\n", "echo: PING\n"}, {"pong\n", "echo: pong\n"}} {
+		_, err = io.WriteString(tlsConn, tt.send)
+		require.NoError(t, err)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, line)
+	}
+}
+
+func TestSniffClientHello(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, &tls.Config{ServerName: "db.example.com", NextProtos: []string{"postgresql"}}).Handshake()
+	}()
+	record := make([]byte, 5)
+	_, err := io.ReadFull(server, record)
+	require.NoError(t, err)
+	body := make([]byte, int(record[3])<<8|int(record[4]))
+	_, err = io.ReadFull(server, body)
+	require.NoError(t, err)
+	record = append(record, body...)
+
+	hello, ok := goproxy.SniffClientHello(record)
+	require.True(t, ok)
+	assert.Equal(t, "db.example.com", hello.ServerName)
+	assert.Equal(t, []string{"postgresql"}, hello.ALPN)
+	_, ok = goproxy.SniffClientHello(record[:len(record)-10])
+	assert.False(t, ok)
+	_, ok = goproxy.SniffClientHello([]byte("GET / HTTP/1.1\r\n"))
+	assert.False(t, ok)
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	upstream := httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+			_ = websocket.Message.Send(ws, msg)
+		}
+	}))
+	defer upstream.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.WebSocketHandler = goproxy.FuncWebSocketHandler(func(f *goproxy.WebSocketFrame, ctx *goproxy.ProxyCtx) *goproxy.WebSocketFrame {
+			if f.Opcode != goproxy.WebSocketText {
+				return f
+			}
+			if string(f.Payload) == "drop" {
+				return nil
+			}
+			if f.FromClient {
+				f.Payload = bytes.ToUpper(f.Payload)
+			} else {
+				f.Payload = append(f.Payload, '!')
+			}
+			return f
+		})
+		return req, nil
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+
+	host := upstream.Listener.Addr().String()
+	tlsConn, _ := mitmConn(t, l, host)
+	config, err := websocket.NewConfig("wss://"+host+"/", "https://"+host)
+	require.NoError(t, err)
+	ws, err := websocket.NewClient(config, tlsConn)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	for _, msg := range []string{"hello", "drop", strings.Repeat("x", 70000)} {
+		require.NoError(t, websocket.Message.Send(ws, msg))
+	}
+	var got string
+	require.NoError(t, websocket.Message.Receive(ws, &got))
+	assert.Equal(t, "HELLO!", got)
+	require.NoError(t, websocket.Message.Receive(ws, &got))
+	assert.Equal(t, strings.Repeat("X", 70000)+"!", got)
+}
+
+func TestEvents(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlHasPrefix("/bobo")).Named("bobo").DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, nil
+	})
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewUnstartedServer(proxy)
+	s.Listener = proxy.TrackListener(s.Listener)
+	s.Start()
+	defer s.Close()
+
+	var mu sync.Mutex
+	var events []string
+	unsubscribe := proxy.Subscribe(func(e *goproxy.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch e.Type {
+		case goproxy.EventRequestCompleted:
+			events = append(events, e.Type.String()+" "+e.Req.URL.Path+" "+e.Resp.Status)
+		case goproxy.EventRuleMatched:
+			events = append(events, e.Type.String()+" "+e.Rule)
+		default:
+			events = append(events, e.Type.String())
+		}
+	})
+	var closed int
+	proxy.Subscribe(func(e *goproxy.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		closed++
+	}, goproxy.EventConnClosed)
+
+	proxyURL, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := &http.Client{Transport: tr}
+	assert.Equal(t, "bobo", string(getOrFail(t, srv.URL+"/bobo", client)))
+	assert.Equal(t, "bobo", string(getOrFail(t, https.URL+"/bobo", client)))
+	tr.CloseIdleConnections()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return closed == 2
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{
+		"conn_opened",
+		"request_started",
+		"rule_matched bobo",
+		"request_completed /bobo 200 OK",
+		"conn_opened",
+		"mitm_established",
+		"request_started",
+		"rule_matched bobo",
+		"request_completed /bobo 200 OK",
+		"conn_closed",
+		"conn_closed",
+	}, events)
+	mu.Unlock()
+
+	unsubscribe()
+	assert.Equal(t, "bobo", string(getOrFail(t, srv.URL+"/bobo", client)))
+	mu.Lock()
+	assert.Len(t, events, 11)
+	mu.Unlock()
+}
+
+func TestSwapRules(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	started, release := make(chan struct{}), make(chan struct{})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/bobo")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.Query().Get("wait") != "" {
+			close(started)
+			<-release
+		}
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Rules", "old")
+		return resp
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	inFlight := make(chan string)
+	go func() {
+		resp, err := client.Get(srv.URL + "/bobo?wait=1")
+		if err != nil {
+			inFlight <- err.Error()
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.Header.Get("X-Rules")
+	}()
+	<-started
+
+	rules := goproxy.NewRules()
+	rules.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Rules", "new")
+		return resp
+	})
+	old := proxy.SwapRules(rules)
+	assert.Same(t, rules, proxy.Rules())
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "new", resp.Header.Get("X-Rules"))
+	close(release)
+	assert.Equal(t, "old", <-inFlight)
+
+	// The rules are extended without changing those in place.
+	extended := old.Clone()
+	extended.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "denied")
+	})
+	proxy.SwapRules(extended)
+	resp, err = client.Get(srv.URL + "/bobo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "old", resp.Header.Get("X-Rules"))
+	proxy.SwapRules(old)
+	assert.Equal(t, "bobo", string(getOrFail(t, srv.URL+"/bobo", client)))
+}
+
+func TestCertClock(t *testing.T) {
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := goproxy.NewFakeClock(now)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertClock = goproxy.SkewClock(clock, -24*time.Hour)
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+
+	tlsConn, _ := mitmConn(t, l, https.Listener.Addr().String())
+	require.NoError(t, tlsConn.Handshake())
+	leaf := tlsConn.ConnectionState().PeerCertificates[0]
+	assert.Equal(t, now.Add(-24*time.Hour-30*24*time.Hour), leaf.NotBefore)
+	assert.Equal(t, now.Add(-24*time.Hour+365*24*time.Hour), leaf.NotAfter)
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, now.Add(time.Hour), clock.Now())
+}
+
+func TestCAPermits(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	_, excluded, _ := net.ParseCIDR("10.1.0.0/16")
+	ca := &x509.Certificate{
+		PermittedDNSDomains: []string{"example.com", ".example.org"},
+		ExcludedDNSDomains:  []string{"secret.example.com"},
+		PermittedIPRanges:   []*net.IPNet{private},
+		ExcludedIPRanges:    []*net.IPNet{excluded},
+	}
+	for host, permitted := range map[string]bool{
+		"example.com":          true,
+		"WWW.Example.com.:443": true,
+		"example.org":          false,
+		"www.example.org":      true,
+		"secret.example.com":   false,
+		"a.secret.example.com": false,
+		"notexample.com":       false,
+		"10.2.3.4":             true,
+		"10.1.2.3:443":         false,
+		"192.0.2.1":            false,
+		"[::1]:443":            false,
+		"www.example.net":      false,
+	} {
+		assert.Equal(t, permitted, goproxy.CAPermits(ca, host), host)
+	}
+	assert.True(t, goproxy.CAPermits(&x509.Certificate{}, "example.net"))
+	assert.True(t, goproxy.CAPermits(&x509.Certificate{PermittedDNSDomains: []string{"example.com"}}, "192.0.2.1"))
+
+	handler := goproxy.MitmWithinCA(&tls.Certificate{Leaf: ca})
+	ctx := &goproxy.ProxyCtx{Proxy: goproxy.NewProxyHttpServer()}
+	action, _ := handler.HandleConnect("www.example.com:443", ctx)
+	assert.EqualValues(t, goproxy.ConnectMitm, action.Action)
+	action, _ = handler.HandleConnect("www.example.net:443", ctx)
+	assert.EqualValues(t, goproxy.ConnectAccept, action.Action)
+}
+
+type countingTransport struct {
+	n  int32
+	tr http.RoundTripper
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.n, 1)
+	return c.tr.RoundTrip(req)
+}
+
+func TestRequestTransport(t *testing.T) {
+	tr := &countingTransport{tr: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	var dials int32
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlHasPrefix("/transport")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Transport = tr
+		return req, nil
+	})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/dialer")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		return req, nil
+	})
+	// The wrappers of the RoundTripper end with the transport of the request.
+	proxy.OnRequest().Do(goproxy.DisableRanges)
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Transport = tr
+		return goproxy.MitmConnect, host
+	}))
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for _, path := range []string{"/transport", "/dialer", "/default"} {
+		resp, err := client.Get(srv.URL + path)
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&tr.n))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+
+	// The MITM'd requests inherit the transport of their CONNECT request.
+	resp, err := client.Get(https.URL + "/bobo")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "bobo", string(body))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&tr.n))
+}
+
+func TestTunnelDialerKeepAlive(t *testing.T) {
+	var dials int32
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		return goproxy.MitmConnect, host
+	}))
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+
+	// The requests of the tunnel reuse the connection of its Dialer.
+	host := https.Listener.Addr().String()
+	tlsConn, r := mitmConn(t, l, host)
+	for i := 0; i < 3; i++ {
+		_, err := io.WriteString(tlsConn, "GET /bobo HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(r, nil)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "bobo", string(body))
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials))
+}
+
+func TestRequestID(t *testing.T) {
+	var received []string
+	var mu sync.Mutex
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		received = append(received, req.Header.Get("X-Request-Id"))
+		mu.Unlock()
+	}))
+	defer upstream.Close()
+
+	var ids []string
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.RequestIDHeader = "X-Request-Id"
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		assert.Equal(t, ctx.RequestID(), ctx.RequestID())
+		ids = append(ids, ctx.RequestID())
+		return req, nil
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, id := range []string{"", "client-id-1", "bad id"} {
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	require.Len(t, received, 3)
+	assert.Equal(t, ids, received)
+	assert.Regexp(t, "^[0-9a-f]{32}$", received[0])
+	assert.Equal(t, "client-id-1", received[1])
+	assert.Regexp(t, "^[0-9a-f]{32}$", received[2])
+	assert.NotEqual(t, received[0], received[2])
+}
+
+func TestErrorClasses(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedURL := closed.URL
+	closed.Close()
+
+	errs := make(chan error, 1)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Subscribe(func(e *goproxy.Event) { errs <- e.Err }, goproxy.EventRequestCompleted)
+	proxy.OnRequest(goproxy.UrlHasPrefix("/verify")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		// Sent to the TLS server, with a transport verifying its certificate.
+		u, _ := url.Parse(https.URL)
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		ctx.Transport = &http.Transport{}
+		return req, nil
+	})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	for _, c := range []struct {
+		url   string
+		class error
+		name  string
+	}{
+		{closedURL, goproxy.ErrDialRefused, "dial_refused"},
+		{srv.URL + "/verify", goproxy.ErrTLSVerify, "tls_verify"},
+	} {
+		resp, err := client.Get(c.url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		err = <-errs
+		assert.ErrorIs(t, err, c.class)
+		assert.Equal(t, c.name, goproxy.ErrorClass(err))
+	}
+
+	// The 407 responses of the upstream proxies to the CONNECT requests.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer upstream.Close()
+	_, err := proxy.NewConnectDialToProxy(upstream.URL)("tcp", "example.com:443")
+	assert.ErrorIs(t, err, goproxy.ErrUpstreamProxyAuth)
+	assert.Equal(t, "upstream_proxy_auth", goproxy.ErrorClass(err))
+
+	assert.Equal(t, "blocked", goproxy.ErrorClass(&goproxy.ErrBlockedByRule{RuleID: "ads"}))
+	assert.Equal(t, "other", goproxy.ErrorClass(io.ErrUnexpectedEOF))
+	assert.Equal(t, "", goproxy.ErrorClass(nil))
+}
+
+func TestTimeouts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow-header" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Header().Set("Content-Length", "4")
+		io.WriteString(w, "ab")
+		w.(http.Flusher).Flush()
+		if req.URL.Path == "/slow-body" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		io.WriteString(w, "cd")
+	}))
+	defer upstream.Close()
+
+	errs := make(chan error, 1)
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Subscribe(func(e *goproxy.Event) { errs <- e.Err }, goproxy.EventRequestCompleted)
+	proxy.OnRequest().Do(goproxy.Timeouts{Response: 100 * time.Millisecond, Total: 200 * time.Millisecond})
+	l := httptest.NewServer(proxy)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(upstream.URL + "/fast")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(body))
+	assert.NoError(t, <-errs)
+
+	// The response header isn't received in time.
+	resp, err = client.Get(upstream.URL + "/slow-header")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Contains(t, string(body), "response timeout")
+	err = <-errs
+	var timeout *goproxy.TimeoutError
+	require.ErrorAs(t, err, &timeout)
+	assert.Equal(t, goproxy.PhaseResponse, timeout.Phase)
+	assert.ErrorIs(t, err, goproxy.ErrResponseTimeout)
+
+	// The body is cut by the total timeout.
+	resp, err = client.Get(upstream.URL + "/slow-body")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Error(t, err)
+	<-errs
+}
+
+func TestParseUserAgent(t *testing.T) {
+	for ua, expected := range map[string]goproxy.UserAgent{
+		"curl/8.4.0":             {Class: goproxy.UATool, Name: "curl", Version: "8.4.0"},
+		"python-requests/2.31.0": {Class: goproxy.UATool, Name: "python-requests", Version: "2.31.0"},
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": {
+			Class: goproxy.UABot, Name: "Googlebot", Version: "2.1",
+		},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36": {
+			Class: goproxy.UABrowser, Name: "Chrome", Version: "120.0.0.0", OS: "Windows",
+		},
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91": {
+			Class: goproxy.UABrowser, Name: "Edge", Version: "120.0.2210.91", OS: "Windows",
+		},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1": {
+			Class: goproxy.UABrowser, Name: "Safari", Version: "17.2", OS: "iOS",
+		},
+		"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0": {
+			Class: goproxy.UABrowser, Name: "Firefox", Version: "121.0", OS: "Linux",
+		},
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.144 Mobile Safari/537.36": {
+			Class: goproxy.UABrowser, Name: "Chrome", Version: "120.0.6099.144", OS: "Android",
+		},
+		"SomeCrawler/1.0": {Class: goproxy.UABot},
+		"":                {},
+	} {
+		assert.Equal(t, expected, goproxy.ParseUserAgent(ua), ua)
+	}
+}
+
+func TestClientFingerprint(t *testing.T) {
+	var fingerprint *goproxy.TLSFingerprint
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		fingerprint = ctx.ClientFingerprint()
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotNil(t, fingerprint)
+	// No SNI for the IP addresses.
+	assert.Regexp(t, `^t13i\d{4}00_[0-9a-f]{12}_[0-9a-f]{12}$`, fingerprint.JA4)
+	assert.Regexp(t, `^771,[0-9-]+,[0-9-]+,[0-9-]+,0$`, fingerprint.JA3)
+	assert.Regexp(t, "^[0-9a-f]{32}$", fingerprint.JA3Hash)
+
+	// The Go client claiming to be Chrome is still blocked by its
+	// fingerprint, but not the other requests.
+	fingerprints := goproxy.ClientFingerprints{fingerprint.JA4: goproxy.UATool}
+	proxy.OnRequest(fingerprints.ClientIs(goproxy.UATool), goproxy.JA3Is(fingerprint.JA3Hash), goproxy.JA4Is(fingerprint.JA4)).DoFunc(
+		func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked")
+		})
+	req, _ := http.NewRequest(http.MethodGet, https.URL+"/bobo", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = client.Get(srv.URL + "/bobo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// connWriter writes the responses on a connection served by the proxy
+// itself, outside net/http, as the transparent proxies do.
+type connWriter struct {
+	net.Conn
+	header http.Header
+}
+
+func (w *connWriter) Header() http.Header { return w.header }
+
+func (w *connWriter) WriteHeader(code int) {
+	_, _ = io.WriteString(w.Conn, "HTTP/1.1 "+strconv.Itoa(code)+" "+http.StatusText(code)+"\r\n\r\n")
+}
+
+func (w *connWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.Conn, bufio.NewReadWriter(bufio.NewReader(w.Conn), bufio.NewWriter(w.Conn)), nil
+}
+
+func TestAbortOwnConn(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			return nil, http.ErrAbortHandler
+		})
+		return req, nil
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	go proxy.ServeHTTP(&connWriter{Conn: server, header: http.Header{}}, req)
+
+	// The connection is closed without any response, and without a panic
+	// that nothing would recover from.
+	b, err := io.ReadAll(client)
+	require.NoError(t, err)
+	assert.Empty(t, b)
+}
@@ -0,0 +1,58 @@
+package goproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// RequestID returns the unique ID of the request, included in the logs of
+// the proxy, for the correlation of the logs, the metrics and the error
+// pages of a request. It is assigned when the request is received, or on
+// the first call for the CONNECT requests, and propagated with the
+// RequestIDHeader of the proxy.
+func (ctx *ProxyCtx) RequestID() string {
+	if ctx.requestID == "" {
+		ctx.requestID = newRequestID()
+	}
+	return ctx.requestID
+}
+
+// newRequestID returns 16 random bytes in hexadecimal, the format of the
+// trace IDs of W3C Trace Context.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("goproxy: can't generate a request ID: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID returns whether the id received from a client can be used,
+// in the logs and the headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// assignRequestID assigns the ID of the request of ctx, propagated with the
+// RequestIDHeader.
+func (ctx *ProxyCtx) assignRequestID() {
+	header := ctx.Proxy.RequestIDHeader
+	if header == "" || ctx.Req == nil {
+		ctx.RequestID()
+		return
+	}
+	if id := ctx.Req.Header.Get(header); validRequestID(id) {
+		ctx.requestID = id
+	} else {
+		ctx.RequestID()
+	}
+	ctx.Req.Header.Set(header, ctx.requestID)
+}
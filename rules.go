@@ -0,0 +1,77 @@
+package goproxy
+
+// Rules is a set of request, CONNECT and response handlers, registered with
+// its OnRequest and OnResponse as on the proxy. A Rules is built offline,
+// then swapped into the running proxy with SwapRules, atomically: each
+// request is handled entirely by the rules in place when its handlers
+// started, so that a reload is never seen partially applied, and the
+// requests in flight finish under the old rules.
+//
+//	rules := goproxy.NewRules()
+//	rules.OnRequest(goproxy.ReqHostIs("ads.example.com")).DoFunc(block)
+//	rules.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	proxy.SwapRules(rules)
+//
+// A Rules must not be changed once swapped in, except by the proxy
+// OnRequest and OnResponse before the proxy serves, as usual.
+type Rules struct {
+	reqHandlers   []ReqHandler
+	respHandlers  []RespHandler
+	httpsHandlers []HttpsHandler
+}
+
+// NewRules returns an empty set of rules.
+func NewRules() *Rules {
+	return &Rules{}
+}
+
+// Clone returns a copy of the rules, to which rules can be added without
+// changing rules, for example to extend the rules in place.
+func (rules *Rules) Clone() *Rules {
+	return &Rules{
+		reqHandlers:   append([]ReqHandler(nil), rules.reqHandlers...),
+		respHandlers:  append([]RespHandler(nil), rules.respHandlers...),
+		httpsHandlers: append([]HttpsHandler(nil), rules.httpsHandlers...),
+	}
+}
+
+// OnRequest is ProxyHttpServer.OnRequest for the rules.
+func (rules *Rules) OnRequest(conds ...ReqCondition) *ReqProxyConds {
+	return &ReqProxyConds{rules: rules, reqConds: conds}
+}
+
+// OnResponse is ProxyHttpServer.OnResponse for the rules.
+func (rules *Rules) OnResponse(conds ...RespCondition) *ProxyConds {
+	return &ProxyConds{rules: rules, reqConds: make([]ReqCondition, 0), respCond: conds}
+}
+
+// Rules returns the rules in place.
+func (proxy *ProxyHttpServer) Rules() *Rules {
+	if rules := proxy.rules.Load(); rules != nil {
+		return rules
+	}
+	proxy.rules.CompareAndSwap(nil, NewRules())
+	return proxy.rules.Load()
+}
+
+// SwapRules replaces the rules of the proxy by rules, returning the
+// previous ones. The requests already handled keep the previous rules.
+func (proxy *ProxyHttpServer) SwapRules(rules *Rules) *Rules {
+	if rules == nil {
+		rules = NewRules()
+	}
+	old := proxy.rules.Swap(rules)
+	if old == nil {
+		old = NewRules()
+	}
+	return old
+}
+
+// rules returns the rules handling the request of ctx, those in place when
+// first asked for.
+func (ctx *ProxyCtx) rules() *Rules {
+	if ctx.ruleSet == nil {
+		ctx.ruleSet = ctx.Proxy.Rules()
+	}
+	return ctx.ruleSet
+}
@@ -0,0 +1,372 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Protocol is the protocol of a tunnel, sniffed from the first bytes of the
+// client.
+type Protocol int
+
+const (
+	// ProtocolUnknown is any other protocol, or a tunnel where the server
+	// speaks first.
+	ProtocolUnknown Protocol = iota
+	ProtocolTLS
+	ProtocolHTTP
+	ProtocolSSH
+	// ProtocolSMTP is sniffed from the greeting of the server, its clients
+	// being silent until then.
+	ProtocolSMTP
+	ProtocolBitTorrent
+)
+
+var protocolNames = [...]string{
+	ProtocolUnknown:    "unknown",
+	ProtocolTLS:        "tls",
+	ProtocolHTTP:       "http",
+	ProtocolSSH:        "ssh",
+	ProtocolSMTP:       "smtp",
+	ProtocolBitTorrent: "bittorrent",
+}
+
+func (p Protocol) String() string {
+	if p < 0 || int(p) >= len(protocolNames) {
+		return "unknown"
+	}
+	return protocolNames[p]
+}
+
+// connectAction returns how the tunnels of a protocol are handled by
+// default.
+func (p Protocol) connectAction() ConnectActionLiteral {
+	switch p {
+	case ProtocolTLS:
+		return ConnectMitm
+	case ProtocolHTTP:
+		return ConnectHTTPMitm
+	}
+	return ConnectAccept
+}
+
+// sniffSize is the largest prefix sniffed, holding the greeting line of
+// most SMTP servers.
+const sniffSize = 64
+
+var httpMethods = [][]byte{
+	[]byte("GET"), []byte("HEAD"), []byte("POST"), []byte("PUT"), []byte("DELETE"),
+	[]byte("OPTIONS"), []byte("PATCH"), []byte("TRACE"),
+	[]byte("PROPFIND"), []byte("PROPPATCH"), []byte("MKCOL"), []byte("COPY"),
+	[]byte("MOVE"), []byte("LOCK"), []byte("UNLOCK"), []byte("REPORT"), []byte("SEARCH"),
+}
+
+// sniffTLS returns whether prefix starts a TLS handshake record, of the
+// record versions SSL 3.0 to TLS 1.3, and whether it may still start one.
+func sniffTLS(prefix []byte) (match, maybe bool) {
+	pattern := []byte{0x16, 0x03}
+	if len(prefix) < 3 {
+		return false, bytes.HasPrefix(pattern, prefix) || bytes.HasPrefix(prefix, pattern)
+	}
+	return bytes.HasPrefix(prefix, pattern) && prefix[2] <= 0x04, false
+}
+
+// sniffHTTP returns whether prefix starts an HTTP/1 request line, and
+// whether it may still start one.
+func sniffHTTP(prefix []byte) (match, maybe bool) {
+	for _, m := range httpMethods {
+		line := append(m[:len(m):len(m)], ' ')
+		if bytes.HasPrefix(prefix, line) {
+			return true, false
+		}
+		if bytes.HasPrefix(line, prefix) {
+			maybe = true
+		}
+	}
+	return false, maybe
+}
+
+// sniffMagic returns whether prefix starts with magic, and whether it may
+// still start with it.
+func sniffMagic(prefix []byte, magic string) (match, maybe bool) {
+	if len(prefix) < len(magic) {
+		return false, bytes.HasPrefix([]byte(magic), prefix)
+	}
+	return bytes.HasPrefix(prefix, []byte(magic)), false
+}
+
+// sniffSMTP returns whether prefix is the greeting of an SMTP server, such
+// as "220 mx.example.com ESMTP", and whether more bytes are needed.
+func sniffSMTP(prefix []byte) (match, maybe bool) {
+	if code, more := sniffMagic(prefix, "220"); !code {
+		return false, more
+	}
+	line, _, complete := bytes.Cut(prefix, []byte("\n"))
+	if !complete && len(prefix) < sniffSize {
+		return false, true
+	}
+	// The FTP servers greet with 220 as well.
+	return bytes.Contains(bytes.ToUpper(line), []byte("SMTP")), false
+}
+
+// SniffProtocol returns the protocol of a tunnel whose client starts with
+// prefix.
+func SniffProtocol(prefix []byte) Protocol {
+	proto, _ := sniffProtocol(prefix)
+	return proto
+}
+
+// SniffServerProtocol returns the protocol of a tunnel whose server starts
+// with prefix, the client being silent.
+func SniffServerProtocol(prefix []byte) Protocol {
+	proto, _ := sniffServerProtocol(prefix)
+	return proto
+}
+
+// sniffProtocol returns the protocol whose client starts with prefix, and
+// false when more bytes are needed.
+func sniffProtocol(prefix []byte) (Protocol, bool) {
+	tls, maybeTLS := sniffTLS(prefix)
+	if tls {
+		return ProtocolTLS, true
+	}
+	http, maybeHTTP := sniffHTTP(prefix)
+	if http {
+		return ProtocolHTTP, true
+	}
+	ssh, maybeSSH := sniffMagic(prefix, "SSH-")
+	if ssh {
+		return ProtocolSSH, true
+	}
+	// The handshake of the BitTorrent peers.
+	bt, maybeBT := sniffMagic(prefix, "\x13BitTorrent protocol")
+	if bt {
+		return ProtocolBitTorrent, true
+	}
+	return ProtocolUnknown, !maybeTLS && !maybeHTTP && !maybeSSH && !maybeBT
+}
+
+// sniffServerProtocol returns the protocol whose server starts with prefix,
+// and false when more bytes are needed.
+func sniffServerProtocol(prefix []byte) (Protocol, bool) {
+	ssh, maybeSSH := sniffMagic(prefix, "SSH-")
+	if ssh {
+		return ProtocolSSH, true
+	}
+	smtp, maybeSMTP := sniffSMTP(prefix)
+	if smtp {
+		return ProtocolSMTP, true
+	}
+	return ProtocolUnknown, !maybeSSH && !maybeSMTP
+}
+
+// ClientHello is the SNI, the ALPN protocols and the extensions of a TLS
+// ClientHello.
+type ClientHello struct {
+	// ServerName is empty when the client sent no SNI: it connects to an
+	// IP address, or hides its SNI as with ECH.
+	ServerName string
+	ALPN       []string
+	// Extensions are the types of the extensions, in the order sent.
+	Extensions []uint16
+}
+
+// SniffClientHello parses the ClientHello of prefix, the first TLS record
+// of a client sniffed by ConnectSniff. It returns false when prefix isn't a
+// whole ClientHello.
+func SniffClientHello(prefix []byte) (*ClientHello, bool) {
+	if match, _ := sniffTLS(prefix); !match || len(prefix) < 5 {
+		return nil, false
+	}
+	record := helloReader(prefix[5:])
+	if n := int(binary.BigEndian.Uint16(prefix[3:5])); n < len(record) {
+		record = record[:n]
+	}
+	msgType, ok := record.uint8()
+	if !ok || msgType != 1 {
+		return nil, false
+	}
+	// The version, the random, the session ID, the cipher suites and the
+	// compression methods.
+	body, ok := record.vector(3)
+	if !ok || !body.skip(2+32) || !body.skipVector(1) || !body.skipVector(2) || !body.skipVector(1) {
+		return nil, false
+	}
+	hello := &ClientHello{}
+	if len(body) == 0 {
+		return hello, true
+	}
+	extensions, ok := body.vector(2)
+	if !ok {
+		return nil, false
+	}
+	for len(extensions) > 0 {
+		typ, ok := extensions.uint16()
+		if !ok {
+			return nil, false
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return nil, false
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+		switch typ {
+		case 0: // server_name
+			names, _ := data.vector(2)
+			for len(names) > 0 {
+				nameType, _ := names.uint8()
+				name, ok := names.vector(2)
+				if !ok {
+					break
+				}
+				if nameType == 0 {
+					hello.ServerName = string(name)
+				}
+			}
+		case 16: // application_layer_protocol_negotiation
+			protos, _ := data.vector(2)
+			for len(protos) > 0 {
+				proto, ok := protos.vector(1)
+				if !ok {
+					break
+				}
+				hello.ALPN = append(hello.ALPN, string(proto))
+			}
+		}
+	}
+	return hello, true
+}
+
+// helloReader reads the fields of a ClientHello.
+type helloReader []byte
+
+func (r *helloReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vector reads a vector whose length takes size bytes.
+func (r *helloReader) vector(size int) (helloReader, bool) {
+	if len(*r) < size {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:size] {
+		n = n<<8 | int(b)
+	}
+	if len(*r) < size+n {
+		return nil, false
+	}
+	v := (*r)[size : size+n]
+	*r = (*r)[size+n:]
+	return v, true
+}
+
+func (r *helloReader) skipVector(size int) bool {
+	_, ok := r.vector(size)
+	return ok
+}
+
+func (proxy *ProxyHttpServer) sniffTimeout() time.Duration {
+	if proxy.SniffTimeout > 0 {
+		return proxy.SniffTimeout
+	}
+	return time.Second
+}
+
+// maxHelloRecord is the largest TLS record holding a ClientHello sniffed.
+const maxHelloRecord = 5 + 1<<14
+
+// sniff reads the first bytes of conn, for timeout at most, until classify
+// recognizes their protocol. It returns the connection replaying them, the
+// sniffed protocol and prefix, the whole first record for TLS.
+func sniff(conn net.Conn, timeout time.Duration, classify func([]byte) (Protocol, bool)) (net.Conn, Protocol, []byte) {
+	r := bufio.NewReaderSize(conn, maxHelloRecord)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	var prefix []byte
+	proto := ProtocolUnknown
+	for n := 1; n <= sniffSize; n++ {
+		var err error
+		if prefix, err = r.Peek(n); err != nil {
+			break
+		}
+		var done bool
+		if proto, done = classify(prefix); done {
+			break
+		}
+		// Peek the bytes already received at once.
+		if b := r.Buffered(); b > n {
+			n = b - 1
+			if n >= sniffSize {
+				n = sniffSize - 1
+			}
+		}
+	}
+	if proto == ProtocolTLS {
+		if header, err := r.Peek(5); err == nil {
+			n := 5 + int(binary.BigEndian.Uint16(header[3:5]))
+			if n > maxHelloRecord {
+				n = maxHelloRecord
+			}
+			if record, err := r.Peek(n); err == nil {
+				prefix = record
+			}
+		}
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	sniffed := &sniffedConn{Conn: conn, r: r}
+	if hc, ok := conn.(halfClosable); ok {
+		return &sniffedHalfConn{sniffedConn: sniffed, hc: hc}, proto, append([]byte(nil), prefix...)
+	}
+	return sniffed, proto, append([]byte(nil), prefix...)
+}
+
+// sniffedConn replays the bytes read by the sniffing.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// sniffedHalfConn is a sniffedConn of a TCP connection, which tunnels are
+// half closed.
+type sniffedHalfConn struct {
+	*sniffedConn
+	hc halfClosable
+}
+
+func (c *sniffedHalfConn) CloseWrite() error {
+	return c.hc.CloseWrite()
+}
+
+func (c *sniffedHalfConn) CloseRead() error {
+	return c.hc.CloseRead()
+}
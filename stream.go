@@ -0,0 +1,108 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// StreamHandler takes over the sessions MITM'd by a ConnectAction whose
+// Stream is set, for the protocols over TLS that aren't HTTP. The client
+// and upstream sides are the decrypted sessions with the client and with
+// the server, closed once HandleStream returns.
+type StreamHandler interface {
+	HandleStream(client, upstream io.ReadWriteCloser, ctx *ProxyCtx) error
+}
+
+// FuncStreamHandler is a StreamHandler function.
+type FuncStreamHandler func(client, upstream io.ReadWriteCloser, ctx *ProxyCtx) error
+
+// HandleStream implements StreamHandler.
+func (h FuncStreamHandler) HandleStream(client, upstream io.ReadWriteCloser, ctx *ProxyCtx) error {
+	return h(client, upstream, ctx)
+}
+
+// RelayStream relays the sessions as they are, until both sides are done.
+var RelayStream FuncStreamHandler = func(client, upstream io.ReadWriteCloser, ctx *ProxyCtx) error {
+	errs := make(chan error, 1)
+	go func() {
+		_, err := copyBuffer(upstream, client)
+		if cw, ok := upstream.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		errs <- err
+	}()
+	_, err := copyBuffer(client, upstream)
+	if cw, ok := client.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	if uerr := <-errs; err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// streaming returns a copy of config opening the upstream session of the
+// client hello into *upstream, before its handshake is completed: the
+// protocols offered by the client are offered to the server, the one it
+// selects being negotiated with the client.
+func (proxy *ProxyHttpServer) streaming(config *tls.Config, host string, ctx *ProxyCtx, upstream **tls.Conn) *tls.Config {
+	// The CONNECT request is done once its connection is hijacked, the
+	// session outliving it.
+	ctx.Req = ctx.Req.WithContext(context.Background())
+	config = config.Clone()
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		base := config
+		if next != nil {
+			c, err := next(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				base = c
+			}
+		}
+		addr := host
+		if !hasPort.MatchString(addr) {
+			addr += ":443"
+		}
+		conn, err := proxy.connectDial(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig := &tls.Config{}
+		if proxy.Tr != nil && proxy.Tr.TLSClientConfig != nil {
+			clientConfig = proxy.Tr.TLSClientConfig.Clone()
+		}
+		if clientConfig.ServerName == "" && hello.ServerName != "" {
+			clientConfig.ServerName = hello.ServerName
+		}
+		clientConfig.NextProtos = hello.SupportedProtos
+		tlsConn, err := proxy.initializeTLSconnection(ctx, conn, clientConfig, addr)
+		if err != nil {
+			_ = conn.Close()
+			return nil, classifyError(err)
+		}
+		*upstream = tlsConn.(*tls.Conn)
+
+		base = base.Clone()
+		base.GetConfigForClient = nil
+		base.NextProtos = nil
+		if proto := (*upstream).ConnectionState().NegotiatedProtocol; proto != "" {
+			base.NextProtos = []string{proto}
+		}
+		return base, nil
+	}
+	return config
+}
+
+// serveStream hands the MITM'd session of client with upstream to h.
+func (proxy *ProxyHttpServer) serveStream(h StreamHandler, client net.Conn, upstream *tls.Conn, host string, ctx *ProxyCtx) {
+	defer upstream.Close()
+	ctx.Logf("Streaming the MITM'd session to %s", host)
+	if err := h.HandleStream(client, upstream, ctx); err != nil {
+		ctx.Warnf("Error streaming the session to %s: %v", host, err)
+	}
+}
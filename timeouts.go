@@ -0,0 +1,227 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timeouts bounds the phases of the upstream exchanges of the requests it
+// handles, on top of the timeouts of the transport, so that the rules give
+// their own timeouts to the different destinations:
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("api.example.com:443")).Do(goproxy.Timeouts{
+//		Connect:  2 * time.Second,
+//		Response: 5 * time.Second,
+//	})
+//	proxy.OnRequest(goproxy.ReqHostIs("files.example.com:443")).Do(goproxy.Timeouts{
+//		Connect: 10 * time.Second,
+//		Total:   time.Hour,
+//	})
+//
+// The phases are timed with the httptrace events of the transport. The
+// requests timed out before their response are answered with 504 Gateway
+// Timeout, and their ProxyCtx.Error is the TimeoutError. The body of the
+// responses timed out by Total fails with the TimeoutError. Zero is
+// unlimited. The Timeouts of all the rules handling a request apply.
+type Timeouts struct {
+	// Resolve bounds the DNS lookup of the destination.
+	Resolve time.Duration
+	// Connect bounds the TCP connection to the destination, or to the
+	// upstream proxy.
+	Connect time.Duration
+	// TLS bounds the TLS handshake with the destination.
+	TLS time.Duration
+	// Response bounds the wait for the response header, once the request
+	// is sent.
+	Response time.Duration
+	// Total bounds the exchange, from the request to the end of the
+	// response body.
+	Total time.Duration
+}
+
+// The phases of the exchanges bounded by Timeouts.
+const (
+	PhaseResolve  = "resolve"
+	PhaseConnect  = "connect"
+	PhaseTLS      = "tls"
+	PhaseResponse = "response"
+	PhaseTotal    = "total"
+)
+
+// TimeoutError is the error of the exchanges timed out by Timeouts. It
+// wraps ErrDialTimeout for the phases before the request is sent, and
+// ErrResponseTimeout for the others.
+type TimeoutError struct {
+	// Phase is the phase timed out, such as PhaseConnect.
+	Phase string
+	// Timeout is the timeout of the phase.
+	Timeout time.Duration
+	// Host is the destination of the request.
+	Host string
+	// Timing is the timeline of the exchange when it timed out.
+	Timing Timing
+	// Elapsed is the duration of the exchange when it timed out.
+	Elapsed time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	t := e.Timing
+	return fmt.Sprintf("goproxy: %s timeout of %v to %s after %v (dns %v, connect %v, tls %v, ttfb %v)",
+		e.Phase, e.Timeout, e.Host, e.Elapsed.Round(time.Millisecond),
+		t.DNS().Round(time.Millisecond), t.Connect().Round(time.Millisecond),
+		t.TLS().Round(time.Millisecond), t.TTFB().Round(time.Millisecond))
+}
+
+func (e *TimeoutError) Unwrap() error {
+	switch e.Phase {
+	case PhaseResolve, PhaseConnect, PhaseTLS:
+		return ErrDialTimeout
+	}
+	return ErrResponseTimeout
+}
+
+// Handle implements ReqHandler, wrapping the RoundTripper of ctx.
+func (t Timeouts) Handle(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+	next := ctx.NextRoundTripper()
+	ctx.RoundTripper = RoundTripperFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Response, error) {
+		roundTrip := func(req *http.Request) (*http.Response, error) {
+			return next.RoundTrip(req, ctx)
+		}
+		return t.roundTrip(req, ctx, roundTrip)
+	})
+	return req, nil
+}
+
+func (t Timeouts) roundTrip(req *http.Request, ctx *ProxyCtx, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	reqCtx, cancel := context.WithCancelCause(req.Context())
+	d := &deadlines{cancel: cancel, host: req.URL.Host, begin: time.Now(), timing: ctx.timing}
+	d.start(PhaseTotal, t.Total)
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { d.start(PhaseResolve, t.Resolve) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { d.stop(PhaseResolve) },
+		ConnectStart:         func(string, string) { d.start(PhaseConnect, t.Connect) },
+		ConnectDone:          func(string, string, error) { d.stop(PhaseConnect) },
+		TLSHandshakeStart:    func() { d.start(PhaseTLS, t.TLS) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { d.stop(PhaseTLS) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { d.start(PhaseResponse, t.Response) },
+		GotFirstResponseByte: func() { d.stop(PhaseResponse) },
+	}
+	resp, err := roundTrip(req.WithContext(httptrace.WithClientTrace(reqCtx, trace)))
+	d.stop(PhaseResponse)
+	if err != nil {
+		d.done()
+		var timeout *TimeoutError
+		if !errors.As(context.Cause(reqCtx), &timeout) {
+			return nil, err
+		}
+		ctx.Error = timeout
+		ctx.Warnf("%v", timeout)
+		return NewResponse(req, ContentTypeText, http.StatusGatewayTimeout, timeout.Error()), nil
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The body of the protocol upgrades is the connection, whose type
+		// is asserted, which outlives the exchange.
+		d.stopAll()
+		return resp, nil
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		d.done()
+		return resp, nil
+	}
+	resp.Body = &deadlineBody{ReadCloser: resp.Body, deadlines: d, ctx: reqCtx}
+	return resp, nil
+}
+
+// deadlines runs the timers of the phases of an exchange, canceling it with
+// a TimeoutError when one fires.
+type deadlines struct {
+	cancel context.CancelCauseFunc
+	host   string
+	begin  time.Time
+	timing *timing
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func (d *deadlines) start(phase string, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timers == nil {
+		d.timers = make(map[string]*time.Timer)
+	}
+	if _, ok := d.timers[phase]; ok {
+		return
+	}
+	d.timers[phase] = time.AfterFunc(timeout, func() {
+		err := &TimeoutError{Phase: phase, Timeout: timeout, Host: d.host, Elapsed: time.Since(d.begin)}
+		if d.timing != nil {
+			d.timing.mu.Lock()
+			err.Timing = d.timing.t
+			d.timing.mu.Unlock()
+		}
+		d.cancel(err)
+	})
+}
+
+func (d *deadlines) stop(phase string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if timer, ok := d.timers[phase]; ok {
+		timer.Stop()
+		delete(d.timers, phase)
+	}
+}
+
+func (d *deadlines) stopAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for phase, timer := range d.timers {
+		timer.Stop()
+		delete(d.timers, phase)
+	}
+}
+
+// done ends the exchange.
+func (d *deadlines) done() {
+	d.stopAll()
+	d.cancel(nil)
+}
+
+// deadlineBody is a response body bounded by the Total timeout, failing
+// with the TimeoutError.
+type deadlineBody struct {
+	io.ReadCloser
+	deadlines *deadlines
+	ctx       context.Context
+	once      sync.Once
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.deadlines.stopAll()
+	} else if err != nil {
+		var timeout *TimeoutError
+		if errors.As(context.Cause(b.ctx), &timeout) {
+			err = timeout
+		}
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.deadlines.done)
+	return err
+}
@@ -0,0 +1,176 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timing is the timeline of an upstream exchange. The events that didn't
+// happen, such as the DNS lookup of a reused connection, are zero.
+type Timing struct {
+	Start        time.Time
+	DNSStart     time.Time
+	DNSDone      time.Time
+	ConnectStart time.Time
+	ConnectDone  time.Time
+	TLSStart     time.Time
+	TLSDone      time.Time
+	// GotConn is when the connection, new or reused, was obtained.
+	GotConn      time.Time
+	WroteRequest time.Time
+	FirstByte    time.Time
+	// BodyDone is when the response body was read entirely or closed.
+	BodyDone time.Time
+	// Reused is whether the connection was reused from a previous exchange.
+	Reused bool
+	// RemoteAddr is the address of the upstream connection, that of the
+	// upstream proxy when there is one.
+	RemoteAddr string
+}
+
+func between(from, to time.Time) time.Duration {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// DNS returns the duration of the DNS lookup.
+func (t Timing) DNS() time.Duration { return between(t.DNSStart, t.DNSDone) }
+
+// Connect returns the duration of the TCP connection.
+func (t Timing) Connect() time.Duration { return between(t.ConnectStart, t.ConnectDone) }
+
+// TLS returns the duration of the TLS handshake.
+func (t Timing) TLS() time.Duration { return between(t.TLSStart, t.TLSDone) }
+
+// RequestWrite returns the duration of the write of the request, its body
+// included.
+func (t Timing) RequestWrite() time.Duration { return between(t.GotConn, t.WroteRequest) }
+
+// TTFB returns the time to the first byte of the response, from the end of
+// the request.
+func (t Timing) TTFB() time.Duration { return between(t.WroteRequest, t.FirstByte) }
+
+// BodyTransfer returns the duration of the transfer of the response body.
+func (t Timing) BodyTransfer() time.Duration { return between(t.FirstByte, t.BodyDone) }
+
+// Total returns the duration of the exchange, until the end of the response
+// body if it is done.
+func (t Timing) Total() time.Duration {
+	if !t.BodyDone.IsZero() {
+		return between(t.Start, t.BodyDone)
+	}
+	return between(t.Start, t.FirstByte)
+}
+
+// timing records a Timing from the callbacks of httptrace, which may run on
+// other goroutines.
+type timing struct {
+	mu sync.Mutex
+	t  Timing
+}
+
+func (t *timing) set(f func(t *Timing)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.t)
+}
+
+func (t *timing) trace() *httptrace.ClientTrace {
+	now := func(field *time.Time) func() {
+		return func() {
+			t.set(func(*Timing) {
+				if field.IsZero() {
+					*field = time.Now()
+				}
+			})
+		}
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { now(&t.t.DNSStart)() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { now(&t.t.DNSDone)() },
+		ConnectStart:      func(string, string) { now(&t.t.ConnectStart)() },
+		ConnectDone:       func(string, string, error) { now(&t.t.ConnectDone)() },
+		TLSHandshakeStart: now(&t.t.TLSStart),
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { now(&t.t.TLSDone)() },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.set(func(t *Timing) {
+				t.GotConn = time.Now()
+				t.Reused = info.Reused
+				if info.Conn != nil {
+					t.RemoteAddr = info.Conn.RemoteAddr().String()
+				}
+			})
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { now(&t.t.WroteRequest)() },
+		GotFirstResponseByte: now(&t.t.FirstByte),
+	}
+}
+
+// timedBody records the end of the body of a response.
+type timedBody struct {
+	io.ReadCloser
+	timing *timing
+}
+
+func (b *timedBody) done() {
+	b.timing.set(func(t *Timing) {
+		if t.BodyDone.IsZero() {
+			t.BodyDone = time.Now()
+		}
+	})
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+// roundTripTimed sends req with RoundTrip, recording its Timing.
+func (ctx *ProxyCtx) roundTripTimed(req *http.Request, roundTrip func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	t := &timing{t: Timing{Start: time.Now()}}
+	ctx.timing = t
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.trace()))
+	resp, err := roundTrip(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	t.set(func(t *Timing) {
+		if t.FirstByte.IsZero() {
+			// Custom RoundTrippers may not report the trace events.
+			t.FirstByte = time.Now()
+		}
+	})
+	// The body of the protocol upgrades is the connection, whose type is
+	// asserted.
+	if resp.Body != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &timedBody{ReadCloser: resp.Body, timing: t}
+	}
+	return resp, nil
+}
+
+// Timing returns the timeline of the last upstream exchange of the request
+// sent by RoundTrip, nil if there is none. The events are reported by the
+// http.Transport of the proxy, or of the custom RoundTripper.
+func (ctx *ProxyCtx) Timing() *Timing {
+	if ctx.timing == nil {
+		return nil
+	}
+	ctx.timing.mu.Lock()
+	defer ctx.timing.mu.Unlock()
+	t := ctx.timing.t
+	return &t
+}
@@ -0,0 +1,83 @@
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// trailerNames returns the names of the trailers, announced in the Trailer
+// header before the body.
+func trailerNames(trailer http.Header) string {
+	names := make([]string, 0, len(trailer))
+	for k := range trailer {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// keepTrailers lets the trailers of a chunked request be forwarded, even
+// those the client didn't announce: net/http only fills the Trailer of the
+// requests once their body is read, in the map it holds at that time.
+func keepTrailers(req *http.Request) {
+	if req.Trailer == nil && req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody {
+		req.Trailer = make(http.Header)
+	}
+}
+
+// trailerReader calls f once the body it wraps is read, when its trailers
+// are known.
+type trailerReader struct {
+	io.ReadCloser
+	once sync.Once
+	f    func()
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		t.once.Do(t.f)
+	}
+	return n, err
+}
+
+// HandleTrailers returns a RespHandler calling f with the trailers of the
+// response once its body is read, before they are sent to the client. f may
+// change, add or delete them. The length of the responses is then unknown,
+// the HTTP/1.1 clients receive them chunked with their trailers, while the
+// trailers are dropped for the HTTP/1.0 clients.
+func HandleTrailers(f func(trailer http.Header, ctx *ProxyCtx)) RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+			return resp
+		}
+		if resp.Trailer == nil {
+			resp.Trailer = make(http.Header)
+		}
+		resp.Body = &trailerReader{ReadCloser: resp.Body, f: func() { f(resp.Trailer, ctx) }}
+		return resp
+	})
+}
+
+// HandleRequestTrailers returns a ReqHandler calling f with the trailers of
+// the request once its body is read, before they are sent upstream. f may
+// change, add or delete them. The requests with a body are then sent
+// chunked, to carry the trailers.
+func HandleRequestTrailers(f func(trailer http.Header, ctx *ProxyCtx)) ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		if req.Body == nil || req.Body == http.NoBody {
+			return req, nil
+		}
+		if req.Trailer == nil {
+			req.Trailer = make(http.Header)
+		}
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		req.Body = &trailerReader{ReadCloser: req.Body, f: func() { f(req.Trailer, ctx) }}
+		return req, nil
+	})
+}
@@ -0,0 +1,219 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// UAClass is the class of the client of a User-Agent.
+type UAClass int
+
+const (
+	UAUnknown UAClass = iota
+	// UABrowser is a web browser.
+	UABrowser
+	// UABot is a crawler, or a link preview fetcher.
+	UABot
+	// UATool is a command line tool or an HTTP library, such as curl or
+	// python-requests.
+	UATool
+)
+
+func (c UAClass) String() string {
+	switch c {
+	case UABrowser:
+		return "browser"
+	case UABot:
+		return "bot"
+	case UATool:
+		return "tool"
+	}
+	return "unknown"
+}
+
+// UserAgent is a parsed User-Agent.
+type UserAgent struct {
+	Class UAClass
+	// Name is the name of the browser, bot or tool, such as Chrome,
+	// Googlebot or curl.
+	Name    string
+	Version string
+	// OS is the operating system of the browsers: Windows, macOS, iOS,
+	// Android, ChromeOS or Linux.
+	OS string
+}
+
+// The tools, by prefix of their User-Agent.
+var uaTools = []struct{ prefix, name string }{
+	{"curl/", "curl"},
+	{"wget/", "Wget"},
+	{"python-requests/", "python-requests"},
+	{"python-urllib/", "Python-urllib"},
+	{"python-httpx/", "python-httpx"},
+	{"aiohttp/", "aiohttp"},
+	{"go-http-client/", "Go-http-client"},
+	{"okhttp/", "okhttp"},
+	{"axios/", "axios"},
+	{"node-fetch/", "node-fetch"},
+	{"undici", "undici"},
+	{"java/", "Java"},
+	{"apache-httpclient/", "Apache-HttpClient"},
+	{"libwww-perl/", "libwww-perl"},
+	{"postmanruntime/", "PostmanRuntime"},
+	{"httpie/", "HTTPie"},
+	{"powershell/", "PowerShell"},
+}
+
+// The bots, by token of their User-Agent.
+var uaBots = []string{
+	"Googlebot", "bingbot", "DuckDuckBot", "Baiduspider", "YandexBot",
+	"Applebot", "facebookexternalhit", "Twitterbot", "Slackbot", "LinkedInBot",
+	"AhrefsBot", "SemrushBot", "GPTBot",
+}
+
+// The browsers, by token of their User-Agent, the more specific first:
+// Edge and Opera claim to be Chrome, which claims to be Safari.
+var uaBrowsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"},
+}
+
+// The operating systems, by token of the User-Agent, iOS and Android before
+// macOS and Linux which they claim to be.
+var uaOSes = []struct{ token, name string }{
+	{"Windows NT", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// uaVersion returns the version following the token in ua.
+func uaVersion(ua string, i int) string {
+	v := ua[i:]
+	if end := strings.IndexAny(v, " ;)"); end >= 0 {
+		v = v[:end]
+	}
+	return v
+}
+
+// ParseUserAgent parses ua. The User-Agents declaring a crawler, bot or
+// spider are bots, and those not starting with Mozilla/ aren't browsers.
+func ParseUserAgent(ua string) UserAgent {
+	lower := strings.ToLower(ua)
+	for _, t := range uaTools {
+		if strings.HasPrefix(lower, t.prefix) {
+			return UserAgent{Class: UATool, Name: t.name, Version: uaVersion(ua, len(t.prefix))}
+		}
+	}
+	for _, b := range uaBots {
+		if i := strings.Index(lower, strings.ToLower(b)); i >= 0 {
+			var v string
+			if rest := ua[i+len(b):]; strings.HasPrefix(rest, "/") {
+				v = uaVersion(ua, i+len(b)+1)
+			}
+			return UserAgent{Class: UABot, Name: b, Version: v}
+		}
+	}
+	if strings.Contains(lower, "bot") || strings.Contains(lower, "crawler") || strings.Contains(lower, "spider") {
+		return UserAgent{Class: UABot}
+	}
+	if !strings.HasPrefix(ua, "Mozilla/") {
+		return UserAgent{}
+	}
+	parsed := UserAgent{}
+	for _, o := range uaOSes {
+		if strings.Contains(ua, o.token) {
+			parsed.OS = o.name
+			break
+		}
+	}
+	for _, b := range uaBrowsers {
+		i := strings.Index(ua, b.token)
+		if i < 0 || b.name == "Safari" && !strings.Contains(ua, "Safari/") {
+			continue
+		}
+		parsed.Class, parsed.Name, parsed.Version = UABrowser, b.name, uaVersion(ua, i+len(b.token))
+		break
+	}
+	return parsed
+}
+
+// UserAgent returns the parsed User-Agent of the request.
+func (ctx *ProxyCtx) UserAgent() UserAgent {
+	if ctx.Req == nil {
+		return UserAgent{}
+	}
+	return ParseUserAgent(ctx.Req.UserAgent())
+}
+
+// UserAgentIs returns a ReqCondition testing whether the User-Agent of the
+// request is of one of classes, for instance to block the tools but allow
+// the browsers to a host:
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("www.example.com"), goproxy.UserAgentIs(goproxy.UATool)).DoFunc(block)
+func UserAgentIs(classes ...UAClass) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		class := ParseUserAgent(req.UserAgent()).Class
+		for _, c := range classes {
+			if c == class {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// UserAgentNameIs returns a ReqCondition testing whether the User-Agent of
+// the request is of a browser, bot or tool named one of names, such as
+// "curl" or "Firefox".
+func UserAgentNameIs(names ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		name := ParseUserAgent(req.UserAgent()).Name
+		for _, n := range names {
+			if name != "" && strings.EqualFold(n, name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ClientFingerprints maps the JA4 fingerprints of the TLS clients to their
+// class, to classify the clients whatever User-Agent they send, such as the
+// tools claiming to be a browser.
+type ClientFingerprints map[string]UAClass
+
+// Class returns the class of the client of ctx: that of the fingerprint of
+// its TLS client hello when known, that of its User-Agent otherwise.
+func (f ClientFingerprints) Class(ctx *ProxyCtx) UAClass {
+	if fp := ctx.ClientFingerprint(); fp != nil {
+		if class, ok := f[fp.JA4]; ok {
+			return class
+		}
+	}
+	return ctx.UserAgent().Class
+}
+
+// ClientIs returns a ReqCondition testing whether the class of the client
+// of the request is one of classes.
+func (f ClientFingerprints) ClientIs(classes ...UAClass) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		class := f.Class(ctx)
+		for _, c := range classes {
+			if c == class {
+				return true
+			}
+		}
+		return false
+	}
+}
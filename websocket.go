@@ -1,6 +1,10 @@
 package goproxy
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -38,6 +42,10 @@ func (proxy *ProxyHttpServer) hijackConnection(ctx *ProxyCtx, w http.ResponseWri
 }
 
 func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, remoteConn io.ReadWriter, proxyClient io.ReadWriter) {
+	if ctx.WebSocketHandler != nil {
+		proxy.proxyWebsocketFrames(ctx, remoteConn, proxyClient)
+		return
+	}
 	// 2 is the number of goroutines, this code is implemented according to
 	// https://stackoverflow.com/questions/52031332/wait-for-one-goroutine-to-finish
 	waitChan := make(chan struct{}, 2)
@@ -54,3 +62,164 @@ func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, remoteConn io.ReadWr
 	// Wait until one end closes the connection
 	<-waitChan
 }
+
+// The opcodes of the WebSocket frames.
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xa
+)
+
+// maxWebSocketFrame bounds the frames read for a WebSocketHandler.
+const maxWebSocketFrame = 64 << 20
+
+var errWebSocketFrameTooLarge = errors.New("websocket frame too large")
+
+// WebSocketFrame is a frame of a WebSocket connection, with its payload
+// unmasked.
+type WebSocketFrame struct {
+	Fin bool
+	// Rsv holds the RSV1, RSV2 and RSV3 bits, as the lower bits.
+	Rsv     byte
+	Opcode  byte
+	Payload []byte
+	// FromClient is whether the frame is sent by the client.
+	FromClient bool
+}
+
+// WebSocketHandler handles the frames of a WebSocket connection relayed by
+// the proxy. It returns the frame to relay, f possibly modified, or nil to
+// drop it. The frames of each direction are handled in order, the two
+// directions concurrently.
+type WebSocketHandler interface {
+	HandleFrame(f *WebSocketFrame, ctx *ProxyCtx) *WebSocketFrame
+}
+
+// FuncWebSocketHandler is a WebSocketHandler function.
+type FuncWebSocketHandler func(f *WebSocketFrame, ctx *ProxyCtx) *WebSocketFrame
+
+// HandleFrame implements WebSocketHandler.
+func (h FuncWebSocketHandler) HandleFrame(f *WebSocketFrame, ctx *ProxyCtx) *WebSocketFrame {
+	return h(f, ctx)
+}
+
+// readWebSocketFrame reads a frame, unmasking its payload.
+func readWebSocketFrame(r *bufio.Reader) (*WebSocketFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &WebSocketFrame{Fin: head[0]&0x80 != 0, Rsv: head[0] >> 4 & 0x7, Opcode: head[0] & 0xf}
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketFrame {
+		return nil, errWebSocketFrameTooLarge
+	}
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range f.Payload {
+			f.Payload[i] ^= key[i%4]
+		}
+	}
+	return f, nil
+}
+
+// writeWebSocketFrame writes f, masked with a new key when mask is set, as
+// the frames of the clients must be.
+func writeWebSocketFrame(w io.Writer, f *WebSocketFrame, mask bool) error {
+	b := make([]byte, 0, 14+len(f.Payload))
+	first := f.Rsv&0x7<<4 | f.Opcode&0xf
+	if f.Fin {
+		first |= 0x80
+	}
+	b = append(b, first)
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch n := len(f.Payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xffff:
+		b = append(b, maskBit|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, maskBit|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if !mask {
+		b = append(b, f.Payload...)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		b = append(b, key[:]...)
+		for i, c := range f.Payload {
+			b = append(b, c^key[i%4])
+		}
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// proxyWebsocketFrames relays the frames of a WebSocket connection through
+// ctx.WebSocketHandler.
+func (proxy *ProxyHttpServer) proxyWebsocketFrames(ctx *ProxyCtx, remoteConn io.ReadWriter, proxyClient io.ReadWriter) {
+	relay := func(dst io.Writer, src io.Reader, fromClient bool) {
+		r := bufio.NewReader(src)
+		for {
+			f, err := readWebSocketFrame(r)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					ctx.Warnf("Error reading websocket frame: %v", err)
+				}
+				return
+			}
+			f.FromClient = fromClient
+			if f = ctx.WebSocketHandler.HandleFrame(f, ctx); f == nil {
+				continue
+			}
+			if err := writeWebSocketFrame(dst, f, fromClient); err != nil {
+				ctx.Warnf("Error writing websocket frame: %v", err)
+				return
+			}
+		}
+	}
+	waitChan := make(chan struct{}, 2)
+	go func() {
+		relay(remoteConn, proxyClient, true)
+		waitChan <- struct{}{}
+	}()
+	go func() {
+		relay(proxyClient, remoteConn, false)
+		waitChan <- struct{}{}
+	}()
+	// Wait until one end closes the connection
+	<-waitChan
+}